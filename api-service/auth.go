@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// apiKeyHeader carries the caller's API key
+	apiKeyHeader = "X-API-Key"
+	// apiKeyHashPrefix marks the hash of an API key in the key config
+	apiKeyHashPrefix = "sha256:"
+	// defaultAuthReload is how often the key config is reloaded
+	defaultAuthReload = 30 * time.Second
+	// callerHeader and sourceHeader name the caller and client address of
+	// the RPCs a request makes, for the KV service's audit log
+	callerHeader = "x-kv-caller"
+	sourceHeader = "x-forwarded-for"
+
+	// principalKey is where the middleware leaves the caller in the gin
+	// context
+	principalKey = "principal"
+)
+
+// permission is what a rule allows on the keys it covers
+type permission string
+
+const (
+	permRead   permission = "read"
+	permWrite  permission = "write"
+	permDelete permission = "delete"
+)
+
+// authRule grants permissions on the keys of a namespace that start with a
+// prefix. A namespace of "" is the default namespace and "*" is every
+// namespace.
+type authRule struct {
+	Namespace   string       `json:"namespace,omitempty"`
+	Prefix      string       `json:"prefix"`
+	Permissions []permission `json:"permissions"`
+}
+
+// covers reports whether the rule grants perm on every key of ns that starts
+// with prefix, which is a single key for requests on one key
+func (r authRule) covers(ns, prefix string, perm permission) bool {
+	if r.Namespace != "*" && normalizeNamespace(r.Namespace) != normalizeNamespace(ns) {
+		return false
+	}
+	if !strings.HasPrefix(prefix, r.Prefix) {
+		return false
+	}
+	for _, p := range r.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeNamespace(ns string) string {
+	if ns == "" {
+		return "default"
+	}
+	return ns
+}
+
+// authConfig is the key config document: API keys, identified by the SHA-256
+// of the key, and the roles they hold
+type authConfig struct {
+	Keys []struct {
+		Name  string   `json:"name"`
+		Hash  string   `json:"hash"`
+		Roles []string `json:"roles"`
+	} `json:"keys"`
+	Roles map[string][]authRule `json:"roles"`
+}
+
+// principal is an authenticated caller and the rules of every role it holds
+type principal struct {
+	name  string
+	rules []authRule
+}
+
+// allows reports whether p may use perm on every key of ns starting with
+// prefix
+func (p *principal) allows(ns, prefix string, perm permission) bool {
+	for _, r := range p.rules {
+		if r.covers(ns, prefix, perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAuthConfig checks a key config document and indexes its keys by hash
+func parseAuthConfig(data []byte) (map[string]*principal, error) {
+	var cfg authConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid key config: %w", err)
+	}
+	for role, rules := range cfg.Roles {
+		if err := checkRules(rules); err != nil {
+			return nil, fmt.Errorf("role %s: %w", role, err)
+		}
+	}
+
+	keys := make(map[string]*principal)
+	for i, k := range cfg.Keys {
+		if k.Name == "" {
+			return nil, fmt.Errorf("key %d has no name", i)
+		}
+		hash, ok := strings.CutPrefix(k.Hash, apiKeyHashPrefix)
+		if decoded, err := hex.DecodeString(hash); !ok || err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("key %s: hash must be %s followed by a hex SHA-256", k.Name, apiKeyHashPrefix)
+		}
+		hash = strings.ToLower(hash)
+		if _, dup := keys[hash]; dup {
+			return nil, fmt.Errorf("key %s: the same key is listed twice", k.Name)
+		}
+		p := &principal{name: k.Name}
+		for _, role := range k.Roles {
+			rules, ok := cfg.Roles[role]
+			if !ok {
+				return nil, fmt.Errorf("key %s: unknown role %s", k.Name, role)
+			}
+			p.rules = append(p.rules, rules...)
+		}
+		keys[hash] = p
+	}
+	return keys, nil
+}
+
+// checkRules refuses rules that grant unknown permissions
+func checkRules(rules []authRule) error {
+	for _, r := range rules {
+		for _, p := range r.Permissions {
+			if p != permRead && p != permWrite && p != permDelete {
+				return fmt.Errorf("unknown permission %q", p)
+			}
+		}
+	}
+	return nil
+}
+
+// hashAPIKey returns the hex SHA-256 that identifies an API key. Keys are
+// random tokens rather than passwords, so a fast hash is enough to keep the
+// config from revealing them.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeys authenticates callers by API key against a key config that is
+// reloaded periodically, so keys can be added and revoked without a restart
+type apiKeys struct {
+	load func(ctx context.Context) ([]byte, error)
+	// reserved is the namespace holding the key config when it is kept in
+	// the store, which REST requests may not touch
+	reserved string
+
+	mu     sync.RWMutex
+	keys   map[string]*principal // nil until a config has loaded
+	loaded []byte
+}
+
+// reload fetches the key config and swaps it in if it changed. A config that
+// fails to load or parse leaves the previous one in place.
+func (a *apiKeys) reload(ctx context.Context) error {
+	data, err := a.load(ctx)
+	if err != nil {
+		return err
+	}
+	a.mu.RLock()
+	same := a.keys != nil && bytes.Equal(data, a.loaded)
+	a.mu.RUnlock()
+	if same {
+		return nil
+	}
+	keys, err := parseAuthConfig(data)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.keys, a.loaded = keys, data
+	a.mu.Unlock()
+	log.Printf("Loaded %d API keys", len(keys))
+	return nil
+}
+
+// reloadEvery calls reload every interval until ctx is done, logging
+// failures to reload what
+func reloadEvery(ctx context.Context, interval time.Duration, what string, reload func(context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			if err := reload(rctx); err != nil {
+				log.Printf("Failed to reload %s: %v", what, err)
+			}
+			cancel()
+		}
+	}
+}
+
+// lookup returns the caller holding key, or nil. ready is false until a key
+// config has loaded.
+func (a *apiKeys) lookup(key string) (p *principal, ready bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.keys == nil {
+		return nil, false
+	}
+	return a.keys[hashAPIKey(key)], true
+}
+
+// fileKeys loads a key config, or a JWKS, from a file
+func fileKeys(path string) func(ctx context.Context) ([]byte, error) {
+	return func(ctx context.Context) ([]byte, error) {
+		return os.ReadFile(path)
+	}
+}
+
+// storeKeys loads the key config from a key of a namespace in the store
+func (s *APIServer) storeKeys(ns, key string) func(ctx context.Context) ([]byte, error) {
+	return func(ctx context.Context) ([]byte, error) {
+		resp, err := s.clientFor(key).Get(ctx, &pb.GetRequest{Namespace: ns, Key: key})
+		if err != nil {
+			return nil, err
+		}
+		if !resp.Found {
+			return nil, fmt.Errorf("key %s/%s not found", ns, key)
+		}
+		return resp.ValueBytes, nil
+	}
+}
+
+// configureAuth turns on API key authentication if API_KEYS_FILE names a key
+// config file or API_KEYS_STORE names a namespace/key in the store holding
+// one. The config is reloaded every API_KEYS_RELOAD.
+func (s *APIServer) configureAuth(ctx context.Context) error {
+	file, store := os.Getenv("API_KEYS_FILE"), os.Getenv("API_KEYS_STORE")
+	switch {
+	case file != "" && store != "":
+		return fmt.Errorf("API_KEYS_FILE and API_KEYS_STORE are mutually exclusive")
+	case file != "":
+		s.auth = &apiKeys{load: fileKeys(file)}
+	case store != "":
+		ns, key, ok := strings.Cut(store, "/")
+		if !ok || key == "" || normalizeNamespace(ns) == "default" {
+			return fmt.Errorf("API_KEYS_STORE must be a namespace other than default and a key, as namespace/key")
+		}
+		s.auth = &apiKeys{load: s.storeKeys(ns, key), reserved: ns}
+	default:
+		return nil
+	}
+
+	interval := defaultAuthReload
+	if v := os.Getenv("API_KEYS_RELOAD"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid API_KEYS_RELOAD %q", v)
+		}
+		interval = d
+	}
+	// Until a config loads, requests are refused rather than let through
+	lctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := s.auth.reload(lctx); err != nil {
+		log.Printf("Failed to load API keys, retrying every %s: %v", interval, err)
+	}
+	go reloadEvery(ctx, interval, "API keys", s.auth.reload)
+	return nil
+}
+
+// authEnabled reports whether callers have to identify themselves
+func (s *APIServer) authEnabled() bool {
+	return s.auth != nil || s.jwt != nil
+}
+
+// Authenticate is middleware that identifies the caller by a bearer token in
+// the Authorization header or an API key in the X-API-Key header, and refuses
+// the request with 401 Unauthorized if neither is given or valid. It lets
+// every request through when authentication is off. Handlers check what the
+// caller may do with authorize.
+func (s *APIServer) Authenticate(c *gin.Context) {
+	if !s.authEnabled() {
+		c.Next()
+		return
+	}
+	var p *principal
+	if token, ok := bearerToken(c); ok && s.jwt != nil {
+		var err error
+		p, err = s.jwt.verify(c.Request.Context(), token)
+		switch {
+		case errors.Is(err, errJWKSNotLoaded):
+			notReady(c, "Signing keys are not loaded yet")
+			return
+		case err != nil:
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token", error_description="`+strings.ReplaceAll(err.Error(), `"`, `'`)+`"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid bearer token: " + err.Error()})
+			return
+		}
+	} else if key := c.GetHeader(apiKeyHeader); key != "" && s.auth != nil {
+		var ready bool
+		p, ready = s.auth.lookup(key)
+		if !ready {
+			notReady(c, "API keys are not loaded yet")
+			return
+		}
+		if p == nil {
+			s.unauthorized(c, "Invalid API key")
+			return
+		}
+	} else {
+		s.unauthorized(c, "Missing credentials")
+		return
+	}
+	c.Set(principalKey, p)
+	c.Next()
+}
+
+// bearerToken returns the token of an Authorization: Bearer header
+func bearerToken(c *gin.Context) (string, bool) {
+	scheme, token, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// unauthorized refuses a request that carries no valid credentials, naming
+// the schemes it could have used
+func (s *APIServer) unauthorized(c *gin.Context, msg string) {
+	if s.jwt != nil {
+		c.Header("WWW-Authenticate", "Bearer")
+	}
+	if s.auth != nil {
+		c.Writer.Header().Add("WWW-Authenticate", `ApiKey header="`+apiKeyHeader+`"`)
+	}
+	c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: msg})
+}
+
+func notReady(c *gin.Context, msg string) {
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, ErrorResponse{Error: msg})
+}
+
+// authorize reports whether the caller may use perm on each of keys in ns,
+// where a key stands for every key it is a prefix of in listings and prefix
+// watches. Otherwise it refuses the request with 403 Forbidden.
+func (s *APIServer) authorize(c *gin.Context, ns string, perm permission, keys ...string) bool {
+	if !s.authEnabled() {
+		return true
+	}
+	if s.auth != nil && s.auth.reserved != "" && normalizeNamespace(ns) == s.auth.reserved {
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{
+			Error: fmt.Sprintf("Namespace '%s' holds the API keys and can't be used through the REST API", ns),
+		})
+		return false
+	}
+	v, _ := c.Get(principalKey)
+	p, _ := v.(*principal)
+	for _, key := range keys {
+		if p == nil || !p.allows(ns, key, perm) {
+			name := "anonymous"
+			if p != nil {
+				name = p.name
+			}
+			c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{
+				Error: fmt.Sprintf("'%s' may not %s '%s' in namespace '%s'", name, perm, key, normalizeNamespace(ns)),
+			})
+			return false
+		}
+	}
+	return true
+}
+
+// callContext returns parent carrying the caller of c, if it authenticated,
+// and its address in the metadata of the RPCs made with it
+func callContext(parent context.Context, c *gin.Context) context.Context {
+	md := metadata.Pairs(sourceHeader, c.ClientIP())
+	if v, ok := c.Get(principalKey); ok {
+		if p, _ := v.(*principal); p != nil {
+			md.Set(callerHeader, p.name)
+		}
+	}
+	return metadata.NewOutgoingContext(parent, md)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// testKeyConfig gives "reader" read access to everything in the default
+// namespace and "writer" full access to app- in team-a
+func testKeyConfig(t *testing.T) []byte {
+	t.Helper()
+	return []byte(fmt.Sprintf(`{
+		"keys": [
+			{"name": "reader", "hash": "sha256:%s", "roles": ["read-all"]},
+			{"name": "writer", "hash": "sha256:%s", "roles": ["app-owner"]}
+		],
+		"roles": {
+			"read-all": [{"prefix": "", "permissions": ["read"]}],
+			"app-owner": [{"namespace": "team-a", "prefix": "app-", "permissions": ["read", "write", "delete"]}]
+		}
+	}`, hashAPIKey("reader-key"), hashAPIKey("writer-key")))
+}
+
+func newAuthServer(t *testing.T, client pb.KVStoreClient) (*APIServer, *gin.Engine) {
+	t.Helper()
+	config := testKeyConfig(t)
+	apiServer := NewAPIServer(client)
+	apiServer.auth = &apiKeys{load: func(ctx context.Context) ([]byte, error) { return config, nil }}
+	if err := apiServer.auth.reload(context.Background()); err != nil {
+		t.Fatalf("reload() error = %v", err)
+	}
+	return apiServer, setupRouter(apiServer)
+}
+
+func serveAs(router http.Handler, apiKey, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set(apiKeyHeader, apiKey)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAuthenticate(t *testing.T) {
+	_, router := newAuthServer(t, &mockKVClient{})
+
+	tests := []struct {
+		name, apiKey string
+		code         int
+	}{
+		{"missing key", "", http.StatusUnauthorized},
+		{"unknown key", "guess", http.StatusUnauthorized},
+		{"valid key", "reader-key", http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := serveAs(router, tt.apiKey, http.MethodGet, "/kv/k", "")
+		if w.Code != tt.code {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.code, w.Code)
+		}
+		if tt.code == http.StatusUnauthorized {
+			var resp ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Error == "" {
+				t.Errorf("%s: expected an ErrorResponse, got %s", tt.name, w.Body)
+			}
+			if w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("%s: expected a WWW-Authenticate header", tt.name)
+			}
+		}
+	}
+
+	// Until a config loads, nothing gets through
+	apiServer := NewAPIServer(&mockKVClient{})
+	apiServer.auth = &apiKeys{}
+	w := serveAs(setupRouter(apiServer), "reader-key", http.MethodGet, "/kv/k", "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d before the keys load, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+func TestAuthorizePrefixRules(t *testing.T) {
+	_, router := newAuthServer(t, &mockKVClient{})
+
+	tests := []struct {
+		apiKey, method, path, body string
+		code                       int
+	}{
+		{"reader-key", http.MethodGet, "/kv/anything", "", http.StatusOK},
+		{"reader-key", http.MethodGet, "/kv?prefix=a", "", http.StatusOK},
+		{"reader-key", http.MethodPut, "/kv/anything", `{"value": "v"}`, http.StatusForbidden},
+		{"reader-key", http.MethodDelete, "/kv/anything", "", http.StatusForbidden},
+		{"reader-key", http.MethodGet, "/ns/team-a/kv/app-x", "", http.StatusForbidden},
+		{"writer-key", http.MethodPut, "/ns/team-a/kv/app-x", `{"value": "v"}`, http.StatusOK},
+		{"writer-key", http.MethodDelete, "/ns/team-a/kv/app-x", "", http.StatusOK},
+		{"writer-key", http.MethodPut, "/ns/team-a/kv/other", `{"value": "v"}`, http.StatusForbidden},
+		{"writer-key", http.MethodPut, "/kv/app-x", `{"value": "v"}`, http.StatusForbidden},
+		{"writer-key", http.MethodGet, "/ns/team-a/kv?prefix=app-", "", http.StatusOK},
+		// A listing wider than the rule's prefix would reveal other keys
+		{"writer-key", http.MethodGet, "/ns/team-a/kv", "", http.StatusForbidden},
+		{"writer-key", http.MethodPost, "/ns/team-a/kv/batch", `{"op": "delete", "items": [{"key": "app-a"}, {"key": "app-b"}]}`, http.StatusOK},
+		{"writer-key", http.MethodPost, "/ns/team-a/kv/batch", `{"op": "set", "items": [{"key": "app-a", "value": "v"}, {"key": "b", "value": "v"}]}`, http.StatusForbidden},
+		{"reader-key", http.MethodPost, "/kv/batch", `{"op": "get", "items": [{"key": "a"}]}`, http.StatusOK},
+		{"reader-key", http.MethodPost, "/kv/txn", `{"compare": [{"key": "a", "target": "version", "result": "equal", "version": 1}], "success": [{"op": "get", "key": "a"}]}`, http.StatusOK},
+		{"reader-key", http.MethodPost, "/kv/txn", `{"success": [{"op": "get", "key": "a"}], "failure": [{"op": "delete", "key": "a"}]}`, http.StatusForbidden},
+		{"reader-key", http.MethodPost, "/kv", `{"key": "a", "value": "v"}`, http.StatusForbidden},
+		{"reader-key", http.MethodPut, "/kv/a/ttl", `{"ttl_seconds": 5}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := serveAs(router, tt.apiKey, tt.method, tt.path, tt.body)
+		if w.Code != tt.code {
+			t.Errorf("%s %s as %s: expected status %d, got %d: %s", tt.method, tt.path, tt.apiKey, tt.code, w.Code, w.Body)
+		}
+		if tt.code == http.StatusForbidden {
+			var resp ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || !strings.Contains(resp.Error, "may not") {
+				t.Errorf("%s %s: expected an ErrorResponse naming the denied permission, got %s", tt.method, tt.path, w.Body)
+			}
+		}
+	}
+}
+
+func TestParseAuthConfigRejectsMistakes(t *testing.T) {
+	hash := "sha256:" + hashAPIKey("k")
+	tests := map[string]string{
+		"unknown role":       `{"keys": [{"name": "a", "hash": "` + hash + `", "roles": ["missing"]}]}`,
+		"unknown permission": `{"keys": [], "roles": {"r": [{"prefix": "", "permissions": ["admin"]}]}}`,
+		"plain key":          `{"keys": [{"name": "a", "hash": "k"}]}`,
+		"duplicate key":      `{"keys": [{"name": "a", "hash": "` + hash + `"}, {"name": "b", "hash": "` + hash + `"}]}`,
+		"unknown field":      `{"keys": [], "users": []}`,
+	}
+	for name, config := range tests {
+		if _, err := parseAuthConfig([]byte(config)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestAuthConfigReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, testKeyConfig(t), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	apiServer := NewAPIServer(&mockKVClient{})
+	apiServer.auth = &apiKeys{load: fileKeys(path)}
+	if err := apiServer.auth.reload(context.Background()); err != nil {
+		t.Fatalf("reload() error = %v", err)
+	}
+	router := setupRouter(apiServer)
+	if w := serveAs(router, "writer-key", http.MethodGet, "/ns/team-a/kv/app-x", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	// Revoking a key takes effect on the next reload, and a broken config
+	// keeps the last good one
+	os.WriteFile(path, []byte(`{"keys": []}`), 0o600)
+	apiServer.auth.reload(context.Background())
+	if w := serveAs(router, "writer-key", http.MethodGet, "/ns/team-a/kv/app-x", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for a revoked key, got %d", http.StatusUnauthorized, w.Code)
+	}
+	os.WriteFile(path, []byte(`{`), 0o600)
+	if err := apiServer.auth.reload(context.Background()); err == nil {
+		t.Errorf("Expected reload() of a broken config to fail")
+	}
+	if w := serveAs(router, "reader-key", http.MethodGet, "/kv/k", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the last good config to stay in place, got status %d", w.Code)
+	}
+}
+
+func TestAuthConfigFromStore(t *testing.T) {
+	config := testKeyConfig(t)
+	mockClient := &mockKVClient{
+		getFunc: func(ctx context.Context, req *pb.GetRequest, opts ...grpc.CallOption) (*pb.GetResponse, error) {
+			if req.Namespace == "auth" && req.Key == "api-keys" {
+				return &pb.GetResponse{Found: true, ValueBytes: config, Version: 1}, nil
+			}
+			return &pb.GetResponse{Found: true, Value: "v", Version: 1}, nil
+		},
+	}
+	t.Setenv("API_KEYS_STORE", "auth/api-keys")
+	apiServer := NewAPIServer(mockClient)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := apiServer.configureAuth(ctx); err != nil {
+		t.Fatalf("configureAuth() error = %v", err)
+	}
+	router := setupRouter(apiServer)
+
+	if w := serveAs(router, "reader-key", http.MethodGet, "/kv/k", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	// Nobody may reach the key config through the REST API
+	apiServer.auth.keys[hashAPIKey("reader-key")].rules = []authRule{{Namespace: "*", Permissions: []permission{permRead, permWrite}}}
+	if w := serveAs(router, "reader-key", http.MethodGet, "/ns/auth/kv/api-keys", ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d for the key config, got %d", http.StatusForbidden, w.Code)
+	}
+
+	// A sharded gateway reads the config from the shard that owns its key
+	sharded, fc := newShardedServer(t, 3)
+	fc.shard(sharded.ring.owner("api-keys")).store[storedKey("auth", "api-keys")] = string(config)
+	if err := sharded.configureAuth(ctx); err != nil {
+		t.Fatalf("configureAuth() on shards error = %v", err)
+	}
+	if w := serveAs(setupRouter(sharded), "reader-key", http.MethodGet, "/kv/k", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d from the shards, got %d", http.StatusNotFound, w.Code)
+	}
+
+	t.Setenv("API_KEYS_STORE", "default/api-keys")
+	if err := NewAPIServer(mockClient).configureAuth(ctx); err == nil {
+		t.Errorf("Expected configureAuth() to refuse keys in the default namespace")
+	}
+}
+
+func TestCallerForwardedToKVService(t *testing.T) {
+	var md metadata.MD
+	mockClient := &mockKVClient{
+		setFunc: func(ctx context.Context, req *pb.SetRequest, opts ...grpc.CallOption) (*pb.SetResponse, error) {
+			md, _ = metadata.FromOutgoingContext(ctx)
+			return &pb.SetResponse{Success: true, Version: 1}, nil
+		},
+	}
+	_, router := newAuthServer(t, mockClient)
+	req := httptest.NewRequest(http.MethodPut, "/ns/team-a/kv/app-x", strings.NewReader(`{"value": "v"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(apiKeyHeader, "writer-key")
+	req.RemoteAddr = "203.0.113.7:40000"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if got := md.Get(callerHeader); len(got) != 1 || got[0] != "writer" {
+		t.Errorf("Expected the caller to be forwarded, got %v", got)
+	}
+	if got := md.Get(sourceHeader); len(got) != 1 || got[0] != "203.0.113.7" {
+		t.Errorf("Expected the client address to be forwarded, got %v", got)
+	}
+
+	// Without authentication only the address is known
+	router = setupRouter(NewAPIServer(mockClient))
+	serveAs(router, "", http.MethodPut, "/kv/k", `{"value": "v"}`)
+	if got := md.Get(callerHeader); len(got) != 0 {
+		t.Errorf("Expected no caller without authentication, got %v", got)
+	}
+}
+
+func TestForwardedForOnlyTrustedFromProxies(t *testing.T) {
+	var md metadata.MD
+	mockClient := &mockKVClient{
+		setFunc: func(ctx context.Context, req *pb.SetRequest, opts ...grpc.CallOption) (*pb.SetResponse, error) {
+			md, _ = metadata.FromOutgoingContext(ctx)
+			return &pb.SetResponse{Success: true, Version: 1}, nil
+		},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tt := range []struct {
+		proxies string
+		want    string
+	}{
+		{"", "203.0.113.7"},
+		{"198.51.100.0/24", "203.0.113.7"},
+		{"203.0.113.7, 198.51.100.0/24", "192.0.2.1"},
+	} {
+		router, err := newRouter(tt.proxies)
+		if err != nil {
+			t.Fatalf("newRouter(%q) error = %v", tt.proxies, err)
+		}
+		registerKVRoutes(router, NewAPIServer(mockClient))
+		req := httptest.NewRequest(http.MethodPut, "/kv/k", strings.NewReader(`{"value": "v"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		req.RemoteAddr = "203.0.113.7:40000"
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		if got := md.Get(sourceHeader); len(got) != 1 || got[0] != tt.want {
+			t.Errorf("With trusted proxies %q, expected the client address %s, got %v", tt.proxies, tt.want, got)
+		}
+	}
+	if _, err := newRouter("not-an-address"); err == nil {
+		t.Errorf("Expected newRouter() to refuse an invalid proxy")
+	}
+}
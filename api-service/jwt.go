@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultJWKSRefresh is how often the signing keys are fetched again
+	defaultJWKSRefresh = 5 * time.Minute
+	// jwksMinRefresh is the least time between fetches prompted by tokens
+	// signed with an unknown key, so such tokens can't hammer the source
+	jwksMinRefresh = 30 * time.Second
+	// jwtLeeway absorbs clock skew between the issuer and the gateway
+	jwtLeeway = 30 * time.Second
+	// defaultPermissionsClaim holds a token's rules, in the form of the
+	// rules of an API key role
+	defaultPermissionsClaim = "kv_permissions"
+)
+
+var (
+	// errUnknownSigningKey is returned for a token whose signing key is not
+	// in the key set, even after fetching it again
+	errUnknownSigningKey = errors.New("unknown signing key")
+	// errJWKSNotLoaded is returned until a key set has loaded
+	errJWKSNotLoaded = errors.New("signing keys are not loaded")
+)
+
+// jwtAlgs maps the JWS algorithms that are accepted to their hash and the key
+// type they need. "none" and the HMAC algorithms are refused, since they
+// would let anyone holding the public keys mint tokens.
+var jwtAlgs = map[string]struct {
+	hash crypto.Hash
+	kty  string
+}{
+	"RS256": {crypto.SHA256, "RSA"},
+	"RS384": {crypto.SHA384, "RSA"},
+	"RS512": {crypto.SHA512, "RSA"},
+	"ES256": {crypto.SHA256, "EC"},
+	"ES384": {crypto.SHA384, "EC"},
+	"ES512": {crypto.SHA512, "EC"},
+}
+
+// jwk is a key of a JSON Web Key Set, as far as verifying signatures needs
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// signingKey is a public key from the key set
+type signingKey struct {
+	kty string
+	alg string // "" accepts any algorithm for the key type
+	key crypto.PublicKey
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid base64url integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// publicKey converts a JWK to the public key it describes
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		if n.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA keys must have at least 2048 bits")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// parseJWKS returns the signing keys of a key set by key ID. Keys meant for
+// encryption or of unsupported types are skipped, so a set shared with other
+// uses still loads.
+func parseJWKS(data []byte) (map[string]*signingKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+	keys := make(map[string]*signingKey)
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if alg, ok := jwtAlgs[k.Alg]; k.Alg != "" && (!ok || alg.kty != k.Kty) {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			log.Printf("Skipping JWKS key %d (kid %q): %v", i, k.Kid, err)
+			continue
+		}
+		if _, dup := keys[k.Kid]; dup {
+			return nil, fmt.Errorf("invalid JWKS: key ID %q is used twice", k.Kid)
+		}
+		keys[k.Kid] = &signingKey{kty: k.Kty, alg: k.Alg, key: pub}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS holds no usable signing keys")
+	}
+	return keys, nil
+}
+
+// jwtVerifier authenticates callers by bearer tokens signed with a key from
+// a JWKS, issued by issuer for audience
+type jwtVerifier struct {
+	load     func(ctx context.Context) ([]byte, error)
+	issuer   string
+	audience string
+	claim    string
+	now      func() time.Time
+	// minRefresh is the least time between fetches of the key set
+	minRefresh time.Duration
+
+	// fetchMu serializes fetches of the key set
+	fetchMu   sync.Mutex
+	lastFetch time.Time
+
+	mu   sync.RWMutex
+	keys map[string]*signingKey // nil until a key set has loaded
+}
+
+// refresh fetches the key set and swaps it in. A set that fails to load or
+// parse leaves the previous one in place.
+func (v *jwtVerifier) refresh(ctx context.Context) error {
+	v.fetchMu.Lock()
+	defer v.fetchMu.Unlock()
+	return v.refreshLocked(ctx)
+}
+
+func (v *jwtVerifier) refreshLocked(ctx context.Context) error {
+	v.lastFetch = v.now()
+	data, err := v.load(ctx)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	v.keys = keys
+	v.mu.Unlock()
+	return nil
+}
+
+// signingKey returns the key called kid, fetching the key set again if it
+// is missing and the last fetch isn't too recent, since issuers publish a
+// new key before they start signing with it
+func (v *jwtVerifier) signingKey(ctx context.Context, kid string) (*signingKey, error) {
+	lookup := func() (*signingKey, bool) {
+		v.mu.RLock()
+		defer v.mu.RUnlock()
+		if kid == "" && len(v.keys) == 1 {
+			for _, k := range v.keys {
+				return k, true
+			}
+		}
+		k, ok := v.keys[kid]
+		return k, ok
+	}
+	if k, ok := lookup(); ok {
+		return k, nil
+	}
+
+	v.fetchMu.Lock()
+	if v.now().Sub(v.lastFetch) >= v.minRefresh {
+		if err := v.refreshLocked(ctx); err != nil {
+			log.Printf("Failed to refresh JWKS: %v", err)
+		}
+	}
+	v.fetchMu.Unlock()
+	if k, ok := lookup(); ok {
+		return k, nil
+	}
+	v.mu.RLock()
+	loaded := v.keys != nil
+	v.mu.RUnlock()
+	if !loaded {
+		return nil, errJWKSNotLoaded
+	}
+	if kid == "" {
+		return nil, fmt.Errorf("%w: the token names no key ID", errUnknownSigningKey)
+	}
+	return nil, fmt.Errorf("%w %q", errUnknownSigningKey, kid)
+}
+
+// jwtClaims are the registered claims a token is checked against. The
+// audience may be a string or a list of strings.
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *json.Number    `json:"exp"`
+	NotBefore *json.Number    `json:"nbf"`
+}
+
+func (c *jwtClaims) hasAudience(audience string) bool {
+	var one string
+	if json.Unmarshal(c.Audience, &one) == nil {
+		return one == audience
+	}
+	var many []string
+	if json.Unmarshal(c.Audience, &many) == nil {
+		for _, a := range many {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func claimTime(n *json.Number) (time.Time, error) {
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(int64(f), 0), nil
+}
+
+func decodeSegment(s string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// verify checks a compact JWS token's signature, issuer, audience and
+// validity period and returns the caller it identifies, with the rules in
+// its permissions claim
+func (v *jwtVerifier) verify(ctx context.Context, token string) (*principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header")
+	}
+	alg, ok := jwtAlgs[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+	key, err := v.signingKey(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if key.kty != alg.kty || (key.alg != "" && key.alg != header.Alg) {
+		return nil, fmt.Errorf("token algorithm %s does not match its signing key", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature")
+	}
+	h := alg.hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if !verifySignature(key.key, alg.hash, h.Sum(nil), sig) {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims")
+	}
+	if claims.Issuer != v.issuer {
+		return nil, fmt.Errorf("token issuer %q is not trusted", claims.Issuer)
+	}
+	if !claims.hasAudience(v.audience) {
+		return nil, fmt.Errorf("token is not meant for audience %q", v.audience)
+	}
+	now := v.now()
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	exp, err := claimTime(claims.ExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token expiry")
+	}
+	if now.After(exp.Add(jwtLeeway)) {
+		return nil, fmt.Errorf("token expired at %s", exp.UTC().Format(time.RFC3339))
+	}
+	if claims.NotBefore != nil {
+		nbf, err := claimTime(claims.NotBefore)
+		if err != nil {
+			return nil, fmt.Errorf("malformed token not-before time")
+		}
+		if now.Add(jwtLeeway).Before(nbf) {
+			return nil, fmt.Errorf("token is not valid until %s", nbf.UTC().Format(time.RFC3339))
+		}
+	}
+
+	var all map[string]json.RawMessage
+	decodeSegment(parts[1], &all)
+	p := &principal{name: claims.Subject}
+	if p.name == "" {
+		p.name = "token without a subject"
+	}
+	if raw, ok := all[v.claim]; ok {
+		if err := json.Unmarshal(raw, &p.rules); err != nil {
+			return nil, fmt.Errorf("malformed %s claim: %v", v.claim, err)
+		}
+		if err := checkRules(p.rules); err != nil {
+			return nil, fmt.Errorf("malformed %s claim: %v", v.claim, err)
+		}
+	}
+	return p, nil
+}
+
+// verifySignature checks a JWS signature, which for ECDSA is r and s as
+// fixed-size big-endian integers
+func verifySignature(pub crypto.PublicKey, hash crypto.Hash, digest, sig []byte) bool {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
+
+// httpJWKS fetches a key set from a URL
+func httpJWKS(url string) func(ctx context.Context) ([]byte, error) {
+	return func(ctx context.Context) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	}
+}
+
+// configureJWT turns on bearer token authentication if JWT_JWKS names a
+// JWKS file or URL. Tokens must come from JWT_ISSUER for JWT_AUDIENCE, and
+// the key set is fetched again every JWT_JWKS_REFRESH.
+func (s *APIServer) configureJWT(ctx context.Context) error {
+	source := os.Getenv("JWT_JWKS")
+	if source == "" {
+		return nil
+	}
+	v := &jwtVerifier{
+		issuer:     os.Getenv("JWT_ISSUER"),
+		audience:   os.Getenv("JWT_AUDIENCE"),
+		claim:      os.Getenv("JWT_PERMISSIONS_CLAIM"),
+		now:        time.Now,
+		minRefresh: jwksMinRefresh,
+	}
+	if v.issuer == "" || v.audience == "" {
+		return fmt.Errorf("JWT_ISSUER and JWT_AUDIENCE are required with JWT_JWKS")
+	}
+	if v.claim == "" {
+		v.claim = defaultPermissionsClaim
+	}
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		v.load = httpJWKS(source)
+	} else {
+		v.load = fileKeys(source)
+	}
+	interval := defaultJWKSRefresh
+	if r := os.Getenv("JWT_JWKS_REFRESH"); r != "" {
+		d, err := time.ParseDuration(r)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid JWT_JWKS_REFRESH %q", r)
+		}
+		interval = d
+	}
+
+	s.jwt = v
+	lctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := v.refresh(lctx); err != nil {
+		log.Printf("Failed to load JWKS, retrying every %s: %v", interval, err)
+	}
+	go reloadEvery(ctx, interval, "JWKS", v.refresh)
+	return nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://issuer.test"
+	testAudience = "kv-gateway"
+)
+
+// jwksStub serves a key set that tests can swap, like an issuer's JWKS
+// endpoint
+type jwksStub struct {
+	mu      sync.Mutex
+	keys    []map[string]string
+	fetches int
+}
+
+func (j *jwksStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.fetches++
+	json.NewEncoder(w).Encode(map[string]any{"keys": j.keys})
+}
+
+func (j *jwksStub) set(keys ...map[string]string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.keys = keys
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func rsaJWK(kid string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA", "kid": kid, "use": "sig", "alg": "RS256",
+		"n": b64(key.N.Bytes()),
+		"e": b64([]byte{1, 0, 1}),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "EC", "kid": kid, "crv": "P-256",
+		"x": b64(key.X.FillBytes(make([]byte, 32))),
+		"y": b64(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+// signToken signs claims as a compact JWS with an RSA or P-256 key
+func signToken(t *testing.T, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(signed))
+	var sig []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		s, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = s
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + b64(sig)
+}
+
+// validClaims grants read on the default namespace and write on app- in
+// team-a
+func validClaims() map[string]any {
+	return map[string]any{
+		"iss": testIssuer,
+		"aud": []string{"other", testAudience},
+		"sub": "billing-service",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"kv_permissions": []map[string]any{
+			{"prefix": "", "permissions": []string{"read"}},
+			{"namespace": "team-a", "prefix": "app-", "permissions": []string{"write"}},
+		},
+	}
+}
+
+func newJWTServer(t *testing.T, stub *jwksStub) *APIServer {
+	t.Helper()
+	ts := httptest.NewServer(stub)
+	t.Cleanup(ts.Close)
+	apiServer := NewAPIServer(&mockKVClient{})
+	apiServer.jwt = &jwtVerifier{
+		load:     httpJWKS(ts.URL),
+		issuer:   testIssuer,
+		audience: testAudience,
+		claim:    defaultPermissionsClaim,
+		now:      time.Now,
+	}
+	if err := apiServer.jwt.refresh(context.Background()); err != nil {
+		t.Fatalf("refresh() error = %v", err)
+	}
+	return apiServer
+}
+
+func serveWithToken(router http.Handler, token, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestBearerTokens(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	stub := &jwksStub{}
+	stub.set(rsaJWK("rsa-1", rsaKey), ecJWK("ec-1", ecKey))
+	router := setupRouter(newJWTServer(t, stub))
+
+	with := func(change func(map[string]any)) map[string]any {
+		claims := validClaims()
+		change(claims)
+		return claims
+	}
+	tampered := signToken(t, "ec-1", ecKey, validClaims())
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+
+	tests := []struct {
+		name, token string
+		code        int
+		errContains string
+	}{
+		{"RSA token", signToken(t, "rsa-1", rsaKey, validClaims()), http.StatusOK, ""},
+		{"EC token", signToken(t, "ec-1", ecKey, validClaims()), http.StatusOK, ""},
+		{"wrong issuer", signToken(t, "ec-1", ecKey, with(func(c map[string]any) { c["iss"] = "https://evil.test" })), http.StatusUnauthorized, "issuer"},
+		{"wrong audience", signToken(t, "ec-1", ecKey, with(func(c map[string]any) { c["aud"] = "other" })), http.StatusUnauthorized, "audience"},
+		{"expired", signToken(t, "ec-1", ecKey, with(func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() })), http.StatusUnauthorized, "expired"},
+		{"no expiry", signToken(t, "ec-1", ecKey, with(func(c map[string]any) { delete(c, "exp") })), http.StatusUnauthorized, "expiry"},
+		{"not yet valid", signToken(t, "ec-1", ecKey, with(func(c map[string]any) { c["nbf"] = time.Now().Add(time.Hour).Unix() })), http.StatusUnauthorized, "not valid until"},
+		{"unknown key", signToken(t, "ec-2", other, validClaims()), http.StatusUnauthorized, "unknown signing key \"ec-2\""},
+		{"key ID of another key", signToken(t, "ec-1", other, validClaims()), http.StatusUnauthorized, "signature"},
+		{"RSA key ID on an EC token", signToken(t, "rsa-1", ecKey, validClaims()), http.StatusUnauthorized, "does not match"},
+		{"tampered", tampered, http.StatusUnauthorized, "signature"},
+		{"unsigned", b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{}`)) + ".", http.StatusUnauthorized, "algorithm"},
+		{"garbage", "not-a-token", http.StatusUnauthorized, "malformed"},
+	}
+	for _, tt := range tests {
+		w := serveWithToken(router, tt.token, http.MethodGet, "/kv/k", "")
+		if w.Code != tt.code {
+			t.Errorf("%s: expected status %d, got %d: %s", tt.name, tt.code, w.Code, w.Body)
+			continue
+		}
+		if tt.errContains != "" {
+			var resp ErrorResponse
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if !strings.Contains(resp.Error, tt.errContains) {
+				t.Errorf("%s: expected an error mentioning %q, got %q", tt.name, tt.errContains, resp.Error)
+			}
+			if !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Bearer") {
+				t.Errorf("%s: expected a Bearer challenge, got %q", tt.name, w.Header().Get("WWW-Authenticate"))
+			}
+		}
+	}
+}
+
+func TestBearerTokenClaimsGrantPermissions(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	stub := &jwksStub{}
+	stub.set(ecJWK("ec-1", ecKey))
+	router := setupRouter(newJWTServer(t, stub))
+	token := signToken(t, "ec-1", ecKey, validClaims())
+
+	tests := []struct {
+		method, path, body string
+		code               int
+	}{
+		{http.MethodGet, "/kv/k", "", http.StatusOK},
+		{http.MethodPut, "/kv/k", `{"value": "v"}`, http.StatusForbidden},
+		{http.MethodPut, "/ns/team-a/kv/app-x", `{"value": "v"}`, http.StatusOK},
+		{http.MethodDelete, "/ns/team-a/kv/app-x", "", http.StatusForbidden},
+		{http.MethodGet, "/ns/team-a/kv/app-x", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if w := serveWithToken(router, token, tt.method, tt.path, tt.body); w.Code != tt.code {
+			t.Errorf("%s %s: expected status %d, got %d: %s", tt.method, tt.path, tt.code, w.Code, w.Body)
+		}
+	}
+
+	// A token without the claim authenticates but may do nothing
+	bare := signToken(t, "ec-1", ecKey, map[string]any{"iss": testIssuer, "aud": testAudience, "exp": time.Now().Add(time.Hour).Unix()})
+	if w := serveWithToken(router, bare, http.MethodGet, "/kv/k", ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d for a token without permissions, got %d", http.StatusForbidden, w.Code)
+	}
+	bad := signToken(t, "ec-1", ecKey, map[string]any{"iss": testIssuer, "aud": testAudience, "exp": time.Now().Add(time.Hour).Unix(),
+		"kv_permissions": []map[string]any{{"prefix": "", "permissions": []string{"admin"}}}})
+	if w := serveWithToken(router, bad, http.MethodGet, "/kv/k", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for a malformed permissions claim, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestJWKSRefresh(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	stub := &jwksStub{}
+	stub.set(ecJWK("old", oldKey))
+	apiServer := newJWTServer(t, stub)
+	router := setupRouter(apiServer)
+
+	// The issuer publishes a new key and starts signing with it; the first
+	// token that names it prompts a fetch
+	stub.set(ecJWK("old", oldKey), ecJWK("new", newKey))
+	token := signToken(t, "new", newKey, validClaims())
+	if w := serveWithToken(router, token, http.MethodGet, "/kv/k", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected a token signed with a newly published key to pass, got %d: %s", w.Code, w.Body)
+	}
+
+	// Unknown keys prompt at most one fetch per minRefresh
+	apiServer.jwt.minRefresh = time.Hour
+	fetches := stub.fetches
+	unknown := signToken(t, "unknown", newKey, validClaims())
+	for i := 0; i < 3; i++ {
+		serveWithToken(router, unknown, http.MethodGet, "/kv/k", "")
+	}
+	if stub.fetches != fetches {
+		t.Errorf("Expected no fetches within minRefresh, got %d", stub.fetches-fetches)
+	}
+
+	// Retired keys stop working once the periodic refresh drops them
+	stub.set(ecJWK("new", newKey))
+	if err := apiServer.jwt.refresh(context.Background()); err != nil {
+		t.Fatalf("refresh() error = %v", err)
+	}
+	old := signToken(t, "old", oldKey, validClaims())
+	if w := serveWithToken(router, old, http.MethodGet, "/kv/k", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for a retired key, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	// A broken key set keeps the last good one
+	stub.set()
+	if err := apiServer.jwt.refresh(context.Background()); err == nil {
+		t.Errorf("Expected refresh() of an empty key set to fail")
+	}
+	if w := serveWithToken(router, token, http.MethodGet, "/kv/k", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected the last good key set to stay in place, got %d", w.Code)
+	}
+}
+
+func TestBearerTokensAndAPIKeysTogether(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	stub := &jwksStub{}
+	stub.set(ecJWK("ec-1", ecKey))
+	apiServer := newJWTServer(t, stub)
+	config := testKeyConfig(t)
+	apiServer.auth = &apiKeys{load: func(ctx context.Context) ([]byte, error) { return config, nil }}
+	apiServer.auth.reload(context.Background())
+	router := setupRouter(apiServer)
+
+	if w := serveAs(router, "reader-key", http.MethodGet, "/kv/k", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected an API key to pass, got %d", w.Code)
+	}
+	if w := serveWithToken(router, signToken(t, "ec-1", ecKey, validClaims()), http.MethodGet, "/kv/k", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected a bearer token to pass, got %d", w.Code)
+	}
+	w := serveAs(router, "", http.MethodGet, "/kv/k", "")
+	if w.Code != http.StatusUnauthorized || len(w.Header().Values("WWW-Authenticate")) != 2 {
+		t.Errorf("Expected status %d with both challenges, got %d with %v", http.StatusUnauthorized, w.Code, w.Header().Values("WWW-Authenticate"))
+	}
+}
+
+func TestConfigureJWTFromFile(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{ecJWK("ec-1", ecKey)}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Setenv("JWT_JWKS", path)
+	if err := NewAPIServer(&mockKVClient{}).configureJWT(ctx); err == nil {
+		t.Errorf("Expected configureJWT() to require an issuer and audience")
+	}
+	t.Setenv("JWT_ISSUER", testIssuer)
+	t.Setenv("JWT_AUDIENCE", testAudience)
+	apiServer := NewAPIServer(&mockKVClient{})
+	if err := apiServer.configureJWT(ctx); err != nil {
+		t.Fatalf("configureJWT() error = %v", err)
+	}
+	token := signToken(t, "ec-1", ecKey, validClaims())
+	if w := serveWithToken(setupRouter(apiServer), token, http.MethodGet, "/kv/k", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	// Until a key set loads, tokens can't be checked
+	t.Setenv("JWT_JWKS", filepath.Join(t.TempDir(), "missing.json"))
+	apiServer = NewAPIServer(&mockKVClient{})
+	if err := apiServer.configureJWT(ctx); err != nil {
+		t.Fatalf("configureJWT() error = %v", err)
+	}
+	if w := serveWithToken(setupRouter(apiServer), token, http.MethodGet, "/kv/k", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d before the key set loads, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
@@ -2,24 +2,75 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pranavmerugu/censys-take-home/mtls"
 	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 type APIServer struct {
+	pb.UnimplementedShardAdminServer
+
 	kvClient pb.KVStoreClient
+
+	// The fields below are set when the keyspace is partitioned across
+	// several KV services, in which case kvClient is nil. mu guards them;
+	// a rebalance replaces the ring and maps rather than changing them.
+	mu      sync.RWMutex
+	ring    *hashRing
+	shards  map[string]pb.KVStoreClient
+	addrs   map[string]string
+	closers map[string]io.Closer
+	dial    dialFunc
+	// moving is the rebalance whose keys are being copied, if any, and
+	// rebalance is the latest one
+	moving    *rebalance
+	rebalance *rebalance
+	// stateSeq numbers the rebalance statuses stored on the shards
+	stateSeq atomic.Uint64
+
+	// auth and jwt authenticate callers by API key and bearer token; with
+	// neither the API is open
+	auth *apiKeys
+	jwt  *jwtVerifier
 }
 
+// SetRequest is the body of POST /kv. The value is given either as text in
+// Value or base64-encoded in ValueBase64, which any bytes can be sent as.
 type SetRequest struct {
-	Key   string `json:"key" binding:"required"`
-	Value string `json:"value" binding:"required"`
+	Key         string `json:"key" binding:"required"`
+	Value       string `json:"value"`
+	ValueBase64 string `json:"value_base64,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	TTLSeconds  int64  `json:"ttl_seconds,omitempty" binding:"gte=0"`
+}
+
+// PutRequest is the JSON body of PUT /kv/:key. The key comes from the URL.
+// A body of any other content type is stored as the value itself.
+type PutRequest struct {
+	Value       string `json:"value"`
+	ValueBase64 string `json:"value_base64,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	TTLSeconds  int64  `json:"ttl_seconds,omitempty" binding:"gte=0"`
 }
 
 type GetRequest struct {
@@ -33,13 +84,19 @@ type DeleteRequest struct {
 type SetResponse struct {
 	Success bool   `json:"success"`
 	Message string `json:"message"`
+	Version uint64 `json:"version,omitempty"`
 }
 
+// GetResponse describes a stored value. Values that aren't valid UTF-8 are
+// returned base64-encoded in ValueBase64 instead of Value.
 type GetResponse struct {
-	Found   bool   `json:"found"`
-	Message string `json:"message"`
-	Key     string `json:"key,omitempty"`
-	Value   string `json:"value,omitempty"`
+	Found       bool   `json:"found"`
+	Message     string `json:"message"`
+	Key         string `json:"key,omitempty"`
+	Value       string `json:"value,omitempty"`
+	ValueBase64 string `json:"value_base64,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Version     uint64 `json:"version,omitempty"`
 }
 
 type DeleteResponse struct {
@@ -47,6 +104,127 @@ type DeleteResponse struct {
 	Message string `json:"message"`
 }
 
+type TTLResponse struct {
+	Found      bool   `json:"found"`
+	Message    string `json:"message"`
+	Key        string `json:"key,omitempty"`
+	TTLSeconds int64  `json:"ttl_seconds,omitempty"`
+}
+
+type TouchRequest struct {
+	TTLSeconds *int64 `json:"ttl_seconds" binding:"required,gte=0"`
+}
+
+type TouchResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+type KeyValue struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	ValueBase64 string `json:"value_base64,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Version     uint64 `json:"version,omitempty"`
+}
+
+type ListResponse struct {
+	Items []KeyValue `json:"items"`
+	// NextCursor is passed back as ?cursor= to fetch the next page; it is
+	// empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// WatchEvent is the data of a server-sent event on /kv/watch
+type WatchEvent struct {
+	Type        string `json:"type"`
+	Key         string `json:"key"`
+	Value       string `json:"value,omitempty"`
+	ValueBase64 string `json:"value_base64,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Revision    uint64 `json:"revision"`
+}
+
+// TxnCompare is a condition of POST /kv/txn. Target is "value" or "version"
+// and Result is "equal", "not_equal", "greater" or "less".
+type TxnCompare struct {
+	Key         string `json:"key" binding:"required"`
+	Target      string `json:"target" binding:"required"`
+	Result      string `json:"result" binding:"required"`
+	Value       string `json:"value,omitempty"`
+	ValueBase64 string `json:"value_base64,omitempty"`
+	Version     uint64 `json:"version,omitempty"`
+}
+
+// TxnOp is an operation of POST /kv/txn. Op is "get", "put" or "delete".
+type TxnOp struct {
+	Op          string `json:"op" binding:"required"`
+	Key         string `json:"key" binding:"required"`
+	Value       string `json:"value,omitempty"`
+	ValueBase64 string `json:"value_base64,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	TTLSeconds  int64  `json:"ttl_seconds,omitempty" binding:"gte=0"`
+}
+
+type TxnRequest struct {
+	Compare []TxnCompare `json:"compare" binding:"dive"`
+	Success []TxnOp      `json:"success" binding:"dive"`
+	Failure []TxnOp      `json:"failure" binding:"dive"`
+}
+
+type TxnOpResult struct {
+	Op          string `json:"op"`
+	Key         string `json:"key"`
+	Found       bool   `json:"found"`
+	Value       string `json:"value,omitempty"`
+	ValueBase64 string `json:"value_base64,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Version     uint64 `json:"version,omitempty"`
+}
+
+type TxnResponse struct {
+	Succeeded bool          `json:"succeeded"`
+	Revision  uint64        `json:"revision"`
+	Results   []TxnOpResult `json:"results"`
+}
+
+// BatchItem is one key of POST /kv/batch. Value and TTLSeconds apply to set
+// batches, and Version makes a delete conditional on the key's version.
+type BatchItem struct {
+	Key         string `json:"key"`
+	Value       string `json:"value,omitempty"`
+	ValueBase64 string `json:"value_base64,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	TTLSeconds  int64  `json:"ttl_seconds,omitempty"`
+	Version     uint64 `json:"version,omitempty"`
+}
+
+// BatchRequest is the body of POST /kv/batch. Op is "get", "set" or
+// "delete". Without atomic, items that fail are reported in their result and
+// the rest of the batch is still applied.
+type BatchRequest struct {
+	Op     string      `json:"op" binding:"required,oneof=get set delete"`
+	Items  []BatchItem `json:"items" binding:"required"`
+	Atomic bool        `json:"atomic,omitempty"`
+	// Namespace comes from the URL
+	Namespace string `json:"-"`
+}
+
+type BatchItemResult struct {
+	Key         string `json:"key"`
+	Success     bool   `json:"success"`
+	Message     string `json:"message"`
+	Value       string `json:"value,omitempty"`
+	ValueBase64 string `json:"value_base64,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Version     uint64 `json:"version,omitempty"`
+}
+
+type BatchResponse struct {
+	Revision uint64            `json:"revision"`
+	Results  []BatchItemResult `json:"results"`
+}
+
 type ErrorResponse struct {
 	Error string `json:"error"`
 }
@@ -60,37 +238,191 @@ func NewAPIServer(kvClient pb.KVStoreClient) *APIServer {
 
 // SetHandler handles POST requests to store a key-value pair
 func (s *APIServer) SetHandler(c *gin.Context) {
+	ns := namespaceOf(c)
 	var req SetRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
+	err := c.ShouldBindJSON(&req)
+	var (
+		text string
+		raw  []byte
+	)
+	if err == nil {
+		text, raw, err = decodeRequiredJSONValue(req.Value, req.ValueBase64)
+	}
+	if err != nil {
 		c.JSON(http.StatusBadRequest, ErrorResponse{
 			Error: "Invalid request: " + err.Error(),
 		})
 		return
 	}
+	if !s.authorize(c, ns, permWrite, req.Key) {
+		return
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(callContext(context.Background(), c), 5*time.Second)
 	defer cancel()
 
-	resp, err := s.kvClient.Set(ctx, &pb.SetRequest{
-		Key:   req.Key,
-		Value: req.Value,
+	r := s.routeWrite(req.Key)
+	defer r.release()
+	defer r.mirror(ctx, ns, req.Key)
+
+	resp, err := r.client(req.Key).Set(ctx, &pb.SetRequest{
+		Namespace:   ns,
+		Key:         req.Key,
+		Value:       text,
+		ValueBytes:  raw,
+		ContentType: req.ContentType,
+		TtlSeconds:  req.TTLSeconds,
 	})
 
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
+		c.JSON(httpStatusFromGRPC(err), ErrorResponse{
 			Error: "Failed to set key: " + err.Error(),
 		})
 		return
 	}
 
+	setETag(c, resp.Version)
 	c.JSON(http.StatusOK, SetResponse{
 		Success: resp.Success,
 		Message: resp.Message,
+		Version: resp.Version,
 	})
 }
 
-// GetHandler handles GET requests to retrieve a value by key
+// PutHandler handles PUT requests to store a value under the key in the URL.
+// A JSON body describes the value; a body of any other content type is the
+// value, streamed to the KV service and stored with that content type and a
+// TTL given by ?ttl_seconds=.
+// An If-Match header makes the write conditional on the key's current ETag,
+// or with *, on the key existing, and If-None-Match: * makes it conditional
+// on the key not existing. A failed condition is reported as 412 Precondition
+// Failed.
+func (s *APIServer) PutHandler(c *gin.Context) {
+	ns := namespaceOf(c)
+	key := c.Param("key")
+	if key == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Key parameter is required",
+		})
+		return
+	}
+	if !s.authorize(c, ns, permWrite, key) {
+		return
+	}
+
+	ifMatch := c.GetHeader("If-Match")
+	ifNoneMatch := c.GetHeader("If-None-Match")
+	if ifMatch != "" && ifNoneMatch != "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "If-Match and If-None-Match cannot be combined",
+		})
+		return
+	}
+	if ifNoneMatch != "" && strings.TrimSpace(ifNoneMatch) != "*" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "If-None-Match only supports * on PUT",
+		})
+		return
+	}
+	var (
+		expected  uint64
+		mustExist bool
+	)
+	if ifMatch != "" {
+		v, anyVersion, err := parseIfMatch(ifMatch)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error: "Invalid If-Match header: " + err.Error(),
+			})
+			return
+		}
+		expected, mustExist = v, anyVersion
+	}
+
+	if !isJSONBody(c) {
+		s.putRawValue(c, ns, key, expected, mustExist, ifNoneMatch != "")
+		return
+	}
+	var req PutRequest
+	err := c.ShouldBindJSON(&req)
+	var (
+		text string
+		raw  []byte
+	)
+	if err == nil {
+		text, raw, err = decodeRequiredJSONValue(req.Value, req.ValueBase64)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(callContext(context.Background(), c), 5*time.Second)
+	defer cancel()
+
+	r := s.routeWrite(key)
+	defer r.release()
+	defer r.mirror(ctx, ns, key)
+
+	var (
+		version uint64
+		message string
+	)
+	if ifMatch == "" && ifNoneMatch == "" {
+		var resp *pb.SetResponse
+		resp, err = r.client(key).Set(ctx, &pb.SetRequest{
+			Namespace:   ns,
+			Key:         key,
+			Value:       text,
+			ValueBytes:  raw,
+			ContentType: req.ContentType,
+			TtlSeconds:  req.TTLSeconds,
+		})
+		if err == nil {
+			version, message = resp.Version, resp.Message
+		}
+	} else {
+		casReq := &pb.CompareAndSetRequest{
+			Namespace:       ns,
+			Key:             key,
+			Value:           text,
+			ValueBytes:      raw,
+			ContentType:     req.ContentType,
+			TtlSeconds:      req.TTLSeconds,
+			ExpectedVersion: expected,
+			MustExist:       mustExist,
+			MustNotExist:    ifNoneMatch != "",
+		}
+
+		var resp *pb.CompareAndSetResponse
+		resp, err = r.client(key).CompareAndSet(ctx, casReq)
+		if err == nil {
+			version, message = resp.Version, resp.Message
+		}
+	}
+
+	if err != nil {
+		c.JSON(httpStatusFromGRPC(err), ErrorResponse{
+			Error: "Failed to set key: " + err.Error(),
+		})
+		return
+	}
+
+	setETag(c, version)
+	c.JSON(http.StatusOK, SetResponse{
+		Success: true,
+		Message: message,
+		Version: version,
+	})
+}
+
+// GetHandler handles GET requests to retrieve a value by key. The value is
+// described by a JSON document, unless the Accept header admits no JSON, in
+// which case the value itself is streamed back with its content type.
 func (s *APIServer) GetHandler(c *gin.Context) {
+	ns := namespaceOf(c)
 	key := c.Param("key")
 	if key == "" {
 		c.JSON(http.StatusBadRequest, ErrorResponse{
@@ -98,16 +430,25 @@ func (s *APIServer) GetHandler(c *gin.Context) {
 		})
 		return
 	}
+	if !s.authorize(c, ns, permRead, key) {
+		return
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if wantsRawValue(c) {
+		s.getRawValue(c, ns, key)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(callContext(context.Background(), c), 5*time.Second)
 	defer cancel()
 
-	resp, err := s.kvClient.Get(ctx, &pb.GetRequest{
-		Key: key,
+	resp, err := s.clientFor(key).Get(ctx, &pb.GetRequest{
+		Namespace: ns,
+		Key:       key,
 	})
 
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
+		c.JSON(httpStatusFromGRPC(err), ErrorResponse{
 			Error: "Failed to get key: " + err.Error(),
 		})
 		return
@@ -121,16 +462,29 @@ func (s *APIServer) GetHandler(c *gin.Context) {
 		return
 	}
 
+	setETag(c, resp.Version)
+	if resp.Version != 0 && etagMatches(c.GetHeader("If-None-Match"), formatETag(resp.Version)) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	value, valueBase64 := encodeJSONValue(resp.Value, resp.ValueBytes)
 	c.JSON(http.StatusOK, GetResponse{
-		Found:   true,
-		Message: resp.Message,
-		Key:     key,
-		Value:   resp.Value,
+		Found:       true,
+		Message:     resp.Message,
+		Key:         key,
+		Value:       value,
+		ValueBase64: valueBase64,
+		ContentType: resp.ContentType,
+		Version:     resp.Version,
 	})
 }
 
-// DeleteHandler handles DELETE requests to remove a key-value pair
+// DeleteHandler handles DELETE requests to remove a key-value pair. An
+// If-Match header makes the delete conditional on the key's current ETag, and
+// If-Match: * reports a missing key as 412 Precondition Failed.
 func (s *APIServer) DeleteHandler(c *gin.Context) {
+	ns := namespaceOf(c)
 	key := c.Param("key")
 	if key == "" {
 		c.JSON(http.StatusBadRequest, ErrorResponse{
@@ -138,23 +492,51 @@ func (s *APIServer) DeleteHandler(c *gin.Context) {
 		})
 		return
 	}
+	if !s.authorize(c, ns, permDelete, key) {
+		return
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	var (
+		expected  uint64
+		mustExist bool
+	)
+	if ifMatch := c.GetHeader("If-Match"); ifMatch != "" {
+		v, anyVersion, err := parseIfMatch(ifMatch)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error: "Invalid If-Match header: " + err.Error(),
+			})
+			return
+		}
+		expected, mustExist = v, anyVersion
+	}
+
+	ctx, cancel := context.WithTimeout(callContext(context.Background(), c), 5*time.Second)
 	defer cancel()
 
-	resp, err := s.kvClient.Delete(ctx, &pb.DeleteRequest{
-		Key: key,
+	r := s.routeWrite(key)
+	defer r.release()
+	defer r.mirror(ctx, ns, key)
+
+	resp, err := r.client(key).Delete(ctx, &pb.DeleteRequest{
+		Namespace:       ns,
+		Key:             key,
+		ExpectedVersion: expected,
 	})
 
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
+		c.JSON(httpStatusFromGRPC(err), ErrorResponse{
 			Error: "Failed to delete key: " + err.Error(),
 		})
 		return
 	}
 
 	if !resp.Success {
-		c.JSON(http.StatusNotFound, DeleteResponse{
+		code := http.StatusNotFound
+		if mustExist {
+			code = http.StatusPreconditionFailed
+		}
+		c.JSON(code, DeleteResponse{
 			Success: false,
 			Message: resp.Message,
 		})
@@ -167,30 +549,806 @@ func (s *APIServer) DeleteHandler(c *gin.Context) {
 	})
 }
 
-func main() {
-	// Get KV service address from environment variable or use default
-	kvServiceAddr := os.Getenv("KV_SERVICE_ADDR")
-	if kvServiceAddr == "" {
-		kvServiceAddr = "localhost:50051"
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// ListHandler handles GET requests that list key-value pairs in key order. It
+// accepts an optional prefix, a cursor from a previous page and a page limit.
+func (s *APIServer) ListHandler(c *gin.Context) {
+	ns := namespaceOf(c)
+	limit := defaultListLimit
+	if l := c.Query("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxListLimit {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error: fmt.Sprintf("limit must be between 1 and %d", maxListLimit),
+			})
+			return
+		}
+		limit = n
 	}
 
-	// Connect to KV store gRPC service
-	conn, err := grpc.NewClient(kvServiceAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	var start string
+	if cursor := c.Query("cursor"); cursor != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error: "Invalid cursor",
+			})
+			return
+		}
+		start = string(decoded)
+	}
+
+	if !s.authorize(c, ns, permRead, c.Query("prefix")) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(callContext(context.Background(), c), 5*time.Second)
+	defer cancel()
+
+	// Fetch one extra key to learn where the next page starts
+	stream, err := s.scan(ctx, &pb.ScanRequest{
+		Namespace: ns,
+		StartKey:  start,
+		Prefix:    c.Query("prefix"),
+		Limit:     int64(limit + 1),
+	})
 	if err != nil {
-		log.Fatalf("Failed to connect to KV service: %v", err)
+		c.JSON(httpStatusFromGRPC(err), ErrorResponse{
+			Error: "Failed to list keys: " + err.Error(),
+		})
+		return
 	}
-	defer conn.Close()
 
-	kvClient := pb.NewKVStoreClient(conn)
-	apiServer := NewAPIServer(kvClient)
+	resp := ListResponse{Items: []KeyValue{}}
+	for {
+		item, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.JSON(httpStatusFromGRPC(err), ErrorResponse{
+				Error: "Failed to list keys: " + err.Error(),
+			})
+			return
+		}
+		if len(resp.Items) == limit {
+			resp.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(item.Key))
+			break
+		}
+		value, valueBase64 := encodeJSONValue(item.Value, item.ValueBytes)
+		resp.Items = append(resp.Items, KeyValue{
+			Key:         item.Key,
+			Value:       value,
+			ValueBase64: valueBase64,
+			ContentType: item.ContentType,
+			Version:     item.Version,
+		})
+	}
 
-	// Set up Gin router
+	c.JSON(http.StatusOK, resp)
+}
+
+// watchKeepAlive is how often a comment is sent on an idle watch so that
+// proxies don't close the connection
+const watchKeepAlive = 15 * time.Second
+
+// WatchHandler streams changes to a key (?key=) or key prefix (?prefix=) as
+// Server-Sent Events. Each event's id is its revision, followed by its place
+// among the events of that revision when a transaction or batch made several,
+// so a reconnecting client that sends Last-Event-ID resumes without missing
+// changes; ?start_revision= starts at a revision explicitly.
+func (s *APIServer) WatchHandler(c *gin.Context) {
+	ns := namespaceOf(c)
+	key, hasKey := c.GetQuery("key")
+	prefix, hasPrefix := c.GetQuery("prefix")
+	if hasKey == hasPrefix {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Exactly one of key or prefix is required",
+		})
+		return
+	}
+	req := &pb.WatchRequest{Namespace: ns, Key: key}
+	if hasPrefix {
+		req = &pb.WatchRequest{Namespace: ns, Key: prefix, Prefix: true}
+	}
+	if !s.authorize(c, ns, permRead, req.Key) {
+		return
+	}
+	// Revisions are numbered per shard, so a prefix spread over several
+	// shards has no single revision to resume from
+	r := s.routeRead()
+	client := r.client(key)
+	if hasPrefix && r.ring != nil {
+		c.JSON(http.StatusNotImplemented, ErrorResponse{
+			Error: "Prefix watches are not supported when the keyspace is sharded",
+		})
+		return
+	}
+
+	if rev := c.Query("start_revision"); rev != "" {
+		n, err := strconv.ParseUint(rev, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error: "Invalid start_revision",
+			})
+			return
+		}
+		req.StartRevision = n
+	}
+	// Events of the last revision the client saw, up to and including the
+	// one it names, are skipped
+	seen := 0
+	if id := c.GetHeader("Last-Event-ID"); id != "" {
+		rev, index, err := parseEventID(id)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error: "Invalid Last-Event-ID",
+			})
+			return
+		}
+		req.StartRevision, seen = rev, index+1
+	}
+
+	// The watch lives as long as the client stays connected
+	ctx, cancel := context.WithCancel(callContext(c.Request.Context(), c))
+	defer cancel()
+
+	stream, err := client.Watch(ctx, req)
+	if err == nil {
+		// The KV service sends headers once it has accepted the watch, so
+		// errors such as a compacted revision surface before streaming
+		// starts. A stream that ended without headers carries its error in
+		// the status returned by Recv.
+		var md metadata.MD
+		md, err = stream.Header()
+		if err == nil && md == nil {
+			_, err = stream.Recv()
+		}
+	}
+	if err != nil {
+		code := httpStatusFromGRPC(err)
+		if status.Code(err) == codes.OutOfRange {
+			code = http.StatusGone
+		}
+		c.JSON(code, ErrorResponse{
+			Error: "Failed to watch: " + err.Error(),
+		})
+		return
+	}
+
+	type result struct {
+		event *pb.WatchEvent
+		err   error
+	}
+	results := make(chan result)
+	go func() {
+		for {
+			event, err := stream.Recv()
+			select {
+			case results <- result{event, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(watchKeepAlive)
+	defer ticker.Stop()
+
+	var (
+		lastRev uint64
+		index   int
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fmt.Fprint(c.Writer, ": keep-alive\n\n")
+		case r := <-results:
+			if r.err == io.EOF {
+				return
+			}
+			if r.err != nil {
+				data, _ := json.Marshal(ErrorResponse{Error: r.err.Error()})
+				fmt.Fprintf(c.Writer, "event: error\ndata: %s\n\n", data)
+				c.Writer.Flush()
+				return
+			}
+
+			if r.event.Revision == lastRev {
+				index++
+			} else {
+				lastRev, index = r.event.Revision, 0
+			}
+			if lastRev == req.StartRevision && index < seen {
+				continue
+			}
+
+			value, valueBase64 := encodeJSONValue(r.event.Value, r.event.ValueBytes)
+			event := WatchEvent{
+				Type:        strings.ToLower(r.event.Type.String()),
+				Key:         r.event.Key,
+				Value:       value,
+				ValueBase64: valueBase64,
+				ContentType: r.event.ContentType,
+				Revision:    r.event.Revision,
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(c.Writer, "id: %s\nevent: %s\ndata: %s\n\n", formatEventID(event.Revision, index), event.Type, data)
+		}
+		c.Writer.Flush()
+	}
+}
+
+// formatEventID returns the SSE id of the event at index among the events of
+// revision rev: the revision alone for the first, and rev.index after it
+func formatEventID(rev uint64, index int) string {
+	if index == 0 {
+		return strconv.FormatUint(rev, 10)
+	}
+	return fmt.Sprintf("%d.%d", rev, index)
+}
+
+// parseEventID parses an SSE id made by formatEventID
+func parseEventID(id string) (rev uint64, index int, err error) {
+	revPart, indexPart, hasIndex := strings.Cut(id, ".")
+	if rev, err = strconv.ParseUint(revPart, 10, 64); err != nil {
+		return 0, 0, err
+	}
+	if hasIndex {
+		if index, err = strconv.Atoi(indexPart); err != nil || index < 0 {
+			return 0, 0, fmt.Errorf("invalid event index %q", indexPart)
+		}
+	}
+	return rev, index, nil
+}
+
+// GetTTLHandler handles GET requests for the remaining TTL of a key. A TTL of
+// -1 means the key never expires.
+func (s *APIServer) GetTTLHandler(c *gin.Context) {
+	ns := namespaceOf(c)
+	key := c.Param("key")
+	if key == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Key parameter is required",
+		})
+		return
+	}
+	if !s.authorize(c, ns, permRead, key) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(callContext(context.Background(), c), 5*time.Second)
+	defer cancel()
+
+	resp, err := s.clientFor(key).GetTTL(ctx, &pb.GetTTLRequest{
+		Namespace: ns,
+		Key:       key,
+	})
+
+	if err != nil {
+		c.JSON(httpStatusFromGRPC(err), ErrorResponse{
+			Error: "Failed to get TTL: " + err.Error(),
+		})
+		return
+	}
+
+	if !resp.Found {
+		c.JSON(http.StatusNotFound, TTLResponse{
+			Found:   false,
+			Message: resp.Message,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, TTLResponse{
+		Found:      true,
+		Message:    resp.Message,
+		Key:        key,
+		TTLSeconds: resp.TtlSeconds,
+	})
+}
+
+// TouchHandler handles PUT requests that replace the TTL of a key without
+// rewriting its value. A TTL of 0 removes the expiry.
+func (s *APIServer) TouchHandler(c *gin.Context) {
+	ns := namespaceOf(c)
+	key := c.Param("key")
+	if key == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Key parameter is required",
+		})
+		return
+	}
+	if !s.authorize(c, ns, permWrite, key) {
+		return
+	}
+
+	var req TouchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(callContext(context.Background(), c), 5*time.Second)
+	defer cancel()
+
+	r := s.routeWrite(key)
+	defer r.release()
+	defer r.mirror(ctx, ns, key)
+
+	resp, err := r.client(key).Touch(ctx, &pb.TouchRequest{
+		Namespace:  ns,
+		Key:        key,
+		TtlSeconds: *req.TTLSeconds,
+	})
+
+	if err != nil {
+		c.JSON(httpStatusFromGRPC(err), ErrorResponse{
+			Error: "Failed to update TTL: " + err.Error(),
+		})
+		return
+	}
+
+	if !resp.Success {
+		c.JSON(http.StatusNotFound, TouchResponse{
+			Success: false,
+			Message: resp.Message,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, TouchResponse{
+		Success: true,
+		Message: resp.Message,
+	})
+}
+
+// BatchHandler handles POST requests that get, set or delete many keys in one
+// round trip. Results are reported per key in request order.
+func (s *APIServer) BatchHandler(c *gin.Context) {
+	ns := namespaceOf(c)
+	var req BatchRequest
+	err := c.ShouldBindJSON(&req)
+	for i := 0; err == nil && i < len(req.Items); i++ {
+		if _, _, err = decodeJSONValue(req.Items[i].Value, req.Items[i].ValueBase64); err != nil {
+			err = fmt.Errorf("item %d: %w", i, err)
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	for _, item := range req.Items {
+		if !s.authorize(c, ns, batchPermissions[req.Op], item.Key) {
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(callContext(context.Background(), c), 5*time.Second)
+	defer cancel()
+
+	req.Namespace = ns
+	resp, err := s.batch(ctx, req)
+	if err != nil {
+		c.JSON(httpStatusFromGRPC(err), ErrorResponse{
+			Error: "Failed to run batch: " + err.Error(),
+		})
+		return
+	}
+
+	out := BatchResponse{Revision: resp.Revision, Results: []BatchItemResult{}}
+	for _, r := range resp.Results {
+		value, valueBase64 := encodeJSONValue(r.Value, r.ValueBytes)
+		out.Results = append(out.Results, BatchItemResult{
+			Key:         r.Key,
+			Success:     r.Success,
+			Message:     r.Message,
+			Value:       value,
+			ValueBase64: valueBase64,
+			ContentType: r.ContentType,
+			Version:     r.Version,
+		})
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+var (
+	txnTargets = map[string]pb.Compare_Target{
+		"value":   pb.Compare_VALUE,
+		"version": pb.Compare_VERSION,
+	}
+	txnResults = map[string]pb.Compare_Result{
+		"equal":     pb.Compare_EQUAL,
+		"not_equal": pb.Compare_NOT_EQUAL,
+		"greater":   pb.Compare_GREATER,
+		"less":      pb.Compare_LESS,
+	}
+	txnOpTypes = map[string]pb.TxnOp_Type{
+		"get":    pb.TxnOp_GET,
+		"put":    pb.TxnOp_PUT,
+		"delete": pb.TxnOp_DELETE,
+	}
+	batchPermissions = map[string]permission{
+		"get":    permRead,
+		"set":    permWrite,
+		"delete": permDelete,
+	}
+	txnPermissions = map[pb.TxnOp_Type]permission{
+		pb.TxnOp_GET:    permRead,
+		pb.TxnOp_PUT:    permWrite,
+		pb.TxnOp_DELETE: permDelete,
+	}
+)
+
+// TxnHandler handles POST requests that run a transaction: if every compare
+// holds the success ops are applied, otherwise the failure ops, atomically
+func (s *APIServer) TxnHandler(c *gin.Context) {
+	ns := namespaceOf(c)
+	var req TxnRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	txn := &pb.TxnRequest{Namespace: ns}
+	for _, cmp := range req.Compare {
+		target, ok := txnTargets[cmp.Target]
+		if !ok {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error: fmt.Sprintf("Invalid request: unknown compare target %q", cmp.Target),
+			})
+			return
+		}
+		result, ok := txnResults[cmp.Result]
+		if !ok {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error: fmt.Sprintf("Invalid request: unknown compare result %q", cmp.Result),
+			})
+			return
+		}
+		text, raw, err := decodeJSONValue(cmp.Value, cmp.ValueBase64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error: "Invalid request: " + err.Error(),
+			})
+			return
+		}
+		txn.Compare = append(txn.Compare, &pb.Compare{
+			Key:        cmp.Key,
+			Target:     target,
+			Result:     result,
+			Value:      text,
+			ValueBytes: raw,
+			Version:    cmp.Version,
+		})
+	}
+	var err error
+	if txn.Success, err = txnOps(req.Success); err == nil {
+		txn.Failure, err = txnOps(req.Failure)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Invalid request: " + err.Error(),
+		})
+		return
+	}
+
+	keys := make([]string, 0, len(txn.Compare)+len(txn.Success)+len(txn.Failure))
+	for _, cmp := range txn.Compare {
+		keys = append(keys, cmp.Key)
+		if !s.authorize(c, ns, permRead, cmp.Key) {
+			return
+		}
+	}
+	for _, op := range append(txn.Success, txn.Failure...) {
+		keys = append(keys, op.Key)
+		if !s.authorize(c, ns, txnPermissions[op.Type], op.Key) {
+			return
+		}
+	}
+	r := s.routeWrite(keys...)
+	defer r.release()
+	if !r.sameShard(keys) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Invalid request: transaction keys belong to more than one shard",
+		})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(callContext(context.Background(), c), 5*time.Second)
+	defer cancel()
+	// A transaction that fails may still have run, and either branch
+	var writes []string
+	for _, op := range append(txn.Success, txn.Failure...) {
+		if op.Type != pb.TxnOp_GET {
+			writes = append(writes, op.Key)
+		}
+	}
+	defer r.mirror(ctx, ns, writes...)
+
+	resp, err := r.client(firstKey(keys)).Txn(ctx, txn)
+	if err != nil {
+		c.JSON(httpStatusFromGRPC(err), ErrorResponse{
+			Error: "Failed to run transaction: " + err.Error(),
+		})
+		return
+	}
+	out := TxnResponse{
+		Succeeded: resp.Succeeded,
+		Revision:  resp.Revision,
+		Results:   []TxnOpResult{},
+	}
+	for _, r := range resp.Results {
+		value, valueBase64 := encodeJSONValue(r.Value, r.ValueBytes)
+		out.Results = append(out.Results, TxnOpResult{
+			Op:          strings.ToLower(r.Type.String()),
+			Key:         r.Key,
+			Found:       r.Found,
+			Value:       value,
+			ValueBase64: valueBase64,
+			ContentType: r.ContentType,
+			Version:     r.Version,
+		})
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// txnOps converts the ops of one transaction branch to their gRPC form
+func txnOps(ops []TxnOp) ([]*pb.TxnOp, error) {
+	out := make([]*pb.TxnOp, 0, len(ops))
+	for _, op := range ops {
+		typ, ok := txnOpTypes[op.Op]
+		if !ok {
+			return nil, fmt.Errorf("unknown op %q", op.Op)
+		}
+		text, raw, err := decodeJSONValue(op.Value, op.ValueBase64)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &pb.TxnOp{
+			Type:        typ,
+			Key:         op.Key,
+			Value:       text,
+			ValueBytes:  raw,
+			ContentType: op.ContentType,
+			TtlSeconds:  op.TTLSeconds,
+		})
+	}
+	return out, nil
+}
+
+// formatETag renders a key version as a strong ETag
+func formatETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// setETag sets the ETag response header for a key version, if known
+func setETag(c *gin.Context, version uint64) {
+	if version != 0 {
+		c.Header("ETag", formatETag(version))
+	}
+}
+
+// parseETag extracts the key version from a single ETag, as sent in If-Match.
+// Weak ETags are accepted since versions identify values exactly.
+func parseETag(s string) (uint64, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "W/")
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return 0, fmt.Errorf("expected a single quoted ETag, got %s", s)
+	}
+	v, err := strconv.ParseUint(s[1:len(s)-1], 10, 64)
+	if err != nil || v == 0 {
+		return 0, fmt.Errorf("unknown ETag %s", s)
+	}
+	return v, nil
+}
+
+// parseIfMatch parses an If-Match header, which is either a single ETag or *,
+// meaning any current version of the key
+func parseIfMatch(header string) (version uint64, anyVersion bool, err error) {
+	if strings.TrimSpace(header) == "*" {
+		return 0, true, nil
+	}
+	version, err = parseETag(header)
+	return version, false, err
+}
+
+// etagMatches reports whether an If-None-Match header matches etag
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// errorInfo returns the ErrorInfo detail of a gRPC error, if it has one
+func errorInfo(err error) *errdetails.ErrorInfo {
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			return info
+		}
+	}
+	return nil
+}
+
+// primaryHint returns the address of the node that accepts writes if err is a
+// write rejected by a follower, or "" otherwise
+func primaryHint(err error) string {
+	if info := errorInfo(err); info != nil && info.Reason == "NOT_PRIMARY" {
+		return info.Metadata["primary"]
+	}
+	return ""
+}
+
+// httpStatusFromGRPC maps a gRPC error from the KV service to an HTTP status
+func httpStatusFromGRPC(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.FailedPrecondition:
+		if primaryHint(err) != "" {
+			// The gateway is pointed at a read-only follower
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusPreconditionFailed
+	case codes.Aborted:
+		// A clustered write kept losing to concurrent writes
+		return http.StatusConflict
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.ResourceExhausted:
+		if info := errorInfo(err); info != nil && info.Reason == "OBJECT_TOO_LARGE" {
+			return http.StatusRequestEntityTooLarge
+		}
+		// The KV service's memory limit or a namespace's quota is reached
+		return http.StatusInsufficientStorage
+	case codes.DataLoss:
+		// The value did not match the checksum sent with it
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// newRouter returns a router that takes a client's address from
+// X-Forwarded-For or X-Real-IP only on requests from the comma-separated
+// proxies, given as addresses or CIDR ranges. With none, the address is always
+// the peer's, so callers can't forge the one the audit log records.
+func newRouter(trustedProxies string) (*gin.Engine, error) {
+	var proxies []string
+	for _, proxy := range strings.Split(trustedProxies, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
 	router := gin.Default()
+	if err := router.SetTrustedProxies(proxies); err != nil {
+		return nil, err
+	}
+	return router, nil
+}
+
+func main() {
+	// KV_TLS_CERT, KV_TLS_KEY and KV_TLS_CA turn on mutual TLS to the KV
+	// services and on the ShardAdmin port
+	tlsFiles, err := mtls.FromEnv(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load TLS files: %v", err)
+	}
+	creds := insecure.NewCredentials()
+	var adminOpts []grpc.ServerOption
+	if tlsFiles != nil {
+		creds = tlsFiles.Credentials()
+		adminOpts = append(adminOpts, grpc.Creds(creds))
+		log.Printf("Using mutual TLS to the KV service")
+	}
+	dial := kvDialer(creds)
+
+	// KV_SHARDS spreads the keyspace over several KV services; otherwise
+	// every request goes to KV_SERVICE_ADDR
+	var apiServer *APIServer
+	if spec := os.Getenv("KV_SHARDS"); spec != "" {
+		addrs, err := parseShards(spec)
+		if err != nil || len(addrs) == 0 {
+			log.Fatalf("Invalid KV_SHARDS %q: %v", spec, err)
+		}
+		vnodes := defaultVirtualNodes
+		if v := os.Getenv("KV_SHARD_VNODES"); v != "" {
+			if vnodes, err = strconv.Atoi(v); err != nil || vnodes < 1 {
+				log.Fatalf("Invalid KV_SHARD_VNODES %q", v)
+			}
+		}
+		apiServer, err = NewShardedAPIServer(addrs, vnodes, dial)
+		if err != nil {
+			log.Fatalf("Failed to connect to KV service: %v", err)
+		}
+		defer apiServer.Close()
+		// A rebalance may have changed the shards since KV_SHARDS was set
+		if err := apiServer.resumeRebalance(context.Background()); err != nil {
+			log.Fatalf("Failed to resume the last rebalance: %v", err)
+		}
+		log.Printf("Routing keys across %d shards", len(apiServer.shardAddrs()))
+
+		// Shards are added and removed through the ShardAdmin gRPC service
+		adminAddr := os.Getenv("ADMIN_LISTEN_ADDR")
+		if adminAddr == "" {
+			adminAddr = ":50052"
+		}
+		lis, err := net.Listen("tcp", adminAddr)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", adminAddr, err)
+		}
+		adminServer := grpc.NewServer(adminOpts...)
+		pb.RegisterShardAdminServer(adminServer, apiServer)
+		go func() {
+			if err := adminServer.Serve(lis); err != nil {
+				log.Fatalf("Failed to serve shard admin: %v", err)
+			}
+		}()
+		log.Printf("Shard admin gRPC server listening on %s", adminAddr)
+	} else {
+		// Get KV service address from environment variable or use default
+		kvServiceAddr := os.Getenv("KV_SERVICE_ADDR")
+		if kvServiceAddr == "" {
+			kvServiceAddr = "localhost:50051"
+		}
+
+		// Connect to KV store gRPC service
+		client, conn, err := dial(kvServiceAddr)
+		if err != nil {
+			log.Fatalf("Failed to connect to KV service: %v", err)
+		}
+		defer conn.Close()
+
+		apiServer = NewAPIServer(client)
+	}
+
+	// Set up Gin router
+	router, err := newRouter(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
+	// API_KEYS_FILE or API_KEYS_STORE turn on API key authentication, and
+	// JWT_JWKS bearer token authentication
+	if err := apiServer.configureAuth(context.Background()); err != nil {
+		log.Fatalf("Failed to configure authentication: %v", err)
+	}
+	if err := apiServer.configureJWT(context.Background()); err != nil {
+		log.Fatalf("Failed to configure bearer tokens: %v", err)
+	}
 
 	// Define REST API endpoints
-	router.POST("/kv", apiServer.SetHandler)
-	router.GET("/kv/:key", apiServer.GetHandler)
-	router.DELETE("/kv/:key", apiServer.DeleteHandler)
+	registerKVRoutes(router, apiServer)
 
 	// Health check endpoint
 	router.GET("/health", func(c *gin.Context) {
@@ -3,21 +3,57 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
 	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 // Mock KVStoreClient for testing
 type mockKVClient struct {
-	setFunc    func(ctx context.Context, req *pb.SetRequest, opts ...grpc.CallOption) (*pb.SetResponse, error)
-	getFunc    func(ctx context.Context, req *pb.GetRequest, opts ...grpc.CallOption) (*pb.GetResponse, error)
-	deleteFunc func(ctx context.Context, req *pb.DeleteRequest, opts ...grpc.CallOption) (*pb.DeleteResponse, error)
+	setFunc         func(ctx context.Context, req *pb.SetRequest, opts ...grpc.CallOption) (*pb.SetResponse, error)
+	getFunc         func(ctx context.Context, req *pb.GetRequest, opts ...grpc.CallOption) (*pb.GetResponse, error)
+	deleteFunc      func(ctx context.Context, req *pb.DeleteRequest, opts ...grpc.CallOption) (*pb.DeleteResponse, error)
+	getTTLFunc      func(ctx context.Context, req *pb.GetTTLRequest, opts ...grpc.CallOption) (*pb.GetTTLResponse, error)
+	touchFunc       func(ctx context.Context, req *pb.TouchRequest, opts ...grpc.CallOption) (*pb.TouchResponse, error)
+	casFunc         func(ctx context.Context, req *pb.CompareAndSetRequest, opts ...grpc.CallOption) (*pb.CompareAndSetResponse, error)
+	scanFunc        func(ctx context.Context, req *pb.ScanRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[pb.ScanResponse], error)
+	watchFunc       func(ctx context.Context, req *pb.WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[pb.WatchEvent], error)
+	txnFunc         func(ctx context.Context, req *pb.TxnRequest, opts ...grpc.CallOption) (*pb.TxnResponse, error)
+	batchGetFunc    func(ctx context.Context, req *pb.BatchGetRequest, opts ...grpc.CallOption) (*pb.BatchResponse, error)
+	batchSetFunc    func(ctx context.Context, req *pb.BatchSetRequest, opts ...grpc.CallOption) (*pb.BatchResponse, error)
+	batchDeleteFunc func(ctx context.Context, req *pb.BatchDeleteRequest, opts ...grpc.CallOption) (*pb.BatchResponse, error)
+	uploadFunc      func(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[pb.UploadRequest, pb.SetResponse], error)
+	downloadFunc    func(ctx context.Context, req *pb.DownloadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[pb.DownloadChunk], error)
+	exportFunc      func(ctx context.Context, req *pb.ExportRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[pb.Mutation], error)
+	importFunc      func(ctx context.Context, req *pb.ImportRequest, opts ...grpc.CallOption) (*pb.ImportResponse, error)
+}
+
+// mockScanStream replays a fixed list of scan results
+type mockScanStream struct {
+	grpc.ClientStream
+	items []*pb.ScanResponse
+}
+
+func (m *mockScanStream) Recv() (*pb.ScanResponse, error) {
+	if len(m.items) == 0 {
+		return nil, io.EOF
+	}
+	item := m.items[0]
+	m.items = m.items[1:]
+	return item, nil
 }
 
 func (m *mockKVClient) Set(ctx context.Context, req *pb.SetRequest, opts ...grpc.CallOption) (*pb.SetResponse, error) {
@@ -41,12 +77,219 @@ func (m *mockKVClient) Delete(ctx context.Context, req *pb.DeleteRequest, opts .
 	return &pb.DeleteResponse{Success: true, Message: "Key deleted successfully"}, nil
 }
 
+func (m *mockKVClient) GetTTL(ctx context.Context, req *pb.GetTTLRequest, opts ...grpc.CallOption) (*pb.GetTTLResponse, error) {
+	if m.getTTLFunc != nil {
+		return m.getTTLFunc(ctx, req, opts...)
+	}
+	return &pb.GetTTLResponse{Found: true, TtlSeconds: 60, Message: "TTL retrieved successfully"}, nil
+}
+
+func (m *mockKVClient) Touch(ctx context.Context, req *pb.TouchRequest, opts ...grpc.CallOption) (*pb.TouchResponse, error) {
+	if m.touchFunc != nil {
+		return m.touchFunc(ctx, req, opts...)
+	}
+	return &pb.TouchResponse{Success: true, Message: "TTL updated successfully"}, nil
+}
+
+func (m *mockKVClient) CompareAndSet(ctx context.Context, req *pb.CompareAndSetRequest, opts ...grpc.CallOption) (*pb.CompareAndSetResponse, error) {
+	if m.casFunc != nil {
+		return m.casFunc(ctx, req, opts...)
+	}
+	return &pb.CompareAndSetResponse{Success: true, Message: "Key set successfully", Version: 2}, nil
+}
+
+// mockWatchStream replays a fixed list of watch events and then ends
+type mockWatchStream struct {
+	grpc.ClientStream
+	headerErr error
+	events    []*pb.WatchEvent
+}
+
+func (m *mockWatchStream) Header() (metadata.MD, error) {
+	if m.headerErr != nil {
+		return nil, m.headerErr
+	}
+	return metadata.MD{}, nil
+}
+
+func (m *mockWatchStream) Recv() (*pb.WatchEvent, error) {
+	if len(m.events) == 0 {
+		return nil, io.EOF
+	}
+	event := m.events[0]
+	m.events = m.events[1:]
+	return event, nil
+}
+
+func (m *mockKVClient) Watch(ctx context.Context, req *pb.WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[pb.WatchEvent], error) {
+	if m.watchFunc != nil {
+		return m.watchFunc(ctx, req, opts...)
+	}
+	return &mockWatchStream{}, nil
+}
+
+func (m *mockKVClient) Scan(ctx context.Context, req *pb.ScanRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[pb.ScanResponse], error) {
+	if m.scanFunc != nil {
+		return m.scanFunc(ctx, req, opts...)
+	}
+	return &mockScanStream{}, nil
+}
+
+func (m *mockKVClient) Txn(ctx context.Context, req *pb.TxnRequest, opts ...grpc.CallOption) (*pb.TxnResponse, error) {
+	if m.txnFunc != nil {
+		return m.txnFunc(ctx, req, opts...)
+	}
+	return &pb.TxnResponse{Succeeded: true, Revision: 1}, nil
+}
+
+func (m *mockKVClient) BatchGet(ctx context.Context, req *pb.BatchGetRequest, opts ...grpc.CallOption) (*pb.BatchResponse, error) {
+	if m.batchGetFunc != nil {
+		return m.batchGetFunc(ctx, req, opts...)
+	}
+	return &pb.BatchResponse{}, nil
+}
+
+func (m *mockKVClient) BatchSet(ctx context.Context, req *pb.BatchSetRequest, opts ...grpc.CallOption) (*pb.BatchResponse, error) {
+	if m.batchSetFunc != nil {
+		return m.batchSetFunc(ctx, req, opts...)
+	}
+	return &pb.BatchResponse{}, nil
+}
+
+func (m *mockKVClient) BatchDelete(ctx context.Context, req *pb.BatchDeleteRequest, opts ...grpc.CallOption) (*pb.BatchResponse, error) {
+	if m.batchDeleteFunc != nil {
+		return m.batchDeleteFunc(ctx, req, opts...)
+	}
+	return &pb.BatchResponse{}, nil
+}
+
+// mockExportStream replays a fixed list of exported keys
+type mockExportStream struct {
+	grpc.ClientStream
+	muts []*pb.Mutation
+}
+
+func (m *mockExportStream) Recv() (*pb.Mutation, error) {
+	if len(m.muts) == 0 {
+		return nil, io.EOF
+	}
+	mut := m.muts[0]
+	m.muts = m.muts[1:]
+	return mut, nil
+}
+
+func (m *mockKVClient) Export(ctx context.Context, req *pb.ExportRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[pb.Mutation], error) {
+	if m.exportFunc != nil {
+		return m.exportFunc(ctx, req, opts...)
+	}
+	return &mockExportStream{}, nil
+}
+
+func (m *mockKVClient) Import(ctx context.Context, req *pb.ImportRequest, opts ...grpc.CallOption) (*pb.ImportResponse, error) {
+	if m.importFunc != nil {
+		return m.importFunc(ctx, req, opts...)
+	}
+	return &pb.ImportResponse{Revision: 1}, nil
+}
+
+// mockUploadStream collects the messages of an Upload and, once closed,
+// checks the checksum and stores the value through the mock's Set, or its
+// CompareAndSet for a conditional upload
+type mockUploadStream struct {
+	grpc.ClientStream
+	m    *mockKVClient
+	ctx  context.Context
+	msgs []*pb.UploadRequest
+}
+
+func (u *mockUploadStream) Send(msg *pb.UploadRequest) error {
+	// The sender reuses its buffer, as it may with a real stream
+	msg = &pb.UploadRequest{
+		Key: msg.Key, ContentType: msg.ContentType, TtlSeconds: msg.TtlSeconds, Size: msg.Size,
+		ExpectedVersion: msg.ExpectedVersion, MustNotExist: msg.MustNotExist,
+		Data: bytes.Clone(msg.Data), Sha256: msg.Sha256,
+	}
+	u.msgs = append(u.msgs, msg)
+	return nil
+}
+
+func (u *mockUploadStream) CloseAndRecv() (*pb.SetResponse, error) {
+	head := u.msgs[0]
+	var data []byte
+	var sum []byte
+	for _, msg := range u.msgs {
+		data = append(data, msg.Data...)
+		if len(msg.Sha256) > 0 {
+			sum = msg.Sha256
+		}
+	}
+	if got := sha256.Sum256(data); !bytes.Equal(got[:], sum) {
+		return nil, status.Error(codes.DataLoss, "value does not match its checksum")
+	}
+	if head.ExpectedVersion != 0 || head.MustNotExist {
+		resp, err := u.m.CompareAndSet(u.ctx, &pb.CompareAndSetRequest{
+			Key: head.Key, ValueBytes: data, ContentType: head.ContentType, TtlSeconds: head.TtlSeconds,
+			ExpectedVersion: head.ExpectedVersion, MustNotExist: head.MustNotExist,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !resp.Success {
+			return nil, status.Error(codes.FailedPrecondition, resp.Message)
+		}
+		return &pb.SetResponse{Success: true, Message: resp.Message, Version: resp.Version}, nil
+	}
+	return u.m.Set(u.ctx, &pb.SetRequest{Key: head.Key, ValueBytes: data, ContentType: head.ContentType, TtlSeconds: head.TtlSeconds})
+}
+
+func (m *mockKVClient) Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[pb.UploadRequest, pb.SetResponse], error) {
+	if m.uploadFunc != nil {
+		return m.uploadFunc(ctx, opts...)
+	}
+	return &mockUploadStream{m: m, ctx: ctx}, nil
+}
+
+// mockDownloadStream replays a fixed list of download chunks
+type mockDownloadStream struct {
+	grpc.ClientStream
+	chunks []*pb.DownloadChunk
+}
+
+func (m *mockDownloadStream) Recv() (*pb.DownloadChunk, error) {
+	if len(m.chunks) == 0 {
+		return nil, io.EOF
+	}
+	chunk := m.chunks[0]
+	m.chunks = m.chunks[1:]
+	return chunk, nil
+}
+
+// Download streams the value the mock's Get returns, in small chunks so that
+// callers see more than one
+func (m *mockKVClient) Download(ctx context.Context, req *pb.DownloadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[pb.DownloadChunk], error) {
+	if m.downloadFunc != nil {
+		return m.downloadFunc(ctx, req, opts...)
+	}
+	got, err := m.Get(ctx, &pb.GetRequest{Key: req.Key})
+	if err != nil {
+		return nil, err
+	}
+	if !got.Found {
+		return nil, status.Errorf(codes.NotFound, "Key '%s' not found", req.Key)
+	}
+	data := storedValue(got.Value, got.ValueBytes)
+	sum := sha256.Sum256(data)
+	chunks := []*pb.DownloadChunk{{Size: int64(len(data)), ContentType: got.ContentType, Version: got.Version, Sha256: sum[:]}}
+	for i := 0; i < len(data); i += 4 {
+		chunks = append(chunks, &pb.DownloadChunk{Data: data[i:min(i+4, len(data))]})
+	}
+	return &mockDownloadStream{chunks: chunks}, nil
+}
+
 func setupRouter(apiServer *APIServer) *gin.Engine {
 	gin.SetMode(gin.TestMode)
 	router := gin.New()
-	router.POST("/kv", apiServer.SetHandler)
-	router.GET("/kv/:key", apiServer.GetHandler)
-	router.DELETE("/kv/:key", apiServer.DeleteHandler)
+	registerKVRoutes(router, apiServer)
 	return router
 }
 
@@ -194,3 +437,705 @@ func TestDeleteHandlerNonExistentKey(t *testing.T) {
 		t.Errorf("Expected success=false, got %v", resp.Success)
 	}
 }
+
+func TestSetHandlerWithTTL(t *testing.T) {
+	var got *pb.SetRequest
+	mockClient := &mockKVClient{
+		setFunc: func(ctx context.Context, req *pb.SetRequest, opts ...grpc.CallOption) (*pb.SetResponse, error) {
+			got = req
+			return &pb.SetResponse{Success: true, Message: "Key set successfully"}, nil
+		},
+	}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	body := []byte(`{"key": "session", "value": "token", "ttl_seconds": 30}`)
+	req := httptest.NewRequest(http.MethodPost, "/kv", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if got == nil || got.TtlSeconds != 30 {
+		t.Errorf("Expected ttl_seconds=30 to be forwarded, got %v", got)
+	}
+}
+
+func TestSetHandlerNegativeTTL(t *testing.T) {
+	mockClient := &mockKVClient{}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	body := []byte(`{"key": "session", "value": "token", "ttl_seconds": -5}`)
+	req := httptest.NewRequest(http.MethodPost, "/kv", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestGetTTLHandler(t *testing.T) {
+	mockClient := &mockKVClient{}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/test-key/ttl", nil)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var resp TTLResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Errorf("Failed to unmarshal response: %v", err)
+	}
+	if !resp.Found || resp.TTLSeconds != 60 {
+		t.Errorf("Expected found=true ttl_seconds=60, got %v %v", resp.Found, resp.TTLSeconds)
+	}
+}
+
+func TestTouchHandler(t *testing.T) {
+	var got *pb.TouchRequest
+	mockClient := &mockKVClient{
+		touchFunc: func(ctx context.Context, req *pb.TouchRequest, opts ...grpc.CallOption) (*pb.TouchResponse, error) {
+			got = req
+			return &pb.TouchResponse{Success: true, Message: "TTL updated successfully"}, nil
+		},
+	}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	// A TTL of 0 is valid and clears the expiry
+	req := httptest.NewRequest(http.MethodPut, "/kv/test-key/ttl", bytes.NewBufferString(`{"ttl_seconds": 0}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if got == nil || got.Key != "test-key" || got.TtlSeconds != 0 {
+		t.Errorf("Unexpected Touch request %v", got)
+	}
+}
+
+func TestTouchHandlerNonExistentKey(t *testing.T) {
+	mockClient := &mockKVClient{
+		touchFunc: func(ctx context.Context, req *pb.TouchRequest, opts ...grpc.CallOption) (*pb.TouchResponse, error) {
+			return &pb.TouchResponse{Success: false, Message: "Key not found"}, nil
+		},
+	}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	req := httptest.NewRequest(http.MethodPut, "/kv/nonexistent/ttl", bytes.NewBufferString(`{"ttl_seconds": 10}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestGetHandlerETag(t *testing.T) {
+	mockClient := &mockKVClient{
+		getFunc: func(ctx context.Context, req *pb.GetRequest, opts ...grpc.CallOption) (*pb.GetResponse, error) {
+			return &pb.GetResponse{Found: true, Value: "v", Version: 7, Message: "Key retrieved successfully"}, nil
+		},
+	}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/test-key", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if etag := w.Header().Get("ETag"); etag != `"7"` {
+		t.Errorf("Expected ETag %q, got %q", `"7"`, etag)
+	}
+
+	// A matching If-None-Match means the client's copy is current
+	req = httptest.NewRequest(http.MethodGet, "/kv/test-key", nil)
+	req.Header.Set("If-None-Match", `"7"`)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected status %d, got %d", http.StatusNotModified, w.Code)
+	}
+}
+
+func TestPutHandlerUnconditional(t *testing.T) {
+	var got *pb.SetRequest
+	mockClient := &mockKVClient{
+		setFunc: func(ctx context.Context, req *pb.SetRequest, opts ...grpc.CallOption) (*pb.SetResponse, error) {
+			got = req
+			return &pb.SetResponse{Success: true, Message: "Key set successfully", Version: 3}, nil
+		},
+	}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	req := httptest.NewRequest(http.MethodPut, "/kv/test-key", bytes.NewBufferString(`{"value": "v"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if got == nil || got.Key != "test-key" || got.Value != "v" {
+		t.Errorf("Unexpected Set request %v", got)
+	}
+	if etag := w.Header().Get("ETag"); etag != `"3"` {
+		t.Errorf("Expected ETag %q, got %q", `"3"`, etag)
+	}
+}
+
+func TestPutHandlerIfMatch(t *testing.T) {
+	var got *pb.CompareAndSetRequest
+	mockClient := &mockKVClient{
+		casFunc: func(ctx context.Context, req *pb.CompareAndSetRequest, opts ...grpc.CallOption) (*pb.CompareAndSetResponse, error) {
+			got = req
+			return nil, status.Error(codes.FailedPrecondition, "key 'test-key' is at version 6, expected version 5")
+		},
+	}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	req := httptest.NewRequest(http.MethodPut, "/kv/test-key", bytes.NewBufferString(`{"value": "v"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", `"5"`)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status %d, got %d", http.StatusPreconditionFailed, w.Code)
+	}
+	if got == nil || got.ExpectedVersion != 5 || got.MustNotExist {
+		t.Errorf("Unexpected CompareAndSet request %v", got)
+	}
+}
+
+func TestPutHandlerIfMatchAny(t *testing.T) {
+	var got *pb.CompareAndSetRequest
+	mockClient := &mockKVClient{
+		casFunc: func(ctx context.Context, req *pb.CompareAndSetRequest, opts ...grpc.CallOption) (*pb.CompareAndSetResponse, error) {
+			got = req
+			return nil, status.Error(codes.FailedPrecondition, "key 'test-key' does not exist")
+		},
+	}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	req := httptest.NewRequest(http.MethodPut, "/kv/test-key", bytes.NewBufferString(`{"value": "v"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", "*")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status %d, got %d", http.StatusPreconditionFailed, w.Code)
+	}
+	if got == nil || !got.MustExist || got.ExpectedVersion != 0 || got.MustNotExist {
+		t.Errorf("Unexpected CompareAndSet request %v", got)
+	}
+}
+
+func TestPutHandlerIfNoneMatch(t *testing.T) {
+	var got *pb.CompareAndSetRequest
+	mockClient := &mockKVClient{
+		casFunc: func(ctx context.Context, req *pb.CompareAndSetRequest, opts ...grpc.CallOption) (*pb.CompareAndSetResponse, error) {
+			got = req
+			return &pb.CompareAndSetResponse{Success: true, Message: "Key set successfully", Version: 1}, nil
+		},
+	}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	req := httptest.NewRequest(http.MethodPut, "/kv/test-key", bytes.NewBufferString(`{"value": "v"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-None-Match", "*")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if got == nil || !got.MustNotExist {
+		t.Errorf("Unexpected CompareAndSet request %v", got)
+	}
+}
+
+func TestPutHandlerInvalidIfMatch(t *testing.T) {
+	mockClient := &mockKVClient{}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	req := httptest.NewRequest(http.MethodPut, "/kv/test-key", bytes.NewBufferString(`{"value": "v"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", "not-an-etag")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestDeleteHandlerIfMatch(t *testing.T) {
+	var got *pb.DeleteRequest
+	mockClient := &mockKVClient{
+		deleteFunc: func(ctx context.Context, req *pb.DeleteRequest, opts ...grpc.CallOption) (*pb.DeleteResponse, error) {
+			got = req
+			return &pb.DeleteResponse{Success: true, Message: "Key deleted successfully"}, nil
+		},
+	}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	req := httptest.NewRequest(http.MethodDelete, "/kv/test-key", nil)
+	req.Header.Set("If-Match", `W/"9"`)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if got == nil || got.ExpectedVersion != 9 {
+		t.Errorf("Unexpected Delete request %v", got)
+	}
+}
+
+func TestDeleteHandlerIfMatchAny(t *testing.T) {
+	mockClient := &mockKVClient{
+		deleteFunc: func(ctx context.Context, req *pb.DeleteRequest, opts ...grpc.CallOption) (*pb.DeleteResponse, error) {
+			return &pb.DeleteResponse{Success: false, Message: "Key 'test-key' not found"}, nil
+		},
+	}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	req := httptest.NewRequest(http.MethodDelete, "/kv/test-key", nil)
+	req.Header.Set("If-Match", "*")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status %d, got %d", http.StatusPreconditionFailed, w.Code)
+	}
+}
+
+func TestListHandlerPagination(t *testing.T) {
+	var got *pb.ScanRequest
+	mockClient := &mockKVClient{
+		scanFunc: func(ctx context.Context, req *pb.ScanRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[pb.ScanResponse], error) {
+			got = req
+			var items []*pb.ScanResponse
+			for i := 0; i < int(req.Limit); i++ {
+				items = append(items, &pb.ScanResponse{Key: fmt.Sprintf("user/%d", i), Value: "v", Version: 1})
+			}
+			return &mockScanStream{items: items}, nil
+		},
+	}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv?prefix=user/&limit=2", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if got.Prefix != "user/" || got.Limit != 3 {
+		t.Errorf("Unexpected Scan request %v", got)
+	}
+
+	var resp ListResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if len(resp.Items) != 2 || resp.NextCursor == "" {
+		t.Fatalf("Expected 2 items and a cursor, got %d items and cursor %q", len(resp.Items), resp.NextCursor)
+	}
+
+	// The cursor resumes at the first key not returned
+	req = httptest.NewRequest(http.MethodGet, "/kv?prefix=user/&limit=2&cursor="+resp.NextCursor, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if got.StartKey != "user/2" {
+		t.Errorf("Expected next page to start at %q, got %q", "user/2", got.StartKey)
+	}
+}
+
+func TestListHandlerLastPage(t *testing.T) {
+	mockClient := &mockKVClient{
+		scanFunc: func(ctx context.Context, req *pb.ScanRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[pb.ScanResponse], error) {
+			return &mockScanStream{items: []*pb.ScanResponse{{Key: "a", Value: "1"}}}, nil
+		},
+	}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var resp ListResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if len(resp.Items) != 1 || resp.NextCursor != "" {
+		t.Errorf("Expected 1 item and no cursor, got %d items and cursor %q", len(resp.Items), resp.NextCursor)
+	}
+}
+
+func TestListHandlerInvalidParams(t *testing.T) {
+	mockClient := &mockKVClient{}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	for _, query := range []string{"limit=0", "limit=abc", "limit=100000", "cursor=!!!"} {
+		req := httptest.NewRequest(http.MethodGet, "/kv?"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET /kv?%s: expected status %d, got %d", query, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestWatchHandler(t *testing.T) {
+	var got *pb.WatchRequest
+	mockClient := &mockKVClient{
+		watchFunc: func(ctx context.Context, req *pb.WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[pb.WatchEvent], error) {
+			got = req
+			return &mockWatchStream{events: []*pb.WatchEvent{
+				{Type: pb.WatchEvent_PUT, Key: "config/a", Value: "v1", Revision: 11},
+				{Type: pb.WatchEvent_DELETE, Key: "config/b", Revision: 12},
+			}}, nil
+		},
+	}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/watch?prefix=config/", nil)
+	req.Header.Set("Last-Event-ID", "10")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected Content-Type text/event-stream, got %q", ct)
+	}
+	if got == nil || got.Key != "config/" || !got.Prefix || got.StartRevision != 10 {
+		t.Errorf("Unexpected Watch request %v", got)
+	}
+
+	body := w.Body.String()
+	for _, want := range []string{
+		"id: 11\nevent: put\ndata: {\"type\":\"put\",\"key\":\"config/a\",\"value\":\"v1\",\"revision\":11}\n\n",
+		"id: 12\nevent: delete\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected body to contain %q, got %q", want, body)
+		}
+	}
+}
+
+func TestWatchHandlerResumesWithinRevision(t *testing.T) {
+	var got *pb.WatchRequest
+	mockClient := &mockKVClient{
+		watchFunc: func(ctx context.Context, req *pb.WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[pb.WatchEvent], error) {
+			got = req
+			return &mockWatchStream{events: []*pb.WatchEvent{
+				{Type: pb.WatchEvent_PUT, Key: "a", Value: "1", Revision: 5},
+				{Type: pb.WatchEvent_PUT, Key: "b", Value: "1", Revision: 5},
+				{Type: pb.WatchEvent_DELETE, Key: "c", Revision: 5},
+				{Type: pb.WatchEvent_PUT, Key: "a", Value: "2", Revision: 6},
+			}}, nil
+		},
+	}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	// The client saw the first two events of a transaction before it
+	// disconnected
+	req := httptest.NewRequest(http.MethodGet, "/kv/watch?prefix=", nil)
+	req.Header.Set("Last-Event-ID", "5.1")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if got == nil || got.StartRevision != 5 {
+		t.Errorf("Unexpected Watch request %v", got)
+	}
+	body := w.Body.String()
+	if strings.Contains(body, `"key":"a","value":"1"`) || strings.Contains(body, `"key":"b"`) {
+		t.Errorf("Expected the events already seen to be skipped, got %q", body)
+	}
+	for _, want := range []string{"id: 5.2\nevent: delete\n", "id: 6\nevent: put\n"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected body to contain %q, got %q", want, body)
+		}
+	}
+}
+
+func TestWatchHandlerCompacted(t *testing.T) {
+	mockClient := &mockKVClient{
+		watchFunc: func(ctx context.Context, req *pb.WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[pb.WatchEvent], error) {
+			return &mockWatchStream{headerErr: status.Error(codes.OutOfRange, "revision 1 has been compacted")}, nil
+		},
+	}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/watch?key=config&start_revision=1", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusGone {
+		t.Errorf("Expected status %d, got %d", http.StatusGone, w.Code)
+	}
+}
+
+func TestWatchHandlerInvalidParams(t *testing.T) {
+	mockClient := &mockKVClient{}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	for _, query := range []string{"", "key=a&prefix=b", "key=a&start_revision=x"} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/watch?"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET /kv/watch?%s: expected status %d, got %d", query, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestTxnHandler(t *testing.T) {
+	var got *pb.TxnRequest
+	mockClient := &mockKVClient{
+		txnFunc: func(ctx context.Context, req *pb.TxnRequest, opts ...grpc.CallOption) (*pb.TxnResponse, error) {
+			got = req
+			return &pb.TxnResponse{
+				Succeeded: true,
+				Revision:  7,
+				Results: []*pb.TxnOpResult{
+					{Type: pb.TxnOp_PUT, Key: "a", Version: 7},
+					{Type: pb.TxnOp_GET, Key: "b", Found: true, Value: "2", Version: 3},
+				},
+			}, nil
+		},
+	}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	body := `{
+		"compare": [{"key": "a", "target": "version", "result": "equal", "version": 0}],
+		"success": [{"op": "put", "key": "a", "value": "1", "ttl_seconds": 60}, {"op": "get", "key": "b"}],
+		"failure": [{"op": "delete", "key": "a"}]
+	}`
+	req := httptest.NewRequest(http.MethodPost, "/kv/txn", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if got == nil || len(got.Compare) != 1 || got.Compare[0].Target != pb.Compare_VERSION || got.Compare[0].Result != pb.Compare_EQUAL {
+		t.Errorf("Unexpected Txn compares %v", got)
+	}
+	if len(got.Success) != 2 || got.Success[0].Type != pb.TxnOp_PUT || got.Success[0].TtlSeconds != 60 {
+		t.Errorf("Unexpected Txn success ops %v", got.Success)
+	}
+	if len(got.Failure) != 1 || got.Failure[0].Type != pb.TxnOp_DELETE {
+		t.Errorf("Unexpected Txn failure ops %v", got.Failure)
+	}
+
+	var resp TxnResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if !resp.Succeeded || resp.Revision != 7 || len(resp.Results) != 2 {
+		t.Fatalf("Unexpected response %+v", resp)
+	}
+	if r := resp.Results[1]; r.Op != "get" || !r.Found || r.Value != "2" {
+		t.Errorf("Unexpected GET result %+v", r)
+	}
+}
+
+func TestTxnHandlerInvalidRequest(t *testing.T) {
+	apiServer := NewAPIServer(&mockKVClient{})
+	router := setupRouter(apiServer)
+
+	for _, body := range []string{
+		`{"compare": [{"key": "a", "target": "size", "result": "equal"}]}`,
+		`{"compare": [{"key": "a", "target": "value", "result": "like"}]}`,
+		`{"success": [{"op": "append", "key": "a"}]}`,
+		`{"failure": [{"op": "put", "key": "a", "ttl_seconds": -1}]}`,
+		`{"success": [{"op": "put"}]}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/kv/txn", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: Expected status %d, got %d", body, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestBatchHandlerSet(t *testing.T) {
+	var got *pb.BatchSetRequest
+	mockClient := &mockKVClient{
+		batchSetFunc: func(ctx context.Context, req *pb.BatchSetRequest, opts ...grpc.CallOption) (*pb.BatchResponse, error) {
+			got = req
+			return &pb.BatchResponse{Revision: 4, Results: []*pb.BatchResult{
+				{Key: "a", Success: true, Message: "Key 'a' set successfully", Version: 4},
+				{Key: "b", Message: "ttl_seconds must not be negative"},
+			}}, nil
+		},
+	}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	body := `{"op": "set", "items": [{"key": "a", "value": "1", "ttl_seconds": 30}, {"key": "b", "value": "2", "ttl_seconds": -1}]}`
+	req := httptest.NewRequest(http.MethodPost, "/kv/batch", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if got == nil || len(got.Items) != 2 || got.Items[0].TtlSeconds != 30 || got.Atomic {
+		t.Errorf("Unexpected BatchSet request %v", got)
+	}
+
+	var resp BatchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if resp.Revision != 4 || len(resp.Results) != 2 || !resp.Results[0].Success || resp.Results[1].Success {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+}
+
+func TestBatchHandlerGetAndDelete(t *testing.T) {
+	var gotGet *pb.BatchGetRequest
+	var gotDelete *pb.BatchDeleteRequest
+	mockClient := &mockKVClient{
+		batchGetFunc: func(ctx context.Context, req *pb.BatchGetRequest, opts ...grpc.CallOption) (*pb.BatchResponse, error) {
+			gotGet = req
+			return &pb.BatchResponse{Results: []*pb.BatchResult{{Key: "a", Success: true, Value: "1", Version: 2}}}, nil
+		},
+		batchDeleteFunc: func(ctx context.Context, req *pb.BatchDeleteRequest, opts ...grpc.CallOption) (*pb.BatchResponse, error) {
+			gotDelete = req
+			return nil, status.Error(codes.FailedPrecondition, "item 0 (key 'a'): key 'a' is at version 3, expected version 2")
+		},
+	}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	req := httptest.NewRequest(http.MethodPost, "/kv/batch", bytes.NewBufferString(`{"op": "get", "items": [{"key": "a"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if gotGet == nil || len(gotGet.Keys) != 1 || gotGet.Keys[0] != "a" {
+		t.Errorf("Unexpected BatchGet request %v", gotGet)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/kv/batch", bytes.NewBufferString(`{"op": "delete", "atomic": true, "items": [{"key": "a", "version": 2}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status %d, got %d", http.StatusPreconditionFailed, w.Code)
+	}
+	if gotDelete == nil || !gotDelete.Atomic || gotDelete.Items[0].ExpectedVersion != 2 {
+		t.Errorf("Unexpected BatchDelete request %v", gotDelete)
+	}
+}
+
+func TestBatchHandlerInvalidOp(t *testing.T) {
+	apiServer := NewAPIServer(&mockKVClient{})
+	router := setupRouter(apiServer)
+
+	req := httptest.NewRequest(http.MethodPost, "/kv/batch", bytes.NewBufferString(`{"op": "touch", "items": [{"key": "a"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestSetHandlerOnFollower(t *testing.T) {
+	mockClient := &mockKVClient{
+		setFunc: func(ctx context.Context, req *pb.SetRequest, opts ...grpc.CallOption) (*pb.SetResponse, error) {
+			st, _ := status.New(codes.FailedPrecondition, "this node is a read-only follower").WithDetails(&errdetails.ErrorInfo{
+				Reason:   "NOT_PRIMARY",
+				Metadata: map[string]string{"primary": "kv-primary:50051"},
+			})
+			return nil, st.Err()
+		},
+	}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	req := httptest.NewRequest(http.MethodPost, "/kv", bytes.NewBufferString(`{"key": "a", "value": "1"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+func TestSetHandlerContention(t *testing.T) {
+	mockClient := &mockKVClient{
+		setFunc: func(ctx context.Context, req *pb.SetRequest, opts ...grpc.CallOption) (*pb.SetResponse, error) {
+			return nil, status.Error(codes.Aborted, "the write conflicted with concurrent writes 16 times; retry")
+		},
+	}
+	apiServer := NewAPIServer(mockClient)
+	router := setupRouter(apiServer)
+
+	req := httptest.NewRequest(http.MethodPost, "/kv", bytes.NewBufferString(`{"key": "a", "value": "1"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d, got %d", http.StatusConflict, w.Code)
+	}
+}
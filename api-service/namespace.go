@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// kvRoutes are the prefixes the key routes are served under: /kv for the
+// default namespace and /ns/:namespace/kv for a named one
+var kvRoutes = []string{"/kv", "/ns/:namespace/kv"}
+
+// registerKVRoutes serves the key routes of every namespace on router
+func registerKVRoutes(router gin.IRouter, s *APIServer) {
+	for _, prefix := range kvRoutes {
+		kv := router.Group(prefix, s.Authenticate)
+		kv.GET("", s.ListHandler)
+		kv.POST("", s.SetHandler)
+		kv.GET("/watch", s.WatchHandler)
+		kv.POST("/txn", s.TxnHandler)
+		kv.POST("/batch", s.BatchHandler)
+		kv.GET("/:key", s.GetHandler)
+		kv.PUT("/:key", s.PutHandler)
+		kv.DELETE("/:key", s.DeleteHandler)
+		kv.GET("/:key/ttl", s.GetTTLHandler)
+		kv.PUT("/:key/ttl", s.TouchHandler)
+	}
+}
+
+// namespaceOf returns the namespace a request is addressed to, which is ""
+// for the default namespace
+func namespaceOf(c *gin.Context) string {
+	return c.Param("namespace")
+}
+
+// The KV service stores the keys of a named namespace behind a NUL byte, the
+// name and another NUL byte, and the settings of a namespace under two NUL
+// bytes and its name. A rebalance moves keys in that form, and routes them
+// by the key within their namespace, as requests are.
+const metaKeyPrefix = "\x00\x00"
+
+// storedKey returns the key the KV service stores key of namespace ns under
+func storedKey(ns, key string) string {
+	if ns == "" || ns == "default" {
+		return key
+	}
+	return "\x00" + ns + "\x00" + key
+}
+
+// splitStoredKey returns the namespace and key of a stored key, and whether
+// it holds the settings of namespace ns instead
+func splitStoredKey(stored string) (ns, key string, meta bool) {
+	if !strings.HasPrefix(stored, "\x00") {
+		return "", stored, false
+	}
+	if strings.HasPrefix(stored, metaKeyPrefix) {
+		return stored[len(metaKeyPrefix):], "", true
+	}
+	ns, key, _ = strings.Cut(stored[1:], "\x00")
+	return ns, key, false
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNamespacedRoutes(t *testing.T) {
+	got := make(map[string]string)
+	mockClient := &mockKVClient{
+		setFunc: func(ctx context.Context, req *pb.SetRequest, opts ...grpc.CallOption) (*pb.SetResponse, error) {
+			got["set"] = req.Namespace
+			return &pb.SetResponse{Success: true, Version: 1}, nil
+		},
+		getFunc: func(ctx context.Context, req *pb.GetRequest, opts ...grpc.CallOption) (*pb.GetResponse, error) {
+			got["get"] = req.Namespace
+			return &pb.GetResponse{Found: true, Value: "v", Version: 1}, nil
+		},
+		scanFunc: func(ctx context.Context, req *pb.ScanRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[pb.ScanResponse], error) {
+			got["scan"] = req.Namespace
+			return &mockScanStream{}, nil
+		},
+		txnFunc: func(ctx context.Context, req *pb.TxnRequest, opts ...grpc.CallOption) (*pb.TxnResponse, error) {
+			got["txn"] = req.Namespace
+			return &pb.TxnResponse{Succeeded: true}, nil
+		},
+		batchSetFunc: func(ctx context.Context, req *pb.BatchSetRequest, opts ...grpc.CallOption) (*pb.BatchResponse, error) {
+			got["batch"] = req.Namespace
+			return &pb.BatchResponse{}, nil
+		},
+	}
+	router := setupRouter(NewAPIServer(mockClient))
+
+	requests := []struct {
+		op, method, path, body string
+	}{
+		{"set", http.MethodPut, "/ns/team-a/kv/k", `{"value": "v"}`},
+		{"get", http.MethodGet, "/ns/team-a/kv/k", ""},
+		{"scan", http.MethodGet, "/ns/team-a/kv", ""},
+		{"txn", http.MethodPost, "/ns/team-a/kv/txn", `{"success": [{"op": "put", "key": "k", "value": "v"}]}`},
+		{"batch", http.MethodPost, "/ns/team-a/kv/batch", `{"op": "set", "items": [{"key": "k", "value": "v"}]}`},
+	}
+	for _, tt := range requests {
+		req := httptest.NewRequest(tt.method, tt.path, bytes.NewBufferString(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s %s: expected status %d, got %d: %s", tt.method, tt.path, http.StatusOK, w.Code, w.Body)
+		}
+		if got[tt.op] != "team-a" {
+			t.Errorf("%s %s: expected namespace team-a, got %q", tt.method, tt.path, got[tt.op])
+		}
+	}
+
+	// The /kv routes stay on the default namespace
+	req := httptest.NewRequest(http.MethodGet, "/kv/k", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || got["get"] != "" {
+		t.Errorf("Expected GET /kv/k in the default namespace, got %d in %q", w.Code, got["get"])
+	}
+}
+
+func TestNamespaceErrors(t *testing.T) {
+	quota, _ := status.New(codes.ResourceExhausted, "namespace 'team-a' is limited to 2 keys").WithDetails(&errdetails.ErrorInfo{
+		Reason:   "NAMESPACE_QUOTA_EXCEEDED",
+		Domain:   "kvstore",
+		Metadata: map[string]string{"namespace": "team-a", "quota": "keys", "limit": "2"},
+	})
+	tests := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"missing namespace", status.Error(codes.NotFound, "namespace 'team-a' not found"), http.StatusNotFound},
+		{"quota", quota.Err(), http.StatusInsufficientStorage},
+	}
+	for _, tt := range tests {
+		mockClient := &mockKVClient{
+			setFunc: func(ctx context.Context, req *pb.SetRequest, opts ...grpc.CallOption) (*pb.SetResponse, error) {
+				return nil, tt.err
+			},
+		}
+		router := setupRouter(NewAPIServer(mockClient))
+		req := httptest.NewRequest(http.MethodPut, "/ns/team-a/kv/k", bytes.NewBufferString(`{"value": "v"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.code, w.Code)
+		}
+	}
+}
+
+func TestShardedNamespacedRoutes(t *testing.T) {
+	apiServer, fc := newShardedServer(t, 3)
+	router := setupRouter(apiServer)
+
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		req := httptest.NewRequest(http.MethodPut, "/ns/team-a/kv/"+key, bytes.NewBufferString(`{"value": "v"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+		// Keys go to the owner of their key within the namespace
+		if _, ok := fc.shard(apiServer.ring.owner(key)).get(storedKey("team-a", key)); !ok {
+			t.Errorf("%s is not stored in team-a on its owner", key)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/ns/team-a/kv/key-7", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/kv/key-7", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for a key of another namespace, got %d", http.StatusNotFound, w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/ns/team-a/kv?limit=100", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var list ListResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Items) != 30 {
+		t.Errorf("Expected 30 keys listed across shards, got %d (%v)", len(list.Items), err)
+	}
+}
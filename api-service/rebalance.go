@@ -0,0 +1,736 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// rebalanceStripes is the number of locks that order the copy of a key
+	// against writes to it while a rebalance is moving it
+	rebalanceStripes = 256
+	// rebalanceOpTimeout bounds each RPC a rebalance makes for a single key
+	// or batch of keys
+	rebalanceOpTimeout = 5 * time.Second
+	// rebalanceCaller names a rebalance in the audit logs of the shards
+	rebalanceCaller = "rebalance"
+	// copyChunk is the most keys copied under one acquisition of their
+	// stripe locks
+	copyChunk = 128
+	// importBytes is roughly the most value bytes sent in one Import; a
+	// larger value is sent on its own
+	importBytes = 1 << 20
+	// pruneChunk is the most keys deleted in one Import, which is the KV
+	// service's limit per batch
+	pruneChunk = 1000
+	// dirtyPasses is how many times keys whose writes could not be copied
+	// are copied while writes go on, before the rest must fit in one chunk
+	// copied with writes held off
+	dirtyPasses = 3
+)
+
+// keyRange is an arc of the hash ring that moves from one shard to another:
+// the keys whose hash h satisfies start < h <= end, wrapping around the ring
+// when start >= end
+type keyRange struct {
+	start, end uint64
+	from, to   string
+	state      pb.KeyRange_State
+	copied     uint64
+}
+
+func (r *keyRange) contains(h uint64) bool {
+	if r.start < r.end {
+		return r.start < h && h <= r.end
+	}
+	return h > r.start || h <= r.end
+}
+
+// movedRanges returns the arcs whose owner differs between two rings, in
+// order of their end on the ring
+func movedRanges(from, next *hashRing) []*keyRange {
+	var ends []uint64
+	for _, p := range from.points {
+		ends = append(ends, p.hash)
+	}
+	for _, p := range next.points {
+		ends = append(ends, p.hash)
+	}
+	sort.Slice(ends, func(i, j int) bool { return ends[i] < ends[j] })
+
+	// Between two consecutive points of either ring both owners are fixed
+	var ranges []*keyRange
+	for i, end := range ends {
+		start := ends[(i+len(ends)-1)%len(ends)]
+		if i > 0 && start == end {
+			continue
+		}
+		a, b := from.ownerOfHash(end), next.ownerOfHash(end)
+		if a == b {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].end == start && ranges[n-1].from == a && ranges[n-1].to == b {
+			ranges[n-1].end = end
+			continue
+		}
+		ranges = append(ranges, &keyRange{start: start, end: end, from: a, to: b})
+	}
+	return ranges
+}
+
+// rebalance moves the keys whose owner changes when a shard is added or
+// removed, in every namespace. Keys are copied as the KV service stores
+// them, with their versions and expiry times, through its Export and Import
+// RPCs, and are routed by their key within their namespace, as requests are.
+// The settings of namespaces are copied to every shard that receives keys.
+// While the keys are copied, the old owners keep serving every request and
+// each moving key that a write changes is copied to its new owner again,
+// under a stripe lock that the write also holds. The new ring is then
+// swapped in while no write is in flight, and the old owners' copies are
+// deleted.
+type rebalance struct {
+	from, next *hashRing
+	// shards holds clients for the shards of both rings
+	shards  map[string]pb.KVStoreClient
+	added   string
+	removed string
+	// addedAddr and addedConn belong to the added shard until cutover
+	addedAddr string
+	addedConn io.Closer
+	ranges    []*keyRange // sorted by end; only ranges[0] can wrap
+	stripes   [rebalanceStripes]sync.Mutex
+
+	// mu guards the progress below
+	mu          sync.Mutex
+	state       pb.RebalanceStatusResponse_State
+	err         string
+	keysCopied  uint64
+	keysCleaned uint64
+	// dirty holds the stored keys whose write could not be copied to their
+	// new owner, which are copied again before cutover
+	dirty map[string]bool
+}
+
+// rangeFor returns the moving range that holds the ring position h, or nil
+func (rb *rebalance) rangeFor(h uint64) *keyRange {
+	if len(rb.ranges) == 0 {
+		return nil
+	}
+	i := sort.Search(len(rb.ranges), func(i int) bool { return rb.ranges[i].end >= h })
+	if i == len(rb.ranges) {
+		i = 0
+	}
+	if rb.ranges[i].contains(h) {
+		return rb.ranges[i]
+	}
+	return nil
+}
+
+// lockKeys takes the stripe locks of the keys that are moving, in a fixed
+// order, and returns a function that releases them
+func (rb *rebalance) lockKeys(keys []string) func() {
+	seen := make(map[int]bool)
+	var stripes []int
+	for _, key := range keys {
+		h := hashKey(key)
+		if rb.rangeFor(h) == nil {
+			continue
+		}
+		if i := int(h % rebalanceStripes); !seen[i] {
+			seen[i] = true
+			stripes = append(stripes, i)
+		}
+	}
+	sort.Ints(stripes)
+	for _, i := range stripes {
+		rb.stripes[i].Lock()
+	}
+	return func() {
+		for _, i := range stripes {
+			rb.stripes[i].Unlock()
+		}
+	}
+}
+
+// mirror copies keys of namespace ns that a write may have changed on their
+// old owners to their new owners, versions included. The caller holds their
+// stripe locks. Keys whose copy fails, or that are left uncopied because the
+// write ran out of time, are marked dirty.
+func (rb *rebalance) mirror(ctx context.Context, ns string, keys []string) {
+	byRange := make(map[*keyRange][]string)
+	for _, key := range keys {
+		if r := rb.rangeFor(hashKey(key)); r != nil {
+			byRange[r] = append(byRange[r], storedKey(ns, key))
+		}
+	}
+	for r, keys := range byRange {
+		for len(keys) > 0 {
+			chunk := keys[:min(len(keys), copyChunk)]
+			keys = keys[len(chunk):]
+			err := ctx.Err()
+			if err == nil {
+				err = transfer(ctx, rb.shards[r.from], rb.shards[r.to], chunk, true)
+			}
+			if err != nil {
+				log.Printf("Rebalance: failed to copy writes to shard %s: %v", r.to, err)
+				rb.mu.Lock()
+				for _, key := range chunk {
+					rb.dirty[key] = true
+				}
+				rb.mu.Unlock()
+			}
+		}
+	}
+}
+
+// takeDirty returns the dirty keys and clears them
+func (rb *rebalance) takeDirty() map[string]bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	dirty := rb.dirty
+	rb.dirty = make(map[string]bool)
+	return dirty
+}
+
+// dirtyKeys returns how many keys are dirty
+func (rb *rebalance) dirtyKeys() int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return len(rb.dirty)
+}
+
+// copyDirty copies dirty keys to their new owners
+func (rb *rebalance) copyDirty(dirty map[string]bool) error {
+	byRange := make(map[*keyRange][]string)
+	for key := range dirty {
+		_, k, _ := splitStoredKey(key)
+		if r := rb.rangeFor(hashKey(k)); r != nil {
+			byRange[r] = append(byRange[r], key)
+		}
+	}
+	for r, keys := range byRange {
+		for len(keys) > 0 {
+			chunk := keys[:min(len(keys), copyChunk)]
+			keys = keys[len(chunk):]
+			if err := rb.copyKeys(r, chunk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyKeys makes the new owner's copies of stored keys in r match the old
+// owner's, expiry times included
+func (rb *rebalance) copyKeys(r *keyRange, keys []string) error {
+	userKeys := make([]string, len(keys))
+	for i, key := range keys {
+		_, userKeys[i], _ = splitStoredKey(key)
+	}
+	unlock := rb.lockKeys(userKeys)
+	defer unlock()
+
+	ctx, cancel := context.WithTimeout(rebalanceContext(), streamTimeout)
+	defer cancel()
+
+	if err := transfer(ctx, rb.shards[r.from], rb.shards[r.to], keys, true); err != nil {
+		return err
+	}
+
+	rb.mu.Lock()
+	r.copied += uint64(len(keys))
+	rb.keysCopied += uint64(len(keys))
+	rb.mu.Unlock()
+	return nil
+}
+
+// copyFrom copies the keys that move off shard id to their new owners, in
+// batches of the keys of one range. The settings of namespaces sort before
+// every key, so they reach each shard that receives keys from id first.
+func (rb *rebalance) copyFrom(id string) error {
+	var (
+		metas   []string
+		pending = make(map[*keyRange][]string)
+		started bool
+	)
+	copyMetas := func() error {
+		started = true
+		ctx, cancel := context.WithTimeout(rebalanceContext(), streamTimeout)
+		defer cancel()
+		for len(metas) > 0 {
+			chunk := metas[:min(len(metas), copyChunk)]
+			metas = metas[len(chunk):]
+			for _, to := range rb.receivers(id) {
+				if err := transfer(ctx, rb.shards[id], rb.shards[to], chunk, false); err != nil {
+					return fmt.Errorf("failed to copy the settings of namespaces to shard %s: %w", to, err)
+				}
+			}
+		}
+		return nil
+	}
+	err := forEachKey(rb.shards[id], func(key string) error {
+		_, k, meta := splitStoredKey(key)
+		if meta {
+			metas = append(metas, key)
+			return nil
+		}
+		if !started {
+			if err := copyMetas(); err != nil {
+				return err
+			}
+		}
+		r := rb.rangeFor(hashKey(k))
+		if r == nil || r.from != id {
+			return nil
+		}
+		pending[r] = append(pending[r], key)
+		if len(pending[r]) < copyChunk {
+			return nil
+		}
+		keys := pending[r]
+		delete(pending, r)
+		return rb.copyKeys(r, keys)
+	})
+	if err == nil && !started {
+		err = copyMetas()
+	}
+	for r, keys := range pending {
+		if err == nil {
+			err = rb.copyKeys(r, keys)
+		}
+	}
+	return err
+}
+
+// transfer exports stored keys from src and imports them into dst. With
+// deleteMissing, keys src no longer has, or that have expired, are deleted
+// from dst.
+func transfer(ctx context.Context, src, dst pb.KVStoreClient, keys []string, deleteMissing bool) error {
+	// A single value may be as large as the KV service allows
+	stream, err := src.Export(ctx, &pb.ExportRequest{Keys: keys}, grpc.MaxCallRecvMsgSize(math.MaxInt32))
+	if err != nil {
+		return err
+	}
+	var (
+		batch []*pb.Mutation
+		size  int
+		found = make(map[string]bool)
+	)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := dst.Import(ctx, &pb.ImportRequest{Mutations: batch})
+		batch, size = nil, 0
+		return err
+	}
+	for {
+		m, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		found[m.Key] = true
+		if size+len(m.Value) > importBytes {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		batch = append(batch, m)
+		size += len(m.Value)
+	}
+	if deleteMissing {
+		for _, key := range keys {
+			if !found[key] {
+				batch = append(batch, &pb.Mutation{Op: pb.Mutation_DELETE, Key: key})
+			}
+		}
+	}
+	return flush()
+}
+
+// setRanges moves every range matching match to state
+func (rb *rebalance) setRanges(state pb.KeyRange_State, match func(*keyRange) bool) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	for _, r := range rb.ranges {
+		if match(r) {
+			r.state = state
+		}
+	}
+}
+
+func (rb *rebalance) setState(state pb.RebalanceStatusResponse_State, err error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.state = state
+	if err != nil {
+		rb.err = err.Error()
+	}
+}
+
+// active reports whether the rebalance has not yet finished or failed
+func (rb *rebalance) active() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.state != pb.RebalanceStatusResponse_DONE && rb.state != pb.RebalanceStatusResponse_FAILED
+}
+
+// endpoints returns the sorted IDs of the shards that give or receive keys
+func (rb *rebalance) endpoints(to bool) []string {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, r := range rb.ranges {
+		id := r.from
+		if to {
+			id = r.to
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// receivers returns the sorted IDs of the shards that receive keys from id
+func (rb *rebalance) receivers(id string) []string {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, r := range rb.ranges {
+		if r.from == id && !seen[r.to] {
+			seen[r.to] = true
+			ids = append(ids, r.to)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// forEachKey streams every key stored on a shard, in the form the KV service
+// stores it, in key order. The stored status of rebalances is left out.
+func forEachKey(client pb.KVStoreClient, fn func(key string) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.Export(ctx, &pb.ExportRequest{KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	for {
+		item, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if item.Key == rebalanceStateKey {
+			continue
+		}
+		if err := fn(item.Key); err != nil {
+			return err
+		}
+	}
+}
+
+// prune deletes the keys a shard holds but does not own on ring, such as
+// copies left by a failed rebalance or the old copies of moved keys. The
+// settings of namespaces stay on every shard.
+func prune(client pb.KVStoreClient, ring *hashRing, id string) (uint64, error) {
+	var stale []string
+	err := forEachKey(client, func(key string) error {
+		if _, k, meta := splitStoredKey(key); !meta && ring.owner(k) != id {
+			stale = append(stale, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	n := uint64(len(stale))
+	for len(stale) > 0 {
+		chunk := stale[:min(len(stale), pruneChunk)]
+		stale = stale[len(chunk):]
+		muts := make([]*pb.Mutation, len(chunk))
+		for i, key := range chunk {
+			muts[i] = &pb.Mutation{Op: pb.Mutation_DELETE, Key: key}
+		}
+		ctx, cancel := context.WithTimeout(rebalanceContext(), rebalanceOpTimeout)
+		_, err := client.Import(ctx, &pb.ImportRequest{Mutations: muts})
+		cancel()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// runRebalance carries a rebalance through to cutover and cleanup. Its
+// status is stored on the shards at each step, and the cutover only happens
+// once every shard has stored it.
+func (s *APIServer) runRebalance(rb *rebalance) {
+	save := func() {
+		if err := s.saveRebalance(rb, s.shardAddrs()); err != nil {
+			log.Printf("Rebalance: failed to store its status: %v", err)
+		}
+	}
+	fail := func(err error) {
+		log.Printf("Rebalance failed: %v", err)
+		s.mu.Lock()
+		s.moving = nil
+		s.mu.Unlock()
+		if rb.addedConn != nil {
+			rb.addedConn.Close()
+		}
+		rb.setState(pb.RebalanceStatusResponse_FAILED, err)
+		save()
+	}
+	save()
+
+	// Clear out anything the receiving shards hold in the moving ranges
+	// before writes start being copied to them
+	for _, id := range rb.endpoints(true) {
+		if _, err := prune(rb.shards[id], rb.from, id); err != nil {
+			fail(fmt.Errorf("failed to clear shard %s: %w", id, err))
+			return
+		}
+	}
+
+	// From here on writes to moving keys are applied to both owners. The
+	// lock waits out writes that were routed before.
+	s.mu.Lock()
+	s.moving = rb
+	s.mu.Unlock()
+
+	for _, id := range rb.endpoints(false) {
+		fromID := func(r *keyRange) bool { return r.from == id }
+		rb.setRanges(pb.KeyRange_COPYING, fromID)
+		if err := rb.copyFrom(id); err != nil {
+			fail(fmt.Errorf("failed to copy keys from shard %s: %w", id, err))
+			return
+		}
+		rb.setRanges(pb.KeyRange_COPIED, fromID)
+		save()
+	}
+
+	// Copy the writes that could not be copied when they happened while
+	// writes go on, until few enough are left to copy with writes held off
+	for pass := 0; pass < dirtyPasses && rb.dirtyKeys() > copyChunk; pass++ {
+		if err := rb.copyDirty(rb.takeDirty()); err != nil {
+			fail(fmt.Errorf("failed to copy keys written during the rebalance: %w", err))
+			return
+		}
+	}
+
+	// Cut over with no write in flight, after copying the rest
+	s.mu.Lock()
+	rb.setState(pb.RebalanceStatusResponse_CUTOVER, nil)
+	dirty := rb.takeDirty()
+	if len(dirty) > copyChunk {
+		s.mu.Unlock()
+		fail(fmt.Errorf("%d keys written during the rebalance could not be copied", len(dirty)))
+		return
+	}
+	if err := rb.copyDirty(dirty); err != nil {
+		s.mu.Unlock()
+		fail(fmt.Errorf("failed to copy keys written during the rebalance: %w", err))
+		return
+	}
+	shards := make(map[string]pb.KVStoreClient)
+	addrs := make(map[string]string)
+	closers := make(map[string]io.Closer)
+	for _, id := range rb.next.shards() {
+		shards[id] = rb.shards[id]
+		addrs[id] = s.addrs[id]
+		closers[id] = s.closers[id]
+	}
+	var removed io.Closer
+	if rb.added != "" {
+		addrs[rb.added], closers[rb.added] = rb.addedAddr, rb.addedConn
+	} else {
+		removed = s.closers[rb.removed]
+	}
+	// A gateway that restarts from here on routes by the new ring
+	if err := s.saveRebalance(rb, addrs); err != nil {
+		s.mu.Unlock()
+		fail(fmt.Errorf("failed to store the cutover: %w", err))
+		return
+	}
+	s.ring, s.shards, s.addrs, s.closers = rb.next, shards, addrs, closers
+	s.moving = nil
+	s.mu.Unlock()
+	rb.setRanges(pb.KeyRange_DONE, func(*keyRange) bool { return true })
+	rb.setState(pb.RebalanceStatusResponse_CLEANUP, nil)
+	log.Printf("Rebalance cut over to shards %v", rb.next.shards())
+
+	if removed != nil {
+		removed.Close()
+	}
+	s.cleanup(rb)
+}
+
+// cleanup deletes the old owners' copies of moved keys once a rebalance has
+// cut over, since they are no longer read. A removed shard is simply dropped.
+func (s *APIServer) cleanup(rb *rebalance) {
+	for _, id := range rb.endpoints(false) {
+		if id == rb.removed || !rb.next.ids[id] {
+			continue
+		}
+		n, err := prune(rb.shards[id], rb.next, id)
+		rb.mu.Lock()
+		rb.keysCleaned += n
+		rb.mu.Unlock()
+		if err != nil {
+			rb.setState(pb.RebalanceStatusResponse_FAILED, fmt.Errorf("cut over, but failed to delete moved keys from shard %s: %w", id, err))
+			break
+		}
+	}
+	if rb.active() {
+		rb.setState(pb.RebalanceStatusResponse_DONE, nil)
+	}
+	if err := s.saveRebalance(rb, s.shardAddrs()); err != nil {
+		log.Printf("Rebalance: failed to store its status: %v", err)
+	}
+}
+
+// AddShard starts moving the keys a new shard takes over to it
+func (s *APIServer) AddShard(ctx context.Context, req *pb.AddShardRequest) (*pb.RebalanceStatusResponse, error) {
+	if req.Id == "" || req.Address == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "id and address are required")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkRebalanceLocked(); err != nil {
+		return nil, err
+	}
+	if _, ok := s.shards[req.Id]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "shard %s already exists", req.Id)
+	}
+	client, conn, err := s.dial(req.Address)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to connect to shard %s: %v", req.Id, err)
+	}
+
+	next := s.ring.clone()
+	next.add(req.Id)
+	rb := s.newRebalanceLocked(next)
+	rb.shards[req.Id] = client
+	rb.added, rb.addedAddr, rb.addedConn = req.Id, req.Address, conn
+	log.Printf("Rebalance: adding shard %s at %s, moving %d ranges", req.Id, req.Address, len(rb.ranges))
+	go s.runRebalance(rb)
+	return s.statusLocked(), nil
+}
+
+// RemoveShard starts moving a shard's keys to the shards that take them
+// over. The shard is dropped once they have cut over.
+func (s *APIServer) RemoveShard(ctx context.Context, req *pb.RemoveShardRequest) (*pb.RebalanceStatusResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkRebalanceLocked(); err != nil {
+		return nil, err
+	}
+	if _, ok := s.shards[req.Id]; !ok {
+		return nil, status.Errorf(codes.NotFound, "shard %s does not exist", req.Id)
+	}
+	if len(s.shards) == 1 {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot remove the last shard")
+	}
+
+	next := s.ring.clone()
+	next.remove(req.Id)
+	rb := s.newRebalanceLocked(next)
+	rb.removed = req.Id
+	log.Printf("Rebalance: removing shard %s, moving %d ranges", req.Id, len(rb.ranges))
+	go s.runRebalance(rb)
+	return s.statusLocked(), nil
+}
+
+// RebalanceStatus reports the shards and the progress of the last rebalance
+func (s *APIServer) RebalanceStatus(ctx context.Context, req *pb.RebalanceStatusRequest) (*pb.RebalanceStatusResponse, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.ring == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "the gateway is not sharded")
+	}
+	return s.statusLocked(), nil
+}
+
+// checkRebalanceLocked refuses to start a rebalance while another one runs
+func (s *APIServer) checkRebalanceLocked() error {
+	if s.ring == nil {
+		return status.Errorf(codes.FailedPrecondition, "the gateway is not sharded")
+	}
+	if s.rebalance != nil && s.rebalance.active() {
+		return status.Errorf(codes.FailedPrecondition, "a rebalance is already running")
+	}
+	return nil
+}
+
+// newRebalanceLocked plans the move from the current ring to next
+func (s *APIServer) newRebalanceLocked(next *hashRing) *rebalance {
+	rb := &rebalance{
+		from:   s.ring,
+		next:   next,
+		shards: make(map[string]pb.KVStoreClient),
+		ranges: movedRanges(s.ring, next),
+		state:  pb.RebalanceStatusResponse_COPYING,
+		dirty:  make(map[string]bool),
+	}
+	for id, client := range s.shards {
+		rb.shards[id] = client
+	}
+	s.rebalance = rb
+	return rb
+}
+
+func (s *APIServer) statusLocked() *pb.RebalanceStatusResponse {
+	resp := &pb.RebalanceStatusResponse{}
+	for _, id := range s.ring.shards() {
+		resp.Shards = append(resp.Shards, &pb.Shard{Id: id, Address: s.addrs[id]})
+	}
+	if s.rebalance != nil {
+		s.rebalance.fill(resp)
+	}
+	return resp
+}
+
+// fill reports the progress of the rebalance in resp
+func (rb *rebalance) fill(resp *pb.RebalanceStatusResponse) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	resp.State = rb.state
+	resp.Error = rb.err
+	resp.KeysCopied = rb.keysCopied
+	resp.KeysCleaned = rb.keysCleaned
+	for _, r := range rb.ranges {
+		resp.Ranges = append(resp.Ranges, &pb.KeyRange{
+			Start:      r.start,
+			End:        r.end,
+			From:       r.from,
+			To:         r.to,
+			State:      r.state,
+			KeysCopied: r.copied,
+		})
+	}
+}
+
+// rebalanceContext returns a context that names the rebalance as the caller
+// in the audit logs of the shards whose keys it moves
+func rebalanceContext() context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), callerHeader, rebalanceCaller)
+}
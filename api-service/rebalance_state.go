@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// rebalanceStateKey is the stored key under which every shard holds the
+// status of the latest rebalance. Clients can't create its namespace, so no
+// request reaches it, and rebalances neither move nor prune it.
+const rebalanceStateKey = "\x00_rebalance\x00status"
+
+// shardAddrs returns the addresses of the shards that own keys
+func (s *APIServer) shardAddrs() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.addrs
+}
+
+// saveRebalance stores the status of rb, with owners as the shards that own
+// keys, on every shard rb involves. The error names each shard that failed
+// to store it.
+func (s *APIServer) saveRebalance(rb *rebalance, owners map[string]string) error {
+	st := &pb.RebalanceStatusResponse{}
+	for _, id := range sortedIDs(owners) {
+		st.Shards = append(st.Shards, &pb.Shard{Id: id, Address: owners[id]})
+	}
+	rb.fill(st)
+	value, err := proto.Marshal(&pb.RebalanceState{Sequence: s.stateSeq.Add(1), Status: st})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(rebalanceContext(), rebalanceOpTimeout)
+	defer cancel()
+	req := &pb.ImportRequest{Mutations: []*pb.Mutation{{Op: pb.Mutation_SET, Key: rebalanceStateKey, Value: value}}}
+	var errs []error
+	for _, id := range sortedIDs(rb.shards) {
+		if _, err := rb.shards[id].Import(ctx, req); err != nil {
+			errs = append(errs, fmt.Errorf("shard %s: %w", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// readRebalance returns the rebalance status a shard holds, or nil if it
+// holds none
+func readRebalance(ctx context.Context, client pb.KVStoreClient) (*pb.RebalanceState, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.Export(ctx, &pb.ExportRequest{Keys: []string{rebalanceStateKey}})
+	if err != nil {
+		return nil, err
+	}
+	m, err := stream.Recv()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &pb.RebalanceState{}
+	if err := proto.Unmarshal(m.Value, state); err != nil {
+		return nil, fmt.Errorf("malformed rebalance status: %w", err)
+	}
+	return state, nil
+}
+
+// resumeRebalance picks up the latest rebalance from the newest status stored
+// on the configured shards. The shards it lists replace the configured ones,
+// since the rebalance may have changed them. A rebalance that had not cut
+// over is failed, leaving routing as it was, and one that had has its cleanup
+// finished.
+func (s *APIServer) resumeRebalance(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var latest *pb.RebalanceState
+	for _, id := range s.ring.shards() {
+		state, err := readRebalance(ctx, s.shards[id])
+		if err != nil {
+			log.Printf("Failed to read the rebalance status from shard %s: %v", id, err)
+			continue
+		}
+		if state != nil && (latest == nil || state.Sequence > latest.Sequence) {
+			latest = state
+		}
+	}
+	if latest == nil || latest.Status == nil {
+		return nil
+	}
+	s.stateSeq.Store(latest.Sequence)
+	st := latest.Status
+	if err := s.useShardsLocked(st.Shards); err != nil {
+		return err
+	}
+
+	rb := &rebalance{
+		next:        s.ring,
+		shards:      make(map[string]pb.KVStoreClient),
+		state:       st.State,
+		err:         st.Error,
+		keysCopied:  st.KeysCopied,
+		keysCleaned: st.KeysCleaned,
+		dirty:       make(map[string]bool),
+	}
+	for id, client := range s.shards {
+		rb.shards[id] = client
+	}
+	for _, r := range st.Ranges {
+		rb.ranges = append(rb.ranges, &keyRange{start: r.Start, end: r.End, from: r.From, to: r.To, state: r.State, copied: r.KeysCopied})
+	}
+	s.rebalance = rb
+	log.Printf("Routing by the shards of the last rebalance: %v", s.ring.shards())
+
+	switch st.State {
+	case pb.RebalanceStatusResponse_COPYING:
+		rb.state, rb.err = pb.RebalanceStatusResponse_FAILED, "the gateway restarted before cutover"
+		log.Printf("Rebalance failed: %s", rb.err)
+		if err := s.saveRebalance(rb, s.addrs); err != nil {
+			log.Printf("Rebalance: failed to store its status: %v", err)
+		}
+	case pb.RebalanceStatusResponse_CUTOVER, pb.RebalanceStatusResponse_CLEANUP:
+		rb.state = pb.RebalanceStatusResponse_CLEANUP
+		log.Printf("Rebalance: finishing the cleanup after cutover")
+		go s.cleanup(rb)
+	}
+	return nil
+}
+
+// useShardsLocked routes by shards instead of the current ones, keeping the
+// connections to shards whose address is unchanged
+func (s *APIServer) useShardsLocked(shards []*pb.Shard) error {
+	if len(shards) == 0 {
+		return fmt.Errorf("the stored rebalance status lists no shards")
+	}
+	ring := newHashRing(s.ring.vnodes)
+	clients := make(map[string]pb.KVStoreClient)
+	addrs := make(map[string]string)
+	closers := make(map[string]io.Closer)
+	for _, sh := range shards {
+		if addr, ok := s.addrs[sh.Id]; ok && addr == sh.Address {
+			clients[sh.Id], closers[sh.Id] = s.shards[sh.Id], s.closers[sh.Id]
+		} else {
+			client, closer, err := s.dial(sh.Address)
+			if err != nil {
+				for id, c := range closers {
+					if c != nil && c != s.closers[id] {
+						c.Close()
+					}
+				}
+				return fmt.Errorf("failed to connect to shard %s: %w", sh.Id, err)
+			}
+			clients[sh.Id], closers[sh.Id] = client, closer
+		}
+		addrs[sh.Id] = sh.Address
+		ring.add(sh.Id)
+	}
+	for id, c := range s.closers {
+		if c != nil && closers[id] != c {
+			c.Close()
+		}
+	}
+	s.ring, s.shards, s.addrs, s.closers = ring, clients, addrs, closers
+	return nil
+}
+
+// sortedIDs returns the keys of a map of shards in order
+func sortedIDs[V any](m map[string]V) []string {
+	ids := make([]string, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// restartGateway builds a new gateway over the shards of fc, configured with
+// the given shards only, and resumes the last rebalance
+func restartGateway(t *testing.T, fc *fakeCluster, ids ...string) *APIServer {
+	t.Helper()
+	addrs := make(map[string]string)
+	for _, id := range ids {
+		addrs[id] = "addr-" + id
+	}
+	apiServer, err := NewShardedAPIServer(addrs, defaultVirtualNodes, fc.dial)
+	if err != nil {
+		t.Fatalf("NewShardedAPIServer() error = %v", err)
+	}
+	if err := apiServer.resumeRebalance(context.Background()); err != nil {
+		t.Fatalf("resumeRebalance() error = %v", err)
+	}
+	return apiServer
+}
+
+// storedRebalance decodes the rebalance status a fake shard holds
+func storedRebalance(t *testing.T, f *fakeShard) *pb.RebalanceState {
+	t.Helper()
+	value, ok := f.get(rebalanceStateKey)
+	if !ok {
+		t.Fatalf("no rebalance status stored")
+	}
+	state := &pb.RebalanceState{}
+	if err := proto.Unmarshal([]byte(value), state); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	return state
+}
+
+func TestRebalanceSurvivesGatewayRestart(t *testing.T) {
+	apiServer, fc := newShardedServer(t, 2)
+	router := setupRouter(apiServer)
+	want := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		want[key] = "v"
+		putKey(t, router, key, "v")
+	}
+	if _, err := apiServer.AddShard(context.Background(), &pb.AddShardRequest{Id: "shard-2", Address: "addr-shard-2"}); err != nil {
+		t.Fatalf("AddShard() error = %v", err)
+	}
+	done := waitRebalance(t, apiServer)
+	if done.State != pb.RebalanceStatusResponse_DONE {
+		t.Fatalf("rebalance ended in %v: %s", done.State, done.Error)
+	}
+
+	// A gateway still configured with the old shards routes by the new ones
+	restarted := restartGateway(t, fc, "shard-0", "shard-1")
+	st, _ := restarted.RebalanceStatus(context.Background(), &pb.RebalanceStatusRequest{})
+	if st.State != pb.RebalanceStatusResponse_DONE || len(st.Shards) != 3 || st.KeysCopied != done.KeysCopied {
+		t.Fatalf("RebalanceStatus() after restart = %+v, want the finished rebalance over 3 shards", st)
+	}
+	checkPlacement(t, restarted, fc, want)
+	if got := fc.shard("shard-2").len(); got == 0 {
+		t.Errorf("the new shard holds no keys")
+	}
+
+	// One that restarts after cutover finishes the cleanup. Leave a moved
+	// key behind on its old owner, as a cleanup cut short would.
+	var moved string
+	for key := range want {
+		if restarted.ring.owner(key) == "shard-2" {
+			moved = key
+			break
+		}
+	}
+	old := apiServer.ring.clone()
+	old.remove("shard-2")
+	stale := fc.shard(old.owner(moved))
+	stale.store[moved] = "v"
+	state := storedRebalance(t, stale)
+	state.Sequence++
+	state.Status.State = pb.RebalanceStatusResponse_CUTOVER
+	value, _ := proto.Marshal(state)
+	for _, id := range restarted.ring.shards() {
+		fc.shard(id).store[rebalanceStateKey] = string(value)
+	}
+
+	restarted = restartGateway(t, fc, "shard-0")
+	if st := waitRebalance(t, restarted); st.State != pb.RebalanceStatusResponse_DONE {
+		t.Fatalf("resumed cleanup ended in %v: %s", st.State, st.Error)
+	}
+	checkPlacement(t, restarted, fc, want)
+	if got := storedRebalance(t, fc.shard("shard-1")); got.Sequence <= state.Sequence || got.Status.State != pb.RebalanceStatusResponse_DONE {
+		t.Errorf("stored status after the cleanup = %v, want a newer DONE", got)
+	}
+}
+
+func TestRebalanceInterruptedBeforeCutover(t *testing.T) {
+	_, fc := newShardedServer(t, 2)
+	state := &pb.RebalanceState{Sequence: 4, Status: &pb.RebalanceStatusResponse{
+		State:  pb.RebalanceStatusResponse_COPYING,
+		Shards: []*pb.Shard{{Id: "shard-0", Address: "addr-shard-0"}, {Id: "shard-1", Address: "addr-shard-1"}},
+	}}
+	value, _ := proto.Marshal(state)
+	fc.shard("shard-1").store[rebalanceStateKey] = string(value)
+
+	restarted := restartGateway(t, fc, "shard-0", "shard-1")
+	st, _ := restarted.RebalanceStatus(context.Background(), &pb.RebalanceStatusRequest{})
+	if st.State != pb.RebalanceStatusResponse_FAILED || st.Error == "" || len(st.Shards) != 2 {
+		t.Errorf("RebalanceStatus() after restart = %+v, want a failed rebalance over the old shards", st)
+	}
+	for _, id := range []string{"shard-0", "shard-1"} {
+		if got := storedRebalance(t, fc.shard(id)); got.Sequence != 5 || got.Status.State != pb.RebalanceStatusResponse_FAILED {
+			t.Errorf("stored status on %s = %v, want the failure", id, got)
+		}
+	}
+	// A new rebalance can start
+	if _, err := restarted.AddShard(context.Background(), &pb.AddShardRequest{Id: "shard-2", Address: "addr-shard-2"}); err != nil {
+		t.Errorf("AddShard() after restart error = %v", err)
+	}
+	waitRebalance(t, restarted)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// putKey stores a value through the REST API
+func putKey(t *testing.T, router http.Handler, key, value string) {
+	t.Helper()
+	body, _ := json.Marshal(PutRequest{Value: value})
+	req := httptest.NewRequest(http.MethodPut, "/kv/"+key, bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("PUT %s: Expected status %d, got %d", key, http.StatusOK, w.Code)
+	}
+}
+
+// waitRebalance polls RebalanceStatus until the rebalance has finished
+func waitRebalance(t *testing.T, s *APIServer) *pb.RebalanceStatusResponse {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		st, err := s.RebalanceStatus(context.Background(), &pb.RebalanceStatusRequest{})
+		if err != nil {
+			t.Fatalf("RebalanceStatus() error = %v", err)
+		}
+		if st.State == pb.RebalanceStatusResponse_DONE || st.State == pb.RebalanceStatusResponse_FAILED {
+			return st
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("rebalance did not finish")
+	return nil
+}
+
+// checkPlacement verifies that every key is stored on its owner only
+func checkPlacement(t *testing.T, s *APIServer, fc *fakeCluster, want map[string]string) {
+	t.Helper()
+	for key, value := range want {
+		owner := s.ring.owner(key)
+		for _, id := range s.ring.shards() {
+			got, ok := fc.shard(id).get(key)
+			switch {
+			case id == owner && (!ok || got != value):
+				t.Errorf("key %s on its owner %s = %q, %v; want %q", key, id, got, ok, value)
+			case id != owner && ok:
+				t.Errorf("key %s is still stored on %s, which does not own it", key, id)
+			}
+		}
+	}
+}
+
+func TestMovedRanges(t *testing.T) {
+	from := newHashRing(16)
+	from.add("a")
+	from.add("b")
+	next := from.clone()
+	next.add("c")
+	rb := &rebalance{ranges: movedRanges(from, next)}
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		h := rng.Uint64()
+		r := rb.rangeFor(h)
+		a, b := from.ownerOfHash(h), next.ownerOfHash(h)
+		if (r != nil) != (a != b) {
+			t.Fatalf("rangeFor(%d) = %v, but owners are %s and %s", h, r, a, b)
+		}
+		if r != nil && (r.from != a || r.to != b) {
+			t.Fatalf("rangeFor(%d) moves %s to %s, want %s to %s", h, r.from, r.to, a, b)
+		}
+	}
+	for _, h := range []uint64{0, ^uint64(0)} {
+		if r := rb.rangeFor(h); (r != nil) != (from.ownerOfHash(h) != next.ownerOfHash(h)) {
+			t.Errorf("rangeFor(%d) = %v at the edge of the ring", h, r)
+		}
+	}
+}
+
+func TestRebalanceAddShard(t *testing.T) {
+	apiServer, fc := newShardedServer(t, 3)
+	router := setupRouter(apiServer)
+
+	want := make(map[string]string)
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		want[key] = "v" + key
+		putKey(t, router, key, want[key])
+	}
+
+	st, err := apiServer.AddShard(context.Background(), &pb.AddShardRequest{Id: "shard-3", Address: "addr-shard-3"})
+	if err != nil {
+		t.Fatalf("AddShard() error = %v", err)
+	}
+	if len(st.Ranges) == 0 {
+		t.Fatalf("AddShard() planned no ranges")
+	}
+	st = waitRebalance(t, apiServer)
+	if st.State != pb.RebalanceStatusResponse_DONE {
+		t.Fatalf("rebalance ended in %v: %s", st.State, st.Error)
+	}
+	if len(st.Shards) != 4 || st.KeysCopied == 0 || st.KeysCleaned != st.KeysCopied {
+		t.Errorf("Unexpected status %+v", st)
+	}
+	for _, r := range st.Ranges {
+		if r.To != "shard-3" || r.State != pb.KeyRange_DONE {
+			t.Errorf("Unexpected range %+v", r)
+		}
+	}
+
+	checkPlacement(t, apiServer, fc, want)
+	if fc.shard("shard-3").len() == 0 {
+		t.Errorf("the new shard received no keys")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/kv?limit=1000", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var list ListResponse
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Items) != len(want) {
+		t.Errorf("Expected %d keys listed after the rebalance, got %d", len(want), len(list.Items))
+	}
+}
+
+func TestRebalanceKeepsConcurrentWrites(t *testing.T) {
+	apiServer, fc := newShardedServer(t, 2)
+	router := setupRouter(apiServer)
+	for i := 0; i < 200; i++ {
+		putKey(t, router, fmt.Sprintf("key-%d", i), "initial")
+	}
+
+	// Writers keep overwriting and deleting keys until the rebalance is done
+	var (
+		mu   sync.Mutex
+		want = make(map[string]string)
+		stop = make(chan struct{})
+		wg   sync.WaitGroup
+	)
+	for i := 0; i < 200; i++ {
+		want[fmt.Sprintf("key-%d", i)] = "initial"
+	}
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// Each writer owns the keys congruent to g, so the last value
+				// it wrote is the expected one
+				key := fmt.Sprintf("key-%d", (n*4+g)%200)
+				if n%5 == 4 {
+					req := httptest.NewRequest(http.MethodDelete, "/kv/"+key, nil)
+					router.ServeHTTP(httptest.NewRecorder(), req)
+					mu.Lock()
+					delete(want, key)
+					mu.Unlock()
+					continue
+				}
+				value := fmt.Sprintf("w%d-%d", g, n)
+				putKey(t, router, key, value)
+				mu.Lock()
+				want[key] = value
+				mu.Unlock()
+			}
+		}()
+	}
+
+	fc.shard("shard-0").exportDelay = 100 * time.Microsecond
+	fc.shard("shard-1").exportDelay = 100 * time.Microsecond
+	if _, err := apiServer.AddShard(context.Background(), &pb.AddShardRequest{Id: "shard-2", Address: "addr-shard-2"}); err != nil {
+		t.Fatalf("AddShard() error = %v", err)
+	}
+	st := waitRebalance(t, apiServer)
+	close(stop)
+	wg.Wait()
+	if st.State != pb.RebalanceStatusResponse_DONE {
+		t.Fatalf("rebalance ended in %v: %s", st.State, st.Error)
+	}
+
+	checkPlacement(t, apiServer, fc, want)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if _, ok := want[key]; ok {
+			continue
+		}
+		if _, ok := fc.shard(apiServer.ring.owner(key)).get(key); ok {
+			t.Errorf("deleted key %s came back after the rebalance", key)
+		}
+	}
+}
+
+func TestRebalanceCopiesWritesThatFail(t *testing.T) {
+	apiServer, fc := newShardedServer(t, 2)
+	router := setupRouter(apiServer)
+	want := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		putKey(t, router, key, "initial")
+		want[key] = "initial"
+	}
+
+	// Sets are applied but time out, and the rebalance waits before listing
+	// shard-1, by when the keys of shard-0 have been copied
+	for _, id := range []string{"shard-0", "shard-1"} {
+		client, _, _ := fc.dial("addr-" + id)
+		set := client.(*mockKVClient).setFunc
+		client.(*mockKVClient).setFunc = func(ctx context.Context, req *pb.SetRequest, opts ...grpc.CallOption) (*pb.SetResponse, error) {
+			set(ctx, req, opts...)
+			return nil, status.Error(codes.DeadlineExceeded, "context deadline exceeded")
+		}
+	}
+	listing, resume := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	client, _, _ := fc.dial("addr-shard-1")
+	export := client.(*mockKVClient).exportFunc
+	client.(*mockKVClient).exportFunc = func(ctx context.Context, req *pb.ExportRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[pb.Mutation], error) {
+		if req.KeysOnly {
+			once.Do(func() {
+				close(listing)
+				<-resume
+			})
+		}
+		return export(ctx, req, opts...)
+	}
+
+	if _, err := apiServer.AddShard(context.Background(), &pb.AddShardRequest{Id: "shard-2", Address: "addr-shard-2"}); err != nil {
+		t.Fatalf("AddShard() error = %v", err)
+	}
+	<-listing
+	next := apiServer.rebalance.next
+	updated := 0
+	for key := range want {
+		if apiServer.ring.owner(key) != "shard-0" || next.owner(key) != "shard-2" {
+			continue
+		}
+		body, _ := json.Marshal(PutRequest{Value: "updated"})
+		req := httptest.NewRequest(http.MethodPut, "/kv/"+key, bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusGatewayTimeout {
+			t.Errorf("PUT %s: Expected status %d, got %d", key, http.StatusGatewayTimeout, w.Code)
+		}
+		want[key] = "updated"
+		updated++
+	}
+	close(resume)
+	if updated == 0 {
+		t.Fatalf("no key moves from shard-0 to shard-2")
+	}
+
+	if st := waitRebalance(t, apiServer); st.State != pb.RebalanceStatusResponse_DONE {
+		t.Fatalf("rebalance ended in %v: %s", st.State, st.Error)
+	}
+	checkPlacement(t, apiServer, fc, want)
+}
+
+func TestRebalanceRemoveShard(t *testing.T) {
+	apiServer, fc := newShardedServer(t, 3)
+	router := setupRouter(apiServer)
+	want := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		want[key] = "v"
+		putKey(t, router, key, "v")
+	}
+
+	if _, err := apiServer.RemoveShard(context.Background(), &pb.RemoveShardRequest{Id: "shard-1"}); err != nil {
+		t.Fatalf("RemoveShard() error = %v", err)
+	}
+	st := waitRebalance(t, apiServer)
+	if st.State != pb.RebalanceStatusResponse_DONE || len(st.Shards) != 2 {
+		t.Fatalf("Unexpected status %+v", st)
+	}
+	for _, r := range st.Ranges {
+		if r.From != "shard-1" {
+			t.Errorf("Unexpected range %+v", r)
+		}
+	}
+	checkPlacement(t, apiServer, fc, want)
+}
+
+func TestRebalanceMovesNamespaces(t *testing.T) {
+	apiServer, fc := newShardedServer(t, 2)
+	router := setupRouter(apiServer)
+	settings := metaKeyPrefix + "team-a"
+	for _, id := range []string{"shard-0", "shard-1"} {
+		fc.shard(id).store[settings] = "settings"
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		req := httptest.NewRequest(http.MethodPut, "/ns/team-a/kv/"+key, bytes.NewBufferString(`{"value": "v"}`))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if _, err := apiServer.AddShard(context.Background(), &pb.AddShardRequest{Id: "shard-2", Address: "addr-shard-2"}); err != nil {
+		t.Fatalf("AddShard() error = %v", err)
+	}
+	if st := waitRebalance(t, apiServer); st.State != pb.RebalanceStatusResponse_DONE {
+		t.Fatalf("rebalance ended in %v: %s", st.State, st.Error)
+	}
+
+	// The new shard got the namespace's settings, and no shard lost them
+	for _, id := range apiServer.ring.shards() {
+		if _, ok := fc.shard(id).get(settings); !ok {
+			t.Errorf("shard %s has no settings for team-a", id)
+		}
+	}
+	moved := 0
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owner := apiServer.ring.owner(key)
+		for _, id := range apiServer.ring.shards() {
+			if _, ok := fc.shard(id).get(storedKey("team-a", key)); ok != (id == owner) {
+				t.Errorf("%s stored on %s = %v, want it on its owner %s only", key, id, ok, owner)
+			}
+		}
+		if owner == "shard-2" {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Errorf("no key of team-a moved to the new shard")
+	}
+}
+
+func TestRebalanceFailureKeepsRouting(t *testing.T) {
+	apiServer, fc := newShardedServer(t, 2)
+	router := setupRouter(apiServer)
+	for i := 0; i < 50; i++ {
+		putKey(t, router, fmt.Sprintf("key-%d", i), "v")
+	}
+
+	// The new shard rejects every copy
+	client, _, _ := fc.dial("addr-broken")
+	client.(*mockKVClient).importFunc = func(ctx context.Context, req *pb.ImportRequest, opts ...grpc.CallOption) (*pb.ImportResponse, error) {
+		return nil, status.Error(codes.Unavailable, "connection refused")
+	}
+	if _, err := apiServer.AddShard(context.Background(), &pb.AddShardRequest{Id: "broken", Address: "addr-broken"}); err != nil {
+		t.Fatalf("AddShard() error = %v", err)
+	}
+	st := waitRebalance(t, apiServer)
+	if st.State != pb.RebalanceStatusResponse_FAILED || st.Error == "" || len(st.Shards) != 2 {
+		t.Fatalf("Unexpected status %+v", st)
+	}
+
+	for i := 0; i < 50; i++ {
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/kv/key-%d", i), nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+}
+
+func TestShardAdminErrors(t *testing.T) {
+	ctx := context.Background()
+	if _, err := NewAPIServer(&mockKVClient{}).AddShard(ctx, &pb.AddShardRequest{Id: "a", Address: "b"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("AddShard() without shards error = %v, want FailedPrecondition", err)
+	}
+
+	apiServer, _ := newShardedServer(t, 1)
+	tests := []struct {
+		name string
+		call func() error
+		want codes.Code
+	}{
+		{"missing address", func() error {
+			_, err := apiServer.AddShard(ctx, &pb.AddShardRequest{Id: "x"})
+			return err
+		}, codes.InvalidArgument},
+		{"duplicate shard", func() error {
+			_, err := apiServer.AddShard(ctx, &pb.AddShardRequest{Id: "shard-0", Address: "addr"})
+			return err
+		}, codes.AlreadyExists},
+		{"unknown shard", func() error {
+			_, err := apiServer.RemoveShard(ctx, &pb.RemoveShardRequest{Id: "x"})
+			return err
+		}, codes.NotFound},
+		{"last shard", func() error {
+			_, err := apiServer.RemoveShard(ctx, &pb.RemoveShardRequest{Id: "shard-0"})
+			return err
+		}, codes.FailedPrecondition},
+	}
+	for _, tt := range tests {
+		if err := tt.call(); status.Code(err) != tt.want {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
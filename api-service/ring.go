@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultVirtualNodes is how many points each shard gets on the hash ring.
+// More points spread keys more evenly at the cost of a larger ring.
+const defaultVirtualNodes = 128
+
+// hashRing assigns keys to shards by consistent hashing. Each shard owns
+// the arcs of the ring that end at one of its virtual nodes, so adding or
+// removing a shard only moves the keys on the arcs it gains or loses.
+type hashRing struct {
+	vnodes int
+	points []ringPoint // sorted by hash
+	ids    map[string]bool
+}
+
+type ringPoint struct {
+	hash  uint64
+	shard string
+}
+
+func newHashRing(vnodes int) *hashRing {
+	if vnodes <= 0 {
+		vnodes = defaultVirtualNodes
+	}
+	return &hashRing{vnodes: vnodes, ids: make(map[string]bool)}
+}
+
+// hashKey maps a string onto the ring. FNV-1a is cheap but mixes short,
+// similar strings poorly, so its result goes through the splitmix64
+// finalizer to spread virtual nodes such as "a#1" and "a#2" apart.
+func hashKey(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// add places a shard's virtual nodes on the ring. Adding a shard twice is a
+// no-op.
+func (r *hashRing) add(id string) {
+	if r.ids[id] {
+		return
+	}
+	r.ids[id] = true
+	for i := 0; i < r.vnodes; i++ {
+		r.points = append(r.points, ringPoint{hash: hashKey(id + "#" + strconv.Itoa(i)), shard: id})
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].shard < r.points[j].shard
+	})
+}
+
+// remove takes a shard's virtual nodes off the ring
+func (r *hashRing) remove(id string) {
+	if !r.ids[id] {
+		return
+	}
+	delete(r.ids, id)
+	kept := r.points[:0]
+	for _, p := range r.points {
+		if p.shard != id {
+			kept = append(kept, p)
+		}
+	}
+	r.points = kept
+}
+
+// clone returns a copy of the ring. Rings that are routing requests are
+// never changed in place; a rebalance changes a clone and swaps it in.
+func (r *hashRing) clone() *hashRing {
+	c := &hashRing{vnodes: r.vnodes, points: append([]ringPoint(nil), r.points...), ids: make(map[string]bool)}
+	for id := range r.ids {
+		c.ids[id] = true
+	}
+	return c
+}
+
+// owner returns the shard that owns key, or "" if the ring is empty
+func (r *hashRing) owner(key string) string {
+	return r.ownerOfHash(hashKey(key))
+}
+
+// ownerOfHash returns the shard whose arc contains the ring position h
+func (r *hashRing) ownerOfHash(h uint64) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].shard
+}
+
+// shards returns the IDs of the shards on the ring in sorted order
+func (r *hashRing) shards() []string {
+	ids := make([]string, 0, len(r.ids))
+	for id := range r.ids {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// parseShards parses KV_SHARDS, a comma-separated list of id=address pairs.
+// The ID rather than the address places a shard on the ring, so a shard can
+// move to a new address without moving its keys.
+func parseShards(s string) (map[string]string, error) {
+	shards := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, addr, ok := strings.Cut(pair, "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("invalid shard %q, want id=address", pair)
+		}
+		if _, dup := shards[id]; dup {
+			return nil, fmt.Errorf("duplicate shard id %q", id)
+		}
+		shards[id] = addr
+	}
+	return shards, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashRingSpreadsKeys(t *testing.T) {
+	ring := newHashRing(defaultVirtualNodes)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		ring.add(id)
+	}
+
+	counts := make(map[string]int)
+	const keys = 40000
+	for i := 0; i < keys; i++ {
+		counts[ring.owner(fmt.Sprintf("key-%d", i))]++
+	}
+	for id, n := range counts {
+		// Each shard should get its quarter of the keys, give or take
+		if n < keys/4*7/10 || n > keys/4*13/10 {
+			t.Errorf("shard %s owns %d of %d keys, want about %d", id, n, keys, keys/4)
+		}
+	}
+	if len(counts) != 4 {
+		t.Errorf("keys landed on %d shards, want 4", len(counts))
+	}
+}
+
+func TestHashRingMovesOnlyAffectedKeys(t *testing.T) {
+	ring := newHashRing(defaultVirtualNodes)
+	for _, id := range []string{"a", "b", "c"} {
+		ring.add(id)
+	}
+	before := make(map[string]string)
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		before[key] = ring.owner(key)
+	}
+
+	// A new shard only takes keys, it never moves them between old shards
+	ring.add("d")
+	moved := 0
+	for key, old := range before {
+		if owner := ring.owner(key); owner != old {
+			if owner != "d" {
+				t.Fatalf("key %s moved from %s to %s after adding d", key, old, owner)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > len(before)/3 {
+		t.Errorf("%d of %d keys moved to the new shard, want about a quarter", moved, len(before))
+	}
+
+	// Removing it hands exactly those keys back
+	ring.remove("d")
+	for key, old := range before {
+		if owner := ring.owner(key); owner != old {
+			t.Errorf("key %s is owned by %s after removing d, want %s", key, owner, old)
+		}
+	}
+	if got := ring.shards(); len(got) != 3 {
+		t.Errorf("shards() = %v, want 3 shards", got)
+	}
+}
+
+func TestHashRingEmpty(t *testing.T) {
+	ring := newHashRing(0)
+	if owner := ring.owner("key"); owner != "" {
+		t.Errorf("owner() on an empty ring = %q, want \"\"", owner)
+	}
+}
+
+func TestParseShards(t *testing.T) {
+	shards, err := parseShards("s1=kv1:50051, s2=kv2:50051,")
+	if err != nil {
+		t.Fatalf("parseShards() error = %v", err)
+	}
+	if len(shards) != 2 || shards["s2"] != "kv2:50051" {
+		t.Errorf("parseShards() = %v", shards)
+	}
+
+	for _, bad := range []string{"kv1:50051", "s1=", "s1=a:1,s1=b:2"} {
+		if _, err := parseShards(bad); err == nil {
+			t.Errorf("parseShards(%q) error = nil, want an error", bad)
+		}
+	}
+}
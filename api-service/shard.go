@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// dialFunc connects to the KV service at addr
+type dialFunc func(addr string) (pb.KVStoreClient, io.Closer, error)
+
+// kvDialer returns a dialFunc that connects to KV services with creds
+func kvDialer(creds credentials.TransportCredentials) dialFunc {
+	return func(addr string) (pb.KVStoreClient, io.Closer, error) {
+		conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, nil, err
+		}
+		return pb.NewKVStoreClient(conn), conn, nil
+	}
+}
+
+// NewShardedAPIServer creates an API server that spreads keys over several
+// KV services, given as shard IDs mapped to addresses, using a consistent
+// hash ring
+func NewShardedAPIServer(addrs map[string]string, vnodes int, dial dialFunc) (*APIServer, error) {
+	s := &APIServer{
+		ring:    newHashRing(vnodes),
+		shards:  make(map[string]pb.KVStoreClient),
+		addrs:   make(map[string]string),
+		closers: make(map[string]io.Closer),
+		dial:    dial,
+	}
+	for id, addr := range addrs {
+		client, closer, err := dial(addr)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to connect to shard %s: %w", id, err)
+		}
+		s.ring.add(id)
+		s.shards[id], s.addrs[id], s.closers[id] = client, addr, closer
+	}
+	return s, nil
+}
+
+// Close closes the connections to the shards
+func (s *APIServer) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, closer := range s.closers {
+		if closer != nil {
+			closer.Close()
+		}
+	}
+}
+
+// route pins where a request's keys are sent. A write route holds the
+// routing read lock until it is released, so a rebalance cannot cut over
+// while the write is in flight, along with the stripe locks of any keys a
+// rebalance is copying, so that the copy of a key and the writes to it reach
+// the new owner in order.
+type route struct {
+	kv      pb.KVStoreClient
+	ring    *hashRing
+	shards  map[string]pb.KVStoreClient
+	moving  *rebalance
+	release func()
+}
+
+// routeRead returns the current routing without holding any lock
+func (s *APIServer) routeRead() *route {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return &route{kv: s.kvClient, ring: s.ring, shards: s.shards, release: func() {}}
+}
+
+// routeWrite pins the routing of a write to keys until release is called
+func (s *APIServer) routeWrite(keys ...string) *route {
+	s.mu.RLock()
+	r := &route{kv: s.kvClient, ring: s.ring, shards: s.shards, moving: s.moving, release: s.mu.RUnlock}
+	if r.moving != nil {
+		unlock := r.moving.lockKeys(keys)
+		r.release = func() {
+			unlock()
+			s.mu.RUnlock()
+		}
+	}
+	return r
+}
+
+// owner returns the ID of the shard that owns key, or "" without shards
+func (r *route) owner(key string) string {
+	if r.ring == nil {
+		return ""
+	}
+	return r.ring.owner(key)
+}
+
+// client returns the client of the KV service that owns key
+func (r *route) client(key string) pb.KVStoreClient {
+	if r.ring == nil {
+		return r.kv
+	}
+	return r.shards[r.ring.owner(key)]
+}
+
+// sameShard reports whether every one of keys belongs to one shard
+func (r *route) sameShard(keys []string) bool {
+	for _, key := range keys {
+		if r.owner(key) != r.owner(keys[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// mirror copies keys of namespace ns that a write may have changed to their
+// new owners, if they are being moved. Writes call it whatever their outcome,
+// since one that failed, such as by timing out, may still have been applied.
+func (r *route) mirror(ctx context.Context, ns string, keys ...string) {
+	if r.moving != nil {
+		r.moving.mirror(ctx, ns, keys)
+	}
+}
+
+// clientFor returns the client of the KV service that currently owns key.
+// Writes use routeWrite instead.
+func (s *APIServer) clientFor(key string) pb.KVStoreClient {
+	return s.routeRead().client(key)
+}
+
+// scanStream is the receiving side of a Scan, possibly merged across shards
+type scanStream interface {
+	Recv() (*pb.ScanResponse, error)
+}
+
+// scan starts a Scan on every shard and merges the results in key order.
+// Keys a shard holds but does not own, such as copies made by a rebalance
+// that has not cut over or not yet cleaned up, are skipped. Since any number
+// of them can come before the keys of a page, shards are scanned without a
+// limit and the streams are cancelled once the caller has its page.
+func (s *APIServer) scan(ctx context.Context, req *pb.ScanRequest) (scanStream, error) {
+	r := s.routeRead()
+	if r.ring == nil {
+		return s.kvClient.Scan(ctx, req)
+	}
+	req = &pb.ScanRequest{Namespace: req.Namespace, StartKey: req.StartKey, EndKey: req.EndKey, Prefix: req.Prefix}
+	m := &mergedScan{}
+	for _, id := range r.ring.shards() {
+		stream, err := r.shards[id].Scan(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		m.streams = append(m.streams, &ownedScan{stream: stream, ring: r.ring, id: id})
+	}
+	return m, nil
+}
+
+// ownedScan passes on the keys of one shard's scan that the shard owns
+type ownedScan struct {
+	stream scanStream
+	ring   *hashRing
+	id     string
+}
+
+func (o *ownedScan) Recv() (*pb.ScanResponse, error) {
+	for {
+		item, err := o.stream.Recv()
+		if err != nil || o.ring.owner(item.Key) == o.id {
+			return item, err
+		}
+	}
+}
+
+// mergedScan merges per-shard scans, each already in key order. Shards own
+// disjoint keys, so the merge never sees a key twice.
+type mergedScan struct {
+	streams []scanStream
+	heads   []*pb.ScanResponse // next item of each stream, nil once it ends
+	started bool
+}
+
+func (m *mergedScan) Recv() (*pb.ScanResponse, error) {
+	if !m.started {
+		m.started = true
+		m.heads = make([]*pb.ScanResponse, len(m.streams))
+		for i := range m.streams {
+			if err := m.advance(i); err != nil {
+				return nil, err
+			}
+		}
+	}
+	next := -1
+	for i, head := range m.heads {
+		if head != nil && (next < 0 || head.Key < m.heads[next].Key) {
+			next = i
+		}
+	}
+	if next < 0 {
+		return nil, io.EOF
+	}
+	item := m.heads[next]
+	if err := m.advance(next); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// advance reads the next item of stream i into its head
+func (m *mergedScan) advance(i int) error {
+	item, err := m.streams[i].Recv()
+	if err == io.EOF {
+		m.heads[i] = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	m.heads[i] = item
+	return nil
+}
+
+// batch runs a batch on the shards that own its keys. A batch that spans
+// shards is split into one RPC per shard, run in parallel, and the results
+// are put back in request order. Only a batch within one shard can be atomic,
+// and the revision of a split batch is reported as 0 since each shard numbers
+// its revisions separately.
+func (s *APIServer) batch(ctx context.Context, req BatchRequest) (*pb.BatchResponse, error) {
+	keys := make([]string, len(req.Items))
+	for i, item := range req.Items {
+		keys[i] = item.Key
+	}
+	var w *route
+	if req.Op == "get" {
+		w = s.routeRead()
+	} else {
+		w = s.routeWrite(keys...)
+	}
+	defer w.release()
+	if req.Op != "get" {
+		defer w.mirror(ctx, req.Namespace, keys...)
+	}
+
+	var order []string
+	groups := make(map[string][]int)
+	for i, key := range keys {
+		id := w.owner(key)
+		if _, ok := groups[id]; !ok {
+			order = append(order, id)
+		}
+		groups[id] = append(groups[id], i)
+	}
+
+	var out *pb.BatchResponse
+	switch {
+	case len(order) <= 1:
+		resp, err := runBatch(ctx, w.client(firstKey(keys)), req)
+		if err != nil {
+			return nil, err
+		}
+		out = resp
+	case req.Atomic:
+		return nil, status.Errorf(codes.InvalidArgument, "an atomic batch cannot span shards")
+	default:
+		resps := make([]*pb.BatchResponse, len(order))
+		errs := make([]error, len(order))
+		var wg sync.WaitGroup
+		for g, id := range order {
+			sub := BatchRequest{Op: req.Op, Namespace: req.Namespace}
+			for _, i := range groups[id] {
+				sub.Items = append(sub.Items, req.Items[i])
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resps[g], errs[g] = runBatch(ctx, w.shards[id], sub)
+			}()
+		}
+		wg.Wait()
+
+		out = &pb.BatchResponse{Results: make([]*pb.BatchResult, len(req.Items))}
+		failed := 0
+		for g, id := range order {
+			for j, i := range groups[id] {
+				if errs[g] != nil {
+					out.Results[i] = &pb.BatchResult{Key: keys[i], Message: errs[g].Error()}
+					continue
+				}
+				out.Results[i] = resps[g].Results[j]
+			}
+			if errs[g] != nil {
+				failed++
+			}
+		}
+		if failed == len(order) {
+			return nil, errs[0]
+		}
+	}
+
+	return out, nil
+}
+
+// firstKey returns the first of keys, or "" if there are none
+func firstKey(keys []string) string {
+	if len(keys) == 0 {
+		return ""
+	}
+	return keys[0]
+}
+
+// runBatch sends a batch to a single KV service
+func runBatch(ctx context.Context, client pb.KVStoreClient, req BatchRequest) (*pb.BatchResponse, error) {
+	switch req.Op {
+	case "get":
+		keys := make([]string, len(req.Items))
+		for i, item := range req.Items {
+			keys[i] = item.Key
+		}
+		return client.BatchGet(ctx, &pb.BatchGetRequest{Namespace: req.Namespace, Keys: keys})
+	case "set":
+		items := make([]*pb.SetRequest, len(req.Items))
+		for i, item := range req.Items {
+			// BatchHandler has checked that every value decodes
+			text, raw, _ := decodeJSONValue(item.Value, item.ValueBase64)
+			items[i] = &pb.SetRequest{Key: item.Key, Value: text, ValueBytes: raw, ContentType: item.ContentType, TtlSeconds: item.TTLSeconds}
+		}
+		return client.BatchSet(ctx, &pb.BatchSetRequest{Namespace: req.Namespace, Items: items, Atomic: req.Atomic})
+	default:
+		items := make([]*pb.DeleteRequest, len(req.Items))
+		for i, item := range req.Items {
+			items[i] = &pb.DeleteRequest{Key: item.Key, ExpectedVersion: item.Version}
+		}
+		return client.BatchDelete(ctx, &pb.BatchDeleteRequest{Namespace: req.Namespace, Items: items, Atomic: req.Atomic})
+	}
+}
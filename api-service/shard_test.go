@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeShard is an in-memory KV service for routing tests. It holds keys as
+// the KV service stores them, but doesn't check that namespaces exist.
+type fakeShard struct {
+	mu    sync.Mutex
+	store map[string]string
+	// exportDelay slows down Exports of given keys, which only a rebalance
+	// makes, to widen the window in which writes race with them
+	exportDelay time.Duration
+}
+
+func newFakeShard() *fakeShard {
+	return &fakeShard{store: make(map[string]string)}
+}
+
+func (f *fakeShard) get(key string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.store[key]
+	return v, ok
+}
+
+func (f *fakeShard) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.store)
+}
+
+// sortedKeys returns the stored keys in order. The caller holds f.mu.
+func (f *fakeShard) sortedKeys() []string {
+	keys := make([]string, 0, len(f.store))
+	for k := range f.store {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeShard) client() *mockKVClient {
+	return &mockKVClient{
+		setFunc: func(ctx context.Context, req *pb.SetRequest, opts ...grpc.CallOption) (*pb.SetResponse, error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.store[storedKey(req.Namespace, req.Key)] = string(storedValue(req.Value, req.ValueBytes))
+			return &pb.SetResponse{Success: true, Version: 1}, nil
+		},
+		getFunc: func(ctx context.Context, req *pb.GetRequest, opts ...grpc.CallOption) (*pb.GetResponse, error) {
+			v, ok := f.get(storedKey(req.Namespace, req.Key))
+			return &pb.GetResponse{Found: ok, Value: v, ValueBytes: []byte(v), Version: 1}, nil
+		},
+		deleteFunc: func(ctx context.Context, req *pb.DeleteRequest, opts ...grpc.CallOption) (*pb.DeleteResponse, error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			key := storedKey(req.Namespace, req.Key)
+			_, ok := f.store[key]
+			delete(f.store, key)
+			return &pb.DeleteResponse{Success: ok}, nil
+		},
+		scanFunc: func(ctx context.Context, req *pb.ScanRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[pb.ScanResponse], error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			var items []*pb.ScanResponse
+			for _, k := range f.sortedKeys() {
+				ns, key, meta := splitStoredKey(k)
+				if meta || ns != req.Namespace || key < req.StartKey {
+					continue
+				}
+				if req.Limit == 0 || int64(len(items)) < req.Limit {
+					items = append(items, &pb.ScanResponse{Key: key, Value: f.store[k], Version: 1})
+				}
+			}
+			return &mockScanStream{items: items}, nil
+		},
+		txnFunc: func(ctx context.Context, req *pb.TxnRequest, opts ...grpc.CallOption) (*pb.TxnResponse, error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			for _, op := range req.Success {
+				switch op.Type {
+				case pb.TxnOp_PUT:
+					f.store[storedKey(req.Namespace, op.Key)] = op.Value
+				case pb.TxnOp_DELETE:
+					delete(f.store, storedKey(req.Namespace, op.Key))
+				}
+			}
+			return &pb.TxnResponse{Succeeded: true, Revision: 1}, nil
+		},
+		batchSetFunc: func(ctx context.Context, req *pb.BatchSetRequest, opts ...grpc.CallOption) (*pb.BatchResponse, error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			resp := &pb.BatchResponse{Revision: 7}
+			for _, item := range req.Items {
+				f.store[storedKey(req.Namespace, item.Key)] = item.Value
+				resp.Results = append(resp.Results, &pb.BatchResult{Key: item.Key, Success: true})
+			}
+			return resp, nil
+		},
+		batchDeleteFunc: func(ctx context.Context, req *pb.BatchDeleteRequest, opts ...grpc.CallOption) (*pb.BatchResponse, error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			resp := &pb.BatchResponse{Revision: 7}
+			for _, item := range req.Items {
+				key := storedKey(req.Namespace, item.Key)
+				_, ok := f.store[key]
+				delete(f.store, key)
+				resp.Results = append(resp.Results, &pb.BatchResult{Key: item.Key, Success: ok})
+			}
+			return resp, nil
+		},
+		exportFunc: func(ctx context.Context, req *pb.ExportRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[pb.Mutation], error) {
+			keys := req.Keys
+			if len(keys) > 0 {
+				time.Sleep(f.exportDelay)
+			}
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if len(keys) == 0 {
+				keys = f.sortedKeys()
+			}
+			var muts []*pb.Mutation
+			for _, k := range keys {
+				v, ok := f.store[k]
+				if !ok {
+					continue
+				}
+				m := &pb.Mutation{Op: pb.Mutation_SET, Key: k}
+				if !req.KeysOnly {
+					m.Value, m.Version = []byte(v), 1
+				}
+				muts = append(muts, m)
+			}
+			return &mockExportStream{muts: muts}, nil
+		},
+		importFunc: func(ctx context.Context, req *pb.ImportRequest, opts ...grpc.CallOption) (*pb.ImportResponse, error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			for _, m := range req.Mutations {
+				_, found := f.store[m.Key]
+				_, _, meta := splitStoredKey(m.Key)
+				switch {
+				case m.Op == pb.Mutation_DELETE:
+					delete(f.store, m.Key)
+				case meta && found:
+				default:
+					f.store[m.Key] = string(m.Value)
+				}
+			}
+			return &pb.ImportResponse{Revision: 7}, nil
+		},
+	}
+}
+
+// fakeCluster holds fake shards by address and dials them
+type fakeCluster struct {
+	mu      sync.Mutex
+	shards  map[string]*fakeShard
+	clients map[string]*mockKVClient
+}
+
+func newFakeCluster() *fakeCluster {
+	return &fakeCluster{shards: make(map[string]*fakeShard), clients: make(map[string]*mockKVClient)}
+}
+
+func (fc *fakeCluster) dial(addr string) (pb.KVStoreClient, io.Closer, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if _, ok := fc.shards[addr]; !ok {
+		fc.shards[addr] = newFakeShard()
+		fc.clients[addr] = fc.shards[addr].client()
+	}
+	return fc.clients[addr], nil, nil
+}
+
+func (fc *fakeCluster) shard(id string) *fakeShard {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.shards["addr-"+id]
+}
+
+// newShardedServer builds an API server over n fake shards, where shard
+// shard-i is reachable at addr-shard-i
+func newShardedServer(t *testing.T, n int) (*APIServer, *fakeCluster) {
+	fc := newFakeCluster()
+	addrs := make(map[string]string)
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("shard-%d", i)
+		addrs[id] = "addr-" + id
+	}
+	apiServer, err := NewShardedAPIServer(addrs, defaultVirtualNodes, fc.dial)
+	if err != nil {
+		t.Fatalf("NewShardedAPIServer() error = %v", err)
+	}
+	return apiServer, fc
+}
+
+func TestShardedSetGetDelete(t *testing.T) {
+	apiServer, fc := newShardedServer(t, 3)
+	router := setupRouter(apiServer)
+
+	for i := 0; i < 30; i++ {
+		body, _ := json.Marshal(SetRequest{Key: fmt.Sprintf("key-%d", i), Value: "v"})
+		req := httptest.NewRequest(http.MethodPost, "/kv", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+
+	// Every key is stored on exactly the shard the ring assigns it to
+	total := 0
+	for _, id := range apiServer.ring.shards() {
+		shard := fc.shard(id)
+		for key := range shard.store {
+			if owner := apiServer.ring.owner(key); owner != id {
+				t.Errorf("key %s is stored on %s, want %s", key, id, owner)
+			}
+		}
+		if len(shard.store) == 0 {
+			t.Errorf("shard %s received no keys", id)
+		}
+		total += len(shard.store)
+	}
+	if total != 30 {
+		t.Errorf("shards hold %d keys, want 30", total)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/key-7", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/kv/key-7", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if _, ok := fc.shard(apiServer.ring.owner("key-7")).get("key-7"); ok {
+		t.Errorf("key-7 is still stored after delete")
+	}
+}
+
+func TestShardedListMergesShards(t *testing.T) {
+	apiServer, fc := newShardedServer(t, 3)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		fc.shard(apiServer.ring.owner(key)).store[key] = "v"
+	}
+	router := setupRouter(apiServer)
+
+	var keys []string
+	cursor := ""
+	for page := 0; page < 10; page++ {
+		req := httptest.NewRequest(http.MethodGet, "/kv?limit=4&cursor="+cursor, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+		var resp ListResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		for _, item := range resp.Items {
+			keys = append(keys, item.Key)
+		}
+		if cursor = resp.NextCursor; cursor == "" {
+			break
+		}
+	}
+
+	if len(keys) != 10 || !sort.StringsAreSorted(keys) {
+		t.Errorf("Expected all 10 keys in order, got %v", keys)
+	}
+}
+
+func TestShardedBatchSplitsByShard(t *testing.T) {
+	apiServer, fc := newShardedServer(t, 3)
+	router := setupRouter(apiServer)
+
+	var items []BatchItem
+	for i := 0; i < 12; i++ {
+		items = append(items, BatchItem{Key: fmt.Sprintf("key-%d", i), Value: "v"})
+	}
+	body, _ := json.Marshal(BatchRequest{Op: "set", Items: items})
+	req := httptest.NewRequest(http.MethodPost, "/kv/batch", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var resp BatchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if resp.Revision != 0 || len(resp.Results) != len(items) {
+		t.Fatalf("Unexpected response %+v", resp)
+	}
+	for i, r := range resp.Results {
+		if r.Key != items[i].Key || !r.Success {
+			t.Errorf("Result %d = %+v, want a success for %s", i, r, items[i].Key)
+		}
+		if _, ok := fc.shard(apiServer.ring.owner(r.Key)).get(r.Key); !ok {
+			t.Errorf("key %s was not written to its shard", r.Key)
+		}
+	}
+
+	// An atomic batch cannot be split
+	body, _ = json.Marshal(BatchRequest{Op: "set", Items: items, Atomic: true})
+	req = httptest.NewRequest(http.MethodPost, "/kv/batch", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestShardedBatchShardFailure(t *testing.T) {
+	apiServer, _ := newShardedServer(t, 2)
+	down := apiServer.ring.owner("key-0")
+	apiServer.shards[down].(*mockKVClient).batchSetFunc = func(ctx context.Context, req *pb.BatchSetRequest, opts ...grpc.CallOption) (*pb.BatchResponse, error) {
+		return nil, status.Error(codes.Unavailable, "connection refused")
+	}
+	router := setupRouter(apiServer)
+
+	var items []BatchItem
+	for i := 0; i < 12; i++ {
+		items = append(items, BatchItem{Key: fmt.Sprintf("key-%d", i), Value: "v"})
+	}
+	body, _ := json.Marshal(BatchRequest{Op: "set", Items: items})
+	req := httptest.NewRequest(http.MethodPost, "/kv/batch", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var resp BatchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	for _, r := range resp.Results {
+		if want := apiServer.ring.owner(r.Key) != down; r.Success != want {
+			t.Errorf("Result for %s success = %v, want %v", r.Key, r.Success, want)
+		}
+	}
+}
+
+func TestShardedTxnAndWatch(t *testing.T) {
+	apiServer, _ := newShardedServer(t, 3)
+	router := setupRouter(apiServer)
+
+	// Find two keys on different shards
+	a, b := "key-0", ""
+	for i := 1; b == ""; i++ {
+		if key := fmt.Sprintf("key-%d", i); apiServer.ring.owner(key) != apiServer.ring.owner(a) {
+			b = key
+		}
+	}
+
+	body := fmt.Sprintf(`{"success": [{"op": "put", "key": %q, "value": "1"}, {"op": "put", "key": %q, "value": "2"}]}`, a, b)
+	req := httptest.NewRequest(http.MethodPost, "/kv/txn", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	body = fmt.Sprintf(`{"success": [{"op": "put", "key": %q, "value": "1"}]}`, a)
+	req = httptest.NewRequest(http.MethodPost, "/kv/txn", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/kv/watch?prefix=user/", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected status %d, got %d", http.StatusNotImplemented, w.Code)
+	}
+}
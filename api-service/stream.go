@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// uploadChunkSize is how much of a body each Upload message carries
+	uploadChunkSize = 64 << 10
+
+	// streamTimeout bounds an upload or download, which may move far more
+	// data than the other requests
+	streamTimeout = 5 * time.Minute
+
+	// checksumHeader carries the hex SHA-256 of a raw value. On a PUT the
+	// KV service only stores the body if it matches; on a GET it lets the
+	// client check what it received.
+	checksumHeader = "X-Checksum-SHA256"
+)
+
+// bodyError is a failure to read the request body rather than one reported
+// by the KV service
+type bodyError struct{ err error }
+
+func (e *bodyError) Error() string { return "failed to read body: " + e.err.Error() }
+
+func (e *bodyError) Unwrap() error { return e.err }
+
+// upload streams body to the KV service as the value described by head,
+// without holding more than a chunk of it in memory. Unless head already
+// carries the SHA-256 the body must match, the one computed while sending is
+// sent after the body.
+func upload(ctx context.Context, client pb.KVStoreClient, head *pb.UploadRequest, body io.Reader) (*pb.SetResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.Upload(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	buf := make([]byte, uploadChunkSize)
+	msg := head
+	for {
+		n, rerr := io.ReadFull(body, buf)
+		if rerr != nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+			return nil, &bodyError{rerr}
+		}
+		msg.Data = buf[:n]
+		hash.Write(msg.Data)
+		if rerr != nil && len(head.Sha256) == 0 {
+			msg.Sha256 = hash.Sum(nil)
+		}
+		if err := stream.Send(msg); err != nil {
+			if err == io.EOF {
+				// The service ended the stream; its status says why
+				_, err = stream.CloseAndRecv()
+			}
+			return nil, err
+		}
+		if rerr != nil {
+			return stream.CloseAndRecv()
+		}
+		msg = &pb.UploadRequest{}
+	}
+}
+
+// openDownload starts streaming key of namespace ns from the KV service and returns the
+// first chunk, which describes the value, so that errors such as a missing
+// key surface before any of it is relayed
+func openDownload(ctx context.Context, client pb.KVStoreClient, ns, key string) (grpc.ServerStreamingClient[pb.DownloadChunk], *pb.DownloadChunk, error) {
+	stream, err := client.Download(ctx, &pb.DownloadRequest{Namespace: ns, Key: key})
+	if err != nil {
+		return nil, nil, err
+	}
+	first, err := stream.Recv()
+	if err == io.EOF {
+		err = status.Errorf(codes.Internal, "download of key '%s' ended before its first chunk", key)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return stream, first, nil
+}
+
+// chunkReader reads a value from a Download stream whose first chunk has
+// already been received
+type chunkReader struct {
+	stream grpc.ServerStreamingClient[pb.DownloadChunk]
+	buf    []byte
+}
+
+func newChunkReader(stream grpc.ServerStreamingClient[pb.DownloadChunk], first *pb.DownloadChunk) *chunkReader {
+	return &chunkReader{stream: stream, buf: first.Data}
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		chunk, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = chunk.Data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// putRawValue handles a PUT /kv/:key whose body is the value itself by
+// streaming it to the KV service. The write is conditional on expected or,
+// with mustExist or mustNotExist, on whether the key exists.
+func (s *APIServer) putRawValue(c *gin.Context, ns, key string, expected uint64, mustExist, mustNotExist bool) {
+	head := &pb.UploadRequest{
+		Namespace:       ns,
+		Key:             key,
+		ContentType:     c.GetHeader("Content-Type"),
+		ExpectedVersion: expected,
+		MustExist:       mustExist,
+		MustNotExist:    mustNotExist,
+	}
+	if ttl := c.Query("ttl_seconds"); ttl != "" {
+		n, err := strconv.ParseInt(ttl, 10, 64)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error: "Invalid request: ttl_seconds must be a non-negative integer",
+			})
+			return
+		}
+		head.TtlSeconds = n
+	}
+	if c.Request.ContentLength > 0 {
+		head.Size = c.Request.ContentLength
+	}
+	if sum := c.GetHeader(checksumHeader); sum != "" {
+		decoded, err := hex.DecodeString(sum)
+		if err != nil || len(decoded) != sha256.Size {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error: fmt.Sprintf("Invalid %s header: want a hex SHA-256", checksumHeader),
+			})
+			return
+		}
+		head.Sha256 = decoded
+	}
+
+	ctx, cancel := context.WithTimeout(callContext(c.Request.Context(), c), streamTimeout)
+	defer cancel()
+
+	r := s.routeWrite(key)
+	defer r.release()
+	defer r.mirror(ctx, ns, key)
+
+	resp, err := upload(ctx, r.client(key), head, c.Request.Body)
+	if err != nil {
+		code := httpStatusFromGRPC(err)
+		if errors.As(err, new(*bodyError)) {
+			code = http.StatusBadRequest
+		}
+		c.JSON(code, ErrorResponse{
+			Error: "Failed to set key: " + err.Error(),
+		})
+		return
+	}
+
+	setETag(c, resp.Version)
+	c.JSON(http.StatusOK, SetResponse{
+		Success: true,
+		Message: resp.Message,
+		Version: resp.Version,
+	})
+}
+
+// getRawValue handles a GET /kv/:key that asks for the value itself by
+// streaming it from the KV service, with its content type, length and
+// SHA-256 in the headers
+func (s *APIServer) getRawValue(c *gin.Context, ns, key string) {
+	ctx, cancel := context.WithTimeout(callContext(c.Request.Context(), c), streamTimeout)
+	defer cancel()
+
+	stream, first, err := openDownload(ctx, s.clientFor(key), ns, key)
+	if status.Code(err) == codes.NotFound {
+		c.JSON(http.StatusNotFound, GetResponse{
+			Found:   false,
+			Message: status.Convert(err).Message(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(httpStatusFromGRPC(err), ErrorResponse{
+			Error: "Failed to get key: " + err.Error(),
+		})
+		return
+	}
+
+	setETag(c, first.Version)
+	if first.Version != 0 && etagMatches(c.GetHeader("If-None-Match"), formatETag(first.Version)) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	contentType := first.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Length", strconv.FormatInt(first.Size, 10))
+	c.Header(checksumHeader, hex.EncodeToString(first.Sha256))
+	c.Status(http.StatusOK)
+
+	// Once the body has started the status can't change, so a failure
+	// midway cuts the response short of its Content-Length
+	if _, err := io.Copy(c.Writer, newChunkReader(stream, first)); err != nil {
+		log.Printf("Download of key %s failed midway: %v", key, err)
+	}
+}
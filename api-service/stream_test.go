@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// largeValue spans several upload chunks
+var largeValue = bytes.Repeat([]byte("0123456789abcdef"), 3*uploadChunkSize/16+5)
+
+func TestPutHandlerStreamsRawBody(t *testing.T) {
+	var stream *mockUploadStream
+	mockClient := &mockKVClient{}
+	mockClient.uploadFunc = func(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[pb.UploadRequest, pb.SetResponse], error) {
+		stream = &mockUploadStream{m: mockClient, ctx: ctx}
+		return stream, nil
+	}
+	router := setupRouter(NewAPIServer(mockClient))
+	sum := sha256.Sum256(largeValue)
+
+	req := httptest.NewRequest(http.MethodPut, "/kv/big", bytes.NewReader(largeValue))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(checksumHeader, hex.EncodeToString(sum[:]))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if len(stream.msgs) != 4 {
+		t.Fatalf("Expected the body in 4 messages, got %d", len(stream.msgs))
+	}
+	head := stream.msgs[0]
+	if head.Key != "big" || head.Size != int64(len(largeValue)) || !bytes.Equal(head.Sha256, sum[:]) {
+		t.Errorf("Unexpected first message key=%q size=%d", head.Key, head.Size)
+	}
+	for _, msg := range stream.msgs[1:] {
+		if msg.Key != "" || len(msg.Data) > uploadChunkSize {
+			t.Errorf("Unexpected later message key=%q with %d bytes", msg.Key, len(msg.Data))
+		}
+	}
+
+	// A body that doesn't match its checksum is refused
+	req = httptest.NewRequest(http.MethodPut, "/kv/big", bytes.NewReader(largeValue[1:]))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(checksumHeader, hex.EncodeToString(sum[:]))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a checksum mismatch, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/kv/big", bytes.NewReader(largeValue))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(checksumHeader, "not hex")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an invalid checksum header, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestPutHandlerRawBodyIsConditional(t *testing.T) {
+	var got *pb.CompareAndSetRequest
+	mockClient := &mockKVClient{
+		casFunc: func(ctx context.Context, req *pb.CompareAndSetRequest, opts ...grpc.CallOption) (*pb.CompareAndSetResponse, error) {
+			got = req
+			return &pb.CompareAndSetResponse{Success: true, Version: 8}, nil
+		},
+	}
+	router := setupRouter(NewAPIServer(mockClient))
+
+	req := httptest.NewRequest(http.MethodPut, "/kv/img", bytes.NewReader(binaryValue))
+	req.Header.Set("Content-Type", "image/png")
+	req.Header.Set("If-Match", `"7"`)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if got == nil || got.ExpectedVersion != 7 || !bytes.Equal(got.ValueBytes, binaryValue) {
+		t.Errorf("Unexpected CompareAndSet request %v", got)
+	}
+	if etag := w.Header().Get("ETag"); etag != `"8"` {
+		t.Errorf("Expected ETag %q, got %q", `"8"`, etag)
+	}
+}
+
+func TestPutHandlerObjectTooLarge(t *testing.T) {
+	tooLarge, _ := status.New(codes.ResourceExhausted, "value is larger than the maximum object size").WithDetails(&errdetails.ErrorInfo{
+		Reason:   "OBJECT_TOO_LARGE",
+		Domain:   "kvstore",
+		Metadata: map[string]string{"limit": "4"},
+	})
+	tests := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"object size", tooLarge.Err(), http.StatusRequestEntityTooLarge},
+		{"memory limit", status.Error(codes.ResourceExhausted, "memory limit reached"), http.StatusInsufficientStorage},
+	}
+	for _, tt := range tests {
+		mockClient := &mockKVClient{
+			setFunc: func(ctx context.Context, req *pb.SetRequest, opts ...grpc.CallOption) (*pb.SetResponse, error) {
+				return nil, tt.err
+			},
+		}
+		router := setupRouter(NewAPIServer(mockClient))
+		req := httptest.NewRequest(http.MethodPut, "/kv/big", bytes.NewReader(largeValue))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.code, w.Code)
+		}
+	}
+}
+
+func TestGetHandlerStreamsRawValue(t *testing.T) {
+	mockClient := &mockKVClient{
+		getFunc: func(ctx context.Context, req *pb.GetRequest, opts ...grpc.CallOption) (*pb.GetResponse, error) {
+			if req.Key != "big" {
+				return &pb.GetResponse{Found: false}, nil
+			}
+			return &pb.GetResponse{Found: true, ValueBytes: largeValue, Version: 3}, nil
+		},
+	}
+	router := setupRouter(NewAPIServer(mockClient))
+
+	req := httptest.NewRequest(http.MethodGet, "/kv/big", nil)
+	req.Header.Set("Accept", "application/octet-stream")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), largeValue) {
+		t.Fatalf("Expected the raw value, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+	sum := sha256.Sum256(largeValue)
+	if got := w.Header().Get(checksumHeader); got != hex.EncodeToString(sum[:]) {
+		t.Errorf("Expected checksum %x, got %s", sum, got)
+	}
+	if got := w.Header().Get("Content-Length"); got != strconv.Itoa(len(largeValue)) {
+		t.Errorf("Expected Content-Length %d, got %s", len(largeValue), got)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != defaultContentType {
+		t.Errorf("Expected Content-Type %s, got %q", defaultContentType, ct)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/kv/big", nil)
+	req.Header.Set("Accept", "application/octet-stream")
+	req.Header.Set("If-None-Match", `"3"`)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("Expected status %d and no body, got %d with %d bytes", http.StatusNotModified, w.Code, w.Body.Len())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/kv/missing", nil)
+	req.Header.Set("Accept", "application/octet-stream")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for a missing key, got %d", http.StatusNotFound, w.Code)
+	}
+}
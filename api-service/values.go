@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultContentType is sent for a raw value that was stored without one
+const defaultContentType = "application/octet-stream"
+
+// decodeJSONValue returns the value of a JSON write, which carries it either
+// as text in value or base64-encoded in value_base64, in the form the KV
+// service takes it: text, or raw bytes
+func decodeJSONValue(value, valueBase64 string) (string, []byte, error) {
+	if valueBase64 == "" {
+		return value, nil, nil
+	}
+	if value != "" {
+		return "", nil, fmt.Errorf("value and value_base64 are mutually exclusive")
+	}
+	raw, err := base64.StdEncoding.DecodeString(valueBase64)
+	if err != nil {
+		return "", nil, fmt.Errorf("value_base64 is not valid base64")
+	}
+	return "", raw, nil
+}
+
+// decodeRequiredJSONValue is decodeJSONValue for writes that must carry a
+// value
+func decodeRequiredJSONValue(value, valueBase64 string) (string, []byte, error) {
+	if value == "" && valueBase64 == "" {
+		return "", nil, fmt.Errorf("value or value_base64 is required")
+	}
+	return decodeJSONValue(value, valueBase64)
+}
+
+// encodeJSONValue returns the value and value_base64 fields for a value the
+// KV service returned. Values that aren't valid UTF-8 can't be sent as JSON
+// text, so they are only sent base64-encoded.
+func encodeJSONValue(text string, raw []byte) (string, string) {
+	if text != "" || len(raw) == 0 {
+		return text, ""
+	}
+	if utf8.Valid(raw) {
+		return string(raw), ""
+	}
+	return "", base64.StdEncoding.EncodeToString(raw)
+}
+
+// storedValue returns the bytes of a value the KV service returned. Servers
+// that predate value_bytes only send the text.
+func storedValue(text string, raw []byte) []byte {
+	if len(raw) > 0 {
+		return raw
+	}
+	return []byte(text)
+}
+
+// isJSONBody reports whether a request body is a JSON document rather than a
+// raw value. Bodies without a Content-Type are taken to be JSON.
+func isJSONBody(c *gin.Context) bool {
+	ct := c.ContentType()
+	return ct == "" || ct == gin.MIMEJSON
+}
+
+// wantsRawValue reports whether a GET asks for the stored value itself rather
+// than a JSON document describing it, which is when the Accept header is set
+// and admits no JSON
+func wantsRawValue(c *gin.Context) bool {
+	accept := c.GetHeader("Accept")
+	if accept == "" {
+		return false
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if mt == gin.MIMEJSON || mt == "application/*" || mt == "*/*" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc"
+)
+
+// binaryValue is not valid UTF-8, so it can't be sent as JSON text
+var binaryValue = []byte{0xff, 0x00, 0xfe, 'k', 'v'}
+
+func TestPutHandlerRawBody(t *testing.T) {
+	var got *pb.SetRequest
+	mockClient := &mockKVClient{
+		setFunc: func(ctx context.Context, req *pb.SetRequest, opts ...grpc.CallOption) (*pb.SetResponse, error) {
+			got = req
+			return &pb.SetResponse{Success: true, Version: 4}, nil
+		},
+	}
+	router := setupRouter(NewAPIServer(mockClient))
+
+	req := httptest.NewRequest(http.MethodPut, "/kv/img?ttl_seconds=60", bytes.NewReader(binaryValue))
+	req.Header.Set("Content-Type", "image/png")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if got == nil || !bytes.Equal(got.ValueBytes, binaryValue) || got.Value != "" || got.ContentType != "image/png" || got.TtlSeconds != 60 {
+		t.Errorf("Unexpected Set request %v", got)
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/kv/img?ttl_seconds=-1", bytes.NewReader(binaryValue))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a negative TTL, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestSetHandlerBase64Value(t *testing.T) {
+	var got *pb.SetRequest
+	mockClient := &mockKVClient{
+		setFunc: func(ctx context.Context, req *pb.SetRequest, opts ...grpc.CallOption) (*pb.SetResponse, error) {
+			got = req
+			return &pb.SetResponse{Success: true}, nil
+		},
+	}
+	router := setupRouter(NewAPIServer(mockClient))
+
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"base64", `{"key":"k","value_base64":"/wD+a3Y=","content_type":"application/x-thing"}`, http.StatusOK},
+		{"both values", `{"key":"k","value":"v","value_base64":"dg=="}`, http.StatusBadRequest},
+		{"invalid base64", `{"key":"k","value_base64":"not base64!"}`, http.StatusBadRequest},
+		{"no value", `{"key":"k"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/kv", bytes.NewBufferString(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.code, w.Code)
+		}
+	}
+	if got == nil || !bytes.Equal(got.ValueBytes, binaryValue) || got.ContentType != "application/x-thing" {
+		t.Errorf("Unexpected Set request %v", got)
+	}
+}
+
+func TestGetHandlerBinaryValue(t *testing.T) {
+	mockClient := &mockKVClient{
+		getFunc: func(ctx context.Context, req *pb.GetRequest, opts ...grpc.CallOption) (*pb.GetResponse, error) {
+			return &pb.GetResponse{Found: true, ValueBytes: binaryValue, ContentType: "image/png", Version: 2}, nil
+		},
+	}
+	router := setupRouter(NewAPIServer(mockClient))
+
+	// Without an Accept header the value is described as JSON
+	req := httptest.NewRequest(http.MethodGet, "/kv/img", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var resp GetResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if resp.Value != "" || resp.ValueBase64 != "/wD+a3Y=" || resp.ContentType != "image/png" {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/kv/img", nil)
+	req.Header.Set("Accept", "image/png, image/*;q=0.8")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), binaryValue) {
+		t.Errorf("Expected the raw value, got %d %q", w.Code, w.Body.Bytes())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Expected Content-Type image/png, got %q", ct)
+	}
+	if etag := w.Header().Get("ETag"); etag != `"2"` {
+		t.Errorf("Expected ETag %q, got %q", `"2"`, etag)
+	}
+}
+
+func TestWantsRawValue(t *testing.T) {
+	router := setupRouter(NewAPIServer(&mockKVClient{}))
+	for accept, want := range map[string]bool{
+		"":                               false,
+		"*/*":                            false,
+		"application/json":               false,
+		"text/html, application/*;q=0.9": false,
+		"application/octet-stream":       true,
+		"text/plain; charset=utf-8":      true,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/kv/k", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		raw := w.Header().Get("Content-Type") != "application/json; charset=utf-8"
+		if raw != want {
+			t.Errorf("Accept %q: raw response = %v, want %v", accept, raw, want)
+		}
+	}
+}
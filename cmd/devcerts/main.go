@@ -0,0 +1,34 @@
+// Command devcerts writes a development CA and certificates for mutual TLS
+// between the services:
+//
+//	go run ./cmd/devcerts -out certs kv-service api-service
+//
+// Running it again with the same -out reuses the CA, so certificates can be
+// added or renewed without touching the ones the services already trust.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/pranavmerugu/censys-take-home/mtls"
+)
+
+func main() {
+	out := flag.String("out", "certs", "directory to write the CA and certificates to")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: devcerts [-out dir] name...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := mtls.WriteDevCerts(*out, flag.Args()...); err != nil {
+		log.Fatalf("Failed to write certificates: %v", err)
+	}
+	log.Printf("Wrote a CA and certificates for %v to %s", flag.Args(), *out)
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// auditCurrent is the file entries are appended to; rotated files are
+	// renamed to auditPrefix, the rotation time and auditSuffix
+	auditCurrent = "audit.jsonl"
+	auditPrefix  = "audit-"
+	auditSuffix  = ".jsonl"
+	// auditTimeFormat sorts rotated files by the time they were rotated
+	auditTimeFormat = "20060102T150405.000000000Z"
+
+	defaultAuditMaxSize = 100 << 20
+
+	// callerHeader and sourceHeader carry the caller and client address a
+	// gateway is writing on behalf of
+	callerHeader = "x-kv-caller"
+	sourceHeader = "x-forwarded-for"
+
+	defaultAuditQueryLimit = 100
+	maxAuditQueryLimit     = 1000
+)
+
+// Operations recorded in the audit log
+const (
+	auditSet    = "set"
+	auditDelete = "delete"
+	auditTouch  = "touch"
+)
+
+// Outcomes recorded in the audit log
+const (
+	outcomeOK       = "ok"
+	outcomeNotFound = "not_found"
+	outcomeError    = "error"
+)
+
+type auditOptions struct {
+	// Dir holds the audit log; empty disables it
+	Dir string
+	// MaxSize is the size at which the current file is rotated; zero means
+	// defaultAuditMaxSize
+	MaxSize int64
+	// Retain is how many rotated files are kept; zero keeps every one
+	Retain int
+	// Gateways are the common names of the client certificates trusted to
+	// name the caller and client they write for
+	Gateways []string
+}
+
+// auditEntry is one line of the audit log
+type auditEntry struct {
+	Time        time.Time `json:"time"`
+	Caller      string    `json:"caller,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	Op          string    `json:"op"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Key         string    `json:"key"`
+	ValueSHA256 string    `json:"value_sha256,omitempty"`
+	Version     uint64    `json:"version,omitempty"`
+	Outcome     string    `json:"outcome"`
+	Code        string    `json:"code,omitempty"`
+	Message     string    `json:"message,omitempty"`
+}
+
+// auditLog appends entries to JSON lines files, rotating the current file
+// once it reaches a size
+type auditLog struct {
+	opts     auditOptions
+	now      func() time.Time
+	gateways map[string]bool
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// openAuditLog opens the audit log in opts.Dir, appending to the current file
+// if there is one
+func openAuditLog(opts auditOptions, now func() time.Time) (*auditLog, error) {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = defaultAuditMaxSize
+	}
+	if opts.Retain < 0 {
+		return nil, fmt.Errorf("audit retention must not be negative")
+	}
+	if err := os.MkdirAll(opts.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create audit dir: %w", err)
+	}
+	a := &auditLog{opts: opts, now: now, gateways: make(map[string]bool, len(opts.Gateways))}
+	for _, name := range opts.Gateways {
+		a.gateways[name] = true
+	}
+	if err := a.openCurrent(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) openCurrent() error {
+	f, err := os.OpenFile(filepath.Join(a.opts.Dir, auditCurrent), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("open audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f, a.size = f, info.Size()
+	return nil
+}
+
+// append writes entries to the current file in one write, so a crash never
+// leaves some of them without the rest, rotating it first if it is full
+func (a *auditLog) append(entries []auditEntry) error {
+	var buf []byte
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return os.ErrClosed
+	}
+	if a.size > 0 && a.size+int64(len(buf)) > a.opts.MaxSize {
+		if err := a.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	n, err := a.f.Write(buf)
+	a.size += int64(n)
+	return err
+}
+
+// rotateLocked renames the current file after the time it was rotated,
+// starts a new one and deletes the oldest rotated files beyond opts.Retain
+func (a *auditLog) rotateLocked() error {
+	if err := a.f.Sync(); err != nil {
+		return err
+	}
+	if err := a.f.Close(); err != nil {
+		return err
+	}
+	a.f = nil
+	name := auditPrefix + a.now().UTC().Format(auditTimeFormat) + auditSuffix
+	if err := os.Rename(filepath.Join(a.opts.Dir, auditCurrent), filepath.Join(a.opts.Dir, name)); err != nil {
+		return err
+	}
+	if err := syncDir(a.opts.Dir); err != nil {
+		return err
+	}
+	if err := a.openCurrent(); err != nil {
+		return err
+	}
+
+	if a.opts.Retain > 0 {
+		rotated, err := a.rotatedFiles()
+		if err != nil {
+			return err
+		}
+		for len(rotated) > a.opts.Retain {
+			if err := os.Remove(filepath.Join(a.opts.Dir, rotated[0])); err != nil {
+				return err
+			}
+			rotated = rotated[1:]
+		}
+	}
+	return nil
+}
+
+// rotatedFiles returns the names of the rotated files, oldest first
+func (a *auditLog) rotatedFiles() ([]string, error) {
+	dirEntries, err := os.ReadDir(a.opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, d := range dirEntries {
+		name := d.Name()
+		if strings.HasPrefix(name, auditPrefix) && strings.HasSuffix(name, auditSuffix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// close syncs and closes the current file
+func (a *auditLog) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Sync()
+	if cerr := a.f.Close(); err == nil {
+		err = cerr
+	}
+	a.f = nil
+	return err
+}
+
+// auditFilter selects entries for a query
+type auditFilter struct {
+	key, namespace, caller string
+	since, until           time.Time
+}
+
+func (f auditFilter) matches(e auditEntry) bool {
+	switch {
+	case f.key != "" && e.Key != f.key:
+		return false
+	case f.namespace == "default" && e.Namespace != "":
+		return false
+	case f.namespace != "" && f.namespace != "default" && e.Namespace != f.namespace:
+		return false
+	case f.caller != "" && e.Caller != f.caller:
+		return false
+	case !f.since.IsZero() && e.Time.Before(f.since):
+		return false
+	case !f.until.IsZero() && !e.Time.Before(f.until):
+		return false
+	}
+	return true
+}
+
+// auditCursor is where a query that ran out of room stopped
+type auditCursor struct {
+	// First is the SHA-256 of the first line of the file the cursor points
+	// into, which names it whether or not it has been rotated since
+	First string `json:"first"`
+	// Offset is where the next matching line starts in that file
+	Offset int64 `json:"offset"`
+}
+
+func (c *auditCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeAuditCursor(s string) (*auditCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c auditCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	if c.First == "" || c.Offset < 0 {
+		return nil, fmt.Errorf("incomplete cursor")
+	}
+	return &c, nil
+}
+
+// auditFile is one audit log file, read only up to size
+type auditFile struct {
+	f    *os.File
+	size int64
+}
+
+// first returns the SHA-256 of the file's first line
+func (af auditFile) first() (string, error) {
+	line, err := bufio.NewReader(io.NewSectionReader(af.f, 0, af.size)).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// query returns up to limit entries matching f, oldest first, starting at
+// from if it isn't nil, and a cursor to the next match if there was one. The
+// files are opened under the lock, so a rotation can't move them away, and
+// read after it is released, so writes aren't held up; the current file is
+// only read up to its size at the time. A cursor into a file retention has
+// since deleted continues from the oldest file left.
+func (a *auditLog) query(f auditFilter, limit int, from *auditCursor) ([]auditEntry, *auditCursor, error) {
+	a.mu.Lock()
+	rotated, err := a.rotatedFiles()
+	if err != nil {
+		a.mu.Unlock()
+		return nil, nil, err
+	}
+	var files []auditFile
+	defer func() {
+		for _, af := range files {
+			af.f.Close()
+		}
+	}()
+	for _, name := range rotated {
+		// A file rotated before since holds nothing newer
+		if rotatedAt, err := time.Parse(auditTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, auditPrefix), auditSuffix)); err == nil && from == nil && !f.since.IsZero() && rotatedAt.Before(f.since) {
+			continue
+		}
+		file, err := os.Open(filepath.Join(a.opts.Dir, name))
+		if err != nil {
+			a.mu.Unlock()
+			return nil, nil, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			a.mu.Unlock()
+			return nil, nil, err
+		}
+		files = append(files, auditFile{f: file, size: info.Size()})
+	}
+	current, err := os.Open(filepath.Join(a.opts.Dir, auditCurrent))
+	if err != nil {
+		a.mu.Unlock()
+		return nil, nil, err
+	}
+	files = append(files, auditFile{f: current, size: a.size})
+	a.mu.Unlock()
+
+	start, offset := 0, int64(0)
+	if from != nil {
+		for i, af := range files {
+			first, err := af.first()
+			if err != nil {
+				return nil, nil, err
+			}
+			if first == from.First {
+				start, offset = i, min(from.Offset, af.size)
+				break
+			}
+		}
+	}
+
+	var entries []auditEntry
+	for i := start; i < len(files); i, offset = i+1, 0 {
+		af := files[i]
+		scanner := bufio.NewScanner(io.NewSectionReader(af.f, offset, af.size-offset))
+		scanner.Buffer(make([]byte, 64<<10), 1<<20)
+		for pos := offset; scanner.Scan(); {
+			line := scanner.Bytes()
+			lineStart := pos
+			pos += int64(len(line)) + 1
+			var e auditEntry
+			if err := json.Unmarshal(line, &e); err != nil {
+				// A line torn by a crash is skipped rather than failing the query
+				continue
+			}
+			if !f.matches(e) {
+				continue
+			}
+			if len(entries) == limit {
+				first, err := af.first()
+				if err != nil {
+					return nil, nil, err
+				}
+				return entries, &auditCursor{First: first, Offset: lineStart}, nil
+			}
+			entries = append(entries, e)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return entries, nil, nil
+}
+
+// auditEvent is a key an RPC wrote or tried to write
+type auditEvent struct {
+	op        string
+	namespace string
+	key       string
+	// sum is the SHA-256 of the value of a set
+	sum []byte
+	// version is the revision of the write
+	version uint64
+	// missing is set when the key to delete or touch didn't exist
+	missing bool
+	err     error
+}
+
+// recordAudit appends events to the audit log, if there is one, along with
+// the caller ctx carries. A failure to record is logged rather than returned,
+// since the write it records has already happened.
+func (s *kvServer) recordAudit(ctx context.Context, events ...auditEvent) {
+	if s.audit == nil || len(events) == 0 {
+		return
+	}
+	caller, source := s.audit.caller(ctx)
+	now := s.now()
+	entries := make([]auditEntry, len(events))
+	for i, ev := range events {
+		e := auditEntry{
+			Time:      now,
+			Caller:    caller,
+			Source:    source,
+			Op:        ev.op,
+			Namespace: ev.namespace,
+			Key:       ev.key,
+			Version:   ev.version,
+			Outcome:   outcomeOK,
+		}
+		if e.Namespace == "default" {
+			e.Namespace = ""
+		}
+		if ev.sum != nil {
+			e.ValueSHA256 = hex.EncodeToString(ev.sum)
+		}
+		switch {
+		case ev.err != nil:
+			st := status.Convert(ev.err)
+			e.Outcome, e.Code, e.Message, e.Version = outcomeError, st.Code().String(), st.Message(), 0
+		case ev.missing:
+			e.Outcome, e.Version = outcomeNotFound, 0
+		}
+		entries[i] = e
+	}
+	if err := s.audit.append(entries); err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+	}
+}
+
+// auditSum returns the SHA-256 of a value sent as text or raw bytes, or nil
+// when there is no audit log to record it in
+func (s *kvServer) auditSum(text string, raw []byte) []byte {
+	if s.audit == nil {
+		return nil
+	}
+	if len(raw) == 0 {
+		raw = []byte(text)
+	}
+	sum := sha256.Sum256(raw)
+	return sum[:]
+}
+
+// caller returns who a write is made for and where it came from: the common
+// name of the client certificate, if any, and the peer's address. A gateway
+// whose certificate is in opts.Gateways names its own caller and client in
+// the request metadata instead; anyone else's metadata is ignored, since
+// nothing stops a client from sending it.
+func (a *auditLog) caller(ctx context.Context) (caller, source string) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", ""
+	}
+	if p.Addr != nil {
+		source = p.Addr.String()
+	}
+	if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.PeerCertificates) > 0 {
+		caller = info.State.PeerCertificates[0].Subject.CommonName
+	}
+	if !a.gateways[caller] {
+		return caller, source
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(callerHeader); len(v) > 0 {
+		caller = v[0]
+	}
+	if v := md.Get(sourceHeader); len(v) > 0 {
+		source = v[0]
+	}
+	return caller, source
+}
+
+// QueryAudit returns the entries of the audit log matching the request
+func (s *kvServer) QueryAudit(ctx context.Context, req *pb.QueryAuditRequest) (*pb.QueryAuditResponse, error) {
+	if s.audit == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "the audit log is not enabled on this node")
+	}
+	limit := int(req.Limit)
+	switch {
+	case limit < 0:
+		return nil, status.Errorf(codes.InvalidArgument, "limit must not be negative")
+	case limit == 0:
+		limit = defaultAuditQueryLimit
+	case limit > maxAuditQueryLimit:
+		limit = maxAuditQueryLimit
+	}
+	f := auditFilter{key: req.Key, namespace: req.Namespace, caller: req.Caller}
+	if req.SinceUnixMs > 0 {
+		f.since = time.UnixMilli(req.SinceUnixMs)
+	}
+	if req.UntilUnixMs > 0 {
+		f.until = time.UnixMilli(req.UntilUnixMs)
+	}
+
+	var from *auditCursor
+	if req.Cursor != "" {
+		var err error
+		if from, err = decodeAuditCursor(req.Cursor); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid cursor: %v", err)
+		}
+	}
+
+	entries, next, err := s.audit.query(f, limit, from)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read the audit log: %v", err)
+	}
+	resp := &pb.QueryAuditResponse{More: next != nil}
+	if next != nil {
+		resp.NextCursor = next.encode()
+	}
+	for _, e := range entries {
+		resp.Entries = append(resp.Entries, &pb.AuditEntry{
+			TimeUnixMs:  e.Time.UnixMilli(),
+			Caller:      e.Caller,
+			Source:      e.Source,
+			Op:          e.Op,
+			Namespace:   e.Namespace,
+			Key:         e.Key,
+			ValueSha256: e.ValueSHA256,
+			Version:     e.Version,
+			Outcome:     e.Outcome,
+			Code:        e.Code,
+			Message:     e.Message,
+		})
+	}
+	return resp, nil
+}
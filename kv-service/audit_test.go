@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// testGateway is the common name of the gateway certificate the audit tests
+// trust
+const testGateway = "api-service"
+
+// newAuditServer returns a test server that audits into dir, trusting
+// testGateway unless opts names other gateways, and whose clock the test
+// advances by hand
+func newAuditServer(t *testing.T, opts auditOptions) (*kvServer, *time.Time) {
+	t.Helper()
+	if opts.Gateways == nil {
+		opts.Gateways = []string{testGateway}
+	}
+	s := newTestServer(t)
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	a, err := openAuditLog(opts, s.now)
+	if err != nil {
+		t.Fatalf("openAuditLog() error = %v", err)
+	}
+	t.Cleanup(func() { a.close() })
+	s.audit = a
+	return s, &now
+}
+
+// asCaller returns a context carrying the metadata testGateway sends
+func asCaller(caller, source string) context.Context {
+	return fromPeer(testGateway, "192.0.2.1:40000", metadata.Pairs(callerHeader, caller, sourceHeader, source))
+}
+
+// fromPeer returns a context for a request from addr with a client
+// certificate for commonName and the metadata md
+func fromPeer(commonName, addr string, md metadata.MD) context.Context {
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: tcpAddr,
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: commonName}}},
+		}},
+	})
+	return metadata.NewIncomingContext(ctx, md)
+}
+
+func sha256Hex(v string) string {
+	sum := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAuditRecordsWrites(t *testing.T) {
+	server, _ := newAuditServer(t, auditOptions{Dir: t.TempDir()})
+	alice := asCaller("alice", "203.0.113.7")
+	createNamespace(t, server, "team", nil)
+
+	set, _ := server.Set(alice, &pb.SetRequest{Key: "a", Value: "1"})
+	server.Set(alice, &pb.SetRequest{Key: "a", Value: "1", TtlSeconds: -1})
+	server.CompareAndSet(alice, &pb.CompareAndSetRequest{Key: "a", Value: "2", ExpectedVersion: set.Version + 10})
+	server.Delete(asCaller("bob", "198.51.100.1"), &pb.DeleteRequest{Key: "missing"})
+	server.Delete(context.Background(), &pb.DeleteRequest{Key: "a"})
+	batch, _ := server.BatchSet(alice, &pb.BatchSetRequest{Namespace: "team", Items: []*pb.SetRequest{{Key: "x", Value: "v"}, {Key: "", Value: "v"}}})
+	txn, _ := server.Txn(alice, &pb.TxnRequest{Namespace: "team", Success: []*pb.TxnOp{
+		{Type: pb.TxnOp_GET, Key: "x"},
+		{Type: pb.TxnOp_DELETE, Key: "x"},
+		{Type: pb.TxnOp_PUT, Key: "y", Value: "w"},
+	}})
+	server.Touch(alice, &pb.TouchRequest{Namespace: "team", Key: "y", TtlSeconds: 60})
+
+	resp, err := server.QueryAudit(context.Background(), &pb.QueryAuditRequest{})
+	if err != nil {
+		t.Fatalf("QueryAudit() error = %v", err)
+	}
+	want := []struct {
+		caller, op, namespace, key, outcome, code, value string
+		version                                          uint64
+	}{
+		{"alice", auditSet, "", "a", outcomeOK, "", "1", set.Version},
+		{"alice", auditSet, "", "a", outcomeError, "InvalidArgument", "1", 0},
+		{"alice", auditSet, "", "a", outcomeError, "FailedPrecondition", "2", 0},
+		{"bob", auditDelete, "", "missing", outcomeNotFound, "", "", 0},
+		{"", auditDelete, "", "a", outcomeOK, "", "", set.Version + 1},
+		{"alice", auditSet, "team", "x", outcomeOK, "", "v", batch.Revision},
+		{"alice", auditSet, "team", "", outcomeError, "InvalidArgument", "v", 0},
+		{"alice", auditDelete, "team", "x", outcomeOK, "", "", txn.Revision},
+		{"alice", auditSet, "team", "y", outcomeOK, "", "w", txn.Revision},
+		{"alice", auditTouch, "team", "y", outcomeOK, "", "", txn.Revision + 1},
+	}
+	if len(resp.Entries) != len(want) {
+		t.Fatalf("QueryAudit() returned %d entries, want %d: %v", len(resp.Entries), len(want), resp.Entries)
+	}
+	for i, w := range want {
+		e := resp.Entries[i]
+		if e.Caller != w.caller || e.Op != w.op || e.Namespace != w.namespace || e.Key != w.key || e.Outcome != w.outcome || e.Code != w.code || e.Version != w.version {
+			t.Errorf("entry %d = %v, want %+v", i, e, w)
+		}
+		if w.value != "" && e.ValueSha256 != sha256Hex(w.value) {
+			t.Errorf("entry %d value_sha256 = %q, want the SHA-256 of %q", i, e.ValueSha256, w.value)
+		}
+		if w.caller == "alice" && e.Source != "203.0.113.7" {
+			t.Errorf("entry %d source = %q, want the forwarded address", i, e.Source)
+		}
+	}
+}
+
+func TestAuditIgnoresCallerMetadataFromOtherClients(t *testing.T) {
+	server, _ := newAuditServer(t, auditOptions{Dir: t.TempDir()})
+	spoofed := metadata.Pairs(callerHeader, "alice", sourceHeader, "203.0.113.7")
+
+	server.Set(fromPeer("mallory", "198.51.100.9:5000", spoofed), &pb.SetRequest{Key: "a", Value: "1"})
+	server.Set(fromPeer("", "198.51.100.10:5000", spoofed), &pb.SetRequest{Key: "a", Value: "2"})
+	server.Set(metadata.NewIncomingContext(context.Background(), spoofed), &pb.SetRequest{Key: "a", Value: "3"})
+	server.Set(fromPeer(testGateway, "192.0.2.1:40000", spoofed), &pb.SetRequest{Key: "a", Value: "4"})
+
+	resp, err := server.QueryAudit(context.Background(), &pb.QueryAuditRequest{})
+	if err != nil {
+		t.Fatalf("QueryAudit() error = %v", err)
+	}
+	want := []struct{ caller, source string }{
+		{"mallory", "198.51.100.9:5000"},
+		{"", "198.51.100.10:5000"},
+		{"", ""},
+		{"alice", "203.0.113.7"},
+	}
+	if len(resp.Entries) != len(want) {
+		t.Fatalf("QueryAudit() returned %d entries, want %d", len(resp.Entries), len(want))
+	}
+	for i, w := range want {
+		if e := resp.Entries[i]; e.Caller != w.caller || e.Source != w.source {
+			t.Errorf("entry %d caller, source = %q, %q, want %q, %q", i, e.Caller, e.Source, w.caller, w.source)
+		}
+	}
+}
+
+func TestQueryAuditFilters(t *testing.T) {
+	server, now := newAuditServer(t, auditOptions{Dir: t.TempDir()})
+	start := *now
+	for i, caller := range []string{"alice", "bob", "alice", "carol"} {
+		server.Set(asCaller(caller, ""), &pb.SetRequest{Key: []string{"a", "b", "a", "a"}[i], Value: "v"})
+		*now = now.Add(time.Minute)
+	}
+	createNamespace(t, server, "team", nil)
+	server.Set(asCaller("alice", ""), &pb.SetRequest{Namespace: "team", Key: "a", Value: "v"})
+
+	count := func(req *pb.QueryAuditRequest) int {
+		t.Helper()
+		resp, err := server.QueryAudit(context.Background(), req)
+		if err != nil {
+			t.Fatalf("QueryAudit(%v) error = %v", req, err)
+		}
+		return len(resp.Entries)
+	}
+	tests := []struct {
+		name string
+		req  *pb.QueryAuditRequest
+		want int
+	}{
+		{"key", &pb.QueryAuditRequest{Key: "a"}, 4},
+		{"key in default", &pb.QueryAuditRequest{Key: "a", Namespace: "default"}, 3},
+		{"namespace", &pb.QueryAuditRequest{Namespace: "team"}, 1},
+		{"caller", &pb.QueryAuditRequest{Caller: "alice"}, 3},
+		{"since", &pb.QueryAuditRequest{SinceUnixMs: start.Add(time.Minute).UnixMilli()}, 4},
+		{"until", &pb.QueryAuditRequest{UntilUnixMs: start.Add(time.Minute).UnixMilli()}, 1},
+		{"range", &pb.QueryAuditRequest{Caller: "alice", SinceUnixMs: start.Add(time.Minute).UnixMilli(), UntilUnixMs: start.Add(3 * time.Minute).UnixMilli()}, 1},
+	}
+	for _, tt := range tests {
+		if got := count(tt.req); got != tt.want {
+			t.Errorf("%s: got %d entries, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	resp, _ := server.QueryAudit(context.Background(), &pb.QueryAuditRequest{Limit: 2})
+	if len(resp.Entries) != 2 || !resp.More || resp.Entries[0].Caller != "alice" || resp.Entries[1].Caller != "bob" {
+		t.Errorf("QueryAudit(limit 2) = %v, more = %v, want the two oldest entries and more", resp.Entries, resp.More)
+	}
+}
+
+func TestQueryAuditCursor(t *testing.T) {
+	server, now := newAuditServer(t, auditOptions{Dir: t.TempDir(), MaxSize: 1024})
+	write := func(from, to int) {
+		for i := from; i < to; i++ {
+			server.Set(asCaller("alice", ""), &pb.SetRequest{Key: fmt.Sprintf("k%02d", i), Value: "v"})
+			// Every entry falls in the same millisecond
+			*now = now.Add(time.Microsecond)
+		}
+	}
+	write(0, 12)
+
+	// Page through with a write between pages that rotates the file the
+	// cursor points into
+	var keys []string
+	var cursor string
+	for page := 0; ; page++ {
+		resp, err := server.QueryAudit(context.Background(), &pb.QueryAuditRequest{Limit: 5, Cursor: cursor})
+		if err != nil {
+			t.Fatalf("QueryAudit(page %d) error = %v", page, err)
+		}
+		for _, e := range resp.Entries {
+			keys = append(keys, e.Key)
+		}
+		if resp.More != (resp.NextCursor != "") {
+			t.Fatalf("page %d: more = %v with next_cursor %q", page, resp.More, resp.NextCursor)
+		}
+		if !resp.More {
+			break
+		}
+		if page == 1 {
+			before, _ := server.audit.rotatedFiles()
+			write(12, 20)
+			if after, _ := server.audit.rotatedFiles(); len(after) == len(before) {
+				t.Fatalf("Expected the writes between pages to rotate the log")
+			}
+		}
+		cursor = resp.NextCursor
+	}
+	if len(keys) != 20 {
+		t.Fatalf("Paged through %d entries, want 20: %v", len(keys), keys)
+	}
+	for i, key := range keys {
+		if want := fmt.Sprintf("k%02d", i); key != want {
+			t.Fatalf("entry %d is %q, want %q: %v", i, key, want, keys)
+		}
+	}
+
+	_, err := server.QueryAudit(context.Background(), &pb.QueryAuditRequest{Cursor: "not a cursor"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("QueryAudit(bad cursor) error = %v, want InvalidArgument", err)
+	}
+}
+
+func TestAuditLogRotates(t *testing.T) {
+	dir := t.TempDir()
+	server, now := newAuditServer(t, auditOptions{Dir: dir, MaxSize: 1024, Retain: 2})
+	for i := 0; i < 40; i++ {
+		server.Set(asCaller("alice", ""), &pb.SetRequest{Key: "k", Value: strings.Repeat("v", i)})
+		*now = now.Add(time.Second)
+	}
+
+	rotated, err := server.audit.rotatedFiles()
+	if err != nil {
+		t.Fatalf("rotatedFiles() error = %v", err)
+	}
+	if len(rotated) != 2 {
+		t.Errorf("Expected 2 rotated files to be kept, got %v", rotated)
+	}
+	for _, name := range append(rotated, auditCurrent) {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1024 {
+			t.Errorf("%s is %d bytes, more than the maximum size", name, info.Size())
+		}
+	}
+
+	// Queries read the kept files in order, and the newest entry is last
+	resp, err := server.QueryAudit(context.Background(), &pb.QueryAuditRequest{Limit: maxAuditQueryLimit})
+	if err != nil {
+		t.Fatalf("QueryAudit() error = %v", err)
+	}
+	for i := 1; i < len(resp.Entries); i++ {
+		if resp.Entries[i].TimeUnixMs <= resp.Entries[i-1].TimeUnixMs {
+			t.Fatalf("Entries are out of order at %d", i)
+		}
+	}
+	if last := resp.Entries[len(resp.Entries)-1]; last.ValueSha256 != sha256Hex(strings.Repeat("v", 39)) {
+		t.Errorf("Expected the last entry to be the latest write, got %v", last)
+	}
+}
+
+func TestAuditLogSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	server, _ := newAuditServer(t, auditOptions{Dir: dir})
+	server.Set(asCaller("alice", ""), &pb.SetRequest{Key: "a", Value: "1"})
+	server.audit.close()
+
+	// A line torn by a crash doesn't hide the entries around it
+	f, _ := os.OpenFile(filepath.Join(dir, auditCurrent), os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString(`{"time":"2026-01-02T03:04:05Z","op":"se` + "\n")
+	f.Close()
+
+	server, _ = newAuditServer(t, auditOptions{Dir: dir})
+	server.Set(asCaller("bob", ""), &pb.SetRequest{Key: "a", Value: "2"})
+	resp, err := server.QueryAudit(context.Background(), &pb.QueryAuditRequest{Key: "a"})
+	if err != nil {
+		t.Fatalf("QueryAudit() error = %v", err)
+	}
+	if len(resp.Entries) != 2 || resp.Entries[0].Caller != "alice" || resp.Entries[1].Caller != "bob" {
+		t.Errorf("QueryAudit() = %v, want the entries from before and after the restart", resp.Entries)
+	}
+}
+
+func TestQueryAuditWithoutLog(t *testing.T) {
+	_, err := newTestServer(t).QueryAudit(context.Background(), &pb.QueryAuditRequest{})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("QueryAudit() error = %v, want %v", err, codes.FailedPrecondition)
+	}
+}
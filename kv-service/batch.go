@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxBatchSize bounds the number of keys in a batch, since the whole batch is
+// processed under one acquisition of the lock
+const maxBatchSize = 1000
+
+func checkBatchSize(n int) error {
+	if n > maxBatchSize {
+		return status.Errorf(codes.InvalidArgument, "batches are limited to %d keys, got %d", maxBatchSize, n)
+	}
+	return nil
+}
+
+// batchItemError wraps the error for one item of an atomic batch so the
+// caller can tell which item failed
+func batchItemError(i int, key string, err error) error {
+	st := status.Convert(err)
+	return status.Errorf(st.Code(), "item %d (key '%s'): %s", i, key, st.Message())
+}
+
+// BatchGet reads every requested key under a single read lock, so the
+// results are a consistent view of the store
+func (s *kvServer) BatchGet(ctx context.Context, req *pb.BatchGetRequest) (*pb.BatchResponse, error) {
+	if err := checkBatchSize(len(req.Keys)); err != nil {
+		return nil, err
+	}
+	n, err := s.namespace(req.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	s.rlockAll()
+	defer s.runlockAll()
+
+	now := s.now().UnixNano()
+	results := make([]*pb.BatchResult, len(req.Keys))
+	for i, key := range req.Keys {
+		if err := n.checkKey(key); err != nil {
+			results[i] = &pb.BatchResult{Key: key, Message: status.Convert(err).Message()}
+			continue
+		}
+		e, found, err := s.lookup(n.key(key))
+		if err != nil {
+			return nil, err
+		}
+		if !found || e.expired(now) {
+			results[i] = &pb.BatchResult{Key: key, Message: fmt.Sprintf("Key '%s' not found", key)}
+			continue
+		}
+		if s.budget != nil {
+			s.budget.touch(n.key(key))
+		}
+		results[i] = &pb.BatchResult{
+			Key:         key,
+			Success:     true,
+			Message:     "Key retrieved successfully",
+			Value:       textValue(e.value),
+			Version:     e.version,
+			ValueBytes:  []byte(e.value),
+			ContentType: e.contentType,
+		}
+	}
+	log.Printf("BatchGet keys=%d", len(req.Keys))
+
+	return &pb.BatchResponse{Results: results, Revision: s.rev}, nil
+}
+
+// BatchSet stores every valid item under a single write lock. The writes are
+// logged as one WAL record, so they share a revision and survive a crash
+// together.
+func (s *kvServer) BatchSet(ctx context.Context, req *pb.BatchSetRequest) (resp *pb.BatchResponse, err error) {
+	events := make([]auditEvent, len(req.Items))
+	for i, item := range req.Items {
+		events[i] = auditEvent{op: auditSet, namespace: req.Namespace, key: item.Key, sum: s.auditSum(item.Value, item.ValueBytes)}
+	}
+	defer func() { s.recordAudit(ctx, batchAudit(events, resp, err)...) }()
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := checkBatchSize(len(req.Items)); err != nil {
+		return nil, err
+	}
+	n, err := s.namespace(req.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*pb.BatchResult, len(req.Items))
+	var valid []*pb.SetRequest
+	var values []string
+	var written []*pb.BatchResult
+	for i, item := range req.Items {
+		results[i] = &pb.BatchResult{Key: item.Key}
+		value, err := s.requestValue(n, item.Value, item.ValueBytes, item.ContentType)
+		if err == nil {
+			err = n.checkKey(item.Key)
+		}
+		switch {
+		case err != nil:
+		case item.Key == "":
+			err = status.Errorf(codes.InvalidArgument, "key is required")
+		default:
+			err = checkTTL(item.TtlSeconds)
+		}
+		if err != nil {
+			if req.Atomic {
+				return nil, batchItemError(i, item.Key, err)
+			}
+			results[i].Message = status.Convert(err).Message()
+			events[i].err = err
+			continue
+		}
+		valid = append(valid, item)
+		values = append(values, value)
+		written = append(written, results[i])
+	}
+
+	revision, err := s.mutate(ctx, func(v *txnView) (*walRecord, error) {
+		if len(valid) == 0 {
+			return nil, nil
+		}
+		if err := s.checkNamespace(n); err != nil {
+			return nil, err
+		}
+		rec := walRecord{Op: walOpTxn}
+		for i, item := range valid {
+			rec.Ops = append(rec.Ops, walRecord{Op: walOpSet, Key: n.key(item.Key), Value: values[i], ExpiresAt: s.expiryFor(n.ttl(item.TtlSeconds)), ContentType: item.ContentType})
+		}
+		return &rec, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, result := range written {
+		result.Success = true
+		result.Message = fmt.Sprintf("Key '%s' set successfully", result.Key)
+		result.Version = revision
+	}
+	log.Printf("BatchSet keys=%d, written=%d, revision=%d", len(req.Items), len(written), revision)
+
+	return &pb.BatchResponse{Results: results, Revision: revision}, nil
+}
+
+// BatchDelete deletes every item under a single write lock. Missing keys are
+// reported as unsuccessful without failing the batch, like Delete.
+func (s *kvServer) BatchDelete(ctx context.Context, req *pb.BatchDeleteRequest) (resp *pb.BatchResponse, err error) {
+	events := make([]auditEvent, len(req.Items))
+	for i, item := range req.Items {
+		events[i] = auditEvent{op: auditDelete, namespace: req.Namespace, key: item.Key}
+	}
+	defer func() { s.recordAudit(ctx, batchAudit(events, resp, err)...) }()
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := checkBatchSize(len(req.Items)); err != nil {
+		return nil, err
+	}
+	n, err := s.namespace(req.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		results []*pb.BatchResult
+		deleted []*pb.BatchResult
+	)
+	// A key may appear more than once, so later items must see earlier
+	// deletes through the view
+	revision, err := s.mutate(ctx, func(view *txnView) (*walRecord, error) {
+		if err := s.checkNamespace(n); err != nil {
+			return nil, err
+		}
+		results = make([]*pb.BatchResult, len(req.Items))
+		deleted = nil
+		rec := walRecord{Op: walOpTxn}
+		for i, item := range req.Items {
+			result := &pb.BatchResult{Key: item.Key}
+			results[i] = result
+			events[i] = auditEvent{op: auditDelete, namespace: req.Namespace, key: item.Key}
+
+			if err := n.checkKey(item.Key); err != nil {
+				if req.Atomic {
+					return nil, batchItemError(i, item.Key, err)
+				}
+				result.Message = status.Convert(err).Message()
+				events[i].err = err
+				continue
+			}
+			key := n.key(item.Key)
+			e, found, _ := view.get(key)
+			if item.ExpectedVersion != 0 {
+				if err := checkVersion(item.Key, e, found, item.ExpectedVersion, false); err != nil {
+					if req.Atomic {
+						return nil, batchItemError(i, item.Key, err)
+					}
+					result.Message = status.Convert(err).Message()
+					events[i].err = err
+					continue
+				}
+			}
+			if !found {
+				result.Message = fmt.Sprintf("Key '%s' not found", item.Key)
+				events[i].missing = true
+				continue
+			}
+
+			view.put(key, entry{}, false)
+			rec.Ops = append(rec.Ops, walRecord{Op: walOpDelete, Key: key})
+			deleted = append(deleted, result)
+		}
+		if len(rec.Ops) == 0 {
+			return nil, nil
+		}
+		return &rec, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, result := range deleted {
+		result.Success = true
+		result.Message = fmt.Sprintf("Key '%s' deleted successfully", result.Key)
+	}
+	log.Printf("BatchDelete keys=%d, deleted=%d, revision=%d", len(req.Items), len(deleted), revision)
+
+	return &pb.BatchResponse{Results: results, Revision: revision}, nil
+}
+
+// batchAudit completes the audit events of a batch's items once it has run:
+// written items get the batch's revision, and if the batch failed as a whole
+// every item fails with it
+func batchAudit(events []auditEvent, resp *pb.BatchResponse, err error) []auditEvent {
+	for i := range events {
+		switch {
+		case err != nil:
+			events[i].err = err
+		case resp.Results[i].Success:
+			events[i].version = resp.Revision
+		}
+	}
+	return events
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBatchSetAndGet(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+
+	setResp, err := server.BatchSet(ctx, &pb.BatchSetRequest{Items: []*pb.SetRequest{
+		{Key: "a", Value: "1"},
+		{Key: "", Value: "no key"},
+		{Key: "b", Value: "2", TtlSeconds: -1},
+		{Key: "c", Value: "3", TtlSeconds: 60},
+	}})
+	if err != nil {
+		t.Fatalf("BatchSet() error = %v", err)
+	}
+	wantSuccess := []bool{true, false, false, true}
+	for i, result := range setResp.Results {
+		if result.Success != wantSuccess[i] {
+			t.Errorf("BatchSet() result %d = %v, want success=%v", i, result, wantSuccess[i])
+		}
+	}
+	if v := setResp.Results[0].Version; v != setResp.Revision || v != setResp.Results[3].Version {
+		t.Errorf("BatchSet() versions = %d, %d; want shared revision %d", v, setResp.Results[3].Version, setResp.Revision)
+	}
+
+	getResp, err := server.BatchGet(ctx, &pb.BatchGetRequest{Keys: []string{"c", "b", "a"}})
+	if err != nil {
+		t.Fatalf("BatchGet() error = %v", err)
+	}
+	got := getResp.Results
+	if len(got) != 3 || !got[0].Success || got[0].Value != "3" || got[1].Success || !got[2].Success || got[2].Value != "1" {
+		t.Errorf("BatchGet() = %v, want c=3, b missing, a=1", got)
+	}
+	if getResp.Revision != setResp.Revision {
+		t.Errorf("BatchGet() revision = %d, want %d", getResp.Revision, setResp.Revision)
+	}
+}
+
+func TestBatchSetAtomic(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+
+	_, err := server.BatchSet(ctx, &pb.BatchSetRequest{Atomic: true, Items: []*pb.SetRequest{
+		{Key: "a", Value: "1"},
+		{Key: "b", Value: "2", TtlSeconds: -1},
+	}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("BatchSet(atomic) error = %v, want InvalidArgument", err)
+	}
+	resp, _ := server.Get(ctx, &pb.GetRequest{Key: "a"})
+	if resp.Found {
+		t.Errorf("Get(a) found = true, want false after failed atomic batch")
+	}
+}
+
+func TestBatchDelete(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+
+	a, _ := server.Set(ctx, &pb.SetRequest{Key: "a", Value: "1"})
+	server.Set(ctx, &pb.SetRequest{Key: "b", Value: "2"})
+
+	resp, err := server.BatchDelete(ctx, &pb.BatchDeleteRequest{Items: []*pb.DeleteRequest{
+		{Key: "a", ExpectedVersion: a.Version},
+		{Key: "a"},
+		{Key: "b", ExpectedVersion: a.Version},
+		{Key: "missing"},
+	}})
+	if err != nil {
+		t.Fatalf("BatchDelete() error = %v", err)
+	}
+	wantSuccess := []bool{true, false, false, false}
+	for i, result := range resp.Results {
+		if result.Success != wantSuccess[i] {
+			t.Errorf("BatchDelete() result %d = %v, want success=%v", i, result, wantSuccess[i])
+		}
+	}
+	if get, _ := server.Get(ctx, &pb.GetRequest{Key: "b"}); !get.Found {
+		t.Errorf("Get(b) found = false, want true after version mismatch")
+	}
+
+	_, err = server.BatchDelete(ctx, &pb.BatchDeleteRequest{Atomic: true, Items: []*pb.DeleteRequest{
+		{Key: "b"},
+		{Key: "c", ExpectedVersion: 1},
+	}})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("BatchDelete(atomic) error = %v, want FailedPrecondition", err)
+	}
+	if get, _ := server.Get(ctx, &pb.GetRequest{Key: "b"}); !get.Found {
+		t.Errorf("Get(b) found = false, want true after failed atomic batch")
+	}
+}
+
+func TestBatchSizeLimit(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+
+	keys := make([]string, maxBatchSize+1)
+	_, err := server.BatchGet(ctx, &pb.BatchGetRequest{Keys: keys})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("BatchGet() with %d keys error = %v, want InvalidArgument", len(keys), err)
+	}
+}
+
+func TestBatchSetReplay(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	server, err := openKVServer(dir, serverOptions{WAL: walOptions{Sync: syncAlways}})
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	server.BatchSet(ctx, &pb.BatchSetRequest{Items: []*pb.SetRequest{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}})
+	server.BatchDelete(ctx, &pb.BatchDeleteRequest{Items: []*pb.DeleteRequest{{Key: "a"}}})
+	if err := server.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	server, err = openKVServer(dir, serverOptions{WAL: walOptions{Sync: syncAlways}})
+	if err != nil {
+		t.Fatalf("openKVServer() after restart error = %v", err)
+	}
+	defer server.Close()
+
+	resp, _ := server.BatchGet(ctx, &pb.BatchGetRequest{Keys: []string{"a", "b"}})
+	if resp.Results[0].Success || !resp.Results[1].Success || resp.Results[1].Value != "2" {
+		t.Errorf("BatchGet() after restart = %v, want a missing and b=2", resp.Results)
+	}
+}
@@ -0,0 +1,841 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	bitcaskOpPut    byte = 1
+	bitcaskOpDelete byte = 2
+	bitcaskOpCommit byte = 3
+	// bitcaskOpReset starts the output of a compaction and discards every
+	// record before it
+	bitcaskOpReset byte = 4
+
+	bitcaskPrefix            = "data-"
+	bitcaskSuffix            = ".log"
+	defaultBitcaskSegment    = 64 << 20
+	defaultBitcaskCompactMin = 16 << 20
+	bitcaskHeaderSize        = walHeaderSize
+	bitcaskMaxRecordSize     = walMaxRecordSize
+	// bitcaskPurgeBatch is how many records purge copies per hold of the
+	// server's write lock
+	bitcaskPurgeBatch = 256
+)
+
+type bitcaskOptions struct {
+	// SegmentSize is the size at which the active data file is rotated
+	SegmentSize int64
+	// CompactMin is the least garbage, in bytes, that triggers a compaction
+	// once there is also more garbage than live data
+	CompactMin int64
+}
+
+// bitcaskEngine is a persistent engine in the style of Bitcask. Every write
+// is appended to a data file and an in-memory key directory maps each key to
+// the position of its latest value, so values don't have to fit in memory
+// and a read costs one disk access. Overwritten and deleted values are
+// garbage until a compaction copies the live entries to fresh files.
+//
+// Records are framed like WAL records, crc32c(payload) | len(payload) |
+// payload, where the payload is one of
+//
+//	put    | len(key) key | len(value) value | expiresAt | version [| len(contentType) contentType]
+//	delete | len(key) key
+//	commit | rev
+//	reset
+//
+// with uvarint integers, the content type being left out when the value has
+// none. Replay applies the writes up to the last commit
+// only, so the engine always reopens at a revision boundary, and a reset
+// discards everything before it.
+type bitcaskEngine struct {
+	dir  string
+	opts bitcaskOptions
+
+	keys  map[string]bitcaskLoc
+	index *keyIndex
+	rev   uint64
+	// segs holds the data files oldest first; the last one is appended to
+	segs []*bitcaskSegment
+	// live and garbage count the bytes of current and of superseded records
+	live, garbage int64
+
+	// mu guards the reference counts of segments, which snapshots drop
+	// without holding the server's lock
+	mu sync.Mutex
+}
+
+type bitcaskSegment struct {
+	id   uint64
+	path string
+	f    *os.File
+	size int64
+	// refs counts the engine while the file is current, plus every snapshot
+	// that may still read from it. The file is deleted when it drops to 0.
+	refs int
+}
+
+// bitcaskLoc is the key directory entry of a key
+type bitcaskLoc struct {
+	seg *bitcaskSegment
+	// off and n locate the value in the data file
+	off int64
+	n   int
+	// size is the size of the whole record
+	size        int64
+	expiresAt   int64
+	version     uint64
+	contentType string
+}
+
+// bitcaskRecord is a decoded data file record. valuePos is the offset of
+// the value within the payload.
+type bitcaskRecord struct {
+	op          byte
+	key         string
+	valuePos    int
+	valueLen    int
+	expiresAt   int64
+	version     uint64
+	contentType string
+	rev         uint64
+}
+
+// openBitcask opens (or creates) the data files in dir and rebuilds the key
+// directory from them. Writes after the last commit are an interrupted
+// revision and are cut off.
+func openBitcask(dir string, opts bitcaskOptions) (*bitcaskEngine, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultBitcaskSegment
+	}
+	if opts.CompactMin <= 0 {
+		opts.CompactMin = defaultBitcaskCompactMin
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create bitcask dir: %w", err)
+	}
+	ids, err := listBitcaskSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &bitcaskEngine{dir: dir, opts: opts, keys: make(map[string]bitcaskLoc), index: newKeyIndex()}
+	type pendingOp struct {
+		rec bitcaskRecord
+		loc bitcaskLoc
+		seg int
+	}
+	var (
+		pending []pendingOp
+		// the position just past the last commit, and the segment holding
+		// the last reset applied
+		commitSeg, resetSeg = -1, 0
+		commitEnd           int64
+	)
+	for i, id := range ids {
+		seg, err := b.openSegment(id)
+		if err != nil {
+			b.close()
+			return nil, err
+		}
+		b.segs = append(b.segs, seg)
+		good, err := replayBitcask(seg, func(rec bitcaskRecord, off, size int64) {
+			if rec.op != bitcaskOpCommit {
+				loc := bitcaskLoc{seg: seg, off: off + bitcaskHeaderSize + int64(rec.valuePos), n: rec.valueLen, size: size, expiresAt: rec.expiresAt, version: rec.version, contentType: rec.contentType}
+				pending = append(pending, pendingOp{rec: rec, loc: loc, seg: i})
+				return
+			}
+			for _, p := range pending {
+				switch p.rec.op {
+				case bitcaskOpPut:
+					b.setLoc(p.rec.key, p.loc)
+				case bitcaskOpDelete:
+					b.dropLoc(p.rec.key, p.loc.size)
+				case bitcaskOpReset:
+					b.keys = make(map[string]bitcaskLoc)
+					b.index = newKeyIndex()
+					b.live, b.garbage = 0, 0
+					resetSeg = p.seg
+				}
+			}
+			pending = pending[:0]
+			b.garbage += size
+			b.rev = rec.rev
+			commitSeg, commitEnd = i, off+size
+		})
+		if err != nil {
+			if i != len(ids)-1 {
+				b.close()
+				return nil, fmt.Errorf("bitcask file %s is corrupt at offset %d: %w", seg.path, good, err)
+			}
+			log.Printf("Bitcask: discarding torn tail of %s at offset %d: %v", seg.path, good, err)
+		}
+		seg.size = good
+	}
+
+	// Drop the writes of an interrupted revision, and the files a finished
+	// compaction had not deleted yet
+	for len(b.segs) > commitSeg+1 {
+		seg := b.segs[len(b.segs)-1]
+		b.segs = b.segs[:len(b.segs)-1]
+		if err := b.removeSegment(seg); err != nil {
+			b.close()
+			return nil, err
+		}
+	}
+	if commitSeg >= 0 {
+		seg := b.segs[commitSeg]
+		if seg.size != commitEnd {
+			if err := seg.f.Truncate(commitEnd); err != nil {
+				b.close()
+				return nil, fmt.Errorf("truncate bitcask file: %w", err)
+			}
+			seg.size = commitEnd
+		}
+		for _, seg := range b.segs[:resetSeg] {
+			if err := b.removeSegment(seg); err != nil {
+				b.close()
+				return nil, err
+			}
+		}
+		b.segs = b.segs[resetSeg:]
+	}
+
+	if len(b.segs) == 0 {
+		id := uint64(1)
+		if len(ids) > 0 {
+			id = ids[len(ids)-1] + 1
+		}
+		seg, err := b.createSegment(id)
+		if err != nil {
+			return nil, err
+		}
+		b.segs = append(b.segs, seg)
+	}
+	return b, nil
+}
+
+// setLoc points key at a new record
+func (b *bitcaskEngine) setLoc(key string, loc bitcaskLoc) {
+	if old, ok := b.keys[key]; ok {
+		b.live -= old.size
+		b.garbage += old.size
+	}
+	b.keys[key] = loc
+	b.index.insert(key)
+	b.live += loc.size
+}
+
+// dropLoc removes key after a tombstone of the given size was written
+func (b *bitcaskEngine) dropLoc(key string, size int64) {
+	b.garbage += size
+	if old, ok := b.keys[key]; ok {
+		b.live -= old.size
+		b.garbage += old.size
+		delete(b.keys, key)
+		b.index.remove(key)
+	}
+}
+
+func (b *bitcaskEngine) active() *bitcaskSegment {
+	return b.segs[len(b.segs)-1]
+}
+
+// readValue reads the value at loc from its data file
+func readValue(loc bitcaskLoc) (entry, error) {
+	buf := make([]byte, loc.n)
+	if _, err := loc.seg.f.ReadAt(buf, loc.off); err != nil {
+		return entry{}, fmt.Errorf("read %s at offset %d: %w", loc.seg.path, loc.off, err)
+	}
+	return entry{value: string(buf), expiresAt: loc.expiresAt, version: loc.version, contentType: loc.contentType}, nil
+}
+
+func (b *bitcaskEngine) get(key string) (entry, bool, error) {
+	loc, ok := b.keys[key]
+	if !ok {
+		return entry{}, false, nil
+	}
+	e, err := readValue(loc)
+	return e, err == nil, err
+}
+
+func (b *bitcaskEngine) put(key string, e entry) error {
+	loc, err := appendPut(b.active(), key, e)
+	if err != nil {
+		return err
+	}
+	b.setLoc(key, loc)
+	return nil
+}
+
+func (b *bitcaskEngine) delete(key string) error {
+	if _, ok := b.keys[key]; !ok {
+		return nil
+	}
+	payload := []byte{bitcaskOpDelete}
+	payload = binary.AppendUvarint(payload, uint64(len(key)))
+	payload = append(payload, key...)
+	if _, err := appendRecord(b.active(), payload); err != nil {
+		return err
+	}
+	b.dropLoc(key, bitcaskHeaderSize+int64(len(payload)))
+	return nil
+}
+
+// commit writes a commit record, then rotates the active file once it is
+// full and compacts when garbage outweighs live data. Failures to rotate or
+// compact are logged and retried on a later commit, since the revision
+// itself is already committed.
+func (b *bitcaskEngine) commit(rev uint64) error {
+	size, err := appendCommit(b.active(), rev)
+	if err != nil {
+		return err
+	}
+	b.garbage += size
+	b.rev = rev
+
+	if b.garbage >= b.opts.CompactMin && b.garbage > b.live {
+		live, garbage := len(b.keys), b.garbage
+		if err := b.rewrite(b, rev); err != nil {
+			log.Printf("Bitcask: compaction failed: %v", err)
+		} else {
+			log.Printf("Bitcask: compacted %d keys, reclaiming %d bytes", live, garbage)
+			return nil
+		}
+	}
+	if b.active().size >= b.opts.SegmentSize {
+		if err := b.rotate(); err != nil {
+			log.Printf("Bitcask: failed to rotate data file: %v", err)
+		}
+	}
+	return nil
+}
+
+// rotate starts a fresh active data file
+func (b *bitcaskEngine) rotate() error {
+	seg, err := b.createSegment(b.active().id + 1)
+	if err != nil {
+		return err
+	}
+	b.segs = append(b.segs, seg)
+	return nil
+}
+
+func (b *bitcaskEngine) revision() uint64 {
+	return b.rev
+}
+
+func (b *bitcaskEngine) len() int {
+	return len(b.keys)
+}
+
+func (b *bitcaskEngine) ascend(start string, fn func(key string, e entry) bool) error {
+	var err error
+	b.index.ascend(start, func(key string) bool {
+		var e entry
+		if e, err = readValue(b.keys[key]); err != nil {
+			return false
+		}
+		return fn(key, e)
+	})
+	return err
+}
+
+func (b *bitcaskEngine) load(store map[string]entry, rev uint64) error {
+	return b.rewrite(entriesOf(store), rev)
+}
+
+// rewrite writes the entries of src to fresh data files that start with a
+// reset and end with a commit at rev, then retires the current files. The
+// new files only take effect on replay once that commit is on disk.
+func (b *bitcaskEngine) rewrite(src entrySource, rev uint64) error {
+	var (
+		segs  []*bitcaskSegment
+		keys  = make(map[string]bitcaskLoc, src.len())
+		index = newKeyIndex()
+		live  int64
+	)
+	fail := func(err error) error {
+		for _, seg := range segs {
+			b.removeSegment(seg)
+		}
+		return err
+	}
+
+	seg, err := b.createSegment(b.active().id + 1)
+	if err != nil {
+		return err
+	}
+	segs = append(segs, seg)
+	if _, err := appendRecord(seg, []byte{bitcaskOpReset}); err != nil {
+		return fail(err)
+	}
+	var werr error
+	err = src.ascend("", func(key string, e entry) bool {
+		if seg.size >= b.opts.SegmentSize {
+			if seg, werr = b.createSegment(seg.id + 1); werr != nil {
+				return false
+			}
+			segs = append(segs, seg)
+		}
+		var loc bitcaskLoc
+		if loc, werr = appendPut(seg, key, e); werr != nil {
+			return false
+		}
+		keys[key] = loc
+		index.insert(key)
+		live += loc.size
+		return true
+	})
+	if err == nil {
+		err = werr
+	}
+	if err == nil {
+		_, err = appendCommit(seg, rev)
+	}
+	for _, s := range segs {
+		if err == nil {
+			err = s.f.Sync()
+		}
+	}
+	if err == nil {
+		err = syncDir(b.dir)
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	old := b.segs
+	b.segs, b.keys, b.index, b.rev = segs, keys, index, rev
+	b.live, b.garbage = live, 0
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range old {
+		b.unrefLocked(s)
+	}
+	return nil
+}
+
+// purge retires every data file that existed when it started, oldest first,
+// after copying the entries that still live in it to the active file, so
+// that no file keeps a value that was overwritten or deleted. Going oldest
+// first means a retired file never holds a tombstone that a remaining file
+// still needs.
+func (b *bitcaskEngine) purge(lock func() uint64, unlock func()) error {
+	lock()
+	err := b.rotate()
+	old := slices.Clone(b.segs[:len(b.segs)-1])
+	// Hold a reference to each file, since a compaction may retire them
+	// while they are scanned
+	b.mu.Lock()
+	for _, seg := range old {
+		seg.refs++
+	}
+	b.mu.Unlock()
+	unlock()
+	defer func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for _, seg := range old {
+			b.unrefLocked(seg)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	for _, seg := range old {
+		if err := b.purgeSegment(seg, lock, unlock); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeSegment copies the entries that still live in seg to the active file,
+// bitcaskPurgeBatch at a time under the lock and each batch committed at the
+// server's revision, then syncs the copies and retires seg. It stops early
+// if a compaction has retired seg already.
+func (b *bitcaskEngine) purgeSegment(seg *bitcaskSegment, lock func() uint64, unlock func()) error {
+	type put struct {
+		key string
+		off int64
+	}
+	var puts []put
+	if _, err := replayBitcask(seg, func(rec bitcaskRecord, off, size int64) {
+		if rec.op == bitcaskOpPut {
+			puts = append(puts, put{key: rec.key, off: off + bitcaskHeaderSize + int64(rec.valuePos)})
+		}
+	}); err != nil {
+		return fmt.Errorf("read %s: %w", seg.path, err)
+	}
+
+	for len(puts) > 0 {
+		batch := puts[:min(len(puts), bitcaskPurgeBatch)]
+		puts = puts[len(batch):]
+		rev := lock()
+		if !slices.Contains(b.segs, seg) {
+			unlock()
+			return nil
+		}
+		var err error
+		for _, p := range batch {
+			if err = b.copyLive(seg, p.key, p.off); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = b.commit(rev)
+		}
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Sync the files the copies went to, which all come after seg, and
+	// retire seg
+	lock()
+	defer unlock()
+	i := slices.Index(b.segs, seg)
+	if i < 0 {
+		return nil
+	}
+	for _, s := range b.segs[i+1:] {
+		if err := s.f.Sync(); err != nil {
+			return fmt.Errorf("sync %s: %w", s.path, err)
+		}
+	}
+	b.segs = slices.Delete(b.segs, i, i+1)
+	b.garbage = max(b.garbage-seg.size, 0)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.unrefLocked(seg)
+	return nil
+}
+
+// copyLive appends the value of key to the active file if the key directory
+// still points at off in seg
+func (b *bitcaskEngine) copyLive(seg *bitcaskSegment, key string, off int64) error {
+	loc, ok := b.keys[key]
+	if !ok || loc.seg != seg || loc.off != off {
+		return nil
+	}
+	e, err := readValue(loc)
+	if err != nil {
+		return err
+	}
+	if loc, err = appendPut(b.active(), key, e); err != nil {
+		return err
+	}
+	b.setLoc(key, loc)
+	return nil
+}
+
+// snapshot copies the key directory. The data files it points into are
+// kept open, even across a compaction, until the snapshot is released.
+func (b *bitcaskEngine) snapshot() (engineSnapshot, error) {
+	snap := &bitcaskSnapshot{b: b, segs: append([]*bitcaskSegment(nil), b.segs...)}
+	snap.items = make([]bitcaskItem, 0, len(b.keys))
+	b.index.ascend("", func(key string) bool {
+		snap.items = append(snap.items, bitcaskItem{key: key, loc: b.keys[key]})
+		return true
+	})
+	b.mu.Lock()
+	for _, seg := range snap.segs {
+		seg.refs++
+	}
+	b.mu.Unlock()
+	return snap, nil
+}
+
+// close flushes the active data file and closes every file
+func (b *bitcaskEngine) close() error {
+	var err error
+	if len(b.segs) > 0 {
+		err = b.active().f.Sync()
+	}
+	for _, seg := range b.segs {
+		if cerr := seg.f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	b.segs = nil
+	return err
+}
+
+func (b *bitcaskEngine) createSegment(id uint64) (*bitcaskSegment, error) {
+	path := filepath.Join(b.dir, bitcaskSegmentName(id))
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("create bitcask file: %w", err)
+	}
+	if err := syncDir(b.dir); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &bitcaskSegment{id: id, path: path, f: f, refs: 1}, nil
+}
+
+func (b *bitcaskEngine) openSegment(id uint64) (*bitcaskSegment, error) {
+	path := filepath.Join(b.dir, bitcaskSegmentName(id))
+	f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open bitcask file: %w", err)
+	}
+	return &bitcaskSegment{id: id, path: path, f: f, refs: 1}, nil
+}
+
+// removeSegment closes and deletes a data file that nothing else references
+func (b *bitcaskEngine) removeSegment(seg *bitcaskSegment) error {
+	seg.f.Close()
+	if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove bitcask file: %w", err)
+	}
+	return nil
+}
+
+// unrefLocked drops a reference to seg and deletes the file with the last one
+func (b *bitcaskEngine) unrefLocked(seg *bitcaskSegment) {
+	if seg.refs--; seg.refs > 0 {
+		return
+	}
+	if err := b.removeSegment(seg); err != nil {
+		log.Printf("Bitcask: %v", err)
+	}
+}
+
+// bitcaskItem is a key and its location in a snapshot
+type bitcaskItem struct {
+	key string
+	loc bitcaskLoc
+}
+
+type bitcaskSnapshot struct {
+	b     *bitcaskEngine
+	items []bitcaskItem
+	segs  []*bitcaskSegment
+}
+
+func (s *bitcaskSnapshot) len() int {
+	return len(s.items)
+}
+
+func (s *bitcaskSnapshot) ascend(start string, fn func(key string, e entry) bool) error {
+	i := sort.Search(len(s.items), func(i int) bool { return s.items[i].key >= start })
+	for _, item := range s.items[i:] {
+		e, err := readValue(item.loc)
+		if err != nil {
+			return err
+		}
+		if !fn(item.key, e) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *bitcaskSnapshot) release() {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	for _, seg := range s.segs {
+		s.b.unrefLocked(seg)
+	}
+	s.segs = nil
+}
+
+// appendRecord frames payload and appends it to seg, returning its offset
+func appendRecord(seg *bitcaskSegment, payload []byte) (int64, error) {
+	if len(payload) > bitcaskMaxRecordSize {
+		return 0, fmt.Errorf("write %s: %w", seg.path, errRecordTooLarge)
+	}
+	buf := make([]byte, bitcaskHeaderSize, bitcaskHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.Checksum(payload, crcTable))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(payload)))
+	buf = append(buf, payload...)
+	off := seg.size
+	if _, err := seg.f.WriteAt(buf, off); err != nil {
+		return 0, fmt.Errorf("write %s: %w", seg.path, err)
+	}
+	seg.size += int64(len(buf))
+	return off, nil
+}
+
+// appendPut appends a put record to seg and returns where its value is
+func appendPut(seg *bitcaskSegment, key string, e entry) (bitcaskLoc, error) {
+	payload := make([]byte, 0, 1+5*binary.MaxVarintLen64+len(key)+len(e.value)+len(e.contentType))
+	payload = append(payload, bitcaskOpPut)
+	payload = binary.AppendUvarint(payload, uint64(len(key)))
+	payload = append(payload, key...)
+	payload = binary.AppendUvarint(payload, uint64(len(e.value)))
+	valuePos := len(payload)
+	payload = append(payload, e.value...)
+	payload = binary.AppendUvarint(payload, uint64(e.expiresAt))
+	payload = binary.AppendUvarint(payload, e.version)
+	if e.contentType != "" {
+		payload = binary.AppendUvarint(payload, uint64(len(e.contentType)))
+		payload = append(payload, e.contentType...)
+	}
+
+	off, err := appendRecord(seg, payload)
+	if err != nil {
+		return bitcaskLoc{}, err
+	}
+	return bitcaskLoc{
+		seg:         seg,
+		off:         off + bitcaskHeaderSize + int64(valuePos),
+		n:           len(e.value),
+		size:        bitcaskHeaderSize + int64(len(payload)),
+		expiresAt:   e.expiresAt,
+		version:     e.version,
+		contentType: e.contentType,
+	}, nil
+}
+
+// appendCommit appends a commit record for rev and returns its size
+func appendCommit(seg *bitcaskSegment, rev uint64) (int64, error) {
+	payload := binary.AppendUvarint([]byte{bitcaskOpCommit}, rev)
+	if _, err := appendRecord(seg, payload); err != nil {
+		return 0, err
+	}
+	return bitcaskHeaderSize + int64(len(payload)), nil
+}
+
+var errBadBitcaskRecord = errors.New("malformed bitcask record")
+
+func decodeBitcaskRecord(payload []byte) (bitcaskRecord, error) {
+	var rec bitcaskRecord
+	if len(payload) < 1 {
+		return rec, errBadBitcaskRecord
+	}
+	rec.op = payload[0]
+	p := payload[1:]
+	switch rec.op {
+	case bitcaskOpPut, bitcaskOpDelete:
+		key, rest, ok := readBytes(p)
+		if !ok {
+			return rec, errBadBitcaskRecord
+		}
+		rec.key, p = string(key), rest
+		if rec.op == bitcaskOpDelete {
+			break
+		}
+		value, rest, ok := readBytes(p)
+		if !ok {
+			return rec, errBadBitcaskRecord
+		}
+		rec.valuePos = len(payload) - len(rest) - len(value)
+		rec.valueLen = len(value)
+		p = rest
+		exp, n := binary.Uvarint(p)
+		if n <= 0 {
+			return rec, errBadBitcaskRecord
+		}
+		rec.expiresAt = int64(exp)
+		p = p[n:]
+		if rec.version, n = binary.Uvarint(p); n <= 0 {
+			return rec, errBadBitcaskRecord
+		}
+		p = p[n:]
+		if len(p) > 0 {
+			contentType, rest, ok := readBytes(p)
+			if !ok {
+				return rec, errBadBitcaskRecord
+			}
+			rec.contentType, p = string(contentType), rest
+		}
+	case bitcaskOpCommit:
+		var n int
+		if rec.rev, n = binary.Uvarint(p); n <= 0 {
+			return rec, errBadBitcaskRecord
+		}
+		p = p[n:]
+	case bitcaskOpReset:
+	default:
+		return rec, fmt.Errorf("unknown bitcask op %d", rec.op)
+	}
+	if len(p) != 0 {
+		return rec, errBadBitcaskRecord
+	}
+	return rec, nil
+}
+
+// replayBitcask calls apply with the offset and size of every intact record
+// in seg. It returns the offset just past the last good record and, if the
+// file did not end cleanly, the reason.
+func replayBitcask(seg *bitcaskSegment, apply func(rec bitcaskRecord, off, size int64)) (int64, error) {
+	r := bufio.NewReader(io.NewSectionReader(seg.f, 0, 1<<62))
+	var (
+		offset int64
+		header [bitcaskHeaderSize]byte
+	)
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			return offset, err
+		}
+		sum := binary.LittleEndian.Uint32(header[0:4])
+		size := binary.LittleEndian.Uint32(header[4:8])
+		if size == 0 || size > bitcaskMaxRecordSize {
+			return offset, fmt.Errorf("invalid record length %d", size)
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return offset, err
+		}
+		if crc32.Checksum(payload, crcTable) != sum {
+			return offset, errors.New("checksum mismatch")
+		}
+		rec, err := decodeBitcaskRecord(payload)
+		if err != nil {
+			return offset, err
+		}
+		apply(rec, offset, bitcaskHeaderSize+int64(size))
+		offset += bitcaskHeaderSize + int64(size)
+	}
+}
+
+func bitcaskSegmentName(id uint64) string {
+	return fmt.Sprintf("%s%016x%s", bitcaskPrefix, id, bitcaskSuffix)
+}
+
+// listBitcaskSegments returns the ID of every data file in dir in ascending
+// order
+func listBitcaskSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read bitcask dir: %w", err)
+	}
+	var ids []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, bitcaskPrefix) || !strings.HasSuffix(name, bitcaskSuffix) {
+			continue
+		}
+		var id uint64
+		hex := strings.TrimSuffix(strings.TrimPrefix(name, bitcaskPrefix), bitcaskSuffix)
+		if _, err := fmt.Sscanf(hex, "%x", &id); err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestBitcask(t *testing.T, dir string, opts bitcaskOptions) *bitcaskEngine {
+	t.Helper()
+	b, err := openBitcask(dir, opts)
+	if err != nil {
+		t.Fatalf("openBitcask() error = %v", err)
+	}
+	t.Cleanup(func() { b.close() })
+	return b
+}
+
+func TestBitcaskDropsUncommittedWrites(t *testing.T) {
+	dir := t.TempDir()
+	b := openTestBitcask(t, dir, bitcaskOptions{})
+	b.put("kept", entry{value: "v", version: 1})
+	b.commit(1)
+	b.put("lost", entry{value: "v", version: 2})
+	b.delete("kept")
+	b.close()
+
+	b = openTestBitcask(t, dir, bitcaskOptions{})
+	if b.revision() != 1 {
+		t.Errorf("revision() = %d, want 1", b.revision())
+	}
+	if _, found, _ := b.get("kept"); !found {
+		t.Errorf("get(kept) found = false; the uncommitted delete was replayed")
+	}
+	if _, found, _ := b.get("lost"); found {
+		t.Errorf("get(lost) found = true; the uncommitted put was replayed")
+	}
+
+	// Writes continue from the cut
+	b.put("after", entry{value: "v", version: 2})
+	b.commit(2)
+	b.close()
+	b = openTestBitcask(t, dir, bitcaskOptions{})
+	if _, found, _ := b.get("after"); !found || b.revision() != 2 {
+		t.Errorf("get(after) found = %v at revision %d, want true at 2", found, b.revision())
+	}
+}
+
+func TestBitcaskTornTail(t *testing.T) {
+	dir := t.TempDir()
+	b := openTestBitcask(t, dir, bitcaskOptions{})
+	b.put("kept", entry{value: "v"})
+	b.commit(1)
+	b.put("torn", entry{value: "v"})
+	b.commit(2)
+	b.close()
+
+	path := filepath.Join(dir, bitcaskSegmentName(1))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if err := os.Truncate(path, info.Size()-2); err != nil {
+		t.Fatalf("Truncate() error = %v", err)
+	}
+
+	b = openTestBitcask(t, dir, bitcaskOptions{})
+	if b.revision() != 1 || b.len() != 1 {
+		t.Errorf("reopened at revision %d with %d keys, want 1 and 1", b.revision(), b.len())
+	}
+	if _, found, _ := b.get("torn"); found {
+		t.Errorf("get(torn) found = true, want false")
+	}
+}
+
+func TestBitcaskCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := bitcaskOptions{SegmentSize: 4 << 10, CompactMin: 16 << 10}
+	b := openTestBitcask(t, dir, opts)
+	rev := uint64(0)
+	write := func(key, value string) {
+		rev++
+		if err := b.put(key, entry{value: value, version: rev}); err != nil {
+			t.Fatalf("put() error = %v", err)
+		}
+		if err := b.commit(rev); err != nil {
+			t.Fatalf("commit() error = %v", err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		write(fmt.Sprintf("key-%02d", i), "first")
+	}
+	old, err := b.snapshot()
+	if err != nil {
+		t.Fatalf("snapshot() error = %v", err)
+	}
+	first := b.segs[0].path
+
+	// Overwriting every key many times turns most of the data into garbage
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 50; i++ {
+			write(fmt.Sprintf("key-%02d", i), fmt.Sprintf("round-%d", round))
+		}
+	}
+	if b.garbage > b.live+opts.CompactMin {
+		t.Errorf("garbage = %d bytes with %d live, want it compacted away", b.garbage, b.live)
+	}
+
+	// The snapshot still reads the values it was taken with, from files
+	// that were kept for it
+	if _, err := os.Stat(first); err != nil {
+		t.Errorf("data file of a live snapshot was removed: %v", err)
+	}
+	old.ascend("", func(key string, e entry) bool {
+		if e.value != "first" {
+			t.Errorf("snapshot %s = %q, want first", key, e.value)
+		}
+		return true
+	})
+	old.release()
+	if _, err := os.Stat(first); !os.IsNotExist(err) {
+		t.Errorf("compacted data file survived the release of the last snapshot")
+	}
+
+	b.close()
+	b = openTestBitcask(t, dir, opts)
+	if b.revision() != rev || b.len() != 50 {
+		t.Errorf("reopened at revision %d with %d keys, want %d and 50", b.revision(), b.len(), rev)
+	}
+	if e, _, _ := b.get("key-07"); e.value != "round-19" {
+		t.Errorf("get(key-07) = %q, want round-19", e.value)
+	}
+}
+
+func TestBitcaskIgnoresFilesBeforeReset(t *testing.T) {
+	dir := t.TempDir()
+	b := openTestBitcask(t, dir, bitcaskOptions{})
+	b.put("gone", entry{value: "old"})
+	b.commit(1)
+	stale, err := os.ReadFile(filepath.Join(dir, bitcaskSegmentName(1)))
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if err := b.load(map[string]entry{"new": {value: "v"}}, 5); err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	b.close()
+
+	// A crash before the replaced file was deleted leaves it behind
+	if err := os.WriteFile(filepath.Join(dir, bitcaskSegmentName(1)), stale, 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	b = openTestBitcask(t, dir, bitcaskOptions{})
+	if _, found, _ := b.get("gone"); found || b.len() != 1 || b.revision() != 5 {
+		t.Errorf("reopened with %d keys at revision %d, want only the loaded key at 5", b.len(), b.revision())
+	}
+	if _, err := os.Stat(filepath.Join(dir, bitcaskSegmentName(1))); !os.IsNotExist(err) {
+		t.Errorf("the replaced data file was not removed on open")
+	}
+}
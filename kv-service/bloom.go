@@ -0,0 +1,79 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// bloomBitsPerKey gives a false positive rate of about 1%
+const bloomBitsPerKey = 10
+
+// bloomFilter answers whether a key may be in a set, with no false
+// negatives. Each key sets k bits chosen by double hashing a 64-bit hash.
+type bloomFilter struct {
+	bits []byte
+	k    uint8
+}
+
+// newBloomFilter returns a filter sized for n keys
+func newBloomFilter(n int) *bloomFilter {
+	nbits := max(n*bloomBitsPerKey, 64)
+	k := uint8(math.Round(bloomBitsPerKey * math.Ln2))
+	return &bloomFilter{bits: make([]byte, (nbits+7)/8), k: k}
+}
+
+// bloomHash is FNV-1a followed by a finalizer, since the filter relies on
+// the low bits, which FNV alone leaves close together for similar keys
+func bloomHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return x
+}
+
+// add puts key in the set
+func (f *bloomFilter) add(key string) {
+	f.addHash(bloomHash(key))
+}
+
+// addHash adds a key by its bloomHash
+func (f *bloomFilter) addHash(h uint64) {
+	delta := h>>33 | h<<31
+	nbits := uint64(len(f.bits)) * 8
+	for i := uint8(0); i < f.k; i++ {
+		bit := h % nbits
+		f.bits[bit/8] |= 1 << (bit % 8)
+		h += delta
+	}
+}
+
+// mayContain reports false only if key was never added
+func (f *bloomFilter) mayContain(key string) bool {
+	h := bloomHash(key)
+	delta := h>>33 | h<<31
+	nbits := uint64(len(f.bits)) * 8
+	for i := uint8(0); i < f.k; i++ {
+		bit := h % nbits
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+// encode appends the filter as its bits followed by k
+func (f *bloomFilter) encode(buf []byte) []byte {
+	buf = append(buf, f.bits...)
+	return append(buf, f.k)
+}
+
+func decodeBloomFilter(p []byte) (*bloomFilter, bool) {
+	if len(p) < 2 || p[len(p)-1] == 0 {
+		return nil, false
+	}
+	return &bloomFilter{bits: p[:len(p)-1], k: p[len(p)-1]}, true
+}
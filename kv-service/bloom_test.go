@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	const n = 10000
+	f := newBloomFilter(n)
+	for i := 0; i < n; i++ {
+		f.add(fmt.Sprintf("key-%d", i))
+	}
+	for i := 0; i < n; i++ {
+		if !f.mayContain(fmt.Sprintf("key-%d", i)) {
+			t.Fatalf("mayContain(key-%d) = false for an added key", i)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < n; i++ {
+		if f.mayContain(fmt.Sprintf("other-%d", i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / n; rate > 0.03 {
+		t.Errorf("false positive rate = %.3f, want about 0.01", rate)
+	}
+
+	decoded, ok := decodeBloomFilter(f.encode(nil))
+	if !ok || !decoded.mayContain("key-42") || decoded.k != f.k {
+		t.Errorf("decodeBloomFilter(encode()) did not round trip")
+	}
+	if _, ok := decodeBloomFilter([]byte{0}); ok {
+		t.Errorf("decodeBloomFilter() accepted a truncated filter")
+	}
+}
@@ -0,0 +1,982 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+)
+
+const (
+	btreeMagic = "KVBTREE1"
+	// btreePageSize is the unit of allocation; a node spans as many
+	// contiguous pages as it needs
+	btreePageSize = 4096
+	// btreeHeaderSize is crc32c | type | 3 unused bytes | pages | length
+	btreeHeaderSize = 16
+	// btreeNodeSize is the payload size at which a node is split
+	btreeNodeSize = btreePageSize - btreeHeaderSize
+	// btreeEntryOverhead bounds the varints of an entry
+	btreeEntryOverhead = 3 * binary.MaxVarintLen64
+
+	btreeLeaf   byte = 1
+	btreeBranch byte = 2
+	// btreeTypedLeaf is a leaf whose entries end with a content type
+	btreeTypedLeaf byte = 3
+
+	defaultBTreeFlushSize  = 4 << 20
+	defaultBTreeCachePages = 8192
+
+	// btreePurgeBatch is how many free pages purge scrubs per hold of the
+	// server's write lock
+	btreePurgeBatch = 256
+)
+
+type btreeOptions struct {
+	// FlushSize is roughly how many bytes of pages may change in memory
+	// before a commit writes them out
+	FlushSize int64
+	// CachePages is the number of pages whose decoded nodes are cached
+	CachePages int
+}
+
+// btreeEngine is a copy-on-write B+tree in a single file. Nodes are never
+// modified in place: a write copies the path from the root down to the leaf
+// it changes, so every root is an immutable tree and a snapshot is just a
+// root, readable without locks while writes carry on.
+//
+// Pages 0 and 1 hold two copies of the meta record, the root page,
+// revision, key count and file size, which are written alternately. Commits
+// collect changes in memory and, once FlushSize of pages have changed,
+// write the new nodes to free pages, sync them, then write the meta to the
+// older slot and sync it. The newest meta with a valid checksum wins on
+// open, so a crash leaves either the old tree or the new one, never a
+// mix, and the engine reopens at the revision of that meta. Pages replaced
+// by a flush are reused once no snapshot can still read them. The free
+// list isn't stored; it is rebuilt on open from the pages the tree reaches.
+type btreeEngine struct {
+	path string
+	f    *os.File
+	opts btreeOptions
+
+	// root, count and rev are the current tree and the last commit, which
+	// only the server's writers change. dirty estimates the bytes changed
+	// since the last flush and superseded lists the pages they replaced.
+	root       btRef
+	count      int
+	rev        uint64
+	dirty      int64
+	superseded []uint64
+	highwater  uint64
+
+	// mu guards the fields below, which snapshots use without the server's
+	// lock
+	mu   sync.Mutex
+	meta btreeMeta
+	// free lists reusable pages in ascending order, and pending the pages
+	// freed by each flush until no snapshot of an older tree remains
+	free    []uint64
+	pending map[uint64][]uint64
+	// readers counts the live snapshots by the flush they were taken after
+	readers map[uint64]int
+
+	cacheMu sync.Mutex
+	cache   map[uint64]*btNode
+}
+
+// btreeMeta is the durable state of the tree as of a flush
+type btreeMeta struct {
+	txid, rev, root, count, highwater uint64
+}
+
+// btNode is a decoded node. keys[i] of a branch is a lower bound for the
+// keys under children[i] and greater than every key under children[i-1].
+// Nodes are immutable once they are reachable from a root.
+type btNode struct {
+	leaf     bool
+	keys     []string
+	entries  []entry
+	children []btRef
+	// pgid and pages locate the node on disk; pgid is 0 for a node that
+	// only exists in memory
+	pgid  uint64
+	pages int
+}
+
+// btRef points to a child by page, or at a node not yet written. The zero
+// btRef is an empty tree.
+type btRef struct {
+	pgid uint64
+	node *btNode
+}
+
+func (r btRef) empty() bool {
+	return r.pgid == 0 && r.node == nil
+}
+
+func (n *btNode) clone() *btNode {
+	return &btNode{
+		leaf:     n.leaf,
+		keys:     slices.Clone(n.keys),
+		entries:  slices.Clone(n.entries),
+		children: slices.Clone(n.children),
+	}
+}
+
+// size is the encoded size of the payload, or a little more
+func (n *btNode) size() int {
+	size := binary.MaxVarintLen64
+	for i, k := range n.keys {
+		size += len(k) + btreeEntryOverhead
+		if n.leaf {
+			size += len(n.entries[i].value)
+			if ct := n.entries[i].contentType; ct != "" {
+				size += binary.MaxVarintLen64 + len(ct)
+			}
+		}
+	}
+	return size
+}
+
+// childIndex returns the child whose keys cover key
+func (n *btNode) childIndex(key string) int {
+	i := sort.Search(len(n.keys), func(i int) bool { return n.keys[i] > key }) - 1
+	return max(i, 0)
+}
+
+// replaceChild swaps children[i] for nodes, which may be none
+func (n *btNode) replaceChild(i int, nodes []*btNode) {
+	refs := make([]btRef, len(nodes))
+	keys := make([]string, len(nodes))
+	for j, c := range nodes {
+		refs[j], keys[j] = btRef{node: c}, c.keys[0]
+	}
+	n.children = slices.Replace(n.children, i, i+1, refs...)
+	n.keys = slices.Replace(n.keys, i, i+1, keys...)
+}
+
+// openBTree opens (or creates) the tree file at path
+func openBTree(path string, opts btreeOptions) (*btreeEngine, error) {
+	if opts.FlushSize <= 0 {
+		opts.FlushSize = defaultBTreeFlushSize
+	}
+	if opts.CachePages <= 0 {
+		opts.CachePages = defaultBTreeCachePages
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open btree file: %w", err)
+	}
+	b := &btreeEngine{
+		path:    path,
+		f:       f,
+		opts:    opts,
+		pending: make(map[uint64][]uint64),
+		readers: make(map[uint64]int),
+		cache:   make(map[uint64]*btNode),
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() == 0 {
+		meta := btreeMeta{highwater: 2}
+		for slot := uint64(0); slot < 2; slot++ {
+			if err := b.writeMeta(slot, meta); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("sync btree file: %w", err)
+		}
+		if err := syncDir(filepath.Dir(path)); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	meta, err := b.readMetas()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	b.meta = meta
+	b.root = btRef{pgid: meta.root}
+	b.count, b.rev, b.highwater = int(meta.count), meta.rev, meta.highwater
+
+	used := make(map[uint64]bool)
+	err = b.walkPages(b.root, func(pgid uint64, pages int) {
+		for p := pgid; p < pgid+uint64(pages); p++ {
+			used[p] = true
+		}
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	for p := uint64(2); p < b.highwater; p++ {
+		if !used[p] {
+			b.free = append(b.free, p)
+		}
+	}
+	return b, nil
+}
+
+// readMetas returns the newest meta with a valid checksum
+func (b *btreeEngine) readMetas() (btreeMeta, error) {
+	var (
+		best  btreeMeta
+		found bool
+	)
+	for slot := int64(0); slot < 2; slot++ {
+		buf := make([]byte, btreePageSize)
+		if _, err := b.f.ReadAt(buf, slot*btreePageSize); err != nil {
+			continue
+		}
+		meta, ok := decodeBTreeMeta(buf)
+		if ok && (!found || meta.txid > best.txid) {
+			best, found = meta, true
+		}
+	}
+	if !found {
+		return best, fmt.Errorf("btree file %s has no valid meta page", b.path)
+	}
+	return best, nil
+}
+
+// writeMeta writes meta to page slot. The meta is magic | page size |
+// txid | rev | root | count | highwater | crc32c, with fixed 64-bit
+// integers and a 32-bit page size.
+func (b *btreeEngine) writeMeta(slot uint64, meta btreeMeta) error {
+	buf := []byte(btreeMagic)
+	buf = binary.LittleEndian.AppendUint32(buf, btreePageSize)
+	for _, v := range []uint64{meta.txid, meta.rev, meta.root, meta.count, meta.highwater} {
+		buf = binary.LittleEndian.AppendUint64(buf, v)
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+	buf = slices.Grow(buf, btreePageSize-len(buf))[:btreePageSize]
+	if _, err := b.f.WriteAt(buf, int64(slot)*btreePageSize); err != nil {
+		return fmt.Errorf("write btree meta: %w", err)
+	}
+	return nil
+}
+
+func decodeBTreeMeta(buf []byte) (btreeMeta, bool) {
+	const size = len(btreeMagic) + 4 + 5*8
+	if string(buf[:len(btreeMagic)]) != btreeMagic || crc32.Checksum(buf[:size], crcTable) != binary.LittleEndian.Uint32(buf[size:]) {
+		return btreeMeta{}, false
+	}
+	if binary.LittleEndian.Uint32(buf[len(btreeMagic):]) != btreePageSize {
+		return btreeMeta{}, false
+	}
+	p := buf[len(btreeMagic)+4:]
+	return btreeMeta{
+		txid:      binary.LittleEndian.Uint64(p[0:8]),
+		rev:       binary.LittleEndian.Uint64(p[8:16]),
+		root:      binary.LittleEndian.Uint64(p[16:24]),
+		count:     binary.LittleEndian.Uint64(p[24:32]),
+		highwater: binary.LittleEndian.Uint64(p[32:40]),
+	}, true
+}
+
+// node returns the node ref points to, reading and caching it if it is
+// only on disk
+func (b *btreeEngine) node(ref btRef) (*btNode, error) {
+	if ref.node != nil {
+		return ref.node, nil
+	}
+	b.cacheMu.Lock()
+	n := b.cache[ref.pgid]
+	b.cacheMu.Unlock()
+	if n != nil {
+		return n, nil
+	}
+	n, err := b.readNode(ref.pgid)
+	if err != nil {
+		return nil, err
+	}
+	b.cacheMu.Lock()
+	for k := range b.cache {
+		if len(b.cache) < b.opts.CachePages {
+			break
+		}
+		delete(b.cache, k)
+	}
+	b.cache[ref.pgid] = n
+	b.cacheMu.Unlock()
+	return n, nil
+}
+
+// readNode reads and decodes the node at pgid, verifying its checksum
+func (b *btreeEngine) readNode(pgid uint64) (*btNode, error) {
+	buf := make([]byte, btreePageSize)
+	if _, err := b.f.ReadAt(buf, int64(pgid)*btreePageSize); err != nil {
+		return nil, fmt.Errorf("read btree page %d: %w", pgid, err)
+	}
+	pages := int(binary.LittleEndian.Uint32(buf[8:12]))
+	length := int(binary.LittleEndian.Uint32(buf[12:16]))
+	if pages < 1 || pages > math.MaxInt32/btreePageSize || length > pages*btreePageSize-btreeHeaderSize {
+		return nil, fmt.Errorf("btree page %d: bad header", pgid)
+	}
+	if pages > 1 {
+		buf = slices.Grow(buf, (pages-1)*btreePageSize)[:pages*btreePageSize]
+		if _, err := b.f.ReadAt(buf[btreePageSize:], int64(pgid+1)*btreePageSize); err != nil {
+			return nil, fmt.Errorf("read btree page %d: %w", pgid, err)
+		}
+	}
+	if crc32.Checksum(buf[4:btreeHeaderSize+length], crcTable) != binary.LittleEndian.Uint32(buf[0:4]) {
+		return nil, fmt.Errorf("btree page %d: checksum mismatch", pgid)
+	}
+	n, ok := decodeBTreeNode(buf[4], buf[btreeHeaderSize:btreeHeaderSize+length])
+	if !ok {
+		return nil, fmt.Errorf("btree page %d: malformed node", pgid)
+	}
+	n.pgid, n.pages = pgid, pages
+	return n, nil
+}
+
+// encodeBTreeNode encodes n as whole pages, with children at the given
+// pages. A leaf entry is len(key) key | len(value) value | expiresAt |
+// version, followed by len(contentType) contentType in a typed leaf, and a
+// branch entry len(key) key | child page, all uvarints, after the number of
+// entries. Leaves are only typed when one of their values has a content type.
+func encodeBTreeNode(n *btNode, children []uint64) []byte {
+	typed := n.leaf && slices.ContainsFunc(n.entries, func(e entry) bool { return e.contentType != "" })
+	buf := make([]byte, btreeHeaderSize, btreeHeaderSize+n.size())
+	buf = binary.AppendUvarint(buf, uint64(len(n.keys)))
+	for i, k := range n.keys {
+		buf = binary.AppendUvarint(buf, uint64(len(k)))
+		buf = append(buf, k...)
+		if n.leaf {
+			e := n.entries[i]
+			buf = binary.AppendUvarint(buf, uint64(len(e.value)))
+			buf = append(buf, e.value...)
+			buf = binary.AppendUvarint(buf, uint64(e.expiresAt))
+			buf = binary.AppendUvarint(buf, e.version)
+			if typed {
+				buf = binary.AppendUvarint(buf, uint64(len(e.contentType)))
+				buf = append(buf, e.contentType...)
+			}
+		} else {
+			buf = binary.AppendUvarint(buf, children[i])
+		}
+	}
+	length := len(buf) - btreeHeaderSize
+	pages := (len(buf) + btreePageSize - 1) / btreePageSize
+	buf = slices.Grow(buf, pages*btreePageSize-len(buf))[:pages*btreePageSize]
+	switch {
+	case typed:
+		buf[4] = btreeTypedLeaf
+	case n.leaf:
+		buf[4] = btreeLeaf
+	default:
+		buf[4] = btreeBranch
+	}
+	binary.LittleEndian.PutUint32(buf[8:12], uint32(pages))
+	binary.LittleEndian.PutUint32(buf[12:16], uint32(length))
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.Checksum(buf[4:btreeHeaderSize+length], crcTable))
+	return buf
+}
+
+func decodeBTreeNode(typ byte, p []byte) (*btNode, bool) {
+	if typ != btreeLeaf && typ != btreeBranch && typ != btreeTypedLeaf {
+		return nil, false
+	}
+	n := &btNode{leaf: typ != btreeBranch}
+	count, k := binary.Uvarint(p)
+	if k <= 0 || count > uint64(len(p)) {
+		return nil, false
+	}
+	p = p[k:]
+	n.keys = make([]string, 0, count)
+	for i := uint64(0); i < count; i++ {
+		key, rest, ok := readBytes(p)
+		if !ok {
+			return nil, false
+		}
+		n.keys, p = append(n.keys, string(key)), rest
+		if !n.leaf {
+			child, k := binary.Uvarint(p)
+			if k <= 0 {
+				return nil, false
+			}
+			n.children, p = append(n.children, btRef{pgid: child}), p[k:]
+			continue
+		}
+		value, rest, ok := readBytes(p)
+		if !ok {
+			return nil, false
+		}
+		p = rest
+		exp, k := binary.Uvarint(p)
+		if k <= 0 {
+			return nil, false
+		}
+		p = p[k:]
+		version, k := binary.Uvarint(p)
+		if k <= 0 {
+			return nil, false
+		}
+		p = p[k:]
+		e := entry{value: string(value), expiresAt: int64(exp), version: version}
+		if typ == btreeTypedLeaf {
+			contentType, rest, ok := readBytes(p)
+			if !ok {
+				return nil, false
+			}
+			e.contentType, p = string(contentType), rest
+		}
+		n.entries = append(n.entries, e)
+	}
+	return n, len(p) == 0 && len(n.keys) > 0
+}
+
+// walkPages calls fn for every page run the tree under ref occupies on disk
+func (b *btreeEngine) walkPages(ref btRef, fn func(pgid uint64, pages int)) error {
+	if ref.empty() {
+		return nil
+	}
+	n, err := b.node(ref)
+	if err != nil {
+		return err
+	}
+	if n.pgid != 0 {
+		fn(n.pgid, n.pages)
+	}
+	for _, c := range n.children {
+		if err := b.walkPages(c, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *btreeEngine) get(key string) (entry, bool, error) {
+	return b.lookup(b.root, key)
+}
+
+func (b *btreeEngine) lookup(ref btRef, key string) (entry, bool, error) {
+	if ref.empty() {
+		return entry{}, false, nil
+	}
+	for {
+		n, err := b.node(ref)
+		if err != nil {
+			return entry{}, false, err
+		}
+		if n.leaf {
+			if i, found := slices.BinarySearch(n.keys, key); found {
+				return n.entries[i], true, nil
+			}
+			return entry{}, false, nil
+		}
+		ref = n.children[n.childIndex(key)]
+	}
+}
+
+// cow returns a private copy of n to modify. If n is on disk, its pages
+// are superseded once the copy is flushed.
+func (b *btreeEngine) cow(n *btNode) *btNode {
+	if n.pgid != 0 {
+		for p := n.pgid; p < n.pgid+uint64(n.pages); p++ {
+			b.superseded = append(b.superseded, p)
+		}
+		b.dirty += int64(n.pages) * btreePageSize
+	}
+	return n.clone()
+}
+
+func (b *btreeEngine) put(key string, e entry) error {
+	b.dirty += int64(len(key) + len(e.value))
+	if b.root.empty() {
+		b.root = btRef{node: &btNode{leaf: true, keys: []string{key}, entries: []entry{e}}}
+		b.count++
+		return nil
+	}
+	nodes, found, err := b.insert(b.root, key, e)
+	if err != nil {
+		return err
+	}
+	if !found {
+		b.count++
+	}
+	b.setRoot(nodes)
+	return nil
+}
+
+// insert copies the path to key's leaf with key set to e, and returns the
+// copy of the node at ref, split if it grew too large
+func (b *btreeEngine) insert(ref btRef, key string, e entry) ([]*btNode, bool, error) {
+	n, err := b.node(ref)
+	if err != nil {
+		return nil, false, err
+	}
+	c := b.cow(n)
+	if c.leaf {
+		i, found := slices.BinarySearch(c.keys, key)
+		if found {
+			c.entries[i] = e
+		} else {
+			c.keys = slices.Insert(c.keys, i, key)
+			c.entries = slices.Insert(c.entries, i, e)
+		}
+		return splitBTreeNode(c), found, nil
+	}
+	i := c.childIndex(key)
+	nodes, found, err := b.insert(c.children[i], key, e)
+	if err != nil {
+		return nil, false, err
+	}
+	c.replaceChild(i, nodes)
+	return splitBTreeNode(c), found, nil
+}
+
+func (b *btreeEngine) delete(key string) error {
+	if b.root.empty() {
+		return nil
+	}
+	nodes, found, err := b.remove(b.root, key)
+	if err != nil || !found {
+		return err
+	}
+	b.count--
+	b.dirty += int64(len(key))
+	b.setRoot(nodes)
+	return nil
+}
+
+// remove copies the path to key's leaf without key, and returns the copy
+// of the node at ref, which is none once it is empty. Nothing is copied if
+// key is absent.
+func (b *btreeEngine) remove(ref btRef, key string) ([]*btNode, bool, error) {
+	n, err := b.node(ref)
+	if err != nil {
+		return nil, false, err
+	}
+	if n.leaf {
+		i, found := slices.BinarySearch(n.keys, key)
+		if !found {
+			return nil, false, nil
+		}
+		c := b.cow(n)
+		c.keys = slices.Delete(c.keys, i, i+1)
+		c.entries = slices.Delete(c.entries, i, i+1)
+		if len(c.keys) == 0 {
+			return nil, true, nil
+		}
+		return []*btNode{c}, true, nil
+	}
+	i := n.childIndex(key)
+	nodes, found, err := b.remove(n.children[i], key)
+	if err != nil || !found {
+		return nil, found, err
+	}
+	c := b.cow(n)
+	c.replaceChild(i, nodes)
+	if len(nodes) == 1 {
+		if err := b.mergeChild(c, i); err != nil {
+			return nil, false, err
+		}
+	}
+	if len(c.children) == 0 {
+		return nil, true, nil
+	}
+	return splitBTreeNode(c), true, nil
+}
+
+// mergeChild merges children[i] of n into a sibling when it has shrunk
+// below a quarter of a page, splitting the result again if needed
+func (b *btreeEngine) mergeChild(n *btNode, i int) error {
+	child := n.children[i].node
+	if len(n.children) < 2 || child.size() >= btreeNodeSize/4 {
+		return nil
+	}
+	lo := i
+	if i == len(n.children)-1 {
+		lo = i - 1
+	}
+	left, err := b.node(n.children[lo])
+	if err != nil {
+		return err
+	}
+	right, err := b.node(n.children[lo+1])
+	if err != nil {
+		return err
+	}
+	merged := b.cow(left)
+	right = b.cow(right)
+	merged.keys = append(merged.keys, right.keys...)
+	merged.entries = append(merged.entries, right.entries...)
+	merged.children = append(merged.children, right.children...)
+	n.replaceChild(lo+1, nil)
+	n.replaceChild(lo, splitBTreeNode(merged))
+	return nil
+}
+
+// setRoot makes nodes the new top of the tree, adding branches above them
+// while there are several and dropping new branches with a single child
+func (b *btreeEngine) setRoot(nodes []*btNode) {
+	for len(nodes) > 1 {
+		root := &btNode{children: []btRef{{}}, keys: []string{""}}
+		root.replaceChild(0, nodes)
+		nodes = splitBTreeNode(root)
+	}
+	if len(nodes) == 0 {
+		b.root = btRef{}
+		return
+	}
+	b.root = btRef{node: nodes[0]}
+	for n := b.root.node; n != nil && !n.leaf && len(n.children) == 1; n = b.root.node {
+		b.root = n.children[0]
+	}
+}
+
+// splitBTreeNode splits n into nodes of at most btreeNodeSize each, unless
+// it holds a single entry
+func splitBTreeNode(n *btNode) []*btNode {
+	size := n.size()
+	if size <= btreeNodeSize || len(n.keys) < 2 {
+		return []*btNode{n}
+	}
+	parts := (size + btreeNodeSize - 1) / btreeNodeSize
+	target := size / parts
+	var (
+		nodes []*btNode
+		start int
+		acc   int
+	)
+	for i, k := range n.keys {
+		s := len(k) + btreeEntryOverhead
+		if n.leaf {
+			s += len(n.entries[i].value)
+		}
+		if acc > 0 && acc+s > target && len(nodes) < parts-1 {
+			nodes = append(nodes, n.slice(start, i))
+			start, acc = i, 0
+		}
+		acc += s
+	}
+	return append(nodes, n.slice(start, len(n.keys)))
+}
+
+func (n *btNode) slice(i, j int) *btNode {
+	s := &btNode{leaf: n.leaf, keys: slices.Clone(n.keys[i:j])}
+	if n.leaf {
+		s.entries = slices.Clone(n.entries[i:j])
+	} else {
+		s.children = slices.Clone(n.children[i:j])
+	}
+	return s
+}
+
+// commit flushes once enough pages have changed
+func (b *btreeEngine) commit(rev uint64) error {
+	b.rev = rev
+	if b.dirty < b.opts.FlushSize {
+		return nil
+	}
+	return b.flush()
+}
+
+// flush writes the nodes that only exist in memory to free pages, syncs
+// them, and then points the older meta page at the new root
+func (b *btreeEngine) flush() error {
+	b.mu.Lock()
+	b.releaseLocked()
+	b.mu.Unlock()
+
+	root := uint64(0)
+	if !b.root.empty() {
+		var err error
+		if root, err = b.writeTree(b.root); err != nil {
+			return err
+		}
+	}
+	if err := b.f.Sync(); err != nil {
+		return fmt.Errorf("sync btree file: %w", err)
+	}
+	b.mu.Lock()
+	meta := btreeMeta{txid: b.meta.txid + 1, rev: b.rev, root: root, count: uint64(b.count), highwater: b.highwater}
+	b.mu.Unlock()
+	if err := b.writeMeta(meta.txid%2, meta); err != nil {
+		return err
+	}
+	if err := b.f.Sync(); err != nil {
+		return fmt.Errorf("sync btree file: %w", err)
+	}
+
+	b.mu.Lock()
+	b.meta = meta
+	if len(b.superseded) > 0 {
+		b.pending[meta.txid] = b.superseded
+	}
+	b.mu.Unlock()
+	b.superseded = nil
+	b.root = btRef{pgid: root}
+	b.dirty = 0
+	return nil
+}
+
+// writeTree writes the in-memory nodes under ref, children first, and
+// returns the page of ref
+func (b *btreeEngine) writeTree(ref btRef) (uint64, error) {
+	if ref.node == nil {
+		return ref.pgid, nil
+	}
+	n := ref.node
+	if n.pgid != 0 {
+		return n.pgid, nil
+	}
+	var children []uint64
+	for _, c := range n.children {
+		pgid, err := b.writeTree(c)
+		if err != nil {
+			return 0, err
+		}
+		children = append(children, pgid)
+	}
+	buf := encodeBTreeNode(n, children)
+	pages := len(buf) / btreePageSize
+	pgid := b.allocate(pages)
+	b.cacheMu.Lock()
+	for p := pgid; p < pgid+uint64(pages); p++ {
+		delete(b.cache, p)
+	}
+	b.cacheMu.Unlock()
+	if _, err := b.f.WriteAt(buf, int64(pgid)*btreePageSize); err != nil {
+		return 0, fmt.Errorf("write btree page %d: %w", pgid, err)
+	}
+	return pgid, nil
+}
+
+// allocate returns the first of n contiguous free pages, growing the file
+// if there is no such run
+func (b *btreeEngine) allocate(n int) uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := 0; i+n <= len(b.free); i++ {
+		if b.free[i+n-1]-b.free[i] == uint64(n-1) {
+			pgid := b.free[i]
+			b.free = slices.Delete(b.free, i, i+n)
+			return pgid
+		}
+	}
+	pgid := b.highwater
+	b.highwater += uint64(n)
+	return pgid
+}
+
+// releaseLocked moves the pages freed by each flush to the free list once
+// every snapshot left was taken after that flush
+func (b *btreeEngine) releaseLocked() {
+	oldest := uint64(math.MaxUint64)
+	for txid := range b.readers {
+		oldest = min(oldest, txid)
+	}
+	released := false
+	for txid, pages := range b.pending {
+		if txid <= oldest {
+			b.free = append(b.free, pages...)
+			delete(b.pending, txid)
+			released = true
+		}
+	}
+	if released {
+		slices.Sort(b.free)
+	}
+}
+
+// revision returns the revision of the last flush
+func (b *btreeEngine) revision() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.meta.rev
+}
+
+func (b *btreeEngine) len() int {
+	return b.count
+}
+
+func (b *btreeEngine) ascend(start string, fn func(key string, e entry) bool) error {
+	_, err := b.ascendFrom(b.root, start, fn)
+	return err
+}
+
+// ascendFrom walks the tree under ref and reports whether fn wants more
+func (b *btreeEngine) ascendFrom(ref btRef, start string, fn func(key string, e entry) bool) (bool, error) {
+	if ref.empty() {
+		return true, nil
+	}
+	n, err := b.node(ref)
+	if err != nil {
+		return false, err
+	}
+	if n.leaf {
+		for i := sort.SearchStrings(n.keys, start); i < len(n.keys); i++ {
+			if !fn(n.keys[i], n.entries[i]) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+	for i := n.childIndex(start); i < len(n.children); i++ {
+		if more, err := b.ascendFrom(n.children[i], start, fn); err != nil || !more {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// load builds a new tree from store bottom up and flushes it, freeing
+// every page of the old one
+func (b *btreeEngine) load(store map[string]entry, rev uint64) error {
+	err := b.walkPages(b.root, func(pgid uint64, pages int) {
+		for p := pgid; p < pgid+uint64(pages); p++ {
+			b.superseded = append(b.superseded, p)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	var level []*btNode
+	leaf := &btNode{leaf: true}
+	for _, item := range entriesOf(store) {
+		if len(leaf.keys) > 0 && leaf.size()+len(item.key)+len(item.value)+btreeEntryOverhead > btreeNodeSize {
+			level = append(level, leaf)
+			leaf = &btNode{leaf: true}
+		}
+		leaf.keys = append(leaf.keys, item.key)
+		leaf.entries = append(leaf.entries, item.entry)
+	}
+	if len(leaf.keys) > 0 {
+		level = append(level, leaf)
+	}
+	for len(level) > 1 {
+		var parents []*btNode
+		parent := &btNode{}
+		for _, c := range level {
+			if len(parent.keys) > 0 && parent.size()+len(c.keys[0])+btreeEntryOverhead > btreeNodeSize {
+				parents = append(parents, parent)
+				parent = &btNode{}
+			}
+			parent.keys = append(parent.keys, c.keys[0])
+			parent.children = append(parent.children, btRef{node: c})
+		}
+		level = append(parents, parent)
+	}
+	b.root = btRef{}
+	if len(level) == 1 {
+		b.root = btRef{node: level[0]}
+	}
+	b.count, b.rev = len(store), rev
+	return b.flush()
+}
+
+// purge flushes the tree and overwrites every free page with zeros, so that
+// the file keeps no copy of a value the tree no longer reaches. Pages that a
+// live snapshot can still read are left until they are reused. The pages
+// are scrubbed btreePurgeBatch at a time, each batch under the lock so that
+// a write can't reuse a page while it is zeroed; pages reused since the
+// flush hold newer data and are skipped.
+func (b *btreeEngine) purge(lock func() uint64, unlock func()) error {
+	b.rev = lock()
+	err := b.flush()
+	b.mu.Lock()
+	b.releaseLocked()
+	free := slices.Clone(b.free)
+	b.mu.Unlock()
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	zero := make([]byte, btreePageSize)
+	for len(free) > 0 {
+		batch := free[:min(len(free), btreePurgeBatch)]
+		free = free[len(batch):]
+		lock()
+		b.mu.Lock()
+		for _, pgid := range batch {
+			if _, ok := slices.BinarySearch(b.free, pgid); !ok {
+				continue
+			}
+			if _, err = b.f.WriteAt(zero, int64(pgid)*btreePageSize); err != nil {
+				err = fmt.Errorf("scrub btree page %d: %w", pgid, err)
+				break
+			}
+		}
+		b.mu.Unlock()
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if err := b.f.Sync(); err != nil {
+		return fmt.Errorf("sync btree file: %w", err)
+	}
+	return nil
+}
+
+// snapshot pins the current root. Pages it can reach stay untouched until
+// it is released, however many flushes happen meanwhile.
+func (b *btreeEngine) snapshot() (engineSnapshot, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	txid := b.meta.txid
+	b.readers[txid]++
+	return &btreeSnapshot{b: b, root: b.root, count: b.count, txid: txid}, nil
+}
+
+// close flushes any commits still in memory and closes the file
+func (b *btreeEngine) close() error {
+	if b.f == nil {
+		return nil
+	}
+	var err error
+	if b.dirty > 0 || b.rev != b.revision() {
+		err = b.flush()
+	}
+	if cerr := b.f.Close(); err == nil {
+		err = cerr
+	}
+	b.f = nil
+	return err
+}
+
+type btreeSnapshot struct {
+	b     *btreeEngine
+	root  btRef
+	count int
+	txid  uint64
+	done  bool
+}
+
+func (s *btreeSnapshot) len() int {
+	return s.count
+}
+
+func (s *btreeSnapshot) ascend(start string, fn func(key string, e entry) bool) error {
+	_, err := s.b.ascendFrom(s.root, start, fn)
+	return err
+}
+
+func (s *btreeSnapshot) release() {
+	if s.done {
+		return
+	}
+	s.done = true
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	if s.b.readers[s.txid]--; s.b.readers[s.txid] == 0 {
+		delete(s.b.readers, s.txid)
+	}
+}
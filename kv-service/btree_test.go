@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openTestBTree(t *testing.T, path string, opts btreeOptions) *btreeEngine {
+	t.Helper()
+	b, err := openBTree(path, opts)
+	if err != nil {
+		t.Fatalf("openBTree() error = %v", err)
+	}
+	t.Cleanup(func() { b.close() })
+	return b
+}
+
+// btreeDepth returns the number of levels from the root to a leaf
+func btreeDepth(t *testing.T, b *btreeEngine) int {
+	t.Helper()
+	depth := 0
+	for ref := b.root; !ref.empty(); depth++ {
+		n, err := b.node(ref)
+		if err != nil {
+			t.Fatalf("node() error = %v", err)
+		}
+		if n.leaf {
+			return depth + 1
+		}
+		ref = n.children[0]
+	}
+	return depth
+}
+
+func TestBTreeSplitsAndShrinks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "btree.db")
+	opts := btreeOptions{FlushSize: 64 << 10}
+	b := openTestBTree(t, path, opts)
+	rev := uint64(0)
+	for i := 0; i < 5000; i++ {
+		rev++
+		if err := b.put(fmt.Sprintf("key-%05d", (i*7919)%5000), entry{value: strings.Repeat("v", 50), version: rev}); err != nil {
+			t.Fatalf("put() error = %v", err)
+		}
+		if err := b.commit(rev); err != nil {
+			t.Fatalf("commit() error = %v", err)
+		}
+	}
+	if d := btreeDepth(t, b); d < 3 {
+		t.Errorf("depth = %d with 5000 keys, want the tree to have split", d)
+	}
+	keys := engineKeys(t, b, "key-04997")
+	if fmt.Sprint(keys) != "[key-04997 key-04998 key-04999]" || b.len() != 5000 {
+		t.Errorf("ascend(key-04997) = %v with %d keys", keys, b.len())
+	}
+
+	for i := 0; i < 5000; i++ {
+		if i%100 == 0 {
+			continue
+		}
+		rev++
+		if err := b.delete(fmt.Sprintf("key-%05d", i)); err != nil {
+			t.Fatalf("delete() error = %v", err)
+		}
+		b.commit(rev)
+	}
+	if d := btreeDepth(t, b); d > 2 {
+		t.Errorf("depth = %d with 50 keys left, want leaves merged back", d)
+	}
+	b.close()
+
+	b = openTestBTree(t, path, opts)
+	if b.revision() != rev || b.len() != 50 {
+		t.Errorf("reopened at revision %d with %d keys, want %d and 50", b.revision(), b.len(), rev)
+	}
+	if e, found, _ := b.get("key-00300"); !found || e.value != strings.Repeat("v", 50) {
+		t.Errorf("get(key-00300) = %+v, %v", e, found)
+	}
+	if _, found, _ := b.get("key-00301"); found {
+		t.Errorf("get(key-00301) found a deleted key")
+	}
+}
+
+func TestBTreeReopensAtLastIntactMeta(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "btree.db")
+	b := openTestBTree(t, path, btreeOptions{FlushSize: 1})
+	b.put("a", entry{value: "1"})
+	b.commit(1)
+	b.put("a", entry{value: "2"})
+	b.put("b", entry{value: "2"})
+	b.commit(2)
+	b.close()
+
+	// A crash while the meta of the second flush was being written leaves
+	// it torn; the tree of the first flush is still intact
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	// The second flush is txid 2, whose meta lives in page 0
+	f.WriteAt([]byte{0xff}, 20)
+	f.Close()
+
+	b = openTestBTree(t, path, btreeOptions{})
+	if b.revision() != 1 || b.len() != 1 {
+		t.Errorf("reopened at revision %d with %d keys, want 1 and 1", b.revision(), b.len())
+	}
+	if e, _, _ := b.get("a"); e.value != "1" {
+		t.Errorf("get(a) = %q, want 1", e.value)
+	}
+}
+
+func TestBTreeSnapshotPinsPages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "btree.db")
+	b := openTestBTree(t, path, btreeOptions{FlushSize: 1})
+	rev := uint64(0)
+	write := func(value string) {
+		for i := 0; i < 500; i++ {
+			rev++
+			b.put(fmt.Sprintf("key-%03d", i), entry{value: value, version: rev})
+			b.commit(rev)
+		}
+	}
+	write("old")
+	snap, err := b.snapshot()
+	if err != nil {
+		t.Fatalf("snapshot() error = %v", err)
+	}
+	// Every commit flushes, so without the snapshot the old pages would
+	// be overwritten many times over
+	write("new")
+	write("newer")
+
+	n := 0
+	err = snap.ascend("", func(key string, e entry) bool {
+		if e.value != "old" {
+			t.Errorf("snapshot %s = %q, want old", key, e.value)
+		}
+		n++
+		return true
+	})
+	if err != nil || n != 500 {
+		t.Errorf("snapshot ascend() visited %d keys, err = %v", n, err)
+	}
+	snap.release()
+
+	// With the snapshot gone, the old pages are reused rather than the
+	// file growing
+	write("again")
+	grown := b.highwater
+	write("and again")
+	if b.highwater > grown {
+		t.Errorf("file grew from %d to %d pages while overwriting", grown, b.highwater)
+	}
+}
+
+func TestBTreeLargeValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "btree.db")
+	b := openTestBTree(t, path, btreeOptions{})
+	big := strings.Repeat("x", 5*btreePageSize+123)
+	b.put("big", entry{value: big})
+	b.put("small", entry{value: "s"})
+	b.commit(1)
+	b.close()
+
+	b = openTestBTree(t, path, btreeOptions{})
+	if e, found, err := b.get("big"); err != nil || !found || e.value != big {
+		t.Errorf("get(big) found = %v, err = %v, %d bytes", found, err, len(e.value))
+	}
+	if e, _, _ := b.get("small"); e.value != "s" {
+		t.Errorf("get(small) = %q, want s", e.value)
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Eviction policies, which decide what happens to a write that would take the
+// store over its memory limit
+const (
+	// evictNone refuses the write
+	evictNone = "none"
+	// evictLRU evicts the least recently read or written keys
+	evictLRU = "lru"
+	// evictLFU evicts the least frequently read or written keys
+	evictLFU = "lfu"
+	// evictTTLFirst evicts the keys closest to expiring, and then the least
+	// recently used keys without a TTL
+	evictTTLFirst = "ttl-first"
+)
+
+var evictionPolicies = []string{evictNone, evictLRU, evictLFU, evictTTLFirst}
+
+// memoryOptions limits the bytes of keys and values a server holds
+type memoryOptions struct {
+	// Limit is the most key and value bytes the store may hold; zero means
+	// unlimited
+	Limit int64
+	// Policy is one of evictionPolicies; empty means evictNone
+	Policy string
+}
+
+// memoryBudget counts the key and value bytes in the store and chooses keys
+// to evict once they exceed the limit. It has its own lock because reads
+// record accesses while holding only the server's read lock.
+type memoryBudget struct {
+	mu     sync.Mutex
+	limit  int64
+	policy string
+	used   int64
+	keys   map[string]*budgetKey
+	// recent orders keys by last access, most recent first. It holds every
+	// key under lru, and the keys without a TTL under ttl-first.
+	recent list.List
+	// queue orders keys by access count under lfu, and the keys with a TTL
+	// by expiry time under ttl-first
+	queue budgetQueue
+	// clock numbers accesses, so that lfu evicts the least recently used of
+	// equally used keys
+	clock uint64
+
+	evictedKeys    uint64
+	evictedBytes   uint64
+	rejectedWrites uint64
+}
+
+// budgetKey is the accounting for one key
+type budgetKey struct {
+	key       string
+	size      int64
+	expiresAt int64
+	hits      uint64
+	lastUse   uint64
+	// elem is the key's place in recent, if it is there
+	elem *list.Element
+	// index is the key's place in queue, or -1
+	index int
+}
+
+func newMemoryBudget(opts memoryOptions) *memoryBudget {
+	b := &memoryBudget{
+		limit:  opts.Limit,
+		policy: opts.Policy,
+		keys:   make(map[string]*budgetKey),
+		queue:  budgetQueue{byExpiry: opts.Policy == evictTTLFirst},
+	}
+	if b.policy == "" {
+		b.policy = evictNone
+	}
+	return b
+}
+
+// entrySize is what a key and its value count against the limit
+func entrySize(key, value string) int64 {
+	return int64(len(key) + len(value))
+}
+
+// set records that key was written with a value of the given size
+func (b *memoryBudget) set(key string, size, expiresAt int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	k, ok := b.keys[key]
+	if !ok {
+		k = &budgetKey{key: key, index: -1}
+		b.keys[key] = k
+	}
+	b.used += size - k.size
+	k.size = size
+	k.expiresAt = expiresAt
+	b.useLocked(k)
+}
+
+// reset forgets every key, keeping the eviction counters
+func (b *memoryBudget) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used = 0
+	b.keys = make(map[string]*budgetKey)
+	b.recent.Init()
+	b.queue.keys = nil
+}
+
+// expire records a new expiry time for key without counting an access
+func (b *memoryBudget) expire(key string, expiresAt int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if k, ok := b.keys[key]; ok {
+		k.expiresAt = expiresAt
+		b.placeLocked(k)
+	}
+}
+
+// touch records a read of key
+func (b *memoryBudget) touch(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if k, ok := b.keys[key]; ok {
+		b.useLocked(k)
+	}
+}
+
+func (b *memoryBudget) remove(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	k, ok := b.keys[key]
+	if !ok {
+		return
+	}
+	b.used -= k.size
+	delete(b.keys, key)
+	if k.elem != nil {
+		b.recent.Remove(k.elem)
+	}
+	if k.index >= 0 {
+		heap.Remove(&b.queue, k.index)
+	}
+}
+
+func (b *memoryBudget) useLocked(k *budgetKey) {
+	b.clock++
+	k.hits++
+	k.lastUse = b.clock
+	b.placeLocked(k)
+}
+
+// placeLocked moves k to where the policy orders it after an access or a new
+// expiry time
+func (b *memoryBudget) placeLocked(k *budgetKey) {
+	inQueue := b.policy == evictLFU || (b.policy == evictTTLFirst && k.expiresAt != 0)
+	inRecent := b.policy == evictLRU || (b.policy == evictTTLFirst && k.expiresAt == 0)
+
+	switch {
+	case inQueue && k.index >= 0:
+		heap.Fix(&b.queue, k.index)
+	case inQueue:
+		heap.Push(&b.queue, k)
+	case k.index >= 0:
+		heap.Remove(&b.queue, k.index)
+	}
+	switch {
+	case inRecent && k.elem != nil:
+		b.recent.MoveToFront(k.elem)
+	case inRecent:
+		k.elem = b.recent.PushFront(k)
+	case k.elem != nil:
+		b.recent.Remove(k.elem)
+		k.elem = nil
+	}
+}
+
+// admit checks that the mutations of a record fit within the limit. Writes
+// that don't grow the store are always admitted. Under evictNone the store
+// must have room for the growth; otherwise the record's values only have to
+// fit on their own, since other keys can be evicted to make room.
+func (b *memoryBudget) admit(ops []walRecord) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var delta int64
+	written := make(map[string]int64, len(ops))
+	for _, op := range ops {
+		old, ok := written[op.Key]
+		if !ok {
+			if k, found := b.keys[op.Key]; found {
+				old = k.size
+			}
+		}
+		switch op.Op {
+		case walOpSet:
+			size := entrySize(op.Key, op.Value)
+			delta += size - old
+			written[op.Key] = size
+		case walOpDelete:
+			delta -= old
+			written[op.Key] = 0
+		}
+	}
+	var size int64
+	for _, n := range written {
+		size += n
+	}
+	switch {
+	case delta <= 0 || b.used+delta <= b.limit:
+		return nil
+	case size > b.limit:
+		b.rejectedWrites++
+		return status.Errorf(codes.ResourceExhausted, "write of %d bytes is larger than the memory limit of %d bytes", size, b.limit)
+	case b.policy == evictNone:
+		b.rejectedWrites++
+		return status.Errorf(codes.ResourceExhausted, "memory limit of %d bytes reached (%d bytes in use)", b.limit, b.used)
+	}
+	return nil
+}
+
+// overLimit reports whether keys need to be evicted
+func (b *memoryBudget) overLimit() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used > b.limit && b.policy != evictNone
+}
+
+// victim returns the next key to evict and its size, if the store is over
+// its limit and the policy evicts. Keys in keep, which the write that took
+// the store over its limit has just stored, are passed over.
+func (b *memoryBudget) victim(keep map[string]bool) (string, int64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used <= b.limit || b.policy == evictNone {
+		return "", 0, false
+	}
+
+	var kept []*budgetKey
+	defer func() {
+		for _, k := range kept {
+			heap.Push(&b.queue, k)
+		}
+	}()
+	for len(b.queue.keys) > 0 {
+		k := b.queue.keys[0]
+		if !keep[k.key] {
+			return k.key, k.size, true
+		}
+		kept = append(kept, heap.Pop(&b.queue).(*budgetKey))
+	}
+	for e := b.recent.Back(); e != nil; e = e.Prev() {
+		if k := e.Value.(*budgetKey); !keep[k.key] {
+			return k.key, k.size, true
+		}
+	}
+	return "", 0, false
+}
+
+// evicted counts a key evicted by the server
+func (b *memoryBudget) evicted(size int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.evictedKeys++
+	b.evictedBytes += uint64(size)
+}
+
+// budgetQueue is a min-heap of keys ordered by expiry time, or by access
+// count and then last access
+type budgetQueue struct {
+	keys     []*budgetKey
+	byExpiry bool
+}
+
+func (q budgetQueue) Len() int { return len(q.keys) }
+
+func (q budgetQueue) Less(i, j int) bool {
+	a, b := q.keys[i], q.keys[j]
+	if q.byExpiry {
+		return a.expiresAt < b.expiresAt
+	}
+	if a.hits != b.hits {
+		return a.hits < b.hits
+	}
+	return a.lastUse < b.lastUse
+}
+
+func (q budgetQueue) Swap(i, j int) {
+	q.keys[i], q.keys[j] = q.keys[j], q.keys[i]
+	q.keys[i].index = i
+	q.keys[j].index = j
+}
+
+func (q *budgetQueue) Push(x any) {
+	k := x.(*budgetKey)
+	k.index = len(q.keys)
+	q.keys = append(q.keys, k)
+}
+
+func (q *budgetQueue) Pop() any {
+	k := q.keys[len(q.keys)-1]
+	q.keys = q.keys[:len(q.keys)-1]
+	k.index = -1
+	return k
+}
+
+// recordOps returns the individual mutations of a record
+func recordOps(rec *walRecord) []walRecord {
+	if rec.Op == walOpTxn {
+		return rec.Ops
+	}
+	return []walRecord{*rec}
+}
+
+// useMemoryBudget limits the store to opts.Limit bytes of keys and values, or
+// removes the limit if it is zero, and counts the keys already stored. Callers
+// must have exclusive access to the server.
+func (s *kvServer) useMemoryBudget(opts memoryOptions) error {
+	s.budget = nil
+	if opts.Limit == 0 {
+		return nil
+	}
+	s.budget = newMemoryBudget(opts)
+	return s.rebuildBudget()
+}
+
+// rebuildBudget counts every key in the engine against the memory budget, if
+// there is one
+func (s *kvServer) rebuildBudget() error {
+	if s.budget == nil {
+		return nil
+	}
+	s.budget.reset()
+	return s.engine.ascend("", func(k string, e entry) bool {
+		// The settings of namespaces are never evicted
+		if !isMetaKey(k) {
+			s.budget.set(k, entrySize(k, e.value), e.expiresAt)
+		}
+		return true
+	})
+}
+
+// admit checks a record against the namespace quotas and the memory budget
+// before it is logged. Callers must hold the locks of the keys it writes.
+func (s *kvServer) admit(rec *walRecord) error {
+	if err := s.checkQuotas(rec); err != nil {
+		return err
+	}
+	if s.budget == nil {
+		return nil
+	}
+	return s.budget.admit(recordOps(rec))
+}
+
+// evictLocked deletes the keys the eviction policy chooses until the store is
+// back within its memory limit, sparing the keys rec wrote. Evictions are
+// logged like any other delete, so followers and a restart see them too.
+// Callers must hold the write lock.
+func (s *kvServer) evictLocked(rec *walRecord) {
+	if s.budget == nil {
+		return
+	}
+	keep := make(map[string]bool)
+	for _, op := range recordOps(rec) {
+		keep[op.Key] = true
+	}
+	n := 0
+	for {
+		key, size, ok := s.budget.victim(keep)
+		if !ok {
+			break
+		}
+		rec := walRecord{Op: walOpDelete, Key: key}
+		if err := s.logMutation(&rec); err != nil {
+			log.Printf("Eviction: %v", err)
+			break
+		}
+		s.apply(rec)
+		s.budget.evicted(size)
+		n++
+	}
+	if n > 0 {
+		log.Printf("Evicted %d keys to stay within the memory limit", n)
+	}
+}
+
+// Stats reports the number of keys, the memory budget and eviction counters
+func (s *kvServer) Stats(ctx context.Context, req *pb.StatsRequest) (*pb.StatsResponse, error) {
+	s.rlockAll()
+	resp := &pb.StatsResponse{
+		Keys:           uint64(s.engine.len()),
+		Revision:       s.rev,
+		EvictionPolicy: evictNone,
+	}
+	b := s.budget
+	s.runlockAll()
+
+	if b != nil {
+		b.mu.Lock()
+		resp.MemoryUsedBytes = b.used
+		resp.MemoryLimitBytes = b.limit
+		resp.EvictionPolicy = b.policy
+		resp.EvictedKeys = b.evictedKeys
+		resp.EvictedBytes = b.evictedBytes
+		resp.RejectedWrites = b.rejectedWrites
+		b.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// parseByteSize parses a size such as 512, 64KB, 256MB or 2GB, where a
+// kilobyte is 1024 bytes
+func parseByteSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		shift  uint
+	}{{"GB", 30}, {"MB", 20}, {"KB", 10}, {"B", 0}}
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	var shift uint
+	for _, u := range units {
+		if strings.HasSuffix(upper, u.suffix) {
+			upper, shift = strings.TrimSpace(strings.TrimSuffix(upper, u.suffix)), u.shift
+			break
+		}
+	}
+	n, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil || n < 0 || n > (1<<62)>>shift {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
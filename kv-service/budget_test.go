@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"testing"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newBudgetServer returns a test server limited to room for three keys of
+// one byte with nine-byte values
+func newBudgetServer(t *testing.T, policy string) *kvServer {
+	t.Helper()
+	server := newTestServer(t)
+	if err := server.useMemoryBudget(memoryOptions{Limit: 30, Policy: policy}); err != nil {
+		t.Fatalf("useMemoryBudget() error = %v", err)
+	}
+	return server
+}
+
+// setKeys stores each key with a nine-byte value and the given TTL
+func setKeys(t *testing.T, server *kvServer, ttl int64, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		if _, err := server.Set(context.Background(), &pb.SetRequest{Key: key, Value: "123456789", TtlSeconds: ttl}); err != nil {
+			t.Fatalf("Set(%s) error = %v", key, err)
+		}
+	}
+}
+
+// presentKeys returns which of keys are stored
+func presentKeys(server *kvServer, keys ...string) map[string]bool {
+	found := make(map[string]bool)
+	for _, key := range keys {
+		resp, _ := server.Get(context.Background(), &pb.GetRequest{Key: key})
+		found[key] = resp.Found
+	}
+	return found
+}
+
+func TestMemoryLimitRejectsWrites(t *testing.T) {
+	server := newBudgetServer(t, evictNone)
+	ctx := context.Background()
+	setKeys(t, server, 0, "a", "b", "c")
+
+	_, err := server.Set(ctx, &pb.SetRequest{Key: "d", Value: "123456789"})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Set() over the limit error = %v, want ResourceExhausted", err)
+	}
+	// Writes that don't grow the store still go through
+	if _, err := server.Set(ctx, &pb.SetRequest{Key: "a", Value: "1"}); err != nil {
+		t.Errorf("Set() shrinking a value error = %v", err)
+	}
+	if _, err := server.Set(ctx, &pb.SetRequest{Key: "d", Value: "1234567"}); err != nil {
+		t.Errorf("Set() into freed room error = %v", err)
+	}
+
+	stats, err := server.Stats(ctx, &pb.StatsRequest{})
+	if err != nil {
+		t.Fatalf("Stats() error = %v", err)
+	}
+	if stats.Keys != 4 || stats.MemoryUsedBytes != 30 || stats.MemoryLimitBytes != 30 || stats.RejectedWrites != 1 || stats.EvictedKeys != 0 {
+		t.Errorf("Stats() = %+v, want 4 keys in 30 of 30 bytes and 1 rejected write", stats)
+	}
+}
+
+func TestMemoryLimitRejectsOversizedWrites(t *testing.T) {
+	server := newBudgetServer(t, evictLRU)
+	ctx := context.Background()
+	setKeys(t, server, 0, "a")
+
+	_, err := server.Set(ctx, &pb.SetRequest{Key: "big", Value: string(make([]byte, 40))})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Set() of a value larger than the limit error = %v, want ResourceExhausted", err)
+	}
+	_, err = server.BatchSet(ctx, &pb.BatchSetRequest{Atomic: true, Items: []*pb.SetRequest{
+		{Key: "x", Value: "123456789"}, {Key: "y", Value: "123456789"},
+		{Key: "z", Value: "123456789"}, {Key: "w", Value: "123456789"},
+	}})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("BatchSet() of more than the limit error = %v, want ResourceExhausted", err)
+	}
+	if got := presentKeys(server, "a"); !got["a"] {
+		t.Errorf("a was evicted for a write that was refused")
+	}
+}
+
+func TestLRUEviction(t *testing.T) {
+	server := newBudgetServer(t, evictLRU)
+	setKeys(t, server, 0, "a", "b", "c")
+	presentKeys(server, "a")
+
+	setKeys(t, server, 0, "d")
+	want := map[string]bool{"a": true, "b": false, "c": true, "d": true}
+	if got := presentKeys(server, "a", "b", "c", "d"); !maps.Equal(got, want) {
+		t.Errorf("keys after eviction = %v, want %v", got, want)
+	}
+
+	stats, _ := server.Stats(context.Background(), &pb.StatsRequest{})
+	if stats.EvictedKeys != 1 || stats.EvictedBytes != 10 || stats.EvictionPolicy != evictLRU {
+		t.Errorf("Stats() = %+v, want 1 key of 10 bytes evicted by lru", stats)
+	}
+}
+
+func TestLFUEviction(t *testing.T) {
+	server := newBudgetServer(t, evictLFU)
+	setKeys(t, server, 0, "a", "b", "c")
+	presentKeys(server, "a", "a", "b", "c", "c")
+
+	// The new key has been used least of all, but it is not evicted by
+	// the write that stores it
+	setKeys(t, server, 0, "d")
+	want := map[string]bool{"a": true, "b": false, "c": true, "d": true}
+	if got := presentKeys(server, "a", "b", "c", "d"); !maps.Equal(got, want) {
+		t.Errorf("keys after eviction = %v, want %v", got, want)
+	}
+}
+
+func TestTTLFirstEviction(t *testing.T) {
+	server := newBudgetServer(t, evictTTLFirst)
+	setKeys(t, server, 0, "x")
+	setKeys(t, server, 100, "l")
+	setKeys(t, server, 10, "s")
+
+	// s expires soonest, then l
+	setKeys(t, server, 0, "d")
+	if got := presentKeys(server, "s", "l"); got["s"] || !got["l"] {
+		t.Errorf("keys after first eviction = %v, want the key closest to expiring gone", got)
+	}
+	setKeys(t, server, 0, "e")
+	if got := presentKeys(server, "l", "x"); got["l"] || !got["x"] {
+		t.Errorf("keys after second eviction = %v, want the remaining TTL key gone", got)
+	}
+	// With no TTLs left, the least recently used key goes
+	presentKeys(server, "x")
+	setKeys(t, server, 0, "g")
+	want := map[string]bool{"x": true, "d": false, "e": true, "g": true}
+	if got := presentKeys(server, "x", "d", "e", "g"); !maps.Equal(got, want) {
+		t.Errorf("keys after third eviction = %v, want %v", got, want)
+	}
+}
+
+func TestEvictionsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	opts := serverOptions{WAL: walOptions{Sync: syncAlways}, Memory: memoryOptions{Limit: 30, Policy: evictLRU}}
+
+	server, err := openKVServer(dir, opts)
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	setKeys(t, server, 0, "a", "b", "c", "d")
+	server.Close()
+
+	server, err = openKVServer(dir, opts)
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	defer server.Close()
+	if got := presentKeys(server, "a"); got["a"] {
+		t.Errorf("evicted key is back after a restart")
+	}
+	stats, _ := server.Stats(ctx, &pb.StatsRequest{})
+	if stats.MemoryUsedBytes != 30 {
+		t.Errorf("Stats() memory used after restart = %d, want 30", stats.MemoryUsedBytes)
+	}
+}
+
+func TestMemoryLimitOptions(t *testing.T) {
+	for name, opts := range map[string]serverOptions{
+		"unknown policy": {Memory: memoryOptions{Limit: 10, Policy: "random"}},
+		"negative limit": {Memory: memoryOptions{Limit: -1}},
+		"cluster mode":   {Memory: memoryOptions{Limit: 10}, Raft: raftOptions{ID: "n1"}},
+	} {
+		if _, err := openKVServer(t.TempDir(), opts); err == nil {
+			t.Errorf("openKVServer() with %s error = nil, want an error", name)
+		}
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for in, want := range map[string]int64{"0": 0, "512": 512, "64KB": 64 << 10, "256mb": 256 << 20, "2GB": 2 << 30, "10B": 10} {
+		if got, err := parseByteSize(in); err != nil || got != want {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "-1", "1TB", "MB", "1.5GB"} {
+		if _, err := parseByteSize(in); err == nil {
+			t.Errorf("parseByteSize(%q) error = nil, want an error", in)
+		}
+	}
+}
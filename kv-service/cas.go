@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// checkVersion returns a FailedPrecondition error unless the key's current
+// state satisfies the condition: it must not exist when mustNotExist is set,
+// and otherwise must exist, at exactly the expected version unless that is 0
+func checkVersion(key string, e entry, found bool, expected uint64, mustNotExist bool) error {
+	switch {
+	case mustNotExist && found:
+		return status.Errorf(codes.FailedPrecondition, "key '%s' already exists at version %d", key, e.version)
+	case mustNotExist:
+		return nil
+	case !found && expected == 0:
+		return status.Errorf(codes.FailedPrecondition, "key '%s' does not exist", key)
+	case !found:
+		return status.Errorf(codes.FailedPrecondition, "key '%s' does not exist, expected version %d", key, expected)
+	case expected != 0 && e.version != expected:
+		return status.Errorf(codes.FailedPrecondition, "key '%s' is at version %d, expected version %d", key, e.version, expected)
+	}
+	return nil
+}
+
+// checkCondition returns an InvalidArgument error if a write asks for more
+// than one of the conditions checkVersion enforces
+func checkCondition(expected uint64, mustExist, mustNotExist bool) error {
+	n := 0
+	for _, set := range []bool{expected != 0, mustExist, mustNotExist} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		return status.Errorf(codes.InvalidArgument, "expected_version, must_exist and must_not_exist are mutually exclusive")
+	}
+	return nil
+}
+
+// CompareAndSet stores a key-value pair only if the key is at the expected
+// version, exists at all when must_exist is set, or does not exist when
+// must_not_exist is set. The check and the write happen under the same write
+// lock.
+func (s *kvServer) CompareAndSet(ctx context.Context, req *pb.CompareAndSetRequest) (resp *pb.CompareAndSetResponse, err error) {
+	defer func() {
+		s.recordAudit(ctx, auditEvent{op: auditSet, namespace: req.Namespace, key: req.Key, sum: s.auditSum(req.Value, req.ValueBytes), version: resp.GetVersion(), err: err})
+	}()
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := checkCondition(req.ExpectedVersion, req.MustExist, req.MustNotExist); err != nil {
+		return nil, err
+	}
+	if req.ExpectedVersion == 0 && !req.MustExist && !req.MustNotExist {
+		return nil, status.Errorf(codes.InvalidArgument, "one of expected_version, must_exist or must_not_exist is required")
+	}
+	if err := checkTTL(req.TtlSeconds); err != nil {
+		return nil, err
+	}
+	n, key, err := s.namespaceKey(req.Namespace, req.Key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := s.requestValue(n, req.Value, req.ValueBytes, req.ContentType)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := s.mutateKey(ctx, key, func(v *txnView) (*walRecord, error) {
+		if err := s.checkNamespace(n); err != nil {
+			return nil, err
+		}
+		e, found, _ := v.get(key)
+		if err := checkVersion(req.Key, e, found, req.ExpectedVersion, req.MustNotExist); err != nil {
+			return nil, err
+		}
+		return &walRecord{Op: walOpSet, Key: key, Value: value, ExpiresAt: s.expiryFor(n.ttl(req.TtlSeconds)), ContentType: req.ContentType}, nil
+	})
+	if err != nil {
+		if status.Code(err) == codes.FailedPrecondition {
+			log.Printf("CompareAndSet key=%s, conflict", req.Key)
+		}
+		return nil, err
+	}
+	log.Printf("CompareAndSet key=%s, version=%d", req.Key, version)
+
+	return &pb.CompareAndSetResponse{
+		Success: true,
+		Message: fmt.Sprintf("Key '%s' set successfully", req.Key),
+		Version: version,
+	}, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVersionIncreases(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+
+	first, _ := server.Set(ctx, &pb.SetRequest{Key: "key", Value: "v1"})
+	server.Set(ctx, &pb.SetRequest{Key: "other", Value: "v"})
+	second, _ := server.Set(ctx, &pb.SetRequest{Key: "key", Value: "v2"})
+	if second.Version <= first.Version {
+		t.Errorf("Set() version = %d after %d, want it to increase", second.Version, first.Version)
+	}
+
+	resp, _ := server.Get(ctx, &pb.GetRequest{Key: "key"})
+	if resp.Version != second.Version {
+		t.Errorf("Get() version = %d, want %d", resp.Version, second.Version)
+	}
+
+	// Recreating a deleted key must not reuse an old version
+	server.Delete(ctx, &pb.DeleteRequest{Key: "key"})
+	third, _ := server.Set(ctx, &pb.SetRequest{Key: "key", Value: "v3"})
+	if third.Version <= second.Version {
+		t.Errorf("Set() version = %d after delete, want > %d", third.Version, second.Version)
+	}
+}
+
+func TestCompareAndSet(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+
+	created, err := server.CompareAndSet(ctx, &pb.CompareAndSetRequest{Key: "key", Value: "v1", MustNotExist: true})
+	if err != nil || !created.Success {
+		t.Fatalf("CompareAndSet(must_not_exist) = %v, %v; want success", created, err)
+	}
+
+	_, err = server.CompareAndSet(ctx, &pb.CompareAndSetRequest{Key: "key", Value: "v1", MustNotExist: true})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("CompareAndSet(must_not_exist) on existing key error = %v, want FailedPrecondition", err)
+	}
+
+	updated, err := server.CompareAndSet(ctx, &pb.CompareAndSetRequest{Key: "key", Value: "v2", ExpectedVersion: created.Version})
+	if err != nil || !updated.Success {
+		t.Fatalf("CompareAndSet(expected_version) = %v, %v; want success", updated, err)
+	}
+
+	// A second writer holding the old version loses
+	_, err = server.CompareAndSet(ctx, &pb.CompareAndSetRequest{Key: "key", Value: "lost", ExpectedVersion: created.Version})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("CompareAndSet() with stale version error = %v, want FailedPrecondition", err)
+	}
+
+	resp, _ := server.Get(ctx, &pb.GetRequest{Key: "key"})
+	if resp.Value != "v2" || resp.Version != updated.Version {
+		t.Errorf("Get() = %q@%d, want %q@%d", resp.Value, resp.Version, "v2", updated.Version)
+	}
+
+	_, err = server.CompareAndSet(ctx, &pb.CompareAndSetRequest{Key: "missing", Value: "v", ExpectedVersion: 1})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("CompareAndSet() on missing key error = %v, want FailedPrecondition", err)
+	}
+	_, err = server.CompareAndSet(ctx, &pb.CompareAndSetRequest{Key: "key", Value: "v"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CompareAndSet() without condition error = %v, want InvalidArgument", err)
+	}
+	_, err = server.CompareAndSet(ctx, &pb.CompareAndSetRequest{Key: "key", Value: "v", MustExist: true, MustNotExist: true})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CompareAndSet() with two conditions error = %v, want InvalidArgument", err)
+	}
+}
+
+func TestCompareAndSetMustExist(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+
+	_, err := server.CompareAndSet(ctx, &pb.CompareAndSetRequest{Key: "key", Value: "v1", MustExist: true})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("CompareAndSet(must_exist) on missing key error = %v, want FailedPrecondition", err)
+	}
+
+	server.Set(ctx, &pb.SetRequest{Key: "key", Value: "v1"})
+	resp, err := server.CompareAndSet(ctx, &pb.CompareAndSetRequest{Key: "key", Value: "v2", MustExist: true})
+	if err != nil || !resp.Success {
+		t.Fatalf("CompareAndSet(must_exist) = %v, %v; want success", resp, err)
+	}
+	if got, _ := server.Get(ctx, &pb.GetRequest{Key: "key"}); got.Value != "v2" {
+		t.Errorf("Get() = %q, want %q", got.Value, "v2")
+	}
+}
+
+func TestConditionalDelete(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+
+	setResp, _ := server.Set(ctx, &pb.SetRequest{Key: "key", Value: "v"})
+
+	_, err := server.Delete(ctx, &pb.DeleteRequest{Key: "key", ExpectedVersion: setResp.Version + 1})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Delete() with wrong version error = %v, want FailedPrecondition", err)
+	}
+
+	resp, err := server.Delete(ctx, &pb.DeleteRequest{Key: "key", ExpectedVersion: setResp.Version})
+	if err != nil || !resp.Success {
+		t.Errorf("Delete() with matching version = %v, %v; want success", resp, err)
+	}
+}
+
+func TestVersionSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	opts := serverOptions{WAL: walOptions{Sync: syncAlways}}
+
+	server, err := openKVServer(dir, opts)
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	snapResp, _ := server.Set(ctx, &pb.SetRequest{Key: "snap", Value: "v"})
+	server.snapshot()
+	walResp, _ := server.Set(ctx, &pb.SetRequest{Key: "wal", Value: "v"})
+	server.Close()
+
+	server, err = openKVServer(dir, opts)
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	defer server.Close()
+
+	for key, want := range map[string]uint64{"snap": snapResp.Version, "wal": walResp.Version} {
+		resp, _ := server.Get(ctx, &pb.GetRequest{Key: key})
+		if resp.Version != want {
+			t.Errorf("Get(%s) version = %d, want %d", key, resp.Version, want)
+		}
+	}
+
+	next, _ := server.Set(ctx, &pb.SetRequest{Key: "new", Value: "v"})
+	if next.Version <= walResp.Version {
+		t.Errorf("Set() after restart version = %d, want > %d", next.Version, walResp.Version)
+	}
+}
@@ -0,0 +1,723 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	keyringFile = "keyring.json"
+
+	// sealedMagic opens every sealed record. No WAL op or Raft entry type has
+	// this value, so a sealed frame is never mistaken for a plaintext one.
+	sealedMagic byte = 0xe5
+	// A sealed record is laid out as
+	//
+	//	sealedMagic | key ID | nonce | AES-GCM ciphertext and tag
+	//
+	// where the key ID is a little-endian uint32 naming the data key
+	sealedHeaderSize = 1 + 4 + 12
+
+	dataKeySize = 32
+	// resealBatch is how many keys of an engine are re-encrypted under one
+	// hold of the write lock
+	resealBatch = 256
+)
+
+var (
+	// errTampered is returned when a sealed record fails authentication
+	errTampered = errors.New("record failed authentication")
+	// errResealStopped is returned when the server stops during a
+	// re-encryption, which resumes on the next start
+	errResealStopped = errors.New("re-encryption stopped by shutdown")
+)
+
+// walAAD is the additional data of a sealed WAL record. It ties the record to
+// the WAL and to its sequence number, which follows from its place in its
+// segment, so records can't be dropped, repeated or reordered.
+func walAAD(seq uint64) []byte {
+	return binary.AppendUvarint([]byte("wal"), seq)
+}
+
+// raftAAD is the additional data of a sealed Raft log frame. It ties the
+// frame to the Raft log and to the index and term of the frame before it in
+// the file, so frames can't be dropped, repeated or reordered. The frame's
+// own index can't serve, since appending an entry at an index already in the
+// log legitimately replaces it.
+func raftAAD(prevIndex, prevTerm uint64) []byte {
+	aad := binary.AppendUvarint([]byte("raft"), prevIndex)
+	return binary.AppendUvarint(aad, prevTerm)
+}
+
+// encryptionOptions configures encryption at rest
+type encryptionOptions struct {
+	// KeyFile holds master keys, one per line as hex or base64, newest last.
+	// Empty leaves the data dir unencrypted.
+	KeyFile string
+}
+
+// keyringState is the content of the keyring file. The data keys are only
+// ever stored wrapped by the master key.
+type keyringState struct {
+	// Master is the fingerprint of the master key the data keys are wrapped by
+	Master string `json:"master"`
+	// Active is the ID of the data key new records are sealed with
+	Active uint32       `json:"active"`
+	Keys   []wrappedKey `json:"keys"`
+	// Plaintext is set until every file written before encryption was
+	// enabled has been re-encrypted. Until then, records that are not sealed
+	// are read as they are.
+	Plaintext bool `json:"plaintext,omitempty"`
+}
+
+type wrappedKey struct {
+	ID uint32 `json:"id"`
+	// Key is nonce | AES-GCM(master key, data key)
+	Key []byte `json:"key"`
+}
+
+// keyView is a fixed set of data keys that can open sealed records
+type keyView struct {
+	aeads     map[uint32]cipher.AEAD
+	plaintext bool
+}
+
+// keyring holds the data keys that seal records in a data dir. The keys are
+// persisted in the keyring file, wrapped by the newest master key of the key
+// file. A nil keyring seals nothing.
+type keyring struct {
+	dir     string
+	keyFile string
+
+	mu     sync.RWMutex
+	state  keyringState
+	master []byte
+	// view is replaced, never modified, so that readers can keep one
+	view keyView
+}
+
+// openKeyring loads the keyring of dir, creating it if dir has none, and
+// reports whether files in dir may still need re-encrypting: when the
+// keyring is new, when a newer master key was added to the key file, or
+// when an earlier re-encryption did not finish.
+func openKeyring(dir string, opts encryptionOptions) (*keyring, bool, error) {
+	masters, err := readMasterKeys(opts.KeyFile)
+	if err != nil {
+		return nil, false, err
+	}
+	k := &keyring{dir: dir, keyFile: opts.KeyFile}
+	b, err := os.ReadFile(filepath.Join(dir, keyringFile))
+	if errors.Is(err, os.ErrNotExist) {
+		// Any files already in dir were written without encryption
+		k.master = masters[len(masters)-1]
+		k.state = keyringState{Master: keyFingerprint(k.master), Plaintext: true}
+		k.view.aeads = make(map[uint32]cipher.AEAD)
+		if err := k.addKeyLocked(); err != nil {
+			return nil, false, err
+		}
+		return k, true, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("read keyring: %w", err)
+	}
+	if err := json.Unmarshal(b, &k.state); err != nil {
+		return nil, false, fmt.Errorf("parse keyring: %w", err)
+	}
+	rotated, err := k.useMasters(masters)
+	if err != nil {
+		return nil, false, err
+	}
+	return k, rotated || k.state.Plaintext || len(k.state.Keys) > 1, nil
+}
+
+// readMasterKeys reads the master keys from path, skipping blank lines and
+// comments. Each key is 32 bytes, written as hex or base64.
+func readMasterKeys(path string) ([][]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read master key file: %w", err)
+	}
+	var keys [][]byte
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil {
+			key, err = base64.StdEncoding.DecodeString(line)
+		}
+		if err != nil || len(key) != dataKeySize {
+			return nil, fmt.Errorf("%s:%d: a master key must be %d bytes in hex or base64", path, i+1, dataKeySize)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s holds no master key", path)
+	}
+	return keys, nil
+}
+
+// keyFingerprint identifies a master key without revealing it
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrapAAD binds a wrapped data key to its ID
+func wrapAAD(id uint32) []byte {
+	return binary.LittleEndian.AppendUint32([]byte("kv data key "), id)
+}
+
+func wrapKey(master []byte, id uint32, key []byte) ([]byte, error) {
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return aead.Seal(nonce, nonce, key, wrapAAD(id)), nil
+}
+
+func unwrapKey(master []byte, w wrappedKey) ([]byte, error) {
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(w.Key) < aead.NonceSize() {
+		return nil, errTampered
+	}
+	key, err := aead.Open(nil, w.Key[:aead.NonceSize()], w.Key[aead.NonceSize():], wrapAAD(w.ID))
+	if err != nil {
+		return nil, errTampered
+	}
+	return key, nil
+}
+
+// useMasters unwraps the data keys with whichever of masters wrapped them.
+// If that is not the newest, the keys are rewrapped by the newest, and since
+// the older master may have been exposed, a new data key is added. It
+// reports whether that happened. Callers must hold k.mu or have exclusive
+// access to k.
+func (k *keyring) useMasters(masters [][]byte) (bool, error) {
+	var wrapping []byte
+	for _, m := range masters {
+		if keyFingerprint(m) == k.state.Master {
+			wrapping = m
+		}
+	}
+	if wrapping == nil {
+		return false, fmt.Errorf("the keyring in %s is wrapped by master key %s, which is not in %s", k.dir, k.state.Master, k.keyFile)
+	}
+	raw := make(map[uint32][]byte, len(k.state.Keys))
+	aeads := make(map[uint32]cipher.AEAD, len(k.state.Keys))
+	for _, w := range k.state.Keys {
+		key, err := unwrapKey(wrapping, w)
+		if err != nil {
+			return false, fmt.Errorf("unwrap data key %d: %w", w.ID, err)
+		}
+		if aeads[w.ID], err = newGCM(key); err != nil {
+			return false, err
+		}
+		raw[w.ID] = key
+	}
+	if aeads[k.state.Active] == nil {
+		return false, fmt.Errorf("the keyring in %s has no active data key %d", k.dir, k.state.Active)
+	}
+	k.view = keyView{aeads: aeads, plaintext: k.state.Plaintext}
+
+	newest := masters[len(masters)-1]
+	k.master = newest
+	if bytes.Equal(wrapping, newest) {
+		return false, nil
+	}
+	state := k.state
+	state.Master = keyFingerprint(newest)
+	state.Keys = make([]wrappedKey, len(k.state.Keys))
+	for i, w := range k.state.Keys {
+		wrapped, err := wrapKey(newest, w.ID, raw[w.ID])
+		if err != nil {
+			return false, err
+		}
+		state.Keys[i] = wrappedKey{ID: w.ID, Key: wrapped}
+	}
+	k.state = state
+	return true, k.addKeyLocked()
+}
+
+// addKeyLocked generates a data key, makes it the active one and saves the
+// keyring. Callers must hold k.mu or have exclusive access to k.
+func (k *keyring) addKeyLocked() error {
+	key := make([]byte, dataKeySize)
+	rand.Read(key)
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	id := uint32(1)
+	for _, w := range k.state.Keys {
+		id = max(id, w.ID+1)
+	}
+	wrapped, err := wrapKey(k.master, id, key)
+	if err != nil {
+		return err
+	}
+
+	state := k.state
+	state.Keys = append(state.Keys[:len(state.Keys):len(state.Keys)], wrappedKey{ID: id, Key: wrapped})
+	state.Active = id
+	if err := saveKeyring(k.dir, state); err != nil {
+		return err
+	}
+	k.state = state
+	aeads := maps.Clone(k.view.aeads)
+	aeads[id] = aead
+	k.view = keyView{aeads: aeads, plaintext: state.Plaintext}
+	return nil
+}
+
+// saveKeyring atomically replaces the keyring file of dir
+func saveKeyring(dir string, state keyringState) error {
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, keyringFile+"*.tmp")
+	if err != nil {
+		return fmt.Errorf("create keyring: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write keyring: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("fsync keyring: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, keyringFile)); err != nil {
+		return fmt.Errorf("rename keyring: %w", err)
+	}
+	return syncDir(dir)
+}
+
+// rotate rereads the key file and switches to a new data key, wrapped by
+// the newest master key. It returns the ID of the new key and whether the
+// master key changed.
+func (k *keyring) rotate() (uint32, bool, error) {
+	masters, err := readMasterKeys(k.keyFile)
+	if err != nil {
+		return 0, false, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	rotated, err := k.useMasters(masters)
+	if err == nil && !rotated {
+		err = k.addKeyLocked()
+	}
+	return k.state.Active, rotated, err
+}
+
+// retire drops every data key older than id once nothing on disk is sealed
+// with them any more, and stops accepting unencrypted records
+func (k *keyring) retire(id uint32) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	state := k.state
+	state.Plaintext = false
+	state.Keys = nil
+	for _, w := range k.state.Keys {
+		if w.ID >= id {
+			state.Keys = append(state.Keys, w)
+		}
+	}
+	if err := saveKeyring(k.dir, state); err != nil {
+		return err
+	}
+	k.state = state
+	aeads := make(map[uint32]cipher.AEAD, len(state.Keys))
+	for _, w := range state.Keys {
+		aeads[w.ID] = k.view.aeads[w.ID]
+	}
+	k.view = keyView{aeads: aeads}
+	return nil
+}
+
+// activeKey returns the ID of the data key new records are sealed with
+func (k *keyring) activeKey() uint32 {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.state.Active
+}
+
+// keys returns the data keys as they are now, for a reader that must keep
+// opening records after the older keys are retired
+func (k *keyring) keys() keyView {
+	if k == nil {
+		return keyView{plaintext: true}
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.view
+}
+
+// seal encrypts plain with the active data key, authenticating aad with it
+func (k *keyring) seal(plain, aad []byte) []byte {
+	if k == nil {
+		return plain
+	}
+	k.mu.RLock()
+	id := k.state.Active
+	aead := k.view.aeads[id]
+	k.mu.RUnlock()
+
+	out := make([]byte, sealedHeaderSize, sealedHeaderSize+len(plain)+aead.Overhead())
+	out[0] = sealedMagic
+	binary.LittleEndian.PutUint32(out[1:5], id)
+	nonce := out[5:sealedHeaderSize]
+	rand.Read(nonce)
+	return aead.Seal(out, nonce, plain, aad)
+}
+
+// open decrypts a record sealed with aad
+func (k *keyring) open(sealed, aad []byte) ([]byte, error) {
+	return k.keys().open(sealed, aad)
+}
+
+// stale reports whether a record is not sealed with the active data key
+func (k *keyring) stale(p []byte) bool {
+	id, ok := sealedKey(p)
+	return !ok || id != k.activeKey()
+}
+
+// sealedKey returns the ID of the data key p is sealed with
+func sealedKey(p []byte) (uint32, bool) {
+	if len(p) < sealedHeaderSize || p[0] != sealedMagic {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(p[1:5]), true
+}
+
+// open decrypts a record sealed with aad. While unencrypted records are
+// still accepted, one without the sealed header is returned as it is; a
+// sealed one that does not open has been tampered with either way.
+func (v keyView) open(sealed, aad []byte) ([]byte, error) {
+	if v.aeads == nil {
+		return sealed, nil
+	}
+	if _, ok := sealedKey(sealed); !ok && v.plaintext {
+		return sealed, nil
+	}
+	return v.unseal(sealed, aad)
+}
+
+func (v keyView) unseal(sealed, aad []byte) ([]byte, error) {
+	id, ok := sealedKey(sealed)
+	if !ok {
+		return nil, fmt.Errorf("%w: record is not encrypted", errTampered)
+	}
+	aead := v.aeads[id]
+	if aead == nil {
+		return nil, fmt.Errorf("%w: unknown data key %d", errTampered, id)
+	}
+	plain, err := aead.Open(nil, sealed[5:sealedHeaderSize], sealed[sealedHeaderSize:], aad)
+	if err != nil {
+		return nil, errTampered
+	}
+	return plain, nil
+}
+
+// purger is implemented by engines whose files can keep superseded copies of
+// values, such as records that a later write replaced. purge rewrites or
+// scrubs the files so that only the values current when it started remain.
+// Writes go on meanwhile: purge takes the server's write lock with lock,
+// which returns the server's revision, only for short steps, and commits
+// any step that changes the engine at that revision.
+type purger interface {
+	purge(lock func() uint64, unlock func()) error
+}
+
+// sealedEngine stores the values of a persistent engine sealed with the
+// keyring, each one bound to its key. Keys, expiries, versions and content
+// types are stored as they are.
+type sealedEngine struct {
+	engine
+	keys *keyring
+}
+
+func (e *sealedEngine) get(key string) (entry, bool, error) {
+	x, found, err := e.engine.get(key)
+	if err != nil || !found {
+		return x, found, err
+	}
+	x, err = openEntry(e.keys.keys(), key, x)
+	return x, err == nil, err
+}
+
+func (e *sealedEngine) put(key string, x entry) error {
+	x.value = string(e.keys.seal([]byte(x.value), []byte(key)))
+	return e.engine.put(key, x)
+}
+
+func (e *sealedEngine) ascend(start string, fn func(key string, x entry) bool) error {
+	return ascendOpened(e.engine, e.keys.keys(), start, fn)
+}
+
+func (e *sealedEngine) load(store map[string]entry, rev uint64) error {
+	sealed := make(map[string]entry, len(store))
+	for k, x := range store {
+		x.value = string(e.keys.seal([]byte(x.value), []byte(k)))
+		sealed[k] = x
+	}
+	return e.engine.load(sealed, rev)
+}
+
+func (e *sealedEngine) snapshot() (engineSnapshot, error) {
+	snap, err := e.engine.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &sealedSnapshot{engineSnapshot: snap, keys: e.keys.keys()}, nil
+}
+
+// staleKeys returns up to limit keys from start on whose values are not
+// sealed with the active data key, and whether there may be more
+func (e *sealedEngine) staleKeys(start string, limit int) ([]string, bool, error) {
+	var keys []string
+	err := e.engine.ascend(start, func(k string, x entry) bool {
+		if len(keys) == limit {
+			return false
+		}
+		if e.keys.stale([]byte(x.value)) {
+			keys = append(keys, k)
+		}
+		return true
+	})
+	return keys, len(keys) == limit, err
+}
+
+// reseal seals the value of key again with the active data key
+func (e *sealedEngine) reseal(key string) error {
+	x, found, err := e.engine.get(key)
+	if err != nil || !found || !e.keys.stale([]byte(x.value)) {
+		return err
+	}
+	if x, err = openEntry(e.keys.keys(), key, x); err != nil {
+		return err
+	}
+	return e.put(key, x)
+}
+
+// sealedSnapshot is a snapshot of a sealedEngine. It opens values with the
+// keys of when it was taken, which a re-encryption may retire meanwhile.
+type sealedSnapshot struct {
+	engineSnapshot
+	keys keyView
+}
+
+func (s *sealedSnapshot) ascend(start string, fn func(key string, x entry) bool) error {
+	return ascendOpened(s.engineSnapshot, s.keys, start, fn)
+}
+
+// ascendOpened walks src with every value opened by keys
+func ascendOpened(src entrySource, keys keyView, start string, fn func(key string, x entry) bool) error {
+	var openErr error
+	err := src.ascend(start, func(k string, x entry) bool {
+		if x, openErr = openEntry(keys, k, x); openErr != nil {
+			return false
+		}
+		return fn(k, x)
+	})
+	if openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+func openEntry(keys keyView, key string, x entry) (entry, error) {
+	plain, err := keys.open([]byte(x.value), []byte(key))
+	if err != nil {
+		return entry{}, fmt.Errorf("value of key '%s': %w", key, err)
+	}
+	x.value = string(plain)
+	return x, nil
+}
+
+// requestReseal starts a re-encryption of the data dir, or another one after
+// the one in progress
+func (s *kvServer) requestReseal() {
+	select {
+	case s.resealc <- struct{}{}:
+	default:
+	}
+}
+
+func (s *kvServer) resealLoop() {
+	defer s.loops.Done()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.resealc:
+			err := s.reseal()
+			switch {
+			case errors.Is(err, errResealStopped):
+				return
+			case err != nil:
+				log.Printf("Re-encryption failed: %v", err)
+			}
+		}
+	}
+}
+
+// reseal re-encrypts the snapshots, the WAL or Raft log and the values of
+// the storage engine with the active data key, then retires the older keys.
+// Writes go on meanwhile; the engine is re-encrypted in batches that each
+// hold the write lock briefly.
+func (s *kvServer) reseal() error {
+	target := s.keys.activeKey()
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+
+	seqs, err := listSnapshots(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, seq := range seqs {
+		path := filepath.Join(s.dir, snapshotName(seq))
+		store, _, err := readSnapshot(path, s.keys)
+		if err != nil {
+			// Recovery skips it the same way
+			log.Printf("Re-encryption: skipping %s: %v", path, err)
+			continue
+		}
+		if _, err := writeSnapshot(s.dir, seq, entriesOf(store), s.keys); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case s.raft != nil:
+		err = s.raft.reseal()
+	case s.wal != nil:
+		err = s.wal.reseal()
+	}
+	if err != nil {
+		return err
+	}
+	if e, ok := s.engine.(*sealedEngine); ok {
+		if err := s.resealEngine(e); err != nil {
+			return err
+		}
+	}
+	if err := s.keys.retire(target); err != nil {
+		return err
+	}
+	log.Printf("Re-encrypted %s with data key %d", s.dir, target)
+	return nil
+}
+
+// resealEngine re-encrypts every value of e that is not sealed with the
+// active data key
+func (s *kvServer) resealEngine(e *sealedEngine) error {
+	start := ""
+	for {
+		select {
+		case <-s.stop:
+			return errResealStopped
+		default:
+		}
+		s.rlockAll()
+		keys, more, err := e.staleKeys(start, resealBatch)
+		s.runlockAll()
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			break
+		}
+
+		s.mu.Lock()
+		for _, k := range keys {
+			if err = e.reseal(k); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = e.commit(s.rev)
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("re-encrypt storage engine: %w", err)
+		}
+		if !more {
+			break
+		}
+		start = keys[len(keys)-1] + "\x00"
+	}
+
+	// Values sealed with an older key, or not at all, may survive in
+	// superseded records
+	p, ok := e.engine.(purger)
+	if !ok {
+		return nil
+	}
+	lock := func() uint64 {
+		s.mu.Lock()
+		return s.rev
+	}
+	if err := p.purge(lock, s.mu.Unlock); err != nil {
+		return fmt.Errorf("purge storage engine: %w", err)
+	}
+	return nil
+}
+
+// RotateEncryptionKey switches new writes to a fresh data key, wrapped by the
+// newest master key in the key file, and re-encrypts the data dir in the
+// background
+func (s *kvServer) RotateEncryptionKey(ctx context.Context, req *pb.RotateEncryptionKeyRequest) (*pb.RotateEncryptionKeyResponse, error) {
+	if s.keys == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "encryption at rest is not enabled on this node")
+	}
+	id, rotated, err := s.keys.rotate()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to rotate the data key: %v", err)
+	}
+	s.requestReseal()
+	return &pb.RotateEncryptionKeyResponse{KeyId: id, MasterRotated: rotated}, nil
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+)
+
+// secret marks the values that must never reach the disk in plaintext
+const secret = "top-secret-value"
+
+// writeMasterKeys writes a key file holding keys, newest last
+func writeMasterKeys(t *testing.T, path string, keys ...[]byte) {
+	t.Helper()
+	var b strings.Builder
+	b.WriteString("# master keys, newest last\n")
+	for _, k := range keys {
+		b.WriteString(hex.EncodeToString(k) + "\n")
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newMasterKey() []byte {
+	key := make([]byte, dataKeySize)
+	rand.Read(key)
+	return key
+}
+
+func encryptedOptions(keyFile string) serverOptions {
+	return serverOptions{WAL: walOptions{Sync: syncAlways}, Encryption: encryptionOptions{KeyFile: keyFile}}
+}
+
+func openEncrypted(t *testing.T, dir, keyFile string) *kvServer {
+	t.Helper()
+	server, err := openKVServer(dir, encryptedOptions(keyFile))
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	return server
+}
+
+// waitResealed waits until the server has re-encrypted its data dir and
+// kept only its newest data key
+func waitResealed(t *testing.T, s *kvServer) {
+	t.Helper()
+	waitFor(t, "re-encryption", func() bool {
+		s.keys.mu.RLock()
+		defer s.keys.mu.RUnlock()
+		return !s.keys.state.Plaintext && len(s.keys.state.Keys) == 1
+	})
+}
+
+// assertNoPlaintext fails if any file under dir holds a secret value
+func assertNoPlaintext(t *testing.T, dir string) {
+	t.Helper()
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(b, []byte(secret)) {
+			t.Errorf("%s holds a value in plaintext", path)
+		}
+		return nil
+	})
+}
+
+// assertValues checks that keys k0 to k(n-1) hold their secret values
+func assertValues(t *testing.T, s *kvServer, n int) {
+	t.Helper()
+	for i := range n {
+		key := "k" + string(rune('a'+i))
+		resp, err := s.Get(context.Background(), &pb.GetRequest{Key: key})
+		if err != nil || resp.Value != secret+key {
+			t.Fatalf("Get(%s) = %v, %v, want %q", key, resp, err, secret+key)
+		}
+	}
+}
+
+func setValues(t *testing.T, s *kvServer, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		key := "k" + string(rune('a'+i))
+		if _, err := s.Set(context.Background(), &pb.SetRequest{Key: key, Value: secret + key}); err != nil {
+			t.Fatalf("Set(%s) error = %v", key, err)
+		}
+	}
+}
+
+// tamperRecord flips a byte in the payload of the first framed record of a
+// WAL segment or Raft log and fixes its checksum, as an attacker who can
+// write the file would
+func tamperRecord(t *testing.T, path string) {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := binary.LittleEndian.Uint32(b[4:8])
+	payload := b[walHeaderSize : walHeaderSize+size]
+	payload[len(payload)-1] ^= 1
+	binary.LittleEndian.PutUint32(b[0:4], crc32.Checksum(payload, crcTable))
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rewriteFrames replaces the framed records of a WAL segment or Raft log
+// with the ones edit returns, as an attacker who can write the file would
+func rewriteFrames(t *testing.T, path string, edit func(frames [][]byte) [][]byte) {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames [][]byte
+	for len(b) > 0 {
+		size := walHeaderSize + int(binary.LittleEndian.Uint32(b[4:8]))
+		frames = append(frames, b[:size])
+		b = b[size:]
+	}
+	if err := os.WriteFile(path, bytes.Join(edit(frames), nil), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	writeMasterKeys(t, keyFile, newMasterKey())
+
+	server := openEncrypted(t, dir, keyFile)
+	setValues(t, server, 0, 10)
+	if err := server.snapshot(); err != nil {
+		t.Fatalf("snapshot() error = %v", err)
+	}
+	setValues(t, server, 10, 20)
+	waitResealed(t, server)
+	server.Close()
+	assertNoPlaintext(t, dir)
+
+	server = openEncrypted(t, dir, keyFile)
+	defer server.Close()
+	assertValues(t, server, 20)
+}
+
+func TestTamperedWALRecordIsDetected(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	writeMasterKeys(t, keyFile, newMasterKey())
+
+	server := openEncrypted(t, dir, keyFile)
+	setValues(t, server, 0, 3)
+	waitResealed(t, server)
+	server.Close()
+
+	segments, err := listSegments(dir)
+	if err != nil || len(segments) == 0 {
+		t.Fatalf("listSegments() = %v, %v", segments, err)
+	}
+	tamperRecord(t, filepath.Join(dir, segmentName(segments[0])))
+	if _, err := openKVServer(dir, encryptedOptions(keyFile)); !errors.Is(err, errTampered) {
+		t.Errorf("openKVServer() of a tampered WAL error = %v, want %v", err, errTampered)
+	}
+}
+
+func TestTamperedWALRecordIsDetectedDuringMigration(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	writeMasterKeys(t, keyFile, newMasterKey())
+
+	server := openEncrypted(t, dir, keyFile)
+	setValues(t, server, 0, 3)
+	waitResealed(t, server)
+	server.Close()
+
+	// Put the keyring back to accepting unencrypted records, as it does
+	// until a migration finishes
+	path := filepath.Join(dir, keyringFile)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state keyringState
+	if err := json.Unmarshal(b, &state); err != nil {
+		t.Fatal(err)
+	}
+	state.Plaintext = true
+	if err := saveKeyring(dir, state); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil || len(segments) == 0 {
+		t.Fatalf("listSegments() = %v, %v", segments, err)
+	}
+	tamperRecord(t, filepath.Join(dir, segmentName(segments[0])))
+	if _, err := openKVServer(dir, encryptedOptions(keyFile)); !errors.Is(err, errTampered) {
+		t.Errorf("openKVServer() of a tampered WAL during a migration error = %v, want %v", err, errTampered)
+	}
+}
+
+func TestReorderedWALRecordsAreDetected(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	writeMasterKeys(t, keyFile, newMasterKey())
+
+	server := openEncrypted(t, dir, keyFile)
+	setValues(t, server, 0, 3)
+	waitResealed(t, server)
+	server.Close()
+
+	segments, err := listSegments(dir)
+	if err != nil || len(segments) == 0 {
+		t.Fatalf("listSegments() = %v, %v", segments, err)
+	}
+	path := filepath.Join(dir, segmentName(segments[0]))
+	rewriteFrames(t, path, func(frames [][]byte) [][]byte {
+		return append([][]byte{frames[1], frames[0]}, frames[2:]...)
+	})
+	if _, err := openKVServer(dir, encryptedOptions(keyFile)); !errors.Is(err, errTampered) {
+		t.Errorf("openKVServer() of a reordered WAL error = %v, want %v", err, errTampered)
+	}
+}
+
+func TestReplayedRaftLogFrameIsDetected(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	writeMasterKeys(t, keyFile, newMasterKey())
+	keys, _, err := openKeyring(dir, encryptionOptions{KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("openKeyring() error = %v", err)
+	}
+	l, err := openRaftLog(dir, keys)
+	if err != nil {
+		t.Fatalf("openRaftLog() error = %v", err)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		if err := l.append(raftEntry{Index: i, Term: 1, Data: []byte(secret)}); err != nil {
+			t.Fatalf("append(%d) error = %v", i, err)
+		}
+	}
+	l.Close()
+
+	// Written again at the end, the first entry would replace the whole log
+	rewriteFrames(t, filepath.Join(dir, raftLogFile), func(frames [][]byte) [][]byte {
+		return append(frames, frames[0])
+	})
+	if _, err := openRaftLog(dir, keys); !errors.Is(err, errTampered) {
+		t.Errorf("openRaftLog() of a log with a replayed frame error = %v, want %v", err, errTampered)
+	}
+}
+
+func TestTamperedSnapshotIsDetected(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	writeMasterKeys(t, keyFile, newMasterKey())
+	keys, _, err := openKeyring(dir, encryptionOptions{KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("openKeyring() error = %v", err)
+	}
+	if err := keys.retire(keys.activeKey()); err != nil {
+		t.Fatalf("retire() error = %v", err)
+	}
+
+	path, err := writeSnapshot(dir, 1, entriesOf(map[string]entry{"k": {value: secret}}), keys)
+	if err != nil {
+		t.Fatalf("writeSnapshot() error = %v", err)
+	}
+	if store, _, err := readSnapshot(path, keys); err != nil || store["k"].value != secret {
+		t.Fatalf("readSnapshot() = %v, %v, want the value back", store, err)
+	}
+
+	// The value starts after the header, the key and the value's length
+	b, _ := os.ReadFile(path)
+	b[len(snapshotMagic)+1+8+8+3+sealedHeaderSize] ^= 1
+	binary.LittleEndian.PutUint32(b[len(b)-4:], crc32.Checksum(b[:len(b)-4], crcTable))
+	os.WriteFile(path, b, 0o644)
+	if _, _, err := readSnapshot(path, keys); !errors.Is(err, errTampered) {
+		t.Errorf("readSnapshot() of a tampered value error = %v, want %v", err, errTampered)
+	}
+	if _, _, err := loadLatestSnapshot(dir, keys); !errors.Is(err, errTampered) {
+		t.Errorf("loadLatestSnapshot() error = %v, want it not to fall back past a tampered snapshot", err)
+	}
+
+	// Nor may a snapshot be swapped for an unencrypted one
+	if _, err := writeSnapshot(dir, 1, entriesOf(map[string]entry{"k": {value: "forged"}}), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readSnapshot(path, keys); !errors.Is(err, errTampered) {
+		t.Errorf("readSnapshot() of an unencrypted snapshot error = %v, want %v", err, errTampered)
+	}
+}
+
+func TestKeyRotationReencrypts(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	oldMaster, newMaster := newMasterKey(), newMasterKey()
+	writeMasterKeys(t, keyFile, oldMaster)
+
+	server := openEncrypted(t, dir, keyFile)
+	setValues(t, server, 0, 10)
+	server.snapshot()
+	waitResealed(t, server)
+
+	resp, err := server.RotateEncryptionKey(context.Background(), &pb.RotateEncryptionKeyRequest{})
+	if err != nil || resp.MasterRotated || resp.KeyId != 2 {
+		t.Fatalf("RotateEncryptionKey() = %v, %v, want data key 2 under the same master", resp, err)
+	}
+	setValues(t, server, 10, 15)
+
+	writeMasterKeys(t, keyFile, oldMaster, newMaster)
+	resp, err = server.RotateEncryptionKey(context.Background(), &pb.RotateEncryptionKeyRequest{})
+	if err != nil || !resp.MasterRotated || resp.KeyId != 3 {
+		t.Fatalf("RotateEncryptionKey() = %v, %v, want data key 3 under the new master", resp, err)
+	}
+	setValues(t, server, 15, 20)
+	waitResealed(t, server)
+	assertValues(t, server, 20)
+	server.Close()
+
+	// Once everything is re-encrypted, the old master key can be thrown away
+	writeMasterKeys(t, keyFile, newMaster)
+	server = openEncrypted(t, dir, keyFile)
+	defer server.Close()
+	assertValues(t, server, 20)
+	if id := server.keys.activeKey(); id != 3 {
+		t.Errorf("activeKey() after restart = %d, want 3", id)
+	}
+
+	writeMasterKeys(t, keyFile, oldMaster)
+	fresh, err := openKVServer(t.TempDir(), encryptedOptions(keyFile))
+	if err != nil {
+		t.Fatalf("openKVServer() of a new data dir error = %v", err)
+	}
+	fresh.Close()
+	if _, _, err := openKeyring(dir, encryptionOptions{KeyFile: keyFile}); err == nil {
+		t.Errorf("Expected a keyring to refuse a master key that did not wrap it")
+	}
+}
+
+func TestEnableEncryptionOnExistingData(t *testing.T) {
+	dir := t.TempDir()
+	server, err := openKVServer(dir, serverOptions{WAL: walOptions{Sync: syncAlways}})
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	setValues(t, server, 0, 10)
+	server.snapshot()
+	setValues(t, server, 10, 20)
+	server.Close()
+
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	writeMasterKeys(t, keyFile, newMasterKey())
+	server = openEncrypted(t, dir, keyFile)
+	assertValues(t, server, 20)
+	waitResealed(t, server)
+	server.Close()
+	assertNoPlaintext(t, dir)
+
+	server = openEncrypted(t, dir, keyFile)
+	assertValues(t, server, 20)
+	server.Close()
+	if _, err := openKVServer(dir, serverOptions{}); err == nil {
+		t.Errorf("Expected an encrypted data dir to need its master key")
+	}
+}
+
+func TestEncryptedRaftLog(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	writeMasterKeys(t, keyFile, newMasterKey())
+	lis := listen(t, "127.0.0.1:0")
+	lis.Close()
+	opts := clusterOptions("n1", map[string]string{"n1": lis.Addr().String()})
+	opts.Encryption = encryptionOptions{KeyFile: keyFile}
+	server, err := openKVServer(dir, opts)
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	waitFor(t, "a leader", func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := server.Set(ctx, &pb.SetRequest{Key: "k", Value: secret})
+		return err == nil
+	})
+	server.Close()
+	assertNoPlaintext(t, dir)
+
+	keys, _, err := openKeyring(dir, encryptionOptions{KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("openKeyring() error = %v", err)
+	}
+	l, err := openRaftLog(dir, keys)
+	if err != nil {
+		t.Fatalf("openRaftLog() error = %v", err)
+	}
+	found := false
+	for _, e := range l.entries {
+		if _, rec, err := decodeRaftCommand(e.Data); err == nil && rec.Value == secret {
+			found = true
+		}
+	}
+	l.Close()
+	if !found {
+		t.Errorf("Expected the write to be read back from the encrypted Raft log")
+	}
+
+	tamperRecord(t, filepath.Join(dir, raftLogFile))
+	if _, err := openRaftLog(dir, keys); !errors.Is(err, errTampered) {
+		t.Errorf("openRaftLog() of a tampered log error = %v, want %v", err, errTampered)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	engineMemory  = "memory"
+	engineBitcask = "bitcask"
+	engineLSM     = "lsm"
+	engineBTree   = "btree"
+)
+
+// engineNames lists the storage engines an operator can choose from
+var engineNames = []string{engineMemory, engineBitcask, engineLSM, engineBTree}
+
+// defaultEngine is the engine used when serverOptions doesn't name one
+var defaultEngine = engineMemory
+
+// entrySource is a set of entries that can be walked in key order
+type entrySource interface {
+	len() int
+	// ascend calls fn for every key >= start in ascending order until fn
+	// returns false
+	ascend(start string, fn func(key string, e entry) bool) error
+}
+
+// engine stores the entries of a kvServer. The server serializes writes
+// under its own lock: get, ascend, len and snapshot may run concurrently
+// with each other but never with put, delete, commit or load.
+type engine interface {
+	entrySource
+	// get returns the entry stored for key
+	get(key string) (entry, bool, error)
+	put(key string, e entry) error
+	// delete removes key; it is a no-op if key is absent
+	delete(key string) error
+	// commit marks the writes so far as the state at revision rev. A
+	// persistent engine reopens at its last commit, never part way through
+	// the writes of a revision.
+	commit(rev uint64) error
+	// revision returns the revision the engine would reopen at, which may
+	// trail the last commit, or 0 for an engine that starts empty on every
+	// open
+	revision() uint64
+	// load replaces the whole contents of the engine with store at rev. The
+	// engine may keep the map.
+	load(store map[string]entry, rev uint64) error
+	// snapshot returns a point-in-time view that later writes don't change.
+	// It stays readable without the server's lock until it is released.
+	snapshot() (engineSnapshot, error)
+	close() error
+}
+
+// engineSnapshot is a point-in-time view of an engine
+type engineSnapshot interface {
+	entrySource
+	release()
+}
+
+// openEngine opens the named storage engine, keeping any files it needs
+// under dir
+func openEngine(name, dir string) (engine, error) {
+	switch name {
+	case "", engineMemory:
+		return newMemoryEngine(), nil
+	case engineBitcask:
+		return openBitcask(filepath.Join(dir, engineBitcask), bitcaskOptions{})
+	case engineLSM:
+		return openLSM(filepath.Join(dir, engineLSM), lsmOptions{})
+	case engineBTree:
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("create data dir: %w", err)
+		}
+		return openBTree(filepath.Join(dir, "btree.db"), btreeOptions{})
+	}
+	return nil, fmt.Errorf("unknown storage engine %q (want %s)", name, strings.Join(engineNames, ", "))
+}
+
+// memoryShards is how many maps the memory engine spreads its entries over
+const memoryShards = 64
+
+// memoryEngine keeps every entry in key-hashed maps, with a skip list of the
+// keys for ordered iteration. Nothing survives a restart; the WAL and
+// snapshots rebuild it. Each map has its own lock, so a get may run while a
+// key in another map is written; puts and deletes must still be serialized,
+// and nothing may write while the keys are iterated.
+type memoryEngine struct {
+	shards [memoryShards]memoryShard
+	index  *keyIndex
+	count  int
+}
+
+type memoryShard struct {
+	mu    sync.RWMutex
+	store map[string]entry
+}
+
+func newMemoryEngine() *memoryEngine {
+	m := &memoryEngine{}
+	m.load(nil, 0)
+	return m
+}
+
+// shard returns the map holding key
+func (m *memoryEngine) shard(key string) *memoryShard {
+	return &m.shards[keyHash(key)%memoryShards]
+}
+
+func (m *memoryEngine) concurrentGets() {}
+
+func (m *memoryEngine) get(key string) (entry, bool, error) {
+	sh := m.shard(key)
+	sh.mu.RLock()
+	e, ok := sh.store[key]
+	sh.mu.RUnlock()
+	return e, ok, nil
+}
+
+func (m *memoryEngine) put(key string, e entry) error {
+	sh := m.shard(key)
+	sh.mu.Lock()
+	_, existed := sh.store[key]
+	sh.store[key] = e
+	sh.mu.Unlock()
+	if !existed {
+		m.index.insert(key)
+		m.count++
+	}
+	return nil
+}
+
+func (m *memoryEngine) delete(key string) error {
+	sh := m.shard(key)
+	sh.mu.Lock()
+	_, existed := sh.store[key]
+	delete(sh.store, key)
+	sh.mu.Unlock()
+	if existed {
+		m.index.remove(key)
+		m.count--
+	}
+	return nil
+}
+
+func (m *memoryEngine) commit(rev uint64) error {
+	return nil
+}
+
+// revision is always 0, since the engine never outlives the process
+func (m *memoryEngine) revision() uint64 {
+	return 0
+}
+
+func (m *memoryEngine) len() int {
+	return m.count
+}
+
+func (m *memoryEngine) ascend(start string, fn func(key string, e entry) bool) error {
+	m.index.ascend(start, func(key string) bool {
+		e, _, _ := m.get(key)
+		return fn(key, e)
+	})
+	return nil
+}
+
+func (m *memoryEngine) load(store map[string]entry, rev uint64) error {
+	for i := range m.shards {
+		m.shards[i].store = make(map[string]entry)
+	}
+	m.index = newKeyIndex()
+	m.count = 0
+	for k, e := range store {
+		m.put(k, e)
+	}
+	return nil
+}
+
+// snapshot copies the entries in key order. Values are immutable strings,
+// so the copy shares them with the maps.
+func (m *memoryEngine) snapshot() (engineSnapshot, error) {
+	snap := make(sortedEntries, 0, m.count)
+	m.ascend("", func(key string, e entry) bool {
+		snap = append(snap, scanItem{key: key, entry: e})
+		return true
+	})
+	return snap, nil
+}
+
+func (m *memoryEngine) close() error {
+	return nil
+}
+
+// sortedEntries is an in-memory entrySource ordered by key
+type sortedEntries []scanItem
+
+// entriesOf sorts the entries of a map into an entrySource
+func entriesOf(store map[string]entry) sortedEntries {
+	keys := slices.Sorted(maps.Keys(store))
+	items := make(sortedEntries, len(keys))
+	for i, k := range keys {
+		items[i] = scanItem{key: k, entry: store[k]}
+	}
+	return items
+}
+
+func (s sortedEntries) len() int {
+	return len(s)
+}
+
+func (s sortedEntries) ascend(start string, fn func(key string, e entry) bool) error {
+	i := sort.Search(len(s), func(i int) bool { return s[i].key >= start })
+	for _, item := range s[i:] {
+		if !fn(item.key, item.entry) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s sortedEntries) release() {}
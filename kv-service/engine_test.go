@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMain runs the whole suite once against every storage engine, or only
+// against KV_TEST_ENGINE when it is set. Benchmarks compare the engines
+// themselves, so a benchmark run goes through the suite once.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	engines := engineNames
+	if name := os.Getenv("KV_TEST_ENGINE"); name != "" {
+		engines = []string{name}
+	} else if flag.Lookup("test.bench").Value.String() != "" {
+		engines = engines[:1]
+	}
+	code := 0
+	for _, name := range engines {
+		defaultEngine = name
+		fmt.Printf("=== storage engine: %s\n", name)
+		if c := m.Run(); c != 0 {
+			code = c
+		}
+	}
+	os.Exit(code)
+}
+
+// newTestServer returns a server without a WAL on the engine under test
+func newTestServer(t *testing.T) *kvServer {
+	t.Helper()
+	s := newKVServer()
+	s.engine = openTestEngine(t, t.TempDir())
+	s.useLockStripes(defaultLockStripes)
+	return s
+}
+
+// openTestEngine opens the engine under test in dir and closes it when the
+// test ends
+func openTestEngine(t *testing.T, dir string) engine {
+	t.Helper()
+	eng, err := openEngine(defaultEngine, dir)
+	if err != nil {
+		t.Fatalf("openEngine(%s) error = %v", defaultEngine, err)
+	}
+	t.Cleanup(func() { eng.close() })
+	return eng
+}
+
+// engineKeys returns the keys of src in the order ascend visits them
+func engineKeys(t *testing.T, src entrySource, start string) []string {
+	t.Helper()
+	var keys []string
+	if err := src.ascend(start, func(key string, e entry) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		t.Fatalf("ascend() error = %v", err)
+	}
+	return keys
+}
+
+func TestEngineGetPutDelete(t *testing.T) {
+	eng := openTestEngine(t, t.TempDir())
+
+	for _, k := range []string{"b", "d", "a", "c"} {
+		if err := eng.put(k, entry{value: "v" + k, version: 1}); err != nil {
+			t.Fatalf("put(%s) error = %v", k, err)
+		}
+	}
+	eng.put("b", entry{value: "new", expiresAt: 99, version: 2})
+	if err := eng.delete("d"); err != nil {
+		t.Fatalf("delete() error = %v", err)
+	}
+	if err := eng.delete("missing"); err != nil {
+		t.Fatalf("delete() of a missing key error = %v", err)
+	}
+	eng.commit(2)
+
+	e, found, err := eng.get("b")
+	if err != nil || !found || e != (entry{value: "new", expiresAt: 99, version: 2}) {
+		t.Errorf("get(b) = %+v, %v, %v", e, found, err)
+	}
+	if _, found, _ := eng.get("d"); found {
+		t.Errorf("get(d) found a deleted key")
+	}
+	if n := eng.len(); n != 3 {
+		t.Errorf("len() = %d, want 3", n)
+	}
+	if got := fmt.Sprint(engineKeys(t, eng, "")); got != "[a b c]" {
+		t.Errorf("ascend() = %s, want [a b c]", got)
+	}
+	if got := fmt.Sprint(engineKeys(t, eng, "ab")); got != "[b c]" {
+		t.Errorf("ascend(ab) = %s, want [b c]", got)
+	}
+}
+
+func TestEngineSnapshotIsolation(t *testing.T) {
+	eng := openTestEngine(t, t.TempDir())
+	eng.put("a", entry{value: "1"})
+	eng.put("b", entry{value: "1"})
+	eng.commit(1)
+
+	snap, err := eng.snapshot()
+	if err != nil {
+		t.Fatalf("snapshot() error = %v", err)
+	}
+	eng.put("a", entry{value: "2"})
+	eng.delete("b")
+	eng.put("c", entry{value: "2"})
+	eng.commit(2)
+
+	got := make(map[string]string)
+	snap.ascend("", func(key string, e entry) bool {
+		got[key] = e.value
+		return true
+	})
+	snap.release()
+	if len(got) != 2 || got["a"] != "1" || got["b"] != "1" || snap.len() != 2 {
+		t.Errorf("snapshot saw %v, want the state before the later writes", got)
+	}
+	if got := fmt.Sprint(engineKeys(t, eng, "")); got != "[a c]" {
+		t.Errorf("engine keys = %s, want [a c]", got)
+	}
+}
+
+func TestEngineLoad(t *testing.T) {
+	dir := t.TempDir()
+	eng := openTestEngine(t, dir)
+	eng.put("stale", entry{value: "x"})
+	eng.commit(1)
+
+	if err := eng.load(map[string]entry{"a": {value: "1", version: 7}, "b": {value: "2", version: 9}}, 9); err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	if got := fmt.Sprint(engineKeys(t, eng, "")); got != "[a b]" {
+		t.Errorf("keys after load = %s, want [a b]", got)
+	}
+	eng.put("c", entry{value: "3", version: 10})
+	eng.commit(10)
+	eng.close()
+
+	// A persistent engine reopens at its last commit
+	eng = openTestEngine(t, dir)
+	if eng.revision() == 0 {
+		t.Skipf("the %s engine does not persist", defaultEngine)
+	}
+	if rev := eng.revision(); rev != 10 {
+		t.Errorf("revision() after reopen = %d, want 10", rev)
+	}
+	if got := fmt.Sprint(engineKeys(t, eng, "")); got != "[a b c]" {
+		t.Errorf("keys after reopen = %s, want [a b c]", got)
+	}
+	if e, _, _ := eng.get("a"); e.version != 7 {
+		t.Errorf("get(a) after reopen = %+v, want version 7", e)
+	}
+}
+
+func TestOpenEngineUnknown(t *testing.T) {
+	if _, err := openEngine("floppy", t.TempDir()); err == nil {
+		t.Errorf("openEngine(floppy) error = nil, want an error")
+	}
+}
+
+func TestEngineContentTypeSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	eng := openTestEngine(t, dir)
+	want := map[string]entry{
+		"bin":   {value: "\xff\x00\xfe", version: 1, contentType: "application/octet-stream"},
+		"plain": {value: "text", version: 2},
+		"json":  {value: `{"a":1}`, expiresAt: 99, version: 3, contentType: "application/json"},
+	}
+	for k, e := range want {
+		eng.put(k, e)
+	}
+	eng.commit(3)
+	for k, e := range want {
+		if got, _, err := eng.get(k); err != nil || got != e {
+			t.Errorf("get(%s) = %+v, %v, want %+v", k, got, err, e)
+		}
+	}
+	eng.close()
+
+	eng = openTestEngine(t, dir)
+	if eng.revision() == 0 {
+		t.Skipf("the %s engine does not persist", defaultEngine)
+	}
+	for k, e := range want {
+		if got, _, err := eng.get(k); err != nil || got != e {
+			t.Errorf("get(%s) after reopen = %+v, %v, want %+v", k, got, err, e)
+		}
+	}
+}
+
+func TestEnginePurgeLetsWritesInterleave(t *testing.T) {
+	dir := t.TempDir()
+	eng := openTestEngine(t, dir)
+	p, ok := eng.(purger)
+	if !ok {
+		t.Skipf("the %s engine keeps nothing to purge", defaultEngine)
+	}
+	const n = 600
+	for i := range n {
+		eng.put(fmt.Sprintf("k%03d", i), entry{value: fmt.Sprintf("stale-%03d", i), version: 1})
+	}
+	eng.commit(1)
+	for i := range n {
+		eng.put(fmt.Sprintf("k%03d", i), entry{value: "fresh", version: 2})
+	}
+	eng.commit(2)
+
+	// Every time purge takes the lock, a write has gone in before it
+	rev := uint64(2)
+	lock := func() uint64 {
+		rev++
+		eng.put(fmt.Sprintf("w%03d", rev), entry{value: "fresh", version: rev})
+		eng.commit(rev)
+		return rev
+	}
+	if err := p.purge(lock, func() {}); err != nil {
+		t.Fatalf("purge() error = %v", err)
+	}
+	writes := int(rev - 2)
+
+	check := func(when string) {
+		t.Helper()
+		keys := engineKeys(t, eng, "")
+		if len(keys) != n+writes {
+			t.Fatalf("%s: %d keys, want %d", when, len(keys), n+writes)
+		}
+		for _, k := range keys {
+			if e, _, err := eng.get(k); err != nil || e.value != "fresh" {
+				t.Fatalf("%s: get(%s) = %+v, %v, want the latest value", when, k, e, err)
+			}
+		}
+	}
+	check("after purge")
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if b, _ := os.ReadFile(path); bytes.Contains(b, []byte("stale-")) {
+			t.Errorf("%s still holds an overwritten value", path)
+		}
+		return nil
+	})
+
+	eng.close()
+	eng = openTestEngine(t, dir)
+	check("after reopen")
+}
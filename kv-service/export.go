@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// exportMutation converts a stored key and its entry into the form Export
+// streams
+func exportMutation(key string, e entry, keysOnly bool) *pb.Mutation {
+	if keysOnly {
+		return &pb.Mutation{Op: pb.Mutation_SET, Key: key}
+	}
+	return &pb.Mutation{
+		Op:          pb.Mutation_SET,
+		Key:         key,
+		Value:       []byte(e.value),
+		ExpiresAt:   e.expiresAt,
+		Version:     e.version,
+		ContentType: e.contentType,
+	}
+}
+
+// exportKeys reads the live entries of keys under a read lock, so they are a
+// consistent view of the store
+func (s *kvServer) exportKeys(keys []string) ([]scanItem, error) {
+	s.rlockAll()
+	defer s.runlockAll()
+
+	now := s.now().UnixNano()
+	var items []scanItem
+	for _, key := range keys {
+		e, found, err := s.lookup(key)
+		if err != nil {
+			return nil, err
+		}
+		if found && !e.expired(now) {
+			items = append(items, scanItem{key: key, entry: e})
+		}
+	}
+	return items, nil
+}
+
+// Export streams stored keys for a rebalance. Every key is read in batches,
+// like a scan, so the result reflects each batch at the time it was read.
+func (s *kvServer) Export(req *pb.ExportRequest, stream grpc.ServerStreamingServer[pb.Mutation]) error {
+	if len(req.Keys) > 0 {
+		if err := checkBatchSize(len(req.Keys)); err != nil {
+			return err
+		}
+		items, err := s.exportKeys(req.Keys)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err := stream.Send(exportMutation(item.key, item.entry, req.KeysOnly)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	start, sent := "", 0
+	for {
+		if err := stream.Context().Err(); err != nil {
+			return status.FromContextError(err).Err()
+		}
+		items, err := s.scanBatch(start, "", scanBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err := stream.Send(exportMutation(item.key, item.entry, req.KeysOnly)); err != nil {
+				return err
+			}
+		}
+		sent += len(items)
+		if len(items) < scanBatchSize {
+			break
+		}
+		start = items[len(items)-1].key + "\x00"
+	}
+	log.Printf("Export returned=%d", sent)
+	return nil
+}
+
+// Import applies the sets and deletes of stored keys that a rebalance moves
+// here as one record. Keys keep the versions they had, so ETags read before
+// the move still match. Settings of a namespace that already exists are left
+// alone, so its quotas and usage stay as they are; keys are checked against
+// the quotas and memory limit like any other write.
+func (s *kvServer) Import(ctx context.Context, req *pb.ImportRequest) (resp *pb.ImportResponse, err error) {
+	var events []auditEvent
+	for _, m := range req.Mutations {
+		name, meta, _ := splitStoredKey(m.Key)
+		if meta {
+			continue
+		}
+		ev := auditEvent{op: auditDelete, namespace: name, key: m.Key[len(nsPrefix(name)):]}
+		if m.Op == pb.Mutation_SET {
+			ev.op, ev.sum = auditSet, s.auditSum("", m.Value)
+		}
+		events = append(events, ev)
+	}
+	defer func() {
+		for i := range events {
+			if err != nil {
+				events[i].err = err
+			} else {
+				events[i].version = resp.Revision
+			}
+		}
+		s.recordAudit(ctx, events...)
+	}()
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := checkBatchSize(len(req.Mutations)); err != nil {
+		return nil, err
+	}
+	for i, m := range req.Mutations {
+		switch {
+		case m.Key == "":
+			return nil, status.Errorf(codes.InvalidArgument, "mutation %d has no key", i)
+		case m.Op != pb.Mutation_SET && m.Op != pb.Mutation_DELETE:
+			return nil, status.Errorf(codes.InvalidArgument, "mutation %d must be a SET or DELETE", i)
+		case int64(len(m.Value)) > s.maxObjectSize:
+			return nil, status.Errorf(codes.InvalidArgument, "mutation %d holds a value over the maximum object size of %d bytes", i, s.maxObjectSize)
+		}
+	}
+
+	revision, err := s.mutate(ctx, func(v *txnView) (*walRecord, error) {
+		rec := walRecord{Op: walOpTxn}
+		for _, m := range req.Mutations {
+			_, found, _ := v.get(m.Key)
+			switch {
+			case m.Op == pb.Mutation_DELETE:
+				if !found {
+					continue
+				}
+				v.put(m.Key, entry{}, false)
+				rec.Ops = append(rec.Ops, walRecord{Op: walOpDelete, Key: m.Key})
+			case isMetaKey(m.Key) && found:
+			default:
+				e := entry{value: string(m.Value), expiresAt: m.ExpiresAt, version: m.Version, contentType: m.ContentType}
+				v.put(m.Key, e, true)
+				rec.Ops = append(rec.Ops, walRecord{Op: walOpSet, Key: m.Key, Value: e.value, ExpiresAt: e.expiresAt, ContentType: e.contentType, Version: e.version})
+			}
+		}
+		if len(rec.Ops) == 0 {
+			return nil, nil
+		}
+		return &rec, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Import mutations=%d, revision=%d", len(req.Mutations), revision)
+
+	return &pb.ImportResponse{Revision: revision}, nil
+}
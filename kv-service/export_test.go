@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeExportStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent []*pb.Mutation
+}
+
+func (f *fakeExportStream) Context() context.Context { return f.ctx }
+
+func (f *fakeExportStream) Send(m *pb.Mutation) error {
+	f.sent = append(f.sent, m)
+	return nil
+}
+
+func export(t *testing.T, server *kvServer, req *pb.ExportRequest) []*pb.Mutation {
+	t.Helper()
+	stream := &fakeExportStream{ctx: context.Background()}
+	if err := server.Export(req, stream); err != nil {
+		t.Fatalf("Export(%v) error = %v", req, err)
+	}
+	return stream.sent
+}
+
+func TestExportImportMovesEveryNamespace(t *testing.T) {
+	src, dst := newTestServer(t), newTestServer(t)
+	ctx := context.Background()
+	createNamespace(t, src, "a", &pb.NamespaceSettings{MaxKeys: 10})
+	src.Set(ctx, &pb.SetRequest{Key: "k", Value: "default"})
+	src.Set(ctx, &pb.SetRequest{Namespace: "a", Key: "k", Value: "in a", ContentType: "text/plain"})
+	src.Set(ctx, &pb.SetRequest{Namespace: "a", Key: "ttl", Value: "x", TtlSeconds: 60})
+
+	muts := export(t, src, &pb.ExportRequest{})
+	want := []string{metaKey("a"), nsPrefix("a") + "k", nsPrefix("a") + "ttl", "k"}
+	if len(muts) != len(want) {
+		t.Fatalf("Export() streamed %d keys, want %d", len(muts), len(want))
+	}
+	for i, m := range muts {
+		if m.Key != want[i] || m.Version == 0 {
+			t.Errorf("Export()[%d] = %q at version %d, want %q", i, m.Key, m.Version, want[i])
+		}
+	}
+	if keys := export(t, src, &pb.ExportRequest{KeysOnly: true}); len(keys) != len(want) || keys[1].Value != nil {
+		t.Errorf("Export(keys_only) = %v, want the keys alone", keys)
+	}
+
+	if _, err := dst.Import(ctx, &pb.ImportRequest{Mutations: muts}); err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	resp, err := dst.Get(ctx, &pb.GetRequest{Namespace: "a", Key: "k"})
+	if err != nil || resp.Value != "in a" || resp.ContentType != "text/plain" || resp.Version != muts[1].Version {
+		t.Errorf("Get(a/k) after import = %v, %v", resp, err)
+	}
+	ttl, err := dst.GetTTL(ctx, &pb.GetTTLRequest{Namespace: "a", Key: "ttl"})
+	if err != nil || ttl.TtlSeconds <= 0 || ttl.TtlSeconds > 60 {
+		t.Errorf("GetTTL(a/ttl) after import = %v, %v, want the remaining TTL", ttl, err)
+	}
+	list, _ := dst.ListNamespaces(ctx, &pb.ListNamespacesRequest{})
+	if len(list.Namespaces) != 2 || list.Namespaces[1].Settings.MaxKeys != 10 || list.Namespaces[1].Keys != 2 {
+		t.Errorf("ListNamespaces() after import = %v", list.Namespaces)
+	}
+
+	// Settings a server already has are kept, and keys that don't exist on
+	// the exporting server are left out
+	src.DropNamespace(ctx, &pb.DropNamespaceRequest{Name: "a"})
+	createNamespace(t, src, "a", &pb.NamespaceSettings{MaxKeys: 1})
+	muts = export(t, src, &pb.ExportRequest{Keys: []string{metaKey("a"), "missing", "k"}})
+	if len(muts) != 2 || muts[0].Key != metaKey("a") || muts[1].Key != "k" {
+		t.Fatalf("Export(keys) = %v, want the settings of a and k", muts)
+	}
+	muts = append(muts, &pb.Mutation{Op: pb.Mutation_DELETE, Key: nsPrefix("a") + "ttl"})
+	if _, err := dst.Import(ctx, &pb.ImportRequest{Mutations: muts}); err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	list, _ = dst.ListNamespaces(ctx, &pb.ListNamespacesRequest{})
+	if list.Namespaces[1].Settings.MaxKeys != 10 || list.Namespaces[1].Keys != 1 {
+		t.Errorf("ListNamespaces() after a second import = %v, want the settings kept and one key left", list.Namespaces)
+	}
+
+	_, err = dst.Import(ctx, &pb.ImportRequest{Mutations: []*pb.Mutation{{Op: pb.Mutation_EXPIRE, Key: "k"}}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Import() of an EXPIRE error = %v, want InvalidArgument", err)
+	}
+}
+
+func TestImportKeepsVersions(t *testing.T) {
+	src := newTestServer(t)
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		src.Set(ctx, &pb.SetRequest{Key: "k", Value: "v"})
+	}
+	want, _ := src.Get(ctx, &pb.GetRequest{Key: "k"})
+
+	dir := t.TempDir()
+	opts := serverOptions{WAL: walOptions{Sync: syncAlways}}
+	dst, err := openKVServer(dir, opts)
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	dst.Set(ctx, &pb.SetRequest{Key: "other", Value: "v"})
+	if _, err := dst.Import(ctx, &pb.ImportRequest{Mutations: export(t, src, &pb.ExportRequest{})}); err != nil {
+		t.Fatalf("Import() error = %v", err)
+	}
+	if got, _ := dst.Get(ctx, &pb.GetRequest{Key: "k"}); got.Version != want.Version {
+		t.Errorf("Get(k) after import = version %d, want %d", got.Version, want.Version)
+	}
+	dst.Close()
+
+	dst, err = openKVServer(dir, opts)
+	if err != nil {
+		t.Fatalf("openKVServer() after restart error = %v", err)
+	}
+	defer dst.Close()
+	if got, _ := dst.Get(ctx, &pb.GetRequest{Key: "k"}); got.Version != want.Version {
+		t.Errorf("Get(k) after restart = version %d, want %d", got.Version, want.Version)
+	}
+
+	// Followers apply the imported version too
+	rec := walRecord{Op: walOpSet, Seq: 3, Key: "k", Value: "v", Version: want.Version}
+	if got, err := replicatedRecord(replicationMessage(rec, 3)); err != nil || got.Version != want.Version {
+		t.Errorf("replicatedRecord() = %+v, %v, want version %d", got, err, want.Version)
+	}
+}
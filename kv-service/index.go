@@ -0,0 +1,113 @@
+package main
+
+import "math/rand/v2"
+
+const (
+	indexMaxLevel = 32
+	// indexP is the probability that a node is promoted to the next level
+	indexP = 0.25
+)
+
+// keyIndex is a skip list holding the store's keys in lexicographic order so
+// that range scans don't have to sort the whole map. It is not safe for
+// concurrent use; the server guards it with the same lock as the map.
+type keyIndex struct {
+	head   indexNode
+	level  int
+	length int
+}
+
+type indexNode struct {
+	key  string
+	next []*indexNode
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		head:  indexNode{next: make([]*indexNode, indexMaxLevel)},
+		level: 1,
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < indexMaxLevel && rand.Float64() < indexP {
+		level++
+	}
+	return level
+}
+
+// findPath fills update with the rightmost node before key at every level and
+// returns the first node whose key is >= key, or nil
+func (x *keyIndex) findPath(key string, update *[indexMaxLevel]*indexNode) *indexNode {
+	n := &x.head
+	for i := x.level - 1; i >= 0; i-- {
+		for n.next[i] != nil && n.next[i].key < key {
+			n = n.next[i]
+		}
+		if update != nil {
+			update[i] = n
+		}
+	}
+	return n.next[0]
+}
+
+// insert adds key to the index; it is a no-op if key is already present
+func (x *keyIndex) insert(key string) {
+	var update [indexMaxLevel]*indexNode
+	if n := x.findPath(key, &update); n != nil && n.key == key {
+		return
+	}
+
+	level := randomLevel()
+	if level > x.level {
+		for i := x.level; i < level; i++ {
+			update[i] = &x.head
+		}
+		x.level = level
+	}
+
+	n := &indexNode{key: key, next: make([]*indexNode, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+	x.length++
+}
+
+// remove deletes key from the index; it is a no-op if key is absent
+func (x *keyIndex) remove(key string) {
+	var update [indexMaxLevel]*indexNode
+	n := x.findPath(key, &update)
+	if n == nil || n.key != key {
+		return
+	}
+
+	for i := 0; i < len(n.next); i++ {
+		update[i].next[i] = n.next[i]
+	}
+	for x.level > 1 && x.head.next[x.level-1] == nil {
+		x.level--
+	}
+	x.length--
+}
+
+// ascend calls fn for every key >= start in ascending order until fn returns false
+func (x *keyIndex) ascend(start string, fn func(key string) bool) {
+	for n := x.findPath(start, nil); n != nil; n = n.next[0] {
+		if !fn(n.key) {
+			return
+		}
+	}
+}
+
+// Len returns the number of keys in the index
+func (x *keyIndex) Len() int {
+	return x.length
+}
+
+// seek returns the first node whose key is >= key, or nil. Following
+// next[0] from it walks the rest of the index in order.
+func (x *keyIndex) seek(key string) *indexNode {
+	return x.findPath(key, nil)
+}
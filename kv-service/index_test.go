@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+func TestKeyIndexOrder(t *testing.T) {
+	x := newKeyIndex()
+	want := map[string]bool{}
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%04d", rand.IntN(1000))
+		if rand.IntN(3) == 0 {
+			x.remove(key)
+			delete(want, key)
+		} else {
+			x.insert(key)
+			want[key] = true
+		}
+	}
+
+	var got []string
+	x.ascend("", func(key string) bool {
+		got = append(got, key)
+		return true
+	})
+
+	keys := make([]string, 0, len(want))
+	for k := range want {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	if !slices.Equal(got, keys) {
+		t.Errorf("ascend() returned %d keys, want %d in sorted order", len(got), len(keys))
+	}
+	if x.Len() != len(keys) {
+		t.Errorf("Len() = %d, want %d", x.Len(), len(keys))
+	}
+}
+
+func TestKeyIndexAscendFrom(t *testing.T) {
+	x := newKeyIndex()
+	for _, k := range []string{"b", "d", "a", "c", "e"} {
+		x.insert(k)
+	}
+	x.insert("c")
+
+	var got []string
+	x.ascend("bb", func(key string) bool {
+		got = append(got, key)
+		return len(got) < 2
+	})
+	if !slices.Equal(got, []string{"c", "d"}) {
+		t.Errorf("ascend(bb) = %v, want [c d]", got)
+	}
+}
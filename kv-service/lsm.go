@@ -0,0 +1,904 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+const (
+	lsmManifestName  = "MANIFEST"
+	lsmManifestMagic = "KVLSM001"
+	lsmLevels        = 7
+	// lsmL0Trigger is the number of L0 tables that triggers a compaction
+	// into L1
+	lsmL0Trigger = 4
+	// lsmL0Stop is the number of L0 tables past which compaction goes
+	// before flushing, so that writes stall rather than reads slowing down
+	// without bound
+	lsmL0Stop = 3 * lsmL0Trigger
+	// lsmMaxImmutable is the number of memtables that may wait to be
+	// flushed before commit blocks
+	lsmMaxImmutable = 2
+	// lsmEntryOverhead approximates the memory a memtable entry costs beyond
+	// its key and value
+	lsmEntryOverhead = 64
+
+	defaultLSMMemtableSize = 4 << 20
+	defaultLSMTableSize    = 2 << 20
+	defaultLSMLevelSize    = 10 << 20
+)
+
+type lsmOptions struct {
+	// MemtableSize is the approximate size at which the memtable is frozen
+	// and flushed to an L0 table
+	MemtableSize int64
+	// TableSize is the size at which compaction output is split
+	TableSize int64
+	// LevelSize is the target size of L1; every deeper level is ten times
+	// larger than the one above
+	LevelSize int64
+}
+
+// lsmEngine is a log-structured merge-tree. Writes go to an in-memory
+// memtable; once it is large enough it is frozen and a background worker
+// flushes it to an immutable SSTable in L0. The same worker compacts
+// tables: once L0 holds lsmL0Trigger tables they are merged into L1, and
+// once a deeper level outgrows its target one of its tables is merged into
+// the level below. Tables in L0 may overlap and are searched newest first;
+// every deeper level is a sorted run of tables that don't overlap, so a
+// lookup reads at most one table per level, and the bloom filter of each
+// table lets most misses skip the read altogether.
+//
+// The MANIFEST file lists the tables of every level with the revision and
+// key count of the newest flushed memtable. It is replaced atomically
+// after each flush and compaction, so the engine reopens at that revision
+// and the server replays the rest from its WAL. Files not in the manifest
+// are leftovers of an interrupted flush or compaction and are deleted on
+// open.
+type lsmEngine struct {
+	dir  string
+	opts lsmOptions
+
+	// mem takes every write and count is the number of live keys. Only the
+	// server's writers touch them, under its lock.
+	mem   *memtable
+	count int
+
+	// editMu serializes the changes to the set of tables made by flushes,
+	// compactions and load, and the manifest writes that record them
+	editMu sync.Mutex
+
+	// mu guards the fields below. Readers hold it for the length of a
+	// lookup or scan, so tables they reach can't be released under them.
+	mu sync.RWMutex
+	// flushed is signalled when imm shrinks or the worker fails
+	flushed *sync.Cond
+	// imm holds frozen memtables newest first
+	imm     []*memtable
+	version *lsmVersion
+	nextID  uint64
+	// rev and total are the revision and key count the manifest records
+	rev   uint64
+	total int
+	// bgErr is the sticky error of the background worker
+	bgErr error
+
+	work chan struct{}
+	stop chan struct{}
+	done chan struct{}
+	// compactPtr is, per level, the last key of the table last compacted
+	// out of it, so compactions rotate through the key space
+	compactPtr [lsmLevels]string
+}
+
+// lsmVersion is an immutable set of tables. levels[0] is ordered newest
+// first; deeper levels are ordered by key.
+type lsmVersion struct {
+	levels [lsmLevels][]*sstTable
+}
+
+func (v *lsmVersion) clone() *lsmVersion {
+	c := &lsmVersion{}
+	for i, tables := range v.levels {
+		c.levels[i] = slices.Clone(tables)
+	}
+	return c
+}
+
+func (v *lsmVersion) tables() []*sstTable {
+	var all []*sstTable
+	for _, tables := range v.levels {
+		all = append(all, tables...)
+	}
+	return all
+}
+
+// levelBytes returns the size of the tables in a level
+func (v *lsmVersion) levelBytes(level int) int64 {
+	var n int64
+	for _, t := range v.levels[level] {
+		n += t.size
+	}
+	return n
+}
+
+// memtable is a set of recent writes, deletes included, with a skip list
+// for ordered iteration. Once frozen it is never written again.
+type memtable struct {
+	entries map[string]lsmEntry
+	index   *keyIndex
+	size    int64
+	// rev and count are the revision and live key count of the engine as of
+	// the last commit into the memtable
+	rev   uint64
+	count int
+}
+
+func newMemtable() *memtable {
+	return &memtable{entries: make(map[string]lsmEntry), index: newKeyIndex()}
+}
+
+func (m *memtable) set(key string, e lsmEntry) {
+	if _, ok := m.entries[key]; !ok {
+		m.size += int64(len(key)) + lsmEntryOverhead
+		m.index.insert(key)
+	}
+	m.size += int64(len(e.value) + len(e.contentType))
+	m.entries[key] = e
+}
+
+// memIter walks a memtable in key order
+type memIter struct {
+	m *memtable
+	n *indexNode
+}
+
+func (m *memtable) iter(start string) *memIter {
+	return &memIter{m: m, n: m.index.seek(start)}
+}
+
+func (it *memIter) valid() bool     { return it.n != nil }
+func (it *memIter) key() string     { return it.n.key }
+func (it *memIter) value() lsmEntry { return it.m.entries[it.n.key] }
+func (it *memIter) next()           { it.n = it.n.next[0] }
+func (it *memIter) err() error      { return nil }
+
+// openLSM opens (or creates) the tables in dir as listed by its manifest
+// and starts the background worker
+func openLSM(dir string, opts lsmOptions) (*lsmEngine, error) {
+	if opts.MemtableSize <= 0 {
+		opts.MemtableSize = defaultLSMMemtableSize
+	}
+	if opts.TableSize <= 0 {
+		opts.TableSize = defaultLSMTableSize
+	}
+	if opts.LevelSize <= 0 {
+		opts.LevelSize = defaultLSMLevelSize
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create lsm dir: %w", err)
+	}
+	e := &lsmEngine{
+		dir:     dir,
+		opts:    opts,
+		mem:     newMemtable(),
+		version: &lsmVersion{},
+		nextID:  1,
+		work:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	e.flushed = sync.NewCond(&e.mu)
+
+	m, err := readLSMManifest(filepath.Join(dir, lsmManifestName))
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		e.rev, e.total, e.count, e.nextID = m.rev, m.count, m.count, m.nextID
+		for _, ref := range m.tables {
+			t, err := openSSTable(filepath.Join(dir, sstTableName(ref.id)), ref.id)
+			if err != nil {
+				e.closeTables()
+				return nil, err
+			}
+			e.version.levels[ref.level] = append(e.version.levels[ref.level], t)
+		}
+	}
+	if err := e.removeOrphans(); err != nil {
+		e.closeTables()
+		return nil, err
+	}
+
+	go e.worker()
+	e.signal()
+	return e, nil
+}
+
+// removeOrphans deletes the tables the manifest doesn't list
+func (e *lsmEngine) removeOrphans() error {
+	live := make(map[uint64]bool)
+	for _, t := range e.version.tables() {
+		live[t.id] = true
+	}
+	entries, err := os.ReadDir(e.dir)
+	if err != nil {
+		return fmt.Errorf("read lsm dir: %w", err)
+	}
+	for _, de := range entries {
+		if id, ok := parseSSTableName(de.Name()); ok && !live[id] {
+			if err := os.Remove(filepath.Join(e.dir, de.Name())); err != nil {
+				return fmt.Errorf("remove orphaned sstable: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (e *lsmEngine) get(key string) (entry, bool, error) {
+	le, found, err := e.lookup(key)
+	if err != nil || !found || le.deleted {
+		return entry{}, false, err
+	}
+	return le.entry, true, nil
+}
+
+// lookup returns the newest version of key, which may be a tombstone
+func (e *lsmEngine) lookup(key string) (lsmEntry, bool, error) {
+	if le, ok := e.mem.entries[key]; ok {
+		return le, true, nil
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, m := range e.imm {
+		if le, ok := m.entries[key]; ok {
+			return le, true, nil
+		}
+	}
+	for _, t := range e.version.levels[0] {
+		if le, ok, err := t.get(key); err != nil || ok {
+			return le, ok, err
+		}
+	}
+	for _, tables := range e.version.levels[1:] {
+		i, _ := slices.BinarySearchFunc(tables, key, func(t *sstTable, key string) int {
+			if t.last < key {
+				return -1
+			}
+			return 1
+		})
+		if i == len(tables) {
+			continue
+		}
+		if le, ok, err := tables[i].get(key); err != nil || ok {
+			return le, ok, err
+		}
+	}
+	return lsmEntry{}, false, nil
+}
+
+func (e *lsmEngine) put(key string, x entry) error {
+	if _, found, err := e.get(key); err != nil {
+		return err
+	} else if !found {
+		e.count++
+	}
+	e.mem.set(key, lsmEntry{entry: x})
+	return nil
+}
+
+// delete writes a tombstone, which shadows the key in older tables until
+// compaction reaches the deepest level holding it
+func (e *lsmEngine) delete(key string) error {
+	if _, found, err := e.get(key); err != nil || !found {
+		return err
+	}
+	e.count--
+	e.mem.set(key, lsmEntry{deleted: true})
+	return nil
+}
+
+// commit freezes the memtable once it is full and hands it to the worker.
+// It blocks while lsmMaxImmutable memtables are already waiting, so writes
+// can't outrun flushing, and fails once the worker has failed.
+func (e *lsmEngine) commit(rev uint64) error {
+	e.mem.rev, e.mem.count = rev, e.count
+	if e.mem.size < e.opts.MemtableSize {
+		return nil
+	}
+	e.mu.Lock()
+	for len(e.imm) >= lsmMaxImmutable && e.bgErr == nil {
+		e.flushed.Wait()
+	}
+	if err := e.bgErr; err != nil {
+		e.mu.Unlock()
+		return fmt.Errorf("lsm background work failed: %w", err)
+	}
+	e.imm = append([]*memtable{e.mem}, e.imm...)
+	e.mu.Unlock()
+	e.mem = newMemtable()
+	e.signal()
+	return nil
+}
+
+// revision returns the revision of the newest flushed memtable. Writes in
+// memory only are replayed from the WAL after a restart.
+func (e *lsmEngine) revision() uint64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.rev
+}
+
+func (e *lsmEngine) len() int {
+	return e.count
+}
+
+func (e *lsmEngine) ascend(start string, fn func(key string, e entry) bool) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	srcs := []lsmIter{e.mem.iter(start)}
+	for _, m := range e.imm {
+		srcs = append(srcs, m.iter(start))
+	}
+	return ascendMerged(append(srcs, e.version.iters(start)...), fn)
+}
+
+// iters returns an iterator per L0 table and per deeper level, newest first
+func (v *lsmVersion) iters(start string) []lsmIter {
+	var srcs []lsmIter
+	for _, t := range v.levels[0] {
+		srcs = append(srcs, t.iter(start))
+	}
+	for _, tables := range v.levels[1:] {
+		if len(tables) > 0 {
+			srcs = append(srcs, newLevelIter(tables, start))
+		}
+	}
+	return srcs
+}
+
+// ascendMerged calls fn for the newest version of every key in srcs,
+// skipping tombstones
+func ascendMerged(srcs []lsmIter, fn func(key string, e entry) bool) error {
+	it := newMergeIter(srcs)
+	for ; it.valid(); it.next() {
+		if v := it.value(); !v.deleted && !fn(it.key(), v.entry) {
+			return nil
+		}
+	}
+	return it.err()
+}
+
+// load writes store as a sorted run in the deepest level and drops every
+// other table and memtable
+func (e *lsmEngine) load(store map[string]entry, rev uint64) error {
+	e.editMu.Lock()
+	defer e.editMu.Unlock()
+
+	sorted := entriesOf(store)
+	items := make([]lsmItem, len(sorted))
+	for i, item := range sorted {
+		items[i] = lsmItem{key: item.key, lsmEntry: lsmEntry{entry: item.entry}}
+	}
+	tables, err := e.writeTables(newSliceIter(items, ""), false)
+	if err != nil {
+		return err
+	}
+	v := &lsmVersion{}
+	v.levels[lsmLevels-1] = tables
+	if err := e.writeManifest(v, rev, len(store)); err != nil {
+		unrefTables(tables)
+		return err
+	}
+
+	e.mu.Lock()
+	old := e.version
+	e.version, e.imm, e.rev, e.total = v, nil, rev, len(store)
+	e.flushed.Broadcast()
+	e.mu.Unlock()
+	e.mem = newMemtable()
+	e.count = len(store)
+	unrefTables(old.tables())
+	return nil
+}
+
+// purge rewrites the entries live when it starts as a sorted run in the
+// deepest level and drops every table and memtable they came from, so that
+// no table keeps a value that was overwritten or deleted. It freezes the
+// memtable under the lock and merges without it, so writes go on into
+// fresh memtables, which stay on top of the new run; they only stall once
+// lsmMaxImmutable of them wait to be flushed, since flushes wait for purge.
+// Flushes and compactions of what it merged find their inputs gone and are
+// discarded, as they are after a load.
+func (e *lsmEngine) purge(lock func() uint64, unlock func()) error {
+	e.editMu.Lock()
+	defer e.editMu.Unlock()
+
+	rev := lock()
+	e.mem.rev, e.mem.count = rev, e.count
+	e.mu.Lock()
+	e.imm = append([]*memtable{e.mem}, e.imm...)
+	frozen := slices.Clone(e.imm)
+	v := e.version
+	pinned := v.tables()
+	for _, t := range pinned {
+		t.ref()
+	}
+	e.mu.Unlock()
+	e.mem = newMemtable()
+	count := e.count
+	unlock()
+	defer unrefTables(pinned)
+
+	var srcs []lsmIter
+	for _, m := range frozen {
+		srcs = append(srcs, m.iter(""))
+	}
+	tables, err := e.writeTables(newMergeIter(append(srcs, v.iters("")...)), true)
+	if err != nil {
+		return err
+	}
+	nv := &lsmVersion{}
+	nv.levels[lsmLevels-1] = tables
+	if err := e.writeManifest(nv, rev, count); err != nil {
+		unrefTables(tables)
+		return err
+	}
+
+	e.mu.Lock()
+	e.version, e.rev, e.total = nv, rev, count
+	e.imm = slices.DeleteFunc(e.imm, func(m *memtable) bool { return slices.Contains(frozen, m) })
+	e.flushed.Broadcast()
+	e.mu.Unlock()
+	unrefTables(v.tables())
+	e.signal()
+	return nil
+}
+
+// snapshot copies the memtable and pins the frozen memtables and tables,
+// which later writes never change
+func (e *lsmEngine) snapshot() (engineSnapshot, error) {
+	snap := &lsmSnapshot{count: e.count}
+	snap.mem = make([]lsmItem, 0, len(e.mem.entries))
+	for it := e.mem.iter(""); it.valid(); it.next() {
+		snap.mem = append(snap.mem, lsmItem{key: it.key(), lsmEntry: it.value()})
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	snap.imm = slices.Clone(e.imm)
+	snap.version = e.version
+	for _, t := range snap.version.tables() {
+		t.ref()
+	}
+	return snap, nil
+}
+
+// close stops the worker and flushes whatever is still in memory, so the
+// engine reopens at its last commit without needing the WAL
+func (e *lsmEngine) close() error {
+	select {
+	case <-e.stop:
+		return nil
+	default:
+	}
+	close(e.stop)
+	<-e.done
+
+	var err error
+	if e.bgErr == nil {
+		if len(e.mem.entries) > 0 || e.mem.rev > e.rev {
+			e.imm = append([]*memtable{e.mem}, e.imm...)
+			e.mem = newMemtable()
+		}
+		for len(e.imm) > 0 && err == nil {
+			err = e.flush(e.imm[len(e.imm)-1])
+		}
+	}
+	e.closeTables()
+	return err
+}
+
+func (e *lsmEngine) closeTables() {
+	for _, t := range e.version.tables() {
+		t.f.Close()
+	}
+	e.version = &lsmVersion{}
+}
+
+// signal wakes the worker without blocking
+func (e *lsmEngine) signal() {
+	select {
+	case e.work <- struct{}{}:
+	default:
+	}
+}
+
+// worker flushes frozen memtables, oldest first, and compacts while there
+// is nothing to flush
+func (e *lsmEngine) worker() {
+	defer close(e.done)
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-e.work:
+		}
+		for {
+			did, err := e.backgroundStep()
+			if err != nil {
+				log.Printf("LSM: background work failed: %v", err)
+				e.mu.Lock()
+				e.bgErr = err
+				e.flushed.Broadcast()
+				e.mu.Unlock()
+				return
+			}
+			if !did {
+				break
+			}
+			select {
+			case <-e.stop:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// backgroundStep does one flush or compaction and reports whether there was
+// anything to do
+func (e *lsmEngine) backgroundStep() (bool, error) {
+	e.mu.RLock()
+	var m *memtable
+	if len(e.imm) > 0 {
+		m = e.imm[len(e.imm)-1]
+	}
+	l0 := len(e.version.levels[0])
+	e.mu.RUnlock()
+	if m != nil && l0 >= lsmL0Stop {
+		if did, err := e.compact(); did || err != nil {
+			return did, err
+		}
+	}
+	if m != nil {
+		return true, e.flush(m)
+	}
+	return e.compact()
+}
+
+// flush writes a frozen memtable to a new L0 table and records it in the
+// manifest along with the memtable's revision
+func (e *lsmEngine) flush(m *memtable) error {
+	var tables []*sstTable
+	if len(m.entries) > 0 {
+		id := e.newID()
+		t, err := e.writeTable(id, m.iter(""), false, 0)
+		if err != nil {
+			return err
+		}
+		tables = append(tables, t)
+	}
+
+	e.editMu.Lock()
+	defer e.editMu.Unlock()
+	e.mu.RLock()
+	v := e.version.clone()
+	pending := slices.Contains(e.imm, m)
+	e.mu.RUnlock()
+	if !pending {
+		// load replaced everything while the table was being written
+		unrefTables(tables)
+		return nil
+	}
+	v.levels[0] = append(tables, v.levels[0]...)
+	if err := e.writeManifest(v, m.rev, m.count); err != nil {
+		unrefTables(tables)
+		return err
+	}
+
+	e.mu.Lock()
+	e.version, e.rev, e.total = v, m.rev, m.count
+	e.imm = slices.DeleteFunc(e.imm, func(x *memtable) bool { return x == m })
+	e.flushed.Broadcast()
+	e.mu.Unlock()
+	return nil
+}
+
+// compact merges tables into the next level when L0 has too many tables or
+// a deeper level is over its target size. Where no deeper level holds any
+// tables, tombstones have nothing left to hide and are dropped.
+func (e *lsmEngine) compact() (bool, error) {
+	e.mu.RLock()
+	v := e.version
+	level, inputs := e.pickCompaction(v)
+	if inputs == nil {
+		e.mu.RUnlock()
+		return false, nil
+	}
+	first, last := inputs[0].first, inputs[0].last
+	for _, t := range inputs {
+		first, last = min(first, t.first), max(last, t.last)
+	}
+	var overlaps []*sstTable
+	for _, t := range v.levels[level+1] {
+		if t.overlaps(first, last) {
+			overlaps = append(overlaps, t)
+		}
+	}
+	all := append(slices.Clone(inputs), overlaps...)
+	for _, t := range all {
+		t.ref()
+	}
+	e.mu.RUnlock()
+	defer unrefTables(all)
+
+	bottom := true
+	for _, tables := range v.levels[level+2:] {
+		bottom = bottom && len(tables) == 0
+	}
+	var srcs []lsmIter
+	if level == 0 {
+		for _, t := range inputs {
+			srcs = append(srcs, t.iter(""))
+		}
+	} else {
+		srcs = append(srcs, newLevelIter(inputs, ""))
+	}
+	srcs = append(srcs, newLevelIter(overlaps, ""))
+	outputs, err := e.writeTables(newMergeIter(srcs), bottom)
+	if err != nil {
+		return false, err
+	}
+
+	e.editMu.Lock()
+	defer e.editMu.Unlock()
+	e.mu.RLock()
+	nv := e.version.clone()
+	rev, total := e.rev, e.total
+	e.mu.RUnlock()
+	for _, t := range all {
+		if !slices.Contains(nv.levels[level], t) && !slices.Contains(nv.levels[level+1], t) {
+			// load replaced the inputs while they were being merged
+			unrefTables(outputs)
+			return true, nil
+		}
+	}
+	nv.levels[level] = slices.DeleteFunc(nv.levels[level], func(t *sstTable) bool { return slices.Contains(inputs, t) })
+	next := slices.DeleteFunc(nv.levels[level+1], func(t *sstTable) bool { return slices.Contains(overlaps, t) })
+	next = append(next, outputs...)
+	slices.SortFunc(next, func(a, b *sstTable) int {
+		if a.first < b.first {
+			return -1
+		}
+		return 1
+	})
+	nv.levels[level+1] = next
+	if err := e.writeManifest(nv, rev, total); err != nil {
+		unrefTables(outputs)
+		return false, err
+	}
+
+	e.mu.Lock()
+	e.version = nv
+	e.compactPtr[level] = last
+	e.mu.Unlock()
+	unrefTables(all)
+	log.Printf("LSM: compacted %d tables from L%d and %d from L%d into %d tables", len(inputs), level, len(overlaps), level+1, len(outputs))
+	return true, nil
+}
+
+// pickCompaction returns the level to compact from and its input tables,
+// or nil if every level is within its limits
+func (e *lsmEngine) pickCompaction(v *lsmVersion) (int, []*sstTable) {
+	if len(v.levels[0]) >= lsmL0Trigger {
+		return 0, v.levels[0]
+	}
+	target := e.opts.LevelSize
+	for level := 1; level < lsmLevels-1; level++ {
+		if v.levelBytes(level) > target {
+			tables := v.levels[level]
+			i := slices.IndexFunc(tables, func(t *sstTable) bool { return t.first > e.compactPtr[level] })
+			if i < 0 {
+				i = 0
+			}
+			return level, tables[i : i+1]
+		}
+		target *= 10
+	}
+	return 0, nil
+}
+
+// writeTables writes the entries of it to new tables of about TableSize
+// each, dropping tombstones if dropDeleted is set
+func (e *lsmEngine) writeTables(it lsmIter, dropDeleted bool) ([]*sstTable, error) {
+	var tables []*sstTable
+	for it.valid() {
+		t, err := e.writeTable(e.newID(), it, dropDeleted, e.opts.TableSize)
+		if err != nil {
+			unrefTables(tables)
+			return nil, err
+		}
+		if t.count == 0 {
+			unrefTables([]*sstTable{t})
+			continue
+		}
+		tables = append(tables, t)
+	}
+	if err := it.err(); err != nil {
+		unrefTables(tables)
+		return nil, err
+	}
+	return tables, nil
+}
+
+// writeTable writes entries of it to a new table until it is exhausted or,
+// if limit is set, the table reaches limit bytes
+func (e *lsmEngine) writeTable(id uint64, it lsmIter, dropDeleted bool, limit int64) (*sstTable, error) {
+	w, err := createSSTable(filepath.Join(e.dir, sstTableName(id)))
+	if err != nil {
+		return nil, err
+	}
+	for ; it.valid() && (limit <= 0 || w.size() < limit); it.next() {
+		if v := it.value(); !v.deleted || !dropDeleted {
+			if err := w.add(it.key(), v); err != nil {
+				w.abort()
+				return nil, err
+			}
+		}
+	}
+	if err := it.err(); err != nil {
+		w.abort()
+		return nil, err
+	}
+	return w.finish(id)
+}
+
+func (e *lsmEngine) newID() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	id := e.nextID
+	e.nextID++
+	return id
+}
+
+func unrefTables(tables []*sstTable) {
+	for _, t := range tables {
+		if err := t.unref(); err != nil {
+			log.Printf("LSM: %v", err)
+		}
+	}
+}
+
+// lsmTableRef is a table listed in the manifest
+type lsmTableRef struct {
+	level int
+	id    uint64
+}
+
+type lsmManifest struct {
+	rev, nextID uint64
+	count       int
+	tables      []lsmTableRef
+}
+
+// writeManifest atomically replaces the manifest with v at rev. The manifest
+// is
+//
+//	magic | rev | count | nextID | len(tables) | (level | id)... | crc32c
+//
+// with fixed 64-bit integers and one byte per level.
+func (e *lsmEngine) writeManifest(v *lsmVersion, rev uint64, count int) error {
+	e.mu.RLock()
+	nextID := e.nextID
+	e.mu.RUnlock()
+	tables := v.tables()
+	buf := []byte(lsmManifestMagic)
+	buf = binary.LittleEndian.AppendUint64(buf, rev)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(count))
+	buf = binary.LittleEndian.AppendUint64(buf, nextID)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(tables)))
+	for level, ts := range v.levels {
+		for _, t := range ts {
+			buf = append(buf, byte(level))
+			buf = binary.LittleEndian.AppendUint64(buf, t.id)
+		}
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+
+	path := filepath.Join(e.dir, lsmManifestName)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("create lsm manifest: %w", err)
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return fmt.Errorf("write lsm manifest: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("sync lsm manifest: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close lsm manifest: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("rename lsm manifest: %w", err)
+	}
+	return syncDir(e.dir)
+}
+
+// readLSMManifest reads the manifest at path, or returns nil if there is
+// none yet
+func readLSMManifest(path string) (*lsmManifest, error) {
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read lsm manifest: %w", err)
+	}
+	bad := errors.New("lsm manifest is corrupt")
+	header := len(lsmManifestMagic) + 4*8
+	if len(buf) < header+4 || string(buf[:len(lsmManifestMagic)]) != lsmManifestMagic {
+		return nil, bad
+	}
+	body := buf[:len(buf)-4]
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(buf[len(buf)-4:]) {
+		return nil, bad
+	}
+	p := body[len(lsmManifestMagic):]
+	m := &lsmManifest{
+		rev:    binary.LittleEndian.Uint64(p[0:8]),
+		count:  int(binary.LittleEndian.Uint64(p[8:16])),
+		nextID: binary.LittleEndian.Uint64(p[16:24]),
+	}
+	n := binary.LittleEndian.Uint64(p[24:32])
+	p = p[32:]
+	if uint64(len(p)) != n*9 {
+		return nil, bad
+	}
+	for ; len(p) > 0; p = p[9:] {
+		level := int(p[0])
+		if level >= lsmLevels {
+			return nil, bad
+		}
+		m.tables = append(m.tables, lsmTableRef{level: level, id: binary.LittleEndian.Uint64(p[1:9])})
+	}
+	return m, nil
+}
+
+// lsmSnapshot is a copy of the memtable plus the frozen memtables and
+// tables of the moment it was taken
+type lsmSnapshot struct {
+	mem     []lsmItem
+	imm     []*memtable
+	version *lsmVersion
+	count   int
+}
+
+func (s *lsmSnapshot) len() int {
+	return s.count
+}
+
+func (s *lsmSnapshot) ascend(start string, fn func(key string, e entry) bool) error {
+	srcs := []lsmIter{newSliceIter(s.mem, start)}
+	for _, m := range s.imm {
+		srcs = append(srcs, m.iter(start))
+	}
+	return ascendMerged(append(srcs, s.version.iters(start)...), fn)
+}
+
+func (s *lsmSnapshot) release() {
+	if s.version != nil {
+		unrefTables(s.version.tables())
+		s.version = nil
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func openTestLSM(t *testing.T, dir string, opts lsmOptions) *lsmEngine {
+	t.Helper()
+	e, err := openLSM(dir, opts)
+	if err != nil {
+		t.Fatalf("openLSM() error = %v", err)
+	}
+	t.Cleanup(func() { e.close() })
+	return e
+}
+
+// waitIdle waits until the worker has flushed every frozen memtable and has
+// no compaction left to do
+func waitIdle(t *testing.T, e *lsmEngine) {
+	t.Helper()
+	waitFor(t, "the LSM worker to go idle", func() bool {
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		_, inputs := e.pickCompaction(e.version)
+		return len(e.imm) == 0 && inputs == nil
+	})
+}
+
+func TestLSMFlushAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	opts := lsmOptions{MemtableSize: 4 << 10, TableSize: 8 << 10, LevelSize: 32 << 10}
+	e := openTestLSM(t, dir, opts)
+	rev := uint64(0)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 200; i++ {
+			rev++
+			if err := e.put(fmt.Sprintf("key-%03d", i), entry{value: fmt.Sprintf("round-%d", round), version: rev}); err != nil {
+				t.Fatalf("put() error = %v", err)
+			}
+			if err := e.commit(rev); err != nil {
+				t.Fatalf("commit() error = %v", err)
+			}
+		}
+	}
+	for i := 0; i < 200; i += 2 {
+		rev++
+		e.delete(fmt.Sprintf("key-%03d", i))
+		e.commit(rev)
+	}
+	waitIdle(t, e)
+
+	e.mu.RLock()
+	tables := len(e.version.tables())
+	l0 := len(e.version.levels[0])
+	e.mu.RUnlock()
+	if tables == 0 || l0 >= lsmL0Trigger {
+		t.Errorf("%d tables with %d in L0, want flushed and compacted tables", tables, l0)
+	}
+	if e.revision() == 0 {
+		t.Errorf("revision() = 0 after several flushes")
+	}
+
+	check := func(e *lsmEngine) {
+		t.Helper()
+		if n := e.len(); n != 100 {
+			t.Errorf("len() = %d, want 100", n)
+		}
+		if x, found, err := e.get("key-001"); err != nil || !found || x.value != "round-4" {
+			t.Errorf("get(key-001) = %+v, %v, %v, want round-4", x, found, err)
+		}
+		if _, found, _ := e.get("key-002"); found {
+			t.Errorf("get(key-002) found a deleted key")
+		}
+		keys := engineKeys(t, e, "key-190")
+		if got := fmt.Sprint(keys); got != "[key-191 key-193 key-195 key-197 key-199]" {
+			t.Errorf("ascend(key-190) = %s", got)
+		}
+	}
+	check(e)
+
+	// close flushes the memtable, so the engine reopens at the last commit
+	// without a WAL
+	e.close()
+	e = openTestLSM(t, dir, opts)
+	if e.revision() != rev {
+		t.Errorf("revision() after reopen = %d, want %d", e.revision(), rev)
+	}
+	check(e)
+}
+
+func TestLSMSnapshotPinsTables(t *testing.T) {
+	dir := t.TempDir()
+	opts := lsmOptions{MemtableSize: 1 << 10, TableSize: 2 << 10, LevelSize: 4 << 10}
+	e := openTestLSM(t, dir, opts)
+	rev := uint64(0)
+	write := func(value string) {
+		for i := 0; i < 100; i++ {
+			rev++
+			e.put(fmt.Sprintf("key-%02d", i), entry{value: value, version: rev})
+			e.commit(rev)
+		}
+	}
+	write("old")
+	waitIdle(t, e)
+	snap, err := e.snapshot()
+	if err != nil {
+		t.Fatalf("snapshot() error = %v", err)
+	}
+	pinned := snap.(*lsmSnapshot).version.tables()
+
+	// Later writes compact the pinned tables away
+	for round := 0; round < 5; round++ {
+		write("new")
+	}
+	waitIdle(t, e)
+	for _, tbl := range pinned {
+		if _, err := os.Stat(tbl.path); err != nil {
+			t.Errorf("table of a live snapshot was removed: %v", err)
+		}
+	}
+	n := 0
+	snap.ascend("", func(key string, x entry) bool {
+		if x.value != "old" {
+			t.Errorf("snapshot %s = %q, want old", key, x.value)
+		}
+		n++
+		return true
+	})
+	if n != 100 {
+		t.Errorf("snapshot has %d keys, want 100", n)
+	}
+	snap.release()
+
+	// The worker drops its own references just after installing a
+	// compaction, so the files may take a moment to go
+	waitFor(t, "compacted tables to be removed", func() bool {
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		for _, tbl := range pinned {
+			if _, err := os.Stat(tbl.path); !slices.Contains(e.version.tables(), tbl) && !os.IsNotExist(err) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestLSMRemovesOrphanedTables(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestLSM(t, dir, lsmOptions{})
+	e.put("a", entry{value: "1"})
+	e.commit(1)
+	e.close()
+
+	// A crash during a flush leaves a table the manifest doesn't list
+	orphan := filepath.Join(dir, sstTableName(99))
+	if err := os.WriteFile(orphan, []byte("partial"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	e = openTestLSM(t, dir, lsmOptions{})
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("orphaned table was not removed on open")
+	}
+	if x, found, _ := e.get("a"); !found || x.value != "1" {
+		t.Errorf("get(a) = %+v, %v after reopen", x, found)
+	}
+}
+
+func TestLSMCorruptManifest(t *testing.T) {
+	dir := t.TempDir()
+	e := openTestLSM(t, dir, lsmOptions{})
+	e.put("a", entry{value: "1"})
+	e.commit(1)
+	e.close()
+
+	path := filepath.Join(dir, lsmManifestName)
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	buf[len(lsmManifestMagic)] ^= 0xff
+	if err := os.WriteFile(path, buf, 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if _, err := openLSM(dir, lsmOptions{}); err == nil {
+		t.Errorf("openLSM() with a corrupt manifest error = nil, want an error")
+	}
+}
@@ -2,48 +2,724 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/pranavmerugu/censys-take-home/mtls"
 	pb "github.com/pranavmerugu/censys-take-home/proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// entry is a stored value together with its metadata
+type entry struct {
+	value string
+	// expiresAt is the expiry time in Unix nanoseconds, or 0 if the key never expires
+	expiresAt int64
+	// version is the revision at which the value was last written
+	version uint64
+	// contentType is the media type the value was stored with, if any
+	contentType string
+}
+
+// expired reports whether the entry has expired at the given Unix nanosecond time
+func (e entry) expired(now int64) bool {
+	return e.expiresAt != 0 && e.expiresAt <= now
+}
+
 type kvServer struct {
 	pb.UnimplementedKVStoreServer
-	mu    sync.RWMutex
-	store map[string]string
+	pb.UnimplementedKVReplicationServer
+	pb.UnimplementedKVAdminServer
+	pb.UnimplementedKVRaftServer
+	mu sync.RWMutex
+	// stripes, when set, split single-key operations across key-hashed locks
+	// taken under a read lock of mu; see rlockKey and mutateKey. Anything
+	// else that reads the store holds all of them.
+	stripes []lockStripe
+	// seqMu serializes logging and applying the writes of striped operations
+	seqMu sync.Mutex
+	// engine stores the entries; guarded by mu
+	engine engine
+	// rev is the revision of the latest mutation. It matches the WAL sequence
+	// number when the server is persistent, and the Raft index of the last
+	// applied entry in cluster mode.
+	rev uint64
+
+	// budget, when set, limits the key and value bytes in the store
+	budget *memoryBudget
+	// maxObjectSize bounds the size of a single value
+	maxObjectSize int64
+	// namespaces holds the named namespaces and their usage
+	namespaces namespaceTable
+
+	// expiries indexes keys with a TTL by expiry time; guarded by mu
+	expiries expiryHeap
+	now      func() time.Time
+	// feed retains recent mutations for watchers; guarded by mu
+	feed *changeFeed
+
+	// wal is nil when the server runs purely in memory or in cluster mode
+	wal *wal
+	// raft is set in cluster mode, where its log takes the place of the WAL
+	raft *raftNode
+
+	// replicaOf is the primary's address when the server is a follower
+	replicaOf string
+	nodeID    string
+	repl      replication
+	// tls, when set, secures the gRPC port and connections to peers with
+	// mutual TLS
+	tls *mtls.Reloader
+	// audit, when set, records the keys written by each write RPC
+	audit *auditLog
+	// keys, when set, encrypts the files in dir; resealc asks for them to be
+	// re-encrypted
+	keys    *keyring
+	resealc chan struct{}
+
+	dir      string
+	snapOpts snapshotOptions
+	snapMu   sync.Mutex // serializes snapshot writes
+	stop     chan struct{}
+	stopOnce sync.Once
+	loops    sync.WaitGroup
+}
+
+// serverOptions configures the persistence of a KV store server
+type serverOptions struct {
+	WAL      walOptions
+	Snapshot snapshotOptions
+	// SweepInterval is how often expired keys are reclaimed; zero disables the sweeper
+	SweepInterval time.Duration
+	// WatchHistory is how many recent mutations are retained for watchers
+	WatchHistory int
+	// ReplicaOf makes the server a read-only follower of the primary at this
+	// address
+	ReplicaOf string
+	// NodeID identifies a follower to its primary
+	NodeID string
+	// Raft enables cluster mode when its ID is set
+	Raft raftOptions
+	// Engine names the storage engine; empty means defaultEngine
+	Engine string
+	// LockStripes is how many locks single-key operations are spread over
+	// when the engine allows it; zero means defaultLockStripes, and 1 puts
+	// every operation on one lock
+	LockStripes int
+	// Memory limits the size of the store; it cannot be combined with Raft
+	Memory memoryOptions
+	// MaxObjectSize bounds the size of a single value; zero means
+	// defaultMaxObjectSize
+	MaxObjectSize int64
+	// TLS, when set, requires mutual TLS on the gRPC port and uses it to
+	// reach the primary and cluster peers
+	TLS *mtls.Reloader
+	// Audit records every write RPC when its Dir is set
+	Audit auditOptions
+	// Encryption encrypts the data dir at rest when its KeyFile is set
+	Encryption encryptionOptions
 }
 
-// newKVServer creates a new KV store server instance with an empty map
+// newKVServer creates a new KV store server instance with an empty in-memory
+// engine
 func newKVServer() *kvServer {
-	return &kvServer{
-		store: make(map[string]string),
+	s := &kvServer{
+		engine:        newMemoryEngine(),
+		maxObjectSize: defaultMaxObjectSize,
+		now:           time.Now,
+		feed:          newChangeFeed(defaultWatchHistory),
+		stop:          make(chan struct{}),
 	}
+	s.namespaces.byName = make(map[string]*namespace)
+	s.useLockStripes(defaultLockStripes)
+	return s
 }
 
-// Set stores a key-value pair in the map using a write lock
-func (s *kvServer) Set(ctx context.Context, req *pb.SetRequest) (*pb.SetResponse, error) {
+// openKVServer creates a KV store server backed by a write-ahead log in dir.
+// The store is recovered from the storage engine if it persists its contents,
+// or else from the newest valid snapshot, plus the log records written after
+// that.
+func openKVServer(dir string, opts serverOptions) (*kvServer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create data dir: %w", err)
+	}
+	if opts.Snapshot.Retain <= 0 {
+		opts.Snapshot.Retain = defaultSnapshotRetain
+	}
+	if opts.LockStripes == 0 {
+		opts.LockStripes = defaultLockStripes
+	}
+	if opts.MaxObjectSize < 0 || opts.MaxObjectSize > maxObjectSizeLimit {
+		return nil, fmt.Errorf("maximum object size must be between 0 and %d bytes", maxObjectSizeLimit)
+	}
+	if opts.MaxObjectSize == 0 {
+		opts.MaxObjectSize = defaultMaxObjectSize
+	}
+
+	s := newKVServer()
+	s.dir = dir
+	s.snapOpts = opts.Snapshot
+	s.feed = newChangeFeed(opts.WatchHistory)
+	s.replicaOf = opts.ReplicaOf
+	s.nodeID = opts.NodeID
+	s.maxObjectSize = opts.MaxObjectSize
+	s.tls = opts.TLS
+
+	if opts.Raft.ID != "" && opts.ReplicaOf != "" {
+		return nil, fmt.Errorf("cluster mode cannot be combined with asynchronous replication")
+	}
+	if opts.Memory.Limit < 0 {
+		return nil, fmt.Errorf("memory limit must not be negative")
+	}
+	if opts.Memory.Policy != "" && !slices.Contains(evictionPolicies, opts.Memory.Policy) {
+		return nil, fmt.Errorf("unknown eviction policy %q (want %s)", opts.Memory.Policy, strings.Join(evictionPolicies, ", "))
+	}
+	if opts.Raft.ID != "" && opts.Memory.Limit > 0 {
+		// Nodes would choose different keys to evict
+		return nil, fmt.Errorf("cluster mode cannot be combined with a memory limit")
+	}
+
+	reseal := false
+	if opts.Encryption.KeyFile != "" {
+		keys, pending, err := openKeyring(dir, opts.Encryption)
+		if err != nil {
+			return nil, err
+		}
+		s.keys, s.resealc, reseal = keys, make(chan struct{}, 1), pending
+	} else if _, err := os.Stat(filepath.Join(dir, keyringFile)); err == nil {
+		return nil, fmt.Errorf("%s is encrypted at rest; a master key file is needed to open it", dir)
+	}
+
+	if opts.Audit.Dir != "" {
+		a, err := openAuditLog(opts.Audit, func() time.Time { return s.now() })
+		if err != nil {
+			return nil, err
+		}
+		s.audit = a
+	}
+	if opts.Engine == "" {
+		opts.Engine = defaultEngine
+	}
+	eng, err := openEngine(opts.Engine, dir)
+	if err != nil {
+		if s.audit != nil {
+			s.audit.close()
+		}
+		return nil, err
+	}
+	if s.keys != nil && opts.Engine != engineMemory {
+		eng = &sealedEngine{engine: eng, keys: s.keys}
+	}
+	s.engine = eng
+	s.useLockStripes(opts.LockStripes)
+	fail := func(err error) (*kvServer, error) {
+		eng.close()
+		if s.audit != nil {
+			s.audit.close()
+		}
+		return nil, err
+	}
+
+	applied, err := s.recover(false)
+	if err != nil {
+		return fail(err)
+	}
+
+	if opts.Raft.ID != "" {
+		// Entries after the snapshot are applied again as the node learns
+		// that they are committed
+		if err := s.openRaft(opts.Raft, applied); err != nil {
+			return fail(err)
+		}
+	} else {
+		w, err := s.replayWAL(opts.WAL, applied)
+		if err != nil {
+			return fail(err)
+		}
+		if w.lastSequence() < applied {
+			// The engine got ahead of a log that lost its tail, so numbering
+			// would reuse revisions it already holds. Start over from the
+			// snapshot.
+			log.Printf("Storage engine is at revision %d but the WAL ends at %d; rebuilding from the snapshot", applied, w.lastSequence())
+			w.Close()
+			s.feed = newChangeFeed(opts.WatchHistory)
+			if applied, err = s.recover(true); err != nil {
+				return fail(err)
+			}
+			if w, err = s.replayWAL(opts.WAL, applied); err != nil {
+				return fail(err)
+			}
+		}
+		s.wal = w
+		s.rev = w.lastSequence()
+		log.Printf("Recovered %d keys from WAL in %s", s.engine.len(), dir)
+	}
+	if err := s.useMemoryBudget(opts.Memory); err != nil {
+		return fail(err)
+	}
+
+	if opts.Snapshot.Interval > 0 {
+		s.loops.Add(1)
+		go s.snapshotLoop(opts.Snapshot.Interval)
+	}
+	if s.replicaOf != "" {
+		// Followers learn about expirations from the primary's log
+		s.loops.Add(1)
+		go s.followLoop(s.replicaOf)
+	} else if opts.SweepInterval > 0 {
+		s.loops.Add(1)
+		go s.sweepLoop(opts.SweepInterval)
+	}
+	if s.keys != nil {
+		s.loops.Add(1)
+		go s.resealLoop()
+		if reseal {
+			s.requestReseal()
+		}
+	}
+	return s, nil
+}
+
+// recover brings the engine up to the newest valid snapshot, unless it
+// already persists a later revision, and returns the revision it is at. With
+// force the snapshot is loaded regardless. Callers must have exclusive access
+// to the server.
+func (s *kvServer) recover(force bool) (uint64, error) {
+	applied := s.engine.revision()
+	if seqs, err := listSnapshots(s.dir); err != nil {
+		return 0, err
+	} else if !force && (len(seqs) == 0 || seqs[len(seqs)-1] <= applied) {
+		if applied > 0 {
+			log.Printf("Storage engine is at revision %d with %d keys", applied, s.engine.len())
+		}
+		s.rev = applied
+		return applied, s.rebuildIndexes()
+	}
+
+	store, snapSeq, err := loadLatestSnapshot(s.dir, s.keys)
+	if err != nil {
+		return 0, err
+	}
+	if store == nil && !force {
+		// Every newer snapshot is corrupt, but the engine is intact
+		s.rev = applied
+		return applied, s.rebuildIndexes()
+	}
+	if err := s.load(store, snapSeq); err != nil {
+		return 0, err
+	}
+	s.rev = snapSeq
+	if store != nil {
+		log.Printf("Loaded snapshot at seq %d with %d keys", snapSeq, len(store))
+	}
+	return snapSeq, nil
+}
+
+// replayWAL opens the WAL and applies the records after applied. Records the
+// engine already holds, back to the snapshot a restart would otherwise load,
+// only go into the change feed, so watchers resume across a restart whichever
+// engine is used.
+func (s *kvServer) replayWAL(opts walOptions, applied uint64) (*wal, error) {
+	seqs, err := listSnapshots(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var from uint64
+	for _, seq := range seqs {
+		if seq <= applied {
+			from = seq
+		}
+	}
+	opts.keys = s.keys
+	return openWAL(s.dir, opts, from, func(rec walRecord) {
+		if rec.Seq <= applied {
+			s.feed.append(rec)
+			return
+		}
+		s.apply(rec)
+	})
+}
+
+// load replaces the contents of the store and rebuilds the expiry index,
+// namespace table and memory budget.
+// Callers must have exclusive access to the server.
+func (s *kvServer) load(store map[string]entry, rev uint64) error {
+	if err := s.engine.load(store, rev); err != nil {
+		return fmt.Errorf("load storage engine: %w", err)
+	}
+	if err := s.rebuildBudget(); err != nil {
+		return err
+	}
+	return s.rebuildIndexes()
+}
+
+// rebuildIndexes rebuilds the namespace table and expiry index from the
+// engine
+func (s *kvServer) rebuildIndexes() error {
+	if err := s.rebuildNamespaces(); err != nil {
+		return err
+	}
+	return s.rebuildExpiries()
+}
+
+// rebuildExpiries indexes every key in the engine that has a TTL
+func (s *kvServer) rebuildExpiries() error {
+	s.expiries.reset()
+	return s.engine.ascend("", func(k string, e entry) bool {
+		s.expiries.set(k, e.expiresAt)
+		return true
+	})
+}
+
+// lookup returns the entry stored for key, whether or not it has expired.
+// Callers must hold the lock.
+func (s *kvServer) lookup(key string) (entry, bool, error) {
+	e, found, err := s.engine.get(key)
+	if err != nil {
+		return entry{}, false, status.Errorf(codes.Internal, "failed to read key '%s': %v", key, err)
+	}
+	return e, found, nil
+}
+
+// snapshot writes a point-in-time copy of the store to disk, prunes old
+// snapshots and drops the WAL segments, or Raft log entries, that no retained
+// snapshot needs. Writers are only blocked while the map is copied, not while
+// it is written out.
+func (s *kvServer) snapshot() error {
+	if s.wal == nil && s.raft == nil {
+		return nil
+	}
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+
+	// Holding the read lock keeps writers out, so the copy and the WAL
+	// position are consistent with each other
+	s.rlockAll()
+	seq := s.rev
+	if seqs, err := listSnapshots(s.dir); err == nil && len(seqs) > 0 && seqs[len(seqs)-1] == seq {
+		// Nothing changed since the last snapshot
+		s.runlockAll()
+		return nil
+	}
+	store, err := s.engine.snapshot()
+	s.runlockAll()
+	if err != nil {
+		return err
+	}
+	defer store.release()
+
+	path, err := writeSnapshot(s.dir, seq, store, s.keys)
+	if err != nil {
+		return err
+	}
+	oldest, err := pruneSnapshots(s.dir, s.snapOpts.Retain)
+	if err != nil {
+		return err
+	}
+	if s.raft != nil {
+		err = s.raft.compact(oldest)
+	} else {
+		err = s.wal.removeBefore(oldest)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Wrote snapshot %s with %d keys", path, store.len())
+	return nil
+}
+
+func (s *kvServer) snapshotLoop(interval time.Duration) {
+	defer s.loops.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.snapshot(); err != nil {
+				log.Printf("Snapshot failed: %v", err)
+			}
+		}
+	}
+}
+
+// apply applies a logged mutation to the store. It is used both for live
+// writes and for replay. Callers must hold the write lock or have exclusive
+// access to the server.
+//
+// The mutation is already in the log, so a storage engine that fails to take
+// it can no longer agree with the log. The process exits and a restart
+// replays the log into the engine.
+func (s *kvServer) apply(rec walRecord) {
+	s.rev = rec.Seq
+	s.feed.append(rec)
+	var err error
+	if rec.Op == walOpTxn {
+		for _, op := range rec.Ops {
+			if err = s.applyOp(op); err != nil {
+				break
+			}
+		}
+	} else {
+		err = s.applyOp(rec)
+	}
+	if err == nil {
+		err = s.engine.commit(rec.Seq)
+	}
+	if err != nil {
+		log.Fatalf("Storage engine failed to apply revision %d: %v", rec.Seq, err)
+	}
+}
+
+// applyOp applies a single set, delete or expire mutation to the engine, the
+// expiry index and the namespace table
+func (s *kvServer) applyOp(rec walRecord) error {
+	switch rec.Op {
+	case walOpSet:
+		if err := s.trackNamespace(rec); err != nil {
+			return err
+		}
+		s.trackExpiry(rec.Key, rec.ExpiresAt)
+		if s.budget != nil && !isMetaKey(rec.Key) {
+			s.budget.set(rec.Key, entrySize(rec.Key, rec.Value), rec.ExpiresAt)
+		}
+		version := rec.Seq
+		if rec.Version != 0 {
+			version = rec.Version
+		}
+		return s.engine.put(rec.Key, entry{value: rec.Value, expiresAt: rec.ExpiresAt, version: version, contentType: rec.ContentType})
+	case walOpDelete:
+		if err := s.trackNamespace(rec); err != nil {
+			return err
+		}
+		s.trackExpiry(rec.Key, 0)
+		if s.budget != nil {
+			s.budget.remove(rec.Key)
+		}
+		return s.engine.delete(rec.Key)
+	case walOpExpire:
+		e, ok, err := s.engine.get(rec.Key)
+		if err != nil || !ok {
+			return err
+		}
+		e.expiresAt = rec.ExpiresAt
+		s.trackExpiry(rec.Key, rec.ExpiresAt)
+		if s.budget != nil {
+			s.budget.expire(rec.Key, rec.ExpiresAt)
+		}
+		return s.engine.put(rec.Key, e)
+	}
+	return nil
+}
+
+// logMutation assigns rec the next revision and appends it to the WAL, if
+// any. Callers must hold the write lock so that log order matches the order in
+// which mutations are applied.
+func (s *kvServer) logMutation(rec *walRecord) error {
+	if s.wal == nil {
+		rec.Seq = s.rev + 1
+		return nil
+	}
+	seq, err := s.wal.append(*rec)
+	if errors.Is(err, errRecordTooLarge) {
+		return tooLarge(fmt.Sprintf("the write is too large to log: %v", err), walMaxRecordSize)
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to write WAL: %v", err)
+	}
+	rec.Seq = seq
+	return nil
+}
+
+// waitDurable blocks until the WAL record seq has been persisted according to
+// the configured sync policy. It must be called without holding the lock.
+func (s *kvServer) waitDurable(seq uint64) error {
+	if s.wal == nil {
+		return nil
+	}
+	if err := s.wal.sync(seq); err != nil {
+		return status.Errorf(codes.Internal, "failed to sync WAL: %v", err)
+	}
+	return nil
+}
+
+// checkServing returns an Unavailable error once the WAL has failed. A write
+// whose fsync failed has already been applied and could be read back, though
+// it may be lost on restart, so the node stops serving reads and writes alike
+// until it is restarted and recovers only what reached the disk.
+func (s *kvServer) checkServing() error {
+	if s.wal == nil {
+		return nil
+	}
+	if err := s.wal.failed(); err != nil {
+		return status.Errorf(codes.Unavailable, "the write-ahead log failed and the node must be restarted: %v", err)
+	}
+	return nil
+}
+
+// servedService reports whether method belongs to a service that reads or
+// writes the store, which checkServing guards
+func servedService(method string) bool {
+	return strings.HasPrefix(method, "/kvstore.KVStore/") || strings.HasPrefix(method, "/kvstore.KVReplication/")
+}
+
+// failStopUnary refuses store RPCs once the WAL has failed
+func (s *kvServer) failStopUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if servedService(info.FullMethod) {
+		if err := s.checkServing(); err != nil {
+			return nil, err
+		}
+	}
+	return handler(ctx, req)
+}
+
+// failStopStream refuses streaming store RPCs once the WAL has failed
+func (s *kvServer) failStopStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if servedService(info.FullMethod) {
+		if err := s.checkServing(); err != nil {
+			return err
+		}
+	}
+	return handler(srv, ss)
+}
+
+// mutate evaluates a write against the current state of the store and
+// commits the record that eval returns, if any. It returns the revision at
+// which the write is visible. eval must not modify the server; it may run more
+// than once in cluster mode, where the record is committed through Raft.
+func (s *kvServer) mutate(ctx context.Context, eval func(v *txnView) (*walRecord, error)) (uint64, error) {
+	if s.raft != nil {
+		return s.mutateRaft(ctx, eval)
+	}
+
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	view := s.newView()
+	rec, err := eval(view)
+	if err == nil {
+		err = view.err
+	}
+	if err != nil || rec == nil {
+		rev := s.rev
+		s.mu.Unlock()
+		return rev, err
+	}
+	if err := s.admit(rec); err != nil {
+		s.mu.Unlock()
+		return 0, err
+	}
+	if err := s.logMutation(rec); err != nil {
+		s.mu.Unlock()
+		return 0, err
+	}
+	for i := range rec.Ops {
+		rec.Ops[i].Seq = rec.Seq
+	}
+	s.apply(*rec)
+	s.evictLocked(rec)
+	s.mu.Unlock()
+
+	return rec.Seq, s.waitDurable(rec.Seq)
+}
 
-	s.store[req.Key] = req.Value
-	log.Printf("Set key=%s, value=%s", req.Key, req.Value)
+// shutdown stops the background loops and ends open watch streams so that a
+// graceful stop of the gRPC server doesn't wait on them
+func (s *kvServer) shutdown() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// Close stops the background loops, flushes and closes the WAL or Raft log,
+// if any, and closes the storage engine
+func (s *kvServer) Close() error {
+	s.shutdown()
+	s.loops.Wait()
+	var err error
+	if s.raft != nil {
+		err = s.raft.close()
+	} else if s.wal != nil {
+		err = s.wal.Close()
+	}
+	if cerr := s.engine.close(); err == nil {
+		err = cerr
+	}
+	if s.audit != nil {
+		if cerr := s.audit.close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Set stores a key-value pair in the map using a write lock
+func (s *kvServer) Set(ctx context.Context, req *pb.SetRequest) (resp *pb.SetResponse, err error) {
+	defer func() {
+		s.recordAudit(ctx, auditEvent{op: auditSet, namespace: req.Namespace, key: req.Key, sum: s.auditSum(req.Value, req.ValueBytes), version: resp.GetVersion(), err: err})
+	}()
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := checkTTL(req.TtlSeconds); err != nil {
+		return nil, err
+	}
+	n, key, err := s.namespaceKey(req.Namespace, req.Key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := s.requestValue(n, req.Value, req.ValueBytes, req.ContentType)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := s.mutateKey(ctx, key, func(v *txnView) (*walRecord, error) {
+		if err := s.checkNamespace(n); err != nil {
+			return nil, err
+		}
+		return &walRecord{Op: walOpSet, Key: key, Value: value, ExpiresAt: s.expiryFor(n.ttl(req.TtlSeconds)), ContentType: req.ContentType}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Set key=%s, bytes=%d", req.Key, len(value))
 
 	return &pb.SetResponse{
 		Success: true,
 		Message: fmt.Sprintf("Key '%s' set successfully", req.Key),
+		Version: version,
 	}, nil
 }
 
-// Get retrieves a value by key from the map using a read lock
+// Get retrieves a value by key from the map using a read lock. The value is
+// always returned in value_bytes, and in value too when it is valid UTF-8.
 func (s *kvServer) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	_, key, err := s.namespaceKey(req.Namespace, req.Key)
+	if err != nil {
+		return nil, err
+	}
+	s.rlockKey(key)
+	defer s.runlockKey(key)
 
-	value, found := s.store[req.Key]
+	e, found, err := s.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	found = found && !e.expired(s.now().UnixNano())
+	if found && s.budget != nil {
+		s.budget.touch(key)
+	}
 	log.Printf("Get key=%s, found=%v", req.Key, found)
 
 	if !found {
@@ -55,47 +731,246 @@ func (s *kvServer) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse
 	}
 
 	return &pb.GetResponse{
-		Found:   true,
-		Value:   value,
-		Message: "Key retrieved successfully",
+		Found:       true,
+		Value:       textValue(e.value),
+		Message:     "Key retrieved successfully",
+		Version:     e.version,
+		ValueBytes:  []byte(e.value),
+		ContentType: e.contentType,
 	}, nil
 }
 
-// Delete removes a key-value pair from the map using a write lock
-func (s *kvServer) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// Delete removes a key-value pair from the map using a write lock. If the
+// request carries an expected version, the delete only happens when the key is
+// at that version.
+func (s *kvServer) Delete(ctx context.Context, req *pb.DeleteRequest) (resp *pb.DeleteResponse, err error) {
+	var (
+		found   bool
+		version uint64
+	)
+	defer func() {
+		s.recordAudit(ctx, auditEvent{op: auditDelete, namespace: req.Namespace, key: req.Key, version: version, missing: !found, err: err})
+	}()
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	n, key, err := s.namespaceKey(req.Namespace, req.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err = s.mutateKey(ctx, key, func(v *txnView) (*walRecord, error) {
+		if err := s.checkNamespace(n); err != nil {
+			return nil, err
+		}
+		var e entry
+		e, found, _ = v.get(key)
+		if req.ExpectedVersion != 0 {
+			if err := checkVersion(req.Key, e, found, req.ExpectedVersion, false); err != nil {
+				return nil, err
+			}
+		}
+		if !found {
+			return nil, nil
+		}
+		return &walRecord{Op: walOpDelete, Key: key}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Delete key=%s, found=%v", req.Key, found)
 
-	_, found := s.store[req.Key]
 	if !found {
-		log.Printf("Delete key=%s, found=false", req.Key)
 		return &pb.DeleteResponse{
 			Success: false,
 			Message: fmt.Sprintf("Key '%s' not found", req.Key),
 		}, nil
 	}
-
-	delete(s.store, req.Key)
-	log.Printf("Delete key=%s, success=true", req.Key)
-
 	return &pb.DeleteResponse{
 		Success: true,
 		Message: fmt.Sprintf("Key '%s' deleted successfully", req.Key),
 	}, nil
 }
 
+// envOrDefault returns the value of the environment variable key, or def if it is unset
+func envOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
 func main() {
-	port := ":50051"
+	// Persistence settings
+	dataDir := envOrDefault("KV_DATA_DIR", "data")
+	policy, err := parseSyncPolicy(envOrDefault("KV_WAL_SYNC", "batch"))
+	if err != nil {
+		log.Fatalf("Invalid KV_WAL_SYNC: %v", err)
+	}
+	syncInterval, err := time.ParseDuration(envOrDefault("KV_WAL_SYNC_INTERVAL", "10ms"))
+	if err != nil {
+		log.Fatalf("Invalid KV_WAL_SYNC_INTERVAL: %v", err)
+	}
+
+	snapInterval, err := time.ParseDuration(envOrDefault("KV_SNAPSHOT_INTERVAL", "5m"))
+	if err != nil {
+		log.Fatalf("Invalid KV_SNAPSHOT_INTERVAL: %v", err)
+	}
+	snapRetain, err := strconv.Atoi(envOrDefault("KV_SNAPSHOT_RETAIN", strconv.Itoa(defaultSnapshotRetain)))
+	if err != nil || snapRetain < 1 {
+		log.Fatalf("Invalid KV_SNAPSHOT_RETAIN: must be a positive integer")
+	}
+
+	sweepInterval, err := time.ParseDuration(envOrDefault("KV_TTL_SWEEP_INTERVAL", "1s"))
+	if err != nil {
+		log.Fatalf("Invalid KV_TTL_SWEEP_INTERVAL: %v", err)
+	}
+
+	watchHistory, err := strconv.Atoi(envOrDefault("KV_WATCH_HISTORY", strconv.Itoa(defaultWatchHistory)))
+	if err != nil || watchHistory < 1 {
+		log.Fatalf("Invalid KV_WATCH_HISTORY: must be a positive integer")
+	}
+
+	// Replication settings; setting KV_REPLICA_OF makes this node a follower
+	replicaOf := os.Getenv("KV_REPLICA_OF")
+
+	// Cluster settings; setting KV_RAFT_ID enables cluster mode
+	raftPeers, err := parseRaftPeers(os.Getenv("KV_RAFT_PEERS"))
+	if err != nil {
+		log.Fatalf("Invalid KV_RAFT_PEERS: %v", err)
+	}
+	raftHeartbeat, err := time.ParseDuration(envOrDefault("KV_RAFT_HEARTBEAT", defaultRaftHeartbeat.String()))
+	if err != nil {
+		log.Fatalf("Invalid KV_RAFT_HEARTBEAT: %v", err)
+	}
+	raftElection, err := time.ParseDuration(envOrDefault("KV_RAFT_ELECTION_TIMEOUT", defaultRaftElectionTimeout.String()))
+	if err != nil {
+		log.Fatalf("Invalid KV_RAFT_ELECTION_TIMEOUT: %v", err)
+	}
+
+	engineName := envOrDefault("KV_STORAGE_ENGINE", engineMemory)
+	if !slices.Contains(engineNames, engineName) {
+		log.Fatalf("Invalid KV_STORAGE_ENGINE: want one of %s", strings.Join(engineNames, ", "))
+	}
+
+	lockStripes, err := strconv.Atoi(envOrDefault("KV_LOCK_STRIPES", strconv.Itoa(defaultLockStripes)))
+	if err != nil || lockStripes < 1 {
+		log.Fatalf("Invalid KV_LOCK_STRIPES: must be a positive integer")
+	}
+
+	memoryLimit, err := parseByteSize(envOrDefault("KV_MEMORY_LIMIT", "0"))
+	if err != nil {
+		log.Fatalf("Invalid KV_MEMORY_LIMIT: %v", err)
+	}
+	evictionPolicy := envOrDefault("KV_EVICTION_POLICY", evictNone)
+	if !slices.Contains(evictionPolicies, evictionPolicy) {
+		log.Fatalf("Invalid KV_EVICTION_POLICY: want one of %s", strings.Join(evictionPolicies, ", "))
+	}
+
+	maxObjectSize, err := parseByteSize(envOrDefault("KV_MAX_OBJECT_SIZE", "64MB"))
+	if err != nil || maxObjectSize < 1 || maxObjectSize > maxObjectSizeLimit {
+		log.Fatalf("Invalid KV_MAX_OBJECT_SIZE: must be a positive size of at most 64MB")
+	}
+
+	auditMaxSize, err := parseByteSize(envOrDefault("KV_AUDIT_MAX_SIZE", "100MB"))
+	if err != nil || auditMaxSize < 1 {
+		log.Fatalf("Invalid KV_AUDIT_MAX_SIZE: must be a positive size")
+	}
+	auditRetain, err := strconv.Atoi(envOrDefault("KV_AUDIT_RETAIN", "0"))
+	if err != nil || auditRetain < 0 {
+		log.Fatalf("Invalid KV_AUDIT_RETAIN: must be a non-negative integer")
+	}
+	var auditGateways []string
+	for _, name := range strings.Split(os.Getenv("KV_AUDIT_GATEWAYS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			auditGateways = append(auditGateways, name)
+		}
+	}
+
+	nodeID := os.Getenv("KV_NODE_ID")
+	if nodeID == "" {
+		if nodeID, err = os.Hostname(); err != nil {
+			log.Fatalf("KV_NODE_ID is not set and the hostname is unavailable: %v", err)
+		}
+	}
+
+	// KV_TLS_CERT, KV_TLS_KEY and KV_TLS_CA turn on mutual TLS for the gRPC
+	// port and for connections to other nodes
+	tlsFiles, err := mtls.FromEnv(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load TLS files: %v", err)
+	}
+
+	server, err := openKVServer(dataDir, serverOptions{
+		WAL: walOptions{
+			Sync:         policy,
+			SyncInterval: syncInterval,
+		},
+		Snapshot: snapshotOptions{
+			Interval: snapInterval,
+			Retain:   snapRetain,
+		},
+		SweepInterval: sweepInterval,
+		WatchHistory:  watchHistory,
+		Engine:        engineName,
+		LockStripes:   lockStripes,
+		Memory: memoryOptions{
+			Limit:  memoryLimit,
+			Policy: evictionPolicy,
+		},
+		MaxObjectSize: maxObjectSize,
+		TLS:           tlsFiles,
+		Audit: auditOptions{
+			Dir:      os.Getenv("KV_AUDIT_DIR"),
+			MaxSize:  auditMaxSize,
+			Retain:   auditRetain,
+			Gateways: auditGateways,
+		},
+		Encryption: encryptionOptions{KeyFile: os.Getenv("KV_MASTER_KEY_FILE")},
+		ReplicaOf:  replicaOf,
+		NodeID:     nodeID,
+		Raft: raftOptions{
+			ID:              os.Getenv("KV_RAFT_ID"),
+			Peers:           raftPeers,
+			Heartbeat:       raftHeartbeat,
+			ElectionTimeout: raftElection,
+		},
+	})
+	if err != nil {
+		log.Fatalf("Failed to open data dir: %v", err)
+	}
+
+	port := envOrDefault("KV_LISTEN_ADDR", ":50051")
 	lis, err := net.Listen("tcp", port)
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
-	grpcServer := grpc.NewServer()
-	pb.RegisterKVStoreServer(grpcServer, newKVServer())
+	grpcServer := grpc.NewServer(server.grpcServerOptions()...)
+	pb.RegisterKVStoreServer(grpcServer, server)
+	pb.RegisterKVReplicationServer(grpcServer, server)
+	pb.RegisterKVAdminServer(grpcServer, server)
+	pb.RegisterKVRaftServer(grpcServer, server)
 
+	// Drain in-flight RPCs and flush the WAL on shutdown
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		log.Printf("Shutting down")
+		server.shutdown()
+		grpcServer.GracefulStop()
+	}()
+
+	if tlsFiles != nil {
+		log.Printf("Requiring mutual TLS on %s", port)
+	}
 	log.Printf("KV Store gRPC server listening on %s", port)
 	if err := grpcServer.Serve(lis); err != nil {
 		log.Fatalf("Failed to serve: %v", err)
 	}
+	if err := server.Close(); err != nil {
+		log.Fatalf("Failed to close WAL: %v", err)
+	}
 }
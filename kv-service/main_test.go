@@ -8,7 +8,7 @@ import (
 )
 
 func TestSet(t *testing.T) {
-	server := newKVServer()
+	server := newTestServer(t)
 	ctx := context.Background()
 
 	req := &pb.SetRequest{Key: "key1", Value: "value1"}
@@ -23,20 +23,20 @@ func TestSet(t *testing.T) {
 
 	// Verify the value was stored
 	server.mu.RLock()
-	storedValue := server.store["key1"]
+	stored, _, _ := server.engine.get("key1")
 	server.mu.RUnlock()
 
-	if storedValue != "value1" {
-		t.Errorf("Stored value = %v, want %v", storedValue, "value1")
+	if stored.value != "value1" {
+		t.Errorf("Stored value = %v, want %v", stored.value, "value1")
 	}
 }
 
 func TestGet(t *testing.T) {
-	server := newKVServer()
+	server := newTestServer(t)
 	ctx := context.Background()
 
 	// Pre-populate data
-	server.store["existing"] = "value"
+	server.engine.put("existing", entry{value: "value"})
 
 	req := &pb.GetRequest{Key: "existing"}
 	resp, err := server.Get(ctx, req)
@@ -53,11 +53,11 @@ func TestGet(t *testing.T) {
 }
 
 func TestDelete(t *testing.T) {
-	server := newKVServer()
+	server := newTestServer(t)
 	ctx := context.Background()
 
 	// Pre-populate data
-	server.store["toDelete"] = "value"
+	server.engine.put("toDelete", entry{value: "value"})
 
 	req := &pb.DeleteRequest{Key: "toDelete"}
 	resp, err := server.Delete(ctx, req)
@@ -71,7 +71,7 @@ func TestDelete(t *testing.T) {
 
 	// Verify the key was deleted
 	server.mu.RLock()
-	_, exists := server.store["toDelete"]
+	_, exists, _ := server.engine.get("toDelete")
 	server.mu.RUnlock()
 
 	if exists {
@@ -80,7 +80,7 @@ func TestDelete(t *testing.T) {
 }
 
 func TestGetNonExistentKey(t *testing.T) {
-	server := newKVServer()
+	server := newTestServer(t)
 	ctx := context.Background()
 
 	req := &pb.GetRequest{Key: "nonexistent"}
@@ -95,7 +95,7 @@ func TestGetNonExistentKey(t *testing.T) {
 }
 
 func TestDeleteNonExistentKey(t *testing.T) {
-	server := newKVServer()
+	server := newTestServer(t)
 	ctx := context.Background()
 
 	req := &pb.DeleteRequest{Key: "nonexistent"}
@@ -110,7 +110,7 @@ func TestDeleteNonExistentKey(t *testing.T) {
 }
 
 func TestEmptyKey(t *testing.T) {
-	server := newKVServer()
+	server := newTestServer(t)
 	ctx := context.Background()
 
 	// Set with empty key
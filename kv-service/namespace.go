@@ -0,0 +1,526 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Keys of a named namespace are stored behind its prefix: a NUL byte, the
+// name and another NUL byte. Keys of the default namespace are stored as they
+// are and may not start with a NUL byte, so the two never collide. The
+// settings of a namespace are stored under metaKeyPrefix and its name, which
+// sorts before every namespaced key, so that the WAL, snapshots, engines and
+// replication persist and copy them like any other key.
+const (
+	defaultNamespace = "default"
+	metaKeyPrefix    = "\x00\x00"
+	// reservedEnd is the first stored key past the namespaced keys and
+	// settings
+	reservedEnd = "\x01"
+
+	maxNamespaceName = 63
+
+	// dropBatchSize bounds how many keys of a dropped namespace are deleted
+	// per record
+	dropBatchSize = 1000
+
+	// namespaceQuotaReason is the ErrorInfo reason attached to writes that
+	// would take a namespace over a quota, which is in its "quota" metadata
+	namespaceQuotaReason = "NAMESPACE_QUOTA_EXCEEDED"
+)
+
+// namespace is a keyspace with its own quotas and settings
+type namespace struct {
+	// name is "" for the default namespace
+	name     string
+	prefix   string
+	settings *pb.NamespaceSettings
+	// keys and bytes count what the namespace holds, including expired keys
+	// that have not been swept yet. They are guarded by the namespace
+	// table's lock and not counted for the default namespace.
+	keys  int64
+	bytes int64
+}
+
+// theDefaultNamespace holds the keys of requests that name no namespace. It
+// has no quotas and is never stored.
+var theDefaultNamespace = &namespace{settings: &pb.NamespaceSettings{}}
+
+// namespaceTable holds the named namespaces, rebuilt from their stored
+// settings and kept up to date as mutations are applied. It has its own lock
+// because striped writes apply mutations while holding only the server's read
+// lock.
+type namespaceTable struct {
+	mu     sync.Mutex
+	byName map[string]*namespace
+	// reserved counts the stored keys that aren't in the default namespace
+	reserved int64
+}
+
+func nsPrefix(name string) string {
+	if name == "" {
+		return ""
+	}
+	return "\x00" + name + "\x00"
+}
+
+func metaKey(name string) string {
+	return metaKeyPrefix + name
+}
+
+// key returns the stored key of key in the namespace
+func (n *namespace) key(key string) string {
+	return n.prefix + key
+}
+
+// userKey returns the key of the namespace that stored is stored under
+func (n *namespace) userKey(stored string) string {
+	return stored[len(n.prefix):]
+}
+
+// contains reports whether the stored key belongs to the namespace
+func (n *namespace) contains(stored string) bool {
+	if n.prefix == "" {
+		return stored >= reservedEnd
+	}
+	return strings.HasPrefix(stored, n.prefix)
+}
+
+// ttl returns the TTL a key written with ttlSeconds gets
+func (n *namespace) ttl(ttlSeconds int64) int64 {
+	if ttlSeconds == 0 {
+		return n.settings.DefaultTtlSeconds
+	}
+	return ttlSeconds
+}
+
+// label names the namespace in messages
+func (n *namespace) label() string {
+	if n.name == "" {
+		return defaultNamespace
+	}
+	return n.name
+}
+
+// splitStoredKey returns the namespace a stored key belongs to and whether it
+// holds the namespace's settings. ok is false for keys of the default
+// namespace.
+func splitStoredKey(stored string) (name string, meta, ok bool) {
+	if !strings.HasPrefix(stored, "\x00") {
+		return "", false, false
+	}
+	if strings.HasPrefix(stored, metaKeyPrefix) {
+		return stored[len(metaKeyPrefix):], true, true
+	}
+	rest := stored[1:]
+	if i := strings.IndexByte(rest, 0); i >= 0 {
+		return rest[:i], false, true
+	}
+	return "", false, true
+}
+
+func isMetaKey(stored string) bool {
+	return strings.HasPrefix(stored, metaKeyPrefix)
+}
+
+func checkNamespaceName(name string) error {
+	if name == "" || len(name) > maxNamespaceName {
+		return status.Errorf(codes.InvalidArgument, "namespace names are 1 to %d characters long", maxNamespaceName)
+	}
+	if name == defaultNamespace {
+		return status.Errorf(codes.InvalidArgument, "namespace '%s' is reserved", name)
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case i > 0 && (c == '-' || c == '_' || c == '.'):
+		default:
+			return status.Errorf(codes.InvalidArgument, "namespace names hold lowercase letters, digits, '-', '_' and '.', and start with a letter or digit")
+		}
+	}
+	return nil
+}
+
+// namespace returns the namespace called name, where "" and "default" name
+// the default namespace
+func (s *kvServer) namespace(name string) (*namespace, error) {
+	if name == "" || name == defaultNamespace {
+		return theDefaultNamespace, nil
+	}
+	t := &s.namespaces
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n, ok := t.byName[name]; ok {
+		return n, nil
+	}
+	return nil, status.Errorf(codes.NotFound, "namespace '%s' not found", name)
+}
+
+// namespaceKey returns the namespace called name and the stored key of key in
+// it
+func (s *kvServer) namespaceKey(name, key string) (*namespace, string, error) {
+	n, err := s.namespace(name)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := n.checkKey(key); err != nil {
+		return nil, "", err
+	}
+	return n, n.key(key), nil
+}
+
+// checkKey rejects keys of the default namespace that would be taken for the
+// stored keys of other namespaces
+func (n *namespace) checkKey(key string) error {
+	if n.prefix == "" && key < reservedEnd && key != "" {
+		return status.Errorf(codes.InvalidArgument, "keys of the default namespace cannot start with a NUL byte")
+	}
+	return nil
+}
+
+// checkNamespace fails with NOT_FOUND if n has been dropped since it was
+// looked up. Writes check it while evaluating, under the lock that keeps a
+// drop from running until they are applied.
+func (s *kvServer) checkNamespace(n *namespace) error {
+	if n.name == "" {
+		return nil
+	}
+	t := &s.namespaces
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.byName[n.name] != n {
+		return status.Errorf(codes.NotFound, "namespace '%s' not found", n.name)
+	}
+	return nil
+}
+
+// trackNamespace updates the namespace table for a set or delete about to be
+// applied: writing the settings of a namespace creates it, deleting them
+// drops it, and writing its keys changes its usage. Callers must hold the
+// lock of rec's key.
+func (s *kvServer) trackNamespace(rec walRecord) error {
+	name, meta, ok := splitStoredKey(rec.Key)
+	if !ok {
+		return nil
+	}
+	old, found, err := s.engine.get(rec.Key)
+	if err != nil {
+		return err
+	}
+	t := &s.namespaces
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case rec.Op == walOpSet && !found:
+		t.reserved++
+	case rec.Op == walOpDelete && found:
+		t.reserved--
+	}
+
+	if meta {
+		if rec.Op == walOpDelete {
+			delete(t.byName, name)
+			return nil
+		}
+		return t.define(name, rec.Value)
+	}
+	n, ok := t.byName[name]
+	if !ok {
+		// Left behind by a dropped namespace
+		return nil
+	}
+	if found {
+		n.keys--
+		n.bytes -= entrySize(n.userKey(rec.Key), old.value)
+	}
+	if rec.Op == walOpSet {
+		n.keys++
+		n.bytes += entrySize(n.userKey(rec.Key), rec.Value)
+	}
+	return nil
+}
+
+// define adds the namespace name with its encoded settings. Callers must hold
+// the table's lock.
+func (t *namespaceTable) define(name, encoded string) error {
+	settings := &pb.NamespaceSettings{}
+	if err := proto.Unmarshal([]byte(encoded), settings); err != nil {
+		return fmt.Errorf("decode settings of namespace %s: %w", name, err)
+	}
+	t.byName[name] = &namespace{name: name, prefix: nsPrefix(name), settings: settings}
+	return nil
+}
+
+// rebuildNamespaces reloads the namespace table from the settings and keys in
+// the engine. Callers must have exclusive access to the server.
+func (s *kvServer) rebuildNamespaces() error {
+	t := &s.namespaces
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.byName = make(map[string]*namespace)
+	t.reserved = 0
+	var derr error
+	err := s.engine.ascend("\x00", func(k string, e entry) bool {
+		if k >= reservedEnd {
+			return false
+		}
+		t.reserved++
+		name, meta, _ := splitStoredKey(k)
+		if meta {
+			derr = t.define(name, e.value)
+			return derr == nil
+		}
+		if n, ok := t.byName[name]; ok {
+			n.keys++
+			n.bytes += entrySize(n.userKey(k), e.value)
+		}
+		return true
+	})
+	if err == nil {
+		err = derr
+	}
+	return err
+}
+
+// checkQuotas fails with RESOURCE_EXHAUSTED and an ErrorInfo detail if the
+// writes of rec would take a namespace over its key or byte quota. Writes that
+// don't grow a namespace are always allowed. Callers must hold the locks of
+// the keys rec writes.
+func (s *kvServer) checkQuotas(rec *walRecord) error {
+	type growth struct{ keys, bytes int64 }
+	var grown map[*namespace]*growth
+	// written holds the size of each key after the ops so far, or -1 if it
+	// is absent
+	written := make(map[string]int64)
+	for _, op := range recordOps(rec) {
+		if op.Op != walOpSet && op.Op != walOpDelete {
+			continue
+		}
+		name, meta, ok := splitStoredKey(op.Key)
+		if !ok || meta {
+			continue
+		}
+		n, err := s.namespace(name)
+		if err != nil || (n.settings.MaxKeys == 0 && n.settings.MaxBytes == 0) {
+			continue
+		}
+		old, seen := written[op.Key]
+		if !seen {
+			e, found, err := s.lookup(op.Key)
+			if err != nil {
+				return err
+			}
+			old = -1
+			if found {
+				old = entrySize(n.userKey(op.Key), e.value)
+			}
+		}
+		size := int64(-1)
+		if op.Op == walOpSet {
+			size = entrySize(n.userKey(op.Key), op.Value)
+		}
+		written[op.Key] = size
+
+		if grown == nil {
+			grown = make(map[*namespace]*growth)
+		}
+		g := grown[n]
+		if g == nil {
+			g = &growth{}
+			grown[n] = g
+		}
+		switch {
+		case old < 0 && size >= 0:
+			g.keys++
+		case old >= 0 && size < 0:
+			g.keys--
+		}
+		g.bytes += max(size, 0) - max(old, 0)
+	}
+
+	t := &s.namespaces
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for n, g := range grown {
+		if limit := n.settings.MaxKeys; g.keys > 0 && limit > 0 && n.keys+g.keys > limit {
+			return quotaError(n, "keys", limit, fmt.Sprintf("namespace '%s' is limited to %d keys", n.name, limit))
+		}
+		if limit := n.settings.MaxBytes; g.bytes > 0 && limit > 0 && n.bytes+g.bytes > limit {
+			return quotaError(n, "bytes", limit, fmt.Sprintf("namespace '%s' is limited to %d bytes (%d in use)", n.name, limit, n.bytes))
+		}
+	}
+	return nil
+}
+
+func quotaError(n *namespace, quota string, limit int64, msg string) error {
+	st := status.New(codes.ResourceExhausted, msg)
+	if detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: namespaceQuotaReason,
+		Domain: "kvstore",
+		Metadata: map[string]string{
+			"namespace": n.name,
+			"quota":     quota,
+			"limit":     strconv.FormatInt(limit, 10),
+		},
+	}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// CreateNamespace adds a namespace. Its settings are written as a key of
+// their own, so they are logged, replicated and recovered like any other
+// write.
+func (s *kvServer) CreateNamespace(ctx context.Context, req *pb.CreateNamespaceRequest) (*pb.Namespace, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := checkNamespaceName(req.Name); err != nil {
+		return nil, err
+	}
+	settings := req.Settings
+	if settings == nil {
+		settings = &pb.NamespaceSettings{}
+	}
+	if settings.MaxKeys < 0 || settings.MaxBytes < 0 || settings.DefaultTtlSeconds < 0 || settings.MaxValueSize < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "namespace settings must not be negative")
+	}
+	if err := checkTTL(settings.DefaultTtlSeconds); err != nil {
+		return nil, err
+	}
+	encoded, err := proto.Marshal(settings)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to encode settings: %v", err)
+	}
+
+	prefix := nsPrefix(req.Name)
+	_, err = s.mutate(ctx, func(v *txnView) (*walRecord, error) {
+		if _, found, _ := v.get(metaKey(req.Name)); found {
+			return nil, status.Errorf(codes.AlreadyExists, "namespace '%s' already exists", req.Name)
+		}
+		// Keys of an earlier namespace of the same name that a drop has not
+		// deleted yet, or that raced it in cluster mode, must not reappear
+		rec := walRecord{Op: walOpTxn}
+		err := s.engine.ascend(prefix, func(k string, e entry) bool {
+			if !strings.HasPrefix(k, prefix) {
+				return false
+			}
+			rec.Ops = append(rec.Ops, walRecord{Op: walOpDelete, Key: k})
+			return true
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to scan keys: %v", err)
+		}
+		rec.Ops = append(rec.Ops, walRecord{Op: walOpSet, Key: metaKey(req.Name), Value: string(encoded)})
+		return &rec, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("CreateNamespace name=%s", req.Name)
+
+	return &pb.Namespace{Name: req.Name, Settings: settings}, nil
+}
+
+// ListNamespaces reports every namespace, the default one first, with its
+// settings and usage
+func (s *kvServer) ListNamespaces(ctx context.Context, req *pb.ListNamespacesRequest) (*pb.ListNamespacesResponse, error) {
+	s.rlockAll()
+	total := int64(s.engine.len())
+	t := &s.namespaces
+	t.mu.Lock()
+	resp := &pb.ListNamespacesResponse{}
+	resp.Namespaces = append(resp.Namespaces, &pb.Namespace{
+		Name:     defaultNamespace,
+		Settings: theDefaultNamespace.settings,
+		Keys:     uint64(total - t.reserved),
+	})
+	for _, n := range t.byName {
+		resp.Namespaces = append(resp.Namespaces, &pb.Namespace{
+			Name:     n.name,
+			Settings: n.settings,
+			Keys:     uint64(n.keys),
+			Bytes:    n.bytes,
+		})
+	}
+	t.mu.Unlock()
+	s.runlockAll()
+
+	sort.Slice(resp.Namespaces[1:], func(i, j int) bool {
+		return resp.Namespaces[1+i].Name < resp.Namespaces[1+j].Name
+	})
+	return resp, nil
+}
+
+// DropNamespace deletes a namespace and its keys. The settings go first, in a
+// record of their own, so the namespace disappears at once; its keys are then
+// deleted in batches. Keys a crash leaves behind are unreachable, and are
+// deleted if the namespace is created again.
+func (s *kvServer) DropNamespace(ctx context.Context, req *pb.DropNamespaceRequest) (*pb.DropNamespaceResponse, error) {
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	if req.Name == "" || req.Name == defaultNamespace {
+		return nil, status.Errorf(codes.InvalidArgument, "the default namespace cannot be dropped")
+	}
+
+	_, err := s.mutate(ctx, func(v *txnView) (*walRecord, error) {
+		if _, found, _ := v.get(metaKey(req.Name)); !found {
+			return nil, status.Errorf(codes.NotFound, "namespace '%s' not found", req.Name)
+		}
+		return &walRecord{Op: walOpDelete, Key: metaKey(req.Name)}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := nsPrefix(req.Name)
+	var deleted uint64
+	for {
+		var n int
+		_, err := s.mutate(ctx, func(v *txnView) (*walRecord, error) {
+			n = 0
+			if _, found, _ := v.get(metaKey(req.Name)); found {
+				// Created again, which deleted what was left
+				return nil, nil
+			}
+			rec := walRecord{Op: walOpTxn}
+			err := s.engine.ascend(prefix, func(k string, e entry) bool {
+				if !strings.HasPrefix(k, prefix) {
+					return false
+				}
+				rec.Ops = append(rec.Ops, walRecord{Op: walOpDelete, Key: k})
+				return len(rec.Ops) < dropBatchSize
+			})
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to scan keys: %v", err)
+			}
+			n = len(rec.Ops)
+			if n == 0 {
+				return nil, nil
+			}
+			return &rec, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		deleted += uint64(n)
+		if n < dropBatchSize {
+			break
+		}
+	}
+	log.Printf("DropNamespace name=%s, keys=%d", req.Name, deleted)
+
+	return &pb.DropNamespaceResponse{KeysDeleted: deleted}, nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func createNamespace(t *testing.T, server *kvServer, name string, settings *pb.NamespaceSettings) {
+	t.Helper()
+	if _, err := server.CreateNamespace(context.Background(), &pb.CreateNamespaceRequest{Name: name, Settings: settings}); err != nil {
+		t.Fatalf("CreateNamespace(%s) error = %v", name, err)
+	}
+}
+
+// errorReason returns the reason of the ErrorInfo detail of err, if any
+func errorReason(err error) string {
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			return info.Reason
+		}
+	}
+	return ""
+}
+
+func TestNamespacesIsolateKeys(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+	createNamespace(t, server, "a", nil)
+	createNamespace(t, server, "b", nil)
+
+	for _, ns := range []string{"", "a", "b"} {
+		if _, err := server.Set(ctx, &pb.SetRequest{Namespace: ns, Key: "k", Value: "in " + ns}); err != nil {
+			t.Fatalf("Set(%s/k) error = %v", ns, err)
+		}
+	}
+	server.Set(ctx, &pb.SetRequest{Namespace: "a", Key: "only-a", Value: "x"})
+
+	for _, ns := range []string{"", "default", "a", "b"} {
+		want := "in " + ns
+		if ns == "default" {
+			want = "in "
+		}
+		resp, err := server.Get(ctx, &pb.GetRequest{Namespace: ns, Key: "k"})
+		if err != nil || resp.Value != want {
+			t.Errorf("Get(%s/k) = %v, %v, want %q", ns, resp, err, want)
+		}
+	}
+	if resp, _ := server.Get(ctx, &pb.GetRequest{Namespace: "b", Key: "only-a"}); resp.Found {
+		t.Errorf("Get(b/only-a) found a key of namespace a")
+	}
+
+	for ns, want := range map[string][]string{"": {"k"}, "a": {"k", "only-a"}, "b": {"k"}} {
+		scan := &fakeScanStream{ctx: ctx}
+		if err := server.Scan(&pb.ScanRequest{Namespace: ns}, scan); err != nil {
+			t.Fatalf("Scan(%s) error = %v", ns, err)
+		}
+		var keys []string
+		for _, resp := range scan.sent {
+			keys = append(keys, resp.Key)
+		}
+		if strings.Join(keys, ",") != strings.Join(want, ",") {
+			t.Errorf("Scan(%s) keys = %v, want %v", ns, keys, want)
+		}
+	}
+
+	batch, err := server.BatchGet(ctx, &pb.BatchGetRequest{Namespace: "a", Keys: []string{"k", "only-a"}})
+	if err != nil || !batch.Results[0].Success || batch.Results[0].Value != "in a" || !batch.Results[1].Success {
+		t.Errorf("BatchGet(a) = %v, %v, want both keys of namespace a", batch, err)
+	}
+
+	txn, err := server.Txn(ctx, &pb.TxnRequest{
+		Namespace: "b",
+		Compare:   []*pb.Compare{{Key: "k", Target: pb.Compare_VALUE, Result: pb.Compare_EQUAL, Value: "in b"}},
+		Success:   []*pb.TxnOp{{Type: pb.TxnOp_PUT, Key: "k", Value: "txn"}},
+	})
+	if err != nil || !txn.Succeeded {
+		t.Fatalf("Txn(b) = %v, %v, want it to compare against namespace b", txn, err)
+	}
+	if resp, _ := server.Get(ctx, &pb.GetRequest{Namespace: "a", Key: "k"}); resp.Value != "in a" {
+		t.Errorf("Get(a/k) = %q after a txn in b, want %q", resp.Value, "in a")
+	}
+
+	if _, err := server.Delete(ctx, &pb.DeleteRequest{Namespace: "a", Key: "k"}); err != nil {
+		t.Fatalf("Delete(a/k) error = %v", err)
+	}
+	if resp, _ := server.Get(ctx, &pb.GetRequest{Key: "k"}); !resp.Found {
+		t.Errorf("Delete(a/k) deleted the key of the default namespace")
+	}
+}
+
+func TestNamespaceValidation(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+	createNamespace(t, server, "team-1", nil)
+
+	if _, err := server.Set(ctx, &pb.SetRequest{Namespace: "missing", Key: "k", Value: "v"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Set() in a missing namespace error = %v, want NotFound", err)
+	}
+	if _, err := server.Get(ctx, &pb.GetRequest{Namespace: "missing", Key: "k"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Get() in a missing namespace error = %v, want NotFound", err)
+	}
+	for _, name := range []string{"", "default", "Upper", "-dash", "a/b", "a\x00b", strings.Repeat("x", maxNamespaceName+1)} {
+		if _, err := server.CreateNamespace(ctx, &pb.CreateNamespaceRequest{Name: name}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("CreateNamespace(%q) error = %v, want InvalidArgument", name, err)
+		}
+	}
+	if _, err := server.CreateNamespace(ctx, &pb.CreateNamespaceRequest{Name: "neg", Settings: &pb.NamespaceSettings{MaxKeys: -1}}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateNamespace() with negative settings error = %v, want InvalidArgument", err)
+	}
+	if _, err := server.CreateNamespace(ctx, &pb.CreateNamespaceRequest{Name: "team-1"}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("CreateNamespace() of an existing namespace error = %v, want AlreadyExists", err)
+	}
+	if _, err := server.Set(ctx, &pb.SetRequest{Key: "\x00team-1\x00k", Value: "v"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Set() of a default key starting with NUL error = %v, want InvalidArgument", err)
+	}
+	if _, err := server.DropNamespace(ctx, &pb.DropNamespaceRequest{Name: defaultNamespace}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("DropNamespace(default) error = %v, want InvalidArgument", err)
+	}
+	if _, err := server.DropNamespace(ctx, &pb.DropNamespaceRequest{Name: "missing"}); status.Code(err) != codes.NotFound {
+		t.Errorf("DropNamespace(missing) error = %v, want NotFound", err)
+	}
+}
+
+func TestNamespaceQuotas(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+	createNamespace(t, server, "keys", &pb.NamespaceSettings{MaxKeys: 2})
+	createNamespace(t, server, "bytes", &pb.NamespaceSettings{MaxBytes: 20})
+	createNamespace(t, server, "values", &pb.NamespaceSettings{MaxValueSize: 4})
+	createNamespace(t, server, "ttl", &pb.NamespaceSettings{DefaultTtlSeconds: 60})
+
+	server.Set(ctx, &pb.SetRequest{Namespace: "keys", Key: "a", Value: "1"})
+	server.Set(ctx, &pb.SetRequest{Namespace: "keys", Key: "b", Value: "2"})
+	_, err := server.Set(ctx, &pb.SetRequest{Namespace: "keys", Key: "c", Value: "3"})
+	if status.Code(err) != codes.ResourceExhausted || errorReason(err) != namespaceQuotaReason {
+		t.Errorf("Set() of a third key error = %v, want ResourceExhausted with reason %s", err, namespaceQuotaReason)
+	}
+	if _, err := server.Set(ctx, &pb.SetRequest{Namespace: "keys", Key: "a", Value: "overwrite"}); err != nil {
+		t.Errorf("Set() overwriting a key at the quota error = %v", err)
+	}
+	_, err = server.BatchSet(ctx, &pb.BatchSetRequest{Namespace: "keys", Items: []*pb.SetRequest{{Key: "c", Value: "3"}}})
+	if errorReason(err) != namespaceQuotaReason {
+		t.Errorf("BatchSet() of a third key error = %v, want reason %s", err, namespaceQuotaReason)
+	}
+	server.Delete(ctx, &pb.DeleteRequest{Namespace: "keys", Key: "b"})
+	if _, err := server.Set(ctx, &pb.SetRequest{Namespace: "keys", Key: "c", Value: "3"}); err != nil {
+		t.Errorf("Set() after a delete freed a key error = %v", err)
+	}
+	// A txn that deletes as many keys as it adds stays within the quota
+	_, err = server.Txn(ctx, &pb.TxnRequest{Namespace: "keys", Success: []*pb.TxnOp{
+		{Type: pb.TxnOp_DELETE, Key: "a"},
+		{Type: pb.TxnOp_PUT, Key: "d", Value: "4"},
+	}})
+	if err != nil {
+		t.Errorf("Txn() swapping a key error = %v", err)
+	}
+
+	// The default namespace has no quota
+	for i := 0; i < 5; i++ {
+		if _, err := server.Set(ctx, &pb.SetRequest{Key: fmt.Sprintf("k%d", i), Value: "v"}); err != nil {
+			t.Fatalf("Set() in the default namespace error = %v", err)
+		}
+	}
+
+	if _, err := server.Set(ctx, &pb.SetRequest{Namespace: "bytes", Key: "a", Value: strings.Repeat("x", 10)}); err != nil {
+		t.Fatalf("Set() within the byte quota error = %v", err)
+	}
+	_, err = server.Set(ctx, &pb.SetRequest{Namespace: "bytes", Key: "b", Value: strings.Repeat("x", 10)})
+	if errorReason(err) != namespaceQuotaReason {
+		t.Errorf("Set() over the byte quota error = %v, want reason %s", err, namespaceQuotaReason)
+	}
+
+	_, err = server.Set(ctx, &pb.SetRequest{Namespace: "values", Key: "a", Value: "12345"})
+	if status.Code(err) != codes.ResourceExhausted || errorReason(err) != objectTooLargeReason {
+		t.Errorf("Set() over the value size error = %v, want reason %s", err, objectTooLargeReason)
+	}
+	if _, err := server.Set(ctx, &pb.SetRequest{Namespace: "values", Key: "a", Value: "1234"}); err != nil {
+		t.Errorf("Set() at the value size error = %v", err)
+	}
+
+	server.Set(ctx, &pb.SetRequest{Namespace: "ttl", Key: "a", Value: "v"})
+	ttl, err := server.GetTTL(ctx, &pb.GetTTLRequest{Namespace: "ttl", Key: "a"})
+	if err != nil || ttl.TtlSeconds <= 0 || ttl.TtlSeconds > 60 {
+		t.Errorf("GetTTL() = %v, %v, want the namespace's default TTL", ttl, err)
+	}
+	server.Set(ctx, &pb.SetRequest{Namespace: "ttl", Key: "b", Value: "v", TtlSeconds: 600})
+	if ttl, _ := server.GetTTL(ctx, &pb.GetTTLRequest{Namespace: "ttl", Key: "b"}); ttl.TtlSeconds <= 60 {
+		t.Errorf("GetTTL() = %d, want an explicit TTL to win over the default", ttl.TtlSeconds)
+	}
+}
+
+func TestDropNamespace(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+	createNamespace(t, server, "tmp", &pb.NamespaceSettings{MaxKeys: 5000})
+	server.Set(ctx, &pb.SetRequest{Key: "keep", Value: "v"})
+
+	// More keys than one delete batch holds
+	const count = dropBatchSize + 10
+	for i := 0; i < count; i += maxBatchSize {
+		var items []*pb.SetRequest
+		for j := i; j < min(i+maxBatchSize, count); j++ {
+			items = append(items, &pb.SetRequest{Key: fmt.Sprintf("k%04d", j), Value: "v"})
+		}
+		if _, err := server.BatchSet(ctx, &pb.BatchSetRequest{Namespace: "tmp", Items: items}); err != nil {
+			t.Fatalf("BatchSet() error = %v", err)
+		}
+	}
+
+	list, err := server.ListNamespaces(ctx, &pb.ListNamespacesRequest{})
+	if err != nil {
+		t.Fatalf("ListNamespaces() error = %v", err)
+	}
+	if len(list.Namespaces) != 2 || list.Namespaces[0].Name != defaultNamespace || list.Namespaces[0].Keys != 1 {
+		t.Fatalf("ListNamespaces() = %v, want the default namespace with 1 key and tmp", list.Namespaces)
+	}
+	if tmp := list.Namespaces[1]; tmp.Name != "tmp" || tmp.Keys != count || tmp.Bytes <= 0 || tmp.Settings.MaxKeys != 5000 {
+		t.Errorf("ListNamespaces() tmp = %v, want %d keys with its settings", tmp, count)
+	}
+
+	resp, err := server.DropNamespace(ctx, &pb.DropNamespaceRequest{Name: "tmp"})
+	if err != nil || resp.KeysDeleted != count {
+		t.Fatalf("DropNamespace() = %v, %v, want %d keys deleted", resp, err, count)
+	}
+	if _, err := server.Get(ctx, &pb.GetRequest{Namespace: "tmp", Key: "k0000"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Get() in a dropped namespace error = %v, want NotFound", err)
+	}
+	if resp, _ := server.Get(ctx, &pb.GetRequest{Key: "keep"}); !resp.Found {
+		t.Errorf("DropNamespace() deleted a key of the default namespace")
+	}
+
+	createNamespace(t, server, "tmp", nil)
+	scan := &fakeScanStream{ctx: ctx}
+	server.Scan(&pb.ScanRequest{Namespace: "tmp"}, scan)
+	if len(scan.sent) != 0 {
+		t.Errorf("Scan() of a re-created namespace = %d keys, want none", len(scan.sent))
+	}
+	list, _ = server.ListNamespaces(ctx, &pb.ListNamespacesRequest{})
+	if tmp := list.Namespaces[1]; tmp.Keys != 0 || tmp.Bytes != 0 || tmp.Settings.MaxKeys != 0 {
+		t.Errorf("ListNamespaces() re-created tmp = %v, want it empty with fresh settings", tmp)
+	}
+}
+
+func TestNamespacesSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	opts := serverOptions{WAL: walOptions{Sync: syncAlways}}
+
+	server, err := openKVServer(dir, opts)
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	createNamespace(t, server, "snap", &pb.NamespaceSettings{MaxKeys: 2})
+	server.Set(ctx, &pb.SetRequest{Namespace: "snap", Key: "a", Value: "v"})
+	if err := server.snapshot(); err != nil {
+		t.Fatalf("snapshot() error = %v", err)
+	}
+	server.Set(ctx, &pb.SetRequest{Namespace: "snap", Key: "b", Value: "v"})
+	createNamespace(t, server, "wal", nil)
+	server.Set(ctx, &pb.SetRequest{Namespace: "wal", Key: "a", Value: "v"})
+	createNamespace(t, server, "gone", nil)
+	server.Set(ctx, &pb.SetRequest{Namespace: "gone", Key: "a", Value: "v"})
+	server.DropNamespace(ctx, &pb.DropNamespaceRequest{Name: "gone"})
+	server.Close()
+
+	server, err = openKVServer(dir, opts)
+	if err != nil {
+		t.Fatalf("openKVServer() after restart error = %v", err)
+	}
+	defer server.Close()
+	list, _ := server.ListNamespaces(ctx, &pb.ListNamespacesRequest{})
+	var names []string
+	for _, n := range list.Namespaces {
+		names = append(names, fmt.Sprintf("%s:%d", n.Name, n.Keys))
+	}
+	if got := strings.Join(names, ","); got != "default:0,snap:2,wal:1" {
+		t.Errorf("ListNamespaces() after restart = %s, want default:0,snap:2,wal:1", got)
+	}
+	_, err = server.Set(ctx, &pb.SetRequest{Namespace: "snap", Key: "c", Value: "v"})
+	if errorReason(err) != namespaceQuotaReason {
+		t.Errorf("Set() over a quota after restart error = %v, want reason %s", err, namespaceQuotaReason)
+	}
+}
+
+func TestReplicationOfNamespaces(t *testing.T) {
+	ctx := context.Background()
+	primary, addr := startNode(t, t.TempDir(), serverOptions{})
+	createNamespace(t, primary, "before", nil)
+	primary.Set(ctx, &pb.SetRequest{Namespace: "before", Key: "k", Value: "v"})
+
+	follower, _ := startNode(t, t.TempDir(), followerOptions(addr, "follower"))
+	createNamespace(t, primary, "after", &pb.NamespaceSettings{MaxKeys: 1})
+	last, _ := primary.Set(ctx, &pb.SetRequest{Namespace: "after", Key: "k", Value: "v"})
+	waitFor(t, "follower to catch up", func() bool {
+		resp, err := follower.Get(ctx, &pb.GetRequest{Namespace: "after", Key: "k"})
+		return err == nil && resp.Version == last.Version
+	})
+	if resp, err := follower.Get(ctx, &pb.GetRequest{Namespace: "before", Key: "k"}); err != nil || !resp.Found {
+		t.Errorf("follower Get(before/k) = %v, %v, want the key from the snapshot", resp, err)
+	}
+	list, _ := follower.ListNamespaces(ctx, &pb.ListNamespacesRequest{})
+	if len(list.Namespaces) != 3 || list.Namespaces[1].Name != "after" || list.Namespaces[1].Settings.MaxKeys != 1 {
+		t.Errorf("follower ListNamespaces() = %v, want both namespaces with their settings", list.Namespaces)
+	}
+}
+
+func TestWatchNamespace(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+	createNamespace(t, server, "app", nil)
+
+	nsEvents, _ := startWatch(t, server, &pb.WatchRequest{Namespace: "app", Key: "", Prefix: true, StartRevision: 1})
+	defaultEvents, _ := startWatch(t, server, &pb.WatchRequest{Key: "", Prefix: true, StartRevision: 1})
+
+	server.Set(ctx, &pb.SetRequest{Namespace: "app", Key: "cfg", Value: "ns"})
+	server.Set(ctx, &pb.SetRequest{Key: "cfg", Value: "default"})
+
+	event := nextEvent(t, nsEvents)
+	if event.Key != "cfg" || event.Value != "ns" {
+		t.Errorf("namespace watch event = %v, want cfg=ns with the namespace stripped", event)
+	}
+	event = nextEvent(t, defaultEvents)
+	if event.Key != "cfg" || event.Value != "default" {
+		t.Errorf("default watch event = %v, want only the default namespace's cfg=default", event)
+	}
+}
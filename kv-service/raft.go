@@ -0,0 +1,1301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultRaftHeartbeat       = 50 * time.Millisecond
+	defaultRaftElectionTimeout = 500 * time.Millisecond
+
+	// raftMaxAppend bounds the number of entries per AppendEntries call, and
+	// raftMaxAppendBytes their size, though a call always carries at least
+	// one entry
+	raftMaxAppend      = 256
+	raftMaxAppendBytes = 1 << 20
+	// raftRPCTimeout bounds votes and appends; raftSnapshotTimeout bounds
+	// sending a whole snapshot
+	raftRPCTimeout      = time.Second
+	raftSnapshotTimeout = time.Minute
+	// raftCommitTimeout is how long a write waits for a quorum
+	raftCommitTimeout = 5 * time.Second
+	// raftConflictRetries bounds how often a write is evaluated again after
+	// concurrent writes invalidated what it read
+	raftConflictRetries = 16
+)
+
+// raftOptions configures cluster mode
+type raftOptions struct {
+	// ID identifies this node in the cluster; setting it enables cluster mode
+	ID string
+	// Peers is the initial membership by node ID, including this node. It is
+	// only used when the node has no saved state, and is empty for a node
+	// that joins an existing cluster through AddMember.
+	Peers map[string]string
+	// Heartbeat is how often the leader contacts idle followers
+	Heartbeat time.Duration
+	// ElectionTimeout is the minimum time without a leader before a follower
+	// starts an election; the actual timeout is randomized up to twice this
+	ElectionTimeout time.Duration
+}
+
+// parseRaftPeers parses a comma separated list of id=address pairs
+func parseRaftPeers(s string) (map[string]string, error) {
+	peers := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, addr, ok := strings.Cut(pair, "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("invalid peer %q, want id=address", pair)
+		}
+		if _, dup := peers[id]; dup {
+			return nil, fmt.Errorf("duplicate peer id %q", id)
+		}
+		peers[id] = addr
+	}
+	return peers, nil
+}
+
+type raftRole int
+
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+func (r raftRole) String() string {
+	switch r {
+	case raftCandidate:
+		return "candidate"
+	case raftLeader:
+		return "leader"
+	}
+	return "follower"
+}
+
+// raftNode runs the Raft protocol for a kvServer in cluster mode. Committed
+// NORMAL entries are applied to the store at their log index, so a Raft index
+// is also the revision of the write it carries; other entries take up a
+// revision without changing anything.
+type raftNode struct {
+	s    *kvServer
+	id   string
+	opts raftOptions
+	// ctx is canceled on shutdown and bounds outgoing RPCs
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	role     raftRole
+	term     uint64
+	votedFor string
+	leaderID string
+	// members is the latest applied membership, by node ID
+	members     map[string]string
+	log         *raftLog
+	commitIndex uint64
+	lastApplied uint64
+	// committed is signaled when commitIndex advances or the node stops
+	committed *sync.Cond
+	// applied is closed and replaced whenever lastApplied advances
+	applied chan struct{}
+	stopped bool
+
+	electionDeadline time.Time
+	// lastContact is when a leader was last heard from
+	lastContact time.Time
+	// pendingConfig is the index of a membership change that has been
+	// appended but not applied, or 0
+	pendingConfig uint64
+	// peers tracks replication to the other members while leader
+	peers   map[string]*raftPeer
+	waiters map[uint64]*raftProposal
+	conns   map[string]*grpc.ClientConn
+
+	// applyMu serializes applying committed entries with installing snapshots
+	applyMu sync.Mutex
+}
+
+// raftPeer is the leader's replication state for one follower
+type raftPeer struct {
+	id      string
+	addr    string
+	next    uint64
+	match   uint64
+	lastAck time.Time
+	notify  chan struct{}
+	stop    chan struct{}
+}
+
+// raftProposal is a write waiting for the entry it appended to be applied
+type raftProposal struct {
+	term uint64
+	done chan raftResult
+}
+
+type raftResult struct {
+	// applied reports whether the reads of a NORMAL entry still held
+	applied bool
+	err     error
+}
+
+// openRaft starts cluster mode on a server whose store reflects the log up to
+// applied. The Raft log and state live next to the snapshots in the data dir.
+func (s *kvServer) openRaft(opts raftOptions, applied uint64) error {
+	if opts.Heartbeat <= 0 {
+		opts.Heartbeat = defaultRaftHeartbeat
+	}
+	if opts.ElectionTimeout <= 0 {
+		opts.ElectionTimeout = defaultRaftElectionTimeout
+	}
+
+	l, err := openRaftLog(s.dir, s.keys)
+	if err != nil {
+		return err
+	}
+	hs, err := loadRaftState(s.dir)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	members := hs.members
+	if len(members) == 0 {
+		members = maps.Clone(opts.Peers)
+	}
+	if members == nil {
+		members = make(map[string]string)
+	}
+
+	if applied < l.snapIndex || applied > l.lastIndex() {
+		// The log does not continue from the snapshot, which happens when
+		// the newest snapshot is unreadable or a crash interrupted
+		// installing one from the leader. The leader fills in the log.
+		log.Printf("Raft log covers (%d, %d] but the store is at %d; discarding the log", l.snapIndex, l.lastIndex(), applied)
+		if err := l.restore(applied, 0); err != nil {
+			l.Close()
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &raftNode{
+		s:           s,
+		id:          opts.ID,
+		opts:        opts,
+		ctx:         ctx,
+		cancel:      cancel,
+		term:        hs.term,
+		votedFor:    hs.votedFor,
+		members:     members,
+		log:         l,
+		commitIndex: applied,
+		lastApplied: applied,
+		applied:     make(chan struct{}),
+		waiters:     make(map[uint64]*raftProposal),
+		conns:       make(map[string]*grpc.ClientConn),
+	}
+	r.committed = sync.NewCond(&r.mu)
+	r.resetElectionTimer()
+	s.raft = r
+	log.Printf("Raft node %s at term %d with log (%d, %d] and members %v", r.id, r.term, l.snapIndex, l.lastIndex(), members)
+
+	s.loops.Add(3)
+	go r.tickLoop()
+	go r.applyLoop()
+	go func() {
+		defer s.loops.Done()
+		<-s.stop
+		r.cancel()
+		r.mu.Lock()
+		r.stopped = true
+		r.stopPeersLocked()
+		r.committed.Broadcast()
+		r.mu.Unlock()
+	}()
+	return nil
+}
+
+// close releases the log and connections once the loops have stopped
+func (r *raftNode) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+	return r.log.Close()
+}
+
+func (r *raftNode) persistLocked() error {
+	return saveRaftState(r.s.dir, raftHardState{term: r.term, votedFor: r.votedFor, members: r.members})
+}
+
+func (r *raftNode) quorum() int {
+	return len(r.members)/2 + 1
+}
+
+func (r *raftNode) resetElectionTimer() {
+	r.electionDeadline = time.Now().Add(r.opts.ElectionTimeout + rand.N(r.opts.ElectionTimeout))
+}
+
+// clientLocked returns a client for the node at addr, reusing connections
+func (r *raftNode) clientLocked(addr string) (pb.KVRaftClient, error) {
+	conn, ok := r.conns[addr]
+	if !ok {
+		var err error
+		if conn, err = grpc.NewClient(addr, r.s.peerDialOptions()...); err != nil {
+			return nil, err
+		}
+		r.conns[addr] = conn
+	}
+	return pb.NewKVRaftClient(conn), nil
+}
+
+func (r *raftNode) tickLoop() {
+	defer r.s.loops.Done()
+	ticker := time.NewTicker(r.opts.Heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.s.stop:
+			return
+		case <-ticker.C:
+			r.tick()
+		}
+	}
+}
+
+// tick starts an election once the election timeout passes without a
+// leader, and makes a leader that has lost touch with a quorum step down
+func (r *raftNode) tick() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return
+	}
+
+	now := time.Now()
+	if r.role == raftLeader {
+		reachable := 1
+		for _, p := range r.peers {
+			if now.Sub(p.lastAck) < r.opts.ElectionTimeout {
+				reachable++
+			}
+		}
+		if reachable < r.quorum() {
+			log.Printf("Raft: leader %s lost contact with a quorum in term %d; stepping down", r.id, r.term)
+			r.becomeFollowerLocked(r.term)
+		}
+		return
+	}
+	// Only voting members campaign, so a node waiting to be added or one
+	// that has been removed stays quiet
+	if _, member := r.members[r.id]; member && now.After(r.electionDeadline) {
+		r.campaignLocked()
+	}
+}
+
+func (r *raftNode) campaignLocked() {
+	r.role = raftCandidate
+	r.term++
+	r.votedFor = r.id
+	r.leaderID = ""
+	r.resetElectionTimer()
+	if err := r.persistLocked(); err != nil {
+		log.Printf("Raft: failed to save state: %v", err)
+		return
+	}
+	log.Printf("Raft: %s campaigning in term %d", r.id, r.term)
+
+	req := &pb.VoteRequest{Term: r.term, CandidateId: r.id, LastLogIndex: r.log.lastIndex(), LastLogTerm: r.log.lastTerm()}
+	votes := 1
+	if votes >= r.quorum() {
+		r.becomeLeaderLocked()
+		return
+	}
+	for id, addr := range r.members {
+		if id == r.id {
+			continue
+		}
+		client, err := r.clientLocked(addr)
+		if err != nil {
+			log.Printf("Raft: invalid address %q for %s: %v", addr, id, err)
+			continue
+		}
+		r.s.loops.Add(1)
+		go func() {
+			defer r.s.loops.Done()
+			ctx, cancel := context.WithTimeout(r.ctx, raftRPCTimeout)
+			defer cancel()
+			resp, err := client.RequestVote(ctx, req)
+			if err != nil {
+				return
+			}
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if resp.Term > r.term {
+				r.becomeFollowerLocked(resp.Term)
+				return
+			}
+			if r.stopped || r.role != raftCandidate || r.term != req.Term || !resp.Granted {
+				return
+			}
+			if votes++; votes >= r.quorum() {
+				r.becomeLeaderLocked()
+			}
+		}()
+	}
+}
+
+// becomeFollowerLocked moves to term, if it is newer, and follows whoever
+// leads it
+func (r *raftNode) becomeFollowerLocked(term uint64) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+		r.leaderID = ""
+		if err := r.persistLocked(); err != nil {
+			log.Printf("Raft: failed to save state: %v", err)
+		}
+	}
+	if r.role == raftLeader {
+		r.stopPeersLocked()
+		r.leaderID = ""
+	}
+	r.role = raftFollower
+	r.pendingConfig = 0
+	r.resetElectionTimer()
+}
+
+func (r *raftNode) becomeLeaderLocked() {
+	r.role = raftLeader
+	r.leaderID = r.id
+	log.Printf("Raft: %s elected leader in term %d", r.id, r.term)
+
+	// A membership change left over from an earlier term still blocks the
+	// next one until it is applied
+	r.pendingConfig = 0
+	for _, e := range r.log.slice(r.lastApplied+1, r.log.lastIndex()+1) {
+		if e.Type == pb.RaftEntry_CONFIG {
+			r.pendingConfig = e.Index
+		}
+	}
+	r.syncPeersLocked()
+
+	// Committing an entry from its own term also commits every earlier one
+	if _, err := r.appendLocked(pb.RaftEntry_NOOP, nil); err != nil {
+		log.Printf("Raft: failed to append to log: %v", err)
+		r.becomeFollowerLocked(r.term)
+	}
+}
+
+// syncPeersLocked starts replicating to new members and stops replicating to
+// removed ones
+func (r *raftNode) syncPeersLocked() {
+	if r.peers == nil {
+		r.peers = make(map[string]*raftPeer)
+	}
+	for id, p := range r.peers {
+		if r.members[id] != p.addr {
+			close(p.stop)
+			delete(r.peers, id)
+		}
+	}
+	for id, addr := range r.members {
+		if _, ok := r.peers[id]; ok || id == r.id {
+			continue
+		}
+		p := &raftPeer{
+			id:      id,
+			addr:    addr,
+			next:    r.log.lastIndex() + 1,
+			lastAck: time.Now(),
+			notify:  make(chan struct{}, 1),
+			stop:    make(chan struct{}),
+		}
+		r.peers[id] = p
+		r.s.loops.Add(1)
+		go r.replicate(p, r.term)
+	}
+}
+
+func (r *raftNode) stopPeersLocked() {
+	for _, p := range r.peers {
+		close(p.stop)
+	}
+	r.peers = nil
+}
+
+// appendLocked appends a new entry in the current term to the leader's log
+// and wakes up the replicators
+func (r *raftNode) appendLocked(typ pb.RaftEntry_Type, data []byte) (raftEntry, error) {
+	e := raftEntry{Index: r.log.lastIndex() + 1, Term: r.term, Type: typ, Data: data}
+	if err := r.log.append(e); err != nil {
+		return e, err
+	}
+	r.advanceCommitLocked()
+	for _, p := range r.peers {
+		select {
+		case p.notify <- struct{}{}:
+		default:
+		}
+	}
+	return e, nil
+}
+
+// advanceCommitLocked commits the latest entry of the current term that a
+// quorum of members has stored
+func (r *raftNode) advanceCommitLocked() {
+	for n := r.log.lastIndex(); n > r.commitIndex; n-- {
+		if term, _ := r.log.term(n); term != r.term {
+			// Entries from earlier terms are only committed indirectly
+			return
+		}
+		stored := 0
+		if _, ok := r.members[r.id]; ok {
+			stored++
+		}
+		for _, p := range r.peers {
+			if p.match >= n {
+				stored++
+			}
+		}
+		if stored >= r.quorum() {
+			r.commitIndex = n
+			r.committed.Broadcast()
+			return
+		}
+	}
+}
+
+// replicate keeps one follower's log in line with the leader's for as long as
+// the node leads in term
+func (r *raftNode) replicate(p *raftPeer, term uint64) {
+	defer r.s.loops.Done()
+	heartbeat := time.NewTicker(r.opts.Heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		more := r.sendAppend(p, term)
+		if !more {
+			select {
+			case <-p.notify:
+			case <-heartbeat.C:
+			case <-p.stop:
+				return
+			}
+		}
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+	}
+}
+
+// sendAppend sends the follower the entries it is missing, or an empty
+// heartbeat. It reports whether more entries are ready to send right away.
+func (r *raftNode) sendAppend(p *raftPeer, term uint64) bool {
+	r.mu.Lock()
+	if r.role != raftLeader || r.term != term {
+		r.mu.Unlock()
+		return false
+	}
+	if p.next <= r.log.snapIndex {
+		r.mu.Unlock()
+		return r.sendSnapshot(p, term)
+	}
+	prev := p.next - 1
+	prevTerm, _ := r.log.term(prev)
+	ents := r.log.slice(p.next, p.next+raftMaxAppend)
+	req := &pb.AppendEntriesRequest{
+		Term:         term,
+		LeaderId:     r.id,
+		PrevLogIndex: prev,
+		PrevLogTerm:  prevTerm,
+		LeaderCommit: r.commitIndex,
+	}
+	size := 0
+	for _, e := range ents {
+		if size += len(e.Data); size > raftMaxAppendBytes && len(req.Entries) > 0 {
+			break
+		}
+		req.Entries = append(req.Entries, &pb.RaftEntry{Index: e.Index, Term: e.Term, Type: e.Type, Data: e.Data})
+	}
+	client, err := r.clientLocked(p.addr)
+	r.mu.Unlock()
+	if err != nil {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(r.ctx, raftRPCTimeout)
+	resp, err := client.AppendEntries(ctx, req)
+	cancel()
+	if err != nil {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if resp.Term > r.term {
+		r.becomeFollowerLocked(resp.Term)
+		return false
+	}
+	if r.role != raftLeader || r.term != term {
+		return false
+	}
+	p.lastAck = time.Now()
+	if !resp.Success {
+		p.next = max(min(resp.NextIndex, p.next-1), 1)
+		return true
+	}
+	p.match = max(p.match, prev+uint64(len(ents)))
+	p.next = p.match + 1
+	r.advanceCommitLocked()
+	return p.next <= r.log.lastIndex()
+}
+
+// sendSnapshot sends the follower a copy of the store at the last applied
+// index, for when the entries it needs have been compacted away
+func (r *raftNode) sendSnapshot(p *raftPeer, term uint64) bool {
+	// Holding applyMu keeps the store at lastApplied while it is copied
+	r.applyMu.Lock()
+	r.s.rlockAll()
+	store, err := r.s.engine.snapshot()
+	index := r.s.rev
+	r.s.runlockAll()
+	if err != nil {
+		r.applyMu.Unlock()
+		log.Printf("Raft: failed to snapshot the store for %s: %v", p.id, err)
+		return false
+	}
+	defer store.release()
+	r.mu.Lock()
+	snapTerm, ok := r.log.term(index)
+	members := memberList(r.members)
+	client, err := r.clientLocked(p.addr)
+	r.mu.Unlock()
+	r.applyMu.Unlock()
+	if !ok || err != nil {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(r.ctx, raftSnapshotTimeout)
+	defer cancel()
+	stream, err := client.InstallSnapshot(ctx)
+	if err != nil {
+		return false
+	}
+	err = snapshotChunks(store, func(muts []*pb.Mutation, done bool) error {
+		return stream.Send(&pb.InstallSnapshotRequest{
+			Term:              term,
+			LeaderId:          r.id,
+			LastIncludedIndex: index,
+			LastIncludedTerm:  snapTerm,
+			Members:           members,
+			Done:              done,
+			Entries:           muts,
+		})
+	})
+	if err != nil {
+		return false
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		log.Printf("Raft: failed to send snapshot at %d to %s: %v", index, p.id, err)
+		return false
+	}
+	log.Printf("Raft: sent snapshot at %d with %d keys to %s", index, store.len(), p.id)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if resp.Term > r.term {
+		r.becomeFollowerLocked(resp.Term)
+		return false
+	}
+	if r.role != raftLeader || r.term != term {
+		return false
+	}
+	p.lastAck = time.Now()
+	p.match = max(p.match, index)
+	p.next = p.match + 1
+	r.advanceCommitLocked()
+	return p.next <= r.log.lastIndex()
+}
+
+// heardFromLeaderLocked records a valid message from the leader of term
+func (r *raftNode) heardFromLeaderLocked(term uint64, leaderID string) {
+	if term > r.term || r.role != raftFollower {
+		r.becomeFollowerLocked(term)
+	}
+	r.leaderID = leaderID
+	r.lastContact = time.Now()
+	r.resetElectionTimer()
+}
+
+func (r *raftNode) requestVote(req *pb.VoteRequest) (*pb.VoteResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// A node that has recently heard from a leader ignores candidates, so
+	// that a removed node that never learned of its removal cannot disrupt
+	// the cluster
+	if r.role == raftLeader || (r.leaderID != "" && time.Since(r.lastContact) < r.opts.ElectionTimeout) {
+		return &pb.VoteResponse{Term: r.term}, nil
+	}
+	if req.Term < r.term {
+		return &pb.VoteResponse{Term: r.term}, nil
+	}
+	if req.Term > r.term {
+		r.becomeFollowerLocked(req.Term)
+	}
+
+	upToDate := req.LastLogTerm > r.log.lastTerm() ||
+		(req.LastLogTerm == r.log.lastTerm() && req.LastLogIndex >= r.log.lastIndex())
+	if (r.votedFor != "" && r.votedFor != req.CandidateId) || !upToDate {
+		return &pb.VoteResponse{Term: r.term}, nil
+	}
+	r.votedFor = req.CandidateId
+	if err := r.persistLocked(); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to save raft state: %v", err)
+	}
+	r.resetElectionTimer()
+	return &pb.VoteResponse{Term: r.term, Granted: true}, nil
+}
+
+func (r *raftNode) appendEntries(req *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.Term < r.term {
+		return &pb.AppendEntriesResponse{Term: r.term}, nil
+	}
+	r.heardFromLeaderLocked(req.Term, req.LeaderId)
+
+	last := r.log.lastIndex()
+	if req.PrevLogIndex > last {
+		return &pb.AppendEntriesResponse{Term: r.term, NextIndex: last + 1}, nil
+	}
+	if req.PrevLogIndex >= r.log.snapIndex {
+		if term, _ := r.log.term(req.PrevLogIndex); term != req.PrevLogTerm {
+			// Skip back over the whole conflicting term in one round trip
+			next := req.PrevLogIndex
+			for next > r.log.snapIndex+1 {
+				if t, _ := r.log.term(next - 1); t != term {
+					break
+				}
+				next--
+			}
+			return &pb.AppendEntriesResponse{Term: r.term, NextIndex: next}, nil
+		}
+	}
+
+	// Entries the log already holds are skipped; the first one that is new
+	// or conflicts replaces the rest of the log
+	for i, e := range req.Entries {
+		if e.Index <= r.log.snapIndex {
+			continue
+		}
+		if term, ok := r.log.term(e.Index); ok && term == e.Term {
+			continue
+		}
+		ents := make([]raftEntry, 0, len(req.Entries)-i)
+		for _, e := range req.Entries[i:] {
+			ents = append(ents, raftEntry{Index: e.Index, Term: e.Term, Type: e.Type, Data: e.Data})
+		}
+		if err := r.log.append(ents...); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to write raft log: %v", err)
+		}
+		break
+	}
+
+	if lastNew := req.PrevLogIndex + uint64(len(req.Entries)); req.LeaderCommit > r.commitIndex {
+		r.commitIndex = max(r.commitIndex, min(req.LeaderCommit, lastNew))
+		r.committed.Broadcast()
+	}
+	return &pb.AppendEntriesResponse{Term: r.term, Success: true}, nil
+}
+
+func (r *raftNode) installSnapshot(stream grpc.ClientStreamingServer[pb.InstallSnapshotRequest, pb.InstallSnapshotResponse]) error {
+	var hdr *pb.InstallSnapshotRequest
+	store := make(map[string]entry)
+	for hdr == nil || !hdr.Done {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return status.Errorf(codes.InvalidArgument, "snapshot ended before its last chunk")
+		}
+		if err != nil {
+			return err
+		}
+		hdr = req
+		for _, m := range req.Entries {
+			store[m.Key] = entry{value: string(m.Value), expiresAt: m.ExpiresAt, version: m.Version, contentType: m.ContentType}
+		}
+	}
+	index := hdr.LastIncludedIndex
+
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+	r.mu.Lock()
+	if hdr.Term < r.term {
+		term := r.term
+		r.mu.Unlock()
+		return stream.SendAndClose(&pb.InstallSnapshotResponse{Term: term})
+	}
+	r.heardFromLeaderLocked(hdr.Term, hdr.LeaderId)
+	term := r.term
+	stale := index <= r.lastApplied
+	r.mu.Unlock()
+	if stale {
+		return stream.SendAndClose(&pb.InstallSnapshotResponse{Term: term})
+	}
+
+	if err := r.s.installSnapshot(index, store); err != nil {
+		return status.Errorf(codes.Internal, "failed to install snapshot: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var err error
+	if t, ok := r.log.term(index); ok && t == hdr.LastIncludedTerm {
+		err = r.log.compact(index)
+	} else {
+		err = r.log.restore(index, hdr.LastIncludedTerm)
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to compact raft log: %v", err)
+	}
+	r.members = make(map[string]string, len(hdr.Members))
+	for _, m := range hdr.Members {
+		r.members[m.Id] = m.Address
+	}
+	if err := r.persistLocked(); err != nil {
+		return status.Errorf(codes.Internal, "failed to save raft state: %v", err)
+	}
+	r.commitIndex = max(r.commitIndex, index)
+	r.setAppliedLocked(index)
+	log.Printf("Raft: installed snapshot at %d with %d keys from %s", index, len(store), hdr.LeaderId)
+	return stream.SendAndClose(&pb.InstallSnapshotResponse{Term: r.term})
+}
+
+func (r *raftNode) setAppliedLocked(index uint64) {
+	r.lastApplied = index
+	close(r.applied)
+	r.applied = make(chan struct{})
+}
+
+func (r *raftNode) applyLoop() {
+	defer r.s.loops.Done()
+	for {
+		r.mu.Lock()
+		for !r.stopped && r.lastApplied >= r.commitIndex {
+			r.committed.Wait()
+		}
+		stopped := r.stopped
+		r.mu.Unlock()
+		if stopped {
+			return
+		}
+		r.applyCommitted()
+	}
+}
+
+// applyCommitted applies every committed entry that has not been applied yet
+// and completes the proposals waiting on them
+func (r *raftNode) applyCommitted() {
+	r.applyMu.Lock()
+	defer r.applyMu.Unlock()
+
+	r.mu.Lock()
+	ents := r.log.slice(r.lastApplied+1, r.commitIndex+1)
+	r.mu.Unlock()
+
+	for _, e := range ents {
+		applied := r.s.applyEntry(e)
+
+		r.mu.Lock()
+		if e.Type == pb.RaftEntry_CONFIG {
+			r.applyConfigLocked(e)
+		}
+		r.setAppliedLocked(e.Index)
+		if p := r.waiters[e.Index]; p != nil {
+			delete(r.waiters, e.Index)
+			if p.term == e.Term {
+				p.done <- raftResult{applied: applied}
+			} else {
+				p.done <- raftResult{err: status.Errorf(codes.Unavailable, "leadership changed before the write was committed; it was not applied")}
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *raftNode) applyConfigLocked(e raftEntry) {
+	members, err := decodeMembers(e.Data)
+	if err != nil {
+		log.Printf("Raft: skipping malformed membership at %d: %v", e.Index, err)
+		return
+	}
+	r.members = members
+	if r.pendingConfig <= e.Index {
+		r.pendingConfig = 0
+	}
+	if err := r.persistLocked(); err != nil {
+		log.Printf("Raft: failed to save state: %v", err)
+	}
+	log.Printf("Raft: membership at %d is %v", e.Index, members)
+
+	if r.role != raftLeader {
+		return
+	}
+	if _, ok := members[r.id]; !ok {
+		log.Printf("Raft: leader %s was removed from the cluster; stepping down", r.id)
+		r.becomeFollowerLocked(r.term)
+		return
+	}
+	r.syncPeersLocked()
+}
+
+// applyEntry applies a committed entry to the store at its index. A NORMAL
+// entry only takes effect if every key it read is still at the version it
+// read and its writes fit the namespace quotas; otherwise, like every other
+// entry, it is applied as a no-op. It reports whether the write took effect.
+func (s *kvServer) applyEntry(e raftEntry) bool {
+	rec := walRecord{Op: walOpNoop, Seq: e.Index}
+	applied := false
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e.Type == pb.RaftEntry_NORMAL {
+		reads, cmd, err := decodeRaftCommand(e.Data)
+		switch {
+		case err != nil:
+			log.Printf("Raft: skipping malformed entry %d: %v", e.Index, err)
+		case s.readsHold(reads) && s.quotasHold(&cmd):
+			rec = cmd
+			rec.Seq = e.Index
+			for i := range rec.Ops {
+				rec.Ops[i].Seq = e.Index
+			}
+			applied = true
+		}
+	}
+	s.apply(rec)
+	return applied
+}
+
+// readsHold reports whether every key is still at the version that was read.
+// Every node must reach the same answer, so a node whose storage engine fails
+// to read the key exits like one that fails to apply an entry. Callers must
+// hold the lock.
+func (s *kvServer) readsHold(reads map[string]uint64) bool {
+	for key, version := range reads {
+		e, _, err := s.engine.get(key)
+		if err != nil {
+			log.Fatalf("Storage engine failed to read key '%s': %v", key, err)
+		}
+		if e.version != version {
+			return false
+		}
+	}
+	return true
+}
+
+// quotasHold reports whether cmd keeps every namespace within its quotas. The
+// leader checks quotas before proposing, but writes proposed concurrently are
+// checked against the same usage, so only the check at apply time, which every
+// node makes against the same state, keeps them from overshooting together.
+// Callers must hold the lock.
+func (s *kvServer) quotasHold(cmd *walRecord) bool {
+	err := s.checkQuotas(cmd)
+	if err != nil && status.Code(err) != codes.ResourceExhausted {
+		log.Fatalf("Storage engine failed to check namespace quotas: %v", err)
+	}
+	return err == nil
+}
+
+// checkLeader returns nil on the leader, and otherwise the error that
+// redirects a write to it
+func (r *raftNode) checkLeader() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.role == raftLeader {
+		return nil
+	}
+	return r.notLeaderLocked()
+}
+
+func (r *raftNode) notLeaderLocked() error {
+	addr, ok := r.members[r.leaderID]
+	if r.leaderID == "" || !ok {
+		return status.Errorf(codes.Unavailable, "no Raft leader is known yet; retry shortly")
+	}
+	return notPrimaryError(fmt.Sprintf("this node is not the Raft leader; send writes to %s at %s", r.leaderID, addr), addr)
+}
+
+func (r *raftNode) isLeader() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.role == raftLeader
+}
+
+// propose appends an entry on the leader and returns the proposal that
+// completes once it is applied
+func (r *raftNode) propose(typ pb.RaftEntry_Type, data []byte) (*raftProposal, uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.role != raftLeader {
+		return nil, 0, r.notLeaderLocked()
+	}
+	e, err := r.appendLocked(typ, data)
+	if errors.Is(err, errRecordTooLarge) {
+		return nil, 0, tooLarge(fmt.Sprintf("the write is too large to log: %v", err), walMaxRecordSize)
+	}
+	if err != nil {
+		return nil, 0, status.Errorf(codes.Internal, "failed to write raft log: %v", err)
+	}
+	p := &raftProposal{term: e.Term, done: make(chan raftResult, 1)}
+	r.waiters[e.Index] = p
+	return p, e.Index, nil
+}
+
+// await waits for a proposal to be applied and reports whether its write
+// took effect
+func (r *raftNode) await(ctx context.Context, p *raftProposal) (bool, error) {
+	timer := time.NewTimer(raftCommitTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-p.done:
+		return res.applied, res.err
+	case <-ctx.Done():
+		return false, status.FromContextError(ctx.Err()).Err()
+	case <-timer.C:
+		return false, status.Errorf(codes.Unavailable, "timed out waiting for a quorum; the write may still be applied")
+	case <-r.s.stop:
+		return false, status.Errorf(codes.Unavailable, "server is shutting down")
+	}
+}
+
+// commit proposes a write and waits for it to be applied, reporting whether
+// it took effect and at which index
+func (r *raftNode) commit(ctx context.Context, data []byte) (bool, uint64, error) {
+	p, index, err := r.propose(pb.RaftEntry_NORMAL, data)
+	if err != nil {
+		return false, 0, err
+	}
+	applied, err := r.await(ctx, p)
+	return applied, index, err
+}
+
+// catchUp waits until every entry that is committed now has been applied, so
+// that writes are evaluated against the latest state the node knows of
+func (r *raftNode) catchUp(ctx context.Context) error {
+	r.mu.Lock()
+	target := r.commitIndex
+	for r.lastApplied < target {
+		applied := r.applied
+		r.mu.Unlock()
+		select {
+		case <-applied:
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-r.s.stop:
+			return status.Errorf(codes.Unavailable, "server is shutting down")
+		}
+		r.mu.Lock()
+	}
+	r.mu.Unlock()
+	return nil
+}
+
+// compact drops the log up to index once a snapshot covers it
+func (r *raftNode) compact(index uint64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if index <= r.log.snapIndex || index > r.lastApplied {
+		return nil
+	}
+	return r.log.compact(index)
+}
+
+// reseal rewrites the log with every entry sealed by the active data key
+func (r *raftNode) reseal() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.log.rewrite(r.log.snapIndex, r.log.snapTerm, r.log.entries)
+}
+
+// mutateRaft is mutate in cluster mode. The write is evaluated against the
+// applied state and proposed together with the versions of every key it read.
+// If another write changes one of those keys, or takes the room it needed in a
+// namespace quota, before the entry is applied, the entry becomes a no-op and
+// the write is evaluated again.
+func (s *kvServer) mutateRaft(ctx context.Context, eval func(v *txnView) (*walRecord, error)) (uint64, error) {
+	if err := s.raft.catchUp(ctx); err != nil {
+		return 0, err
+	}
+	for attempt := 0; attempt < raftConflictRetries; attempt++ {
+		s.rlockAll()
+		view := s.newView()
+		rec, err := eval(view)
+		if err == nil {
+			err = view.err
+		}
+		if err == nil && rec != nil {
+			// Refused early here, and checked again when the entry is
+			// applied; a write that no longer fits there is retried and
+			// then refused by this check
+			err = s.checkQuotas(rec)
+		}
+		rev := s.rev
+		s.runlockAll()
+		if err != nil || rec == nil {
+			return rev, err
+		}
+
+		applied, index, err := s.raft.commit(ctx, encodeRaftCommand(view.reads, *rec))
+		if err != nil {
+			return 0, err
+		}
+		if applied {
+			return index, nil
+		}
+	}
+	return 0, status.Errorf(codes.Aborted, "the write conflicted with concurrent writes %d times; retry", raftConflictRetries)
+}
+
+// sweepCluster reclaims expired keys in cluster mode. Only the leader deletes
+// keys, through the log and guarded by the versions it saw, so that a key
+// rewritten meanwhile survives. Other nodes only drop expiry index items
+// that no longer match their key.
+func (s *kvServer) sweepCluster() int {
+	leader := s.raft.isLeader()
+	removed := 0
+	for {
+		s.mu.Lock()
+		now := s.now().UnixNano()
+		var due []expiryItem
+		reads := make(map[string]uint64)
+		rec := walRecord{Op: walOpTxn}
+		for len(due) < sweepBatchSize && s.expiries.due(now) {
+			item := s.expiries.pop()
+			e, ok, err := s.lookup(item.key)
+			if err != nil {
+				log.Printf("TTL sweep: %v", err)
+				s.expiries.restore(item)
+				break
+			}
+			if !ok || e.expiresAt != item.at {
+				continue
+			}
+			if !leader {
+				// The leader's delete will arrive through the log
+				s.expiries.restore(item)
+				break
+			}
+			due = append(due, item)
+			reads[item.key] = e.version
+			rec.Ops = append(rec.Ops, walRecord{Op: walOpDelete, Key: item.key})
+		}
+		s.mu.Unlock()
+		if len(due) == 0 {
+			return removed
+		}
+
+		applied, _, err := s.raft.commit(context.Background(), encodeRaftCommand(reads, rec))
+		if err != nil || !applied {
+			if err != nil {
+				log.Printf("TTL sweep: %v", err)
+			}
+			// Leave the items for the next sweep, which skips any that
+			// changed
+			s.mu.Lock()
+			for _, item := range due {
+				s.expiries.restore(item)
+			}
+			s.mu.Unlock()
+			return removed
+		}
+		removed += len(due)
+	}
+}
+
+// changeMembership proposes the membership that update makes of the current
+// one and waits for it to be applied. Only one change may be in flight.
+func (r *raftNode) changeMembership(ctx context.Context, update func(members map[string]string) error) (*pb.MembershipResponse, error) {
+	r.mu.Lock()
+	if r.role != raftLeader {
+		err := r.notLeaderLocked()
+		r.mu.Unlock()
+		return nil, err
+	}
+	if r.pendingConfig != 0 {
+		index := r.pendingConfig
+		r.mu.Unlock()
+		return nil, status.Errorf(codes.FailedPrecondition, "the membership change at index %d is still in progress", index)
+	}
+	members := maps.Clone(r.members)
+	if err := update(members); err != nil {
+		r.mu.Unlock()
+		return nil, err
+	}
+	e, err := r.appendLocked(pb.RaftEntry_CONFIG, encodeMembers(members))
+	if err != nil {
+		r.mu.Unlock()
+		return nil, status.Errorf(codes.Internal, "failed to write raft log: %v", err)
+	}
+	r.pendingConfig = e.Index
+	p := &raftProposal{term: e.Term, done: make(chan raftResult, 1)}
+	r.waiters[e.Index] = p
+	r.mu.Unlock()
+
+	if _, err := r.await(ctx, p); err != nil {
+		return nil, err
+	}
+	return &pb.MembershipResponse{Members: memberList(members), Index: e.Index}, nil
+}
+
+// memberList returns members sorted by ID
+func memberList(members map[string]string) []*pb.Member {
+	list := make([]*pb.Member, 0, len(members))
+	for id, addr := range members {
+		list = append(list, &pb.Member{Id: id, Address: addr})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
+
+// clusterNode returns the Raft node, or an error if the server is not in
+// cluster mode
+func (s *kvServer) clusterNode() (*raftNode, error) {
+	if s.raft == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "this node is not running in cluster mode")
+	}
+	return s.raft, nil
+}
+
+func (s *kvServer) RequestVote(ctx context.Context, req *pb.VoteRequest) (*pb.VoteResponse, error) {
+	r, err := s.clusterNode()
+	if err != nil {
+		return nil, err
+	}
+	return r.requestVote(req)
+}
+
+func (s *kvServer) AppendEntries(ctx context.Context, req *pb.AppendEntriesRequest) (*pb.AppendEntriesResponse, error) {
+	r, err := s.clusterNode()
+	if err != nil {
+		return nil, err
+	}
+	return r.appendEntries(req)
+}
+
+func (s *kvServer) InstallSnapshot(stream grpc.ClientStreamingServer[pb.InstallSnapshotRequest, pb.InstallSnapshotResponse]) error {
+	r, err := s.clusterNode()
+	if err != nil {
+		return err
+	}
+	return r.installSnapshot(stream)
+}
+
+// AddMember adds a voting member to the cluster. The new node should already
+// be running in cluster mode with no peers, so that it waits to hear from the
+// leader instead of starting elections of its own.
+func (s *kvServer) AddMember(ctx context.Context, req *pb.AddMemberRequest) (*pb.MembershipResponse, error) {
+	r, err := s.clusterNode()
+	if err != nil {
+		return nil, err
+	}
+	if req.Id == "" || req.Address == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "id and address are required")
+	}
+	resp, err := r.changeMembership(ctx, func(members map[string]string) error {
+		if addr, ok := members[req.Id]; ok {
+			return status.Errorf(codes.AlreadyExists, "%s is already a member at %s", req.Id, addr)
+		}
+		members[req.Id] = req.Address
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("AddMember id=%s, address=%s, index=%d", req.Id, req.Address, resp.Index)
+	return resp, nil
+}
+
+// RemoveMember removes a voting member from the cluster. A removed node
+// should be shut down once the change is applied.
+func (s *kvServer) RemoveMember(ctx context.Context, req *pb.RemoveMemberRequest) (*pb.MembershipResponse, error) {
+	r, err := s.clusterNode()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.changeMembership(ctx, func(members map[string]string) error {
+		if _, ok := members[req.Id]; !ok {
+			return status.Errorf(codes.NotFound, "%q is not a member", req.Id)
+		}
+		if len(members) == 1 {
+			return status.Errorf(codes.FailedPrecondition, "cannot remove the last member")
+		}
+		delete(members, req.Id)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("RemoveMember id=%s, index=%d", req.Id, resp.Index)
+	return resp, nil
+}
+
+// ClusterStatus reports this node's view of the cluster. The leader also
+// reports how far each member's log matches its own.
+func (s *kvServer) ClusterStatus(ctx context.Context, req *pb.ClusterStatusRequest) (*pb.ClusterStatusResponse, error) {
+	r, err := s.clusterNode()
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	resp := &pb.ClusterStatusResponse{
+		Id:            r.id,
+		State:         r.role.String(),
+		Term:          r.term,
+		LeaderId:      r.leaderID,
+		LeaderAddress: r.members[r.leaderID],
+		CommitIndex:   r.commitIndex,
+		AppliedIndex:  r.lastApplied,
+	}
+	for _, m := range memberList(r.members) {
+		ps := &pb.PeerStatus{Id: m.Id, Address: m.Address}
+		if r.role == raftLeader {
+			if m.Id == r.id {
+				ps.MatchIndex = r.log.lastIndex()
+			} else if p := r.peers[m.Id]; p != nil {
+				ps.MatchIndex = p.match
+			}
+		}
+		resp.Members = append(resp.Members, ps)
+	}
+	return resp, nil
+}
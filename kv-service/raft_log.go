@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+)
+
+const (
+	raftLogFile   = "raft.log"
+	raftStateFile = "raft.state"
+
+	// raftMarker is the type of the record that opens a compacted log. It
+	// carries the index and term of the last entry covered by a snapshot.
+	raftMarker byte = 0xff
+)
+
+// raftEntry is a single entry of the Raft log
+type raftEntry struct {
+	Index uint64
+	Term  uint64
+	Type  pb.RaftEntry_Type
+	Data  []byte
+}
+
+// raftLog is the durable Raft log of a node. Entries are framed like WAL
+// records, as crc32c(payload) | len(payload) | payload with a payload of
+//
+//	type | index | term | data
+//
+// and appended to a single file. Appending an entry at an index that is
+// already in the log replaces that entry and every one after it, both in
+// memory and when the file is replayed. Compaction rewrites the file so that
+// it starts with a marker record for the compaction point. The whole log
+// after the compaction point is kept in memory. With a keyring, every
+// payload is sealed.
+type raftLog struct {
+	dir  string
+	keys *keyring
+	f    *os.File
+
+	// snapIndex and snapTerm identify the last entry dropped by compaction
+	snapIndex uint64
+	snapTerm  uint64
+	// entries holds the log after snapIndex
+	entries []raftEntry
+	// tailIndex and tailTerm identify the entry of the last frame in the
+	// file, which the next sealed frame is tied to
+	tailIndex uint64
+	tailTerm  uint64
+}
+
+// openRaftLog opens (or creates) the Raft log in dir, sealing its records
+// with keys if it is set. A torn record at the end of the file is treated as
+// an interrupted append and cut off, but one that fails authentication fails
+// the open.
+func openRaftLog(dir string, keys *keyring) (*raftLog, error) {
+	l := &raftLog{dir: dir, keys: keys}
+	path := filepath.Join(dir, raftLogFile)
+
+	offset, err := l.replay(path)
+	if errors.Is(err, errTampered) {
+		return nil, fmt.Errorf("raft log %s at offset %d: %w", path, offset, err)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Raft log %s: discarding torn tail after offset %d: %v", path, offset, err)
+		if err := os.Truncate(path, offset); err != nil {
+			return nil, fmt.Errorf("truncate raft log: %w", err)
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open raft log: %w", err)
+	}
+	l.f = f
+	return l, nil
+}
+
+// replay loads every intact record of the file at path and returns the offset
+// just past the last one
+func (l *raftLog) replay(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var (
+		offset int64
+		header [walHeaderSize]byte
+	)
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			return offset, err
+		}
+		sum := binary.LittleEndian.Uint32(header[0:4])
+		size := binary.LittleEndian.Uint32(header[4:8])
+		if size == 0 || size > walMaxRecordSize {
+			return offset, fmt.Errorf("invalid record length %d", size)
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return offset, io.ErrUnexpectedEOF
+		}
+		if crc32.Checksum(payload, crcTable) != sum {
+			return offset, errors.New("checksum mismatch")
+		}
+		if payload, err = l.keys.open(payload, raftAAD(l.tailIndex, l.tailTerm)); err != nil {
+			return offset, err
+		}
+
+		typ, e, err := decodeRaftEntry(payload)
+		if err != nil {
+			return offset, err
+		}
+		if typ == raftMarker {
+			l.snapIndex, l.snapTerm, l.entries = e.Index, e.Term, nil
+		} else {
+			if e.Index <= l.snapIndex || e.Index > l.lastIndex()+1 {
+				return offset, fmt.Errorf("entry %d does not follow the log ending at %d", e.Index, l.lastIndex())
+			}
+			l.entries = append(l.entries[:e.Index-l.snapIndex-1], e)
+		}
+		l.tailIndex, l.tailTerm = e.Index, e.Term
+		offset += walHeaderSize + int64(size)
+	}
+}
+
+func encodeRaftEntry(typ byte, e raftEntry) []byte {
+	payload := make([]byte, 0, 1+2*binary.MaxVarintLen64+len(e.Data))
+	payload = append(payload, typ)
+	payload = binary.AppendUvarint(payload, e.Index)
+	payload = binary.AppendUvarint(payload, e.Term)
+	payload = append(payload, e.Data...)
+	return frameRecord(payload)
+}
+
+// encode frames an entry for the file after a frame for prev, sealing its
+// payload if the log is encrypted
+func (l *raftLog) encode(typ byte, e, prev raftEntry) []byte {
+	buf := encodeRaftEntry(typ, e)
+	if l.keys == nil {
+		return buf
+	}
+	return frameRecord(l.keys.seal(buf[walHeaderSize:], raftAAD(prev.Index, prev.Term)))
+}
+
+func decodeRaftEntry(payload []byte) (byte, raftEntry, error) {
+	var e raftEntry
+	typ := payload[0]
+	p := payload[1:]
+	index, n := binary.Uvarint(p)
+	if n <= 0 {
+		return 0, e, errBadRecord
+	}
+	p = p[n:]
+	term, n := binary.Uvarint(p)
+	if n <= 0 {
+		return 0, e, errBadRecord
+	}
+	if _, ok := pb.RaftEntry_Type_name[int32(typ)]; !ok && typ != raftMarker {
+		return 0, e, fmt.Errorf("unknown raft entry type %d", typ)
+	}
+	e = raftEntry{Index: index, Term: term, Type: pb.RaftEntry_Type(typ), Data: p[n:]}
+	return typ, e, nil
+}
+
+func (l *raftLog) lastIndex() uint64 {
+	return l.snapIndex + uint64(len(l.entries))
+}
+
+func (l *raftLog) lastTerm() uint64 {
+	if len(l.entries) == 0 {
+		return l.snapTerm
+	}
+	return l.entries[len(l.entries)-1].Term
+}
+
+// term returns the term of the entry at index, if it is the compaction point
+// or still in the log
+func (l *raftLog) term(index uint64) (uint64, bool) {
+	switch {
+	case index == l.snapIndex:
+		return l.snapTerm, true
+	case index < l.snapIndex || index > l.lastIndex():
+		return 0, false
+	}
+	return l.entries[index-l.snapIndex-1].Term, true
+}
+
+// slice returns the entries in [lo, hi). lo must be after the compaction point.
+func (l *raftLog) slice(lo, hi uint64) []raftEntry {
+	hi = min(hi, l.lastIndex()+1)
+	if lo >= hi {
+		return nil
+	}
+	return l.entries[lo-l.snapIndex-1 : hi-l.snapIndex-1 : hi-l.snapIndex-1]
+}
+
+// append durably writes ents, which must be contiguous and start after the
+// compaction point and no later than just past the end of the log. Any entries
+// from ents[0].Index onwards are replaced.
+func (l *raftLog) append(ents ...raftEntry) error {
+	if len(ents) == 0 {
+		return nil
+	}
+	first := ents[0].Index
+	if first <= l.snapIndex || first > l.lastIndex()+1 {
+		return fmt.Errorf("raft log: cannot append entry %d to a log covering (%d, %d]", first, l.snapIndex, l.lastIndex())
+	}
+
+	var buf []byte
+	prev := raftEntry{Index: l.tailIndex, Term: l.tailTerm}
+	for _, e := range ents {
+		frame := l.encode(byte(e.Type), e, prev)
+		if len(frame)-walHeaderSize > walMaxRecordSize {
+			return fmt.Errorf("raft log: entry %d: %w", e.Index, errRecordTooLarge)
+		}
+		buf = append(buf, frame...)
+		prev = e
+	}
+	if _, err := l.f.Write(buf); err != nil {
+		return fmt.Errorf("write raft log: %w", err)
+	}
+	l.tailIndex, l.tailTerm = prev.Index, prev.Term
+	if err := l.f.Sync(); err != nil {
+		return fmt.Errorf("fsync raft log: %w", err)
+	}
+	kept := l.entries[:first-l.snapIndex-1]
+	if first <= l.lastIndex() {
+		// Copy rather than overwrite, so that entries handed out by slice
+		// never change
+		kept = kept[:len(kept):len(kept)]
+	}
+	l.entries = append(kept, ents...)
+	return nil
+}
+
+// compact drops every entry up to and including index, which must be in the
+// log, by rewriting the file
+func (l *raftLog) compact(index uint64) error {
+	term, ok := l.term(index)
+	if !ok {
+		return fmt.Errorf("raft log: cannot compact to %d outside (%d, %d]", index, l.snapIndex, l.lastIndex())
+	}
+	return l.rewrite(index, term, l.entries[index-l.snapIndex:])
+}
+
+// restore discards the whole log and makes (index, term) the compaction
+// point, after a snapshot has been installed
+func (l *raftLog) restore(index, term uint64) error {
+	return l.rewrite(index, term, nil)
+}
+
+// rewrite atomically replaces the file with a marker for (index, term)
+// followed by ents
+func (l *raftLog) rewrite(index, term uint64, ents []raftEntry) error {
+	tmp, err := os.CreateTemp(l.dir, raftLogFile+"*.tmp")
+	if err != nil {
+		return fmt.Errorf("create raft log: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	bw := bufio.NewWriter(tmp)
+	prev := raftEntry{Index: index, Term: term}
+	bw.Write(l.encode(raftMarker, prev, raftEntry{}))
+	for _, e := range ents {
+		bw.Write(l.encode(byte(e.Type), e, prev))
+		prev = e
+	}
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write raft log: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("fsync raft log: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	path := filepath.Join(l.dir, raftLogFile)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename raft log: %w", err)
+	}
+	if err := syncDir(l.dir); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open raft log: %w", err)
+	}
+	l.f.Close()
+	l.f = f
+	l.snapIndex, l.snapTerm = index, term
+	l.entries = append([]raftEntry(nil), ents...)
+	l.tailIndex, l.tailTerm = prev.Index, prev.Term
+	return nil
+}
+
+func (l *raftLog) Close() error {
+	return l.f.Close()
+}
+
+// raftHardState is the state a node must not forget across restarts besides
+// its log: its current term, its vote in that term and the latest membership
+// it has applied
+type raftHardState struct {
+	term     uint64
+	votedFor string
+	members  map[string]string
+}
+
+// saveRaftState atomically replaces the state file in dir. The file holds
+// the payload term | votedFor | members, framed like a WAL record.
+func saveRaftState(dir string, hs raftHardState) error {
+	payload := binary.AppendUvarint(nil, hs.term)
+	payload = binary.AppendUvarint(payload, uint64(len(hs.votedFor)))
+	payload = append(payload, hs.votedFor...)
+	payload = append(payload, encodeMembers(hs.members)...)
+
+	buf := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.Checksum(payload, crcTable))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(payload)))
+	buf = append(buf, payload...)
+
+	tmp, err := os.CreateTemp(dir, raftStateFile+"*.tmp")
+	if err != nil {
+		return fmt.Errorf("create raft state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write raft state: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("fsync raft state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, raftStateFile)); err != nil {
+		return fmt.Errorf("rename raft state: %w", err)
+	}
+	return syncDir(dir)
+}
+
+// loadRaftState reads the state file in dir, returning the zero state if
+// there is none yet
+func loadRaftState(dir string) (raftHardState, error) {
+	var hs raftHardState
+	buf, err := os.ReadFile(filepath.Join(dir, raftStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return hs, nil
+	}
+	if err != nil {
+		return hs, fmt.Errorf("read raft state: %w", err)
+	}
+	if len(buf) < walHeaderSize || int(binary.LittleEndian.Uint32(buf[4:8])) != len(buf)-walHeaderSize ||
+		crc32.Checksum(buf[walHeaderSize:], crcTable) != binary.LittleEndian.Uint32(buf[0:4]) {
+		return hs, errors.New("raft state file is corrupt")
+	}
+
+	p := buf[walHeaderSize:]
+	term, n := binary.Uvarint(p)
+	if n <= 0 {
+		return hs, errBadRecord
+	}
+	votedFor, p, ok := readBytes(p[n:])
+	if !ok {
+		return hs, errBadRecord
+	}
+	members, err := decodeMembers(p)
+	if err != nil {
+		return hs, err
+	}
+	return raftHardState{term: term, votedFor: string(votedFor), members: members}, nil
+}
+
+// encodeMembers encodes a membership as count | (id address)*, sorted by id
+func encodeMembers(members map[string]string) []byte {
+	ids := make([]string, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	buf := binary.AppendUvarint(nil, uint64(len(ids)))
+	for _, id := range ids {
+		buf = binary.AppendUvarint(buf, uint64(len(id)))
+		buf = append(buf, id...)
+		buf = binary.AppendUvarint(buf, uint64(len(members[id])))
+		buf = append(buf, members[id]...)
+	}
+	return buf
+}
+
+func decodeMembers(p []byte) (map[string]string, error) {
+	count, n := binary.Uvarint(p)
+	if n <= 0 || count > uint64(len(p)) {
+		return nil, errBadRecord
+	}
+	p = p[n:]
+	members := make(map[string]string, count)
+	for i := uint64(0); i < count; i++ {
+		id, rest, ok := readBytes(p)
+		if !ok {
+			return nil, errBadRecord
+		}
+		addr, rest, ok := readBytes(rest)
+		if !ok {
+			return nil, errBadRecord
+		}
+		members[string(id)] = string(addr)
+		p = rest
+	}
+	if len(p) != 0 {
+		return nil, errBadRecord
+	}
+	return members, nil
+}
+
+// encodeRaftCommand encodes a write for a NORMAL entry as
+//
+//	count | (len(key) key version)* | walRecord
+//
+// where the reads are the stored versions the write was evaluated against
+func encodeRaftCommand(reads map[string]uint64, rec walRecord) []byte {
+	keys := make([]string, 0, len(reads))
+	for k := range reads {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := binary.AppendUvarint(nil, uint64(len(keys)))
+	for _, k := range keys {
+		buf = binary.AppendUvarint(buf, uint64(len(k)))
+		buf = append(buf, k...)
+		buf = binary.AppendUvarint(buf, reads[k])
+	}
+	return append(buf, encodeWALRecord(rec)[walHeaderSize:]...)
+}
+
+func decodeRaftCommand(p []byte) (map[string]uint64, walRecord, error) {
+	count, n := binary.Uvarint(p)
+	if n <= 0 || count > uint64(len(p)) {
+		return nil, walRecord{}, errBadRecord
+	}
+	p = p[n:]
+	reads := make(map[string]uint64, count)
+	for i := uint64(0); i < count; i++ {
+		key, rest, ok := readBytes(p)
+		if !ok {
+			return nil, walRecord{}, errBadRecord
+		}
+		version, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, walRecord{}, errBadRecord
+		}
+		reads[string(key)] = version
+		p = rest[n:]
+	}
+	rec, err := decodeWALRecord(p)
+	return reads, rec, err
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+)
+
+func entries(term uint64, from, to uint64) []raftEntry {
+	var ents []raftEntry
+	for i := from; i <= to; i++ {
+		ents = append(ents, raftEntry{Index: i, Term: term, Data: []byte{byte(i)}})
+	}
+	return ents
+}
+
+func TestRaftLogAppendAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	l, err := openRaftLog(dir, nil)
+	if err != nil {
+		t.Fatalf("openRaftLog() error = %v", err)
+	}
+	if err := l.append(entries(1, 1, 5)...); err != nil {
+		t.Fatalf("append() error = %v", err)
+	}
+	// A new leader replaces the uncommitted tail
+	if err := l.append(entries(2, 4, 6)...); err != nil {
+		t.Fatalf("append() over the tail error = %v", err)
+	}
+	if err := l.append(entries(2, 9, 9)...); err == nil {
+		t.Errorf("append() with a gap error = nil, want an error")
+	}
+	l.Close()
+
+	l, err = openRaftLog(dir, nil)
+	if err != nil {
+		t.Fatalf("openRaftLog() after reopen error = %v", err)
+	}
+	defer l.Close()
+	if l.lastIndex() != 6 || l.lastTerm() != 2 {
+		t.Fatalf("reopened log ends at %d/%d, want 6/2", l.lastIndex(), l.lastTerm())
+	}
+	for i, want := range []uint64{1, 1, 1, 2, 2, 2} {
+		if term, _ := l.term(uint64(i + 1)); term != want {
+			t.Errorf("term(%d) = %d, want %d", i+1, term, want)
+		}
+	}
+}
+
+func TestRaftLogTornTail(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := openRaftLog(dir, nil)
+	l.append(entries(1, 1, 3)...)
+	l.Close()
+
+	path := filepath.Join(dir, raftLogFile)
+	info, _ := os.Stat(path)
+	os.Truncate(path, info.Size()-2)
+
+	l, err := openRaftLog(dir, nil)
+	if err != nil {
+		t.Fatalf("openRaftLog() error = %v", err)
+	}
+	defer l.Close()
+	if l.lastIndex() != 2 {
+		t.Errorf("lastIndex() = %d, want 2 after dropping the torn entry", l.lastIndex())
+	}
+	if err := l.append(entries(1, 3, 3)...); err != nil {
+		t.Errorf("append() after recovery error = %v", err)
+	}
+}
+
+func TestRaftLogCompact(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := openRaftLog(dir, nil)
+	l.append(entries(1, 1, 10)...)
+	if err := l.compact(7); err != nil {
+		t.Fatalf("compact() error = %v", err)
+	}
+	if _, ok := l.term(6); ok {
+		t.Errorf("term(6) is still available after compacting to 7")
+	}
+	if got := l.slice(8, 20); len(got) != 3 || got[0].Index != 8 {
+		t.Errorf("slice(8, 20) = %v, want entries 8 to 10", got)
+	}
+	l.append(entries(2, 11, 11)...)
+	l.Close()
+
+	l, err := openRaftLog(dir, nil)
+	if err != nil {
+		t.Fatalf("openRaftLog() error = %v", err)
+	}
+	defer l.Close()
+	if term, ok := l.term(7); !ok || term != 1 {
+		t.Errorf("term(7) = %d, %v; want the compaction point in term 1", term, ok)
+	}
+	if l.lastIndex() != 11 || l.lastTerm() != 2 {
+		t.Errorf("reopened log ends at %d/%d, want 11/2", l.lastIndex(), l.lastTerm())
+	}
+
+	if err := l.restore(20, 3); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+	if l.lastIndex() != 20 || l.lastTerm() != 3 {
+		t.Errorf("restored log ends at %d/%d, want 20/3", l.lastIndex(), l.lastTerm())
+	}
+}
+
+func TestRaftStateRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	if hs, err := loadRaftState(dir); err != nil || hs.term != 0 {
+		t.Fatalf("loadRaftState() with no file = %v, %v; want the zero state", hs, err)
+	}
+	want := raftHardState{term: 7, votedFor: "n2", members: map[string]string{"n1": "a:1", "n2": "b:2"}}
+	if err := saveRaftState(dir, want); err != nil {
+		t.Fatalf("saveRaftState() error = %v", err)
+	}
+	got, err := loadRaftState(dir)
+	if err != nil {
+		t.Fatalf("loadRaftState() error = %v", err)
+	}
+	if got.term != 7 || got.votedFor != "n2" || len(got.members) != 2 || got.members["n2"] != "b:2" {
+		t.Errorf("loadRaftState() = %+v, want %+v", got, want)
+	}
+}
+
+func TestRaftCommandRoundTrip(t *testing.T) {
+	reads := map[string]uint64{"a": 3, "missing": 0}
+	rec := walRecord{Op: walOpTxn, Ops: []walRecord{
+		{Op: walOpSet, Key: "a", Value: "1", ExpiresAt: 42},
+		{Op: walOpDelete, Key: "b"},
+	}}
+	gotReads, gotRec, err := decodeRaftCommand(encodeRaftCommand(reads, rec))
+	if err != nil {
+		t.Fatalf("decodeRaftCommand() error = %v", err)
+	}
+	if len(gotReads) != 2 || gotReads["a"] != 3 {
+		t.Errorf("reads = %v, want %v", gotReads, reads)
+	}
+	if len(gotRec.Ops) != 2 || gotRec.Ops[0].ExpiresAt != 42 || gotRec.Ops[1].Key != "b" {
+		t.Errorf("record = %+v, want %+v", gotRec, rec)
+	}
+	if _, _, err := decodeRaftCommand([]byte{5}); err == nil {
+		t.Errorf("decodeRaftCommand() of garbage error = nil, want an error")
+	}
+
+	if _, e, _ := decodeRaftEntry(encodeRaftEntry(byte(pb.RaftEntry_CONFIG), raftEntry{Index: 1, Term: 1})[walHeaderSize:]); e.Type != pb.RaftEntry_CONFIG {
+		t.Errorf("decodeRaftEntry() type = %v, want CONFIG", e.Type)
+	}
+}
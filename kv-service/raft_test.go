@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// raftTestNode is a cluster-mode server served on a localhost port
+type raftTestNode struct {
+	id     string
+	addr   string
+	dir    string
+	server *kvServer
+	stop   func()
+}
+
+// clusterOptions shortens the Raft timeouts so that elections settle quickly
+func clusterOptions(id string, peers map[string]string) serverOptions {
+	return serverOptions{Raft: raftOptions{
+		ID:              id,
+		Peers:           peers,
+		Heartbeat:       10 * time.Millisecond,
+		ElectionTimeout: 100 * time.Millisecond,
+	}}
+}
+
+// startRaftNode opens a cluster-mode server in dir and serves it on lis. The
+// node is stopped when the test finishes, if not before.
+func startRaftNode(t *testing.T, id string, lis net.Listener, dir string, peers map[string]string) *raftTestNode {
+	t.Helper()
+	server, err := openKVServer(dir, clusterOptions(id, peers))
+	if err != nil {
+		t.Fatalf("openKVServer(%s) error = %v", id, err)
+	}
+	grpcServer := grpc.NewServer()
+	pb.RegisterKVStoreServer(grpcServer, server)
+	pb.RegisterKVAdminServer(grpcServer, server)
+	pb.RegisterKVRaftServer(grpcServer, server)
+	go grpcServer.Serve(lis)
+
+	var once sync.Once
+	n := &raftTestNode{id: id, addr: lis.Addr().String(), dir: dir, server: server}
+	n.stop = func() {
+		once.Do(func() {
+			server.shutdown()
+			grpcServer.Stop()
+			server.Close()
+		})
+	}
+	t.Cleanup(n.stop)
+	return n
+}
+
+func listen(t *testing.T, addr string) net.Listener {
+	t.Helper()
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	return lis
+}
+
+// startCluster starts n nodes that all start out as members
+func startCluster(t *testing.T, n int) []*raftTestNode {
+	t.Helper()
+	listeners := make([]net.Listener, n)
+	peers := make(map[string]string)
+	for i := range listeners {
+		listeners[i] = listen(t, "127.0.0.1:0")
+		peers[fmt.Sprintf("n%d", i+1)] = listeners[i].Addr().String()
+	}
+	nodes := make([]*raftTestNode, n)
+	for i, lis := range listeners {
+		nodes[i] = startRaftNode(t, fmt.Sprintf("n%d", i+1), lis, t.TempDir(), peers)
+	}
+	return nodes
+}
+
+// waitLeader waits until exactly one of nodes leads and returns it
+func waitLeader(t *testing.T, nodes []*raftTestNode) *raftTestNode {
+	t.Helper()
+	var leader *raftTestNode
+	waitFor(t, "a leader to be elected", func() bool {
+		leader = nil
+		for _, n := range nodes {
+			if n.server.raft.isLeader() {
+				if leader != nil {
+					return false
+				}
+				leader = n
+			}
+		}
+		return leader != nil
+	})
+	return leader
+}
+
+// waitApplied waits until every node has applied the log up to index
+func waitApplied(t *testing.T, nodes []*raftTestNode, index uint64) {
+	t.Helper()
+	for _, n := range nodes {
+		waitFor(t, fmt.Sprintf("%s to apply index %d", n.id, index), func() bool {
+			n.server.mu.RLock()
+			defer n.server.mu.RUnlock()
+			return n.server.rev >= index
+		})
+	}
+}
+
+func TestParseRaftPeers(t *testing.T) {
+	peers, err := parseRaftPeers("n1=kv-1:50051, n2=kv-2:50051,")
+	if err != nil {
+		t.Fatalf("parseRaftPeers() error = %v", err)
+	}
+	if len(peers) != 2 || peers["n1"] != "kv-1:50051" || peers["n2"] != "kv-2:50051" {
+		t.Errorf("parseRaftPeers() = %v", peers)
+	}
+	for _, bad := range []string{"n1", "=addr", "n1=a,n1=b"} {
+		if _, err := parseRaftPeers(bad); err == nil {
+			t.Errorf("parseRaftPeers(%q) error = nil, want an error", bad)
+		}
+	}
+}
+
+func TestRaftReplicatesWrites(t *testing.T) {
+	ctx := context.Background()
+	nodes := startCluster(t, 3)
+	leader := waitLeader(t, nodes)
+
+	leader.server.Set(ctx, &pb.SetRequest{Key: "a", Value: "1"})
+	leader.server.Set(ctx, &pb.SetRequest{Key: "b", Value: "2", TtlSeconds: 60})
+	leader.server.Delete(ctx, &pb.DeleteRequest{Key: "a"})
+	txn, err := leader.server.Txn(ctx, &pb.TxnRequest{Success: []*pb.TxnOp{
+		{Type: pb.TxnOp_PUT, Key: "c", Value: "3"},
+		{Type: pb.TxnOp_PUT, Key: "d", Value: "4"},
+	}})
+	if err != nil {
+		t.Fatalf("Txn() error = %v", err)
+	}
+
+	waitApplied(t, nodes, txn.Revision)
+	for _, n := range nodes {
+		for key, want := range map[string]string{"b": "2", "c": "3", "d": "4"} {
+			resp, _ := n.server.Get(ctx, &pb.GetRequest{Key: key})
+			if !resp.Found || resp.Value != want {
+				t.Errorf("%s Get(%s) = %v/%q, want %q", n.id, key, resp.Found, resp.Value, want)
+			}
+		}
+		if resp, _ := n.server.Get(ctx, &pb.GetRequest{Key: "a"}); resp.Found {
+			t.Errorf("%s Get(a) found = true, want false", n.id)
+		}
+		if resp, _ := n.server.Get(ctx, &pb.GetRequest{Key: "c"}); resp.Version != txn.Revision {
+			t.Errorf("%s Get(c) version = %d, want %d", n.id, resp.Version, txn.Revision)
+		}
+	}
+
+	for _, n := range nodes {
+		if n == leader {
+			continue
+		}
+		_, err := n.server.Set(ctx, &pb.SetRequest{Key: "x", Value: "y"})
+		st := status.Convert(err)
+		if st.Code() != codes.FailedPrecondition {
+			t.Fatalf("%s Set() error = %v, want FailedPrecondition", n.id, err)
+		}
+		var hint string
+		for _, d := range st.Details() {
+			if info, ok := d.(*errdetails.ErrorInfo); ok && info.Reason == notPrimaryReason {
+				hint = info.Metadata["primary"]
+			}
+		}
+		if hint != leader.addr {
+			t.Errorf("%s redirect hint = %q, want %q", n.id, hint, leader.addr)
+		}
+	}
+}
+
+func TestRaftLeaderFailover(t *testing.T) {
+	ctx := context.Background()
+	nodes := startCluster(t, 3)
+	leader := waitLeader(t, nodes)
+	first, err := leader.server.Set(ctx, &pb.SetRequest{Key: "a", Value: "1"})
+	if err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	leader.stop()
+	var rest []*raftTestNode
+	for _, n := range nodes {
+		if n != leader {
+			rest = append(rest, n)
+		}
+	}
+	next := waitLeader(t, rest)
+	waitApplied(t, rest, first.Version)
+	if resp, _ := next.server.Get(ctx, &pb.GetRequest{Key: "a"}); !resp.Found || resp.Version != first.Version {
+		t.Errorf("new leader Get(a) = %v@%d, want found at %d", resp.Found, resp.Version, first.Version)
+	}
+	second, err := next.server.Set(ctx, &pb.SetRequest{Key: "a", Value: "2"})
+	if err != nil {
+		t.Fatalf("Set() on new leader error = %v", err)
+	}
+
+	// The old leader rejoins as a follower and catches up from its own log
+	restarted := startRaftNode(t, leader.id, listen(t, leader.addr), leader.dir, nil)
+	waitApplied(t, []*raftTestNode{restarted}, second.Version)
+	if resp, _ := restarted.server.Get(ctx, &pb.GetRequest{Key: "a"}); resp.Value != "2" || resp.Version != second.Version {
+		t.Errorf("restarted node Get(a) = %q@%d, want \"2\"@%d", resp.Value, resp.Version, second.Version)
+	}
+}
+
+func TestRaftConditionalWritesRevalidate(t *testing.T) {
+	ctx := context.Background()
+	nodes := startCluster(t, 3)
+	leader := waitLeader(t, nodes)
+	set, _ := leader.server.Set(ctx, &pb.SetRequest{Key: "counter", Value: "0"})
+
+	// Every writer evaluates against the same version, but only the first
+	// entry to be applied may win
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		successes int
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := leader.server.CompareAndSet(ctx, &pb.CompareAndSetRequest{Key: "counter", Value: fmt.Sprint(i), ExpectedVersion: set.Version})
+			switch status.Code(err) {
+			case codes.OK:
+				mu.Lock()
+				successes++
+				mu.Unlock()
+			case codes.FailedPrecondition:
+			default:
+				t.Errorf("CompareAndSet() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if successes != 1 {
+		t.Errorf("%d conditional writes succeeded, want 1", successes)
+	}
+}
+
+func TestRaftEnforcesQuotasOnConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	nodes := startCluster(t, 3)
+	leader := waitLeader(t, nodes)
+	createNamespace(t, leader.server, "team", &pb.NamespaceSettings{MaxKeys: 3})
+
+	// Every writer is checked against the same usage before proposing, so
+	// only the check when entries are applied can hold the quota
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		successes int
+	)
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := leader.server.Set(ctx, &pb.SetRequest{Namespace: "team", Key: fmt.Sprintf("k%d", i), Value: "v"})
+			switch status.Code(err) {
+			case codes.OK:
+				mu.Lock()
+				successes++
+				mu.Unlock()
+			case codes.ResourceExhausted, codes.Aborted:
+			default:
+				t.Errorf("Set() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if successes != 3 {
+		t.Errorf("%d writes succeeded, want 3", successes)
+	}
+
+	leader.server.mu.RLock()
+	rev := leader.server.rev
+	leader.server.mu.RUnlock()
+	waitApplied(t, nodes, rev)
+	for _, n := range nodes {
+		resp, err := n.server.ListNamespaces(ctx, &pb.ListNamespacesRequest{})
+		if err != nil {
+			t.Fatalf("ListNamespaces() error = %v", err)
+		}
+		for _, ns := range resp.Namespaces {
+			if ns.Name == "team" && ns.Keys != 3 {
+				t.Errorf("%s namespace holds %d keys, want 3", n.id, ns.Keys)
+			}
+		}
+	}
+}
+
+func TestRaftMembershipChange(t *testing.T) {
+	ctx := context.Background()
+	nodes := startCluster(t, 1)
+	leader := waitLeader(t, nodes)
+	first, _ := leader.server.Set(ctx, &pb.SetRequest{Key: "a", Value: "1"})
+
+	// A joining node starts without peers and waits for the leader
+	lis := listen(t, "127.0.0.1:0")
+	joiner := startRaftNode(t, "n2", lis, t.TempDir(), nil)
+	resp, err := leader.server.AddMember(ctx, &pb.AddMemberRequest{Id: "n2", Address: joiner.addr})
+	if err != nil {
+		t.Fatalf("AddMember() error = %v", err)
+	}
+	if len(resp.Members) != 2 {
+		t.Errorf("AddMember() members = %v, want 2", resp.Members)
+	}
+	if _, err := leader.server.AddMember(ctx, &pb.AddMemberRequest{Id: "n2", Address: joiner.addr}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("AddMember() twice error = %v, want AlreadyExists", err)
+	}
+
+	second, err := leader.server.Set(ctx, &pb.SetRequest{Key: "b", Value: "2"})
+	if err != nil {
+		t.Fatalf("Set() with two members error = %v", err)
+	}
+	waitApplied(t, []*raftTestNode{joiner}, second.Version)
+	if got, _ := joiner.server.Get(ctx, &pb.GetRequest{Key: "a"}); got.Version != first.Version {
+		t.Errorf("joiner Get(a) version = %d, want %d", got.Version, first.Version)
+	}
+
+	cs, _ := leader.server.ClusterStatus(ctx, &pb.ClusterStatusRequest{})
+	if cs.State != "leader" || len(cs.Members) != 2 {
+		t.Errorf("ClusterStatus() = %v, want a leader with two members", cs)
+	}
+	waitFor(t, "joiner to report the leader", func() bool {
+		s, _ := joiner.server.ClusterStatus(ctx, &pb.ClusterStatusRequest{})
+		return s.State == "follower" && s.LeaderAddress == leader.addr && len(s.Members) == 2
+	})
+
+	if _, err := leader.server.RemoveMember(ctx, &pb.RemoveMemberRequest{Id: "n2"}); err != nil {
+		t.Fatalf("RemoveMember() error = %v", err)
+	}
+	joiner.stop()
+	if _, err := leader.server.Set(ctx, &pb.SetRequest{Key: "c", Value: "3"}); err != nil {
+		t.Errorf("Set() after removing n2 error = %v", err)
+	}
+}
+
+func TestRaftSnapshotCatchUp(t *testing.T) {
+	ctx := context.Background()
+	nodes := startCluster(t, 1)
+	leader := waitLeader(t, nodes)
+	for i := 0; i < 600; i++ {
+		leader.server.Set(ctx, &pb.SetRequest{Key: fmt.Sprintf("key-%03d", i), Value: "v"})
+	}
+	if err := leader.server.snapshot(); err != nil {
+		t.Fatalf("snapshot() error = %v", err)
+	}
+	leader.server.raft.mu.Lock()
+	compacted := leader.server.raft.log.snapIndex
+	leader.server.raft.mu.Unlock()
+	if compacted == 0 {
+		t.Fatalf("raft log was not compacted")
+	}
+
+	joiner := startRaftNode(t, "n2", listen(t, "127.0.0.1:0"), t.TempDir(), nil)
+	if _, err := leader.server.AddMember(ctx, &pb.AddMemberRequest{Id: "n2", Address: joiner.addr}); err != nil {
+		t.Fatalf("AddMember() error = %v", err)
+	}
+	last, err := leader.server.Set(ctx, &pb.SetRequest{Key: "after", Value: "snapshot"})
+	if err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	waitApplied(t, []*raftTestNode{joiner}, last.Version)
+	joiner.server.mu.RLock()
+	n := joiner.server.engine.len()
+	joiner.server.mu.RUnlock()
+	if n != 601 {
+		t.Errorf("joiner has %d keys, want 601", n)
+	}
+}
+
+func TestRaftRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	lis := listen(t, "127.0.0.1:0")
+	addr := lis.Addr().String()
+	peers := map[string]string{"n1": addr}
+
+	node := startRaftNode(t, "n1", lis, dir, peers)
+	waitLeader(t, []*raftTestNode{node})
+	node.server.Set(ctx, &pb.SetRequest{Key: "a", Value: "1"})
+	if err := node.server.snapshot(); err != nil {
+		t.Fatalf("snapshot() error = %v", err)
+	}
+	node.server.Set(ctx, &pb.SetRequest{Key: "b", Value: "2"})
+	last, _ := node.server.Delete(ctx, &pb.DeleteRequest{Key: "a"})
+	if !last.Success {
+		t.Fatalf("Delete() = %v", last)
+	}
+	node.server.mu.RLock()
+	rev := node.server.rev
+	node.server.mu.RUnlock()
+	node.stop()
+
+	// The snapshot is loaded at once, and the rest of the log is applied
+	// once the node is elected again and commits it
+	node = startRaftNode(t, "n1", listen(t, addr), dir, peers)
+	waitLeader(t, []*raftTestNode{node})
+	waitApplied(t, []*raftTestNode{node}, rev)
+	if resp, _ := node.server.Get(ctx, &pb.GetRequest{Key: "a"}); resp.Found {
+		t.Errorf("Get(a) after restart found = true, want false")
+	}
+	if resp, _ := node.server.Get(ctx, &pb.GetRequest{Key: "b"}); resp.Value != "2" {
+		t.Errorf("Get(b) after restart = %q, want \"2\"", resp.Value)
+	}
+}
+
+func TestRaftSweepsExpiredKeys(t *testing.T) {
+	ctx := context.Background()
+	nodes := startCluster(t, 3)
+	leader := waitLeader(t, nodes)
+	leader.server.Set(ctx, &pb.SetRequest{Key: "short", Value: "1", TtlSeconds: 60})
+	last, _ := leader.server.Set(ctx, &pb.SetRequest{Key: "long", Value: "2"})
+	waitApplied(t, nodes, last.Version)
+
+	later := func() time.Time { return time.Now().Add(2 * time.Hour) }
+	for _, n := range nodes {
+		n.server.mu.Lock()
+		n.server.now = later
+		n.server.mu.Unlock()
+	}
+
+	// Followers leave expired keys to the leader
+	for _, n := range nodes {
+		if n != leader && n.server.sweepExpired() != 0 {
+			t.Errorf("%s sweepExpired() removed keys on a follower", n.id)
+		}
+	}
+	if n := leader.server.sweepExpired(); n != 1 {
+		t.Fatalf("leader sweepExpired() = %d, want 1", n)
+	}
+	leader.server.mu.RLock()
+	rev := leader.server.rev
+	leader.server.mu.RUnlock()
+	waitApplied(t, nodes, rev)
+	for _, n := range nodes {
+		n.server.mu.RLock()
+		_, short, _ := n.server.engine.get("short")
+		_, long, _ := n.server.engine.get("long")
+		n.server.mu.RUnlock()
+		if short || !long {
+			t.Errorf("%s store has short=%v long=%v, want only long", n.id, short, long)
+		}
+	}
+}
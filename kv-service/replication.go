@@ -0,0 +1,519 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// replicationHeartbeat is how often an idle primary tells its followers
+	// its latest revision
+	replicationHeartbeat = time.Second
+	// replicationRetry is how long a follower waits before reconnecting
+	replicationRetry = time.Second
+	// snapshotChunkSize bounds the number of keys per snapshot message, and
+	// snapshotChunkBytes the size of their values
+	snapshotChunkSize  = 256
+	snapshotChunkBytes = 1 << 20
+
+	// notPrimaryReason is the ErrorInfo reason attached to writes rejected by
+	// a follower; the primary's address is in its "primary" metadata
+	notPrimaryReason = "NOT_PRIMARY"
+)
+
+// replication tracks the followers streaming from a primary, or a follower's
+// view of its primary. It has its own lock so that acknowledgements never
+// contend with the store.
+type replication struct {
+	mu        sync.Mutex
+	followers map[string]*followerProgress
+
+	connected  bool
+	primaryRev uint64
+}
+
+// followerProgress is what a primary knows about one connected follower
+type followerProgress struct {
+	id      string
+	addr    string
+	applied uint64
+	lastAck time.Time
+}
+
+// checkWritable rejects a write on a follower with FailedPrecondition and an
+// ErrorInfo detail naming the primary, or the Raft leader in cluster mode, so
+// clients can redirect the write
+func (s *kvServer) checkWritable() error {
+	if s.raft != nil {
+		return s.raft.checkLeader()
+	}
+	if s.replicaOf == "" {
+		return nil
+	}
+	return notPrimaryError(fmt.Sprintf("this node is a read-only follower; send writes to the primary at %s", s.replicaOf), s.replicaOf)
+}
+
+// notPrimaryError builds the FailedPrecondition error for a write sent to a
+// node that does not accept writes, naming the node that does
+func notPrimaryError(msg, primary string) error {
+	st := status.New(codes.FailedPrecondition, msg)
+	if detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   notPrimaryReason,
+		Domain:   "kvstore",
+		Metadata: map[string]string{"primary": primary},
+	}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// mutationOps maps WAL ops to their replication form and back
+var mutationOps = map[byte]pb.Mutation_Op{
+	walOpSet:    pb.Mutation_SET,
+	walOpDelete: pb.Mutation_DELETE,
+	walOpExpire: pb.Mutation_EXPIRE,
+}
+
+// replicationMessage converts a logged record into a replication message
+func replicationMessage(rec walRecord, primaryRev uint64) *pb.ReplicateResponse {
+	ops := []walRecord{rec}
+	if rec.Op == walOpTxn {
+		ops = rec.Ops
+	}
+	msg := &pb.ReplicateResponse{Revision: rec.Seq, PrimaryRevision: primaryRev}
+	for _, op := range ops {
+		msg.Mutations = append(msg.Mutations, &pb.Mutation{
+			Op:          mutationOps[op.Op],
+			Key:         op.Key,
+			Value:       []byte(op.Value),
+			ExpiresAt:   op.ExpiresAt,
+			Version:     op.Version,
+			ContentType: op.ContentType,
+		})
+	}
+	return msg
+}
+
+// replicatedRecord converts a replication message back into a record. A
+// message with several mutations becomes a transaction.
+func replicatedRecord(msg *pb.ReplicateResponse) (walRecord, error) {
+	ops := make([]walRecord, len(msg.Mutations))
+	for i, m := range msg.Mutations {
+		op := walRecord{Seq: msg.Revision, Key: m.Key, Value: string(m.Value), ExpiresAt: m.ExpiresAt, ContentType: m.ContentType, Version: m.Version}
+		for walOp, mutOp := range mutationOps {
+			if mutOp == m.Op {
+				op.Op = walOp
+			}
+		}
+		if op.Op == 0 {
+			return walRecord{}, fmt.Errorf("unknown mutation op %v", m.Op)
+		}
+		ops[i] = op
+	}
+	if len(ops) == 1 {
+		return ops[0], nil
+	}
+	return walRecord{Op: walOpTxn, Seq: msg.Revision, Ops: ops}, nil
+}
+
+// Replicate streams the mutation log to a follower from the revision it asks
+// for. A follower that asks for a revision no longer in the change feed first
+// receives a full copy of the store. Acknowledgements from the follower are
+// recorded for ReplicationStatus.
+func (s *kvServer) Replicate(stream grpc.BidiStreamingServer[pb.ReplicateRequest, pb.ReplicateResponse]) error {
+	if s.raft != nil {
+		return status.Errorf(codes.FailedPrecondition, "asynchronous replication is not available in cluster mode")
+	}
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	hello, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if hello.FollowerId == "" {
+		return status.Errorf(codes.InvalidArgument, "follower_id is required")
+	}
+	next := max(hello.StartRevision, 1)
+
+	s.rlockAll()
+	rev := s.rev
+	s.runlockAll()
+	if next > rev+1 {
+		return status.Errorf(codes.FailedPrecondition, "follower %s starts at revision %d but the primary is only at %d", hello.FollowerId, next, rev)
+	}
+
+	var addr string
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		addr = p.Addr.String()
+	}
+	f := s.repl.register(hello.FollowerId, addr, next-1)
+	defer s.repl.unregister(f)
+	log.Printf("Replicate follower=%s addr=%s from revision %d", f.id, addr, next)
+
+	acks := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				acks <- err
+				return
+			}
+			s.repl.ack(f, req.AppliedRevision)
+		}
+	}()
+
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		s.rlockAll()
+		if s.checkRetained(next) != nil {
+			// The follower is too far behind for the feed, so send it the
+			// whole store instead
+			store, err := s.engine.snapshot()
+			rev := s.rev
+			s.runlockAll()
+			if err != nil {
+				return status.Errorf(codes.Internal, "failed to snapshot the store: %v", err)
+			}
+			err = sendSnapshot(stream, rev, store)
+			store.release()
+			if err != nil {
+				return err
+			}
+			log.Printf("Replicate follower=%s sent snapshot at revision %d with %d keys", f.id, rev, store.len())
+			next = rev + 1
+			continue
+		}
+		events := s.feed.since(next, watchBatchSize)
+		notify := s.feed.notify
+		primaryRev := s.rev
+		s.runlockAll()
+
+		for _, rec := range events {
+			next = rec.Seq + 1
+			if err := stream.Send(replicationMessage(rec, primaryRev)); err != nil {
+				return err
+			}
+		}
+		if len(events) > 0 {
+			continue
+		}
+
+		select {
+		case <-notify:
+		case <-heartbeat.C:
+			if err := stream.Send(&pb.ReplicateResponse{PrimaryRevision: primaryRev}); err != nil {
+				return err
+			}
+		case err := <-acks:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case <-s.stop:
+			return status.Errorf(codes.Unavailable, "server is shutting down")
+		}
+	}
+}
+
+// sendSnapshot sends store as a run of snapshot chunks at rev
+func sendSnapshot(stream grpc.BidiStreamingServer[pb.ReplicateRequest, pb.ReplicateResponse], rev uint64, store entrySource) error {
+	return snapshotChunks(store, func(muts []*pb.Mutation, done bool) error {
+		return stream.Send(&pb.ReplicateResponse{
+			Revision:        rev,
+			Snapshot:        true,
+			SnapshotDone:    done,
+			PrimaryRevision: rev,
+			Mutations:       muts,
+		})
+	})
+}
+
+// snapshotChunks walks src in key order and calls send with runs of up to
+// snapshotChunkSize SET mutations, cut short once their values reach
+// snapshotChunkBytes. The last call, which is made even for an
+// empty source, has done set.
+func snapshotChunks(src entrySource, send func(muts []*pb.Mutation, done bool) error) error {
+	total, sent, size := src.len(), 0, 0
+	var (
+		chunk   []*pb.Mutation
+		sendErr error
+	)
+	err := src.ascend("", func(k string, e entry) bool {
+		chunk = append(chunk, &pb.Mutation{
+			Op:          pb.Mutation_SET,
+			Key:         k,
+			Value:       []byte(e.value),
+			ExpiresAt:   e.expiresAt,
+			Version:     e.version,
+			ContentType: e.contentType,
+		})
+		size += len(e.value)
+		if (len(chunk) < snapshotChunkSize && size < snapshotChunkBytes) || sent+len(chunk) == total {
+			return true
+		}
+		sent += len(chunk)
+		sendErr = send(chunk, false)
+		chunk, size = nil, 0
+		return sendErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if sendErr != nil {
+		return sendErr
+	}
+	return send(chunk, true)
+}
+
+// followLoop replicates from the primary until the server shuts down,
+// reconnecting after errors
+func (s *kvServer) followLoop(primary string) {
+	defer s.loops.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	conn, err := grpc.NewClient(primary, s.peerDialOptions()...)
+	if err != nil {
+		log.Printf("Replication: invalid primary address %q: %v", primary, err)
+		return
+	}
+	defer conn.Close()
+	client := pb.NewKVReplicationClient(conn)
+
+	for {
+		err := s.follow(ctx, client)
+		s.repl.mu.Lock()
+		s.repl.connected = false
+		s.repl.mu.Unlock()
+
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		log.Printf("Replication from %s interrupted: %v; retrying in %v", primary, err, replicationRetry)
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(replicationRetry):
+		}
+	}
+}
+
+// follow runs a single replication stream, applying every record it receives
+// and acknowledging each one once it is durable
+func (s *kvServer) follow(ctx context.Context, client pb.KVReplicationClient) error {
+	stream, err := client.Replicate(ctx)
+	if err != nil {
+		return err
+	}
+	s.rlockAll()
+	start := s.rev + 1
+	s.runlockAll()
+	if err := stream.Send(&pb.ReplicateRequest{FollowerId: s.nodeID, StartRevision: start}); err != nil {
+		return err
+	}
+
+	var staged map[string]entry
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		s.repl.mu.Lock()
+		s.repl.connected = true
+		s.repl.primaryRev = msg.PrimaryRevision
+		s.repl.mu.Unlock()
+
+		switch {
+		case msg.Snapshot:
+			if staged == nil {
+				staged = make(map[string]entry)
+			}
+			for _, m := range msg.Mutations {
+				staged[m.Key] = entry{value: string(m.Value), expiresAt: m.ExpiresAt, version: m.Version, contentType: m.ContentType}
+			}
+			if !msg.SnapshotDone {
+				continue
+			}
+			if err := s.installSnapshot(msg.Revision, staged); err != nil {
+				return err
+			}
+			log.Printf("Replication: installed snapshot at revision %d with %d keys", msg.Revision, len(staged))
+			staged = nil
+		case len(msg.Mutations) > 0:
+			rec, err := replicatedRecord(msg)
+			if err != nil {
+				return err
+			}
+			if err := s.applyReplicated(rec); err != nil {
+				return err
+			}
+		}
+
+		s.rlockAll()
+		applied := s.rev
+		s.runlockAll()
+		if err := stream.Send(&pb.ReplicateRequest{AppliedRevision: applied}); err != nil {
+			return err
+		}
+	}
+}
+
+// applyReplicated logs and applies a record received from the primary. The
+// record keeps the primary's revision, so the follower's log mirrors the
+// primary's.
+func (s *kvServer) applyReplicated(rec walRecord) error {
+	want := rec.Seq
+	s.mu.Lock()
+	if want != s.rev+1 {
+		s.mu.Unlock()
+		return fmt.Errorf("replication gap: received revision %d after %d", want, s.rev)
+	}
+	if err := s.logMutation(&rec); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if rec.Seq != want {
+		s.mu.Unlock()
+		return fmt.Errorf("replicated revision %d was logged at %d", want, rec.Seq)
+	}
+	s.apply(rec)
+	s.mu.Unlock()
+
+	return s.waitDurable(rec.Seq)
+}
+
+// installSnapshot replaces the store with a copy of the primary's or
+// leader's store at rev. The copy is written to disk as a snapshot before the
+// log skips ahead, so a restart resumes from rev.
+func (s *kvServer) installSnapshot(rev uint64, store map[string]entry) error {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+
+	if s.dir != "" {
+		if _, err := writeSnapshot(s.dir, rev, entriesOf(store), s.keys); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	if s.wal != nil {
+		if err := s.wal.skipTo(rev); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	if err := s.load(store, rev); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.rev = rev
+	s.feed.reset()
+	s.mu.Unlock()
+
+	if s.dir == "" {
+		return nil
+	}
+	oldest, err := pruneSnapshots(s.dir, s.snapOpts.Retain)
+	if err != nil || s.wal == nil {
+		return err
+	}
+	return s.wal.removeBefore(oldest)
+}
+
+func (r *replication) register(id, addr string, applied uint64) *followerProgress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.followers == nil {
+		r.followers = make(map[string]*followerProgress)
+	}
+	f := &followerProgress{id: id, addr: addr, applied: applied, lastAck: time.Now()}
+	// A reconnecting follower replaces its previous stream
+	r.followers[id] = f
+	return f
+}
+
+func (r *replication) unregister(f *followerProgress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.followers[f.id] == f {
+		delete(r.followers, f.id)
+	}
+}
+
+func (r *replication) ack(f *followerProgress, applied uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f.applied = applied
+	f.lastAck = time.Now()
+}
+
+// ReplicationStatus reports this node's role and replication progress. On a
+// primary it lists every connected follower with its lag in revisions.
+func (s *kvServer) ReplicationStatus(ctx context.Context, req *pb.ReplicationStatusRequest) (*pb.ReplicationStatusResponse, error) {
+	if s.raft != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "this node runs in cluster mode; use ClusterStatus")
+	}
+	s.rlockAll()
+	rev := s.rev
+	s.runlockAll()
+
+	s.repl.mu.Lock()
+	defer s.repl.mu.Unlock()
+
+	if s.replicaOf != "" {
+		resp := &pb.ReplicationStatusResponse{
+			Role:            "follower",
+			Revision:        rev,
+			Primary:         s.replicaOf,
+			Connected:       s.repl.connected,
+			PrimaryRevision: s.repl.primaryRev,
+		}
+		if s.repl.primaryRev > rev {
+			resp.Lag = s.repl.primaryRev - rev
+		}
+		return resp, nil
+	}
+
+	resp := &pb.ReplicationStatusResponse{Role: "primary", Revision: rev}
+	for _, f := range s.repl.followers {
+		fs := &pb.FollowerStatus{
+			Id:              f.id,
+			Address:         f.addr,
+			AppliedRevision: f.applied,
+			LastAckUnixMs:   f.lastAck.UnixMilli(),
+		}
+		if rev > f.applied {
+			fs.Lag = rev - f.applied
+		}
+		resp.Followers = append(resp.Followers, fs)
+	}
+	sort.Slice(resp.Followers, func(i, j int) bool { return resp.Followers[i].Id < resp.Followers[j].Id })
+	return resp, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pranavmerugu/censys-take-home/mtls"
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// startNode opens a server in its own data dir and serves it on a localhost
+// port. The node is stopped when the test finishes.
+func startNode(t *testing.T, dir string, opts serverOptions) (*kvServer, string) {
+	t.Helper()
+	server, err := openKVServer(dir, opts)
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	grpcServer := grpc.NewServer(server.grpcServerOptions()...)
+	pb.RegisterKVStoreServer(grpcServer, server)
+	pb.RegisterKVReplicationServer(grpcServer, server)
+	pb.RegisterKVAdminServer(grpcServer, server)
+	go grpcServer.Serve(lis)
+
+	t.Cleanup(func() {
+		server.shutdown()
+		grpcServer.Stop()
+		server.Close()
+	})
+	return server, lis.Addr().String()
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func followerOptions(primary, id string) serverOptions {
+	return serverOptions{WAL: walOptions{Sync: syncAlways}, ReplicaOf: primary, NodeID: id}
+}
+
+func TestReplicationStreamsWrites(t *testing.T) {
+	ctx := context.Background()
+	primary, addr := startNode(t, t.TempDir(), serverOptions{WAL: walOptions{Sync: syncAlways}})
+	followers := []*kvServer{}
+	for i := 0; i < 2; i++ {
+		f, _ := startNode(t, t.TempDir(), followerOptions(addr, fmt.Sprintf("follower-%d", i)))
+		followers = append(followers, f)
+	}
+
+	primary.Set(ctx, &pb.SetRequest{Key: "a", Value: "1"})
+	primary.Set(ctx, &pb.SetRequest{Key: "b", Value: "2", TtlSeconds: 60})
+	primary.Delete(ctx, &pb.DeleteRequest{Key: "a"})
+	txn, _ := primary.Txn(ctx, &pb.TxnRequest{Success: []*pb.TxnOp{
+		{Type: pb.TxnOp_PUT, Key: "c", Value: "3"},
+		{Type: pb.TxnOp_PUT, Key: "d", Value: "4"},
+	}})
+
+	for i, f := range followers {
+		waitFor(t, fmt.Sprintf("follower %d to catch up", i), func() bool {
+			f.mu.RLock()
+			defer f.mu.RUnlock()
+			return f.rev == txn.Revision
+		})
+		for key, want := range map[string]string{"b": "2", "c": "3", "d": "4"} {
+			resp, _ := f.Get(ctx, &pb.GetRequest{Key: key})
+			if !resp.Found || resp.Value != want {
+				t.Errorf("follower %d Get(%s) = %v/%q, want %q", i, key, resp.Found, resp.Value, want)
+			}
+		}
+		resp, _ := f.Get(ctx, &pb.GetRequest{Key: "a"})
+		if resp.Found {
+			t.Errorf("follower %d Get(a) found = true, want false", i)
+		}
+		resp, _ = f.Get(ctx, &pb.GetRequest{Key: "c"})
+		if resp.Version != txn.Revision {
+			t.Errorf("follower %d Get(c) version = %d, want %d", i, resp.Version, txn.Revision)
+		}
+		ttl, _ := f.GetTTL(ctx, &pb.GetTTLRequest{Key: "b"})
+		if !ttl.Found || ttl.TtlSeconds <= 0 {
+			t.Errorf("follower %d GetTTL(b) = %v, want a positive TTL", i, ttl)
+		}
+	}
+}
+
+func TestFollowerRejectsWrites(t *testing.T) {
+	ctx := context.Background()
+	_, addr := startNode(t, t.TempDir(), serverOptions{})
+	follower, _ := startNode(t, t.TempDir(), followerOptions(addr, "follower"))
+
+	_, err := follower.Set(ctx, &pb.SetRequest{Key: "a", Value: "1"})
+	st := status.Convert(err)
+	if st.Code() != codes.FailedPrecondition {
+		t.Fatalf("follower Set() error = %v, want FailedPrecondition", err)
+	}
+	var hint string
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Reason == notPrimaryReason {
+			hint = info.Metadata["primary"]
+		}
+	}
+	if hint != addr {
+		t.Errorf("redirect hint = %q, want %q", hint, addr)
+	}
+
+	_, err = follower.Txn(ctx, &pb.TxnRequest{Success: []*pb.TxnOp{{Type: pb.TxnOp_DELETE, Key: "a"}}})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("follower Txn() with writes error = %v, want FailedPrecondition", err)
+	}
+	if _, err := follower.Txn(ctx, &pb.TxnRequest{Success: []*pb.TxnOp{{Type: pb.TxnOp_GET, Key: "a"}}}); err != nil {
+		t.Errorf("follower read-only Txn() error = %v", err)
+	}
+}
+
+func TestFollowerCatchesUpFromSnapshot(t *testing.T) {
+	ctx := context.Background()
+	// The primary's change feed is too short to replay its history
+	primary, addr := startNode(t, t.TempDir(), serverOptions{WatchHistory: 4})
+	for i := 0; i < 600; i++ {
+		primary.Set(ctx, &pb.SetRequest{Key: fmt.Sprintf("key-%03d", i), Value: "v"})
+	}
+
+	dir := t.TempDir()
+	follower, err := openKVServer(dir, followerOptions(addr, "follower"))
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	last, _ := primary.Set(ctx, &pb.SetRequest{Key: "after", Value: "snapshot"})
+	waitFor(t, "follower to catch up", func() bool {
+		follower.mu.RLock()
+		defer follower.mu.RUnlock()
+		return follower.rev == last.Version
+	})
+	if n := follower.engine.len(); n != 601 {
+		t.Errorf("follower has %d keys, want 601", n)
+	}
+	if err := follower.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// A restarted follower resumes from its own snapshot and log
+	primary.Delete(ctx, &pb.DeleteRequest{Key: "key-000"})
+	follower, _ = startNode(t, dir, followerOptions(addr, "follower"))
+	waitFor(t, "restarted follower to catch up", func() bool {
+		resp, _ := follower.Get(ctx, &pb.GetRequest{Key: "key-000"})
+		return !resp.Found
+	})
+	resp, _ := follower.Get(ctx, &pb.GetRequest{Key: "after"})
+	if !resp.Found || resp.Version != last.Version {
+		t.Errorf("restarted follower Get(after) = %v@%d, want found at %d", resp.Found, resp.Version, last.Version)
+	}
+}
+
+func TestReplicationStatus(t *testing.T) {
+	ctx := context.Background()
+	primary, addr := startNode(t, t.TempDir(), serverOptions{})
+	follower, _ := startNode(t, t.TempDir(), followerOptions(addr, "replica-1"))
+
+	set, _ := primary.Set(ctx, &pb.SetRequest{Key: "a", Value: "1"})
+	waitFor(t, "follower to acknowledge", func() bool {
+		resp, _ := primary.ReplicationStatus(ctx, &pb.ReplicationStatusRequest{})
+		return len(resp.Followers) == 1 && resp.Followers[0].AppliedRevision == set.Version
+	})
+
+	resp, _ := primary.ReplicationStatus(ctx, &pb.ReplicationStatusRequest{})
+	if resp.Role != "primary" || resp.Followers[0].Id != "replica-1" || resp.Followers[0].Lag != 0 {
+		t.Errorf("primary ReplicationStatus() = %v, want replica-1 with no lag", resp)
+	}
+
+	resp, _ = follower.ReplicationStatus(ctx, &pb.ReplicationStatusRequest{})
+	if resp.Role != "follower" || resp.Primary != addr || !resp.Connected || resp.Revision != set.Version {
+		t.Errorf("follower ReplicationStatus() = %v, want connected to %s at revision %d", resp, addr, set.Version)
+	}
+}
+
+// Values larger than gRPC's default message size still reach followers, both
+// live and in a snapshot
+func TestReplicationOfLargeValues(t *testing.T) {
+	ctx := context.Background()
+	primary, addr := startNode(t, t.TempDir(), serverOptions{WatchHistory: 4})
+	large := strings.Repeat("x", 5<<20)
+	primary.Set(ctx, &pb.SetRequest{Key: "before", Value: large})
+	for i := 0; i < 4; i++ {
+		primary.Set(ctx, &pb.SetRequest{Key: fmt.Sprintf("key-%d", i), Value: "v"})
+	}
+
+	follower, _ := startNode(t, t.TempDir(), followerOptions(addr, "follower"))
+	last, _ := primary.Set(ctx, &pb.SetRequest{Key: "after", Value: large})
+	waitFor(t, "follower to catch up", func() bool {
+		resp, _ := follower.Get(ctx, &pb.GetRequest{Key: "after"})
+		return resp.Version == last.Version
+	})
+	resp, _ := follower.Get(ctx, &pb.GetRequest{Key: "before"})
+	if len(resp.Value) != len(large) {
+		t.Errorf("follower Get(before) has %d bytes, want %d", len(resp.Value), len(large))
+	}
+}
+
+func TestSnapshotChunksBoundValueBytes(t *testing.T) {
+	eng := newMemoryEngine()
+	value := strings.Repeat("x", snapshotChunkBytes/2+1)
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		eng.put(k, entry{value: value, version: 1})
+	}
+	var sizes []int
+	snapshotChunks(eng, func(muts []*pb.Mutation, done bool) error {
+		sizes = append(sizes, len(muts))
+		return nil
+	})
+	if fmt.Sprint(sizes) != "[2 2 1]" {
+		t.Errorf("snapshot chunk sizes = %v, want [2 2 1]", sizes)
+	}
+}
+
+// loadDevCerts writes development certificates for names to dir and loads
+// the one for name
+func loadDevCerts(t *testing.T, dir, name string) *mtls.Reloader {
+	t.Helper()
+	if err := mtls.WriteDevCerts(dir, name); err != nil {
+		t.Fatalf("WriteDevCerts() error = %v", err)
+	}
+	r, err := mtls.Load(mtls.Files{
+		Cert: filepath.Join(dir, name+".pem"),
+		Key:  filepath.Join(dir, name+"-key.pem"),
+		CA:   filepath.Join(dir, "ca.pem"),
+	})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	return r
+}
+
+func TestReplicationOverMutualTLS(t *testing.T) {
+	ctx := context.Background()
+	certs := t.TempDir()
+	primary, addr := startNode(t, t.TempDir(), serverOptions{WAL: walOptions{Sync: syncAlways}, TLS: loadDevCerts(t, certs, "primary")})
+	opts := followerOptions(addr, "follower")
+	opts.TLS = loadDevCerts(t, certs, "follower")
+	follower, _ := startNode(t, t.TempDir(), opts)
+
+	resp, _ := primary.Set(ctx, &pb.SetRequest{Key: "a", Value: "1"})
+	waitFor(t, "follower to catch up", func() bool {
+		follower.mu.RLock()
+		defer follower.mu.RUnlock()
+		return follower.rev == resp.Version
+	})
+
+	call := func(creds grpc.DialOption) error {
+		conn, err := grpc.NewClient(addr, creds)
+		if err != nil {
+			t.Fatalf("NewClient() error = %v", err)
+		}
+		defer conn.Close()
+		cctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		_, err = pb.NewKVStoreClient(conn).Get(cctx, &pb.GetRequest{Key: "a"})
+		return err
+	}
+	if err := call(grpc.WithTransportCredentials(loadDevCerts(t, certs, "client").Credentials())); err != nil {
+		t.Errorf("Get() with a certificate from the CA error = %v", err)
+	}
+	if err := call(grpc.WithTransportCredentials(insecure.NewCredentials())); status.Code(err) != codes.Unavailable {
+		t.Errorf("Get() over plaintext error = %v, want %v", err, codes.Unavailable)
+	}
+	if err := call(grpc.WithTransportCredentials(loadDevCerts(t, t.TempDir(), "client").Credentials())); status.Code(err) != codes.Unavailable {
+		t.Errorf("Get() with a certificate from another CA error = %v, want %v", err, codes.Unavailable)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// scanBatchSize bounds how many keys a scan collects per acquisition of the
+// read lock, so a long scan to a slow client never holds off writers
+const scanBatchSize = 256
+
+// scanItem is a key-value pair collected by a scan
+type scanItem struct {
+	key string
+	entry
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or "" if there is none
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+// scanRange converts a scan request into a half-open range [start, end) of
+// the stored keys of namespace n, where an empty end is unbounded
+func scanRange(n *namespace, req *pb.ScanRequest) (string, string) {
+	start, end := req.StartKey, req.EndKey
+	if req.Prefix != "" {
+		if start < req.Prefix {
+			start = req.Prefix
+		}
+		if pe := prefixEnd(req.Prefix); pe != "" && (end == "" || pe < end) {
+			end = pe
+		}
+	}
+	if n.prefix == "" {
+		// Skip the keys of other namespaces, which sort first
+		return max(start, reservedEnd), end
+	}
+	if end == "" {
+		return n.key(start), prefixEnd(n.prefix)
+	}
+	return n.key(start), n.key(end)
+}
+
+// scanBatch collects up to n live keys in [start, end) in order using a read lock
+func (s *kvServer) scanBatch(start, end string, n int) ([]scanItem, error) {
+	s.rlockAll()
+	defer s.runlockAll()
+
+	now := s.now().UnixNano()
+	items := make([]scanItem, 0, n)
+	err := s.engine.ascend(start, func(key string, e entry) bool {
+		if end != "" && key >= end {
+			return false
+		}
+		if !e.expired(now) {
+			items = append(items, scanItem{key: key, entry: e})
+		}
+		return len(items) < n
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to scan keys: %v", err)
+	}
+	return items, nil
+}
+
+// Scan streams the key-value pairs in the requested range in lexicographic
+// order. Keys are read in batches, so the result reflects each batch at the
+// time it was read rather than a single point in time.
+func (s *kvServer) Scan(req *pb.ScanRequest, stream grpc.ServerStreamingServer[pb.ScanResponse]) error {
+	if req.Limit < 0 {
+		return status.Errorf(codes.InvalidArgument, "limit must not be negative")
+	}
+	ns, err := s.namespace(req.Namespace)
+	if err != nil {
+		return err
+	}
+	start, end := scanRange(ns, req)
+
+	sent := int64(0)
+	for {
+		n := scanBatchSize
+		if req.Limit > 0 && req.Limit-sent < int64(n) {
+			n = int(req.Limit - sent)
+		}
+		if n == 0 {
+			break
+		}
+
+		if err := stream.Context().Err(); err != nil {
+			return status.FromContextError(err).Err()
+		}
+		items, err := s.scanBatch(start, end, n)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err := stream.Send(&pb.ScanResponse{
+				Key:         ns.userKey(item.key),
+				Value:       textValue(item.value),
+				Version:     item.version,
+				ValueBytes:  []byte(item.value),
+				ContentType: item.contentType,
+			}); err != nil {
+				return err
+			}
+		}
+		sent += int64(len(items))
+		if len(items) < n {
+			break
+		}
+		// Resume just after the last key sent
+		start = items[len(items)-1].key + "\x00"
+	}
+
+	log.Printf("Scan start=%q end=%q prefix=%q, returned=%d", req.StartKey, req.EndKey, req.Prefix, sent)
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc"
+)
+
+// fakeScanStream collects the messages sent by a server-streaming handler
+type fakeScanStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent []*pb.ScanResponse
+}
+
+func (f *fakeScanStream) Context() context.Context { return f.ctx }
+
+func (f *fakeScanStream) Send(resp *pb.ScanResponse) error {
+	f.sent = append(f.sent, resp)
+	return nil
+}
+
+func scanKeys(t *testing.T, server *kvServer, req *pb.ScanRequest) []string {
+	t.Helper()
+	stream := &fakeScanStream{ctx: context.Background()}
+	if err := server.Scan(req, stream); err != nil {
+		t.Fatalf("Scan(%v) error = %v", req, err)
+	}
+	keys := make([]string, len(stream.sent))
+	for i, resp := range stream.sent {
+		keys[i] = resp.Key
+	}
+	return keys
+}
+
+func TestScan(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+	for _, k := range []string{"user/2", "user/10", "order/1", "user/1", "users", "zeta"} {
+		server.Set(ctx, &pb.SetRequest{Key: k, Value: "v-" + k})
+	}
+
+	tests := []struct {
+		name string
+		req  *pb.ScanRequest
+		want []string
+	}{
+		{"all", &pb.ScanRequest{}, []string{"order/1", "user/1", "user/10", "user/2", "users", "zeta"}},
+		{"prefix", &pb.ScanRequest{Prefix: "user/"}, []string{"user/1", "user/10", "user/2"}},
+		{"range", &pb.ScanRequest{StartKey: "user/10", EndKey: "users"}, []string{"user/10", "user/2"}},
+		{"prefix and start", &pb.ScanRequest{Prefix: "user/", StartKey: "user/2"}, []string{"user/2"}},
+		{"limit", &pb.ScanRequest{Limit: 2}, []string{"order/1", "user/1"}},
+		{"empty", &pb.ScanRequest{Prefix: "nothing"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scanKeys(t, server, tt.req); !slices.Equal(got, tt.want) {
+				t.Errorf("Scan() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScanAcrossBatches(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+	total := scanBatchSize*2 + 7
+	for i := 0; i < total; i++ {
+		server.Set(ctx, &pb.SetRequest{Key: fmt.Sprintf("k%05d", i), Value: "v"})
+	}
+
+	keys := scanKeys(t, server, &pb.ScanRequest{})
+	if len(keys) != total || !slices.IsSorted(keys) {
+		t.Errorf("Scan() returned %d keys (sorted=%v), want %d sorted", len(keys), slices.IsSorted(keys), total)
+	}
+
+	keys = scanKeys(t, server, &pb.ScanRequest{Limit: int64(scanBatchSize + 1)})
+	if len(keys) != scanBatchSize+1 {
+		t.Errorf("Scan(limit) returned %d keys, want %d", len(keys), scanBatchSize+1)
+	}
+}
+
+func TestScanSkipsDeletedAndExpired(t *testing.T) {
+	server, clock := newClockedKVServer(t)
+	ctx := context.Background()
+
+	server.Set(ctx, &pb.SetRequest{Key: "a", Value: "v"})
+	server.Set(ctx, &pb.SetRequest{Key: "b", Value: "v", TtlSeconds: 1})
+	server.Set(ctx, &pb.SetRequest{Key: "c", Value: "v"})
+	server.Delete(ctx, &pb.DeleteRequest{Key: "c"})
+	clock.advance(2 * time.Second)
+
+	if got := scanKeys(t, server, &pb.ScanRequest{}); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("Scan() = %v, want [a]", got)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := map[string]string{
+		"abc":      "abd",
+		"a\xff":    "b",
+		"\xff\xff": "",
+		"user/":    "user0",
+		"":         "",
+	}
+	for in, want := range tests {
+		if got := prefixEnd(in); got != want {
+			t.Errorf("prefixEnd(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotPrefix  = "snap-"
+	snapshotSuffix  = ".snap"
+	snapshotMagic   = "KVSNAP01"
+	snapshotVersion = 4
+	// sealedSnapshotVersion is the version of an encrypted snapshot
+	sealedSnapshotVersion = 5
+
+	defaultSnapshotRetain = 3
+)
+
+// errBadSnapshot is returned when a snapshot file fails validation
+var errBadSnapshot = errors.New("malformed snapshot")
+
+type snapshotOptions struct {
+	// Interval between periodic snapshots; zero disables them
+	Interval time.Duration
+	// Retain is how many snapshots are kept on disk
+	Retain int
+}
+
+// A snapshot file is laid out as
+//
+//	magic | version | seq | count | (len(key) key len(value) value expiresAt keyVersion len(contentType) contentType)* | crc32c
+//
+// where seq is the last WAL sequence number reflected in the snapshot and the
+// trailing checksum covers every byte before it. Lengths, expiresAt and
+// keyVersion are uvarints, all other integers are little-endian. Version 1
+// snapshots have neither expiresAt nor keyVersion, version 2 snapshots have
+// no keyVersion, and version 3 snapshots have no contentType. Version 5
+// snapshots are laid out like version 4, but every value is sealed by the
+// keyring and bound to its key.
+
+// writeSnapshot atomically writes the entries of src as the snapshot for seq
+// in dir and returns its path, sealing the values with keys if it is set. The
+// file is written under a temporary name, fsynced and then renamed so that a
+// crash never leaves a partial snapshot behind.
+func writeSnapshot(dir string, seq uint64, src entrySource, keys *keyring) (string, error) {
+	path := filepath.Join(dir, snapshotName(seq))
+	tmp, err := os.CreateTemp(dir, snapshotPrefix+"*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("create snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	sum := crc32.New(crcTable)
+	bw := bufio.NewWriter(io.MultiWriter(tmp, sum))
+
+	var hdr [len(snapshotMagic) + 1 + 8 + 8]byte
+	copy(hdr[:], snapshotMagic)
+	hdr[len(snapshotMagic)] = snapshotVersion
+	if keys != nil {
+		hdr[len(snapshotMagic)] = sealedSnapshotVersion
+	}
+	binary.LittleEndian.PutUint64(hdr[len(snapshotMagic)+1:], seq)
+	binary.LittleEndian.PutUint64(hdr[len(snapshotMagic)+9:], uint64(src.len()))
+	bw.Write(hdr[:])
+
+	// Keys are written in sorted order so identical stores produce identical files
+	var lenBuf [binary.MaxVarintLen64]byte
+	err = src.ascend("", func(k string, e entry) bool {
+		value := e.value
+		if keys != nil {
+			value = string(keys.seal([]byte(value), []byte(k)))
+		}
+		bw.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(k)))])
+		bw.WriteString(k)
+		bw.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(value)))])
+		bw.WriteString(value)
+		bw.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(e.expiresAt))])
+		bw.Write(lenBuf[:binary.PutUvarint(lenBuf[:], e.version)])
+		bw.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(e.contentType)))])
+		bw.WriteString(e.contentType)
+		return true
+	})
+	if err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("read snapshot entries: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("write snapshot: %w", err)
+	}
+
+	var trailer [4]byte
+	binary.LittleEndian.PutUint32(trailer[:], sum.Sum32())
+	if _, err := tmp.Write(trailer[:]); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("write snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("fsync snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("close snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("rename snapshot: %w", err)
+	}
+	if err := syncDir(dir); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// readSnapshot loads and verifies a single snapshot file, opening its values
+// with keys if it is encrypted
+func readSnapshot(path string, keys *keyring) (map[string]entry, uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	const hdrSize = len(snapshotMagic) + 1 + 8 + 8
+	if info.Size() < int64(hdrSize+4) {
+		return nil, 0, errBadSnapshot
+	}
+
+	sum := crc32.New(crcTable)
+	r := &snapshotReader{r: bufio.NewReader(io.LimitReader(f, info.Size()-4)), sum: sum}
+
+	var hdr [hdrSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, 0, errBadSnapshot
+	}
+	if !bytes.Equal(hdr[:len(snapshotMagic)], []byte(snapshotMagic)) {
+		return nil, 0, fmt.Errorf("%w: bad magic", errBadSnapshot)
+	}
+	version := hdr[len(snapshotMagic)]
+	if version < 1 || version > sealedSnapshotVersion {
+		return nil, 0, fmt.Errorf("%w: unsupported version %d", errBadSnapshot, version)
+	}
+	sealed := version == sealedSnapshotVersion
+	if sealed && keys == nil {
+		return nil, 0, errors.New("snapshot is encrypted, but no master key is configured")
+	}
+	seq := binary.LittleEndian.Uint64(hdr[len(snapshotMagic)+1:])
+	count := binary.LittleEndian.Uint64(hdr[len(snapshotMagic)+9:])
+
+	store := make(map[string]entry)
+	for i := uint64(0); i < count; i++ {
+		k, err := r.readString()
+		if err != nil {
+			return nil, 0, err
+		}
+		var e entry
+		if e.value, err = r.readString(); err != nil {
+			return nil, 0, err
+		}
+		if version >= 2 {
+			exp, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, 0, errBadSnapshot
+			}
+			e.expiresAt = int64(exp)
+		}
+		// Keys in older snapshots were last written at or before seq
+		e.version = seq
+		if version >= 3 {
+			if e.version, err = binary.ReadUvarint(r); err != nil {
+				return nil, 0, errBadSnapshot
+			}
+		}
+		if version >= 4 {
+			if e.contentType, err = r.readString(); err != nil {
+				return nil, 0, err
+			}
+		}
+		store[k] = e
+	}
+	if _, err := r.r.ReadByte(); err != io.EOF {
+		return nil, 0, fmt.Errorf("%w: trailing data", errBadSnapshot)
+	}
+
+	var trailer [4]byte
+	if _, err := io.ReadFull(f, trailer[:]); err != nil {
+		return nil, 0, errBadSnapshot
+	}
+	if binary.LittleEndian.Uint32(trailer[:]) != sum.Sum32() {
+		return nil, 0, fmt.Errorf("%w: checksum mismatch", errBadSnapshot)
+	}
+
+	// Values are opened only once the checksum shows the file is intact, so
+	// that a torn snapshot is not taken for a tampered one
+	view := keys.keys()
+	if !sealed {
+		if !view.plaintext {
+			return nil, 0, fmt.Errorf("%w: snapshot is not encrypted", errTampered)
+		}
+		return store, seq, nil
+	}
+	for k, e := range store {
+		if e, err = openEntry(view, k, e); err != nil {
+			return nil, 0, err
+		}
+		store[k] = e
+	}
+	return store, seq, nil
+}
+
+// snapshotReader reads length-prefixed strings while feeding every consumed
+// byte into the running checksum
+type snapshotReader struct {
+	r   *bufio.Reader
+	sum hash.Hash32
+}
+
+func (r *snapshotReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.sum.Write(p[:n])
+	return n, err
+}
+
+func (r *snapshotReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.sum.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (r *snapshotReader) readString() (string, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil || l > walMaxRecordSize {
+		return "", errBadSnapshot
+	}
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", errBadSnapshot
+	}
+	return string(buf), nil
+}
+
+// loadLatestSnapshot returns the contents of the newest snapshot in dir that
+// passes validation, falling back to older ones when a snapshot is corrupt.
+// A snapshot that fails authentication was tampered with rather than torn,
+// so it fails the load. It returns a nil map if there is no usable snapshot.
+func loadLatestSnapshot(dir string, keys *keyring) (map[string]entry, uint64, error) {
+	seqs, err := listSnapshots(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := len(seqs) - 1; i >= 0; i-- {
+		path := filepath.Join(dir, snapshotName(seqs[i]))
+		store, seq, err := readSnapshot(path, keys)
+		if errors.Is(err, errTampered) {
+			return nil, 0, fmt.Errorf("snapshot %s: %w", path, err)
+		}
+		if err != nil {
+			log.Printf("Snapshot: skipping %s: %v", path, err)
+			continue
+		}
+		return store, seq, nil
+	}
+	return nil, 0, nil
+}
+
+// pruneSnapshots deletes all but the newest retain snapshots in dir and
+// returns the sequence number of the oldest one kept
+func pruneSnapshots(dir string, retain int) (uint64, error) {
+	seqs, err := listSnapshots(dir)
+	if err != nil {
+		return 0, err
+	}
+	if len(seqs) == 0 {
+		return 0, nil
+	}
+	if retain < 1 {
+		retain = 1
+	}
+	if len(seqs) > retain {
+		for _, seq := range seqs[:len(seqs)-retain] {
+			if err := os.Remove(filepath.Join(dir, snapshotName(seq))); err != nil && !os.IsNotExist(err) {
+				return 0, fmt.Errorf("remove snapshot: %w", err)
+			}
+		}
+		seqs = seqs[len(seqs)-retain:]
+	}
+	return seqs[0], nil
+}
+
+func snapshotName(seq uint64) string {
+	return fmt.Sprintf("%s%016x%s", snapshotPrefix, seq, snapshotSuffix)
+}
+
+// listSnapshots returns the sequence number of every snapshot in dir, in
+// ascending order
+func listSnapshots(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot dir: %w", err)
+	}
+
+	var seqs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+			continue
+		}
+		var seq uint64
+		hex := strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix)
+		if _, err := fmt.Sscanf(hex, "%x", &seq); err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	store := map[string]entry{
+		"a": {value: "1"},
+		"b": {value: "", expiresAt: 1700000000000000000},
+		"":  {value: "empty key"},
+	}
+
+	path, err := writeSnapshot(dir, 42, entriesOf(store), nil)
+	if err != nil {
+		t.Fatalf("writeSnapshot() error = %v", err)
+	}
+
+	got, seq, err := readSnapshot(path, nil)
+	if err != nil {
+		t.Fatalf("readSnapshot() error = %v", err)
+	}
+	if seq != 42 {
+		t.Errorf("readSnapshot() seq = %d, want 42", seq)
+	}
+	if len(got) != len(store) {
+		t.Fatalf("readSnapshot() = %d keys, want %d", len(got), len(store))
+	}
+	for k, v := range store {
+		if got[k] != v {
+			t.Errorf("readSnapshot()[%q] = %+v, want %+v", k, got[k], v)
+		}
+	}
+}
+
+func TestSnapshotCorruptFallsBack(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := writeSnapshot(dir, 1, entriesOf(map[string]entry{"key": {value: "old"}}), nil); err != nil {
+		t.Fatalf("writeSnapshot() error = %v", err)
+	}
+	path, err := writeSnapshot(dir, 2, entriesOf(map[string]entry{"key": {value: "new"}}), nil)
+	if err != nil {
+		t.Fatalf("writeSnapshot() error = %v", err)
+	}
+
+	// Flip a byte in the middle of the newest snapshot
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	if _, _, err := readSnapshot(path, nil); err == nil {
+		t.Error("readSnapshot() error = nil, want checksum error")
+	}
+
+	store, seq, err := loadLatestSnapshot(dir, nil)
+	if err != nil {
+		t.Fatalf("loadLatestSnapshot() error = %v", err)
+	}
+	if seq != 1 || store["key"].value != "old" {
+		t.Errorf("loadLatestSnapshot() = seq %d, key %q; want seq 1, key %q", seq, store["key"].value, "old")
+	}
+}
+
+func TestSnapshotRetention(t *testing.T) {
+	dir := t.TempDir()
+	for seq := uint64(1); seq <= 5; seq++ {
+		if _, err := writeSnapshot(dir, seq, sortedEntries{}, nil); err != nil {
+			t.Fatalf("writeSnapshot() error = %v", err)
+		}
+	}
+
+	oldest, err := pruneSnapshots(dir, 2)
+	if err != nil {
+		t.Fatalf("pruneSnapshots() error = %v", err)
+	}
+	if oldest != 4 {
+		t.Errorf("pruneSnapshots() oldest = %d, want 4", oldest)
+	}
+	seqs, _ := listSnapshots(dir)
+	if len(seqs) != 2 || seqs[0] != 4 || seqs[1] != 5 {
+		t.Errorf("listSnapshots() = %v, want [4 5]", seqs)
+	}
+}
+
+func TestSnapshotRecoveryWithWAL(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	opts := serverOptions{
+		WAL:      walOptions{Sync: syncNone, SegmentSize: 64},
+		Snapshot: snapshotOptions{Retain: 1},
+	}
+
+	server, err := openKVServer(dir, opts)
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		server.Set(ctx, &pb.SetRequest{Key: "before", Value: string(rune('a' + i))})
+	}
+	if err := server.snapshot(); err != nil {
+		t.Fatalf("snapshot() error = %v", err)
+	}
+	server.Set(ctx, &pb.SetRequest{Key: "after", Value: "value"})
+	server.Delete(ctx, &pb.DeleteRequest{Key: "before"})
+	server.Close()
+
+	// Segments fully covered by the snapshot are compacted away
+	segments, _ := listSegments(dir)
+	if len(segments) == 0 || segments[0] == 1 {
+		t.Errorf("listSegments() = %v, want segments before the snapshot removed", segments)
+	}
+
+	server, err = openKVServer(dir, opts)
+	if err != nil {
+		t.Fatalf("openKVServer() after snapshot error = %v", err)
+	}
+	defer server.Close()
+
+	resp, _ := server.Get(ctx, &pb.GetRequest{Key: "after"})
+	if !resp.Found {
+		t.Errorf("Get(after) found = false, want true")
+	}
+	resp, _ = server.Get(ctx, &pb.GetRequest{Key: "before"})
+	if resp.Found {
+		t.Errorf("Get(before) found = true, want false after replayed delete")
+	}
+}
+
+func TestSnapshotWithoutWAL(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	opts := serverOptions{WAL: walOptions{Sync: syncNone}}
+
+	server, err := openKVServer(dir, opts)
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	server.Set(ctx, &pb.SetRequest{Key: "a", Value: "1"})
+	server.snapshot()
+	server.Close()
+
+	// Losing the log must not reuse sequence numbers covered by the snapshot
+	segments, _ := listSegments(dir)
+	for _, seg := range segments {
+		os.Remove(filepath.Join(dir, segmentName(seg)))
+	}
+
+	server, err = openKVServer(dir, opts)
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	server.Set(ctx, &pb.SetRequest{Key: "b", Value: "2"})
+	server.Close()
+
+	server, err = openKVServer(dir, opts)
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	defer server.Close()
+
+	for _, key := range []string{"a", "b"} {
+		resp, _ := server.Get(ctx, &pb.GetRequest{Key: key})
+		if !resp.Found {
+			t.Errorf("Get(%s) found = false, want true", key)
+		}
+	}
+}
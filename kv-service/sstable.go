@@ -0,0 +1,631 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	sstPrefix = "sst-"
+	sstSuffix = ".sst"
+	sstMagic  = "KVSST001"
+	// sstBlockSize is the size at which a data block is cut
+	sstBlockSize = 4 << 10
+	// sstFooterSize is five fixed 64-bit integers and the magic
+	sstFooterSize = 5*8 + len(sstMagic)
+
+	sstFlagTombstone byte = 1
+	// sstFlagTyped marks a value followed by its content type
+	sstFlagTyped byte = 2
+)
+
+var errBadSSTable = errors.New("malformed sstable")
+
+// lsmEntry is an entry of a memtable or SSTable. A tombstone hides every
+// older version of its key.
+type lsmEntry struct {
+	entry
+	deleted bool
+}
+
+// sstBlockHandle locates a data block and the keys it holds
+type sstBlockHandle struct {
+	first, last string
+	off, size   int64
+}
+
+// sstTable is an open, immutable SSTable. The file is laid out as
+//
+//	data blocks | index block | bloom block | footer
+//
+// where every block is followed by its crc32c. A data block holds entries
+// in key order as
+//
+//	len(key) key | flags [| len(value) value | expiresAt | version [| len(contentType) contentType]]
+//
+// with uvarint integers, the value part being absent for a tombstone and the
+// content type present only under sstFlagTyped. The
+// index block lists the first key, last key, offset and size of every data
+// block, the bloom block holds a filter of every key in the table, and the
+// footer holds the offset and length of those two blocks, the number of
+// entries and the magic. The index and filter stay in memory, so a lookup
+// reads at most one data block, and none when the filter rules the key out.
+type sstTable struct {
+	id    uint64
+	path  string
+	f     *os.File
+	size  int64
+	count int
+	// first and last are the smallest and largest keys in the table
+	first, last string
+	blocks      []sstBlockHandle
+	bloom       *bloomFilter
+	// refs counts the version the table is part of plus every snapshot or
+	// compaction reading it. The file is deleted when it drops to 0.
+	refs atomic.Int32
+}
+
+func sstTableName(id uint64) string {
+	return fmt.Sprintf("%s%016x%s", sstPrefix, id, sstSuffix)
+}
+
+// parseSSTableName returns the ID in an SSTable file name
+func parseSSTableName(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, sstPrefix) || !strings.HasSuffix(name, sstSuffix) {
+		return 0, false
+	}
+	var id uint64
+	hex := strings.TrimSuffix(strings.TrimPrefix(name, sstPrefix), sstSuffix)
+	if _, err := fmt.Sscanf(hex, "%x", &id); err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// sstWriter writes entries, which must be added in key order, to a new
+// SSTable
+type sstWriter struct {
+	path   string
+	f      *os.File
+	w      *bufio.Writer
+	off    int64
+	block  []byte
+	blocks []sstBlockHandle
+	// hashes holds the bloomHash of every key, since the filter can only be
+	// sized once the number of keys is known
+	hashes []uint64
+}
+
+func createSSTable(path string) (*sstWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("create sstable: %w", err)
+	}
+	return &sstWriter{path: path, f: f, w: bufio.NewWriterSize(f, 64<<10)}, nil
+}
+
+func (w *sstWriter) add(key string, e lsmEntry) error {
+	if len(w.block) == 0 {
+		w.blocks = append(w.blocks, sstBlockHandle{first: key})
+	}
+	w.blocks[len(w.blocks)-1].last = key
+	w.hashes = append(w.hashes, bloomHash(key))
+
+	w.block = binary.AppendUvarint(w.block, uint64(len(key)))
+	w.block = append(w.block, key...)
+	if e.deleted {
+		w.block = append(w.block, sstFlagTombstone)
+	} else {
+		var flags byte
+		if e.contentType != "" {
+			flags |= sstFlagTyped
+		}
+		w.block = append(w.block, flags)
+		w.block = binary.AppendUvarint(w.block, uint64(len(e.value)))
+		w.block = append(w.block, e.value...)
+		w.block = binary.AppendUvarint(w.block, uint64(e.expiresAt))
+		w.block = binary.AppendUvarint(w.block, e.version)
+		if e.contentType != "" {
+			w.block = binary.AppendUvarint(w.block, uint64(len(e.contentType)))
+			w.block = append(w.block, e.contentType...)
+		}
+	}
+	if len(w.block) >= sstBlockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+// size returns the number of bytes written so far
+func (w *sstWriter) size() int64 {
+	return w.off + int64(len(w.block))
+}
+
+func (w *sstWriter) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	h := &w.blocks[len(w.blocks)-1]
+	h.off = w.off
+	h.size = int64(len(w.block))
+	_, err := w.writeBlock(w.block)
+	w.block = w.block[:0]
+	return err
+}
+
+// writeBlock writes p and its checksum and returns the offset of p
+func (w *sstWriter) writeBlock(p []byte) (int64, error) {
+	off := w.off
+	if _, err := w.w.Write(p); err != nil {
+		return 0, fmt.Errorf("write %s: %w", w.path, err)
+	}
+	if _, err := w.w.Write(binary.LittleEndian.AppendUint32(nil, crc32.Checksum(p, crcTable))); err != nil {
+		return 0, fmt.Errorf("write %s: %w", w.path, err)
+	}
+	w.off += int64(len(p)) + 4
+	return off, nil
+}
+
+// finish writes the index, filter and footer, syncs the file and opens it
+// for reading
+func (w *sstWriter) finish(id uint64) (*sstTable, error) {
+	if err := w.flushBlock(); err != nil {
+		w.abort()
+		return nil, err
+	}
+	var index []byte
+	index = binary.AppendUvarint(index, uint64(len(w.blocks)))
+	for _, h := range w.blocks {
+		index = binary.AppendUvarint(index, uint64(len(h.first)))
+		index = append(index, h.first...)
+		index = binary.AppendUvarint(index, uint64(len(h.last)))
+		index = append(index, h.last...)
+		index = binary.AppendUvarint(index, uint64(h.off))
+		index = binary.AppendUvarint(index, uint64(h.size))
+	}
+	bloom := newBloomFilter(len(w.hashes))
+	for _, h := range w.hashes {
+		bloom.addHash(h)
+	}
+
+	indexOff, err := w.writeBlock(index)
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+	filter := bloom.encode(nil)
+	bloomOff, err := w.writeBlock(filter)
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+	footer := make([]byte, 0, sstFooterSize)
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(indexOff))
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(len(index)))
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(bloomOff))
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(len(filter)))
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(len(w.hashes)))
+	footer = append(footer, sstMagic...)
+	if _, err := w.w.Write(footer); err != nil {
+		w.abort()
+		return nil, fmt.Errorf("write %s: %w", w.path, err)
+	}
+	if err := w.w.Flush(); err != nil {
+		w.abort()
+		return nil, fmt.Errorf("write %s: %w", w.path, err)
+	}
+	if err := w.f.Sync(); err != nil {
+		w.abort()
+		return nil, fmt.Errorf("sync %s: %w", w.path, err)
+	}
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.path)
+		return nil, fmt.Errorf("close %s: %w", w.path, err)
+	}
+	t, err := openSSTable(w.path, id)
+	if err != nil {
+		os.Remove(w.path)
+	}
+	return t, err
+}
+
+// abort closes and deletes an unfinished table
+func (w *sstWriter) abort() {
+	w.f.Close()
+	os.Remove(w.path)
+}
+
+// openSSTable opens the table at path and loads its index and filter
+func openSSTable(path string, id uint64) (*sstTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open sstable: %w", err)
+	}
+	t, err := readSSTable(f, path, id)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("sstable %s: %w", path, err)
+	}
+	t.refs.Store(1)
+	return t, nil
+}
+
+func readSSTable(f *os.File, path string, id uint64) (*sstTable, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	t := &sstTable{id: id, path: path, f: f, size: info.Size()}
+	if t.size < int64(sstFooterSize) {
+		return nil, errBadSSTable
+	}
+	footer := make([]byte, sstFooterSize)
+	if _, err := f.ReadAt(footer, t.size-int64(sstFooterSize)); err != nil {
+		return nil, err
+	}
+	if string(footer[40:]) != sstMagic {
+		return nil, errBadSSTable
+	}
+	indexOff := int64(binary.LittleEndian.Uint64(footer[0:8]))
+	indexLen := int64(binary.LittleEndian.Uint64(footer[8:16]))
+	bloomOff := int64(binary.LittleEndian.Uint64(footer[16:24]))
+	bloomLen := int64(binary.LittleEndian.Uint64(footer[24:32]))
+	t.count = int(binary.LittleEndian.Uint64(footer[32:40]))
+
+	index, err := t.readBlock(indexOff, indexLen)
+	if err != nil {
+		return nil, err
+	}
+	n, k := binary.Uvarint(index)
+	if k <= 0 {
+		return nil, errBadSSTable
+	}
+	p := index[k:]
+	for i := uint64(0); i < n; i++ {
+		var (
+			h           sstBlockHandle
+			first, last []byte
+			ok          bool
+		)
+		if first, p, ok = readBytes(p); !ok {
+			return nil, errBadSSTable
+		}
+		if last, p, ok = readBytes(p); !ok {
+			return nil, errBadSSTable
+		}
+		h.first, h.last = string(first), string(last)
+		off, k := binary.Uvarint(p)
+		if k <= 0 {
+			return nil, errBadSSTable
+		}
+		p = p[k:]
+		size, k := binary.Uvarint(p)
+		if k <= 0 {
+			return nil, errBadSSTable
+		}
+		p = p[k:]
+		h.off, h.size = int64(off), int64(size)
+		t.blocks = append(t.blocks, h)
+	}
+	if len(t.blocks) > 0 {
+		t.first, t.last = t.blocks[0].first, t.blocks[len(t.blocks)-1].last
+	}
+
+	filter, err := t.readBlock(bloomOff, bloomLen)
+	if err != nil {
+		return nil, err
+	}
+	var ok bool
+	if t.bloom, ok = decodeBloomFilter(filter); !ok {
+		return nil, errBadSSTable
+	}
+	return t, nil
+}
+
+// readBlock reads the block at off and verifies its checksum
+func (t *sstTable) readBlock(off, size int64) ([]byte, error) {
+	if off < 0 || size < 0 || off+size+4 > t.size {
+		return nil, errBadSSTable
+	}
+	buf := make([]byte, size+4)
+	if _, err := t.f.ReadAt(buf, off); err != nil {
+		return nil, fmt.Errorf("read %s at offset %d: %w", t.path, off, err)
+	}
+	p := buf[:size]
+	if crc32.Checksum(p, crcTable) != binary.LittleEndian.Uint32(buf[size:]) {
+		return nil, fmt.Errorf("%s: checksum mismatch in block at offset %d", t.path, off)
+	}
+	return p, nil
+}
+
+// overlaps reports whether the table may hold keys in [first, last]
+func (t *sstTable) overlaps(first, last string) bool {
+	return t.count > 0 && t.first <= last && first <= t.last
+}
+
+// get looks key up, consulting the filter before reading a data block
+func (t *sstTable) get(key string) (lsmEntry, bool, error) {
+	if t.count == 0 || key < t.first || key > t.last || !t.bloom.mayContain(key) {
+		return lsmEntry{}, false, nil
+	}
+	i := sort.Search(len(t.blocks), func(i int) bool { return t.blocks[i].last >= key })
+	if i == len(t.blocks) || t.blocks[i].first > key {
+		return lsmEntry{}, false, nil
+	}
+	p, err := t.readBlock(t.blocks[i].off, t.blocks[i].size)
+	if err != nil {
+		return lsmEntry{}, false, err
+	}
+	// Compare keys in place and decode only the entry asked for
+	for len(p) > 0 {
+		k, rest, ok := readBytes(p)
+		if !ok {
+			return lsmEntry{}, false, fmt.Errorf("%s: %w", t.path, errBadSSTable)
+		}
+		if c := strings.Compare(string(k), key); c >= 0 {
+			if c > 0 {
+				break
+			}
+			_, e, _, err := decodeSSTEntry(p)
+			if err != nil {
+				return lsmEntry{}, false, fmt.Errorf("%s: %w", t.path, err)
+			}
+			return e, true, nil
+		}
+		if p, ok = skipSSTValue(rest); !ok {
+			return lsmEntry{}, false, fmt.Errorf("%s: %w", t.path, errBadSSTable)
+		}
+	}
+	return lsmEntry{}, false, nil
+}
+
+// skipSSTValue skips the flags and value part of an entry
+func skipSSTValue(p []byte) ([]byte, bool) {
+	if len(p) < 1 {
+		return nil, false
+	}
+	flags := p[0]
+	if flags&sstFlagTombstone != 0 {
+		return p[1:], true
+	}
+	_, p, ok := readBytes(p[1:])
+	for i := 0; i < 2 && ok; i++ {
+		_, n := binary.Uvarint(p)
+		if ok = n > 0; ok {
+			p = p[n:]
+		}
+	}
+	if ok && flags&sstFlagTyped != 0 {
+		_, p, ok = readBytes(p)
+	}
+	return p, ok
+}
+
+func decodeSSTEntry(p []byte) (string, lsmEntry, []byte, error) {
+	var e lsmEntry
+	key, p, ok := readBytes(p)
+	if !ok || len(p) < 1 {
+		return "", e, nil, errBadSSTable
+	}
+	flags := p[0]
+	p = p[1:]
+	if flags&sstFlagTombstone != 0 {
+		e.deleted = true
+		return string(key), e, p, nil
+	}
+	value, p, ok := readBytes(p)
+	if !ok {
+		return "", e, nil, errBadSSTable
+	}
+	exp, n := binary.Uvarint(p)
+	if n <= 0 {
+		return "", e, nil, errBadSSTable
+	}
+	p = p[n:]
+	version, n := binary.Uvarint(p)
+	if n <= 0 {
+		return "", e, nil, errBadSSTable
+	}
+	p = p[n:]
+	e.entry = entry{value: string(value), expiresAt: int64(exp), version: version}
+	if flags&sstFlagTyped != 0 {
+		contentType, rest, ok := readBytes(p)
+		if !ok {
+			return "", e, nil, errBadSSTable
+		}
+		e.contentType, p = string(contentType), rest
+	}
+	return string(key), e, p, nil
+}
+
+func (t *sstTable) ref() {
+	t.refs.Add(1)
+}
+
+// unref drops a reference and deletes the file with the last one
+func (t *sstTable) unref() error {
+	if t.refs.Add(-1) > 0 {
+		return nil
+	}
+	t.f.Close()
+	if err := os.Remove(t.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove sstable: %w", err)
+	}
+	return nil
+}
+
+// lsmIter walks entries in key order. Valid is false once it is exhausted
+// or has failed, which err then reports.
+type lsmIter interface {
+	valid() bool
+	key() string
+	value() lsmEntry
+	next()
+	err() error
+}
+
+// sstIter walks a table one data block at a time
+type sstIter struct {
+	t     *sstTable
+	block int
+	p     []byte
+	k     string
+	e     lsmEntry
+	ok    bool
+	fail  error
+}
+
+// iter returns an iterator positioned at the first key >= start
+func (t *sstTable) iter(start string) *sstIter {
+	it := &sstIter{t: t}
+	it.block = sort.Search(len(t.blocks), func(i int) bool { return t.blocks[i].last >= start })
+	if it.load() {
+		for it.ok && it.k < start {
+			it.next()
+		}
+	}
+	return it
+}
+
+// load reads the current block and decodes its first entry
+func (it *sstIter) load() bool {
+	it.ok = false
+	if it.block >= len(it.t.blocks) {
+		return false
+	}
+	h := it.t.blocks[it.block]
+	if it.p, it.fail = it.t.readBlock(h.off, h.size); it.fail != nil {
+		return false
+	}
+	it.next()
+	return it.ok
+}
+
+func (it *sstIter) next() {
+	if len(it.p) == 0 {
+		it.block++
+		it.load()
+		return
+	}
+	it.k, it.e, it.p, it.fail = decodeSSTEntry(it.p)
+	it.ok = it.fail == nil
+}
+
+func (it *sstIter) valid() bool     { return it.ok }
+func (it *sstIter) key() string     { return it.k }
+func (it *sstIter) value() lsmEntry { return it.e }
+func (it *sstIter) err() error      { return it.fail }
+
+// levelIter walks a run of tables that don't overlap, in key order
+type levelIter struct {
+	tables []*sstTable
+	i      int
+	cur    *sstIter
+}
+
+func newLevelIter(tables []*sstTable, start string) *levelIter {
+	it := &levelIter{tables: tables}
+	it.i = sort.Search(len(tables), func(i int) bool { return tables[i].last >= start })
+	if it.i < len(tables) {
+		it.cur = tables[it.i].iter(start)
+		it.skip()
+	}
+	return it
+}
+
+// skip moves on to the next table once the current one is exhausted
+func (it *levelIter) skip() {
+	for !it.cur.valid() && it.cur.err() == nil && it.i+1 < len(it.tables) {
+		it.i++
+		it.cur = it.tables[it.i].iter("")
+	}
+}
+
+func (it *levelIter) valid() bool     { return it.cur != nil && it.cur.valid() }
+func (it *levelIter) key() string     { return it.cur.key() }
+func (it *levelIter) value() lsmEntry { return it.cur.value() }
+
+func (it *levelIter) next() {
+	it.cur.next()
+	it.skip()
+}
+
+func (it *levelIter) err() error {
+	if it.cur == nil {
+		return nil
+	}
+	return it.cur.err()
+}
+
+// mergeIter merges iterators ordered newest first. Where several hold the
+// same key, the newest version is returned and the others are skipped.
+type mergeIter struct {
+	srcs []lsmIter
+	cur  int
+	fail error
+}
+
+func newMergeIter(srcs []lsmIter) *mergeIter {
+	m := &mergeIter{srcs: srcs}
+	m.pick()
+	return m
+}
+
+// pick finds the source holding the smallest key; ties go to the newest
+func (m *mergeIter) pick() {
+	m.cur = -1
+	for i, s := range m.srcs {
+		if err := s.err(); err != nil {
+			m.fail = err
+			m.cur = -1
+			return
+		}
+		if s.valid() && (m.cur < 0 || s.key() < m.srcs[m.cur].key()) {
+			m.cur = i
+		}
+	}
+}
+
+func (m *mergeIter) valid() bool     { return m.cur >= 0 }
+func (m *mergeIter) key() string     { return m.srcs[m.cur].key() }
+func (m *mergeIter) value() lsmEntry { return m.srcs[m.cur].value() }
+func (m *mergeIter) err() error      { return m.fail }
+
+func (m *mergeIter) next() {
+	key := m.key()
+	for _, s := range m.srcs {
+		if s.valid() && s.key() == key {
+			s.next()
+		}
+	}
+	m.pick()
+}
+
+// lsmItem is a key and its entry in an in-memory run
+type lsmItem struct {
+	key string
+	lsmEntry
+}
+
+// sliceIter walks an in-memory run sorted by key
+type sliceIter struct {
+	items []lsmItem
+	i     int
+}
+
+func newSliceIter(items []lsmItem, start string) *sliceIter {
+	return &sliceIter{items: items, i: sort.Search(len(items), func(i int) bool { return items[i].key >= start })}
+}
+
+func (it *sliceIter) valid() bool     { return it.i < len(it.items) }
+func (it *sliceIter) key() string     { return it.items[it.i].key }
+func (it *sliceIter) value() lsmEntry { return it.items[it.i].lsmEntry }
+func (it *sliceIter) next()           { it.i++ }
+func (it *sliceIter) err() error      { return nil }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestSSTable writes n entries, every third one a tombstone, with
+// values large enough to span several blocks
+func writeTestSSTable(t *testing.T, dir string, n int) *sstTable {
+	t.Helper()
+	w, err := createSSTable(filepath.Join(dir, sstTableName(1)))
+	if err != nil {
+		t.Fatalf("createSSTable() error = %v", err)
+	}
+	for i := 0; i < n; i++ {
+		e := lsmEntry{entry: entry{value: fmt.Sprintf("value-%04d-%0100d", i, i), expiresAt: int64(i), version: uint64(i + 1)}}
+		if i%3 == 0 {
+			e = lsmEntry{deleted: true}
+		}
+		if err := w.add(fmt.Sprintf("key-%04d", i), e); err != nil {
+			t.Fatalf("add() error = %v", err)
+		}
+	}
+	tbl, err := w.finish(1)
+	if err != nil {
+		t.Fatalf("finish() error = %v", err)
+	}
+	t.Cleanup(func() { tbl.f.Close() })
+	return tbl
+}
+
+func TestSSTableGetAndIter(t *testing.T) {
+	tbl := writeTestSSTable(t, t.TempDir(), 500)
+	if len(tbl.blocks) < 2 || tbl.count != 500 || tbl.first != "key-0000" || tbl.last != "key-0499" {
+		t.Fatalf("table has %d blocks, %d entries, keys %s..%s", len(tbl.blocks), tbl.count, tbl.first, tbl.last)
+	}
+
+	e, found, err := tbl.get("key-0250")
+	if err != nil || !found || e.deleted || e.version != 251 || e.expiresAt != 250 {
+		t.Errorf("get(key-0250) = %+v, %v, %v", e, found, err)
+	}
+	if e, found, _ := tbl.get("key-0003"); !found || !e.deleted {
+		t.Errorf("get(key-0003) = %+v, %v, want a tombstone", e, found)
+	}
+	for _, key := range []string{"key-0250x", "a", "zzz"} {
+		if _, found, err := tbl.get(key); found || err != nil {
+			t.Errorf("get(%s) found = %v, err = %v", key, found, err)
+		}
+	}
+
+	it := tbl.iter("key-0497x")
+	var keys []string
+	for ; it.valid(); it.next() {
+		keys = append(keys, it.key())
+	}
+	if it.err() != nil || fmt.Sprint(keys) != "[key-0498 key-0499]" {
+		t.Errorf("iter(key-0497x) = %v, %v", keys, it.err())
+	}
+	n := 0
+	for it := tbl.iter(""); it.valid(); it.next() {
+		n++
+	}
+	if n != 500 {
+		t.Errorf("iter() visited %d entries, want 500", n)
+	}
+}
+
+func TestSSTableDetectsCorruption(t *testing.T) {
+	tbl := writeTestSSTable(t, t.TempDir(), 500)
+	h := tbl.blocks[1]
+	f, err := os.OpenFile(tbl.path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	f.WriteAt([]byte{0xff}, h.off+10)
+	f.Close()
+
+	if _, _, err := tbl.get(h.first); err == nil {
+		t.Errorf("get() from a corrupt block error = nil, want a checksum error")
+	}
+	if err := os.Truncate(tbl.path, tbl.size-1); err != nil {
+		t.Fatalf("Truncate() error = %v", err)
+	}
+	if _, err := openSSTable(tbl.path, 1); err == nil {
+		t.Errorf("openSSTable() of a truncated file error = nil, want an error")
+	}
+}
+
+func TestMergeIterPrefersNewest(t *testing.T) {
+	newer := []lsmItem{{key: "b", lsmEntry: lsmEntry{deleted: true}}, {key: "c", lsmEntry: lsmEntry{entry: entry{value: "new"}}}}
+	older := []lsmItem{{key: "a", lsmEntry: lsmEntry{entry: entry{value: "old"}}}, {key: "b", lsmEntry: lsmEntry{entry: entry{value: "old"}}}, {key: "c", lsmEntry: lsmEntry{entry: entry{value: "old"}}}}
+	got := make(map[string]string)
+	err := ascendMerged([]lsmIter{newSliceIter(newer, ""), newSliceIter(older, "")}, func(key string, e entry) bool {
+		got[key] = e.value
+		return true
+	})
+	if err != nil || fmt.Sprint(got) != "map[a:old c:new]" {
+		t.Errorf("ascendMerged() = %v, %v, want map[a:old c:new]", got, err)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"math"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// downloadChunkSize is how much of a value each Download message carries
+	downloadChunkSize = 64 << 10
+
+	// messageOverhead is room in a message for everything besides its
+	// largest value
+	messageOverhead = 1 << 20
+)
+
+// messageLimit is the largest gRPC message the server and its peers accept,
+// which must hold a value of the maximum object size
+func (s *kvServer) messageLimit() int {
+	return int(min(s.maxObjectSize+messageOverhead, math.MaxInt32))
+}
+
+// peerDialOptions returns the options for connections to the primary or to
+// other cluster members
+func (s *kvServer) peerDialOptions() []grpc.DialOption {
+	creds := insecure.NewCredentials()
+	if s.tls != nil {
+		creds = s.tls.Credentials()
+	}
+	return []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(s.messageLimit())),
+	}
+}
+
+// grpcServerOptions returns the options for the server's gRPC port.
+// Replication and Raft carry whole values in one message, so every message
+// up to the largest value must get through.
+// Its interceptors stop store RPCs once the WAL has failed.
+func (s *kvServer) grpcServerOptions() []grpc.ServerOption {
+	opts := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(s.messageLimit()),
+		grpc.ChainUnaryInterceptor(s.failStopUnary),
+		grpc.ChainStreamInterceptor(s.failStopStream),
+	}
+	if s.tls != nil {
+		opts = append(opts, grpc.Creds(s.tls.Credentials()))
+	}
+	return opts
+}
+
+// Upload stores a value received in chunks. The value is collected in memory,
+// checked against the maximum object size as it arrives, and only written
+// once the stream has ended and its SHA-256 matches the one the client sent.
+func (s *kvServer) Upload(stream grpc.ClientStreamingServer[pb.UploadRequest, pb.SetResponse]) (err error) {
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	head, err := stream.Recv()
+	if err == io.EOF {
+		return status.Errorf(codes.InvalidArgument, "upload ended before its first message")
+	}
+	if err != nil {
+		return err
+	}
+	var (
+		sum     []byte
+		version uint64
+	)
+	defer func() {
+		if sum == nil {
+			sum = head.Sha256
+		}
+		s.recordAudit(stream.Context(), auditEvent{op: auditSet, namespace: head.Namespace, key: head.Key, sum: sum, version: version, err: err})
+	}()
+	switch {
+	case head.Key == "":
+		return status.Errorf(codes.InvalidArgument, "key is required")
+	case head.Size < 0:
+		return status.Errorf(codes.InvalidArgument, "size must not be negative")
+	}
+	if err := checkTTL(head.TtlSeconds); err != nil {
+		return err
+	}
+	if err := checkCondition(head.ExpectedVersion, head.MustExist, head.MustNotExist); err != nil {
+		return err
+	}
+	if err := checkContentType(head.ContentType); err != nil {
+		return err
+	}
+	n, key, err := s.namespaceKey(head.Namespace, head.Key)
+	if err != nil {
+		return err
+	}
+	if err := s.checkObjectSize(n, head.Size); err != nil {
+		return err
+	}
+
+	var value bytes.Buffer
+	value.Grow(int(head.Size))
+	hash := sha256.New()
+	want := head.Sha256
+	for msg := head; ; {
+		if err := s.checkObjectSize(n, int64(value.Len()+len(msg.Data))); err != nil {
+			return err
+		}
+		value.Write(msg.Data)
+		hash.Write(msg.Data)
+		if len(msg.Sha256) > 0 {
+			want = msg.Sha256
+		}
+
+		msg, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(want) == 0 {
+		return status.Errorf(codes.InvalidArgument, "sha256 of the value is required")
+	}
+	if sum = hash.Sum(nil); !bytes.Equal(sum, want) {
+		return status.Errorf(codes.DataLoss, "value has SHA-256 %x, expected %x", sum, want)
+	}
+	if head.Size != 0 && int64(value.Len()) != head.Size {
+		return status.Errorf(codes.InvalidArgument, "value is %d bytes, expected %d", value.Len(), head.Size)
+	}
+
+	conditional := head.ExpectedVersion != 0 || head.MustExist || head.MustNotExist
+	version, err = s.mutateKey(stream.Context(), key, func(v *txnView) (*walRecord, error) {
+		if err := s.checkNamespace(n); err != nil {
+			return nil, err
+		}
+		if conditional {
+			e, found, _ := v.get(key)
+			if err := checkVersion(head.Key, e, found, head.ExpectedVersion, head.MustNotExist); err != nil {
+				return nil, err
+			}
+		}
+		return &walRecord{Op: walOpSet, Key: key, Value: value.String(), ExpiresAt: s.expiryFor(n.ttl(head.TtlSeconds)), ContentType: head.ContentType}, nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Upload key=%s, bytes=%d, version=%d", head.Key, value.Len(), version)
+
+	return stream.SendAndClose(&pb.SetResponse{
+		Success: true,
+		Message: fmt.Sprintf("Key '%s' set successfully", head.Key),
+		Version: version,
+	})
+}
+
+// Download sends a value in chunks. The first chunk also carries the value's
+// size, content type, version and SHA-256, so the client can check what it
+// received.
+func (s *kvServer) Download(req *pb.DownloadRequest, stream grpc.ServerStreamingServer[pb.DownloadChunk]) error {
+	_, key, err := s.namespaceKey(req.Namespace, req.Key)
+	if err != nil {
+		return err
+	}
+	s.rlockKey(key)
+	e, found, err := s.lookup(key)
+	found = found && !e.expired(s.now().UnixNano())
+	if found && s.budget != nil {
+		s.budget.touch(key)
+	}
+	s.runlockKey(key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return status.Errorf(codes.NotFound, "Key '%s' not found", req.Key)
+	}
+	log.Printf("Download key=%s, bytes=%d", req.Key, len(e.value))
+
+	// The entry's value is never modified in place, so it can be sent after
+	// the lock is released
+	sum := sha256.Sum256([]byte(e.value))
+	chunk := &pb.DownloadChunk{
+		Size:        int64(len(e.value)),
+		ContentType: e.contentType,
+		Version:     e.version,
+		Sha256:      sum[:],
+	}
+	value := e.value
+	for {
+		n := min(len(value), downloadChunkSize)
+		chunk.Data = []byte(value[:n])
+		if err := stream.Send(chunk); err != nil {
+			return err
+		}
+		value = value[n:]
+		if len(value) == 0 {
+			return nil
+		}
+		chunk = &pb.DownloadChunk{}
+	}
+}
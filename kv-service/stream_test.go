@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"testing"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeUploadStream feeds a fixed list of messages to a client-streaming
+// handler and keeps its response
+type fakeUploadStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	msgs []*pb.UploadRequest
+	resp *pb.SetResponse
+}
+
+func (f *fakeUploadStream) Context() context.Context { return f.ctx }
+
+func (f *fakeUploadStream) Recv() (*pb.UploadRequest, error) {
+	if len(f.msgs) == 0 {
+		return nil, io.EOF
+	}
+	msg := f.msgs[0]
+	f.msgs = f.msgs[1:]
+	return msg, nil
+}
+
+func (f *fakeUploadStream) SendAndClose(resp *pb.SetResponse) error {
+	f.resp = resp
+	return nil
+}
+
+// fakeDownloadStream collects the chunks sent by Download
+type fakeDownloadStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent []*pb.DownloadChunk
+}
+
+func (f *fakeDownloadStream) Context() context.Context { return f.ctx }
+
+func (f *fakeDownloadStream) Send(chunk *pb.DownloadChunk) error {
+	f.sent = append(f.sent, chunk)
+	return nil
+}
+
+// uploadMessages splits value into an Upload stream of chunk-sized messages
+// after head, with the value's SHA-256 on the last one
+func uploadMessages(head *pb.UploadRequest, value []byte, chunk int) []*pb.UploadRequest {
+	msgs := []*pb.UploadRequest{head}
+	for len(value) > 0 {
+		n := min(len(value), chunk)
+		msgs = append(msgs, &pb.UploadRequest{Data: value[:n]})
+		value = value[n:]
+	}
+	sum := sha256.Sum256(bytes.Join(dataOf(msgs), nil))
+	msgs[len(msgs)-1].Sha256 = sum[:]
+	return msgs
+}
+
+func dataOf(msgs []*pb.UploadRequest) [][]byte {
+	var data [][]byte
+	for _, m := range msgs {
+		data = append(data, m.Data)
+	}
+	return data
+}
+
+func upload(server *kvServer, msgs []*pb.UploadRequest) (*pb.SetResponse, error) {
+	stream := &fakeUploadStream{ctx: context.Background(), msgs: msgs}
+	err := server.Upload(stream)
+	return stream.resp, err
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	server := newTestServer(t)
+	value := make([]byte, 200<<10)
+	rand.Read(value)
+
+	resp, err := upload(server, uploadMessages(&pb.UploadRequest{Key: "blob", ContentType: "application/zip", Size: int64(len(value))}, value, 50<<10))
+	if err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+
+	stream := &fakeDownloadStream{ctx: context.Background()}
+	if err := server.Download(&pb.DownloadRequest{Key: "blob"}, stream); err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if len(stream.sent) != 4 {
+		t.Errorf("Download() sent %d chunks, want 4 of at most %d bytes", len(stream.sent), downloadChunkSize)
+	}
+	var got []byte
+	for _, chunk := range stream.sent {
+		got = append(got, chunk.Data...)
+	}
+	first := stream.sent[0]
+	sum := sha256.Sum256(value)
+	if !bytes.Equal(got, value) {
+		t.Errorf("Download() returned %d bytes that differ from the %d uploaded", len(got), len(value))
+	}
+	if first.Size != int64(len(value)) || first.ContentType != "application/zip" || first.Version != resp.Version || !bytes.Equal(first.Sha256, sum[:]) {
+		t.Errorf("Download() first chunk = size %d, %q, version %d, want the value's size, content type, version %d and SHA-256", first.Size, first.ContentType, first.Version, resp.Version)
+	}
+
+	err = server.Download(&pb.DownloadRequest{Key: "missing"}, &fakeDownloadStream{ctx: context.Background()})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Download() of a missing key error = %v, want NotFound", err)
+	}
+}
+
+func TestUploadVerifiesChecksum(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+
+	msgs := uploadMessages(&pb.UploadRequest{Key: "k"}, []byte("hello"), 2)
+	msgs[len(msgs)-1].Sha256 = make([]byte, sha256.Size)
+	if _, err := upload(server, msgs); status.Code(err) != codes.DataLoss {
+		t.Errorf("Upload() with a wrong checksum error = %v, want DataLoss", err)
+	}
+	msgs = uploadMessages(&pb.UploadRequest{Key: "k"}, []byte("hello"), 2)
+	msgs[len(msgs)-1].Sha256 = nil
+	if _, err := upload(server, msgs); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Upload() without a checksum error = %v, want InvalidArgument", err)
+	}
+	msgs = uploadMessages(&pb.UploadRequest{Key: "k", Size: 4}, []byte("hello"), 2)
+	if _, err := upload(server, msgs); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Upload() longer than its size error = %v, want InvalidArgument", err)
+	}
+	if resp, _ := server.Get(ctx, &pb.GetRequest{Key: "k"}); resp.Found {
+		t.Errorf("a failed upload stored the key")
+	}
+}
+
+func TestUploadIsConditional(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+	set, _ := server.Set(ctx, &pb.SetRequest{Key: "k", Value: "v"})
+
+	_, err := upload(server, uploadMessages(&pb.UploadRequest{Key: "k", MustNotExist: true}, []byte("new"), 8))
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Upload() of an existing key with must_not_exist error = %v, want FailedPrecondition", err)
+	}
+	if _, err := upload(server, uploadMessages(&pb.UploadRequest{Key: "k", ExpectedVersion: set.Version}, []byte("new"), 8)); err != nil {
+		t.Errorf("Upload() at the expected version error = %v", err)
+	}
+}
+
+func TestMaxObjectSize(t *testing.T) {
+	server := newTestServer(t)
+	server.maxObjectSize = 1000
+	ctx := context.Background()
+
+	tooLarge := func(what string, err error) {
+		t.Helper()
+		st := status.Convert(err)
+		var reason string
+		for _, d := range st.Details() {
+			if info, ok := d.(*errdetails.ErrorInfo); ok {
+				reason = info.Reason
+			}
+		}
+		if st.Code() != codes.ResourceExhausted || reason != objectTooLargeReason {
+			t.Errorf("%s error = %v, want ResourceExhausted with reason %s", what, err, objectTooLargeReason)
+		}
+	}
+
+	_, err := upload(server, []*pb.UploadRequest{{Key: "k", Size: 1001}})
+	tooLarge("Upload() announcing too large a size", err)
+	_, err = upload(server, uploadMessages(&pb.UploadRequest{Key: "k"}, make([]byte, 1500), 100))
+	tooLarge("Upload() of too large a value", err)
+	_, err = server.Set(ctx, &pb.SetRequest{Key: "k", ValueBytes: make([]byte, 1001)})
+	tooLarge("Set() of too large a value", err)
+	_, err = server.Txn(ctx, &pb.TxnRequest{Success: []*pb.TxnOp{{Type: pb.TxnOp_PUT, Key: "k", ValueBytes: make([]byte, 1001)}}})
+	tooLarge("Txn() put of too large a value", err)
+
+	if _, err := server.Set(ctx, &pb.SetRequest{Key: "k", ValueBytes: make([]byte, 1000)}); err != nil {
+		t.Errorf("Set() of a value at the limit error = %v", err)
+	}
+	if _, err := openKVServer(t.TempDir(), serverOptions{MaxObjectSize: -1}); err == nil {
+		t.Errorf("openKVServer() with a negative maximum object size error = nil, want an error")
+	}
+	if _, err := openKVServer(t.TempDir(), serverOptions{MaxObjectSize: maxObjectSizeLimit + 1}); err == nil {
+		t.Errorf("openKVServer() with a maximum object size over the limit error = nil, want an error")
+	}
+}
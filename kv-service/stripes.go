@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// defaultLockStripes is how many locks single-key operations are spread over
+const defaultLockStripes = 64
+
+// lockStripe is a lock padded to its own cache line, so that goroutines
+// taking neighbouring stripes don't contend on the same line
+type lockStripe struct {
+	sync.RWMutex
+	_ [40]byte
+}
+
+// concurrentEngine is implemented by engines whose get may run while a put or
+// delete of another key is in progress. Writes are still serialized by the
+// server.
+type concurrentEngine interface {
+	engine
+	concurrentGets()
+}
+
+// useLockStripes spreads single-key operations over n key-hashed locks when
+// the engine supports it, and otherwise leaves every operation on the global
+// lock. Callers must have exclusive access to the server.
+func (s *kvServer) useLockStripes(n int) {
+	s.stripes = nil
+	if _, ok := s.engine.(concurrentEngine); ok && n > 1 {
+		s.stripes = make([]lockStripe, n)
+	}
+}
+
+// keyHash is the 32-bit FNV-1a hash of key, computed without allocating
+func keyHash(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// stripeOf returns the lock stripe guarding key
+func (s *kvServer) stripeOf(key string) *lockStripe {
+	return &s.stripes[keyHash(key)%uint32(len(s.stripes))]
+}
+
+// rlockKey takes the locks needed to read key. With striping, writers of
+// other keys may proceed meanwhile.
+func (s *kvServer) rlockKey(key string) {
+	s.mu.RLock()
+	if s.stripes != nil {
+		s.stripeOf(key).RLock()
+	}
+}
+
+func (s *kvServer) runlockKey(key string) {
+	if s.stripes != nil {
+		s.stripeOf(key).RUnlock()
+	}
+	s.mu.RUnlock()
+}
+
+// rlockAll takes the locks needed to read more than one key, or the revision,
+// change feed or expiry index, which keeps every writer out
+func (s *kvServer) rlockAll() {
+	s.mu.RLock()
+	for i := range s.stripes {
+		s.stripes[i].RLock()
+	}
+}
+
+func (s *kvServer) runlockAll() {
+	for i := range s.stripes {
+		s.stripes[i].RUnlock()
+	}
+	s.mu.RUnlock()
+}
+
+// mutateKey is mutate for a write that only reads and writes key. With
+// striping, eval runs under the key's stripe, so that writes of keys on other
+// stripes are evaluated in parallel and readers of other keys are not
+// blocked. Logging and applying the record are serialized by seqMu, which
+// keeps revisions in WAL order; the stripe keeps the key's state from changing
+// between eval and apply, so each key still sees its writes in revision order.
+func (s *kvServer) mutateKey(ctx context.Context, key string, eval func(v *txnView) (*walRecord, error)) (uint64, error) {
+	if s.stripes == nil || s.raft != nil {
+		return s.mutate(ctx, eval)
+	}
+
+	s.mu.RLock()
+	stripe := s.stripeOf(key)
+	stripe.Lock()
+	unlock := func() {
+		stripe.Unlock()
+		s.mu.RUnlock()
+	}
+	view := s.newView()
+	rec, err := eval(view)
+	if err == nil {
+		err = view.err
+	}
+	if err != nil || rec == nil {
+		s.seqMu.Lock()
+		rev := s.rev
+		s.seqMu.Unlock()
+		unlock()
+		return rev, err
+	}
+	s.seqMu.Lock()
+	if err := s.admit(rec); err != nil {
+		s.seqMu.Unlock()
+		unlock()
+		return 0, err
+	}
+	if err := s.logMutation(rec); err != nil {
+		s.seqMu.Unlock()
+		unlock()
+		return 0, err
+	}
+	s.apply(*rec)
+	s.seqMu.Unlock()
+	unlock()
+
+	// Evicting deletes keys on other stripes, so it waits for the write lock.
+	// Until then, concurrent writes may take the store briefly over its limit.
+	if s.budget != nil && s.budget.overLimit() {
+		s.mu.Lock()
+		s.evictLocked(rec)
+		s.mu.Unlock()
+	}
+
+	return rec.Seq, s.waitDurable(rec.Seq)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLockStripesNeedConcurrentEngine(t *testing.T) {
+	server := newKVServer()
+	if server.stripes == nil {
+		t.Errorf("memory engine server has no lock stripes")
+	}
+	server.useLockStripes(1)
+	if server.stripes != nil {
+		t.Errorf("useLockStripes(1) left %d stripes, want none", len(server.stripes))
+	}
+
+	eng, err := openBitcask(t.TempDir(), bitcaskOptions{})
+	if err != nil {
+		t.Fatalf("openBitcask() error = %v", err)
+	}
+	defer eng.close()
+	server.engine = eng
+	server.useLockStripes(defaultLockStripes)
+	if server.stripes != nil {
+		t.Errorf("bitcask engine server has lock stripes, want the global lock")
+	}
+}
+
+// Increments of shared counters by compare-and-set must neither be lost nor
+// applied twice, whichever stripes the counters land on
+func TestStripedCompareAndSetIsLinearizable(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+	const goroutines, increments, counters = 8, 50, 3
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				key := fmt.Sprintf("counter-%d", (g+i)%counters)
+				for {
+					cur, err := server.Get(ctx, &pb.GetRequest{Key: key})
+					if err != nil {
+						t.Errorf("Get() error = %v", err)
+						return
+					}
+					req := &pb.CompareAndSetRequest{Key: key, ExpectedVersion: cur.Version, MustNotExist: !cur.Found}
+					n, _ := strconv.Atoi(cur.Value)
+					req.Value = strconv.Itoa(n + 1)
+					_, err = server.CompareAndSet(ctx, req)
+					if err == nil {
+						break
+					}
+					if status.Code(err) != codes.FailedPrecondition {
+						t.Errorf("CompareAndSet() error = %v", err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	for c := 0; c < counters; c++ {
+		resp, _ := server.Get(ctx, &pb.GetRequest{Key: fmt.Sprintf("counter-%d", c)})
+		n, _ := strconv.Atoi(resp.Value)
+		total += n
+	}
+	if total != goroutines*increments {
+		t.Errorf("counters sum to %d, want %d", total, goroutines*increments)
+	}
+	if server.rev != uint64(goroutines*increments) {
+		t.Errorf("revision = %d, want one per successful increment (%d)", server.rev, goroutines*increments)
+	}
+}
+
+// A multi-key read must not see a later write to one key without an earlier
+// write to another, even when the keys are on different stripes
+func TestStripedBatchGetIsConsistent(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for round := 1; round <= 300; round++ {
+			v := strconv.Itoa(round)
+			server.Set(ctx, &pb.SetRequest{Key: "first", Value: v})
+			server.Set(ctx, &pb.SetRequest{Key: "second", Value: v})
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		resp, err := server.BatchGet(ctx, &pb.BatchGetRequest{Keys: []string{"first", "second"}})
+		if err != nil {
+			t.Fatalf("BatchGet() error = %v", err)
+		}
+		first, _ := strconv.Atoi(resp.Results[0].Value)
+		second, _ := strconv.Atoi(resp.Results[1].Value)
+		if second > first {
+			t.Fatalf("BatchGet() saw second at round %d but first at round %d", second, first)
+		}
+		for _, r := range resp.Results {
+			if r.Version > resp.Revision {
+				t.Fatalf("BatchGet() %s at version %d after revision %d", r.Key, r.Version, resp.Revision)
+			}
+		}
+	}
+}
+
+// benchServerKeys is how many keys the concurrency benchmarks preload
+const benchServerKeys = 10000
+
+// BenchmarkServerConcurrency measures single-key operations per second with
+// increasing numbers of goroutines, once with every operation on the global
+// lock and once with lock striping
+func BenchmarkServerConcurrency(b *testing.B) {
+	// Logging every operation would serialize the goroutines on the logger
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	ctx := context.Background()
+	value := string(make([]byte, benchValueSize))
+	workloads := []struct {
+		name string
+		op   func(s *kvServer, i int)
+	}{
+		{"get", func(s *kvServer, i int) {
+			s.Get(ctx, &pb.GetRequest{Key: benchKey(i % benchServerKeys)})
+		}},
+		{"set", func(s *kvServer, i int) {
+			s.Set(ctx, &pb.SetRequest{Key: benchKey(i % benchServerKeys), Value: value})
+		}},
+		// One write in ten
+		{"mixed", func(s *kvServer, i int) {
+			if i%10 == 0 {
+				s.Set(ctx, &pb.SetRequest{Key: benchKey(i % benchServerKeys), Value: value})
+			} else {
+				s.Get(ctx, &pb.GetRequest{Key: benchKey(i % benchServerKeys)})
+			}
+		}},
+	}
+	locking := []struct {
+		name    string
+		stripes int
+	}{
+		{"global", 1},
+		{"striped", defaultLockStripes},
+	}
+
+	for _, w := range workloads {
+		for _, l := range locking {
+			for _, goroutines := range []int{1, 2, 4, 8, 16, 32, 64} {
+				b.Run(fmt.Sprintf("%s/%s/goroutines=%d", w.name, l.name, goroutines), func(b *testing.B) {
+					s := newKVServer()
+					s.useLockStripes(l.stripes)
+					for i := 0; i < benchServerKeys; i++ {
+						s.Set(ctx, &pb.SetRequest{Key: benchKey(i), Value: value})
+					}
+					runConcurrently(b, goroutines, func(i int) { w.op(s, i) })
+				})
+			}
+		}
+	}
+}
+
+// runConcurrently calls op b.N times in total, spread over the goroutines
+func runConcurrently(b *testing.B, goroutines int, op func(i int)) {
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1))
+				if i > b.N {
+					return
+				}
+				op(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sweepBatchSize bounds how many expiry index entries the sweeper examines per
+// acquisition of the write lock, so reclaiming a large backlog of expired keys
+// never stalls other requests for long
+const sweepBatchSize = 256
+
+// maxTTLSeconds is the longest TTL a key can be given, about 100 years. Expiry
+// times are nanoseconds since the epoch, which a much longer TTL would
+// overflow.
+const maxTTLSeconds = 100 * 365 * 24 * 60 * 60
+
+// expiryItem records that key was given the expiry time at
+type expiryItem struct {
+	key string
+	at  int64
+}
+
+// expiryHeap is a min-heap of expiry items ordered by expiry time, holding at
+// most one item per key. Overwriting, touching or deleting a key moves or
+// removes its item, so the heap never grows beyond the keys that have a TTL.
+type expiryHeap struct {
+	items []expiryItem
+	// index is the position of each key's item in items
+	index map[string]int
+}
+
+func (h expiryHeap) Len() int           { return len(h.items) }
+func (h expiryHeap) Less(i, j int) bool { return h.items[i].at < h.items[j].at }
+func (h expiryHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.index[h.items[i].key] = i
+	h.index[h.items[j].key] = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	item := x.(expiryItem)
+	if h.index == nil {
+		h.index = make(map[string]int)
+	}
+	h.index[item.key] = len(h.items)
+	h.items = append(h.items, item)
+}
+
+func (h *expiryHeap) Pop() any {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	delete(h.index, item.key)
+	return item
+}
+
+// set gives key the expiry time at, or removes it from the heap if at is 0
+func (h *expiryHeap) set(key string, at int64) {
+	i, ok := h.index[key]
+	switch {
+	case at == 0 && ok:
+		heap.Remove(h, i)
+	case at == 0:
+	case ok:
+		h.items[i].at = at
+		heap.Fix(h, i)
+	default:
+		heap.Push(h, expiryItem{key: key, at: at})
+	}
+}
+
+// due reports whether the earliest item expires at or before now
+func (h *expiryHeap) due(now int64) bool {
+	return len(h.items) > 0 && h.items[0].at <= now
+}
+
+// pop removes and returns the earliest item
+func (h *expiryHeap) pop() expiryItem {
+	return heap.Pop(h).(expiryItem)
+}
+
+// restore puts back an item taken by pop, unless its key has been given a
+// new expiry since
+func (h *expiryHeap) restore(item expiryItem) {
+	if _, ok := h.index[item.key]; !ok {
+		heap.Push(h, item)
+	}
+}
+
+// reset empties the heap
+func (h *expiryHeap) reset() {
+	h.items = h.items[:0]
+	h.index = make(map[string]int)
+}
+
+// trackExpiry records the expiry time of key in the expiry index, where 0
+// means it has none. Callers must hold the write lock.
+func (s *kvServer) trackExpiry(key string, at int64) {
+	s.expiries.set(key, at)
+}
+
+// checkTTL returns an InvalidArgument error unless ttlSeconds is a TTL a key
+// can be given
+func checkTTL(ttlSeconds int64) error {
+	switch {
+	case ttlSeconds < 0:
+		return status.Errorf(codes.InvalidArgument, "ttl_seconds must not be negative")
+	case ttlSeconds > maxTTLSeconds:
+		return status.Errorf(codes.InvalidArgument, "ttl_seconds must be at most %d", maxTTLSeconds)
+	}
+	return nil
+}
+
+// expiryFor converts a TTL in seconds into an absolute expiry time, where a
+// TTL of 0 means the key never expires
+func (s *kvServer) expiryFor(ttlSeconds int64) int64 {
+	if ttlSeconds == 0 {
+		return 0
+	}
+	return s.now().Add(time.Duration(ttlSeconds) * time.Second).UnixNano()
+}
+
+// remainingTTL returns the whole seconds left before e expires, rounded up, or
+// -1 if it never expires
+func remainingTTL(e entry, now int64) int64 {
+	if e.expiresAt == 0 {
+		return -1
+	}
+	return (e.expiresAt - now + int64(time.Second) - 1) / int64(time.Second)
+}
+
+// sweepExpired deletes every key whose TTL has elapsed and returns how many
+// were removed. The write lock is taken once per batch rather than for the
+// whole sweep.
+func (s *kvServer) sweepExpired() int {
+	if s.raft != nil {
+		return s.sweepCluster()
+	}
+	removed := 0
+	for {
+		s.mu.Lock()
+		n, more := s.sweepBatchLocked(s.now().UnixNano())
+		s.mu.Unlock()
+
+		removed += n
+		if !more {
+			return removed
+		}
+	}
+}
+
+// sweepBatchLocked examines up to sweepBatchSize due items of the expiry index
+// and deletes the keys that have expired. It reports how many keys it removed
+// and whether due items remain. Callers must hold the write lock.
+func (s *kvServer) sweepBatchLocked(now int64) (int, bool) {
+	removed := 0
+	for i := 0; i < sweepBatchSize; i++ {
+		if !s.expiries.due(now) {
+			return removed, false
+		}
+		item := s.expiries.pop()
+
+		e, ok, err := s.lookup(item.key)
+		if err != nil {
+			log.Printf("TTL sweep: %v", err)
+			s.expiries.restore(item)
+			return removed, false
+		}
+		if !ok || e.expiresAt != item.at {
+			// The engine disagrees with the index, as after a failed
+			// write; the item is dropped
+			continue
+		}
+
+		// Expirations are logged like any other delete so that the WAL
+		// replays to the same state
+		rec := walRecord{Op: walOpDelete, Key: item.key}
+		if err := s.logMutation(&rec); err != nil {
+			log.Printf("TTL sweep: %v", err)
+			s.expiries.restore(item)
+			return removed, false
+		}
+		s.apply(rec)
+		removed++
+	}
+	return removed, true
+}
+
+func (s *kvServer) sweepLoop(interval time.Duration) {
+	defer s.loops.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if n := s.sweepExpired(); n > 0 {
+				log.Printf("TTL sweep removed %d expired keys", n)
+			}
+		}
+	}
+}
+
+// GetTTL returns the remaining time to live of a key using a read lock
+func (s *kvServer) GetTTL(ctx context.Context, req *pb.GetTTLRequest) (*pb.GetTTLResponse, error) {
+	_, key, err := s.namespaceKey(req.Namespace, req.Key)
+	if err != nil {
+		return nil, err
+	}
+	s.rlockKey(key)
+	defer s.runlockKey(key)
+
+	now := s.now().UnixNano()
+	e, found, err := s.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	if !found || e.expired(now) {
+		return &pb.GetTTLResponse{
+			Found:   false,
+			Message: fmt.Sprintf("Key '%s' not found", req.Key),
+		}, nil
+	}
+
+	return &pb.GetTTLResponse{
+		Found:      true,
+		TtlSeconds: remainingTTL(e, now),
+		Message:    "TTL retrieved successfully",
+	}, nil
+}
+
+// Touch replaces the TTL of an existing key without rewriting its value
+func (s *kvServer) Touch(ctx context.Context, req *pb.TouchRequest) (resp *pb.TouchResponse, err error) {
+	var (
+		found   bool
+		version uint64
+	)
+	defer func() {
+		s.recordAudit(ctx, auditEvent{op: auditTouch, namespace: req.Namespace, key: req.Key, version: version, missing: !found, err: err})
+	}()
+	if err := s.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := checkTTL(req.TtlSeconds); err != nil {
+		return nil, err
+	}
+
+	n, key, err := s.namespaceKey(req.Namespace, req.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err = s.mutateKey(ctx, key, func(v *txnView) (*walRecord, error) {
+		if err := s.checkNamespace(n); err != nil {
+			return nil, err
+		}
+		if _, found, _ = v.get(key); !found {
+			return nil, nil
+		}
+		return &walRecord{Op: walOpExpire, Key: key, ExpiresAt: s.expiryFor(req.TtlSeconds)}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return &pb.TouchResponse{
+			Success: false,
+			Message: fmt.Sprintf("Key '%s' not found", req.Key),
+		}, nil
+	}
+	log.Printf("Touch key=%s, ttl=%ds", req.Key, req.TtlSeconds)
+
+	return &pb.TouchResponse{
+		Success: true,
+		Message: fmt.Sprintf("TTL of key '%s' updated successfully", req.Key),
+	}, nil
+}
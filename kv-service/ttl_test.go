@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeClock lets tests move time forward without sleeping
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newClockedKVServer(t *testing.T) (*kvServer, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	server := newTestServer(t)
+	server.now = clock.now
+	return server, clock
+}
+
+func TestTTLExpiredKeyNotFound(t *testing.T) {
+	server, clock := newClockedKVServer(t)
+	ctx := context.Background()
+
+	server.Set(ctx, &pb.SetRequest{Key: "session", Value: "token", TtlSeconds: 10})
+
+	resp, _ := server.Get(ctx, &pb.GetRequest{Key: "session"})
+	if !resp.Found {
+		t.Fatalf("Get() found = false before expiry, want true")
+	}
+
+	clock.advance(10 * time.Second)
+	resp, _ = server.Get(ctx, &pb.GetRequest{Key: "session"})
+	if resp.Found {
+		t.Errorf("Get() found = true after expiry, want false")
+	}
+	delResp, _ := server.Delete(ctx, &pb.DeleteRequest{Key: "session"})
+	if delResp.Success {
+		t.Errorf("Delete() success = true for expired key, want false")
+	}
+}
+
+func TestTTLSetWithoutTTLClearsExpiry(t *testing.T) {
+	server, clock := newClockedKVServer(t)
+	ctx := context.Background()
+
+	server.Set(ctx, &pb.SetRequest{Key: "key", Value: "v1", TtlSeconds: 5})
+	server.Set(ctx, &pb.SetRequest{Key: "key", Value: "v2"})
+	clock.advance(time.Minute)
+
+	if n := server.sweepExpired(); n != 0 {
+		t.Errorf("sweepExpired() = %d, want 0 for overwritten key", n)
+	}
+	resp, _ := server.Get(ctx, &pb.GetRequest{Key: "key"})
+	if !resp.Found || resp.Value != "v2" {
+		t.Errorf("Get() = %v/%q, want true/%q", resp.Found, resp.Value, "v2")
+	}
+}
+
+func TestTTLSweeper(t *testing.T) {
+	server, clock := newClockedKVServer(t)
+	ctx := context.Background()
+
+	// More keys than a single sweep batch
+	for i := 0; i < sweepBatchSize*2+10; i++ {
+		server.Set(ctx, &pb.SetRequest{Key: fmt.Sprintf("key%d", i), Value: "v", TtlSeconds: 1})
+	}
+	server.Set(ctx, &pb.SetRequest{Key: "long", Value: "v", TtlSeconds: 60})
+	server.Set(ctx, &pb.SetRequest{Key: "forever", Value: "v"})
+
+	clock.advance(2 * time.Second)
+	if n := server.sweepExpired(); n != sweepBatchSize*2+10 {
+		t.Errorf("sweepExpired() = %d, want %d", n, sweepBatchSize*2+10)
+	}
+
+	server.mu.RLock()
+	remaining := server.engine.len()
+	server.mu.RUnlock()
+	if remaining != 2 {
+		t.Errorf("store has %d keys after sweep, want 2", remaining)
+	}
+}
+
+func TestGetTTL(t *testing.T) {
+	server, clock := newClockedKVServer(t)
+	ctx := context.Background()
+
+	server.Set(ctx, &pb.SetRequest{Key: "ttl", Value: "v", TtlSeconds: 30})
+	server.Set(ctx, &pb.SetRequest{Key: "forever", Value: "v"})
+	clock.advance(10*time.Second + time.Millisecond)
+
+	resp, err := server.GetTTL(ctx, &pb.GetTTLRequest{Key: "ttl"})
+	if err != nil || !resp.Found || resp.TtlSeconds != 20 {
+		t.Errorf("GetTTL(ttl) = %v, %v; want found with 20s", resp, err)
+	}
+	resp, _ = server.GetTTL(ctx, &pb.GetTTLRequest{Key: "forever"})
+	if !resp.Found || resp.TtlSeconds != -1 {
+		t.Errorf("GetTTL(forever) ttl = %d, want -1", resp.TtlSeconds)
+	}
+	resp, _ = server.GetTTL(ctx, &pb.GetTTLRequest{Key: "missing"})
+	if resp.Found {
+		t.Errorf("GetTTL(missing) found = true, want false")
+	}
+}
+
+func TestTouch(t *testing.T) {
+	server, clock := newClockedKVServer(t)
+	ctx := context.Background()
+
+	server.Set(ctx, &pb.SetRequest{Key: "key", Value: "value", TtlSeconds: 5})
+	clock.advance(4 * time.Second)
+
+	resp, err := server.Touch(ctx, &pb.TouchRequest{Key: "key", TtlSeconds: 5})
+	if err != nil || !resp.Success {
+		t.Fatalf("Touch() = %v, %v; want success", resp, err)
+	}
+	clock.advance(4 * time.Second)
+	server.sweepExpired()
+
+	getResp, _ := server.Get(ctx, &pb.GetRequest{Key: "key"})
+	if !getResp.Found || getResp.Value != "value" {
+		t.Errorf("Get() after Touch = %v/%q, want true/%q", getResp.Found, getResp.Value, "value")
+	}
+
+	// A TTL of 0 makes the key persistent
+	server.Touch(ctx, &pb.TouchRequest{Key: "key", TtlSeconds: 0})
+	clock.advance(time.Hour)
+	getResp, _ = server.Get(ctx, &pb.GetRequest{Key: "key"})
+	if !getResp.Found {
+		t.Errorf("Get() found = false after clearing TTL, want true")
+	}
+
+	resp, _ = server.Touch(ctx, &pb.TouchRequest{Key: "missing", TtlSeconds: 5})
+	if resp.Success {
+		t.Errorf("Touch(missing) success = true, want false")
+	}
+}
+
+func TestTTLNegative(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+
+	_, err := server.Set(ctx, &pb.SetRequest{Key: "key", Value: "v", TtlSeconds: -1})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Set() error = %v, want InvalidArgument", err)
+	}
+	_, err = server.Touch(ctx, &pb.TouchRequest{Key: "key", TtlSeconds: -1})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Touch() error = %v, want InvalidArgument", err)
+	}
+}
+
+func TestTTLMaximum(t *testing.T) {
+	server, clock := newClockedKVServer(t)
+	ctx := context.Background()
+
+	if _, err := server.Set(ctx, &pb.SetRequest{Key: "key", Value: "v", TtlSeconds: maxTTLSeconds}); err != nil {
+		t.Fatalf("Set() with the maximum TTL error = %v", err)
+	}
+	clock.advance(time.Hour)
+	resp, _ := server.GetTTL(ctx, &pb.GetTTLRequest{Key: "key"})
+	if !resp.Found || resp.TtlSeconds != maxTTLSeconds-3600 {
+		t.Errorf("GetTTL() = %v, want found with %ds", resp, maxTTLSeconds-3600)
+	}
+
+	// A TTL that would overflow the expiry time is refused everywhere
+	tooLong := int64(maxTTLSeconds + 1)
+	checks := map[string]func() error{
+		"Set": func() error {
+			_, err := server.Set(ctx, &pb.SetRequest{Key: "key", Value: "v", TtlSeconds: 10_000_000_000})
+			return err
+		},
+		"CompareAndSet": func() error {
+			_, err := server.CompareAndSet(ctx, &pb.CompareAndSetRequest{Key: "key", Value: "v", MustExist: true, TtlSeconds: tooLong})
+			return err
+		},
+		"Touch": func() error {
+			_, err := server.Touch(ctx, &pb.TouchRequest{Key: "key", TtlSeconds: tooLong})
+			return err
+		},
+		"BatchSet": func() error {
+			_, err := server.BatchSet(ctx, &pb.BatchSetRequest{Atomic: true, Items: []*pb.SetRequest{{Key: "key", Value: "v", TtlSeconds: tooLong}}})
+			return err
+		},
+		"Txn": func() error {
+			_, err := server.Txn(ctx, &pb.TxnRequest{Success: []*pb.TxnOp{{Type: pb.TxnOp_PUT, Key: "key", Value: "v", TtlSeconds: tooLong}}})
+			return err
+		},
+	}
+	for name, check := range checks {
+		if err := check(); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s() with a TTL over the maximum error = %v, want InvalidArgument", name, err)
+		}
+	}
+}
+
+func TestExpiryIndexHoldsOneItemPerKey(t *testing.T) {
+	server, clock := newClockedKVServer(t)
+	ctx := context.Background()
+
+	for i := 0; i < 100; i++ {
+		server.Set(ctx, &pb.SetRequest{Key: "hot", Value: "v", TtlSeconds: 3600})
+		server.Touch(ctx, &pb.TouchRequest{Key: "hot", TtlSeconds: 7200})
+	}
+	server.Set(ctx, &pb.SetRequest{Key: "gone", Value: "v", TtlSeconds: 60})
+	server.Delete(ctx, &pb.DeleteRequest{Key: "gone"})
+	server.Set(ctx, &pb.SetRequest{Key: "persistent", Value: "v", TtlSeconds: 60})
+	server.Set(ctx, &pb.SetRequest{Key: "persistent", Value: "v"})
+
+	if n := server.expiries.Len(); n != 1 {
+		t.Errorf("Expiry index holds %d items, want 1", n)
+	}
+
+	// The latest TTL is the one that counts
+	clock.advance(3601 * time.Second)
+	server.sweepExpired()
+	if resp, _ := server.Get(ctx, &pb.GetRequest{Key: "hot"}); !resp.Found {
+		t.Errorf("Expected the key to outlive its earlier TTL")
+	}
+	clock.advance(3600 * time.Second)
+	if n := server.sweepExpired(); n != 1 {
+		t.Errorf("sweepExpired() = %d, want 1", n)
+	}
+}
+
+func TestTTLSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	opts := serverOptions{WAL: walOptions{Sync: syncAlways}}
+
+	server, err := openKVServer(dir, opts)
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	server.Set(ctx, &pb.SetRequest{Key: "snap", Value: "v", TtlSeconds: 3600})
+	server.snapshot()
+	server.Set(ctx, &pb.SetRequest{Key: "wal", Value: "v"})
+	server.Touch(ctx, &pb.TouchRequest{Key: "wal", TtlSeconds: 3600})
+	server.Close()
+
+	server, err = openKVServer(dir, opts)
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	defer server.Close()
+
+	for _, key := range []string{"snap", "wal"} {
+		resp, _ := server.GetTTL(ctx, &pb.GetTTLRequest{Key: key})
+		if !resp.Found || resp.TtlSeconds <= 0 {
+			t.Errorf("GetTTL(%s) = %v/%d, want a positive TTL", key, resp.Found, resp.TtlSeconds)
+		}
+	}
+
+	// The expiry index is rebuilt on recovery
+	server.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if n := server.sweepExpired(); n != 2 {
+		t.Errorf("sweepExpired() after restart = %d, want 2", n)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxTxnOps bounds the number of compares and of ops in each branch of a
+// transaction, since the whole transaction runs under the write lock
+const maxTxnOps = 128
+
+// txnView layers the writes of a transaction in progress over the store, so
+// that later ops see the effect of earlier ones before anything is applied
+type txnView struct {
+	s       *kvServer
+	now     int64
+	pending map[string]txnKey
+	// reads records the stored version of every key read from the store,
+	// 0 if absent, when the write must be validated again at commit time
+	reads map[string]uint64
+	// err is the first error reading from the store. The write is abandoned
+	// if it is set once eval returns.
+	err error
+}
+
+// newView returns a view of the store as it is now. Callers must hold the lock.
+func (s *kvServer) newView() *txnView {
+	v := &txnView{s: s, now: s.now().UnixNano(), pending: make(map[string]txnKey)}
+	if s.raft != nil {
+		v.reads = make(map[string]uint64)
+	}
+	return v
+}
+
+// txnKey is the state of a key written earlier in the same transaction
+type txnKey struct {
+	e     entry
+	found bool
+}
+
+// get returns the live entry for key and whether it was written by the
+// transaction itself
+func (v *txnView) get(key string) (entry, bool, bool) {
+	if k, ok := v.pending[key]; ok {
+		return k.e, k.found, true
+	}
+	e, found, err := v.s.lookup(key)
+	if err != nil && v.err == nil {
+		v.err = err
+	}
+	if v.reads != nil {
+		v.reads[key] = e.version
+	}
+	return e, found && !e.expired(v.now), false
+}
+
+func (v *txnView) put(key string, e entry, found bool) {
+	v.pending[key] = txnKey{e: e, found: found}
+}
+
+// compareHolds evaluates a single compare against the current state of its key
+func compareHolds(c *pb.Compare, e entry, found bool) bool {
+	var cmp int
+	switch c.Target {
+	case pb.Compare_VALUE:
+		if !found {
+			return false
+		}
+		want := c.Value
+		if len(c.ValueBytes) > 0 {
+			want = string(c.ValueBytes)
+		}
+		switch {
+		case e.value < want:
+			cmp = -1
+		case e.value > want:
+			cmp = 1
+		}
+	case pb.Compare_VERSION:
+		var version uint64
+		if found {
+			version = e.version
+		}
+		switch {
+		case version < c.Version:
+			cmp = -1
+		case version > c.Version:
+			cmp = 1
+		}
+	}
+
+	switch c.Result {
+	case pb.Compare_EQUAL:
+		return cmp == 0
+	case pb.Compare_NOT_EQUAL:
+		return cmp != 0
+	case pb.Compare_GREATER:
+		return cmp > 0
+	case pb.Compare_LESS:
+		return cmp < 0
+	}
+	return false
+}
+
+func (s *kvServer) validateTxn(n *namespace, req *pb.TxnRequest) error {
+	if len(req.Compare) > maxTxnOps || len(req.Success) > maxTxnOps || len(req.Failure) > maxTxnOps {
+		return status.Errorf(codes.InvalidArgument, "transactions are limited to %d compares and %d ops per branch", maxTxnOps, maxTxnOps)
+	}
+	for _, c := range req.Compare {
+		if _, ok := pb.Compare_Target_name[int32(c.Target)]; !ok {
+			return status.Errorf(codes.InvalidArgument, "unknown compare target %d", c.Target)
+		}
+		if _, ok := pb.Compare_Result_name[int32(c.Result)]; !ok {
+			return status.Errorf(codes.InvalidArgument, "unknown compare result %d", c.Result)
+		}
+		if c.Value != "" && len(c.ValueBytes) > 0 {
+			return status.Errorf(codes.InvalidArgument, "value and value_bytes are mutually exclusive")
+		}
+		if err := n.checkKey(c.Key); err != nil {
+			return err
+		}
+	}
+	for _, ops := range [][]*pb.TxnOp{req.Success, req.Failure} {
+		for _, op := range ops {
+			if _, ok := pb.TxnOp_Type_name[int32(op.Type)]; !ok {
+				return status.Errorf(codes.InvalidArgument, "unknown op type %d", op.Type)
+			}
+			if err := checkTTL(op.TtlSeconds); err != nil {
+				return err
+			}
+			if _, err := s.requestValue(n, op.Value, op.ValueBytes, op.ContentType); err != nil {
+				return err
+			}
+			if err := n.checkKey(op.Key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// txnWrites reports whether either branch of a transaction can write, which
+// followers only allow for read-only transactions
+func txnWrites(req *pb.TxnRequest) bool {
+	for _, ops := range [][]*pb.TxnOp{req.Success, req.Failure} {
+		for _, op := range ops {
+			if op.Type != pb.TxnOp_GET {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Txn evaluates every compare and then runs either the success or the failure
+// ops, all under a single write lock. The writes are logged as one WAL record
+// so that they are applied, replayed and watched as a unit.
+func (s *kvServer) Txn(ctx context.Context, req *pb.TxnRequest) (resp *pb.TxnResponse, err error) {
+	defer func() { s.recordAudit(ctx, s.txnAudit(req, resp, err)...) }()
+	n, err := s.namespace(req.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.validateTxn(n, req); err != nil {
+		return nil, err
+	}
+	if txnWrites(req) {
+		if err := s.checkWritable(); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		succeeded bool
+		results   []*pb.TxnOpResult
+		writes    int
+		// Reads of keys written earlier in the transaction learn their
+		// version only once the transaction is assigned a revision
+		unversioned []*pb.TxnOpResult
+	)
+	revision, err := s.mutate(ctx, func(view *txnView) (*walRecord, error) {
+		succeeded = true
+		for _, c := range req.Compare {
+			e, found, _ := view.get(n.key(c.Key))
+			if !compareHolds(c, e, found) {
+				succeeded = false
+				break
+			}
+		}
+		ops := req.Success
+		if !succeeded {
+			ops = req.Failure
+		}
+
+		rec := walRecord{Op: walOpTxn}
+		results = make([]*pb.TxnOpResult, len(ops))
+		unversioned = nil
+		for i, op := range ops {
+			result := &pb.TxnOpResult{Type: op.Type, Key: op.Key}
+			results[i] = result
+
+			key := n.key(op.Key)
+			switch op.Type {
+			case pb.TxnOp_GET:
+				e, found, written := view.get(key)
+				if found {
+					result.Found = true
+					result.Value = textValue(e.value)
+					result.ValueBytes = []byte(e.value)
+					result.ContentType = e.contentType
+					result.Version = e.version
+					if written {
+						unversioned = append(unversioned, result)
+					}
+				}
+			case pb.TxnOp_PUT:
+				value, _ := s.requestValue(n, op.Value, op.ValueBytes, op.ContentType)
+				e := entry{value: value, expiresAt: s.expiryFor(n.ttl(op.TtlSeconds)), contentType: op.ContentType}
+				view.put(key, e, true)
+				rec.Ops = append(rec.Ops, walRecord{Op: walOpSet, Key: key, Value: e.value, ExpiresAt: e.expiresAt, ContentType: e.contentType})
+				unversioned = append(unversioned, result)
+			case pb.TxnOp_DELETE:
+				if _, found, _ := view.get(key); found {
+					result.Found = true
+					view.put(key, entry{}, false)
+					rec.Ops = append(rec.Ops, walRecord{Op: walOpDelete, Key: key})
+				}
+			}
+		}
+
+		writes = len(rec.Ops)
+		if writes == 0 {
+			// Read-only transactions leave no trace in the log
+			return nil, nil
+		}
+		if err := s.checkNamespace(n); err != nil {
+			return nil, err
+		}
+		return &rec, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if writes == 0 {
+		return &pb.TxnResponse{Succeeded: succeeded, Revision: revision, Results: results}, nil
+	}
+
+	for _, result := range unversioned {
+		result.Version = revision
+	}
+	log.Printf("Txn succeeded=%v, ops=%d, writes=%d, revision=%d", succeeded, len(results), writes, revision)
+
+	return &pb.TxnResponse{Succeeded: succeeded, Revision: revision, Results: results}, nil
+}
+
+// txnAudit returns the audit events of a transaction's writes: those of the
+// branch that ran, or if the transaction failed, those of both branches
+func (s *kvServer) txnAudit(req *pb.TxnRequest, resp *pb.TxnResponse, err error) []auditEvent {
+	if s.audit == nil {
+		return nil
+	}
+	ops := slices.Concat(req.Success, req.Failure)
+	if err == nil {
+		ops = req.Success
+		if !resp.Succeeded {
+			ops = req.Failure
+		}
+	}
+	var events []auditEvent
+	for i, op := range ops {
+		ev := auditEvent{namespace: req.Namespace, key: op.Key, err: err}
+		switch op.Type {
+		case pb.TxnOp_PUT:
+			ev.op, ev.sum = auditSet, s.auditSum(op.Value, op.ValueBytes)
+		case pb.TxnOp_DELETE:
+			ev.op = auditDelete
+			ev.missing = err == nil && !resp.Results[i].Found
+		default:
+			continue
+		}
+		if err == nil {
+			ev.version = resp.Revision
+		}
+		events = append(events, ev)
+	}
+	return events
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTxnBranches(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+
+	setResp, _ := server.Set(ctx, &pb.SetRequest{Key: "balance", Value: "100"})
+
+	// Compare-and-swap two keys at once
+	req := &pb.TxnRequest{
+		Compare: []*pb.Compare{
+			{Key: "balance", Target: pb.Compare_VERSION, Result: pb.Compare_EQUAL, Version: setResp.Version},
+			{Key: "lock", Target: pb.Compare_VERSION, Result: pb.Compare_EQUAL, Version: 0},
+		},
+		Success: []*pb.TxnOp{
+			{Type: pb.TxnOp_PUT, Key: "balance", Value: "50"},
+			{Type: pb.TxnOp_PUT, Key: "lock", Value: "held"},
+		},
+		Failure: []*pb.TxnOp{
+			{Type: pb.TxnOp_GET, Key: "balance"},
+		},
+	}
+	resp, err := server.Txn(ctx, req)
+	if err != nil || !resp.Succeeded {
+		t.Fatalf("Txn() = %v, %v; want success", resp, err)
+	}
+	for _, key := range []string{"balance", "lock"} {
+		get, _ := server.Get(ctx, &pb.GetRequest{Key: key})
+		if get.Version != resp.Revision {
+			t.Errorf("Get(%s) version = %d, want transaction revision %d", key, get.Version, resp.Revision)
+		}
+	}
+
+	// Replaying the same transaction takes the failure branch
+	resp, err = server.Txn(ctx, req)
+	if err != nil || resp.Succeeded {
+		t.Fatalf("Txn() again = %v, %v; want failure branch", resp, err)
+	}
+	if len(resp.Results) != 1 || !resp.Results[0].Found || resp.Results[0].Value != "50" {
+		t.Errorf("Txn() failure results = %v, want GET balance=50", resp.Results)
+	}
+}
+
+func TestTxnCompares(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+	server.Set(ctx, &pb.SetRequest{Key: "key", Value: "b"})
+
+	tests := []struct {
+		name string
+		cmp  *pb.Compare
+		want bool
+	}{
+		{"value equal", &pb.Compare{Key: "key", Target: pb.Compare_VALUE, Result: pb.Compare_EQUAL, Value: "b"}, true},
+		{"value not equal", &pb.Compare{Key: "key", Target: pb.Compare_VALUE, Result: pb.Compare_NOT_EQUAL, Value: "b"}, false},
+		{"value greater", &pb.Compare{Key: "key", Target: pb.Compare_VALUE, Result: pb.Compare_GREATER, Value: "a"}, true},
+		{"value less", &pb.Compare{Key: "key", Target: pb.Compare_VALUE, Result: pb.Compare_LESS, Value: "a"}, false},
+		{"version greater", &pb.Compare{Key: "key", Target: pb.Compare_VERSION, Result: pb.Compare_GREATER, Version: 0}, true},
+		{"missing value", &pb.Compare{Key: "missing", Target: pb.Compare_VALUE, Result: pb.Compare_NOT_EQUAL, Value: "x"}, false},
+		{"missing version", &pb.Compare{Key: "missing", Target: pb.Compare_VERSION, Result: pb.Compare_EQUAL, Version: 0}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := server.Txn(ctx, &pb.TxnRequest{Compare: []*pb.Compare{tt.cmp}})
+			if err != nil {
+				t.Fatalf("Txn() error = %v", err)
+			}
+			if resp.Succeeded != tt.want {
+				t.Errorf("Txn() succeeded = %v, want %v", resp.Succeeded, tt.want)
+			}
+		})
+	}
+}
+
+func TestTxnSeesOwnWrites(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+	server.Set(ctx, &pb.SetRequest{Key: "gone", Value: "v"})
+
+	resp, err := server.Txn(ctx, &pb.TxnRequest{Success: []*pb.TxnOp{
+		{Type: pb.TxnOp_PUT, Key: "new", Value: "v1"},
+		{Type: pb.TxnOp_GET, Key: "new"},
+		{Type: pb.TxnOp_DELETE, Key: "gone"},
+		{Type: pb.TxnOp_GET, Key: "gone"},
+		{Type: pb.TxnOp_DELETE, Key: "missing"},
+	}})
+	if err != nil {
+		t.Fatalf("Txn() error = %v", err)
+	}
+	get := resp.Results[1]
+	if !get.Found || get.Value != "v1" || get.Version != resp.Revision {
+		t.Errorf("GET after PUT = %v, want v1 at revision %d", get, resp.Revision)
+	}
+	if !resp.Results[2].Found {
+		t.Errorf("DELETE gone found = false, want true")
+	}
+	if resp.Results[3].Found {
+		t.Errorf("GET after DELETE found = true, want false")
+	}
+	if resp.Results[4].Found {
+		t.Errorf("DELETE missing found = true, want false")
+	}
+}
+
+func TestTxnReadOnlyKeepsRevision(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+	setResp, _ := server.Set(ctx, &pb.SetRequest{Key: "key", Value: "v"})
+
+	resp, err := server.Txn(ctx, &pb.TxnRequest{Success: []*pb.TxnOp{{Type: pb.TxnOp_GET, Key: "key"}}})
+	if err != nil {
+		t.Fatalf("Txn() error = %v", err)
+	}
+	if resp.Revision != setResp.Version {
+		t.Errorf("Txn() revision = %d, want unchanged %d", resp.Revision, setResp.Version)
+	}
+	if resp.Results[0].Version != setResp.Version {
+		t.Errorf("GET version = %d, want %d", resp.Results[0].Version, setResp.Version)
+	}
+}
+
+func TestTxnValidation(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+
+	_, err := server.Txn(ctx, &pb.TxnRequest{Success: []*pb.TxnOp{{Type: pb.TxnOp_PUT, Key: "k", TtlSeconds: -1}}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Txn() with negative TTL error = %v, want InvalidArgument", err)
+	}
+
+	ops := make([]*pb.TxnOp, maxTxnOps+1)
+	for i := range ops {
+		ops[i] = &pb.TxnOp{Type: pb.TxnOp_GET, Key: "k"}
+	}
+	_, err = server.Txn(ctx, &pb.TxnRequest{Success: ops})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Txn() with %d ops error = %v, want InvalidArgument", len(ops), err)
+	}
+}
+
+func TestTxnReplayAndWatch(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	server, err := openKVServer(dir, serverOptions{WAL: walOptions{Sync: syncAlways}})
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	setResp, _ := server.Set(ctx, &pb.SetRequest{Key: "app/old", Value: "v"})
+	events, _ := startWatch(t, server, &pb.WatchRequest{Key: "app/", Prefix: true, StartRevision: setResp.Version + 1})
+
+	resp, err := server.Txn(ctx, &pb.TxnRequest{Success: []*pb.TxnOp{
+		{Type: pb.TxnOp_PUT, Key: "app/a", Value: "1"},
+		{Type: pb.TxnOp_DELETE, Key: "app/old"},
+	}})
+	if err != nil {
+		t.Fatalf("Txn() error = %v", err)
+	}
+
+	event := nextEvent(t, events)
+	if event.Type != pb.WatchEvent_PUT || event.Key != "app/a" || event.Revision != resp.Revision {
+		t.Errorf("first event = %v, want PUT app/a at revision %d", event, resp.Revision)
+	}
+	event = nextEvent(t, events)
+	if event.Type != pb.WatchEvent_DELETE || event.Key != "app/old" || event.Revision != resp.Revision {
+		t.Errorf("second event = %v, want DELETE app/old at revision %d", event, resp.Revision)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	server, err = openKVServer(dir, serverOptions{WAL: walOptions{Sync: syncAlways}})
+	if err != nil {
+		t.Fatalf("openKVServer() after restart error = %v", err)
+	}
+	defer server.Close()
+
+	get, _ := server.Get(ctx, &pb.GetRequest{Key: "app/a"})
+	if !get.Found || get.Version != resp.Revision {
+		t.Errorf("Get(app/a) = %v@%d, want found at %d", get.Found, get.Version, resp.Revision)
+	}
+	get, _ = server.Get(ctx, &pb.GetRequest{Key: "app/old"})
+	if get.Found {
+		t.Errorf("Get(app/old) found = true, want false after replayed transaction")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// maxContentTypeLen bounds the content type stored with a value
+	maxContentTypeLen = 256
+
+	// maxObjectSizeLimit is the largest maximum object size a server accepts.
+	// Every log sizes its largest record from it.
+	maxObjectSizeLimit = 64 << 20
+	// defaultMaxObjectSize bounds the size of a single value
+	defaultMaxObjectSize = maxObjectSizeLimit
+
+	// objectTooLargeReason is the ErrorInfo reason attached to writes of
+	// values over the maximum object size, which is in its "limit" metadata
+	objectTooLargeReason = "OBJECT_TOO_LARGE"
+)
+
+// requestValue returns the value of a write to namespace n, which clients
+// send either as text in value or as raw bytes in value_bytes, and checks its
+// size and content type
+func (s *kvServer) requestValue(n *namespace, text string, raw []byte, contentType string) (string, error) {
+	if text != "" && len(raw) > 0 {
+		return "", status.Errorf(codes.InvalidArgument, "value and value_bytes are mutually exclusive")
+	}
+	if err := checkContentType(contentType); err != nil {
+		return "", err
+	}
+	value := text
+	if len(raw) > 0 {
+		value = string(raw)
+	}
+	if err := s.checkObjectSize(n, int64(len(value))); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+func checkContentType(contentType string) error {
+	if len(contentType) > maxContentTypeLen {
+		return status.Errorf(codes.InvalidArgument, "content_type is longer than %d bytes", maxContentTypeLen)
+	}
+	return nil
+}
+
+// objectLimit returns the largest value a key of namespace n may hold
+func (s *kvServer) objectLimit(n *namespace) int64 {
+	if limit := n.settings.MaxValueSize; limit > 0 && limit < s.maxObjectSize {
+		return limit
+	}
+	return s.maxObjectSize
+}
+
+// checkObjectSize fails with RESOURCE_EXHAUSTED and an ErrorInfo detail if a
+// value of size bytes is over the maximum object size of namespace n
+func (s *kvServer) checkObjectSize(n *namespace, size int64) error {
+	limit := s.objectLimit(n)
+	if size <= limit {
+		return nil
+	}
+	return tooLarge(fmt.Sprintf("value of %d bytes is larger than the maximum object size of %d bytes", size, limit), limit)
+}
+
+// tooLarge returns a RESOURCE_EXHAUSTED error with an ErrorInfo detail whose
+// "limit" metadata is the size the write is over
+func tooLarge(msg string, limit int64) error {
+	st := status.New(codes.ResourceExhausted, msg)
+	if detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   objectTooLargeReason,
+		Domain:   "kvstore",
+		Metadata: map[string]string{"limit": strconv.FormatInt(limit, 10)},
+	}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// textValue returns value for a string field of a response, which can only
+// hold UTF-8. Other values are left for the value_bytes field alone.
+func textValue(value string) string {
+	if utf8.ValidString(value) {
+		return value
+	}
+	return ""
+}
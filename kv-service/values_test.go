@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// binaryValue is not valid UTF-8, so it can't travel in a string field
+var binaryValue = []byte{0xff, 0x00, 0xfe, 'k', 'v'}
+
+func TestBinaryValues(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+
+	if _, err := server.Set(ctx, &pb.SetRequest{Key: "img", ValueBytes: binaryValue, ContentType: "image/png"}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	resp, err := server.Get(ctx, &pb.GetRequest{Key: "img"})
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if !bytes.Equal(resp.ValueBytes, binaryValue) || resp.Value != "" || resp.ContentType != "image/png" {
+		t.Errorf("Get() = %q/%q/%q, want the bytes in value_bytes only, as image/png", resp.Value, resp.ValueBytes, resp.ContentType)
+	}
+	if _, err := proto.Marshal(resp); err != nil {
+		t.Errorf("proto.Marshal() of a binary GetResponse error = %v", err)
+	}
+
+	// Text values fill both fields, so clients that only know value still work
+	server.Set(ctx, &pb.SetRequest{Key: "txt", Value: "héllo"})
+	resp, _ = server.Get(ctx, &pb.GetRequest{Key: "txt"})
+	if resp.Value != "héllo" || string(resp.ValueBytes) != "héllo" || resp.ContentType != "" {
+		t.Errorf("Get() = %q/%q/%q, want the text in both fields without a content type", resp.Value, resp.ValueBytes, resp.ContentType)
+	}
+
+	scan := &fakeScanStream{ctx: ctx}
+	if err := server.Scan(&pb.ScanRequest{}, scan); err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	if len(scan.sent) != 2 || !bytes.Equal(scan.sent[0].ValueBytes, binaryValue) || scan.sent[0].ContentType != "image/png" {
+		t.Errorf("Scan() = %v, want img with its bytes and content type first", scan.sent)
+	}
+}
+
+func TestBinaryValuesInTxnAndBatch(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+
+	batch, err := server.BatchSet(ctx, &pb.BatchSetRequest{Items: []*pb.SetRequest{
+		{Key: "a", ValueBytes: binaryValue, ContentType: "application/octet-stream"},
+		{Key: "b", Value: "x", ValueBytes: []byte("y")},
+	}})
+	if err != nil {
+		t.Fatalf("BatchSet() error = %v", err)
+	}
+	if !batch.Results[0].Success || batch.Results[1].Success {
+		t.Errorf("BatchSet() results = %v, want only the item with one value written", batch.Results)
+	}
+
+	txn, err := server.Txn(ctx, &pb.TxnRequest{
+		Compare: []*pb.Compare{{Key: "a", Target: pb.Compare_VALUE, Result: pb.Compare_EQUAL, ValueBytes: binaryValue}},
+		Success: []*pb.TxnOp{
+			{Type: pb.TxnOp_PUT, Key: "c", ValueBytes: []byte{0x80}, ContentType: "application/x-c"},
+			{Type: pb.TxnOp_GET, Key: "c"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Txn() error = %v", err)
+	}
+	if r := txn.Results[1]; !txn.Succeeded || !bytes.Equal(r.ValueBytes, []byte{0x80}) || r.ContentType != "application/x-c" {
+		t.Errorf("Txn() = %v, want the compare on bytes to hold and the put visible to the get", txn)
+	}
+
+	got, err := server.BatchGet(ctx, &pb.BatchGetRequest{Keys: []string{"a", "c"}})
+	if err != nil {
+		t.Fatalf("BatchGet() error = %v", err)
+	}
+	if r := got.Results[0]; !bytes.Equal(r.ValueBytes, binaryValue) || r.ContentType != "application/octet-stream" {
+		t.Errorf("BatchGet() a = %v, want its bytes and content type", r)
+	}
+}
+
+func TestValueFieldsAreValidated(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+
+	for name, req := range map[string]*pb.SetRequest{
+		"both values":       {Key: "k", Value: "a", ValueBytes: []byte("b")},
+		"long content type": {Key: "k", Value: "a", ContentType: strings.Repeat("x", maxContentTypeLen+1)},
+	} {
+		if _, err := server.Set(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Set() with %s error = %v, want InvalidArgument", name, err)
+		}
+	}
+	_, err := server.Txn(ctx, &pb.TxnRequest{Success: []*pb.TxnOp{{Type: pb.TxnOp_PUT, Key: "k", Value: "a", ValueBytes: []byte("b")}}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Txn() put with both values error = %v, want InvalidArgument", err)
+	}
+	_, err = server.CompareAndSet(ctx, &pb.CompareAndSetRequest{Key: "k", MustNotExist: true, Value: "a", ValueBytes: []byte("b")})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CompareAndSet() with both values error = %v, want InvalidArgument", err)
+	}
+}
+
+func TestContentTypesSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	opts := serverOptions{WAL: walOptions{Sync: syncAlways}}
+
+	server, err := openKVServer(dir, opts)
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	server.Set(ctx, &pb.SetRequest{Key: "snap", ValueBytes: binaryValue, ContentType: "image/png"})
+	if err := server.snapshot(); err != nil {
+		t.Fatalf("snapshot() error = %v", err)
+	}
+	server.Set(ctx, &pb.SetRequest{Key: "wal", Value: "{}", ContentType: "application/json"})
+	server.Txn(ctx, &pb.TxnRequest{Success: []*pb.TxnOp{{Type: pb.TxnOp_PUT, Key: "txn", Value: "t", ContentType: "text/plain"}}})
+	server.Close()
+
+	server, err = openKVServer(dir, opts)
+	if err != nil {
+		t.Fatalf("openKVServer() after restart error = %v", err)
+	}
+	defer server.Close()
+	for key, want := range map[string]string{"snap": "image/png", "wal": "application/json", "txn": "text/plain"} {
+		resp, _ := server.Get(ctx, &pb.GetRequest{Key: key})
+		if !resp.Found || resp.ContentType != want {
+			t.Errorf("Get(%s) after restart = %v/%q, want content type %q", key, resp.Found, resp.ContentType, want)
+		}
+	}
+	resp, _ := server.Get(ctx, &pb.GetRequest{Key: "snap"})
+	if !bytes.Equal(resp.ValueBytes, binaryValue) {
+		t.Errorf("Get(snap) after restart = %q, want %q", resp.ValueBytes, binaryValue)
+	}
+}
+
+func TestValueAtTheLimitSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(t.TempDir(), "master.keys")
+	writeMasterKeys(t, keyFile, newMasterKey())
+	ctx := context.Background()
+	key := strings.Repeat("k", 1024)
+	value := bytes.Repeat([]byte{0xff}, defaultMaxObjectSize)
+	contentType := strings.Repeat("t", maxContentTypeLen)
+
+	server := openEncrypted(t, dir, keyFile)
+	if _, err := server.Set(ctx, &pb.SetRequest{Key: key, ValueBytes: value, ContentType: contentType}); err != nil {
+		t.Fatalf("Set() of a value at the limit error = %v", err)
+	}
+	// A write too large to log fails without failing the log
+	_, err := server.Txn(ctx, &pb.TxnRequest{Success: []*pb.TxnOp{
+		{Type: pb.TxnOp_PUT, Key: "a", ValueBytes: value},
+		{Type: pb.TxnOp_PUT, Key: "b", ValueBytes: value},
+	}})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Txn() over the record size error = %v, want ResourceExhausted", err)
+	}
+	if _, err := server.Set(ctx, &pb.SetRequest{Key: "after", Value: "v"}); err != nil {
+		t.Fatalf("Set() after the rejected write error = %v", err)
+	}
+
+	check := func(when string) {
+		t.Helper()
+		resp, _ := server.Get(ctx, &pb.GetRequest{Key: key})
+		if !resp.Found || !bytes.Equal(resp.ValueBytes, value) || resp.ContentType != contentType {
+			t.Errorf("Get() of the value at the limit %s = found %v, %d bytes, want all %d bytes", when, resp.Found, len(resp.ValueBytes), len(value))
+		}
+		for k, want := range map[string]bool{"a": false, "after": true} {
+			if resp, _ := server.Get(ctx, &pb.GetRequest{Key: k}); resp.Found != want {
+				t.Errorf("Get(%s) %s found = %v, want %v", k, when, resp.Found, want)
+			}
+		}
+	}
+	server.Close()
+	server = openEncrypted(t, dir, keyFile)
+	check("after replaying the log")
+	if err := server.snapshot(); err != nil {
+		t.Fatalf("snapshot() error = %v", err)
+	}
+	server.Close()
+	server = openEncrypted(t, dir, keyFile)
+	defer server.Close()
+	check("after loading the snapshot")
+}
@@ -0,0 +1,792 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	walOpSet    byte = 1
+	walOpDelete byte = 2
+	walOpExpire byte = 3
+	walOpTxn    byte = 4
+	// walOpNoop takes up a revision without changing the store. It is only
+	// used for Raft entries that carry no write and is never logged.
+	walOpNoop byte = 5
+	// walOpTyped is set on the op of a mutation whose value has a content
+	// type, which is encoded after the expiry
+	walOpTyped byte = 0x80
+	// walOpVersioned is set on the op of a mutation that keeps a version of
+	// its own, which is encoded last
+	walOpVersioned byte = 0x40
+
+	walHeaderSize = 8
+	// walMaxRecordSize bounds the payload of a record, leaving room past the
+	// largest value for its key, metadata and sealing
+	walMaxRecordSize  = maxObjectSizeLimit + 1<<20
+	walSegmentPrefix  = "wal-"
+	walSegmentSuffix  = ".log"
+	defaultWALSegment = 64 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errWALClosed is returned by append and sync once the log has been closed
+var errWALClosed = errors.New("wal is closed")
+
+// errRecordTooLarge is returned for a record over walMaxRecordSize, which
+// replay would reject, so it is never written
+var errRecordTooLarge = errors.New("record is larger than the maximum record size")
+
+// syncPolicy controls when appended records are fsynced to disk
+type syncPolicy int
+
+const (
+	// syncAlways fsyncs before every mutation is acknowledged, coalescing
+	// concurrent writers into a single fsync
+	syncAlways syncPolicy = iota
+	// syncBatch fsyncs on a fixed interval; writers wait for the next batch
+	syncBatch
+	// syncNone leaves flushing to the operating system
+	syncNone
+)
+
+// parseSyncPolicy converts a config value into a syncPolicy
+func parseSyncPolicy(s string) (syncPolicy, error) {
+	switch strings.ToLower(s) {
+	case "always":
+		return syncAlways, nil
+	case "batch", "batched":
+		return syncBatch, nil
+	case "none":
+		return syncNone, nil
+	}
+	return 0, fmt.Errorf("unknown WAL sync policy %q (want always, batch or none)", s)
+}
+
+type walOptions struct {
+	Sync         syncPolicy
+	SyncInterval time.Duration
+	SegmentSize  int64
+	// keys, when set, seals every record
+	keys *keyring
+}
+
+// walRecord is a single logged mutation. Seq is assigned by the log on append.
+type walRecord struct {
+	Op    byte
+	Seq   uint64
+	Key   string
+	Value string
+	// ExpiresAt is the absolute expiry in Unix nanoseconds for walOpSet and
+	// walOpExpire, or 0 for no expiry
+	ExpiresAt int64
+	// ContentType describes the value of a walOpSet; empty if unknown
+	ContentType string
+	// Version is the version a walOpSet stores instead of the record's
+	// sequence number, for keys imported with their version; 0 if none
+	Version uint64
+	// Ops holds the mutations of a walOpTxn record, which are applied
+	// atomically and share the record's sequence number
+	Ops []walRecord
+}
+
+// wal is an append-only, segmented write-ahead log. Each record is framed as
+// crc32c(payload) | len(payload) | payload so that a torn write at the tail
+// can be detected and discarded on recovery.
+type wal struct {
+	dir  string
+	opts walOptions
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	f         *os.File
+	segSize   int64
+	lastSeq   uint64
+	syncedSeq uint64
+	syncing   bool
+	closed    bool
+	err       error
+	// fsync syncs the active segment; tests replace it to simulate a failing
+	// disk
+	fsync func(*os.File) error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// openWAL opens (or creates) the log in dir, replaying every intact record
+// after afterSeq through apply in order. Records up to afterSeq are already
+// reflected in a snapshot and are skipped. A truncated or corrupt record at the
+// end of the newest segment is treated as an interrupted write and cut off.
+func openWAL(dir string, opts walOptions, afterSeq uint64, apply func(walRecord)) (*wal, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultWALSegment
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = 10 * time.Millisecond
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create wal dir: %w", err)
+	}
+
+	w := &wal{dir: dir, opts: opts, fsync: (*os.File).Sync}
+	w.cond = sync.NewCond(&w.mu)
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, seg := range segments {
+		path := filepath.Join(dir, segmentName(seg))
+		good, err := replaySegment(path, seg, opts.keys, func(rec walRecord) {
+			w.lastSeq = rec.Seq
+			if rec.Seq > afterSeq {
+				apply(rec)
+			}
+		})
+		if err == nil {
+			continue
+		}
+		if i != len(segments)-1 || errors.Is(err, errTampered) {
+			return nil, fmt.Errorf("wal segment %s is corrupt at offset %d: %w", path, good, err)
+		}
+		log.Printf("WAL: discarding torn tail of %s at offset %d: %v", path, good, err)
+		if err := os.Truncate(path, good); err != nil {
+			return nil, fmt.Errorf("truncate wal segment: %w", err)
+		}
+	}
+
+	// The log may end before the snapshot if its segments were lost; new
+	// records must still be numbered after the snapshot
+	fresh := len(segments) == 0 || w.lastSeq < afterSeq
+	if w.lastSeq < afterSeq {
+		w.lastSeq = afterSeq
+	}
+	w.syncedSeq = w.lastSeq
+
+	if fresh {
+		err = w.createSegment(w.lastSeq + 1)
+	} else {
+		err = w.openSegment(segments[len(segments)-1])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Sync == syncBatch {
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.syncLoop()
+	}
+	return w, nil
+}
+
+// append writes rec to the log and returns its sequence number. The record is
+// not guaranteed to be durable until sync returns for that sequence number.
+func (w *wal) append(rec walRecord) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, errWALClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	rec.Seq = w.lastSeq + 1
+	buf := w.encode(rec)
+
+	for w.segSize > 0 && w.segSize+int64(len(buf)) > w.opts.SegmentSize {
+		if w.syncing {
+			// Other appends go ahead while this one waits for the fsync in
+			// flight, so the record is numbered again afterwards
+			w.cond.Wait()
+			if w.closed {
+				return 0, errWALClosed
+			}
+			if w.err != nil {
+				return 0, w.err
+			}
+			rec.Seq = w.lastSeq + 1
+			buf = w.encode(rec)
+			continue
+		}
+		if err := w.rotateLocked(rec.Seq); err != nil {
+			w.err = err
+			return 0, err
+		}
+	}
+	if len(buf)-walHeaderSize > walMaxRecordSize {
+		return 0, errRecordTooLarge
+	}
+
+	if _, err := w.f.Write(buf); err != nil {
+		// A partial write leaves a torn record that recovery will discard, but
+		// appending after it would corrupt the log, so fail all future writes.
+		w.err = fmt.Errorf("wal write: %w", err)
+		return 0, w.err
+	}
+	w.segSize += int64(len(buf))
+	w.lastSeq = rec.Seq
+	return rec.Seq, nil
+}
+
+// sync blocks until the record with the given sequence number is durable
+// according to the configured policy
+func (w *wal) sync(seq uint64) error {
+	switch w.opts.Sync {
+	case syncNone:
+		return nil
+	case syncAlways:
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		for w.syncedSeq < seq && w.err == nil && !w.closed {
+			w.flushLocked()
+		}
+	case syncBatch:
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		for w.syncedSeq < seq && w.err == nil && !w.closed {
+			w.cond.Wait()
+		}
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if w.syncedSeq < seq {
+		return errWALClosed
+	}
+	return nil
+}
+
+// failed returns the error that stopped the log from accepting writes, if
+// any. A failed write or fsync leaves the log's contents on disk unknown, so
+// the log never recovers from one until it is reopened.
+func (w *wal) failed() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// flushLocked fsyncs the active segment, or waits for an in-flight fsync to
+// finish. Callers must hold w.mu and re-check their condition afterwards.
+func (w *wal) flushLocked() {
+	if w.syncing {
+		w.cond.Wait()
+		return
+	}
+	w.syncing = true
+	target := w.lastSeq
+	f := w.f
+	w.mu.Unlock()
+	err := w.fsync(f)
+	w.mu.Lock()
+	w.syncing = false
+	if err != nil && w.err == nil {
+		w.err = fmt.Errorf("wal fsync: %w", err)
+	}
+	if err == nil && target > w.syncedSeq {
+		w.syncedSeq = target
+	}
+	w.cond.Broadcast()
+}
+
+func (w *wal) syncLoop() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.syncedSeq < w.lastSeq && w.err == nil && !w.closed {
+				w.flushLocked()
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// rotateLocked seals the active segment and starts a new one whose first
+// record will be firstSeq. Callers must hold w.mu with no fsync in flight.
+func (w *wal) rotateLocked(firstSeq uint64) error {
+	if w.opts.Sync != syncNone {
+		if err := w.f.Sync(); err != nil {
+			return fmt.Errorf("wal fsync: %w", err)
+		}
+		w.syncedSeq = w.lastSeq
+		w.cond.Broadcast()
+	}
+	if err := w.f.Close(); err != nil {
+		return fmt.Errorf("close wal segment: %w", err)
+	}
+	return w.createSegment(firstSeq)
+}
+
+func (w *wal) createSegment(firstSeq uint64) error {
+	path := filepath.Join(w.dir, segmentName(firstSeq))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("create wal segment: %w", err)
+	}
+	if err := syncDir(w.dir); err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	w.segSize = 0
+	return nil
+}
+
+func (w *wal) openSegment(firstSeq uint64) error {
+	path := filepath.Join(w.dir, segmentName(firstSeq))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open wal segment: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat wal segment: %w", err)
+	}
+	w.f = f
+	w.segSize = info.Size()
+	return nil
+}
+
+// lastSequence returns the sequence number of the most recently appended record
+func (w *wal) lastSequence() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lastSeq
+}
+
+// skipTo seals the active segment and continues the log after seq. It is used
+// when a follower installs a snapshot at seq, which makes every earlier record
+// redundant.
+func (w *wal) skipTo(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.syncing {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return errWALClosed
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.rotateLocked(seq + 1); err != nil {
+		w.err = err
+		return err
+	}
+	w.lastSeq = seq
+	w.syncedSeq = seq
+	w.cond.Broadcast()
+	return nil
+}
+
+// removeBefore deletes sealed segments whose records all have sequence
+// numbers of at most seq. The active segment is never removed.
+func (w *wal) removeBefore(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errWALClosed
+	}
+
+	segments, err := listSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	removed := false
+	// A segment ends just before the next one starts
+	for i := 0; i+1 < len(segments) && segments[i+1] <= seq+1; i++ {
+		if err := os.Remove(filepath.Join(w.dir, segmentName(segments[i]))); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove wal segment: %w", err)
+		}
+		removed = true
+	}
+	if removed {
+		return syncDir(w.dir)
+	}
+	return nil
+}
+
+// reseal rewrites every sealed segment with its records sealed by the
+// active data key. The active segment is sealed first, so that it holds no
+// record sealed with an older key. Callers must keep removeBefore from
+// running meanwhile.
+func (w *wal) reseal() error {
+	w.mu.Lock()
+	for w.syncing {
+		w.cond.Wait()
+	}
+	var err error
+	switch {
+	case w.closed:
+		err = errWALClosed
+	case w.err != nil:
+		err = w.err
+	case w.segSize > 0:
+		if err = w.rotateLocked(w.lastSeq + 1); err != nil {
+			w.err = err
+		}
+	}
+	var segments []uint64
+	if err == nil {
+		segments, err = listSegments(w.dir)
+	}
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, seg := range segments[:len(segments)-1] {
+		if err := w.resealSegment(filepath.Join(w.dir, segmentName(seg)), seg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resealSegment atomically replaces a sealed segment with a copy whose
+// records are sealed by the active data key
+func (w *wal) resealSegment(path string, firstSeq uint64) error {
+	tmp, err := os.CreateTemp(w.dir, walSegmentPrefix+"*.tmp")
+	if err != nil {
+		return fmt.Errorf("create wal segment: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	bw := bufio.NewWriter(tmp)
+	if _, err := replaySegment(path, firstSeq, w.opts.keys, func(rec walRecord) {
+		bw.Write(w.encode(rec))
+	}); err != nil {
+		tmp.Close()
+		return fmt.Errorf("read wal segment %s: %w", path, err)
+	}
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write wal segment: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("fsync wal segment: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename wal segment: %w", err)
+	}
+	return syncDir(w.dir)
+}
+
+// Close flushes any pending records and closes the active segment
+func (w *wal) Close() error {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	for w.syncing {
+		w.cond.Wait()
+	}
+	w.closed = true
+	w.cond.Broadcast()
+
+	err := w.f.Sync()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func encodeWALRecord(rec walRecord) []byte {
+	payload := make([]byte, 0, 1+6*binary.MaxVarintLen64+len(rec.Key)+len(rec.Value)+len(rec.ContentType))
+	payload = append(payload, opByte(rec))
+	payload = binary.AppendUvarint(payload, rec.Seq)
+	if rec.Op == walOpTxn {
+		payload = binary.AppendUvarint(payload, uint64(len(rec.Ops)))
+		for _, op := range rec.Ops {
+			payload = append(payload, opByte(op))
+			payload = appendMutation(payload, op)
+		}
+	} else {
+		payload = appendMutation(payload, rec)
+	}
+	return frameRecord(payload)
+}
+
+// frameRecord prefixes payload with its checksum and length
+func frameRecord(payload []byte) []byte {
+	buf := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.Checksum(payload, crcTable))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(payload)))
+	return append(buf, payload...)
+}
+
+// encode frames rec for the log, sealing its payload if the log is encrypted
+func (w *wal) encode(rec walRecord) []byte {
+	buf := encodeWALRecord(rec)
+	if w.opts.keys == nil {
+		return buf
+	}
+	return frameRecord(w.opts.keys.seal(buf[walHeaderSize:], walAAD(rec.Seq)))
+}
+
+// opByte returns the encoded op of rec, which marks a typed value and a kept
+// version so that records without them keep their earlier encoding
+func opByte(rec walRecord) byte {
+	op := rec.Op
+	if rec.ContentType != "" {
+		op |= walOpTyped
+	}
+	if rec.Version != 0 {
+		op |= walOpVersioned
+	}
+	return op
+}
+
+// appendMutation encodes the key, value, expiry, and content type and version
+// if any, of a single mutation
+func appendMutation(payload []byte, rec walRecord) []byte {
+	payload = binary.AppendUvarint(payload, uint64(len(rec.Key)))
+	payload = append(payload, rec.Key...)
+	payload = binary.AppendUvarint(payload, uint64(len(rec.Value)))
+	payload = append(payload, rec.Value...)
+	payload = binary.AppendUvarint(payload, uint64(rec.ExpiresAt))
+	if rec.ContentType != "" {
+		payload = binary.AppendUvarint(payload, uint64(len(rec.ContentType)))
+		payload = append(payload, rec.ContentType...)
+	}
+	if rec.Version != 0 {
+		payload = binary.AppendUvarint(payload, rec.Version)
+	}
+	return payload
+}
+
+var errBadRecord = errors.New("malformed wal record")
+
+func decodeWALRecord(payload []byte) (walRecord, error) {
+	var rec walRecord
+	if len(payload) < 1 {
+		return rec, errBadRecord
+	}
+	rec.Op = payload[0] &^ (walOpTyped | walOpVersioned)
+	flags := payload[0]
+	p := payload[1:]
+
+	seq, n := binary.Uvarint(p)
+	if n <= 0 {
+		return rec, errBadRecord
+	}
+	rec.Seq = seq
+	p = p[n:]
+
+	if rec.Op == walOpTxn {
+		count, n := binary.Uvarint(p)
+		if n <= 0 || count > uint64(len(p)) {
+			return rec, errBadRecord
+		}
+		p = p[n:]
+		rec.Ops = make([]walRecord, count)
+		for i := range rec.Ops {
+			if len(p) < 1 {
+				return rec, errBadRecord
+			}
+			op := walRecord{Op: p[0] &^ (walOpTyped | walOpVersioned), Seq: rec.Seq}
+			var ok bool
+			if p, ok = readMutation(p[1:], &op, true, p[0]); !ok {
+				return rec, errBadRecord
+			}
+			if op.Op != walOpSet && op.Op != walOpDelete && op.Op != walOpExpire {
+				return rec, fmt.Errorf("unknown wal op %d in transaction", op.Op)
+			}
+			rec.Ops[i] = op
+		}
+	} else {
+		// Records written before TTL support end after the value
+		var ok bool
+		if p, ok = readMutation(p, &rec, len(p) > 0, flags); !ok {
+			return rec, errBadRecord
+		}
+	}
+	if len(p) != 0 {
+		return rec, errBadRecord
+	}
+
+	if rec.Op != walOpSet && rec.Op != walOpDelete && rec.Op != walOpExpire && rec.Op != walOpTxn {
+		return rec, fmt.Errorf("unknown wal op %d", rec.Op)
+	}
+	return rec, nil
+}
+
+// readMutation decodes the key and value of a mutation into rec, followed by
+// its expiry unless the record predates TTL support, and the content type and
+// version that the flags of its op byte mark. It returns the bytes after the
+// mutation.
+func readMutation(p []byte, rec *walRecord, hasExpiry bool, flags byte) ([]byte, bool) {
+	key, p, ok := readBytes(p)
+	if !ok {
+		return nil, false
+	}
+	value, p, ok := readBytes(p)
+	if !ok {
+		return nil, false
+	}
+	rec.Key = string(key)
+	rec.Value = string(value)
+
+	if !hasExpiry {
+		return p, true
+	}
+	exp, n := binary.Uvarint(p)
+	if n <= 0 {
+		return nil, false
+	}
+	rec.ExpiresAt = int64(exp)
+	p = p[n:]
+	if flags&walOpTyped != 0 {
+		contentType, rest, ok := readBytes(p)
+		if !ok {
+			return nil, false
+		}
+		rec.ContentType = string(contentType)
+		p = rest
+	}
+	if flags&walOpVersioned != 0 {
+		version, n := binary.Uvarint(p)
+		if n <= 0 || version == 0 {
+			return nil, false
+		}
+		rec.Version = version
+		p = p[n:]
+	}
+	return p, true
+}
+
+func readBytes(p []byte) ([]byte, []byte, bool) {
+	l, n := binary.Uvarint(p)
+	if n <= 0 || uint64(len(p)-n) < l {
+		return nil, nil, false
+	}
+	p = p[n:]
+	return p[:l], p[l:], true
+}
+
+// replaySegment calls apply for every intact record in the segment whose
+// first record is firstSeq, opening records sealed with keys. It returns the
+// offset just past the last good record and, if the segment did not end
+// cleanly, the reason.
+func replaySegment(path string, firstSeq uint64, keys *keyring, apply func(walRecord)) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var (
+		offset int64
+		header [walHeaderSize]byte
+	)
+	for seq := firstSeq; ; seq++ {
+		if _, err := io.ReadFull(f, header[:]); err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			return offset, err
+		}
+		sum := binary.LittleEndian.Uint32(header[0:4])
+		size := binary.LittleEndian.Uint32(header[4:8])
+		if size == 0 || size > walMaxRecordSize {
+			return offset, fmt.Errorf("invalid record length %d", size)
+		}
+
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(f, payload); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return offset, err
+		}
+		if crc32.Checksum(payload, crcTable) != sum {
+			return offset, errors.New("checksum mismatch")
+		}
+		if payload, err = keys.open(payload, walAAD(seq)); err != nil {
+			return offset, err
+		}
+		rec, err := decodeWALRecord(payload)
+		if err != nil {
+			return offset, err
+		}
+
+		apply(rec)
+		offset += walHeaderSize + int64(size)
+	}
+}
+
+func segmentName(firstSeq uint64) string {
+	return fmt.Sprintf("%s%016x%s", walSegmentPrefix, firstSeq, walSegmentSuffix)
+}
+
+// listSegments returns the first sequence number of every segment in dir, in
+// ascending order
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read wal dir: %w", err)
+	}
+
+	var segments []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, walSegmentPrefix) || !strings.HasSuffix(name, walSegmentSuffix) {
+			continue
+		}
+		var seq uint64
+		hex := strings.TrimSuffix(strings.TrimPrefix(name, walSegmentPrefix), walSegmentSuffix)
+		if _, err := fmt.Sscanf(hex, "%x", &seq); err != nil {
+			continue
+		}
+		segments = append(segments, seq)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// syncDir fsyncs a directory so that newly created or removed files survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("fsync dir: %w", err)
+	}
+	return nil
+}
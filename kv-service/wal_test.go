@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWALReplayAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	server, err := openKVServer(dir, serverOptions{WAL: walOptions{Sync: syncAlways}})
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	server.Set(ctx, &pb.SetRequest{Key: "a", Value: "1"})
+	server.Set(ctx, &pb.SetRequest{Key: "b", Value: "2"})
+	server.Set(ctx, &pb.SetRequest{Key: "a", Value: "3"})
+	server.Delete(ctx, &pb.DeleteRequest{Key: "b"})
+	if err := server.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	server, err = openKVServer(dir, serverOptions{WAL: walOptions{Sync: syncAlways}})
+	if err != nil {
+		t.Fatalf("openKVServer() after restart error = %v", err)
+	}
+	defer server.Close()
+
+	resp, _ := server.Get(ctx, &pb.GetRequest{Key: "a"})
+	if !resp.Found || resp.Value != "3" {
+		t.Errorf("Get(a) = %v/%q, want true/%q", resp.Found, resp.Value, "3")
+	}
+	resp, _ = server.Get(ctx, &pb.GetRequest{Key: "b"})
+	if resp.Found {
+		t.Errorf("Get(b) found = true, want false after replayed delete")
+	}
+}
+
+func TestWALTruncatedTailRecovery(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	server, err := openKVServer(dir, serverOptions{WAL: walOptions{Sync: syncAlways}})
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	server.Set(ctx, &pb.SetRequest{Key: "kept", Value: "value"})
+	server.Set(ctx, &pb.SetRequest{Key: "torn", Value: "value"})
+	server.Close()
+
+	// Simulate a crash partway through writing the last record
+	path := filepath.Join(dir, segmentName(1))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatalf("Truncate() error = %v", err)
+	}
+
+	server, err = openKVServer(dir, serverOptions{WAL: walOptions{Sync: syncAlways}})
+	if err != nil {
+		t.Fatalf("openKVServer() with torn tail error = %v", err)
+	}
+
+	resp, _ := server.Get(ctx, &pb.GetRequest{Key: "kept"})
+	if !resp.Found {
+		t.Errorf("Get(kept) found = false, want true")
+	}
+	resp, _ = server.Get(ctx, &pb.GetRequest{Key: "torn"})
+	if resp.Found {
+		t.Errorf("Get(torn) found = true, want false for torn record")
+	}
+
+	// New writes after recovery must replay cleanly
+	server.Set(ctx, &pb.SetRequest{Key: "after", Value: "value"})
+	server.Close()
+
+	server, err = openKVServer(dir, serverOptions{WAL: walOptions{Sync: syncAlways}})
+	if err != nil {
+		t.Fatalf("openKVServer() after recovery error = %v", err)
+	}
+	defer server.Close()
+
+	resp, _ = server.Get(ctx, &pb.GetRequest{Key: "after"})
+	if !resp.Found {
+		t.Errorf("Get(after) found = false, want true")
+	}
+}
+
+func TestWALCorruptTailRecovery(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	server, err := openKVServer(dir, serverOptions{WAL: walOptions{Sync: syncAlways}})
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	server.Set(ctx, &pb.SetRequest{Key: "kept", Value: "value"})
+	server.Close()
+
+	// Append garbage that looks like a record header
+	path := filepath.Join(dir, segmentName(1))
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	f.Write([]byte{0xde, 0xad, 0xbe, 0xef, 4, 0, 0, 0, 1, 2, 3, 4})
+	f.Close()
+
+	server, err = openKVServer(dir, serverOptions{WAL: walOptions{Sync: syncAlways}})
+	if err != nil {
+		t.Fatalf("openKVServer() with corrupt tail error = %v", err)
+	}
+	defer server.Close()
+
+	resp, _ := server.Get(ctx, &pb.GetRequest{Key: "kept"})
+	if !resp.Found {
+		t.Errorf("Get(kept) found = false, want true")
+	}
+}
+
+func TestWALSegmentRotation(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	opts := walOptions{Sync: syncNone, SegmentSize: 64}
+	server, err := openKVServer(dir, serverOptions{WAL: opts})
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		server.Set(ctx, &pb.SetRequest{Key: "key", Value: string(rune('a' + i))})
+	}
+	server.Close()
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		t.Fatalf("listSegments() error = %v", err)
+	}
+	if len(segments) < 2 {
+		t.Errorf("listSegments() = %d segments, want rotation into several", len(segments))
+	}
+
+	server, err = openKVServer(dir, serverOptions{WAL: opts})
+	if err != nil {
+		t.Fatalf("openKVServer() after rotation error = %v", err)
+	}
+	defer server.Close()
+
+	resp, _ := server.Get(ctx, &pb.GetRequest{Key: "key"})
+	if resp.Value != "t" {
+		t.Errorf("Get(key) = %q, want %q", resp.Value, "t")
+	}
+}
+
+func TestWALConcurrentRotationNumbersRecordsInOrder(t *testing.T) {
+	dir := t.TempDir()
+	w, err := openWAL(dir, walOptions{Sync: syncAlways, SegmentSize: 256}, 0, func(walRecord) {})
+	if err != nil {
+		t.Fatalf("openWAL() error = %v", err)
+	}
+	// A slow fsync keeps rotations waiting on one while other appends run
+	w.fsync = func(f *os.File) error {
+		time.Sleep(time.Millisecond)
+		return f.Sync()
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				seq, err := w.append(walRecord{Op: walOpSet, Key: "key", Value: "value"})
+				if err == nil {
+					err = w.sync(seq)
+				}
+				if err != nil {
+					t.Errorf("append() error = %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	w.Close()
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		t.Fatalf("listSegments() error = %v", err)
+	}
+	next := uint64(1)
+	for _, seg := range segments {
+		if seg != next {
+			t.Fatalf("Segment %d follows record %d", seg, next-1)
+		}
+		if _, err := replaySegment(filepath.Join(dir, segmentName(seg)), seg, nil, func(rec walRecord) {
+			if rec.Seq != next {
+				t.Fatalf("Segment %d holds record %d where %d belongs", seg, rec.Seq, next)
+			}
+			next++
+		}); err != nil {
+			t.Fatalf("replaySegment() error = %v", err)
+		}
+	}
+	if next != 161 {
+		t.Errorf("The log holds %d records, want 160", next-1)
+	}
+}
+
+func TestWALBatchSync(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	server, err := openKVServer(dir, serverOptions{WAL: walOptions{Sync: syncBatch}})
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	defer server.Close()
+
+	resp, err := server.Set(ctx, &pb.SetRequest{Key: "key", Value: "value"})
+	if err != nil || !resp.Success {
+		t.Fatalf("Set() = %v, %v; want success", resp, err)
+	}
+	server.wal.mu.Lock()
+	synced := server.wal.syncedSeq
+	server.wal.mu.Unlock()
+	if synced < 1 {
+		t.Errorf("syncedSeq = %d after Set returned, want >= 1", synced)
+	}
+}
+
+func TestWALSyncFailureStopsServing(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	server, err := openKVServer(dir, serverOptions{WAL: walOptions{Sync: syncAlways}})
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	server.Set(ctx, &pb.SetRequest{Key: "a", Value: "1"})
+	server.wal.mu.Lock()
+	server.wal.fsync = func(*os.File) error { return errors.New("disk gone") }
+	server.wal.mu.Unlock()
+
+	if _, err := server.Set(ctx, &pb.SetRequest{Key: "b", Value: "2"}); status.Code(err) != codes.Internal {
+		t.Errorf("Set() with a failing fsync error = %v, want Internal", err)
+	}
+	if _, err := server.Set(ctx, &pb.SetRequest{Key: "c", Value: "3"}); err == nil {
+		t.Errorf("Expected writes after a failed fsync to be refused")
+	}
+
+	// The unsynced write is applied, so reads are refused too rather than
+	// serving a value a restart may lose
+	called := false
+	handler := func(ctx context.Context, req any) (any, error) {
+		called = true
+		return nil, nil
+	}
+	_, err = server.failStopUnary(ctx, &pb.GetRequest{Key: "b"}, &grpc.UnaryServerInfo{FullMethod: "/kvstore.KVStore/Get"}, handler)
+	if status.Code(err) != codes.Unavailable || called {
+		t.Errorf("Get() after a failed fsync error = %v, called = %v, want Unavailable", err, called)
+	}
+	if _, err := server.failStopUnary(ctx, &pb.StatsRequest{}, &grpc.UnaryServerInfo{FullMethod: "/kvstore.KVAdmin/Stats"}, handler); err != nil || !called {
+		t.Errorf("Stats() after a failed fsync error = %v, want it served", err)
+	}
+	server.Close()
+
+	server, err = openKVServer(dir, serverOptions{WAL: walOptions{Sync: syncAlways}})
+	if err != nil {
+		t.Fatalf("openKVServer() after restart error = %v", err)
+	}
+	defer server.Close()
+	if err := server.checkServing(); err != nil {
+		t.Errorf("checkServing() after restart error = %v", err)
+	}
+	if resp, _ := server.Get(ctx, &pb.GetRequest{Key: "a"}); resp.Value != "1" {
+		t.Errorf("Get(a) after restart = %q, want %q", resp.Value, "1")
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	tests := map[string]syncPolicy{
+		"always":  syncAlways,
+		"batch":   syncBatch,
+		"batched": syncBatch,
+		"NONE":    syncNone,
+	}
+	for in, want := range tests {
+		got, err := parseSyncPolicy(in)
+		if err != nil || got != want {
+			t.Errorf("parseSyncPolicy(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := parseSyncPolicy("sometimes"); err == nil {
+		t.Error("parseSyncPolicy(sometimes) error = nil, want error")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultWatchHistory = 10000
+	// watchBatchSize bounds how many events a watcher copies per acquisition
+	// of the read lock
+	watchBatchSize = 256
+)
+
+// changeFeed retains the most recent mutations in a ring buffer so that
+// watchers can stream them and resume from an earlier revision. Watchers never
+// hold a reference into the buffer: they copy events out under the read lock
+// and wait on notify for more, so a slow watcher can't block writers. A watcher
+// that falls further behind than the buffer holds has to resync.
+//
+// The feed is guarded by the server's mutex.
+type changeFeed struct {
+	ring  []walRecord
+	start int
+	n     int
+	// notify is closed and replaced whenever a mutation is appended
+	notify chan struct{}
+}
+
+func newChangeFeed(size int) *changeFeed {
+	if size <= 0 {
+		size = defaultWatchHistory
+	}
+	return &changeFeed{
+		ring:   make([]walRecord, size),
+		notify: make(chan struct{}),
+	}
+}
+
+// append records a mutation and wakes every waiting watcher
+func (f *changeFeed) append(rec walRecord) {
+	if f.n < len(f.ring) {
+		f.ring[(f.start+f.n)%len(f.ring)] = rec
+		f.n++
+	} else {
+		f.ring[f.start] = rec
+		f.start = (f.start + 1) % len(f.ring)
+	}
+	close(f.notify)
+	f.notify = make(chan struct{})
+}
+
+// reset drops every retained mutation and wakes every waiting watcher, which
+// then has to resync. It is used when the store is replaced wholesale.
+func (f *changeFeed) reset() {
+	clear(f.ring)
+	f.start, f.n = 0, 0
+	close(f.notify)
+	f.notify = make(chan struct{})
+}
+
+// first returns the oldest retained revision, or 0 if the feed is empty
+func (f *changeFeed) first() uint64 {
+	if f.n == 0 {
+		return 0
+	}
+	return f.ring[f.start].Seq
+}
+
+// since copies up to max retained mutations with revision >= rev
+func (f *changeFeed) since(rev uint64, max int) []walRecord {
+	if f.n == 0 {
+		return nil
+	}
+	// Revisions in the ring are contiguous, so the offset is a subtraction
+	first := f.ring[f.start].Seq
+	if rev < first {
+		rev = first
+	}
+	offset := rev - first
+	if offset >= uint64(f.n) {
+		return nil
+	}
+
+	count := f.n - int(offset)
+	if count > max {
+		count = max
+	}
+	out := make([]walRecord, count)
+	for i := range out {
+		out[i] = f.ring[(f.start+int(offset)+i)%len(f.ring)]
+	}
+	return out
+}
+
+// watchMatches reports whether a mutation is visible to the watch request on
+// namespace n
+func watchMatches(n *namespace, req *pb.WatchRequest, rec walRecord) bool {
+	if rec.Op != walOpSet && rec.Op != walOpDelete {
+		return false
+	}
+	if req.Prefix {
+		return strings.HasPrefix(rec.Key, n.key(req.Key)) && n.contains(rec.Key)
+	}
+	return rec.Key == n.key(req.Key)
+}
+
+// Watch streams put and delete events for a key or key prefix, starting at
+// the requested revision. The stream ends when the client goes away, the
+// server shuts down, or the watcher falls too far behind the change feed.
+func (s *kvServer) Watch(req *pb.WatchRequest, stream grpc.ServerStreamingServer[pb.WatchEvent]) error {
+	n, err := s.namespace(req.Namespace)
+	if err != nil {
+		return err
+	}
+	if err := n.checkKey(req.Key); err != nil {
+		return err
+	}
+
+	s.rlockAll()
+	next := req.StartRevision
+	if next == 0 {
+		next = s.rev + 1
+	}
+	err = s.checkRetained(next)
+	s.runlockAll()
+	if err != nil {
+		return err
+	}
+
+	// Send headers right away so clients can tell the watch was accepted
+	// before the first event arrives
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+	log.Printf("Watch key=%q prefix=%v from revision %d", req.Key, req.Prefix, next)
+
+	for {
+		s.rlockAll()
+		if err := s.checkRetained(next); err != nil {
+			s.runlockAll()
+			return err
+		}
+		events := s.feed.since(next, watchBatchSize)
+		notify := s.feed.notify
+		s.runlockAll()
+
+		for _, rec := range events {
+			next = rec.Seq + 1
+			ops := []walRecord{rec}
+			if rec.Op == walOpTxn {
+				// Every mutation of a transaction is reported at the
+				// transaction's revision
+				ops = rec.Ops
+			}
+			for _, op := range ops {
+				if !watchMatches(n, req, op) {
+					continue
+				}
+				event := &pb.WatchEvent{
+					Type:        pb.WatchEvent_PUT,
+					Key:         n.userKey(op.Key),
+					Value:       textValue(op.Value),
+					Revision:    rec.Seq,
+					ValueBytes:  []byte(op.Value),
+					ContentType: op.ContentType,
+				}
+				if op.Op == walOpDelete {
+					event = &pb.WatchEvent{Type: pb.WatchEvent_DELETE, Key: n.userKey(op.Key), Revision: rec.Seq}
+				}
+				if err := stream.Send(event); err != nil {
+					return err
+				}
+			}
+		}
+		if len(events) > 0 {
+			continue
+		}
+
+		select {
+		case <-notify:
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case <-s.stop:
+			return status.Errorf(codes.Unavailable, "server is shutting down")
+		}
+	}
+}
+
+// checkRetained returns an OutOfRange error if mutations from rev onwards are
+// no longer all in the change feed. Callers must hold the lock.
+func (s *kvServer) checkRetained(rev uint64) error {
+	first := s.feed.first()
+	if first == 0 {
+		first = s.rev + 1
+	}
+	if rev < first {
+		return status.Errorf(codes.OutOfRange, "revision %d has been compacted; the oldest available revision is %d", rev, first)
+	}
+	return nil
+}
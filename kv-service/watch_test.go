@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/pranavmerugu/censys-take-home/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// fakeWatchStream forwards the events sent by Watch to a channel
+type fakeWatchStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	events chan *pb.WatchEvent
+}
+
+func (f *fakeWatchStream) Context() context.Context        { return f.ctx }
+func (f *fakeWatchStream) SendHeader(metadata.MD) error    { return nil }
+func (f *fakeWatchStream) Send(event *pb.WatchEvent) error { f.events <- event; return nil }
+
+// startWatch runs Watch in the background and returns its event channel and
+// final error channel. The watch ends when the test finishes.
+func startWatch(t *testing.T, server *kvServer, req *pb.WatchRequest) (chan *pb.WatchEvent, chan error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	stream := &fakeWatchStream{ctx: ctx, events: make(chan *pb.WatchEvent, 100)}
+	errc := make(chan error, 1)
+	go func() { errc <- server.Watch(req, stream) }()
+	return stream.events, errc
+}
+
+func nextEvent(t *testing.T, events chan *pb.WatchEvent) *pb.WatchEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for watch event")
+		return nil
+	}
+}
+
+func TestWatchKey(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+
+	events, _ := startWatch(t, server, &pb.WatchRequest{Key: "config", StartRevision: 1})
+
+	server.Set(ctx, &pb.SetRequest{Key: "other", Value: "ignored"})
+	setResp, _ := server.Set(ctx, &pb.SetRequest{Key: "config", Value: "v1"})
+	server.Delete(ctx, &pb.DeleteRequest{Key: "config"})
+
+	event := nextEvent(t, events)
+	if event.Type != pb.WatchEvent_PUT || event.Key != "config" || event.Value != "v1" || event.Revision != setResp.Version {
+		t.Errorf("first event = %v, want PUT config=v1 at revision %d", event, setResp.Version)
+	}
+	event = nextEvent(t, events)
+	if event.Type != pb.WatchEvent_DELETE || event.Key != "config" {
+		t.Errorf("second event = %v, want DELETE config", event)
+	}
+}
+
+func TestWatchPrefixFromRevision(t *testing.T) {
+	server := newTestServer(t)
+	ctx := context.Background()
+
+	first, _ := server.Set(ctx, &pb.SetRequest{Key: "app/a", Value: "1"})
+	server.Set(ctx, &pb.SetRequest{Key: "db/a", Value: "1"})
+	server.Set(ctx, &pb.SetRequest{Key: "app/b", Value: "2"})
+
+	// Resuming from an earlier revision replays the missed events in order
+	events, _ := startWatch(t, server, &pb.WatchRequest{Key: "app/", Prefix: true, StartRevision: first.Version})
+
+	if event := nextEvent(t, events); event.Key != "app/a" {
+		t.Errorf("first event key = %q, want app/a", event.Key)
+	}
+	if event := nextEvent(t, events); event.Key != "app/b" {
+		t.Errorf("second event key = %q, want app/b", event.Key)
+	}
+
+	server.Set(ctx, &pb.SetRequest{Key: "app/c", Value: "3"})
+	if event := nextEvent(t, events); event.Key != "app/c" {
+		t.Errorf("live event key = %q, want app/c", event.Key)
+	}
+}
+
+func TestWatchCompactedRevision(t *testing.T) {
+	server := newTestServer(t)
+	server.feed = newChangeFeed(2)
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		server.Set(ctx, &pb.SetRequest{Key: "key", Value: "v"})
+	}
+
+	_, errc := startWatch(t, server, &pb.WatchRequest{Key: "key", StartRevision: 1})
+	select {
+	case err := <-errc:
+		if status.Code(err) != codes.OutOfRange {
+			t.Errorf("Watch() error = %v, want OutOfRange", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Watch() did not fail for a compacted revision")
+	}
+}
+
+func TestWatchEndsOnShutdown(t *testing.T) {
+	server := newTestServer(t)
+
+	_, errc := startWatch(t, server, &pb.WatchRequest{Key: "key"})
+	time.Sleep(50 * time.Millisecond)
+	server.shutdown()
+
+	select {
+	case err := <-errc:
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("Watch() error = %v, want Unavailable", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Watch() did not end on shutdown")
+	}
+}
+
+func TestWatchResumesAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	opts := serverOptions{WAL: walOptions{Sync: syncAlways}}
+
+	server, err := openKVServer(dir, opts)
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	first, _ := server.Set(ctx, &pb.SetRequest{Key: "key", Value: "v1"})
+	server.Set(ctx, &pb.SetRequest{Key: "key", Value: "v2"})
+	server.Close()
+
+	server, err = openKVServer(dir, opts)
+	if err != nil {
+		t.Fatalf("openKVServer() error = %v", err)
+	}
+	defer server.Close()
+
+	// The change feed is rebuilt from the replayed WAL
+	events, _ := startWatch(t, server, &pb.WatchRequest{Key: "key", StartRevision: first.Version + 1})
+	if event := nextEvent(t, events); event.Value != "v2" {
+		t.Errorf("event value = %q, want v2", event.Value)
+	}
+}
+
+func TestChangeFeedRing(t *testing.T) {
+	f := newChangeFeed(3)
+	for seq := uint64(1); seq <= 5; seq++ {
+		f.append(walRecord{Op: walOpSet, Seq: seq})
+	}
+
+	if f.first() != 3 {
+		t.Errorf("first() = %d, want 3", f.first())
+	}
+	got := f.since(4, 10)
+	if len(got) != 2 || got[0].Seq != 4 || got[1].Seq != 5 {
+		t.Errorf("since(4) = %v, want revisions 4 and 5", got)
+	}
+	if got := f.since(6, 10); len(got) != 0 {
+		t.Errorf("since(6) = %v, want none", got)
+	}
+}
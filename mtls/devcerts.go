@@ -0,0 +1,156 @@
+package mtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// devValidity is how long development certificates last
+const devValidity = 365 * 24 * time.Hour
+
+// WriteDevCerts writes a development CA to ca.pem and ca-key.pem in dir,
+// reusing the one already there, and for each name a certificate signed by
+// it to name.pem and name-key.pem. The certificates are valid for the name,
+// localhost and the loopback addresses, as servers and clients alike. They
+// are meant for local runs and tests, not for production.
+func WriteDevCerts(dir string, names ...string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	ca, caKey, err := loadDevCA(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		ca, caKey, err = writeDevCA(dir)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		template, err := devTemplate(name)
+		if err != nil {
+			return err
+		}
+		template.DNSNames = []string{name, "localhost"}
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			return err
+		}
+		if err := writePEM(dir, name, der, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// devTemplate returns a certificate template for name with a random serial
+func devTemplate(name string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(devValidity),
+	}, nil
+}
+
+func writeDevCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := devTemplate("kvstore development CA")
+	if err != nil {
+		return nil, nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(dir, "ca", der, key); err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	return ca, key, err
+}
+
+func loadDevCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		return nil, nil, err
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, fmt.Errorf("%s: invalid CA files", dir)
+	}
+	ca, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: CA key is not an ECDSA key", dir)
+	}
+	return ca, ecKey, nil
+}
+
+// writePEM writes a certificate to name.pem and its key to name-key.pem,
+// replacing each file in one rename so a reloading service never reads half
+// of one
+func writePEM(dir, name string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	files := []struct {
+		path  string
+		block *pem.Block
+		mode  os.FileMode
+	}{
+		{filepath.Join(dir, name+"-key.pem"), &pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}, 0o600},
+		{filepath.Join(dir, name+".pem"), &pem.Block{Type: "CERTIFICATE", Bytes: der}, 0o644},
+	}
+	for _, f := range files {
+		tmp := f.path + ".tmp"
+		if err := os.WriteFile(tmp, pem.EncodeToMemory(f.block), f.mode); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, f.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
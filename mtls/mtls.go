@@ -0,0 +1,183 @@
+// Package mtls secures the gRPC connections between the services with mutual
+// TLS. Both sides present a certificate signed by a shared CA and check the
+// other's against it, and the certificate, key and CA files are reread while
+// the services run so they can be rotated without a restart.
+package mtls
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// DefaultReload is how often the files are checked for changes
+const DefaultReload = 30 * time.Second
+
+// Files names the PEM files a service's TLS is built from
+type Files struct {
+	// Cert is the service's certificate chain, presented to servers and
+	// clients alike
+	Cert string
+	// Key is the private key of Cert
+	Key string
+	// CA holds the certificates the other side's certificate must chain to
+	CA string
+}
+
+// Reloader holds the certificate and CA loaded from a set of files and
+// hands out credentials that always use the latest ones
+type Reloader struct {
+	files Files
+
+	mu   sync.RWMutex
+	raw  [3][]byte
+	cert *tls.Certificate
+	pool *x509.CertPool
+}
+
+// Load reads files, failing if any of them is missing or invalid
+func Load(files Files) (*Reloader, error) {
+	r := &Reloader{files: files}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// FromEnv loads the files named by KV_TLS_CERT, KV_TLS_KEY and KV_TLS_CA and
+// rereads them every KV_TLS_RELOAD (default 30s) until ctx is done. It
+// returns nil when none of them is set, and an error when only some are.
+func FromEnv(ctx context.Context) (*Reloader, error) {
+	files := Files{Cert: os.Getenv("KV_TLS_CERT"), Key: os.Getenv("KV_TLS_KEY"), CA: os.Getenv("KV_TLS_CA")}
+	if files == (Files{}) {
+		return nil, nil
+	}
+	if files.Cert == "" || files.Key == "" || files.CA == "" {
+		return nil, errors.New("KV_TLS_CERT, KV_TLS_KEY and KV_TLS_CA must be set together")
+	}
+	interval := DefaultReload
+	if v := os.Getenv("KV_TLS_RELOAD"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid KV_TLS_RELOAD %q", v)
+		}
+		interval = d
+	}
+	r, err := Load(files)
+	if err != nil {
+		return nil, err
+	}
+	go r.Watch(ctx, interval)
+	return r, nil
+}
+
+// Reload rereads the files and swaps in their contents if they changed. A
+// set of files that doesn't load, such as a certificate whose key hasn't
+// been written yet, leaves the previous one in place.
+func (r *Reloader) Reload() error {
+	var raw [3][]byte
+	for i, path := range []string{r.files.Cert, r.files.Key, r.files.CA} {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		raw[i] = b
+	}
+	r.mu.RLock()
+	unchanged := bytes.Equal(raw[0], r.raw[0]) && bytes.Equal(raw[1], r.raw[1]) && bytes.Equal(raw[2], r.raw[2])
+	r.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.X509KeyPair(raw[0], raw[1])
+	if err != nil {
+		return fmt.Errorf("%s: %w", r.files.Cert, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw[2]) {
+		return fmt.Errorf("%s: no certificates found", r.files.CA)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.raw, r.cert, r.pool = raw, &cert, pool
+	return nil
+}
+
+// Watch reloads the files every interval until ctx is done
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Reload(); err != nil {
+				log.Printf("Failed to reload TLS files: %v", err)
+			}
+		}
+	}
+}
+
+// ServerConfig returns a TLS config that presents the current certificate
+// and requires clients to present one signed by the current CA
+func (r *Reloader) ServerConfig() *tls.Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*r.cert},
+		ClientCAs:    r.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
+
+// ClientConfig returns a TLS config that presents the current certificate
+// and trusts servers whose certificate is signed by the current CA
+func (r *Reloader) ClientConfig() *tls.Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*r.cert},
+		RootCAs:      r.pool,
+	}
+}
+
+// Credentials returns gRPC transport credentials that build every handshake
+// from the files as they were last loaded, for clients and servers alike
+func (r *Reloader) Credentials() credentials.TransportCredentials {
+	return &reloadingCreds{r: r, TransportCredentials: credentials.NewTLS(nil)}
+}
+
+// reloadingCreds hands each handshake to fresh TLS credentials, since a
+// tls.Config can't swap its root CAs once it is in use. The embedded
+// credentials only answer Info.
+type reloadingCreds struct {
+	credentials.TransportCredentials
+	r *Reloader
+}
+
+func (c *reloadingCreds) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return credentials.NewTLS(c.r.ClientConfig()).ClientHandshake(ctx, authority, conn)
+}
+
+func (c *reloadingCreds) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return credentials.NewTLS(c.r.ServerConfig()).ServerHandshake(conn)
+}
+
+func (c *reloadingCreds) Clone() credentials.TransportCredentials {
+	return c.r.Credentials()
+}
@@ -0,0 +1,147 @@
+package mtls
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// install copies the certificate of name and the CA from a WriteDevCerts
+// directory into dir, as a service's files would be replaced on rotation
+func install(t *testing.T, from, name, dir string) Files {
+	t.Helper()
+	files := Files{Cert: filepath.Join(dir, "cert.pem"), Key: filepath.Join(dir, "key.pem"), CA: filepath.Join(dir, "ca.pem")}
+	for src, dst := range map[string]string{name + ".pem": files.Cert, name + "-key.pem": files.Key, "ca.pem": files.CA} {
+		b, err := os.ReadFile(filepath.Join(from, src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dst, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return files
+}
+
+// handshake runs a TLS handshake between a client and a server over a pipe
+func handshake(client, server *Reloader) error {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	clientConfig := client.ClientConfig()
+	clientConfig.ServerName = "server"
+	serverErr := make(chan error, 1)
+	go func() {
+		err := tls.Server(s, server.ServerConfig()).Handshake()
+		if err != nil {
+			s.Close()
+		}
+		serverErr <- err
+	}()
+	err := tls.Client(c, clientConfig).Handshake()
+	if err != nil {
+		c.Close()
+	}
+	if sErr := <-serverErr; err == nil {
+		err = sErr
+	}
+	return err
+}
+
+func TestReloadRotatesCertificates(t *testing.T) {
+	oldCA, newCA := t.TempDir(), t.TempDir()
+	if err := WriteDevCerts(oldCA, "server", "client"); err != nil {
+		t.Fatalf("WriteDevCerts() error = %v", err)
+	}
+	if err := WriteDevCerts(newCA, "server", "client"); err != nil {
+		t.Fatalf("WriteDevCerts() error = %v", err)
+	}
+	serverDir, clientDir := t.TempDir(), t.TempDir()
+	server, err := Load(install(t, oldCA, "server", serverDir))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	client, err := Load(install(t, oldCA, "client", clientDir))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if err := handshake(client, server); err != nil {
+		t.Fatalf("handshake() error = %v", err)
+	}
+
+	// New files only take effect once reloaded
+	install(t, newCA, "client", clientDir)
+	if err := handshake(client, server); err != nil {
+		t.Fatalf("handshake() before reload error = %v", err)
+	}
+	if err := client.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if err := handshake(client, server); err == nil {
+		t.Fatalf("Expected a handshake between different CAs to fail")
+	}
+	install(t, newCA, "server", serverDir)
+	if err := server.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if err := handshake(client, server); err != nil {
+		t.Errorf("handshake() after rotation error = %v", err)
+	}
+
+	// A half-written rotation keeps the last good files
+	os.WriteFile(filepath.Join(serverDir, "key.pem"), []byte("not a key"), 0o600)
+	if err := server.Reload(); err == nil {
+		t.Errorf("Expected Reload() of a broken key to fail")
+	}
+	if err := handshake(client, server); err != nil {
+		t.Errorf("handshake() after a failed reload error = %v", err)
+	}
+}
+
+func TestWriteDevCertsReusesCA(t *testing.T) {
+	dir := t.TempDir()
+	if err := WriteDevCerts(dir, "a"); err != nil {
+		t.Fatalf("WriteDevCerts() error = %v", err)
+	}
+	ca, _ := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err := WriteDevCerts(dir, "b"); err != nil {
+		t.Fatalf("WriteDevCerts() error = %v", err)
+	}
+	again, _ := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	if !bytes.Equal(ca, again) {
+		t.Errorf("Expected the CA to be reused")
+	}
+
+	a, _ := Load(install(t, dir, "a", t.TempDir()))
+	b, _ := Load(install(t, dir, "b", t.TempDir()))
+	if err := handshake(a, b); err == nil {
+		t.Errorf("Expected a certificate without the server name to be refused")
+	}
+	if err := WriteDevCerts(dir, "server"); err != nil {
+		t.Fatalf("WriteDevCerts() error = %v", err)
+	}
+	server, _ := Load(install(t, dir, "server", t.TempDir()))
+	if err := handshake(a, server); err != nil {
+		t.Errorf("handshake() between certificates of one CA error = %v", err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected the CA key to be private, got %v", info.Mode())
+	}
+}
+
+func TestFromEnvRequiresEveryFile(t *testing.T) {
+	if r, err := FromEnv(t.Context()); r != nil || err != nil {
+		t.Errorf("FromEnv() without settings = %v, %v, want nil, nil", r, err)
+	}
+	t.Setenv("KV_TLS_CERT", "cert.pem")
+	if _, err := FromEnv(t.Context()); err == nil {
+		t.Errorf("Expected FromEnv() to refuse a certificate without a key and CA")
+	}
+}
@@ -19,9 +19,22 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	KVStore_Set_FullMethodName    = "/kvstore.KVStore/Set"
-	KVStore_Get_FullMethodName    = "/kvstore.KVStore/Get"
-	KVStore_Delete_FullMethodName = "/kvstore.KVStore/Delete"
+	KVStore_Set_FullMethodName           = "/kvstore.KVStore/Set"
+	KVStore_Get_FullMethodName           = "/kvstore.KVStore/Get"
+	KVStore_Delete_FullMethodName        = "/kvstore.KVStore/Delete"
+	KVStore_GetTTL_FullMethodName        = "/kvstore.KVStore/GetTTL"
+	KVStore_Touch_FullMethodName         = "/kvstore.KVStore/Touch"
+	KVStore_CompareAndSet_FullMethodName = "/kvstore.KVStore/CompareAndSet"
+	KVStore_Scan_FullMethodName          = "/kvstore.KVStore/Scan"
+	KVStore_Watch_FullMethodName         = "/kvstore.KVStore/Watch"
+	KVStore_Txn_FullMethodName           = "/kvstore.KVStore/Txn"
+	KVStore_BatchGet_FullMethodName      = "/kvstore.KVStore/BatchGet"
+	KVStore_BatchSet_FullMethodName      = "/kvstore.KVStore/BatchSet"
+	KVStore_BatchDelete_FullMethodName   = "/kvstore.KVStore/BatchDelete"
+	KVStore_Upload_FullMethodName        = "/kvstore.KVStore/Upload"
+	KVStore_Download_FullMethodName      = "/kvstore.KVStore/Download"
+	KVStore_Export_FullMethodName        = "/kvstore.KVStore/Export"
+	KVStore_Import_FullMethodName        = "/kvstore.KVStore/Import"
 )
 
 // KVStoreClient is the client API for KVStore service.
@@ -31,6 +44,26 @@ type KVStoreClient interface {
 	Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*SetResponse, error)
 	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
 	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	GetTTL(ctx context.Context, in *GetTTLRequest, opts ...grpc.CallOption) (*GetTTLResponse, error)
+	Touch(ctx context.Context, in *TouchRequest, opts ...grpc.CallOption) (*TouchResponse, error)
+	CompareAndSet(ctx context.Context, in *CompareAndSetRequest, opts ...grpc.CallOption) (*CompareAndSetResponse, error)
+	Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ScanResponse], error)
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[WatchEvent], error)
+	Txn(ctx context.Context, in *TxnRequest, opts ...grpc.CallOption) (*TxnResponse, error)
+	BatchGet(ctx context.Context, in *BatchGetRequest, opts ...grpc.CallOption) (*BatchResponse, error)
+	BatchSet(ctx context.Context, in *BatchSetRequest, opts ...grpc.CallOption) (*BatchResponse, error)
+	BatchDelete(ctx context.Context, in *BatchDeleteRequest, opts ...grpc.CallOption) (*BatchResponse, error)
+	// Upload stores a value sent in chunks, for values too large for one message
+	Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadRequest, SetResponse], error)
+	// Download returns a value in chunks; a missing key fails with NOT_FOUND
+	Download(ctx context.Context, in *DownloadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DownloadChunk], error)
+	// Export streams keys as they are stored, the keys of named namespaces
+	// behind their prefix and the settings of namespaces included, for a
+	// rebalance to move. Expired keys are left out.
+	Export(ctx context.Context, in *ExportRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Mutation], error)
+	// Import applies the sets and deletes of stored keys that Export streams,
+	// atomically and with their versions
+	Import(ctx context.Context, in *ImportRequest, opts ...grpc.CallOption) (*ImportResponse, error)
 }
 
 type kVStoreClient struct {
@@ -71,6 +104,175 @@ func (c *kVStoreClient) Delete(ctx context.Context, in *DeleteRequest, opts ...g
 	return out, nil
 }
 
+func (c *kVStoreClient) GetTTL(ctx context.Context, in *GetTTLRequest, opts ...grpc.CallOption) (*GetTTLResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetTTLResponse)
+	err := c.cc.Invoke(ctx, KVStore_GetTTL_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVStoreClient) Touch(ctx context.Context, in *TouchRequest, opts ...grpc.CallOption) (*TouchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TouchResponse)
+	err := c.cc.Invoke(ctx, KVStore_Touch_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVStoreClient) CompareAndSet(ctx context.Context, in *CompareAndSetRequest, opts ...grpc.CallOption) (*CompareAndSetResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CompareAndSetResponse)
+	err := c.cc.Invoke(ctx, KVStore_CompareAndSet_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVStoreClient) Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ScanResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &KVStore_ServiceDesc.Streams[0], KVStore_Scan_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ScanRequest, ScanResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type KVStore_ScanClient = grpc.ServerStreamingClient[ScanResponse]
+
+func (c *kVStoreClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[WatchEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &KVStore_ServiceDesc.Streams[1], KVStore_Watch_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchRequest, WatchEvent]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type KVStore_WatchClient = grpc.ServerStreamingClient[WatchEvent]
+
+func (c *kVStoreClient) Txn(ctx context.Context, in *TxnRequest, opts ...grpc.CallOption) (*TxnResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(TxnResponse)
+	err := c.cc.Invoke(ctx, KVStore_Txn_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVStoreClient) BatchGet(ctx context.Context, in *BatchGetRequest, opts ...grpc.CallOption) (*BatchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BatchResponse)
+	err := c.cc.Invoke(ctx, KVStore_BatchGet_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVStoreClient) BatchSet(ctx context.Context, in *BatchSetRequest, opts ...grpc.CallOption) (*BatchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BatchResponse)
+	err := c.cc.Invoke(ctx, KVStore_BatchSet_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVStoreClient) BatchDelete(ctx context.Context, in *BatchDeleteRequest, opts ...grpc.CallOption) (*BatchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BatchResponse)
+	err := c.cc.Invoke(ctx, KVStore_BatchDelete_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVStoreClient) Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadRequest, SetResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &KVStore_ServiceDesc.Streams[2], KVStore_Upload_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[UploadRequest, SetResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type KVStore_UploadClient = grpc.ClientStreamingClient[UploadRequest, SetResponse]
+
+func (c *kVStoreClient) Download(ctx context.Context, in *DownloadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DownloadChunk], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &KVStore_ServiceDesc.Streams[3], KVStore_Download_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[DownloadRequest, DownloadChunk]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type KVStore_DownloadClient = grpc.ServerStreamingClient[DownloadChunk]
+
+func (c *kVStoreClient) Export(ctx context.Context, in *ExportRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Mutation], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &KVStore_ServiceDesc.Streams[4], KVStore_Export_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ExportRequest, Mutation]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type KVStore_ExportClient = grpc.ServerStreamingClient[Mutation]
+
+func (c *kVStoreClient) Import(ctx context.Context, in *ImportRequest, opts ...grpc.CallOption) (*ImportResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ImportResponse)
+	err := c.cc.Invoke(ctx, KVStore_Import_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // KVStoreServer is the server API for KVStore service.
 // All implementations must embed UnimplementedKVStoreServer
 // for forward compatibility.
@@ -78,6 +280,26 @@ type KVStoreServer interface {
 	Set(context.Context, *SetRequest) (*SetResponse, error)
 	Get(context.Context, *GetRequest) (*GetResponse, error)
 	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	GetTTL(context.Context, *GetTTLRequest) (*GetTTLResponse, error)
+	Touch(context.Context, *TouchRequest) (*TouchResponse, error)
+	CompareAndSet(context.Context, *CompareAndSetRequest) (*CompareAndSetResponse, error)
+	Scan(*ScanRequest, grpc.ServerStreamingServer[ScanResponse]) error
+	Watch(*WatchRequest, grpc.ServerStreamingServer[WatchEvent]) error
+	Txn(context.Context, *TxnRequest) (*TxnResponse, error)
+	BatchGet(context.Context, *BatchGetRequest) (*BatchResponse, error)
+	BatchSet(context.Context, *BatchSetRequest) (*BatchResponse, error)
+	BatchDelete(context.Context, *BatchDeleteRequest) (*BatchResponse, error)
+	// Upload stores a value sent in chunks, for values too large for one message
+	Upload(grpc.ClientStreamingServer[UploadRequest, SetResponse]) error
+	// Download returns a value in chunks; a missing key fails with NOT_FOUND
+	Download(*DownloadRequest, grpc.ServerStreamingServer[DownloadChunk]) error
+	// Export streams keys as they are stored, the keys of named namespaces
+	// behind their prefix and the settings of namespaces included, for a
+	// rebalance to move. Expired keys are left out.
+	Export(*ExportRequest, grpc.ServerStreamingServer[Mutation]) error
+	// Import applies the sets and deletes of stored keys that Export streams,
+	// atomically and with their versions
+	Import(context.Context, *ImportRequest) (*ImportResponse, error)
 	mustEmbedUnimplementedKVStoreServer()
 }
 
@@ -97,6 +319,45 @@ func (UnimplementedKVStoreServer) Get(context.Context, *GetRequest) (*GetRespons
 func (UnimplementedKVStoreServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
 }
+func (UnimplementedKVStoreServer) GetTTL(context.Context, *GetTTLRequest) (*GetTTLResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTTL not implemented")
+}
+func (UnimplementedKVStoreServer) Touch(context.Context, *TouchRequest) (*TouchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Touch not implemented")
+}
+func (UnimplementedKVStoreServer) CompareAndSet(context.Context, *CompareAndSetRequest) (*CompareAndSetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CompareAndSet not implemented")
+}
+func (UnimplementedKVStoreServer) Scan(*ScanRequest, grpc.ServerStreamingServer[ScanResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Scan not implemented")
+}
+func (UnimplementedKVStoreServer) Watch(*WatchRequest, grpc.ServerStreamingServer[WatchEvent]) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedKVStoreServer) Txn(context.Context, *TxnRequest) (*TxnResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Txn not implemented")
+}
+func (UnimplementedKVStoreServer) BatchGet(context.Context, *BatchGetRequest) (*BatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchGet not implemented")
+}
+func (UnimplementedKVStoreServer) BatchSet(context.Context, *BatchSetRequest) (*BatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchSet not implemented")
+}
+func (UnimplementedKVStoreServer) BatchDelete(context.Context, *BatchDeleteRequest) (*BatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchDelete not implemented")
+}
+func (UnimplementedKVStoreServer) Upload(grpc.ClientStreamingServer[UploadRequest, SetResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Upload not implemented")
+}
+func (UnimplementedKVStoreServer) Download(*DownloadRequest, grpc.ServerStreamingServer[DownloadChunk]) error {
+	return status.Errorf(codes.Unimplemented, "method Download not implemented")
+}
+func (UnimplementedKVStoreServer) Export(*ExportRequest, grpc.ServerStreamingServer[Mutation]) error {
+	return status.Errorf(codes.Unimplemented, "method Export not implemented")
+}
+func (UnimplementedKVStoreServer) Import(context.Context, *ImportRequest) (*ImportResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Import not implemented")
+}
 func (UnimplementedKVStoreServer) mustEmbedUnimplementedKVStoreServer() {}
 func (UnimplementedKVStoreServer) testEmbeddedByValue()                 {}
 
@@ -172,6 +433,201 @@ func _KVStore_Delete_Handler(srv interface{}, ctx context.Context, dec func(inte
 	return interceptor(ctx, in, info, handler)
 }
 
+func _KVStore_GetTTL_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetTTLRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVStoreServer).GetTTL(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVStore_GetTTL_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVStoreServer).GetTTL(ctx, req.(*GetTTLRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVStore_Touch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TouchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVStoreServer).Touch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVStore_Touch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVStoreServer).Touch(ctx, req.(*TouchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVStore_CompareAndSet_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CompareAndSetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVStoreServer).CompareAndSet(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVStore_CompareAndSet_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVStoreServer).CompareAndSet(ctx, req.(*CompareAndSetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVStore_Scan_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ScanRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(KVStoreServer).Scan(m, &grpc.GenericServerStream[ScanRequest, ScanResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type KVStore_ScanServer = grpc.ServerStreamingServer[ScanResponse]
+
+func _KVStore_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(KVStoreServer).Watch(m, &grpc.GenericServerStream[WatchRequest, WatchEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type KVStore_WatchServer = grpc.ServerStreamingServer[WatchEvent]
+
+func _KVStore_Txn_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TxnRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVStoreServer).Txn(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVStore_Txn_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVStoreServer).Txn(ctx, req.(*TxnRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVStore_BatchGet_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchGetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVStoreServer).BatchGet(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVStore_BatchGet_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVStoreServer).BatchGet(ctx, req.(*BatchGetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVStore_BatchSet_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchSetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVStoreServer).BatchSet(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVStore_BatchSet_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVStoreServer).BatchSet(ctx, req.(*BatchSetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVStore_BatchDelete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchDeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVStoreServer).BatchDelete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVStore_BatchDelete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVStoreServer).BatchDelete(ctx, req.(*BatchDeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVStore_Upload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(KVStoreServer).Upload(&grpc.GenericServerStream[UploadRequest, SetResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type KVStore_UploadServer = grpc.ClientStreamingServer[UploadRequest, SetResponse]
+
+func _KVStore_Download_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(DownloadRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(KVStoreServer).Download(m, &grpc.GenericServerStream[DownloadRequest, DownloadChunk]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type KVStore_DownloadServer = grpc.ServerStreamingServer[DownloadChunk]
+
+func _KVStore_Export_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ExportRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(KVStoreServer).Export(m, &grpc.GenericServerStream[ExportRequest, Mutation]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type KVStore_ExportServer = grpc.ServerStreamingServer[Mutation]
+
+func _KVStore_Import_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ImportRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVStoreServer).Import(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVStore_Import_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVStoreServer).Import(ctx, req.(*ImportRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // KVStore_ServiceDesc is the grpc.ServiceDesc for KVStore service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -191,6 +647,1006 @@ var KVStore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Delete",
 			Handler:    _KVStore_Delete_Handler,
 		},
+		{
+			MethodName: "GetTTL",
+			Handler:    _KVStore_GetTTL_Handler,
+		},
+		{
+			MethodName: "Touch",
+			Handler:    _KVStore_Touch_Handler,
+		},
+		{
+			MethodName: "CompareAndSet",
+			Handler:    _KVStore_CompareAndSet_Handler,
+		},
+		{
+			MethodName: "Txn",
+			Handler:    _KVStore_Txn_Handler,
+		},
+		{
+			MethodName: "BatchGet",
+			Handler:    _KVStore_BatchGet_Handler,
+		},
+		{
+			MethodName: "BatchSet",
+			Handler:    _KVStore_BatchSet_Handler,
+		},
+		{
+			MethodName: "BatchDelete",
+			Handler:    _KVStore_BatchDelete_Handler,
+		},
+		{
+			MethodName: "Import",
+			Handler:    _KVStore_Import_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Scan",
+			Handler:       _KVStore_Scan_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _KVStore_Watch_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Upload",
+			Handler:       _KVStore_Upload_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Download",
+			Handler:       _KVStore_Download_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Export",
+			Handler:       _KVStore_Export_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "proto/kvstore.proto",
+}
+
+const (
+	KVReplication_Replicate_FullMethodName = "/kvstore.KVReplication/Replicate"
+)
+
+// KVReplicationClient is the client API for KVReplication service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// KVReplication is served by a primary to its followers
+type KVReplicationClient interface {
+	// Replicate streams the primary's mutation log to a follower, which
+	// acknowledges the revisions it has applied on the same stream
+	Replicate(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[ReplicateRequest, ReplicateResponse], error)
+}
+
+type kVReplicationClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewKVReplicationClient(cc grpc.ClientConnInterface) KVReplicationClient {
+	return &kVReplicationClient{cc}
+}
+
+func (c *kVReplicationClient) Replicate(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[ReplicateRequest, ReplicateResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &KVReplication_ServiceDesc.Streams[0], KVReplication_Replicate_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ReplicateRequest, ReplicateResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type KVReplication_ReplicateClient = grpc.BidiStreamingClient[ReplicateRequest, ReplicateResponse]
+
+// KVReplicationServer is the server API for KVReplication service.
+// All implementations must embed UnimplementedKVReplicationServer
+// for forward compatibility.
+//
+// KVReplication is served by a primary to its followers
+type KVReplicationServer interface {
+	// Replicate streams the primary's mutation log to a follower, which
+	// acknowledges the revisions it has applied on the same stream
+	Replicate(grpc.BidiStreamingServer[ReplicateRequest, ReplicateResponse]) error
+	mustEmbedUnimplementedKVReplicationServer()
+}
+
+// UnimplementedKVReplicationServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedKVReplicationServer struct{}
+
+func (UnimplementedKVReplicationServer) Replicate(grpc.BidiStreamingServer[ReplicateRequest, ReplicateResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Replicate not implemented")
+}
+func (UnimplementedKVReplicationServer) mustEmbedUnimplementedKVReplicationServer() {}
+func (UnimplementedKVReplicationServer) testEmbeddedByValue()                       {}
+
+// UnsafeKVReplicationServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to KVReplicationServer will
+// result in compilation errors.
+type UnsafeKVReplicationServer interface {
+	mustEmbedUnimplementedKVReplicationServer()
+}
+
+func RegisterKVReplicationServer(s grpc.ServiceRegistrar, srv KVReplicationServer) {
+	// If the following call pancis, it indicates UnimplementedKVReplicationServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&KVReplication_ServiceDesc, srv)
+}
+
+func _KVReplication_Replicate_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(KVReplicationServer).Replicate(&grpc.GenericServerStream[ReplicateRequest, ReplicateResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type KVReplication_ReplicateServer = grpc.BidiStreamingServer[ReplicateRequest, ReplicateResponse]
+
+// KVReplication_ServiceDesc is the grpc.ServiceDesc for KVReplication service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var KVReplication_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "kvstore.KVReplication",
+	HandlerType: (*KVReplicationServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Replicate",
+			Handler:       _KVReplication_Replicate_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "proto/kvstore.proto",
+}
+
+const (
+	KVRaft_RequestVote_FullMethodName     = "/kvstore.KVRaft/RequestVote"
+	KVRaft_AppendEntries_FullMethodName   = "/kvstore.KVRaft/AppendEntries"
+	KVRaft_InstallSnapshot_FullMethodName = "/kvstore.KVRaft/InstallSnapshot"
+)
+
+// KVRaftClient is the client API for KVRaft service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// KVRaft carries the Raft protocol between the nodes of a cluster
+type KVRaftClient interface {
+	RequestVote(ctx context.Context, in *VoteRequest, opts ...grpc.CallOption) (*VoteResponse, error)
+	AppendEntries(ctx context.Context, in *AppendEntriesRequest, opts ...grpc.CallOption) (*AppendEntriesResponse, error)
+	// InstallSnapshot sends a copy of the leader's store to a follower whose
+	// log is behind the leader's compacted log, as a run of chunks
+	InstallSnapshot(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[InstallSnapshotRequest, InstallSnapshotResponse], error)
+}
+
+type kVRaftClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewKVRaftClient(cc grpc.ClientConnInterface) KVRaftClient {
+	return &kVRaftClient{cc}
+}
+
+func (c *kVRaftClient) RequestVote(ctx context.Context, in *VoteRequest, opts ...grpc.CallOption) (*VoteResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(VoteResponse)
+	err := c.cc.Invoke(ctx, KVRaft_RequestVote_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVRaftClient) AppendEntries(ctx context.Context, in *AppendEntriesRequest, opts ...grpc.CallOption) (*AppendEntriesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AppendEntriesResponse)
+	err := c.cc.Invoke(ctx, KVRaft_AppendEntries_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVRaftClient) InstallSnapshot(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[InstallSnapshotRequest, InstallSnapshotResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &KVRaft_ServiceDesc.Streams[0], KVRaft_InstallSnapshot_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[InstallSnapshotRequest, InstallSnapshotResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type KVRaft_InstallSnapshotClient = grpc.ClientStreamingClient[InstallSnapshotRequest, InstallSnapshotResponse]
+
+// KVRaftServer is the server API for KVRaft service.
+// All implementations must embed UnimplementedKVRaftServer
+// for forward compatibility.
+//
+// KVRaft carries the Raft protocol between the nodes of a cluster
+type KVRaftServer interface {
+	RequestVote(context.Context, *VoteRequest) (*VoteResponse, error)
+	AppendEntries(context.Context, *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	// InstallSnapshot sends a copy of the leader's store to a follower whose
+	// log is behind the leader's compacted log, as a run of chunks
+	InstallSnapshot(grpc.ClientStreamingServer[InstallSnapshotRequest, InstallSnapshotResponse]) error
+	mustEmbedUnimplementedKVRaftServer()
+}
+
+// UnimplementedKVRaftServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedKVRaftServer struct{}
+
+func (UnimplementedKVRaftServer) RequestVote(context.Context, *VoteRequest) (*VoteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RequestVote not implemented")
+}
+func (UnimplementedKVRaftServer) AppendEntries(context.Context, *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AppendEntries not implemented")
+}
+func (UnimplementedKVRaftServer) InstallSnapshot(grpc.ClientStreamingServer[InstallSnapshotRequest, InstallSnapshotResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method InstallSnapshot not implemented")
+}
+func (UnimplementedKVRaftServer) mustEmbedUnimplementedKVRaftServer() {}
+func (UnimplementedKVRaftServer) testEmbeddedByValue()                {}
+
+// UnsafeKVRaftServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to KVRaftServer will
+// result in compilation errors.
+type UnsafeKVRaftServer interface {
+	mustEmbedUnimplementedKVRaftServer()
+}
+
+func RegisterKVRaftServer(s grpc.ServiceRegistrar, srv KVRaftServer) {
+	// If the following call pancis, it indicates UnimplementedKVRaftServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&KVRaft_ServiceDesc, srv)
+}
+
+func _KVRaft_RequestVote_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(VoteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVRaftServer).RequestVote(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVRaft_RequestVote_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVRaftServer).RequestVote(ctx, req.(*VoteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVRaft_AppendEntries_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AppendEntriesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVRaftServer).AppendEntries(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVRaft_AppendEntries_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVRaftServer).AppendEntries(ctx, req.(*AppendEntriesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVRaft_InstallSnapshot_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(KVRaftServer).InstallSnapshot(&grpc.GenericServerStream[InstallSnapshotRequest, InstallSnapshotResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type KVRaft_InstallSnapshotServer = grpc.ClientStreamingServer[InstallSnapshotRequest, InstallSnapshotResponse]
+
+// KVRaft_ServiceDesc is the grpc.ServiceDesc for KVRaft service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var KVRaft_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "kvstore.KVRaft",
+	HandlerType: (*KVRaftServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "RequestVote",
+			Handler:    _KVRaft_RequestVote_Handler,
+		},
+		{
+			MethodName: "AppendEntries",
+			Handler:    _KVRaft_AppendEntries_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "InstallSnapshot",
+			Handler:       _KVRaft_InstallSnapshot_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "proto/kvstore.proto",
+}
+
+const (
+	KVAdmin_ReplicationStatus_FullMethodName   = "/kvstore.KVAdmin/ReplicationStatus"
+	KVAdmin_AddMember_FullMethodName           = "/kvstore.KVAdmin/AddMember"
+	KVAdmin_RemoveMember_FullMethodName        = "/kvstore.KVAdmin/RemoveMember"
+	KVAdmin_ClusterStatus_FullMethodName       = "/kvstore.KVAdmin/ClusterStatus"
+	KVAdmin_Stats_FullMethodName               = "/kvstore.KVAdmin/Stats"
+	KVAdmin_CreateNamespace_FullMethodName     = "/kvstore.KVAdmin/CreateNamespace"
+	KVAdmin_ListNamespaces_FullMethodName      = "/kvstore.KVAdmin/ListNamespaces"
+	KVAdmin_DropNamespace_FullMethodName       = "/kvstore.KVAdmin/DropNamespace"
+	KVAdmin_QueryAudit_FullMethodName          = "/kvstore.KVAdmin/QueryAudit"
+	KVAdmin_RotateEncryptionKey_FullMethodName = "/kvstore.KVAdmin/RotateEncryptionKey"
+)
+
+// KVAdminClient is the client API for KVAdmin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// KVAdmin exposes operational state of a node
+type KVAdminClient interface {
+	ReplicationStatus(ctx context.Context, in *ReplicationStatusRequest, opts ...grpc.CallOption) (*ReplicationStatusResponse, error)
+	// AddMember and RemoveMember change the voting members of a cluster one
+	// node at a time. They must be sent to the leader.
+	AddMember(ctx context.Context, in *AddMemberRequest, opts ...grpc.CallOption) (*MembershipResponse, error)
+	RemoveMember(ctx context.Context, in *RemoveMemberRequest, opts ...grpc.CallOption) (*MembershipResponse, error)
+	ClusterStatus(ctx context.Context, in *ClusterStatusRequest, opts ...grpc.CallOption) (*ClusterStatusResponse, error)
+	// Stats reports the size of the store, its memory limit and how many keys
+	// have been evicted to stay within it
+	Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error)
+	// CreateNamespace adds a namespace with its own keyspace, quotas and
+	// settings. ListNamespaces reports every namespace and its usage, and
+	// DropNamespace deletes a namespace along with all of its keys.
+	CreateNamespace(ctx context.Context, in *CreateNamespaceRequest, opts ...grpc.CallOption) (*Namespace, error)
+	ListNamespaces(ctx context.Context, in *ListNamespacesRequest, opts ...grpc.CallOption) (*ListNamespacesResponse, error)
+	DropNamespace(ctx context.Context, in *DropNamespaceRequest, opts ...grpc.CallOption) (*DropNamespaceResponse, error)
+	// QueryAudit returns the writes this node recorded in its audit log, oldest
+	// first, filtered by key, namespace, caller and time
+	QueryAudit(ctx context.Context, in *QueryAuditRequest, opts ...grpc.CallOption) (*QueryAuditResponse, error)
+	// RotateEncryptionKey rereads the master key file, rewraps the data keys
+	// if it gained a newer master key and switches writes to a new data key.
+	// Files sealed with the older keys are re-encrypted in the background.
+	RotateEncryptionKey(ctx context.Context, in *RotateEncryptionKeyRequest, opts ...grpc.CallOption) (*RotateEncryptionKeyResponse, error)
+}
+
+type kVAdminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewKVAdminClient(cc grpc.ClientConnInterface) KVAdminClient {
+	return &kVAdminClient{cc}
+}
+
+func (c *kVAdminClient) ReplicationStatus(ctx context.Context, in *ReplicationStatusRequest, opts ...grpc.CallOption) (*ReplicationStatusResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ReplicationStatusResponse)
+	err := c.cc.Invoke(ctx, KVAdmin_ReplicationStatus_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVAdminClient) AddMember(ctx context.Context, in *AddMemberRequest, opts ...grpc.CallOption) (*MembershipResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MembershipResponse)
+	err := c.cc.Invoke(ctx, KVAdmin_AddMember_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVAdminClient) RemoveMember(ctx context.Context, in *RemoveMemberRequest, opts ...grpc.CallOption) (*MembershipResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MembershipResponse)
+	err := c.cc.Invoke(ctx, KVAdmin_RemoveMember_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVAdminClient) ClusterStatus(ctx context.Context, in *ClusterStatusRequest, opts ...grpc.CallOption) (*ClusterStatusResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ClusterStatusResponse)
+	err := c.cc.Invoke(ctx, KVAdmin_ClusterStatus_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVAdminClient) Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(StatsResponse)
+	err := c.cc.Invoke(ctx, KVAdmin_Stats_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVAdminClient) CreateNamespace(ctx context.Context, in *CreateNamespaceRequest, opts ...grpc.CallOption) (*Namespace, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Namespace)
+	err := c.cc.Invoke(ctx, KVAdmin_CreateNamespace_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVAdminClient) ListNamespaces(ctx context.Context, in *ListNamespacesRequest, opts ...grpc.CallOption) (*ListNamespacesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListNamespacesResponse)
+	err := c.cc.Invoke(ctx, KVAdmin_ListNamespaces_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVAdminClient) DropNamespace(ctx context.Context, in *DropNamespaceRequest, opts ...grpc.CallOption) (*DropNamespaceResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DropNamespaceResponse)
+	err := c.cc.Invoke(ctx, KVAdmin_DropNamespace_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVAdminClient) QueryAudit(ctx context.Context, in *QueryAuditRequest, opts ...grpc.CallOption) (*QueryAuditResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(QueryAuditResponse)
+	err := c.cc.Invoke(ctx, KVAdmin_QueryAudit_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kVAdminClient) RotateEncryptionKey(ctx context.Context, in *RotateEncryptionKeyRequest, opts ...grpc.CallOption) (*RotateEncryptionKeyResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RotateEncryptionKeyResponse)
+	err := c.cc.Invoke(ctx, KVAdmin_RotateEncryptionKey_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// KVAdminServer is the server API for KVAdmin service.
+// All implementations must embed UnimplementedKVAdminServer
+// for forward compatibility.
+//
+// KVAdmin exposes operational state of a node
+type KVAdminServer interface {
+	ReplicationStatus(context.Context, *ReplicationStatusRequest) (*ReplicationStatusResponse, error)
+	// AddMember and RemoveMember change the voting members of a cluster one
+	// node at a time. They must be sent to the leader.
+	AddMember(context.Context, *AddMemberRequest) (*MembershipResponse, error)
+	RemoveMember(context.Context, *RemoveMemberRequest) (*MembershipResponse, error)
+	ClusterStatus(context.Context, *ClusterStatusRequest) (*ClusterStatusResponse, error)
+	// Stats reports the size of the store, its memory limit and how many keys
+	// have been evicted to stay within it
+	Stats(context.Context, *StatsRequest) (*StatsResponse, error)
+	// CreateNamespace adds a namespace with its own keyspace, quotas and
+	// settings. ListNamespaces reports every namespace and its usage, and
+	// DropNamespace deletes a namespace along with all of its keys.
+	CreateNamespace(context.Context, *CreateNamespaceRequest) (*Namespace, error)
+	ListNamespaces(context.Context, *ListNamespacesRequest) (*ListNamespacesResponse, error)
+	DropNamespace(context.Context, *DropNamespaceRequest) (*DropNamespaceResponse, error)
+	// QueryAudit returns the writes this node recorded in its audit log, oldest
+	// first, filtered by key, namespace, caller and time
+	QueryAudit(context.Context, *QueryAuditRequest) (*QueryAuditResponse, error)
+	// RotateEncryptionKey rereads the master key file, rewraps the data keys
+	// if it gained a newer master key and switches writes to a new data key.
+	// Files sealed with the older keys are re-encrypted in the background.
+	RotateEncryptionKey(context.Context, *RotateEncryptionKeyRequest) (*RotateEncryptionKeyResponse, error)
+	mustEmbedUnimplementedKVAdminServer()
+}
+
+// UnimplementedKVAdminServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedKVAdminServer struct{}
+
+func (UnimplementedKVAdminServer) ReplicationStatus(context.Context, *ReplicationStatusRequest) (*ReplicationStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReplicationStatus not implemented")
+}
+func (UnimplementedKVAdminServer) AddMember(context.Context, *AddMemberRequest) (*MembershipResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddMember not implemented")
+}
+func (UnimplementedKVAdminServer) RemoveMember(context.Context, *RemoveMemberRequest) (*MembershipResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveMember not implemented")
+}
+func (UnimplementedKVAdminServer) ClusterStatus(context.Context, *ClusterStatusRequest) (*ClusterStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ClusterStatus not implemented")
+}
+func (UnimplementedKVAdminServer) Stats(context.Context, *StatsRequest) (*StatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stats not implemented")
+}
+func (UnimplementedKVAdminServer) CreateNamespace(context.Context, *CreateNamespaceRequest) (*Namespace, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateNamespace not implemented")
+}
+func (UnimplementedKVAdminServer) ListNamespaces(context.Context, *ListNamespacesRequest) (*ListNamespacesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListNamespaces not implemented")
+}
+func (UnimplementedKVAdminServer) DropNamespace(context.Context, *DropNamespaceRequest) (*DropNamespaceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DropNamespace not implemented")
+}
+func (UnimplementedKVAdminServer) QueryAudit(context.Context, *QueryAuditRequest) (*QueryAuditResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QueryAudit not implemented")
+}
+func (UnimplementedKVAdminServer) RotateEncryptionKey(context.Context, *RotateEncryptionKeyRequest) (*RotateEncryptionKeyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RotateEncryptionKey not implemented")
+}
+func (UnimplementedKVAdminServer) mustEmbedUnimplementedKVAdminServer() {}
+func (UnimplementedKVAdminServer) testEmbeddedByValue()                 {}
+
+// UnsafeKVAdminServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to KVAdminServer will
+// result in compilation errors.
+type UnsafeKVAdminServer interface {
+	mustEmbedUnimplementedKVAdminServer()
+}
+
+func RegisterKVAdminServer(s grpc.ServiceRegistrar, srv KVAdminServer) {
+	// If the following call pancis, it indicates UnimplementedKVAdminServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&KVAdmin_ServiceDesc, srv)
+}
+
+func _KVAdmin_ReplicationStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReplicationStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVAdminServer).ReplicationStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVAdmin_ReplicationStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVAdminServer).ReplicationStatus(ctx, req.(*ReplicationStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVAdmin_AddMember_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddMemberRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVAdminServer).AddMember(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVAdmin_AddMember_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVAdminServer).AddMember(ctx, req.(*AddMemberRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVAdmin_RemoveMember_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveMemberRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVAdminServer).RemoveMember(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVAdmin_RemoveMember_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVAdminServer).RemoveMember(ctx, req.(*RemoveMemberRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVAdmin_ClusterStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClusterStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVAdminServer).ClusterStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVAdmin_ClusterStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVAdminServer).ClusterStatus(ctx, req.(*ClusterStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVAdmin_Stats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVAdminServer).Stats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVAdmin_Stats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVAdminServer).Stats(ctx, req.(*StatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVAdmin_CreateNamespace_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateNamespaceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVAdminServer).CreateNamespace(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVAdmin_CreateNamespace_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVAdminServer).CreateNamespace(ctx, req.(*CreateNamespaceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVAdmin_ListNamespaces_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListNamespacesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVAdminServer).ListNamespaces(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVAdmin_ListNamespaces_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVAdminServer).ListNamespaces(ctx, req.(*ListNamespacesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVAdmin_DropNamespace_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DropNamespaceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVAdminServer).DropNamespace(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVAdmin_DropNamespace_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVAdminServer).DropNamespace(ctx, req.(*DropNamespaceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVAdmin_QueryAudit_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueryAuditRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVAdminServer).QueryAudit(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVAdmin_QueryAudit_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVAdminServer).QueryAudit(ctx, req.(*QueryAuditRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KVAdmin_RotateEncryptionKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RotateEncryptionKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KVAdminServer).RotateEncryptionKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KVAdmin_RotateEncryptionKey_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KVAdminServer).RotateEncryptionKey(ctx, req.(*RotateEncryptionKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// KVAdmin_ServiceDesc is the grpc.ServiceDesc for KVAdmin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var KVAdmin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "kvstore.KVAdmin",
+	HandlerType: (*KVAdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ReplicationStatus",
+			Handler:    _KVAdmin_ReplicationStatus_Handler,
+		},
+		{
+			MethodName: "AddMember",
+			Handler:    _KVAdmin_AddMember_Handler,
+		},
+		{
+			MethodName: "RemoveMember",
+			Handler:    _KVAdmin_RemoveMember_Handler,
+		},
+		{
+			MethodName: "ClusterStatus",
+			Handler:    _KVAdmin_ClusterStatus_Handler,
+		},
+		{
+			MethodName: "Stats",
+			Handler:    _KVAdmin_Stats_Handler,
+		},
+		{
+			MethodName: "CreateNamespace",
+			Handler:    _KVAdmin_CreateNamespace_Handler,
+		},
+		{
+			MethodName: "ListNamespaces",
+			Handler:    _KVAdmin_ListNamespaces_Handler,
+		},
+		{
+			MethodName: "DropNamespace",
+			Handler:    _KVAdmin_DropNamespace_Handler,
+		},
+		{
+			MethodName: "QueryAudit",
+			Handler:    _KVAdmin_QueryAudit_Handler,
+		},
+		{
+			MethodName: "RotateEncryptionKey",
+			Handler:    _KVAdmin_RotateEncryptionKey_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "proto/kvstore.proto",
+}
+
+const (
+	ShardAdmin_AddShard_FullMethodName        = "/kvstore.ShardAdmin/AddShard"
+	ShardAdmin_RemoveShard_FullMethodName     = "/kvstore.ShardAdmin/RemoveShard"
+	ShardAdmin_RebalanceStatus_FullMethodName = "/kvstore.ShardAdmin/RebalanceStatus"
+)
+
+// ShardAdminClient is the client API for ShardAdmin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// ShardAdmin is served by the REST gateway when it routes keys over shards.
+// AddShard and RemoveShard start a rebalance that moves the affected key
+// ranges in the background; only one rebalance runs at a time.
+type ShardAdminClient interface {
+	AddShard(ctx context.Context, in *AddShardRequest, opts ...grpc.CallOption) (*RebalanceStatusResponse, error)
+	RemoveShard(ctx context.Context, in *RemoveShardRequest, opts ...grpc.CallOption) (*RebalanceStatusResponse, error)
+	RebalanceStatus(ctx context.Context, in *RebalanceStatusRequest, opts ...grpc.CallOption) (*RebalanceStatusResponse, error)
+}
+
+type shardAdminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewShardAdminClient(cc grpc.ClientConnInterface) ShardAdminClient {
+	return &shardAdminClient{cc}
+}
+
+func (c *shardAdminClient) AddShard(ctx context.Context, in *AddShardRequest, opts ...grpc.CallOption) (*RebalanceStatusResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RebalanceStatusResponse)
+	err := c.cc.Invoke(ctx, ShardAdmin_AddShard_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shardAdminClient) RemoveShard(ctx context.Context, in *RemoveShardRequest, opts ...grpc.CallOption) (*RebalanceStatusResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RebalanceStatusResponse)
+	err := c.cc.Invoke(ctx, ShardAdmin_RemoveShard_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *shardAdminClient) RebalanceStatus(ctx context.Context, in *RebalanceStatusRequest, opts ...grpc.CallOption) (*RebalanceStatusResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RebalanceStatusResponse)
+	err := c.cc.Invoke(ctx, ShardAdmin_RebalanceStatus_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ShardAdminServer is the server API for ShardAdmin service.
+// All implementations must embed UnimplementedShardAdminServer
+// for forward compatibility.
+//
+// ShardAdmin is served by the REST gateway when it routes keys over shards.
+// AddShard and RemoveShard start a rebalance that moves the affected key
+// ranges in the background; only one rebalance runs at a time.
+type ShardAdminServer interface {
+	AddShard(context.Context, *AddShardRequest) (*RebalanceStatusResponse, error)
+	RemoveShard(context.Context, *RemoveShardRequest) (*RebalanceStatusResponse, error)
+	RebalanceStatus(context.Context, *RebalanceStatusRequest) (*RebalanceStatusResponse, error)
+	mustEmbedUnimplementedShardAdminServer()
+}
+
+// UnimplementedShardAdminServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedShardAdminServer struct{}
+
+func (UnimplementedShardAdminServer) AddShard(context.Context, *AddShardRequest) (*RebalanceStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddShard not implemented")
+}
+func (UnimplementedShardAdminServer) RemoveShard(context.Context, *RemoveShardRequest) (*RebalanceStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveShard not implemented")
+}
+func (UnimplementedShardAdminServer) RebalanceStatus(context.Context, *RebalanceStatusRequest) (*RebalanceStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RebalanceStatus not implemented")
+}
+func (UnimplementedShardAdminServer) mustEmbedUnimplementedShardAdminServer() {}
+func (UnimplementedShardAdminServer) testEmbeddedByValue()                    {}
+
+// UnsafeShardAdminServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ShardAdminServer will
+// result in compilation errors.
+type UnsafeShardAdminServer interface {
+	mustEmbedUnimplementedShardAdminServer()
+}
+
+func RegisterShardAdminServer(s grpc.ServiceRegistrar, srv ShardAdminServer) {
+	// If the following call pancis, it indicates UnimplementedShardAdminServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&ShardAdmin_ServiceDesc, srv)
+}
+
+func _ShardAdmin_AddShard_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddShardRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShardAdminServer).AddShard(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ShardAdmin_AddShard_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShardAdminServer).AddShard(ctx, req.(*AddShardRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ShardAdmin_RemoveShard_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveShardRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShardAdminServer).RemoveShard(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ShardAdmin_RemoveShard_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShardAdminServer).RemoveShard(ctx, req.(*RemoveShardRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ShardAdmin_RebalanceStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RebalanceStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ShardAdminServer).RebalanceStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ShardAdmin_RebalanceStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ShardAdminServer).RebalanceStatus(ctx, req.(*RebalanceStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ShardAdmin_ServiceDesc is the grpc.ServiceDesc for ShardAdmin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ShardAdmin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "kvstore.ShardAdmin",
+	HandlerType: (*ShardAdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "AddShard",
+			Handler:    _ShardAdmin_AddShard_Handler,
+		},
+		{
+			MethodName: "RemoveShard",
+			Handler:    _ShardAdmin_RemoveShard_Handler,
+		},
+		{
+			MethodName: "RebalanceStatus",
+			Handler:    _ShardAdmin_RebalanceStatus_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "proto/kvstore.proto",
@@ -352,7 +352,10 @@ func TestIntegrationSetGetDelete(t *testing.T) {
 	}
 
 	// Verify deletion
-	getResp2, _ := http.Get(baseURL + "/kv/test-key")
+	getResp2, err := http.Get(baseURL + "/kv/test-key")
+	if err != nil {
+		t.Fatalf("Failed to send Get request: %v", err)
+	}
 	defer getResp2.Body.Close()
 
 	if getResp2.StatusCode != http.StatusNotFound {